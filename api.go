@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiTokenFile   = "api.token"
+	apiMaxBodySize = 2 * maxLongTextBytes // Maximum request body size in bytes: the longest text, with room for escapes
+	apiMaxWait     = 60 * time.Second     // Longest a /messages request may block
+)
+
+// APIServer exposes a local HTTP control API for scripting
+type APIServer struct {
+	node     *EnhancedNode
+	server   *http.Server
+	listener net.Listener
+	token    string // Empty when access is controlled by socket file permissions
+}
+
+// apiPeer describes a connected peer in API responses
+type apiPeer struct {
+	ID          string     `json:"id"`
+	NodeID      string     `json:"node_id"`
+	Nick        string     `json:"nick,omitempty"`
+	HasKey      bool       `json:"has_key"`
+	Key         string     `json:"key"` // "none", "exchanged" or "verified"
+	Status      string     `json:"status"`
+	Text        string     `json:"status_text,omitempty"`
+	Muted       bool       `json:"muted,omitempty"`
+	LatencyMS   float64    `json:"latency_ms,omitempty"` // Last measured round trip
+	LastActive  *time.Time `json:"last_active,omitempty"`
+	BytesIn     uint64     `json:"bytes_in"`
+	BytesOut    uint64     `json:"bytes_out"`
+	Version     string     `json:"version,omitempty"`     // The build it announced, as /whois shows it
+	Fingerprint string     `json:"fingerprint,omitempty"` // Of the key held for it
+}
+
+// apiMessageRequest is the body of POST /message
+type apiMessageRequest struct {
+	Peer string `json:"peer,omitempty"`
+	Text string `json:"text"`
+}
+
+// apiSendFileRequest is the body of POST /sendfile
+type apiSendFileRequest struct {
+	Peer string `json:"peer"`
+	Path string `json:"path"`
+}
+
+// apiConnectRequest is the body of POST /connect
+type apiConnectRequest struct {
+	Addr string `json:"addr"`
+}
+
+// apiInputRequest is the body of POST /input
+type apiInputRequest struct {
+	Input string `json:"input"`
+}
+
+// apiStats is the response of GET /stats
+type apiStats struct {
+	Messages      int64         `json:"messages"`
+	Duplicates    uint64        `json:"duplicates_suppressed"`
+	Locked        bool          `json:"locked"`
+	LockedRefused uint64        `json:"locked_refused"`    // Connections refused since the node was last locked
+	Crashes       uint64        `json:"handler_crashes"`   // Panics recovered while handling what peers sent
+	Webhook       *WebhookStats `json:"webhook,omitempty"` // Present when a webhook is configured
+}
+
+// apiInfo is the response of GET /info
+type apiInfo struct {
+	ID        string   `json:"id"`
+	Addresses []string `json:"addresses"` // Every address peers can dial, the ID first
+	Peers     int      `json:"peers"`
+	Profile   string   `json:"profile,omitempty"` // Set when the node runs with -profile
+	Locked    bool     `json:"locked"`            // Refusing new connections (/lock)
+}
+
+// NewAPIServer creates the control API, binds its listener, and writes a fresh access token to the data dir
+func NewAPIServer(node *EnhancedNode, listenAddr string) (*APIServer, error) {
+	token, err := generateAPIToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate API token: %w", err)
+	}
+
+	tokenPath := filepath.Join(node.dataDir, apiTokenFile)
+	if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write API token: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+	}
+
+	if host, _, err := net.SplitHostPort(listener.Addr().String()); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			log.Printf("Warning: control API is listening on non-loopback address %s", listener.Addr())
+		}
+	}
+
+	log.Printf("Control API listening on %s (token in %s)", listener.Addr(), tokenPath)
+	return newAPIServer(node, listener, token), nil
+}
+
+// NewControlSocketServer serves the control API on a unix socket; access is limited by the socket's file mode
+func NewControlSocketServer(node *EnhancedNode, socketPath string) (*APIServer, error) {
+	// Remove a stale socket left behind by an unclean exit
+	if info, err := os.Stat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+
+	log.Printf("Control socket listening on %s", socketPath)
+	return newAPIServer(node, listener, ""), nil
+}
+
+// newAPIServer builds the HTTP server around an already bound listener
+func newAPIServer(node *EnhancedNode, listener net.Listener, token string) *APIServer {
+	api := &APIServer{
+		node:     node,
+		listener: listener,
+		token:    token,
+	}
+
+	handler := api.routes()
+	if token != "" {
+		handler = api.authenticate(handler)
+	}
+	api.server = &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return api
+}
+
+// Start serves the API in the background until the node shuts down
+func (api *APIServer) Start() {
+	api.node.wg.Add(1)
+	go func() {
+		defer api.node.wg.Done()
+		if err := api.server.Serve(api.listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Control API error: %v", err)
+		}
+	}()
+
+	api.node.wg.Add(1)
+	go func() {
+		defer api.node.wg.Done()
+		<-api.node.Shutdown
+		api.server.Close()
+	}()
+}
+
+// routes builds the request multiplexer for all API endpoints
+func (api *APIServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", api.handleInfo)
+	mux.HandleFunc("/peers", api.handlePeers)
+	mux.HandleFunc("/messages", api.handleMessages)
+	mux.HandleFunc("/message", api.handleMessage)
+	mux.HandleFunc("/sendfile", api.handleSendFile)
+	mux.HandleFunc("/transfers", api.handleTransfers)
+	mux.HandleFunc("/playback", api.handlePlayback)
+	mux.HandleFunc("/traffic", api.handleTraffic)
+	mux.HandleFunc("/rooms", api.handleRooms)
+	mux.HandleFunc("/connect", api.handleConnect)
+	mux.HandleFunc("/input", api.handleInput)
+	mux.HandleFunc("/stats", api.handleStats)
+	mux.HandleFunc("/whois", api.handleWhois)
+	mux.HandleFunc("/read", api.handleRead)
+	mux.HandleFunc("/events", api.handleEvents)
+	return mux
+}
+
+// authenticate rejects requests that don't carry the API token
+func (api *APIServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleInfo serves GET /info
+func (api *APIServer) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	api.node.peersMutex.RLock()
+	peerCount := len(api.node.Peers)
+	api.node.peersMutex.RUnlock()
+
+	writeAPIJSON(w, http.StatusOK, apiInfo{ID: api.node.ID, Addresses: api.node.advertised, Peers: peerCount, Profile: api.node.profile, Locked: api.node.Locked()})
+}
+
+// handleStats serves GET /stats
+func (api *APIServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	stats := apiStats{
+		Messages:      api.node.messageLog.LastID(),
+		Duplicates:    api.node.seen.Duplicates(),
+		Locked:        api.node.Locked(),
+		LockedRefused: api.node.lockedRefused.Load(),
+		Crashes:       api.node.handlerPanics.Load(),
+	}
+	if api.node.webhook != nil {
+		webhookStats := api.node.webhook.Stats()
+		stats.Webhook = &webhookStats
+	}
+
+	writeAPIJSON(w, http.StatusOK, stats)
+}
+
+// handlePeers serves GET /peers
+func (api *APIServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	api.node.peersMutex.RLock()
+	connIDs := make([]string, 0, len(api.node.Peers))
+	for _, peer := range api.node.Peers {
+		connIDs = append(connIDs, peer.ID)
+	}
+	api.node.peersMutex.RUnlock()
+	sort.Strings(connIDs)
+
+	peers := make([]apiPeer, 0, len(connIDs))
+	for _, connID := range connIDs {
+		_, nodeID, err := api.node.resolvePeer(connID)
+		if err != nil {
+			// Disconnected while we were building the list
+			continue
+		}
+		info := api.node.PeerInfo(connID)
+		peer := apiPeer{
+			ID:          connID,
+			NodeID:      nodeID,
+			Nick:        info.Nick,
+			HasKey:      info.Key != KeyNone,
+			Key:         info.Key,
+			Status:      info.Presence.Status,
+			Text:        info.Presence.Text,
+			Muted:       info.Muted,
+			LatencyMS:   float64(info.Latency) / float64(time.Millisecond),
+			BytesIn:     info.BytesIn,
+			BytesOut:    info.BytesOut,
+			Fingerprint: info.Fingerprint,
+		}
+		if !info.LastActive.IsZero() {
+			peer.LastActive = &info.LastActive
+		}
+		if version, announced := api.node.peerVersion(connID); announced {
+			peer.Version = version.String()
+		}
+		peers = append(peers, peer)
+	}
+
+	writeAPIJSON(w, http.StatusOK, peers)
+}
+
+// handleMessages serves GET /messages?since=<id>[&wait=<seconds>]
+// With wait set, the request blocks until a newer message arrives or the wait expires.
+func (api *APIServer) handleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	var since int64
+	if value := r.URL.Query().Get("since"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			writeAPIError(w, http.StatusBadRequest, "since must be a non-negative message id")
+			return
+		}
+		since = parsed
+	}
+
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			writeAPIError(w, http.StatusBadRequest, "wait must be a non-negative number of seconds")
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+		if wait > apiMaxWait {
+			wait = apiMaxWait
+		}
+	}
+
+	// Grab the update channel before reading so an append in between isn't missed
+	updated := api.node.messageLog.Updated()
+	messages := api.node.messageLog.Since(since)
+	if len(messages) == 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-updated:
+			messages = api.node.messageLog.Since(since)
+		case <-timer.C:
+		case <-api.node.Shutdown:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	next := since
+	if len(messages) > 0 {
+		next = messages[len(messages)-1].ID
+	}
+
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"messages": messages,
+		"next":     next,
+	})
+}
+
+// handleMessage serves POST /message, broadcasting unless a peer is given
+func (api *APIServer) handleMessage(w http.ResponseWriter, r *http.Request) {
+	var req apiMessageRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if req.Text == "" {
+		writeAPIError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	if err := checkTextSize(req.Text); err != nil {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+
+	var sent Message
+	var err error
+	if req.Peer != "" {
+		sent, err = api.node.SendEncryptedTextTo(req.Peer, req.Text)
+	} else {
+		sent, err = api.node.SendEncryptedText(req.Text)
+	}
+	if !sentToAny(err) {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	api.node.notifyUI(sent)
+	var broadcast *BroadcastError
+	if errors.As(err, &broadcast) {
+		failed := make(map[string]string, len(broadcast.Failed))
+		for _, failure := range broadcast.Failed {
+			failed[failure.Peer] = failure.Err.Error()
+		}
+		writeAPIJSON(w, http.StatusOK, map[string]interface{}{"status": "partial", "failed": failed})
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+}
+
+// handleSendFile serves POST /sendfile
+func (api *APIServer) handleSendFile(w http.ResponseWriter, r *http.Request) {
+	var req apiSendFileRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if req.Peer == "" || req.Path == "" {
+		writeAPIError(w, http.StatusBadRequest, "peer and path are required")
+		return
+	}
+
+	if err := api.node.fileManager.SendFile(req.Peer, req.Path); err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeAPIJSON(w, http.StatusAccepted, map[string]string{"status": "requested"})
+}
+
+// handleTransfers serves GET /transfers
+func (api *APIServer) handleTransfers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, api.node.fileManager.ListTransfers())
+}
+
+// handlePlayback serves GET /playback
+func (api *APIServer) handlePlayback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, api.node.voiceManager.Playback())
+}
+
+// handleTraffic serves GET /traffic
+func (api *APIServer) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, api.node.Traffic())
+}
+
+// handleRooms serves GET /rooms
+func (api *APIServer) handleRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, api.node.Rooms())
+}
+
+// handleConnect serves POST /connect by queueing a /connect command
+func (api *APIServer) handleConnect(w http.ResponseWriter, r *http.Request) {
+	var req apiConnectRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if req.Addr == "" || strings.ContainsAny(req.Addr, " \n") {
+		writeAPIError(w, http.StatusBadRequest, "addr must be a single host:port")
+		return
+	}
+
+	if err := api.node.submitInput("/connect " + req.Addr); err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	writeAPIJSON(w, http.StatusAccepted, map[string]string{"status": "connecting"})
+}
+
+// handleInput serves POST /input, queueing input exactly as if typed at the CLI. Messages may span
+// several lines, as they can in the TUI.
+func (api *APIServer) handleInput(w http.ResponseWriter, r *http.Request) {
+	var req apiInputRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Input) == "" {
+		writeAPIError(w, http.StatusBadRequest, "input must not be empty")
+		return
+	}
+
+	if err := api.node.submitInput(req.Input); err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	writeAPIJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+}
+
+// decodeAPIRequest checks for POST and decodes a JSON body, writing an error response on failure
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// writeAPIJSON writes v as a JSON response
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+// writeAPIError writes a JSON error response
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, map[string]string{"error": message})
+}
+
+// generateAPIToken returns a random hex token
+func generateAPIToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startTestAPI serves node's control API on loopback until the test ends. As in main, it must be
+// called before the node starts.
+func startTestAPI(t *testing.T, node *EnhancedNode) *APIServer {
+	t.Helper()
+	api, err := NewAPIServer(node, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Start()
+	t.Cleanup(func() { api.server.Close() })
+	return api
+}
+
+// apiCall makes one request to the API with the given Authorization header, returning the status
+// and body
+func apiCall(t *testing.T, api *APIServer, method, path, authorization, body string) (int, string) {
+	t.Helper()
+	request, err := http.NewRequest(method, "http://"+api.listener.Addr().String()+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(data)
+}
+
+// TestAPIToken has the API refuse requests without the token in the data dir, only readable by us
+func TestAPIToken(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	node := tn.newNode()
+	api := startTestAPI(t, node)
+	tn.start(node)
+
+	tokenPath := filepath.Join(node.dataDir, apiTokenFile)
+	data, err := os.ReadFile(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token != api.token || len(token) != 64 {
+		t.Fatalf("token file holds %q, want the server's 64-digit token", token)
+	}
+	info, err := os.Stat(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("token file mode %o, want 600", mode)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer " + strings.Repeat("0", 64), http.StatusUnauthorized},
+		{"token prefix", "Bearer " + token[:32], http.StatusUnauthorized},
+		{"token and more", "Bearer " + token + "0", http.StatusUnauthorized},
+		{"other scheme", "Basic " + token, http.StatusUnauthorized},
+		{"token", "Bearer " + token, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body := apiCall(t, api, http.MethodGet, "/info", tc.authorization, "")
+			if status != tc.want {
+				t.Errorf("status %d (%s), want %d", status, strings.TrimSpace(body), tc.want)
+			}
+			if status == http.StatusUnauthorized && strings.Contains(body, node.ID) {
+				t.Errorf("refused request was answered with %s", body)
+			}
+		})
+	}
+
+	// Each run writes a new token, and the old one stops working
+	second, err := NewAPIServer(node, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.listener.Close()
+	if data, _ := os.ReadFile(tokenPath); second.token == token || strings.TrimSpace(string(data)) != second.token {
+		t.Error("a second API server didn't write a new token")
+	}
+	request := httptest.NewRequest(http.MethodGet, "/info", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	second.server.Handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("the previous token got status %d", recorder.Code)
+	}
+}
+
+// TestAPIRoutes calls every route on a node connected to one peer, with the methods and bodies
+// each takes and some it refuses
+func TestAPIRoutes(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	a := tn.newNode()
+	api := startTestAPI(t, a)
+	tn.start(a)
+	b := tn.addNode()
+	tn.connect(a, b)
+	if _, err := b.SendEncryptedTextTo(a.ID, "before the api"); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, a, b.ID, "before the api")
+	bearer := "Bearer " + api.token
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+		contains           string // In the response body
+	}{
+		{"GET", "/info", "", http.StatusOK, `"id":"` + a.ID + `"`},
+		{"POST", "/info", "", http.StatusMethodNotAllowed, "use GET"},
+		{"GET", "/peers", "", http.StatusOK, `"node_id":"` + b.ID + `"`},
+		{"GET", "/messages?since=0", "", http.StatusOK, `"text":"before the api"`},
+		{"GET", "/messages?since=-1", "", http.StatusBadRequest, "since"},
+		{"GET", "/messages?wait=soon", "", http.StatusBadRequest, "wait"},
+		{"POST", "/message", `{"peer":"` + b.ID + `","text":"direct from the api"}`, http.StatusOK, `"status":"sent"`},
+		{"POST", "/message", `{"text":"to everyone from the api"}`, http.StatusOK, `"status":"sent"`},
+		{"POST", "/message", `{"text":""}`, http.StatusBadRequest, "text is required"},
+		{"POST", "/message", `{"text":"hi","colour":"red"}`, http.StatusBadRequest, "unknown field"},
+		{"POST", "/message", `{"peer":"nobody","text":"hi"}`, http.StatusBadGateway, "error"},
+		{"GET", "/message", "", http.StatusMethodNotAllowed, "use POST"},
+		{"POST", "/sendfile", `{"peer":"` + b.ID + `"}`, http.StatusBadRequest, "peer and path are required"},
+		{"GET", "/transfers", "", http.StatusOK, "["},
+		{"POST", "/connect", `{"addr":"two words"}`, http.StatusBadRequest, "single host:port"},
+		{"POST", "/input", `{"input":"  "}`, http.StatusBadRequest, "must not be empty"},
+		{"POST", "/input", `{"input":"typed into the api"}`, http.StatusAccepted, `"status":"queued"`},
+		{"GET", "/nowhere", "", http.StatusNotFound, ""},
+	} {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			status, body := apiCall(t, api, tc.method, tc.path, bearer, tc.body)
+			if status != tc.want || !strings.Contains(body, tc.contains) {
+				t.Errorf("status %d, body %s; want %d containing %s", status, strings.TrimSpace(body), tc.want, tc.contains)
+			}
+			if status != http.StatusNotFound && !json.Valid([]byte(body)) {
+				t.Errorf("body isn't JSON: %s", body)
+			}
+		})
+	}
+
+	waitForText(t, b, a.ID, "direct from the api")
+	waitForText(t, b, a.ID, "to everyone from the api")
+	waitForText(t, b, a.ID, "typed into the api")
+}
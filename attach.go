@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	attachPollWait     = 25              // Seconds each long-poll for messages may block
+	attachRetryDelay   = 2 * time.Second // Delay before reconnecting after an error
+	attachPeerInterval = time.Second     // How often the peer list and transfers are refreshed
+)
+
+// attachClient is a chatBackend that talks to a daemon over its control socket
+type attachClient struct {
+	http      *http.Client
+	nodeID    string
+	profile   string
+	messages  chan Message
+	done      chan struct{}
+	closeMu   sync.Once
+	peers     []string
+	info      map[string]PeerInfo
+	transfers []TransferInfo
+	playback  PlaybackInfo
+	traffic   TrafficInfo
+	rooms     []RoomInfo
+	locked    bool
+	peersMu   sync.RWMutex
+}
+
+// newAttachClient connects to a daemon's control socket and starts streaming its messages
+func newAttachClient(socketPath string) (*attachClient, error) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	client := &attachClient{
+		http:     &http.Client{Transport: transport},
+		messages: make(chan Message, 100),
+		done:     make(chan struct{}),
+	}
+
+	var info apiInfo
+	if err := client.get("/info", &info); err != nil {
+		return nil, fmt.Errorf("failed to reach daemon at %s: %w", socketPath, err)
+	}
+	client.nodeID = info.ID
+	client.profile = info.Profile
+
+	go client.pollMessages()
+	go client.pollPeers()
+
+	return client, nil
+}
+
+// NodeID returns the daemon's node ID (chatBackend)
+func (c *attachClient) NodeID() string {
+	return c.nodeID
+}
+
+// UIMessages returns the stream of messages from the daemon, which starts with the daemon's
+// message log (chatBackend)
+func (c *attachClient) UIMessages() <-chan Message {
+	return c.messages
+}
+
+// PeerIDs returns the most recently fetched peer list (chatBackend)
+func (c *attachClient) PeerIDs() []string {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+
+	return append([]string(nil), c.peers...)
+}
+
+// PeerInfo returns the most recently fetched details of a peer (chatBackend)
+func (c *attachClient) PeerInfo(peerID string) PeerInfo {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+
+	if info, exists := c.info[peerID]; exists {
+		return info
+	}
+	return PeerInfo{Presence: Presence{Status: StatusUnknown}, Key: KeyNone}
+}
+
+// Transfers returns the most recently fetched file transfers (chatBackend)
+func (c *attachClient) Transfers() []TransferInfo {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+
+	return append([]TransferInfo(nil), c.transfers...)
+}
+
+// Playback returns the most recently fetched voice playback state (chatBackend)
+func (c *attachClient) Playback() PlaybackInfo {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+
+	return c.playback
+}
+
+// Traffic returns the daemon's most recently fetched data usage (chatBackend)
+func (c *attachClient) Traffic() TrafficInfo {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+
+	return c.traffic
+}
+
+// Rooms returns the daemon's rooms as most recently fetched (chatBackend)
+func (c *attachClient) Rooms() []RoomInfo {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+
+	return append([]RoomInfo(nil), c.rooms...)
+}
+
+// Locked returns whether the daemon was refusing new connections when last asked (chatBackend)
+func (c *attachClient) Locked() bool {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+
+	return c.locked
+}
+
+// SendInput forwards a line of input to the daemon (chatBackend)
+func (c *attachClient) SendInput(input string) error {
+	body, err := json.Marshal(apiInputRequest{Input: input})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Post("http://daemon/input", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("daemon unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeAPIErrorResponse(resp)
+	}
+	return nil
+}
+
+// MarkRead passes the direct messages the user has seen to the daemon, which sends read receipts
+// if they are on (chatBackend)
+func (c *attachClient) MarkRead(peerID string, ids []string) error {
+	body, err := json.Marshal(apiReadRequest{Peer: peerID, IDs: ids})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Post("http://daemon/read", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("daemon unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeAPIErrorResponse(resp)
+	}
+	return nil
+}
+
+// Done returns a channel closed when the client is closed (chatBackend). A daemon that goes
+// away is retried rather than treated as done.
+func (c *attachClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close stops the background pollers
+func (c *attachClient) Close() {
+	c.closeMu.Do(func() {
+		close(c.done)
+	})
+}
+
+// pollMessages long-polls the daemon's message log, starting from the beginning of its buffer
+// so that a freshly attached client replays recent history before live messages.
+func (c *attachClient) pollMessages() {
+	var since int64
+	for {
+		var page struct {
+			Messages []LoggedMessage `json:"messages"`
+			Next     int64           `json:"next"`
+		}
+
+		path := fmt.Sprintf("/messages?since=%d&wait=%d", since, attachPollWait)
+		if err := c.get(path, &page); err != nil {
+			c.deliver(Message{
+				SenderID: "System",
+				Content:  []byte(fmt.Sprintf("⚠️ Lost connection to daemon: %v (retrying)", err)),
+			})
+			select {
+			case <-time.After(attachRetryDelay):
+				continue
+			case <-c.done:
+				return
+			}
+		}
+
+		for _, entry := range page.Messages {
+			var expiresAt time.Time
+			if entry.ExpiresAt != nil {
+				expiresAt = *entry.ExpiresAt
+			}
+			if !c.deliver(Message{
+				SenderID:   entry.SenderID,
+				SenderKey:  entry.SenderKey,
+				Content:    []byte(entry.Content),
+				FromPeerID: entry.FromPeerID,
+				Lamport:    entry.Lamport,
+				Seq:        entry.Seq,
+				Timestamp:  entry.Timestamp,
+				Backfill:   entry.Backfill,
+				Mention:    entry.Mention,
+				Action:     entry.Action,
+				ExpiresAt:  expiresAt,
+				Direct:     entry.Direct,
+				To:         entry.To,
+				Room:       entry.Room,
+				Attachment: entry.Attachment,
+				ID:         entry.MessageID,
+				ReadIDs:    entry.Read,
+
+				Conversation:    entry.Conversation,
+				ConversationKey: entry.ConversationKey,
+			}) {
+				return
+			}
+		}
+		since = page.Next
+	}
+}
+
+// pollPeers periodically refreshes the cached peer list, file transfers, playback state, traffic,
+// rooms and whether the daemon is locked
+func (c *attachClient) pollPeers() {
+	ticker := time.NewTicker(attachPeerInterval)
+	defer ticker.Stop()
+
+	for {
+		var peers []apiPeer
+		if err := c.get("/peers", &peers); err == nil {
+			ids := make([]string, 0, len(peers))
+			info := make(map[string]PeerInfo, len(peers))
+			for _, peer := range peers {
+				ids = append(ids, peer.ID)
+				peerInfo := PeerInfo{
+					NodeID:      peer.NodeID,
+					Nick:        peer.Nick,
+					Presence:    Presence{Status: peer.Status, Text: peer.Text},
+					Muted:       peer.Muted,
+					Key:         peer.Key,
+					Latency:     time.Duration(peer.LatencyMS * float64(time.Millisecond)),
+					BytesIn:     peer.BytesIn,
+					BytesOut:    peer.BytesOut,
+					Fingerprint: peer.Fingerprint,
+				}
+				if peer.LastActive != nil {
+					peerInfo.LastActive = *peer.LastActive
+				}
+				info[peer.ID] = peerInfo
+			}
+			sort.Strings(ids)
+
+			c.peersMu.Lock()
+			c.peers = ids
+			c.info = info
+			c.peersMu.Unlock()
+		}
+
+		var transfers []TransferInfo
+		if err := c.get("/transfers", &transfers); err == nil {
+			c.peersMu.Lock()
+			c.transfers = transfers
+			c.peersMu.Unlock()
+		}
+
+		var playback PlaybackInfo
+		if err := c.get("/playback", &playback); err == nil {
+			c.peersMu.Lock()
+			c.playback = playback
+			c.peersMu.Unlock()
+		}
+
+		var traffic TrafficInfo
+		if err := c.get("/traffic", &traffic); err == nil {
+			c.peersMu.Lock()
+			c.traffic = traffic
+			c.peersMu.Unlock()
+		}
+
+		var rooms []RoomInfo
+		if err := c.get("/rooms", &rooms); err == nil {
+			c.peersMu.Lock()
+			c.rooms = rooms
+			c.peersMu.Unlock()
+		}
+
+		var info apiInfo
+		if err := c.get("/info", &info); err == nil {
+			c.peersMu.Lock()
+			c.locked = info.Locked
+			c.peersMu.Unlock()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// deliver hands a message to the TUI, returning false once the client is closed
+func (c *attachClient) deliver(msg Message) bool {
+	select {
+	case c.messages <- msg:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// get performs a GET request against the daemon and decodes the JSON response into v
+func (c *attachClient) get(path string, v interface{}) error {
+	resp, err := c.http.Get("http://daemon" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeAPIErrorResponse(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// decodeAPIErrorResponse turns an API error response into a Go error
+func decodeAPIErrorResponse(resp *http.Response) error {
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+		return fmt.Errorf("daemon returned %s", resp.Status)
+	}
+	return fmt.Errorf("%s", apiErr.Error)
+}
+
+// runAttach runs the TUI as a thin client of a daemon listening on socketPath
+func runAttach(socketPath string) {
+	client, err := newAttachClient(socketPath)
+	if err != nil {
+		log.Fatalf("Failed to attach: %v", err)
+	}
+	defer client.Close()
+
+	ui := NewUI(client)
+	if err := ui.setTheme(pickTheme("", ""), nil); err != nil {
+		log.Fatalf("Failed to load theme: %v", err)
+	}
+	// The socket lives in the daemon's data directory, next to its other TUI state
+	if err := ui.setConversationsPath(filepath.Join(filepath.Dir(socketPath), conversationsFile)); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if err := ui.setNotificationsPath(filepath.Join(filepath.Dir(socketPath), notificationsFile)); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	ui.exportDir = filepath.Dir(socketPath)
+	ui.profile = client.profile
+	p := tea.NewProgram(ui, tea.WithAltScreen(), tea.WithReportFocus())
+	if _, err := p.Run(); err != nil {
+		log.Fatalf("Error running TUI: %v", err)
+	}
+}
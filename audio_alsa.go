@@ -0,0 +1,125 @@
+//go:build linux && cgo
+
+package main
+
+/*
+#cgo pkg-config: alsa
+#include <stdlib.h>
+#include <alsa/asoundlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// alsaLatency is how much audio ALSA buffers while recording, in microseconds
+const alsaLatency = 500000
+
+// alsaCapture records through libasound in-process; playback links it already, so nothing needs
+// installing. PulseAudio and PipeWire serve ALSA clients through their plugins, so the default
+// device is the desktop's microphone on most systems.
+type alsaCapture struct{}
+
+// nativeCaptureBackend returns ALSA if its default capture device opens, or nil
+func nativeCaptureBackend() captureBackend {
+	pcm, err := openALSACapture("", C.SND_PCM_NONBLOCK)
+	if err != nil {
+		return nil
+	}
+	C.snd_pcm_close(pcm)
+	return alsaCapture{}
+}
+
+// alsaError describes a negative return from libasound
+func alsaError(what string, code C.int) error {
+	return fmt.Errorf("%s: %s", what, C.GoString(C.snd_strerror(code)))
+}
+
+// openALSACapture opens device ("" for the default) for recording
+func openALSACapture(device string, mode C.int) (*C.snd_pcm_t, error) {
+	if device == "" {
+		device = "default"
+	}
+	name := C.CString(device)
+	defer C.free(unsafe.Pointer(name))
+
+	var pcm *C.snd_pcm_t
+	if code := C.snd_pcm_open(&pcm, name, C.SND_PCM_STREAM_CAPTURE, mode); code < 0 {
+		return nil, alsaError("failed to open "+device, code)
+	}
+	return pcm, nil
+}
+
+func (alsaCapture) Name() string { return "ALSA" }
+
+func (alsaCapture) Record(device string, duration int) ([]byte, error) {
+	pcm, err := openALSACapture(device, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer C.snd_pcm_close(pcm)
+
+	// ALSA resamples if the device can't record at the voice rate itself
+	if code := C.snd_pcm_set_params(pcm, C.SND_PCM_FORMAT_S16_LE, C.SND_PCM_ACCESS_RW_INTERLEAVED,
+		1, voiceSampleRate, 1, alsaLatency); code < 0 {
+		return nil, alsaError("can't record 16-bit mono", code)
+	}
+
+	const bytesPerFrame = 2
+	frames := duration * voiceSampleRate
+	samples := make([]byte, frames*bytesPerFrame)
+	for read := 0; read < frames; {
+		chunk := min(frames-read, voiceSampleRate/10)
+		n := C.snd_pcm_readi(pcm, unsafe.Pointer(&samples[read*bytesPerFrame]), C.snd_pcm_uframes_t(chunk))
+		if n < 0 {
+			// An overrun loses a moment of audio; carry on after it
+			if code := C.snd_pcm_recover(pcm, C.int(n), 1); code < 0 {
+				return nil, alsaError("recording failed", code)
+			}
+			continue
+		}
+		read += int(n)
+	}
+	return samples, nil
+}
+
+// Devices lists the ALSA PCMs that can record, as `arecord -L` does
+func (alsaCapture) Devices() ([]audioDevice, error) {
+	iface := C.CString("pcm")
+	defer C.free(unsafe.Pointer(iface))
+
+	var hints *unsafe.Pointer
+	if code := C.snd_device_name_hint(-1, iface, &hints); code < 0 {
+		return nil, alsaError("failed to list devices", code)
+	}
+	defer C.snd_device_name_free_hint(hints)
+
+	var devices []audioDevice
+	// The hints are a NULL-terminated array
+	for hint := hints; *hint != nil; hint = (*unsafe.Pointer)(unsafe.Add(unsafe.Pointer(hint), unsafe.Sizeof(*hint))) {
+		name := alsaHint(*hint, "NAME")
+		// No IOID means the PCM works both ways
+		if name == "" || name == "null" || alsaHint(*hint, "IOID") == "Output" {
+			continue
+		}
+		description, _, _ := strings.Cut(alsaHint(*hint, "DESC"), "\n")
+		devices = append(devices, audioDevice{Name: name, Description: description})
+	}
+	return devices, nil
+}
+
+// alsaHint returns one field of a device name hint, or "" if it has none
+func alsaHint(hint unsafe.Pointer, id string) string {
+	field := C.CString(id)
+	defer C.free(unsafe.Pointer(field))
+
+	value := C.snd_device_name_get_hint(hint, field)
+	if value == nil {
+		return ""
+	}
+	defer C.free(unsafe.Pointer(value))
+	return C.GoString(value)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// voiceSampleRate is the rate voice messages are recorded at: plenty for speech, and small
+// enough that an unencoded WAV clip stays reasonable when there is no MP3 encoder
+const voiceSampleRate = 16000
+
+// captureBackend records mono 16-bit little-endian PCM from a microphone: natively through ALSA
+// on Linux and winmm on Windows, or by driving a recorder that writes raw samples to stdout. The
+// samples are turned into WAV here, so no encoder is needed to send a voice message.
+type captureBackend interface {
+	Name() string // The recorder program, or ALSA or winmm
+	// Record captures duration seconds from device ("" for the system default)
+	Record(device string, duration int) ([]byte, error)
+	// Devices lists the capture devices the recorder can use
+	Devices() ([]audioDevice, error)
+}
+
+// findCaptureBackend returns the native backend if it can open a microphone, else the first
+// recorder in PATH, or nil if there is none. It runs while the node starts, and opening the
+// native device can hold startup up: through PulseAudio or PipeWire it connects to the server.
+func findCaptureBackend() captureBackend {
+	if native := nativeCaptureBackend(); native != nil {
+		return native
+	}
+	candidates := []captureBackend{ffmpegCapture{}, parecCapture{}, arecordCapture{}, soxCapture{}}
+	for _, backend := range candidates {
+		if _, err := exec.LookPath(backend.Name()); err == nil {
+			return backend
+		}
+	}
+	return nil
+}
+
+// audioProbeTimeout is the longest startup waits for the audio output to open
+const audioProbeTimeout = time.Second
+
+// errNoCaptureBackend explains how to get voice recording working
+var errNoCaptureBackend = errors.New("voice recording disabled: no microphone could be opened " +
+	"and no audio recorder found in PATH (install ffmpeg, or parec from PulseAudio/PipeWire, " +
+	"arecord from alsa-utils, or sox)")
+
+// errNoAudioOutput is returned when voice messages can't be played
+var errNoAudioOutput = errors.New("voice playback disabled: no audio output")
+
+// capture runs a recorder and returns what it wrote to stdout. Recorders without a duration
+// option are given stopAfter, and killed once it has passed; that is not an error.
+func capture(cmd *exec.Cmd, stopAfter time.Duration) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s failed: %w", filepath.Base(cmd.Path), err)
+	}
+
+	var stopped atomic.Bool
+	if stopAfter > 0 {
+		timer := time.AfterFunc(stopAfter, func() {
+			stopped.Store(true)
+			cmd.Process.Kill()
+		})
+		defer timer.Stop()
+	}
+
+	if err := cmd.Wait(); err != nil && !stopped.Load() {
+		return nil, fmt.Errorf("%s failed: %w, stderr: %s", filepath.Base(cmd.Path), err, stderr.String())
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("%s recorded nothing: %s", filepath.Base(cmd.Path), stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// ffmpegCapture records through ffmpeg's platform input device
+type ffmpegCapture struct{}
+
+func (ffmpegCapture) Name() string { return "ffmpeg" }
+
+func (ffmpegCapture) Record(device string, duration int) ([]byte, error) {
+	var input []string
+	switch runtime.GOOS {
+	case "windows":
+		if device == "" {
+			return nil, errors.New("ffmpeg needs a capture device on Windows")
+		}
+		input = []string{"-f", "dshow", "-i", "audio=" + device}
+	case "darwin":
+		if device == "" {
+			device = "0"
+		}
+		input = []string{"-f", "avfoundation", "-i", ":" + device}
+	case "linux":
+		if device == "" {
+			device = "default"
+		}
+		input = []string{"-f", "pulse", "-i", device}
+	default:
+		return nil, fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+
+	args := append(input, "-t", strconv.Itoa(duration), "-ar", strconv.Itoa(voiceSampleRate), "-ac", "1", "-f", "s16le", "-")
+	return capture(exec.Command("ffmpeg", args...), 0)
+}
+
+// parecCapture records from PulseAudio or PipeWire
+type parecCapture struct{}
+
+func (parecCapture) Name() string { return "parec" }
+
+func (parecCapture) Record(device string, duration int) ([]byte, error) {
+	args := []string{"--raw", "--format=s16le", "--rate=" + strconv.Itoa(voiceSampleRate), "--channels=1"}
+	if device != "" {
+		args = append(args, "--device="+device)
+	}
+	return capture(exec.Command("parec", args...), time.Duration(duration)*time.Second)
+}
+
+// arecordCapture records from ALSA
+type arecordCapture struct{}
+
+func (arecordCapture) Name() string { return "arecord" }
+
+func (arecordCapture) Record(device string, duration int) ([]byte, error) {
+	args := []string{"-q", "-t", "raw", "-f", "S16_LE", "-r", strconv.Itoa(voiceSampleRate), "-c", "1", "-d", strconv.Itoa(duration)}
+	if device != "" {
+		args = append(args, "-D", device)
+	}
+	return capture(exec.Command("arecord", args...), 0)
+}
+
+// soxCapture records with sox's rec, which works on macOS and most Unix systems
+type soxCapture struct{}
+
+func (soxCapture) Name() string { return "rec" }
+
+func (soxCapture) Record(device string, duration int) ([]byte, error) {
+	args := []string{"-q", "-t", "raw", "-b", "16", "-e", "signed-integer", "-L", "-c", "1", "-r", strconv.Itoa(voiceSampleRate), "-", "trim", "0", strconv.Itoa(duration)}
+	cmd := exec.Command("rec", args...)
+	if device != "" {
+		// rec takes its input device from the environment
+		cmd.Env = append(cmd.Environ(), "AUDIODEV="+device)
+	}
+	return capture(cmd, 0)
+}
+
+// encodeWAV wraps mono 16-bit little-endian PCM in a WAV header
+func encodeWAV(pcm []byte, sampleRate int) []byte {
+	const channels, bitsPerSample = 1, 16
+	blockAlign := channels * bitsPerSample / 8
+
+	var wav bytes.Buffer
+	wav.Grow(44 + len(pcm))
+	wav.WriteString("RIFF")
+	binary.Write(&wav, binary.LittleEndian, uint32(36+len(pcm)))
+	wav.WriteString("WAVE")
+	wav.WriteString("fmt ")
+	binary.Write(&wav, binary.LittleEndian, uint32(16)) // PCM format chunk size
+	binary.Write(&wav, binary.LittleEndian, uint16(1))  // PCM
+	binary.Write(&wav, binary.LittleEndian, uint16(channels))
+	binary.Write(&wav, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(&wav, binary.LittleEndian, uint32(sampleRate*blockAlign))
+	binary.Write(&wav, binary.LittleEndian, uint16(blockAlign))
+	binary.Write(&wav, binary.LittleEndian, uint16(bitsPerSample))
+	wav.WriteString("data")
+	binary.Write(&wav, binary.LittleEndian, uint32(len(pcm)))
+	wav.Write(pcm)
+	return wav.Bytes()
+}
+
+// encodeMP3 compresses a WAV clip with ffmpeg, if it is installed
+func encodeMP3(wav []byte) ([]byte, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("ffmpeg", "-f", "wav", "-i", "-", "-codec:a", "libmp3lame", "-qscale:a", "5", "-f", "mp3", "-")
+	cmd.Stdin = bytes.NewReader(wav)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg conversion failed: %w, stderr: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// audioDevice is a capture device as a recorder names it
+type audioDevice struct {
+	Name        string // Passed to the recorder
+	Description string // Human-readable, if the recorder gives one
+}
+
+// errCannotListDevices is returned by recorders that have no way to enumerate devices
+var errCannotListDevices = errors.New("this recorder can't list devices; /audiodevice <name> still selects one")
+
+// dshowAudioDevice matches an audio device in `ffmpeg -list_devices true -f dshow` output
+var dshowAudioDevice = regexp.MustCompile(`"([^"]+)" \(audio\)`)
+
+// avfoundationDevice matches a device line in `ffmpeg -f avfoundation -list_devices true` output
+var avfoundationDevice = regexp.MustCompile(`\] \[(\d+)\] (.+)$`)
+
+// listPulseSources lists PulseAudio/PipeWire sources, leaving out the monitors of outputs
+func listPulseSources() ([]audioDevice, error) {
+	output, err := exec.Command("pactl", "list", "short", "sources").Output()
+	if err != nil {
+		return nil, fmt.Errorf("pactl failed: %w", err)
+	}
+
+	var devices []audioDevice
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || strings.HasSuffix(fields[1], ".monitor") {
+			continue
+		}
+		devices = append(devices, audioDevice{Name: fields[1]})
+	}
+	return devices, nil
+}
+
+func (ffmpegCapture) Devices() ([]audioDevice, error) {
+	switch runtime.GOOS {
+	case "linux":
+		// ffmpeg records from PulseAudio here, which knows its own sources
+		return listPulseSources()
+	case "windows":
+		// ffmpeg lists devices on stderr and then fails on the dummy input
+		var stderr bytes.Buffer
+		cmd := exec.Command("ffmpeg", "-hide_banner", "-list_devices", "true", "-f", "dshow", "-i", "dummy")
+		cmd.Stderr = &stderr
+		cmd.Run()
+
+		var devices []audioDevice
+		for _, match := range dshowAudioDevice.FindAllStringSubmatch(stderr.String(), -1) {
+			devices = append(devices, audioDevice{Name: match[1]})
+		}
+		return devices, nil
+	case "darwin":
+		var stderr bytes.Buffer
+		cmd := exec.Command("ffmpeg", "-hide_banner", "-f", "avfoundation", "-list_devices", "true", "-i", "")
+		cmd.Stderr = &stderr
+		cmd.Run()
+
+		var devices []audioDevice
+		inAudio := false
+		scanner := bufio.NewScanner(&stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.Contains(line, "audio devices:") {
+				inAudio = true
+				continue
+			}
+			if match := avfoundationDevice.FindStringSubmatch(line); inAudio && match != nil {
+				devices = append(devices, audioDevice{Name: match[1], Description: match[2]})
+			}
+		}
+		return devices, nil
+	}
+	return nil, errCannotListDevices
+}
+
+func (parecCapture) Devices() ([]audioDevice, error) {
+	return listPulseSources()
+}
+
+// Devices lists ALSA PCM names from `arecord -L`; each name is followed by indented description lines
+func (arecordCapture) Devices() ([]audioDevice, error) {
+	output, err := exec.Command("arecord", "-L").Output()
+	if err != nil {
+		return nil, fmt.Errorf("arecord failed: %w", err)
+	}
+
+	var devices []audioDevice
+	for _, line := range strings.Split(string(output), "\n") {
+		switch {
+		case line == "":
+		case line[0] == ' ' || line[0] == '\t':
+			if len(devices) > 0 && devices[len(devices)-1].Description == "" {
+				devices[len(devices)-1].Description = strings.TrimSpace(line)
+			}
+		case line != "null":
+			devices = append(devices, audioDevice{Name: line})
+		}
+	}
+	return devices, nil
+}
+
+func (soxCapture) Devices() ([]audioDevice, error) {
+	return nil, errCannotListDevices
+}
+
+// pickDevice resolves what /audiodevice was given: a number from /audiodevices or a device name
+func pickDevice(devices []audioDevice, ref string) (string, bool) {
+	if index, err := strconv.Atoi(ref); err == nil {
+		if index < 1 || index > len(devices) {
+			return "", false
+		}
+		return devices[index-1].Name, true
+	}
+	for _, device := range devices {
+		if device.Name == ref {
+			return device.Name, true
+		}
+	}
+	for _, device := range devices {
+		if strings.EqualFold(device.Description, ref) {
+			return device.Name, true
+		}
+	}
+	return "", false
+}
+
+// recordingDevice is the device to record from: the selected one if the recorder still has it,
+// otherwise the default, with a warning
+func (vm *VoiceMessageManager) recordingDevice() string {
+	vm.recordMutex.Lock()
+	device := vm.device
+	vm.recordMutex.Unlock()
+	if device == "" {
+		return ""
+	}
+
+	devices, err := vm.capture.Devices()
+	if err != nil {
+		// Nothing to check against; let the recorder decide
+		return device
+	}
+	for _, available := range devices {
+		if available.Name == device {
+			return device
+		}
+	}
+
+	log.Printf("Audio device %q is gone, recording from the default device", device)
+	vm.node.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("⚠️ Audio device %s isn't available any more; recording from the default device (/audiodevices to pick another)", device)),
+	})
+	return ""
+}
+
+// SetDevice selects the capture device; "" means the recorder's default
+func (vm *VoiceMessageManager) SetDevice(device string) {
+	vm.recordMutex.Lock()
+	defer vm.recordMutex.Unlock()
+	vm.device = device
+}
+
+// handleAudioDevicesCommand processes /audiodevices
+func (en *EnhancedNode) handleAudioDevicesCommand() {
+	vm := en.voiceManager
+	if vm.capture == nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("❌ " + errNoCaptureBackend.Error()),
+		})
+		return
+	}
+
+	devices, err := vm.capture.Devices()
+	if err != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ %s: %v", vm.capture.Name(), err)),
+		})
+		return
+	}
+
+	vm.recordMutex.Lock()
+	selected := vm.device
+	vm.recordMutex.Unlock()
+
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("🎤 Capture devices (%s; /audiodevice <number|name> to choose):", vm.capture.Name()))
+	if len(devices) == 0 {
+		content.WriteString("\n  none found")
+	}
+	for i, device := range devices {
+		marker := " "
+		if device.Name == selected {
+			marker = "*"
+		}
+		content.WriteString(fmt.Sprintf("\n %s%2d. %s", marker, i+1, device.Name))
+		if device.Description != "" {
+			content.WriteString(" — " + device.Description)
+		}
+	}
+	if selected == "" {
+		content.WriteString("\n  Recording from the default device")
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(content.String()),
+	})
+}
+
+// handleAudioDeviceCommand processes /audiodevice <number|name|default>, saving the choice in the config
+func (en *EnhancedNode) handleAudioDeviceCommand(args string) {
+	vm := en.voiceManager
+	ref := strings.TrimSpace(args)
+
+	var reply string
+	switch {
+	case vm.capture == nil:
+		reply = "❌ " + errNoCaptureBackend.Error()
+
+	case ref == "":
+		reply = "Usage: /audiodevice <number|name> (see /audiodevices), or /audiodevice default"
+
+	default:
+		device := ""
+		if ref != "default" {
+			devices, err := vm.capture.Devices()
+			if err != nil {
+				// The recorder can't list devices, so take the name as given
+				device = ref
+			} else if picked, known := pickDevice(devices, ref); known {
+				device = picked
+			} else {
+				reply = fmt.Sprintf("❌ No capture device %s (see /audiodevices)", ref)
+				break
+			}
+		}
+
+		vm.SetDevice(device)
+		if device == "" {
+			reply = "🎤 Recording from the default device"
+		} else {
+			reply = fmt.Sprintf("🎤 Recording from %s", device)
+		}
+
+		en.config.AudioDevice = device
+		if err := SaveConfig(en.configPath, en.config); err != nil {
+			log.Printf("Failed to save config: %v", err)
+			reply += fmt.Sprintf(" (not saved: %v)", err)
+		}
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !windows && (!linux || !cgo)
+
+package main
+
+// nativeCaptureBackend returns nil: capture is native only through ALSA on Linux and winmm on
+// Windows, so other systems record with a program from PATH
+func nativeCaptureBackend() captureBackend {
+	return nil
+}
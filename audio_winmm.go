@@ -0,0 +1,193 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// winmm is the Windows multimedia library; playback already goes through it
+var (
+	winmm                     = windows.NewLazySystemDLL("winmm.dll")
+	procWaveInGetNumDevs      = winmm.NewProc("waveInGetNumDevs")
+	procWaveInGetDevCaps      = winmm.NewProc("waveInGetDevCapsW")
+	procWaveInGetErrorText    = winmm.NewProc("waveInGetErrorTextW")
+	procWaveInOpen            = winmm.NewProc("waveInOpen")
+	procWaveInClose           = winmm.NewProc("waveInClose")
+	procWaveInPrepareHeader   = winmm.NewProc("waveInPrepareHeader")
+	procWaveInUnprepareHeader = winmm.NewProc("waveInUnprepareHeader")
+	procWaveInAddBuffer       = winmm.NewProc("waveInAddBuffer")
+	procWaveInStart           = winmm.NewProc("waveInStart")
+	procWaveInReset           = winmm.NewProc("waveInReset")
+)
+
+const (
+	waveMapper      = 0xFFFFFFFF // the device Windows picks, normally the default microphone
+	waveFormatPCM   = 1
+	waveFormatQuery = 0x1 // waveInOpen only checks the format is supported
+	whdrDone        = 0x1
+
+	// winmmGrace is how long past the recording's length to wait for the device to hand the
+	// buffer back before stopping it
+	winmmGrace = 2 * time.Second
+)
+
+// waveFormat is WAVEFORMATEX
+type waveFormat struct {
+	FormatTag      uint16
+	Channels       uint16
+	SamplesPerSec  uint32
+	AvgBytesPerSec uint32
+	BlockAlign     uint16
+	BitsPerSample  uint16
+	Size           uint16
+}
+
+// waveHeader is WAVEHDR
+type waveHeader struct {
+	Data          uintptr
+	BufferLength  uint32
+	BytesRecorded uint32
+	User          uintptr
+	Flags         uint32
+	Loops         uint32
+	Next          uintptr
+	Reserved      uintptr
+}
+
+// waveInCaps is WAVEINCAPSW
+type waveInCaps struct {
+	Mid           uint16
+	Pid           uint16
+	DriverVersion uint32
+	Name          [32]uint16
+	Formats       uint32
+	Channels      uint16
+	Reserved      uint16
+}
+
+// voiceFormat is 16-bit mono at the voice rate; the wave mapper converts from whatever the
+// device records
+var voiceFormat = waveFormat{
+	FormatTag:      waveFormatPCM,
+	Channels:       1,
+	SamplesPerSec:  voiceSampleRate,
+	AvgBytesPerSec: voiceSampleRate * 2,
+	BlockAlign:     2,
+	BitsPerSample:  16,
+}
+
+// winmmCapture records through winmm in-process, so Windows needs no recorder installed
+type winmmCapture struct{}
+
+// nativeCaptureBackend returns winmm if there is a capture device that records the voice format,
+// or nil
+func nativeCaptureBackend() captureBackend {
+	if procWaveInGetNumDevs.Find() != nil {
+		return nil
+	}
+	if n, _, _ := procWaveInGetNumDevs.Call(); n == 0 {
+		return nil
+	}
+	if winmmCall(procWaveInOpen, 0, waveMapper, uintptr(unsafe.Pointer(&voiceFormat)), 0, 0, waveFormatQuery) != nil {
+		return nil
+	}
+	return winmmCapture{}
+}
+
+// winmmCall calls a waveIn function and describes the MMRESULT it returns if it failed
+func winmmCall(proc *windows.LazyProc, args ...uintptr) error {
+	result, _, _ := proc.Call(args...)
+	if result == 0 {
+		return nil
+	}
+	text := make([]uint16, 256)
+	if code, _, _ := procWaveInGetErrorText.Call(result, uintptr(unsafe.Pointer(&text[0])), uintptr(len(text))); code != 0 {
+		return fmt.Errorf("winmm error %d", result)
+	}
+	return errors.New(windows.UTF16ToString(text))
+}
+
+func (winmmCapture) Name() string { return "winmm" }
+
+func (wc winmmCapture) Record(device string, duration int) ([]byte, error) {
+	id, err := wc.deviceID(device)
+	if err != nil {
+		return nil, err
+	}
+	var handle uintptr
+	if err := winmmCall(procWaveInOpen, uintptr(unsafe.Pointer(&handle)), id, uintptr(unsafe.Pointer(&voiceFormat)), 0, 0, 0); err != nil {
+		return nil, fmt.Errorf("failed to open the microphone: %w", err)
+	}
+	defer procWaveInClose.Call(handle)
+
+	// One buffer holds the whole recording; winmm fills it and marks it done
+	samples := make([]byte, duration*int(voiceFormat.AvgBytesPerSec))
+	header := &waveHeader{Data: uintptr(unsafe.Pointer(&samples[0])), BufferLength: uint32(len(samples))}
+	headerSize := unsafe.Sizeof(*header)
+	if err := winmmCall(procWaveInPrepareHeader, handle, uintptr(unsafe.Pointer(header)), headerSize); err != nil {
+		return nil, fmt.Errorf("can't record 16-bit mono: %w", err)
+	}
+	defer procWaveInUnprepareHeader.Call(handle, uintptr(unsafe.Pointer(header)), headerSize)
+	if err := winmmCall(procWaveInAddBuffer, handle, uintptr(unsafe.Pointer(header)), headerSize); err != nil {
+		return nil, fmt.Errorf("can't record 16-bit mono: %w", err)
+	}
+	if err := winmmCall(procWaveInStart, handle); err != nil {
+		return nil, fmt.Errorf("recording failed: %w", err)
+	}
+
+	deadline := time.Now().Add(time.Duration(duration)*time.Second + winmmGrace)
+	for atomic.LoadUint32(&header.Flags)&whdrDone == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Reset hands the buffer back with what was recorded if the device stalled
+	procWaveInReset.Call(handle)
+	recorded := atomic.LoadUint32(&header.BytesRecorded)
+	runtime.KeepAlive(samples)
+	if recorded == 0 {
+		return nil, errors.New("recording failed: the microphone gave no audio")
+	}
+	return samples[:recorded], nil
+}
+
+// deviceID finds device by name or number; "" is the wave mapper
+func (wc winmmCapture) deviceID(device string) (uintptr, error) {
+	if device == "" {
+		return waveMapper, nil
+	}
+	devices, err := wc.Devices()
+	if err != nil {
+		return 0, err
+	}
+	for i, d := range devices {
+		if d.Name == device {
+			return uintptr(i), nil
+		}
+	}
+	if i, err := strconv.Atoi(device); err == nil && i >= 0 && i < len(devices) {
+		return uintptr(i), nil
+	}
+	return 0, fmt.Errorf("failed to open %s: no such capture device", device)
+}
+
+// Devices lists the capture devices in winmm's order, which is their device ID
+func (winmmCapture) Devices() ([]audioDevice, error) {
+	n, _, _ := procWaveInGetNumDevs.Call()
+	var devices []audioDevice
+	for i := uintptr(0); i < n; i++ {
+		var caps waveInCaps
+		if err := winmmCall(procWaveInGetDevCaps, i, uintptr(unsafe.Pointer(&caps)), unsafe.Sizeof(caps)); err != nil {
+			return nil, fmt.Errorf("failed to list devices: %w", err)
+		}
+		devices = append(devices, audioDevice{Name: windows.UTF16ToString(caps.Name[:])})
+	}
+	return devices, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditLogFile     = "audit.log"
+	auditLogMaxBytes = 1 << 20 // Size at which the log is rotated to audit.log.1, replacing the older one
+	auditRecentLimit = 200     // Entries kept in memory for /audit
+	auditShowDefault = 20      // Entries /audit shows when not given a number
+)
+
+// Severities of security events. Critical ones are also shown in the UI as they happen.
+const (
+	auditInfo     = "info"
+	auditWarning  = "warning"
+	auditCritical = "critical"
+)
+
+// Security events recorded in the audit log
+const (
+	auditKeyFirstSeen      = "key_first_seen"      // A node ID presented a key for the first time
+	auditKeyChanged        = "key_changed"         // A node ID presented a different key than before
+	auditKeyRefused        = "key_refused"         // A key was refused: not the contact's, or not the connection's
+	auditKeyVerified       = "key_verified"        // A peer proved it holds the key we have for it
+	auditContactAdded      = "contact_added"       // A key was pinned to a contact
+	auditContactRemoved    = "contact_removed"     // A contact's pin was removed
+	auditPlaintext         = "plaintext_after_key" // An unencrypted message from a peer whose key we hold
+	auditSignatureFailure  = "signature_failure"   // A message whose signature didn't verify
+	auditDecryptFailure    = "decrypt_failure"     // A message that couldn't be decrypted
+	auditSessionRefused    = "session_refused"     // A session message from a connection not authenticated as its sender
+	auditReplay            = "replay_detected"     // A message sent again over the connection it first came over
+	auditConnectionRefused = "connection_refused"  // A connection refused after its handshake
+	auditSpamMuted         = "spam_muted"          // A peer auto-muted for its reputation
+	auditSpamDisconnected  = "spam_disconnected"   // A peer disconnected and refused for a while for its reputation
+	auditKeyCarried        = "key_carried"         // A known key written again at the top of a rotated log
+)
+
+// AuditEntry is one security event. Entries are written as JSON lines.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Severity    string    `json:"severity"`
+	Peer        string    `json:"peer,omitempty"`        // Node ID, or address if the node ID isn't known
+	Connection  string    `json:"connection,omitempty"`  // Connection ID the event came over
+	Fingerprint string    `json:"fingerprint,omitempty"` // The peer's key, or the key the event is about
+	Detail      string    `json:"detail"`
+}
+
+// String formats an entry for /audit
+func (entry AuditEntry) String() string {
+	icon := map[string]string{auditInfo: "ℹ️", auditWarning: "⚠️", auditCritical: "🚨"}[entry.Severity]
+	line := fmt.Sprintf("%s %s %s", entry.Time.Format("2006-01-02 15:04:05"), icon, entry.Event)
+	if entry.Peer != "" {
+		line += " " + entry.Peer
+	}
+	if entry.Fingerprint != "" {
+		line += fmt.Sprintf(" [%s]", shortFingerprint(entry.Fingerprint))
+	}
+	return line + ": " + entry.Detail
+}
+
+// shortFingerprint is the first four groups of a fingerprint, enough to tell keys apart in a list
+func shortFingerprint(fingerprint string) string {
+	formatted := formatFingerprint(fingerprint)
+	return formatted[:min(19, len(formatted))]
+}
+
+// AuditLog is an append-only record of security events, kept in the data dir apart from chat
+// history. It is rotated once it reaches auditLogMaxBytes, so it and the previous file together
+// never hold much more than twice that. Each new file starts with the keys known so far, so key
+// changes are still caught after the entries that first recorded them are rotated away.
+type AuditLog struct {
+	mutex  sync.Mutex
+	path   string
+	recent []AuditEntry      // The newest auditRecentLimit entries, oldest first
+	keys   map[string]string // Node ID -> the last key it presented, as far as the log remembers
+}
+
+// NewAuditLog opens the audit log in dataDir, reading what earlier runs recorded
+func NewAuditLog(dataDir string) (*AuditLog, error) {
+	al := &AuditLog{
+		path: filepath.Join(dataDir, auditLogFile),
+		keys: make(map[string]string),
+	}
+	for _, path := range []string{al.path + ".1", al.path} {
+		if err := al.load(path); err != nil {
+			return nil, err
+		}
+	}
+	return al, nil
+}
+
+// load reads the entries in one log file. Lines that don't parse, such as one cut short by a
+// crash, are skipped.
+func (al *AuditLog) load(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), auditLogMaxBytes)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			al.remember(entry)
+		}
+	}
+	return scanner.Err()
+}
+
+// remember keeps an entry in memory. Carried keys are only remembered as keys; they aren't
+// events for /audit.
+func (al *AuditLog) remember(entry AuditEntry) {
+	if entry.Event == auditKeyCarried {
+		if entry.Peer != "" {
+			al.keys[entry.Peer] = entry.Fingerprint
+		}
+		return
+	}
+	al.recent = append(al.recent, entry)
+	if len(al.recent) > auditRecentLimit {
+		al.recent = al.recent[len(al.recent)-auditRecentLimit:]
+	}
+	if (entry.Event == auditKeyFirstSeen || entry.Event == auditKeyChanged) && entry.Peer != "" {
+		al.keys[entry.Peer] = entry.Fingerprint
+	}
+}
+
+// Record appends an entry to the log
+func (al *AuditLog) Record(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	al.remember(entry)
+
+	rotate := false
+	if info, err := os.Stat(al.path); err == nil && info.Size()+int64(len(data)) > auditLogMaxBytes {
+		if err := os.Rename(al.path, al.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+		rotate = true
+	}
+	file, err := os.OpenFile(al.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if rotate {
+		data = append(al.carriedKeys(entry.Time), data...)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return file.Close()
+}
+
+// carriedKeys is a key_carried line for each key the log knows, to start a rotated file with
+func (al *AuditLog) carriedKeys(now time.Time) []byte {
+	var data []byte
+	for nodeID, fingerprint := range al.keys {
+		line, err := json.Marshal(AuditEntry{
+			Time: now, Event: auditKeyCarried, Severity: auditInfo, Peer: nodeID, Fingerprint: fingerprint,
+			Detail: "key carried over from the rotated log",
+		})
+		if err == nil {
+			data = append(append(data, line...), '\n')
+		}
+	}
+	return data
+}
+
+// Recent returns up to n of the newest entries, oldest first
+func (al *AuditLog) Recent(n int) []AuditEntry {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	return append([]AuditEntry(nil), al.recent[max(len(al.recent)-n, 0):]...)
+}
+
+// PeerKey returns the key a node ID last presented, if the log remembers one
+func (al *AuditLog) PeerKey(nodeID string) (string, bool) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	fingerprint, known := al.keys[nodeID]
+	return fingerprint, known
+}
+
+// audit records a security event, filling in the time and, if it is known, the peer's key.
+// Critical events are shown in the UI straight away.
+func (en *EnhancedNode) audit(entry AuditEntry) {
+	entry.Time = time.Now()
+	if entry.Fingerprint == "" && entry.Peer != "" {
+		entry.Fingerprint, _ = en.cryptoManager.PeerFingerprint(entry.Peer)
+	}
+	if err := en.auditLog.Record(entry); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if entry.Severity == auditCritical {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("🚨 %s (see /audit)", entry.Detail)),
+		})
+	}
+}
+
+// auditPeerKey records a key a peer presented if it is new for its node ID, or differs from the
+// one it had, this run or in an earlier one
+func (en *EnhancedNode) auditPeerKey(nodeID, connID, fingerprint, source string) {
+	previous, known := en.cryptoManager.PeerFingerprint(nodeID)
+	if !known {
+		previous, known = en.auditLog.PeerKey(nodeID)
+	}
+	switch {
+	case !known:
+		en.audit(AuditEntry{
+			Event: auditKeyFirstSeen, Severity: auditInfo, Peer: nodeID, Connection: connID, Fingerprint: fingerprint,
+			Detail: fmt.Sprintf("first key seen for %s, in %s", nodeID, source),
+		})
+	case previous != fingerprint:
+		en.audit(AuditEntry{
+			Event: auditKeyChanged, Severity: auditCritical, Peer: nodeID, Connection: connID, Fingerprint: fingerprint,
+			Detail: fmt.Sprintf("%s's key changed from %s to %s, in %s", nodeID,
+				shortFingerprint(previous), shortFingerprint(fingerprint), source),
+		})
+	}
+}
+
+// handleAuditCommand processes /audit [count], showing the newest security events
+func (en *EnhancedNode) handleAuditCommand(args string) {
+	count := auditShowDefault
+	if arg := strings.TrimSpace(args); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			en.notifyUI(Message{
+				SenderID: "System",
+				Content:  []byte("Usage: /audit [count]"),
+			})
+			return
+		}
+		count = min(n, auditRecentLimit)
+	}
+
+	entries := en.auditLog.Recent(count)
+	var content strings.Builder
+	if len(entries) == 0 {
+		content.WriteString("🛡️ No security events recorded yet")
+	} else {
+		content.WriteString(fmt.Sprintf("🛡️ Last %d security event(s), from %s:", len(entries), en.auditLog.path))
+	}
+	for _, entry := range entries {
+		content.WriteString("\n  " + entry.String())
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(content.String()),
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAuditLogRotationKeepsKeys fills the log past two rotations, so the entry that first recorded
+// a peer's key is gone from both files, then reopens it and checks a different key from that peer
+// is still caught as a change
+func TestAuditLogRotationKeepsKeys(t *testing.T) {
+	dataDir := t.TempDir()
+	al, err := NewAuditLog(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := al.Record(AuditEntry{Time: now, Event: auditKeyFirstSeen, Severity: auditInfo, Peer: "peer", Fingerprint: "aaaa"}); err != nil {
+		t.Fatal(err)
+	}
+	filler := AuditEntry{Time: now, Event: auditDecryptFailure, Severity: auditWarning, Peer: "other", Detail: strings.Repeat("x", 10_000)}
+	for range 2 * auditLogMaxBytes / len(filler.Detail) {
+		if err := al.Record(filler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{al.path, al.path + ".1"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), auditKeyFirstSeen) {
+			t.Fatalf("%s still holds the first entry; the log didn't rotate twice", filepath.Base(path))
+		}
+	}
+
+	reopened, err := NewAuditLog(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint, known := reopened.PeerKey("peer"); !known || fingerprint != "aaaa" {
+		t.Fatalf("reopened log has key %q (known %v) for the peer, want aaaa", fingerprint, known)
+	}
+	for _, entry := range reopened.Recent(auditRecentLimit) {
+		if entry.Event == auditKeyCarried {
+			t.Fatal("a carried key was listed as an event")
+		}
+	}
+
+	node := newTestNetwork(t, 0).newNode()
+	node.auditLog = reopened
+	node.auditPeerKey("peer", "conn", "bbbb", "a handshake")
+	recent := reopened.Recent(1)
+	if len(recent) != 1 || recent[0].Event != auditKeyChanged || recent[0].Severity != auditCritical {
+		t.Errorf("a new key after the restart was recorded as %+v, want a critical key change", recent)
+	}
+}
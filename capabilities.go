@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Capabilities a node announces. Peers only check for names they know; anything else a newer
+// peer announces is kept, shown by /whois and otherwise ignored.
+const (
+	capabilityAck           = "ack"            // Acknowledges messages that ask for delivery receipts
+	capabilityEphemeral     = "ephemeral"      // Removes ephemeral messages when they expire
+	capabilityFiles         = "files"          // Receives file transfers
+	capabilityHistorySync   = "history-sync"   // Answers history sync requests
+	capabilityPeerRecords   = "peer-records"   // Exchanges signed peer records
+	capabilityVoice         = "voice"          // Receives voice messages
+	capabilityVoicePlayback = "voice-playback" // Has an audio output to play voice messages on
+	capabilityDHT           = "dht"            // Is in the DHT, so it can be found by fingerprint
+	capabilityRooms         = "rooms"          // Joins rooms by proving their passphrase, and takes room messages
+	capabilityReadReceipts  = "read-receipts"  // Understands read receipts, whether or not it shows them
+	capabilityGzip          = "gzip"           // Takes gzip-compressed session messages
+	capabilitySearch        = "search"         // Understands file searches and /get; answers them if it shares files
+	capabilityFileRanges    = "file-ranges"    // Sends chunk ranges of shared files by SHA-256, for multi-source downloads
+
+	maxCapabilities      = 64 // Most capabilities kept from a peer
+	maxCapabilityLength  = 32 // Longest capability name kept
+	capabilityNameLetter = "abcdefghijklmnopqrstuvwxyz0123456789.-_"
+)
+
+// knownCapabilities are the names this version understands, for /whois
+var knownCapabilities = map[string]bool{
+	capabilityAck:           true,
+	capabilityEphemeral:     true,
+	capabilityFiles:         true,
+	capabilityHistorySync:   true,
+	capabilityPeerRecords:   true,
+	capabilityVoice:         true,
+	capabilityVoicePlayback: true,
+	capabilityDHT:           true,
+	capabilityRooms:         true,
+	capabilityReadReceipts:  true,
+	capabilityGzip:          true,
+	capabilitySearch:        true,
+	capabilityFileRanges:    true,
+	quicCapability:          true,
+}
+
+// Capabilities is the set of capabilities a peer announced, sorted
+type Capabilities []string
+
+// parseCapabilities keeps the well-formed names a peer announced, sorted and without duplicates
+func parseCapabilities(announced []string) Capabilities {
+	seen := make(map[string]bool)
+	capabilities := Capabilities{}
+	for _, name := range announced {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || len(name) > maxCapabilityLength || strings.Trim(name, capabilityNameLetter) != "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		capabilities = append(capabilities, name)
+		if len(capabilities) == maxCapabilities {
+			break
+		}
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
+
+// Has reports whether the capability was announced
+func (c Capabilities) Has(name string) bool {
+	i := sort.SearchStrings(c, name)
+	return i < len(c) && c[i] == name
+}
+
+// String lists the capabilities, marking the ones this version doesn't know
+func (c Capabilities) String() string {
+	if len(c) == 0 {
+		return "none"
+	}
+	names := make([]string, len(c))
+	for i, name := range c {
+		if knownCapabilities[name] {
+			names[i] = name
+		} else {
+			names[i] = name + " (unknown)"
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// ownCapabilities returns what this node announces to its peers
+func (n *Node) ownCapabilities() []string {
+	if n.localCapabilities != nil {
+		return n.localCapabilities()
+	}
+	return nil
+}
+
+// capabilities returns what the node supports, given its current setup
+func (en *EnhancedNode) capabilities() []string {
+	capabilities := []string{
+		capabilityAck,
+		capabilityEphemeral,
+		capabilityFiles,
+		capabilityHistorySync,
+		capabilityPeerRecords,
+		capabilityVoice,
+		capabilityRooms,
+		capabilityReadReceipts,
+		capabilityGzip,
+		capabilitySearch,
+		capabilityFileRanges,
+	}
+	if en.voiceManager != nil && en.voiceManager.outputError() == nil {
+		capabilities = append(capabilities, capabilityVoicePlayback)
+	}
+	if en.quic != nil {
+		capabilities = append(capabilities, quicCapability)
+	}
+	if en.dht != nil {
+		capabilities = append(capabilities, capabilityDHT)
+	}
+	return capabilities
+}
+
+// setCapabilities records what a connected peer announced
+func (n *Node) setCapabilities(peer *Peer, nodeID string, announced []string) {
+	capabilities := parseCapabilities(announced)
+	peer.capabilities.Store(&capabilities)
+	n.noteCapabilities(nodeID, capabilities)
+	log.Printf("Peer %s supports: %s", nodeID, capabilities)
+}
+
+// peerCapabilities returns what a connected peer announced. It reports false for peers that
+// announced nothing, older versions that predate capabilities; callers assume they support what
+// every version did.
+func (en *EnhancedNode) peerCapabilities(peerID string) (Capabilities, bool) {
+	connID, _, err := en.resolvePeer(peerID)
+	if err != nil {
+		return nil, false
+	}
+	en.peersMutex.RLock()
+	peer, exists := en.conns[connID]
+	en.peersMutex.RUnlock()
+	if !exists {
+		return nil, false
+	}
+	capabilities := peer.capabilities.Load()
+	if capabilities == nil {
+		return nil, false
+	}
+	return *capabilities, true
+}
+
+// lacksCapability reports whether a peer announced its capabilities without this one. Peers
+// that announced nothing are given the benefit of the doubt.
+func (en *EnhancedNode) lacksCapability(peerID, name string) bool {
+	capabilities, announced := en.peerCapabilities(peerID)
+	return announced && !capabilities.Has(name)
+}
+
+// refuseWithout tells the user, and reports true, if a peer lacks the capability an action needs
+func (en *EnhancedNode) refuseWithout(peerID, name, action string) bool {
+	if !en.lacksCapability(peerID, name) {
+		return false
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("❌ Can't %s %s: it doesn't support %s (see /whois %s)", action, peerID, name, peerID)),
+	})
+	return true
+}
+
+// handshakeCarriedCapabilities reports whether a connection's Noise handshake already carried
+// our capabilities
+func (en *EnhancedNode) handshakeCarriedCapabilities(connID string) bool {
+	en.peersMutex.RLock()
+	peer, exists := en.conns[connID]
+	en.peersMutex.RUnlock()
+	if !exists {
+		return false
+	}
+	ac, ok := peerAuthenticatedConn(peer)
+	if !ok {
+		return false
+	}
+	_, noise := ac.(*noiseConn)
+	return noise
+}
+
+// sendCapabilitiesTo announces our capabilities to a peer on a connection that had no Noise
+// handshake to carry them (QUIC or legacy)
+func (en *EnhancedNode) sendCapabilitiesTo(peerID string) {
+	data, err := json.Marshal(en.capabilities())
+	if err != nil {
+		log.Printf("Failed to serialize capabilities: %v", err)
+		return
+	}
+	if err := en.sendEncryptedTo(peerID, data, "capabilities"); err != nil {
+		log.Printf("Failed to send capabilities to %s: %v", peerID, err)
+	}
+}
+
+// handleCapabilities records the capabilities a peer announced after key exchange
+func (en *EnhancedNode) handleCapabilities(msg Message, fromPeerKey bool, plaintext []byte) {
+	if !fromPeerKey {
+		log.Printf("Ignoring capabilities from %s: sender key not known", msg.SenderID)
+		return
+	}
+	var announced []string
+	if err := json.Unmarshal(plaintext, &announced); err != nil {
+		log.Printf("Invalid capabilities from %s: %v", msg.SenderID, err)
+		return
+	}
+
+	en.peersMutex.RLock()
+	peer, exists := en.conns[msg.FromPeerID]
+	en.peersMutex.RUnlock()
+	if exists {
+		en.setCapabilities(peer, msg.SenderID, announced)
+	}
+}
+
+// peersLacking names the connected peers without a capability, for a broadcast that needs it.
+// olderLack says whether peers that announced nothing, older versions, lack it too.
+func (en *EnhancedNode) peersLacking(name string, olderLack bool) []string {
+	var lacking []string
+	for _, peerID := range en.PeerIDs() {
+		_, nodeID, err := en.resolvePeer(peerID)
+		if err != nil {
+			continue
+		}
+		capabilities, announced := en.peerCapabilities(peerID)
+		if (announced && !capabilities.Has(name)) || (!announced && olderLack) {
+			lacking = append(lacking, en.peerLabel(nodeID))
+		}
+	}
+	sort.Strings(lacking)
+	return lacking
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clipboardMaxText is the longest clipboard text /paste sends as a message, in parts if need be;
+// longer text is better sent as a file
+const clipboardMaxText = maxLongTextBytes
+
+// clipboard reads and writes the system clipboard. Each implementation drives the platform's
+// clipboard tool, so nothing needs cgo; tests can substitute their own.
+type clipboard interface {
+	Name() string // The clipboard tool
+	ReadText() (string, error)
+	// ReadImage returns the clipboard image as PNG, or errClipboardNoImage if it holds none
+	ReadImage() ([]byte, error)
+	WriteText(text string) error
+}
+
+var (
+	// errNoClipboard explains how to get clipboard access working
+	errNoClipboard = errors.New("clipboard unavailable: no clipboard tool found in PATH " +
+		"(install wl-clipboard on Wayland, or xclip or xsel on X11)")
+	// errClipboardNoImage is returned by ReadImage when the clipboard holds no image, or the
+	// tool can't read images
+	errClipboardNoImage = errors.New("no image on the clipboard")
+)
+
+// findClipboard returns the clipboard tool for this system, or nil if there is none. It only
+// looks in PATH.
+func findClipboard() clipboard {
+	var candidates []clipboard
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = []clipboard{pbClipboard{}}
+	case "windows":
+		candidates = []clipboard{powershellClipboard{}}
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			candidates = append(candidates, wlClipboard{})
+		}
+		candidates = append(candidates, xclipClipboard{}, xselClipboard{})
+	}
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate.Name()); err == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// clipboardOutput runs a clipboard tool and returns what it wrote to stdout
+func clipboardOutput(name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %w, stderr: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// clipboardInput runs a clipboard tool with text on stdin. Its output isn't captured: X11 tools
+// stay in the background serving the selection, and would hold the pipes open.
+func clipboardInput(text string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(text)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
+
+// wlClipboard uses wl-paste and wl-copy from wl-clipboard, on Wayland
+type wlClipboard struct{}
+
+func (wlClipboard) Name() string { return "wl-paste" }
+
+func (wlClipboard) ReadText() (string, error) {
+	data, err := clipboardOutput("wl-paste", "--no-newline")
+	return string(data), err
+}
+
+func (wlClipboard) ReadImage() ([]byte, error) {
+	types, err := clipboardOutput("wl-paste", "--list-types")
+	if err != nil || !strings.Contains(string(types), "image/png") {
+		return nil, errClipboardNoImage
+	}
+	return clipboardOutput("wl-paste", "--type", "image/png")
+}
+
+func (wlClipboard) WriteText(text string) error {
+	return clipboardInput(text, "wl-copy")
+}
+
+// xclipClipboard uses xclip, on X11
+type xclipClipboard struct{}
+
+func (xclipClipboard) Name() string { return "xclip" }
+
+func (xclipClipboard) ReadText() (string, error) {
+	data, err := clipboardOutput("xclip", "-selection", "clipboard", "-o")
+	return string(data), err
+}
+
+func (xclipClipboard) ReadImage() ([]byte, error) {
+	targets, err := clipboardOutput("xclip", "-selection", "clipboard", "-t", "TARGETS", "-o")
+	if err != nil || !strings.Contains(string(targets), "image/png") {
+		return nil, errClipboardNoImage
+	}
+	return clipboardOutput("xclip", "-selection", "clipboard", "-t", "image/png", "-o")
+}
+
+func (xclipClipboard) WriteText(text string) error {
+	return clipboardInput(text, "xclip", "-selection", "clipboard", "-i")
+}
+
+// xselClipboard uses xsel, on X11. It only handles text.
+type xselClipboard struct{}
+
+func (xselClipboard) Name() string { return "xsel" }
+
+func (xselClipboard) ReadText() (string, error) {
+	data, err := clipboardOutput("xsel", "--clipboard", "--output")
+	return string(data), err
+}
+
+func (xselClipboard) ReadImage() ([]byte, error) { return nil, errClipboardNoImage }
+
+func (xselClipboard) WriteText(text string) error {
+	return clipboardInput(text, "xsel", "--clipboard", "--input")
+}
+
+// pbClipboard uses pbpaste and pbcopy, on macOS. It only handles text.
+type pbClipboard struct{}
+
+func (pbClipboard) Name() string { return "pbpaste" }
+
+func (pbClipboard) ReadText() (string, error) {
+	data, err := clipboardOutput("pbpaste")
+	return string(data), err
+}
+
+func (pbClipboard) ReadImage() ([]byte, error) { return nil, errClipboardNoImage }
+
+func (pbClipboard) WriteText(text string) error {
+	return clipboardInput(text, "pbcopy")
+}
+
+// powershellClipboard uses PowerShell's clipboard cmdlets, on Windows. It only handles text.
+type powershellClipboard struct{}
+
+func (powershellClipboard) Name() string { return "powershell" }
+
+func (powershellClipboard) ReadText() (string, error) {
+	data, err := clipboardOutput("powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw")
+	return strings.TrimSuffix(string(data), "\r\n"), err
+}
+
+func (powershellClipboard) ReadImage() ([]byte, error) { return nil, errClipboardNoImage }
+
+func (powershellClipboard) WriteText(text string) error {
+	return clipboardInput(text, "powershell", "-NoProfile", "-Command", "$input | Set-Clipboard")
+}
+
+// handlePasteCommand processes /paste [peer]: clipboard text is sent as a message, and an image
+// as a file, to the peer or to everyone
+func (en *EnhancedNode) handlePasteCommand(args string) {
+	err := en.paste(strings.TrimSpace(args))
+	var broadcast *BroadcastError
+	if errors.As(err, &broadcast) {
+		en.notifySendError("Clipboard image", err)
+	} else if err != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Can't paste: %v", err)),
+		})
+	}
+}
+
+// paste sends the clipboard contents to peerRef, or to everyone if it is ""
+func (en *EnhancedNode) paste(peerRef string) error {
+	if en.clipboard == nil {
+		return errNoClipboard
+	}
+	nodeID := ""
+	if peerRef != "" {
+		_, resolved, err := en.resolvePeerRef(peerRef)
+		if err != nil {
+			return err
+		}
+		nodeID = resolved
+	}
+
+	image, err := en.clipboard.ReadImage()
+	if err == nil {
+		return en.pasteImage(nodeID, image)
+	}
+	if !errors.Is(err, errClipboardNoImage) {
+		return err
+	}
+
+	text, err := en.clipboard.ReadText()
+	if err != nil {
+		return err
+	}
+	text = strings.TrimRight(text, "\r\n")
+	switch {
+	case strings.TrimSpace(text) == "":
+		return errors.New("the clipboard is empty")
+	case len(text) > clipboardMaxText:
+		return fmt.Errorf("the clipboard holds %s of text, more than the %s a message can take; save it and use /sendfile",
+			formatBytes(int64(len(text))), formatBytes(clipboardMaxText))
+	}
+
+	if nodeID == "" {
+		en.sendChatText(text, "")
+		return nil
+	}
+	sent, err := en.SendEncryptedTextTo(nodeID, text)
+	if err != nil {
+		return err
+	}
+	en.notifyUI(sent)
+	return nil
+}
+
+// pasteImage saves a clipboard image under a generated name and sends it as a file
+func (en *EnhancedNode) pasteImage(nodeID string, image []byte) error {
+	path := filepath.Join(en.fileManager.fileDir, "clipboard-"+time.Now().Format("20060102-150405")+".png")
+	if err := os.WriteFile(path, image, 0600); err != nil {
+		return fmt.Errorf("failed to save the clipboard image: %w", err)
+	}
+
+	recipients := []string{nodeID}
+	if nodeID == "" {
+		recipients = en.PeerIDs()
+		if len(recipients) == 0 {
+			return errors.New("no connected peers to send the image to")
+		}
+	}
+	var failed []*PeerError
+	offered := 0
+	for _, peerID := range recipients {
+		if en.lacksCapability(peerID, capabilityFiles) {
+			continue
+		}
+		offered++
+		if err := en.fileManager.SendFile(peerID, path); err != nil {
+			log.Printf("Failed to send clipboard image to %s: %v", peerID, err)
+			if nodeID != "" {
+				return err
+			}
+			failed = append(failed, &PeerError{Peer: peerID, Err: err})
+		}
+	}
+	err := newBroadcastError(offered, failed)
+	if sentToAny(err) {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("📋 Offered the clipboard image (%s) as %s", formatBytes(int64(len(image))), filepath.Base(path))),
+		})
+	}
+	return err
+}
+
+// handleCopyCommand processes /copy [id|last], putting a received message's text on the clipboard
+func (en *EnhancedNode) handleCopyCommand(args string) {
+	reply, err := en.copyMessage(strings.TrimSpace(args))
+	if err != nil {
+		reply = fmt.Sprintf("❌ Can't copy: %v", err)
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
+
+// copyMessage puts the text of message ref, a message log ID or "last" (the default), on the clipboard
+func (en *EnhancedNode) copyMessage(ref string) (string, error) {
+	if en.clipboard == nil {
+		return "", errNoClipboard
+	}
+
+	var entry LoggedMessage
+	var found bool
+	if ref == "" || ref == "last" {
+		entry, found = en.messageLog.LastFromPeer()
+		if !found {
+			return "", errors.New("no message from a peer yet")
+		}
+	} else {
+		id, err := strconv.ParseInt(ref, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%q isn't a message ID (see GET /messages) or \"last\"", ref)
+		}
+		if entry, found = en.messageLog.Get(id); !found {
+			return "", fmt.Errorf("no message %d (only the last %d are kept)", id, messageLogLimit)
+		}
+	}
+
+	if err := en.clipboard.WriteText(entry.Content); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("📋 Copied message %d from %s (%s)", entry.ID, entry.SenderID, formatBytes(int64(len(entry.Content)))), nil
+}
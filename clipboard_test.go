@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeClipboard stands in for the system clipboard, holding text, a PNG image or nothing
+type fakeClipboard struct {
+	mu      sync.Mutex
+	text    string
+	image   []byte
+	written []string
+}
+
+func (fc *fakeClipboard) Name() string { return "fake" }
+
+func (fc *fakeClipboard) ReadText() (string, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.text, nil
+}
+
+func (fc *fakeClipboard) ReadImage() ([]byte, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.image == nil {
+		return nil, errClipboardNoImage
+	}
+	return fc.image, nil
+}
+
+func (fc *fakeClipboard) WriteText(text string) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.written = append(fc.written, text)
+	return nil
+}
+
+// receivedFile returns the contents of the file named like pattern that node received, if any
+func receivedFile(node *EnhancedNode, pattern string) []byte {
+	var data []byte
+	filepath.WalkDir(node.dataDir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if matched, _ := filepath.Match(pattern, entry.Name()); matched {
+				data, _ = os.ReadFile(path)
+			}
+		}
+		return nil
+	})
+	return data
+}
+
+// TestPaste sends clipboard text as a message and a clipboard image as a file, and explains an
+// empty clipboard and a missing clipboard tool
+func TestPaste(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	tn.connect(a, b)
+	clip := &fakeClipboard{text: "from the clipboard\n"}
+	a.clipboard = clip
+
+	a.handlePasteCommand("")
+	waitForText(t, b, a.ID, "from the clipboard")
+
+	var png1x1 bytes.Buffer
+	if err := png.Encode(&png1x1, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	clip.mu.Lock()
+	clip.image = png1x1.Bytes()
+	clip.mu.Unlock()
+	a.handlePasteCommand(b.ID)
+	waitForNotice(t, a, "Offered the clipboard image")
+	waitFor(t, "b to receive the image", func() bool {
+		return bytes.Equal(receivedFile(b, "clipboard-*.png"), png1x1.Bytes())
+	})
+
+	clip.mu.Lock()
+	clip.image, clip.text = nil, " \n"
+	clip.mu.Unlock()
+	a.handlePasteCommand("")
+	waitForNotice(t, a, "Can't paste: the clipboard is empty")
+
+	a.clipboard = nil
+	a.handlePasteCommand("")
+	waitForNotice(t, a, "Can't paste: "+errNoClipboard.Error())
+}
+
+// TestCopy puts the last message from a peer, or one named by ID, on the clipboard, and refuses
+// IDs it doesn't know
+func TestCopy(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	tn.connect(a, b)
+	clip := &fakeClipboard{}
+	b.clipboard = clip
+
+	b.handleCopyCommand("")
+	waitForNotice(t, b, "Can't copy: no message from a peer yet")
+
+	a.SendEncryptedText("first")
+	waitForText(t, b, a.ID, "first")
+	a.SendEncryptedText("second")
+	waitForText(t, b, a.ID, "second")
+	var firstID int64
+	for _, msg := range b.messageLog.Since(0) {
+		if msg.SenderID == a.ID && msg.Content == "first" {
+			firstID = msg.ID
+		}
+	}
+
+	b.handleCopyCommand("last")
+	waitForNotice(t, b, "Copied message")
+	b.handleCopyCommand(strconv.FormatInt(firstID, 10))
+	clip.mu.Lock()
+	if strings.Join(clip.written, ",") != "second,first" {
+		t.Errorf("copied %q, want the last message and then the first", clip.written)
+	}
+	clip.mu.Unlock()
+
+	b.handleCopyCommand("99999")
+	waitForNotice(t, b, "Can't copy: no message 99999")
+	b.handleCopyCommand("yesterday")
+	waitForNotice(t, b, `Can't copy: "yesterday" isn't a message ID`)
+
+	b.clipboard = nil
+	b.handleCopyCommand("last")
+	waitForNotice(t, b, "Can't copy: "+errNoClipboard.Error())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Clock is where the node gets the time and its timers, so that timing logic (announce backoff,
+// gossip rounds, redial backoff, transfer and search timeouts, read receipt batching) can be
+// driven by a fake clock instead of real sleeps. Connection deadlines stay on the system clock:
+// the network enforces them.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker is the part of time.Ticker the node uses
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// Timer is the part of time.Timer the node uses
+type Timer interface {
+	Chan() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// Random is where the node gets randomness that needn't be unpredictable: interval jitter and
+// file IDs. Keys, nonces and tokens always come from crypto/rand.
+type Random interface {
+	Float64() float64
+	Uint64() uint64
+}
+
+// WithClock makes a node take the time and its timers from clock instead of the system clock
+func WithClock(clock Clock) NodeOption {
+	return func(options *nodeOptions) {
+		options.clock = clock
+	}
+}
+
+// WithRandom makes a node take jitter and file IDs from random instead of math/rand
+func WithRandom(random Random) NodeOption {
+	return func(options *nodeOptions) {
+		options.random = random
+	}
+}
+
+// systemClock is the default Clock: the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) NewTicker(d time.Duration) Ticker       { return systemTicker{time.NewTicker(d)} }
+func (systemClock) NewTimer(d time.Duration) Timer         { return systemTimer{time.NewTimer(d)} }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+type systemTicker struct{ *time.Ticker }
+
+func (t systemTicker) Chan() <-chan time.Time { return t.C }
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) Chan() <-chan time.Time { return t.C }
+
+// systemRandom is the default Random: math/rand's global source, which is safe to share
+type systemRandom struct{}
+
+func (systemRandom) Float64() float64 { return rand.Float64() }
+func (systemRandom) Uint64() uint64   { return rand.Uint64() }
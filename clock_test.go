@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time moves only when a test calls Advance, firing the timers and
+// tickers that come due on the way, in order
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	// Near the real time, so records signed on it look current to code still on the system clock
+	return &fakeClock{now: time.Now().Truncate(time.Second)}
+}
+
+// fakeTimer is a timer, a ticker (period set) or an AfterFunc (fn set) of a fakeClock
+type fakeTimer struct {
+	clock  *fakeClock
+	ch     chan time.Time
+	fn     func()
+	when   time.Time
+	period time.Duration
+	active bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) add(d, period time.Duration, fn func()) *fakeTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &fakeTimer{clock: c, ch: make(chan time.Time, 1), fn: fn, when: c.now.Add(d), period: period, active: true}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker          { return fakeTicker{c.add(d, d, nil)} }
+func (c *fakeClock) NewTimer(d time.Duration) Timer            { return c.add(d, 0, nil) }
+func (c *fakeClock) After(d time.Duration) <-chan time.Time    { return c.add(d, 0, nil).ch }
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer { return c.add(d, 0, f) }
+
+func (t *fakeTimer) Chan() <-chan time.Time { return t.ch }
+
+type fakeTicker struct{ timer *fakeTimer }
+
+func (t fakeTicker) Chan() <-chan time.Time { return t.timer.ch }
+func (t fakeTicker) Stop()                  { t.timer.Stop() }
+
+// Reset and Stop discard a tick not yet taken, as time.Timer does since Go 1.23
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := t.active
+	t.drain()
+	t.when = t.clock.now.Add(d)
+	t.active = true
+	return wasActive
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	wasActive := t.active
+	t.drain()
+	t.active = false
+	return wasActive
+}
+
+func (t *fakeTimer) drain() {
+	select {
+	case <-t.ch:
+	default:
+	}
+}
+
+// Advance moves the time on by d, firing each timer as the time reaches it
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, timer := range c.timers {
+			if timer.active && !timer.when.After(end) && (next == nil || timer.when.Before(next.when)) {
+				next = timer
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			next.active = false
+		}
+		if next.fn != nil {
+			go next.fn()
+			continue
+		}
+		select {
+		case next.ch <- c.now:
+		default:
+			// A ticker whose last tick wasn't taken drops this one, as time.Ticker does
+		}
+	}
+	c.now = end
+	c.mutex.Unlock()
+}
+
+// waitForTimer waits until a timer or ticker is set to fire d from now, so that a test advancing
+// the clock doesn't get ahead of the goroutine it is driving
+func (c *fakeClock) waitForTimer(t testing.TB, d time.Duration) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("a timer due in %v", d), func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for _, timer := range c.timers {
+			if timer.active && timer.when.Equal(c.now.Add(d)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// fixedRandom is a Random that always returns the same values; 0.5 makes jitter return the
+// interval unchanged
+type fixedRandom struct{ value float64 }
+
+func (r fixedRandom) Float64() float64 { return r.value }
+func (r fixedRandom) Uint64() uint64   { return uint64(r.value * (1 << 63)) }
+
+// dialRecorder is a Transport that notes when each dial was made, by a node's clock
+type dialRecorder struct {
+	Transport
+	clock *fakeClock
+	mutex sync.Mutex
+	dials []time.Time
+}
+
+func (d *dialRecorder) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	d.mutex.Lock()
+	d.dials = append(d.dials, d.clock.Now())
+	d.mutex.Unlock()
+	return d.Transport.Dial(addr, timeout)
+}
+
+func (d *dialRecorder) count() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.dials)
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+
+	timer := clock.NewTimer(2 * time.Second)
+	ticker := clock.NewTicker(time.Second)
+	fired := make(chan struct{})
+	clock.AfterFunc(1500*time.Millisecond, func() { close(fired) })
+
+	clock.Advance(time.Second - 1)
+	select {
+	case <-timer.Chan():
+		t.Fatal("timer fired early")
+	case <-ticker.Chan():
+		t.Fatal("ticker fired early")
+	default:
+	}
+
+	clock.Advance(1)
+	if tick := <-ticker.Chan(); !tick.Equal(start.Add(time.Second)) {
+		t.Errorf("ticker fired at %v, want %v", tick.Sub(start), time.Second)
+	}
+	clock.Advance(time.Second)
+	if fire := <-timer.Chan(); !fire.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("timer fired at %v, want %v", fire.Sub(start), 2*time.Second)
+	}
+	<-fired
+	if tick := <-ticker.Chan(); !tick.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("ticker fired again at %v, want %v", tick.Sub(start), 2*time.Second)
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("Reset of a fired timer reported it active")
+	}
+	if !timer.Stop() {
+		t.Error("Stop of a reset timer reported it inactive")
+	}
+	clock.Advance(time.Hour)
+	select {
+	case <-timer.Chan():
+		t.Error("stopped timer fired")
+	default:
+	}
+}
+
+// TestGossipInterval checks that a record b learns reaches a only at b's next gossip round,
+// gossipInterval after the last with the jitter fixed at none
+func TestGossipInterval(t *testing.T) {
+	clock := newFakeClock()
+	_, a, b := connectedPair(t, WithClock(clock), WithRandom(fixedRandom{0.5}))
+	waitFor(t, "a and b to hold the same records", func() bool {
+		return len(a.peerRecords.Versions()) == 2 && a.peerRecords.Digest() == b.peerRecords.Digest()
+	})
+
+	// The record of a node that isn't running, so a can only hear of it from b
+	dir := t.TempDir()
+	testKeys(t, 2, dir)
+	absent, err := NewCryptoManager(filepath.Join(dir, keysDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const absentID = memoryHost + ":1"
+	record, err := newPeerRecord(absent, absentID, []string{absentID}, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.waitForTimer(t, gossipInterval)
+	b.peerRecords.Put(record)
+
+	clock.Advance(gossipInterval - time.Nanosecond)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := a.peerRecords.Get(absentID); ok {
+		t.Fatal("a had the record before b's gossip round")
+	}
+
+	clock.Advance(time.Nanosecond)
+	waitFor(t, "a to hold the record", func() bool {
+		_, ok := a.peerRecords.Get(absentID)
+		return ok
+	})
+}
+
+func TestAckTimeout(t *testing.T) {
+	clock := newFakeClock()
+	tn := newTestNetwork(t, 0)
+	node := tn.newNode(WithClock(clock))
+	t.Cleanup(func() { node.shutdownWithin(testWait) })
+
+	transfer := &FileTransfer{FileID: "f", TotalChunks: 100, ackSignal: make(chan struct{}, 1)}
+	window := newChunkWindow()
+	result := make(chan error, 1)
+	go func() {
+		result <- node.fileManager.waitForWindow(transfer, window.size, window)
+	}()
+
+	// An ack that frees no room restarts the wait
+	clock.waitForTimer(t, chunkAckTimeout)
+	clock.Advance(chunkAckTimeout - time.Second)
+	transfer.ackSignal <- struct{}{}
+	clock.waitForTimer(t, chunkAckTimeout)
+	clock.Advance(chunkAckTimeout - time.Second)
+	select {
+	case err := <-result:
+		t.Fatalf("wait ended before the timeout: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case err := <-result:
+		if !errors.Is(err, errAckTimeout) {
+			t.Errorf("wait ended with %v, want errAckTimeout", err)
+		}
+	case <-time.After(testWait):
+		t.Fatal("wait didn't time out")
+	}
+}
+
+func TestIdleIncomingTransferDropped(t *testing.T) {
+	clock := newFakeClock()
+	tn := newTestNetwork(t, 0)
+	node := tn.newNode(WithClock(clock))
+	t.Cleanup(func() { node.shutdownWithin(testWait) })
+
+	ftm := node.fileManager
+	stalled := &FileTransfer{FileID: "stalled", FileName: "stalled.bin", PeerID: "peer", Status: "active", Chunks: map[int][]byte{}, heard: clock.Now()}
+	pending := &FileTransfer{FileID: "pending", FileName: "pending.bin", PeerID: "peer", Status: "pending", Chunks: map[int][]byte{}}
+	ftm.mutex.Lock()
+	ftm.activeTransfers[stalled.FileID] = stalled
+	ftm.activeTransfers[pending.FileID] = pending
+	ftm.mutex.Unlock()
+
+	node.wg.Add(1)
+	go ftm.expireIncoming()
+	clock.waitForTimer(t, transferSweepEvery)
+
+	exists := func(id string) bool {
+		ftm.mutex.RLock()
+		defer ftm.mutex.RUnlock()
+		_, ok := ftm.activeTransfers[id]
+		return ok
+	}
+
+	// A chunk halfway through puts the limit back
+	clock.Advance(incomingIdleLimit / 2)
+	stalled.mutex.Lock()
+	stalled.heard = clock.Now()
+	stalled.mutex.Unlock()
+	clock.Advance(incomingIdleLimit)
+	time.Sleep(50 * time.Millisecond)
+	if !exists("stalled") {
+		t.Fatal("transfer dropped before it was idle for the limit")
+	}
+
+	clock.Advance(transferSweepEvery)
+	waitFor(t, "the idle transfer to be dropped", func() bool { return !exists("stalled") })
+	stalled.mutex.Lock()
+	status := stalled.Status
+	stalled.mutex.Unlock()
+	if status != "failed" {
+		t.Errorf("idle transfer ended %s, want failed", status)
+	}
+	if !exists("pending") {
+		t.Error("an offer not yet accepted was dropped")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// argKind says what a command argument is, for tab completion
+type argKind int
+
+const (
+	argText argKind = iota // Free text, not completed
+	argPeer                // Connected peer (connection or node ID)
+	argFile                // Local file path
+)
+
+// commandInfo describes a slash command. The command table drives both /help and tab completion.
+type commandInfo struct {
+	Name    string
+	Usage   string // Arguments as shown in help
+	Help    string
+	Section string
+	Args    []argKind // What each argument completes to
+}
+
+// commandSections lists help sections in display order
+var commandSections = []string{
+	"🔗 Connection",
+	"💬 Chat",
+	"🚪 Rooms",
+	"👋 Presence",
+	"🔔 Mentions",
+	"🔇 Muting",
+	"📁 File Sharing",
+	"🎙️ Voice Messages",
+	"📋 General",
+}
+
+// commandTable holds every slash command the node understands
+var commandTable = []commandInfo{
+	{Name: "/connect", Usage: "<addr|alias|fingerprint> [fingerprint [invitation]]", Help: "Connect to a peer, e.g. /connect 127.0.0.1:8080 (or <name>.onion:<port> with -tor, or a key fingerprint with -dht); a fingerprint after the address requires and trusts that key", Section: "🔗 Connection"},
+	{Name: "/contact", Usage: "add|remove|list [alias] [peer]", Help: "Save a peer under an alias, pinned to its key; aliases work wherever a peer is expected", Section: "🔗 Connection"},
+	{Name: "/peers", Usage: "[-v]", Help: "List connected peers and their status; -v adds the version each runs and what it supports", Section: "🔗 Connection"},
+	{Name: "/whois", Usage: "<peer>", Help: "Show everything known about a peer: key, contact, connection, capabilities, version, latency, traffic and transfers", Section: "🔗 Connection", Args: []argKind{argPeer}},
+	{Name: "/discovered", Help: "List peers found by discovery and gossip, with the retries of those that failed to connect", Section: "🔗 Connection"},
+	{Name: "/invite", Usage: "[alias]", Help: "Create a one-time invitation that saves whoever uses it as a contact, or list open ones", Section: "🔗 Connection"},
+	{Name: "/share", Usage: "[qr]", Help: "Show a blob (or QR code) with your addresses and key, for /add on the other side", Section: "🔗 Connection"},
+	{Name: "/add", Usage: "<blob> [alias]", Help: "Save the peer in a blob from /share as a contact pinned to its key, and connect to it", Section: "🔗 Connection"},
+	{Name: "/lock", Help: "Stop accepting new connections, dialling discovered peers and announcing yourself on the LAN; connected peers stay", Section: "🔗 Connection"},
+	{Name: "/unlock", Help: "Accept new connections and discovery again after /lock", Section: "🔗 Connection"},
+	{Name: "/myaddr", Help: "Show the address peers connect to you at (your .onion address with -tor)", Section: "🔗 Connection"},
+
+	{Name: "/msg", Usage: "<peer|#room> <text>", Help: "Send a message to one peer only, or to the members of a room", Section: "💬 Chat", Args: []argKind{argPeer}},
+	{Name: "/close", Help: "Close the direct message or room tab being shown (TUI)", Section: "💬 Chat"},
+	{Name: "/me", Usage: "<action>", Help: "Send an action, e.g. /me waves → * You waves", Section: "💬 Chat"},
+	{Name: "/shrug", Usage: "[text]", Help: `Send text followed by ¯\_(ツ)_/¯`, Section: "💬 Chat"},
+	{Name: "/ephemeral", Usage: "<seconds> <text>", Help: "Send a message that disappears after the given time", Section: "💬 Chat"},
+	{Name: "/paste", Usage: "[peer]", Help: "Send the clipboard to everyone, or to one peer: text as a message, an image as a PNG file", Section: "💬 Chat", Args: []argKind{argPeer}},
+	{Name: "/copy", Usage: "[id|last]", Help: "Copy a received message to the clipboard (IDs are in GET /messages; default: the last one)", Section: "💬 Chat"},
+	{Name: "//", Usage: "text", Help: `Send a message that starts with "/"`, Section: "💬 Chat"},
+
+	{Name: "/join", Usage: "<#room> [passphrase]", Help: "Join a room; peers that know the passphrase prove it to each other before room messages flow", Section: "🚪 Rooms"},
+	{Name: "/room", Usage: "[list|create <#room> [passphrase]|setpass <#room> [passphrase]|topic <#room> <text>|op <#room> <peer>|kick <#room> <peer>|leave <#room>]", Help: "List your rooms with who is in them, their topics and ops, start a room as its op, or leave one; ops give a room a new passphrase (none opens it), set the topic, make other ops and kick members", Section: "🚪 Rooms"},
+
+	{Name: "/status", Usage: "<online|away|busy> [text]", Help: "Set your status, or /status <text> for a custom message", Section: "👋 Presence"},
+
+	{Name: "/keywords", Usage: "add|remove|list [word]", Help: "Watch for words in incoming messages (your nick always counts)", Section: "🔔 Mentions"},
+	{Name: "/notify", Usage: "[on|off|mentions]", Help: "Desktop notifications while the TUI is in the background (/notify preview off hides text)", Section: "🔔 Mentions"},
+	{Name: "/notifications", Usage: "[#all|#room|peer] [all|mentions|off|default]", Help: "What notifies in a conversation (default: the one shown); off also stops unread counts (TUI)", Section: "🔔 Mentions", Args: []argKind{argPeer}},
+	{Name: "/dnd", Usage: "[duration|off]", Help: "Do not disturb: no bell or desktop notifications for a while, e.g. /dnd 1h (TUI)", Section: "🔔 Mentions"},
+
+	{Name: "/mute", Usage: "<peer>", Help: "Hide a peer's messages (the connection and files keep working)", Section: "🔇 Muting", Args: []argKind{argPeer}},
+	{Name: "/unmute", Usage: "<peer>", Help: "Show a peer's messages again", Section: "🔇 Muting", Args: []argKind{argPeer}},
+	{Name: "/muted", Help: "List muted peers and how many messages were hidden", Section: "🔇 Muting"},
+
+	{Name: "/sendfile", Usage: "<peer|#room> <path>", Help: "Send a file to a peer, or to a room's members", Section: "📁 File Sharing", Args: []argKind{argPeer, argFile}},
+	{Name: "/accept", Usage: "[id]", Help: "Receive a file you were offered (the ID can be left out if there is one offer)", Section: "📁 File Sharing"},
+	{Name: "/reject", Usage: "[id]", Help: "Decline a file you were offered", Section: "📁 File Sharing"},
+	{Name: "/search", Usage: "<term>", Help: "Search connected peers' shared directories for file names containing the term", Section: "📁 File Sharing"},
+	{Name: "/get", Usage: "<n>", Help: "Download result n of the last /search, from every peer with the same file", Section: "📁 File Sharing"},
+
+	{Name: "/voice", Usage: "<seconds> [peer]", Help: "Record a voice message (1-60 seconds) and send it to everyone, or to one peer", Section: "🎙️ Voice Messages", Args: []argKind{argText, argPeer}},
+	{Name: "/play", Usage: "<id|last>", Help: "Play a received voice message", Section: "🎙️ Voice Messages"},
+	{Name: "/voicemsgs", Help: "List received voice messages", Section: "🎙️ Voice Messages"},
+	{Name: "/volume", Usage: "[0-100|mute|unmute]", Help: "Set the voice message volume; /volume mute toggles muting (saved in the config)", Section: "🎙️ Voice Messages"},
+	{Name: "/speed", Usage: "[1|1.5|2]", Help: "Set the voice message playback speed (saved in the config)", Section: "🎙️ Voice Messages"},
+	{Name: "/audiodevices", Help: "List microphones and other capture devices", Section: "🎙️ Voice Messages"},
+	{Name: "/audiodevice", Usage: "<number|name|default>", Help: "Record from this device (saved in the config)", Section: "🎙️ Voice Messages"},
+
+	{Name: "/theme", Usage: "[dark|light|mono]", Help: "Switch the TUI color theme, or show the current one", Section: "📋 General"},
+	{Name: "/audit", Usage: "[count]", Help: "Show recent security events: keys seen, changed or verified, refused connections, bad signatures (default 20)", Section: "📋 General"},
+	{Name: "/save", Usage: "[path]", Help: "Save the conversation as text and JSONL (default: a timestamped file in the data dir)", Section: "📋 General", Args: []argKind{argFile}},
+	{Name: "/stats", Help: "Show message counters, duplicates suppressed and data usage", Section: "📋 General"},
+	{Name: "/debug", Help: "Show goroutines against peers, queue depths and transfers, to spot leaks and stuck channels (see -debug-listen for pprof)", Section: "📋 General"},
+	{Name: "/reload", Help: "Re-read the config file and apply what changed (SIGHUP does the same); says which changes need a restart", Section: "📋 General"},
+	{Name: "/doctor", Help: "Check listening, multicast discovery, keys, the data dir and audio, with hints for what fails", Section: "📋 General"},
+	{Name: "/clear", Help: "Clear the message view (the message log is kept)", Section: "📋 General"},
+	{Name: "/version", Help: "Show the version, commit and build of this node", Section: "📋 General"},
+	{Name: "/help", Help: "Show this help", Section: "📋 General"},
+	{Name: "/quit", Help: "Exit the application", Section: "📋 General"},
+}
+
+// lookupCommand finds a command by name
+func lookupCommand(name string) (commandInfo, bool) {
+	for _, cmd := range commandTable {
+		if cmd.Name == name {
+			return cmd, true
+		}
+	}
+	return commandInfo{}, false
+}
+
+// commandNames returns the names of commands starting with prefix, sorted
+func commandNames(prefix string) []string {
+	var names []string
+	for _, cmd := range commandTable {
+		if cmd.Name != "//" && strings.HasPrefix(cmd.Name, prefix) {
+			names = append(names, cmd.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderCommandHelp formats the command table by section. Commands in unavailable are marked with
+// the reason they can't be used.
+func renderCommandHelp(unavailable map[string]string) string {
+	var help strings.Builder
+	for _, section := range commandSections {
+		help.WriteString(section + ":\n")
+		for _, cmd := range commandTable {
+			if cmd.Section != section {
+				continue
+			}
+			usage := cmd.Name
+			if cmd.Usage != "" {
+				usage += " " + cmd.Usage
+			}
+			if cmd.Name == "//" {
+				usage = cmd.Name + cmd.Usage
+			}
+			text := cmd.Help
+			if reason, found := unavailable[cmd.Name]; found {
+				text = fmt.Sprintf("⚠️ unavailable: %s. %s", reason, text)
+			}
+			help.WriteString(fmt.Sprintf("  %-34s %s\n", usage, text))
+		}
+		help.WriteString("\n")
+	}
+	return help.String()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const maxCompletions = 100 // Most candidates offered for one Tab
+
+// tabCompletion is an in-progress Tab completion. Pressing Tab again while the input still
+// holds the last applied candidate moves on to the next one.
+type tabCompletion struct {
+	base       string // Input before the word being completed
+	candidates []string
+	index      int
+	applied    string // Input after the current candidate was applied
+	paths      bool   // Candidates are file paths
+}
+
+// completeInput replaces the last word of the input with the next completion. It reports whether
+// there was anything to complete.
+func (ui *UI) completeInput() bool {
+	input := ui.textarea.Value()
+
+	c := ui.completion
+	if c != nil && input == c.applied {
+		c.index = (c.index + 1) % len(c.candidates)
+	} else {
+		base, candidates, paths := ui.completionCandidates(input)
+		if len(candidates) == 0 {
+			ui.completion = nil
+			return false
+		}
+		c = &tabCompletion{base: base, candidates: candidates, paths: paths}
+		ui.completion = c
+	}
+
+	candidate := c.candidates[c.index]
+	c.applied = c.base + candidate
+	if !strings.HasSuffix(candidate, string(os.PathSeparator)) {
+		c.applied += " " // Ready for the next argument; directories keep going
+	}
+	ui.textarea.SetValue(c.applied)
+	ui.textarea.CursorEnd()
+
+	if len(c.candidates) == 1 {
+		ui.completion = nil // Nothing to cycle through
+	}
+	return true
+}
+
+// completionCandidates splits off the last word of a command and lists what it could be:
+// a command name for the first word, then whatever the command's arguments take. It also
+// reports whether the candidates are file paths.
+func (ui *UI) completionCandidates(input string) (string, []string, bool) {
+	if !strings.HasPrefix(input, "/") || strings.HasPrefix(input, "//") {
+		return "", nil, false
+	}
+
+	split := strings.LastIndexAny(input, " \n") + 1
+	base, word := input[:split], input[split:]
+	if split == 0 {
+		return base, commandNames(word), false
+	}
+
+	args := strings.Fields(base)
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		return base, nil, false
+	}
+
+	// A file path is always the last argument and may contain spaces, so it runs to the end of the input
+	last := len(cmd.Args) - 1
+	if last >= 0 && cmd.Args[last] == argFile && len(args) > last {
+		split = fieldsEnd(input, last+1)
+		return input[:split], fileCandidates(input[split:]), true
+	}
+
+	if len(args)-1 < len(cmd.Args) && cmd.Args[len(args)-1] == argPeer {
+		return base, ui.peerCandidates(word), false
+	}
+	return base, nil, false
+}
+
+// fieldsEnd returns the offset just past the first n fields of s and the space after them
+func fieldsEnd(s string, n int) int {
+	i := 0
+	for ; n > 0; n-- {
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		for i < len(s) && s[i] != ' ' {
+			i++
+		}
+	}
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+// peerCandidates lists connection and node IDs of connected peers starting with prefix
+func (ui *UI) peerCandidates(prefix string) []string {
+	seen := make(map[string]bool)
+	var candidates []string
+	add := func(id string) {
+		if id != "" && !seen[id] && strings.HasPrefix(id, prefix) {
+			seen[id] = true
+			candidates = append(candidates, id)
+		}
+	}
+
+	for _, peerID := range ui.node.PeerIDs() {
+		add(ui.node.PeerInfo(peerID).NodeID)
+		add(peerID)
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// fileCandidates lists files and directories whose path starts with prefix. Hidden entries are
+// only offered once the name being typed starts with a dot.
+func fileCandidates(prefix string) []string {
+	dir, name := filepath.Split(prefix)
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+
+	entries, err := os.ReadDir(readDir)
+	if err != nil {
+		return nil
+	}
+
+	var candidates []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name) {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".") && !strings.HasPrefix(name, ".") {
+			continue
+		}
+		candidate := dir + entry.Name()
+		if entry.IsDir() {
+			candidate += string(os.PathSeparator)
+		}
+		candidates = append(candidates, candidate)
+		if len(candidates) == maxCompletions {
+			break
+		}
+	}
+	return candidates
+}
+
+// renderCompletions lists the completion candidates for the status bar, marking the current one
+func (ui *UI) renderCompletions() string {
+	c := ui.completion
+	if c == nil {
+		return ""
+	}
+
+	names := make([]string, len(c.candidates))
+	for i, candidate := range c.candidates {
+		name := candidate
+		if c.paths {
+			// Show just the entry name, like a shell does
+			name = filepath.Base(strings.TrimSuffix(candidate, string(os.PathSeparator)))
+			if strings.HasSuffix(candidate, string(os.PathSeparator)) {
+				name += string(os.PathSeparator)
+			}
+		}
+		if i == c.index {
+			name = "[" + name + "]"
+		}
+		names[i] = name
+	}
+	return "Tab: " + strings.Join(names, " ")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+const (
+	compressionGzip = "gzip" // SessionMessage.Compression for a gzip-compressed payload
+
+	compressMinBytes    = 1024 // Smaller payloads are sent as they are; gzip's header would eat the saving
+	maxCompressionRatio = 100  // Most a compressed payload may expand, on top of maxEnvelopeBytes
+)
+
+// compressPayload gzips a session message's payload for a peer that takes compressed ones. The
+// payload comes back unchanged, with no compression named, when it is small, doesn't shrink, or
+// shrinks further than a receiver would expand it (maxCompressionRatio). That last case is
+// deliberate: a run of one repeated byte would otherwise be refused as a bomb, so it is sent raw.
+func compressPayload(plaintext []byte) ([]byte, string) {
+	if len(plaintext) < compressMinBytes {
+		return plaintext, ""
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(plaintext); err != nil {
+		return plaintext, ""
+	}
+	if err := writer.Close(); err != nil {
+		return plaintext, ""
+	}
+	if compressed.Len() >= len(plaintext) || len(plaintext) > compressed.Len()*maxCompressionRatio {
+		return plaintext, ""
+	}
+	return compressed.Bytes(), compressionGzip
+}
+
+// decompressPayload expands a session message's payload. It stops reading past maxEnvelopeBytes,
+// or maxCompressionRatio times the compressed size if less, so a small message can't expand
+// into a large allocation; such a payload is refused with an error wrapping errMessageTooLarge.
+func decompressPayload(payload []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "":
+		return payload, nil
+	case compressionGzip:
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed payload: %w", err)
+	}
+	defer reader.Close()
+
+	limit := min(maxEnvelopeBytes, len(payload)*maxCompressionRatio)
+	plaintext, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed payload: %w", err)
+	}
+	if len(plaintext) > limit {
+		return nil, fmt.Errorf("%w: a %s compressed message expanding past %s", errMessageTooLarge,
+			formatBytes(int64(len(payload))), formatBytes(int64(limit)))
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// logLines returns about n bytes of repetitive log text, which compresses well but not past
+// maxCompressionRatio
+func logLines(n int) []byte {
+	var text bytes.Buffer
+	for i := 0; text.Len() < n; i++ {
+		text.WriteString("2024-05-01T12:00:00Z INFO request served path=/api/items/")
+		text.WriteString(strings.Repeat("x", i%17))
+		text.WriteString(" status=200\n")
+	}
+	return text.Bytes()[:n]
+}
+
+// gzipped returns data as compressPayload's receiver would get it from another implementation
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+// TestCompressPayload compresses payloads from the threshold up, and sends raw what wouldn't
+// shrink or would shrink past what a receiver expands
+func TestCompressPayload(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	for _, tc := range []struct {
+		name       string
+		payload    []byte
+		compressed bool
+	}{
+		{"empty", nil, false},
+		{"just under the threshold", logLines(compressMinBytes - 1), false},
+		{"at the threshold", logLines(compressMinBytes), true},
+		{"a large log", logLines(maxEnvelopeBytes), true},
+		{"random, which doesn't shrink", random, false},
+		{"zeros, which would shrink past the ratio", make([]byte, maxEnvelopeBytes), false},
+	} {
+		payload, compression := compressPayload(tc.payload)
+		if compressed := compression == compressionGzip; compressed != tc.compressed {
+			t.Errorf("%s: compression %q", tc.name, compression)
+		}
+		if !tc.compressed && !bytes.Equal(payload, tc.payload) {
+			t.Errorf("%s: sent raw but changed", tc.name)
+		}
+		if tc.compressed && len(payload) >= len(tc.payload) {
+			t.Errorf("%s: %d bytes compressed to %d", tc.name, len(tc.payload), len(payload))
+		}
+
+		expanded, err := decompressPayload(payload, compression)
+		if err != nil || !bytes.Equal(expanded, tc.payload) {
+			t.Errorf("%s: didn't round trip: %v", tc.name, err)
+		}
+	}
+}
+
+// TestDecompressPayload refuses unknown, corrupt and bomb payloads, and expands one right up to
+// each limit
+func TestDecompressPayload(t *testing.T) {
+	if _, err := decompressPayload([]byte("plain"), "zstd"); err == nil || !strings.Contains(err.Error(), `unknown compression "zstd"`) {
+		t.Errorf("unknown compression: %v", err)
+	}
+	if _, err := decompressPayload([]byte("not gzip"), compressionGzip); err == nil || !strings.Contains(err.Error(), "invalid compressed payload") {
+		t.Errorf("not gzip: %v", err)
+	}
+	truncated := gzipped(t, logLines(4096))
+	if _, err := decompressPayload(truncated[:len(truncated)/2], compressionGzip); err == nil || !strings.Contains(err.Error(), "invalid compressed payload") {
+		t.Errorf("truncated: %v", err)
+	}
+
+	// Bombs: well past the envelope limit, and within it but past the ratio
+	for _, size := range []int{10 << 20, maxEnvelopeBytes} {
+		bomb := gzipped(t, make([]byte, size))
+		if _, err := decompressPayload(bomb, compressionGzip); !errors.Is(err, errMessageTooLarge) {
+			t.Errorf("%d bytes of zeros gzipped to %d: %v, want errMessageTooLarge", size, len(bomb), err)
+		}
+	}
+
+	// At the ratio exactly is fine and a byte past it isn't. Zeros compress to the same size over a
+	// range of lengths, so a length of ratio times its compressed size settles within a few tries.
+	size := compressMinBytes
+	for range 10 {
+		size = len(gzipped(t, make([]byte, size))) * maxCompressionRatio
+	}
+	atRatio := gzipped(t, make([]byte, size))
+	if len(atRatio)*maxCompressionRatio != size {
+		t.Fatalf("no length of zeros compressing to 1/%d found near %d", maxCompressionRatio, size)
+	}
+	if expanded, err := decompressPayload(atRatio, compressionGzip); err != nil || len(expanded) != size {
+		t.Errorf("%d bytes expanding exactly %d times: %v", len(atRatio), maxCompressionRatio, err)
+	}
+	pastRatio := gzipped(t, make([]byte, size+1))
+	if _, err := decompressPayload(pastRatio, compressionGzip); len(pastRatio) == len(atRatio) && !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("%d bytes expanding a byte past %d times: %v, want errMessageTooLarge", len(pastRatio), maxCompressionRatio, err)
+	}
+
+	// At the envelope limit exactly is fine
+	payload := logLines(maxEnvelopeBytes)
+	if expanded, err := decompressPayload(gzipped(t, payload), compressionGzip); err != nil || !bytes.Equal(expanded, payload) {
+		t.Errorf("a payload at the envelope limit: %v", err)
+	}
+}
+
+// TestCompressionBetweenNodes sends a long text to a peer that takes gzip and to one that
+// doesn't announce it: only the first gets it compressed, and both get it intact
+func TestCompressionBetweenNodes(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	legacy := tn.newNode()
+	legacy.localCapabilities = func() []string {
+		return slices.DeleteFunc(legacy.capabilities(), func(name string) bool { return name == capabilityGzip })
+	}
+	tn.start(legacy)
+	tn.connect(a, b)
+	tn.connect(a, legacy)
+	waitFor(t, "a to learn its peers' capabilities", func() bool {
+		bCaps, _ := a.peerCapabilities(b.ID)
+		legacyCaps, _ := a.peerCapabilities(legacy.ID)
+		return bCaps.Has(capabilityGzip) && legacyCaps.Has(capabilityFiles)
+	})
+
+	text := logLines(maxTextBytes)
+	for _, tc := range []struct {
+		peer       *EnhancedNode
+		compressed bool
+	}{{b, true}, {legacy, false}} {
+		connID, _, err := a.resolvePeer(tc.peer.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, ok, err := a.sessionFrame(connID, tc.peer.ID, text, "text")
+		if !ok || err != nil {
+			t.Fatalf("session frame for %s: %v", tc.peer.ID, err)
+		}
+		if compressed := bytes.Contains(frame, []byte(`"compression":"gzip"`)); compressed != tc.compressed {
+			t.Errorf("frame for %s compressed: %v, want %v", tc.peer.ID, compressed, tc.compressed)
+		}
+		if tc.compressed && len(frame) > len(text)/2 {
+			t.Errorf("a %d byte text took a %d byte frame", len(text), len(frame))
+		}
+	}
+
+	if _, err := a.SendEncryptedText(string(text)); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, a.ID, string(text))
+	waitForText(t, legacy, a.ID, string(text))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const defaultConfigFile = "config.json"
+
+// Config holds settings loaded from the JSON config file.
+// Every field is optional; a missing file means all defaults.
+type Config struct {
+	Nick              string            `json:"nick,omitempty"`
+	Keywords          []string          `json:"keywords,omitempty"`            // Words that count as mentions
+	MentionBell       bool              `json:"mention_bell,omitempty"`        // Ring the terminal bell on mentions and direct messages in the TUI
+	SaveHistory       bool              `json:"save_history,omitempty"`        // Keep TUI input history in the data dir across sessions
+	MaxMessages       int               `json:"max_messages,omitempty"`        // Messages kept in the TUI view; 0 means the default
+	Theme             string            `json:"theme,omitempty"`               // TUI theme: dark, light or mono
+	ThemeColors       map[string]string `json:"theme_colors,omitempty"`        // Per-element color overrides, e.g. {"peer": "#00AAFF"}
+	Markdown          *bool             `json:"markdown,omitempty"`            // Render *bold*, _italic_, `code` and code blocks in the TUI; nil means on
+	AutoAccept        bool              `json:"auto_accept_files,omitempty"`   // Receive offered files without asking
+	Notify            string            `json:"notify,omitempty"`              // Desktop notifications in the TUI: on, off or mentions
+	NotifyHidePreview bool              `json:"notify_hide_preview,omitempty"` // Leave message text out of desktop notifications
+	Discovery         *bool             `json:"discovery,omitempty"`           // LAN discovery; nil means on, -no-discovery turns it off regardless
+	DHT               bool              `json:"dht,omitempty"`                 // Join the DHT, as -dht does
+	DHTListen         string            `json:"dht_listen,omitempty"`          // UDP address for the DHT; empty means the listen port
+	DHTBootstrap      []string          `json:"dht_bootstrap,omitempty"`       // UDP addresses of DHT nodes to join through
+	DownloadsDir      string            `json:"downloads_dir,omitempty"`       // Where received files go; empty means <data dir>/downloads
+	DownloadsLayout   string            `json:"downloads_layout,omitempty"`    // Subdirectories received files are sorted into, e.g. "{peer}/{month}"
+	SharedDirs        []string          `json:"shared_dirs,omitempty"`         // Directories peers may search with /search and download from with /get
+	AnswerSearches    *bool             `json:"answer_searches,omitempty"`     // Answer peers' searches of shared_dirs; nil means on
+	Volume            *int              `json:"volume,omitempty"`              // Voice message volume, 0-100, set with /volume
+	VoiceMuted        bool              `json:"voice_muted,omitempty"`         // Voice messages play silently, set with /volume mute
+	PlaybackSpeed     float64           `json:"playback_speed,omitempty"`      // 1, 1.5 or 2, set with /speed
+	AudioDevice       string            `json:"audio_device,omitempty"`        // Capture device for /voice, set with /audiodevice; empty means the default
+	Transcribe        *TranscribeConfig `json:"transcribe,omitempty"`          // Command that transcribes received voice messages
+	Hooks             []ExecHookConfig  `json:"hooks,omitempty"`
+	Reputation        *ReputationConfig `json:"reputation,omitempty"`         // Spam thresholds; nil means the defaults
+	SendReadReceipts  bool              `json:"send_read_receipts,omitempty"` // Tell peers when their direct messages were read in the TUI
+	ShowReadReceipts  bool              `json:"show_read_receipts,omitempty"` // Show when peers read our direct messages
+}
+
+// LoadConfig reads the config file at path, returning defaults if it doesn't exist
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// SaveConfig writes the config file, replacing it atomically
+func SaveConfig(path string, config *Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize config: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return nil
+}
+
+// defaultConfigPath returns the config file location inside the data directory
+func defaultConfigPath(dataDir string) string {
+	return filepath.Join(dataDir, defaultConfigFile)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/x/term"
+	"github.com/muesli/termenv"
+	"github.com/rivo/uniseg"
+)
+
+const consolePrompt = "> "
+
+// errConsoleQuit is returned by ReadLine when Ctrl+C is pressed twice on an empty line
+var errConsoleQuit = errors.New("quit with Ctrl+C")
+
+// Console is the plain CLI's line editor. On a terminal it puts stdin in raw mode and draws the
+// prompt itself, so messages and log lines are printed above the prompt and what is being typed
+// is redrawn under them instead of being broken up. It keeps an input history for Up/Down, and
+// Ctrl+C cancels the line rather than killing the node. When stdin isn't a terminal it reads
+// plain lines and prints no prompt. The editing itself is the lineEditor's.
+type Console struct {
+	mutex   sync.Mutex
+	in      *bufio.Reader
+	inFile  *os.File
+	out     *os.File
+	state   *term.State  // The terminal's mode before raw mode; nil when not in raw mode
+	restore func() error // Undoes enabling escape sequences on Windows consoles
+	editor  *lineEditor
+}
+
+// NewConsole creates a console reading from in and drawing on out. Nothing changes on the
+// terminal until Open.
+func NewConsole(in, out *os.File) *Console {
+	return &Console{
+		in:     bufio.NewReader(in),
+		inFile: in,
+		out:    out,
+		editor: newLineEditor(),
+	}
+}
+
+// Open puts the terminal in raw mode and draws the prompt. Log lines are printed above the
+// prompt too while it is open. Without a terminal it does nothing.
+func (c *Console) Open() error {
+	if !isTerminal(c.inFile) || !isTerminal(c.out) {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	state, err := term.MakeRaw(c.inFile.Fd())
+	if err != nil {
+		return fmt.Errorf("failed to put the terminal in raw mode: %w", err)
+	}
+	c.state = state
+	// Windows consoles only take the escape sequences used to redraw the line once asked to;
+	// elsewhere this does nothing
+	if restore, err := termenv.EnableVirtualTerminalProcessing(termenv.NewOutput(c.out)); err == nil {
+		c.restore = restore
+	}
+	if isTerminal(os.Stderr) {
+		log.SetOutput(consoleLogWriter{c})
+	}
+	c.redraw()
+	return nil
+}
+
+// Close gives the terminal back in the mode it had before Open
+func (c *Console) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == nil {
+		return
+	}
+	log.SetOutput(os.Stderr)
+	fmt.Fprint(c.out, "\r\033[K")
+	if c.restore != nil {
+		c.restore()
+	}
+	term.Restore(c.inFile.Fd(), c.state)
+	c.state = nil
+}
+
+// Println prints text above the prompt, which is then drawn again with the line being typed
+func (c *Console) Println(text string) {
+	c.printAbove(c.out, text)
+}
+
+// Clear clears the screen, keeping the line being typed
+func (c *Console) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == nil {
+		return
+	}
+	fmt.Fprint(c.out, "\033[H\033[2J")
+	c.redraw()
+}
+
+// printAbove writes text to w on the lines above the prompt
+func (c *Console) printAbove(w io.Writer, text string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	text = strings.TrimSuffix(text, "\n")
+	if c.state == nil {
+		fmt.Fprintln(w, text)
+		return
+	}
+	// Raw mode leaves out the carriage return a newline normally comes with
+	fmt.Fprint(c.out, "\r\033[K")
+	fmt.Fprint(w, strings.ReplaceAll(text, "\n", "\r\n")+"\r\n")
+	c.redraw()
+}
+
+// consoleLogWriter sends log output above the prompt, still on stderr
+type consoleLogWriter struct {
+	console *Console
+}
+
+func (w consoleLogWriter) Write(p []byte) (int, error) {
+	w.console.printAbove(os.Stderr, string(p))
+	return len(p), nil
+}
+
+// redraw draws the prompt and the line being typed, with the cursor in place. A line too long
+// for the terminal scrolls sideways to keep the cursor in view. The caller must hold the mutex.
+func (c *Console) redraw() {
+	width, _, err := term.GetSize(c.out.Fd())
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	room := max(width-uniseg.StringWidth(consolePrompt)-1, 1)
+	line, cursor := c.editor.line, c.editor.cursor
+	start, end := c.editor.visible(room)
+
+	fmt.Fprintf(c.out, "\r\033[K%s%s", consolePrompt, string(line[start:end]))
+	if back := uniseg.StringWidth(string(line[cursor:end])); back > 0 {
+		fmt.Fprintf(c.out, "\033[%dD", back)
+	}
+}
+
+// ReadLine returns the next line typed. It returns io.EOF on Ctrl+D on an empty line or the end
+// of input, and errConsoleQuit when Ctrl+C is pressed twice on an empty line.
+func (c *Console) ReadLine() (string, error) {
+	c.mutex.Lock()
+	raw := c.state != nil
+	c.mutex.Unlock()
+
+	if !raw {
+		line, err := c.in.ReadString('\n')
+		if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	for {
+		r, _, err := c.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		if line, done, err := c.key(r); done {
+			return line, err
+		}
+	}
+}
+
+// key handles one key typed in raw mode, reporting when the line is done. The mutex keeps output
+// from elsewhere from being drawn halfway through.
+func (c *Console) key(r rune) (string, bool, error) {
+	if r == '\033' {
+		// Read the escape sequence before taking the mutex: the rest of it may still be arriving
+		sequence := c.readEscape()
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.editor.escape(sequence) {
+			c.redraw()
+		}
+		return "", false, nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	action, line := c.editor.key(r, time.Now())
+	switch action {
+	case editIgnored:
+		return "", false, nil
+	case editSubmit:
+		// Chat text comes back as the sent message, so only commands stay on screen as typed
+		if strings.HasPrefix(line, "/") {
+			fmt.Fprint(c.out, "\r\n")
+		}
+		c.redraw()
+		return line, true, nil
+	case editEmpty:
+		fmt.Fprint(c.out, "\r\n")
+	case editCancel:
+		fmt.Fprint(c.out, "^C\r\n")
+	case editQuitHint:
+		fmt.Fprint(c.out, "\r\033[K(press Ctrl+C again to quit, or type /quit)\r\n")
+	case editQuit:
+		fmt.Fprint(c.out, "^C\r\n")
+		return "", true, errConsoleQuit
+	case editEOF:
+		fmt.Fprint(c.out, "\r\n")
+		return "", true, io.EOF
+	case editClear:
+		fmt.Fprint(c.out, "\033[H\033[2J")
+	}
+	c.redraw()
+	return "", false, nil
+}
+
+// readEscape reads the rest of an escape sequence after ESC: the CSI or SS3 sequences terminals
+// send for arrow and editing keys, such as "[A" or "[3~". Anything else is returned as the one
+// key that followed ESC.
+func (c *Console) readEscape() string {
+	r, _, err := c.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return ""
+	}
+	sequence := []rune{r}
+	for {
+		r, _, err := c.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		sequence = append(sequence, r)
+		// Parameters and intermediates are 0x20-0x3f; a final byte ends the sequence
+		if r >= 0x40 && r <= 0x7e || len(sequence) > 16 {
+			return string(sequence)
+		}
+	}
+}
+
+// readConsole reads commands and messages typed in the plain CLI until the input ends, Ctrl+C
+// is pressed twice or the node shuts down. The reads happen in a goroutine of their own, which is
+// left blocked at shutdown: nothing can interrupt a read from stdin.
+func (n *Node) readConsole() {
+	if err := n.console.Open(); err != nil {
+		log.Printf("Line editing unavailable: %v", err)
+	}
+	defer n.console.Close()
+
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			line, err := n.console.ReadLine()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case lines <- line:
+			case <-n.Shutdown:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line := <-lines:
+			if n.submitInput(line) != nil {
+				return
+			}
+		case err := <-readErr:
+			if !errors.Is(err, io.EOF) && !errors.Is(err, errConsoleQuit) {
+				log.Printf("CLI read error: %v", err)
+			}
+			// Run shutdown separately, since it waits for this goroutine
+			go n.shutdown()
+			return
+		case <-n.Shutdown:
+			return
+		}
+	}
+}
+
+// printToConsole prints what the UI would show in the plain CLI, above the prompt
+func (n *Node) printToConsole() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case msg := <-n.uiChannel:
+			n.console.Println(n.formatConsoleMessage(msg))
+		case <-n.Shutdown:
+			return
+		}
+	}
+}
+
+// formatConsoleMessage formats a message as a line of the plain CLI, the way the TUI shows it
+// but without colors
+func (n *Node) formatConsoleMessage(msg Message) string {
+	timestamp := msg.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	prefix := timestamp.Format("15:04:05") + " "
+	if msg.SenderID == "System" {
+		return prefix + string(msg.Content)
+	}
+
+	// Lines after the first are indented so each message still starts a line of its own
+	content := strings.ReplaceAll(string(msg.Content), "\n", "\n    ")
+	sender := msg.SenderID
+	if sender == n.ID {
+		sender = "You"
+	}
+	if msg.Action {
+		return fmt.Sprintf("%s* %s %s", prefix, sender, content)
+	}
+	if msg.Direct {
+		sender += " ✉"
+	}
+	if msg.Room != "" {
+		sender = msg.Room + " " + sender
+	}
+	if msg.Mention {
+		return fmt.Sprintf("%s[%s] » %s", prefix, sender, content)
+	}
+	return fmt.Sprintf("%s[%s] %s", prefix, sender, content)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	contactsFile        = "contacts.json"
+	maxContactAddresses = 5 // Last known addresses kept per contact
+)
+
+// contactAlias is what an alias may look like. It can't contain ":", so it is never mistaken for
+// a node ID or address.
+var contactAlias = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{0,31}$`)
+
+// Contact is an address book entry: an alias for a peer, pinned to the key it had when added
+type Contact struct {
+	Alias       string    `json:"alias"`
+	NodeID      string    `json:"node_id"`             // Node ID the peer last used
+	Fingerprint string    `json:"fingerprint"`         // Pinned key; the alias never follows a different one
+	Addresses   []string  `json:"addresses,omitempty"` // Last known addresses, newest first
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+}
+
+// ContactBook holds the contacts, persisted in the data dir
+type ContactBook struct {
+	mutex    sync.RWMutex
+	path     string
+	contacts map[string]*Contact // By lowercased alias
+}
+
+// NewContactBook loads the contacts from dataDir, starting empty if there are none
+func NewContactBook(dataDir string) (*ContactBook, error) {
+	cb := &ContactBook{
+		path:     filepath.Join(dataDir, contactsFile),
+		contacts: make(map[string]*Contact),
+	}
+
+	data, err := os.ReadFile(cb.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cb, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contacts: %w", err)
+	}
+
+	var contacts []*Contact
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, fmt.Errorf("invalid contacts %s: %w", cb.path, err)
+	}
+	for _, contact := range contacts {
+		cb.contacts[strings.ToLower(contact.Alias)] = contact
+	}
+	return cb, nil
+}
+
+// Get looks up a contact by alias, ignoring case
+func (cb *ContactBook) Get(alias string) (Contact, bool) {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
+	contact, exists := cb.contacts[strings.ToLower(alias)]
+	if !exists {
+		return Contact{}, false
+	}
+	return *contact, true
+}
+
+// Add saves a new contact, reached at its node ID or, if given, at addresses. An alias is never
+// reused and a key is never saved under two aliases.
+func (cb *ContactBook) Add(alias, nodeID, fingerprint string, addresses ...string) error {
+	if !contactAlias.MatchString(alias) {
+		return fmt.Errorf("invalid alias %q (start with a letter; letters, digits, _ . - only)", alias)
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if existing, exists := cb.contacts[strings.ToLower(alias)]; exists {
+		return fmt.Errorf("%s is already a contact (%s); /contact remove it first", existing.Alias, existing.NodeID)
+	}
+	for _, contact := range cb.contacts {
+		if contact.Fingerprint == fingerprint {
+			return fmt.Errorf("%s is already saved as %s", nodeID, contact.Alias)
+		}
+	}
+
+	if len(addresses) == 0 {
+		addresses = []string{nodeID}
+	}
+	cb.contacts[strings.ToLower(alias)] = &Contact{
+		Alias:       alias,
+		NodeID:      nodeID,
+		Fingerprint: fingerprint,
+		Addresses:   slices.Clone(addresses[:min(len(addresses), maxContactAddresses)]),
+		LastSeen:    time.Now(),
+	}
+	return cb.save()
+}
+
+// Remove deletes a contact
+func (cb *ContactBook) Remove(alias string) (Contact, error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	contact, exists := cb.contacts[strings.ToLower(alias)]
+	if !exists {
+		return Contact{}, fmt.Errorf("no contact called %s", alias)
+	}
+	delete(cb.contacts, strings.ToLower(alias))
+	return *contact, cb.save()
+}
+
+// List returns the contacts sorted by alias
+func (cb *ContactBook) List() []Contact {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
+	contacts := make([]Contact, 0, len(cb.contacts))
+	for _, contact := range cb.contacts {
+		contacts = append(contacts, *contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return strings.ToLower(contacts[i].Alias) < strings.ToLower(contacts[j].Alias)
+	})
+	return contacts
+}
+
+// Conflict returns the contact whose pinned key differs from the one a node just presented, if
+// the node uses that contact's node ID
+func (cb *ContactBook) Conflict(nodeID, fingerprint string) (Contact, bool) {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
+	for _, contact := range cb.contacts {
+		if contact.NodeID == nodeID && contact.Fingerprint != fingerprint {
+			return *contact, true
+		}
+	}
+	return Contact{}, false
+}
+
+// ForKey returns the contact pinned to a key
+func (cb *ContactBook) ForKey(fingerprint string) (Contact, bool) {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
+	for _, contact := range cb.contacts {
+		if contact.Fingerprint == fingerprint {
+			return *contact, true
+		}
+	}
+	return Contact{}, false
+}
+
+// Seen records that the contact with this key is connected as nodeID, moving its node ID and
+// addresses along when it comes back from somewhere else
+func (cb *ContactBook) Seen(nodeID, fingerprint string) error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	for _, contact := range cb.contacts {
+		if contact.Fingerprint != fingerprint {
+			continue
+		}
+		contact.NodeID = nodeID
+		contact.LastSeen = time.Now()
+		addresses := []string{nodeID}
+		for _, addr := range contact.Addresses {
+			if addr != nodeID && len(addresses) < maxContactAddresses {
+				addresses = append(addresses, addr)
+			}
+		}
+		contact.Addresses = addresses
+		return cb.save()
+	}
+	return nil
+}
+
+// save writes the contacts; the caller must hold the mutex
+func (cb *ContactBook) save() error {
+	contacts := make([]*Contact, 0, len(cb.contacts))
+	for _, contact := range cb.contacts {
+		contacts = append(contacts, contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].Alias < contacts[j].Alias })
+
+	data, err := json.MarshalIndent(contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(cb.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save contacts: %w", err)
+	}
+	return nil
+}
+
+// expandAlias replaces a contact alias given as the peer of a command with the contact's node ID,
+// so every command that takes a peer accepts aliases
+func (en *EnhancedNode) expandAlias(input string) string {
+	command, args, _ := strings.Cut(input, " ")
+	cmd, known := lookupCommand(command)
+	peerArg := slices.Index(cmd.Args, argPeer)
+	if !known || peerArg < 0 {
+		return input
+	}
+
+	start := fieldsEnd(args, peerArg)
+	alias, rest, _ := strings.Cut(args[start:], " ")
+	contact, exists := en.contacts.Get(alias)
+	if !exists {
+		return input
+	}
+	return strings.TrimRight(command+" "+args[:start]+contact.NodeID+" "+rest, " ")
+}
+
+// connectToContact handles /connect <alias>, trying the contact's addresses newest first
+func (en *EnhancedNode) connectToContact(contact Contact) {
+	var lastErr error
+	for _, addr := range contact.Addresses {
+		if lastErr = en.connectToPeer(addr); lastErr == nil {
+			return
+		}
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("❌ Couldn't reach %s at any known address: %v", contact.Alias, lastErr)),
+	})
+}
+
+// checkContactKey is called when a peer sends its key. A key that differs from the one pinned for
+// the contact at that node ID is refused, so an alias can't quietly lead somewhere else; a pinned
+// key arriving from a new node ID updates the contact.
+func (en *EnhancedNode) checkContactKey(nodeID, publicKeyPEM string) error {
+	publicKey, err := parsePublicKeyPEM(publicKeyPEM)
+	if err != nil {
+		return err
+	}
+	fingerprint := keyFingerprint(publicKey)
+
+	if contact, conflict := en.contacts.Conflict(nodeID, fingerprint); conflict {
+		return fmt.Errorf("%s presented key %s, but contact %s is pinned to %s; refusing it (/contact remove %s to accept the new key)",
+			nodeID, formatFingerprint(fingerprint)[:19], contact.Alias, formatFingerprint(contact.Fingerprint)[:19], contact.Alias)
+	}
+	if err := en.contacts.Seen(nodeID, fingerprint); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return nil
+}
+
+// handleContactCommand processes /contact add|remove|list
+func (en *EnhancedNode) handleContactCommand(args string) {
+	fields := strings.Fields(args)
+	action := "list"
+	if len(fields) > 0 {
+		action = fields[0]
+	}
+
+	var reply string
+	switch {
+	case action == "list" && len(fields) <= 1:
+		contacts := en.contacts.List()
+		if len(contacts) == 0 {
+			reply = "No contacts yet; add one with /contact add <alias> <peer>"
+			break
+		}
+		var content strings.Builder
+		content.WriteString("📇 Contacts:")
+		for _, contact := range contacts {
+			state := "last seen " + contact.LastSeen.Format("2006-01-02 15:04")
+			if _, _, err := en.resolvePeer(contact.NodeID); err == nil {
+				state = "connected"
+			}
+			content.WriteString(fmt.Sprintf("\n  %s → %s (%s)\n      key %s",
+				contact.Alias, contact.NodeID, state, formatFingerprint(contact.Fingerprint)))
+			if len(contact.Addresses) > 1 {
+				content.WriteString("\n      also seen at " + strings.Join(contact.Addresses[1:], ", "))
+			}
+		}
+		reply = content.String()
+
+	case action == "add" && len(fields) == 3:
+		alias, peer := fields[1], fields[2]
+		nodeID := peer
+		if _, resolved, err := en.resolvePeer(peer); err == nil {
+			nodeID = resolved
+		}
+		fingerprint, known := en.cryptoManager.PeerFingerprint(nodeID)
+		if !known {
+			reply = fmt.Sprintf("❌ No key from %s yet; contacts are pinned to a key, so connect first", peer)
+			break
+		}
+		if err := en.contacts.Add(alias, nodeID, fingerprint); err != nil {
+			reply = fmt.Sprintf("❌ %v", err)
+			break
+		}
+		reply = fmt.Sprintf("📇 Saved %s as %s, pinned to key %s", nodeID, alias, formatFingerprint(fingerprint))
+		en.audit(AuditEntry{
+			Event: auditContactAdded, Severity: auditInfo, Peer: nodeID, Fingerprint: fingerprint,
+			Detail: fmt.Sprintf("pinned %s's key as contact %s", nodeID, alias),
+		})
+
+	case action == "remove" && len(fields) == 2:
+		contact, err := en.contacts.Remove(fields[1])
+		if err != nil {
+			reply = fmt.Sprintf("❌ %v", err)
+			break
+		}
+		reply = fmt.Sprintf("📇 Removed %s (%s)", contact.Alias, contact.NodeID)
+		en.audit(AuditEntry{
+			Event: auditContactRemoved, Severity: auditInfo, Peer: contact.NodeID, Fingerprint: contact.Fingerprint,
+			Detail: fmt.Sprintf("removed contact %s and its pinned key", contact.Alias),
+		})
+
+	default:
+		reply = "Usage: /contact add <alias> <peer> | /contact remove <alias> | /contact list"
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const conversationsFile = "conversations.json" // DM tabs that were open, reopened next time
+
+// conversation is a TUI tab: the broadcast channel, direct messages with one peer, or a room. The
+// shown conversation's messages are in ui.messages; the others keep theirs here until shown.
+type conversation struct {
+	peer     string // Node ID of the other side of a DM, or the room name; empty for the broadcast channel
+	key      string // Fingerprint of the DM peer's key once known; the tab follows it to a new node ID
+	messages []ChatMessage
+	unread   int      // Peer messages that arrived while another conversation was shown
+	unacked  []string // IDs of the peer's direct messages not yet reported read
+	offset   int      // Viewport offset to go back to
+	follow   bool     // The viewport was following new messages when the conversation was left
+}
+
+// broadcastConversation is the conversation key of the broadcast channel; others are the node ID
+// of the peer on the other side, or a room name
+const broadcastConversation = "broadcast"
+
+// messageConversation returns the conversation a message belongs in: the node ID of the other
+// side of a direct message, the room of a room message, broadcastConversation, or for a system
+// notice what it was given, which may be nothing
+func messageConversation(msg Message, self string) string {
+	if msg.SenderID == "System" {
+		return msg.Conversation
+	}
+	if peer := conversationPeer(msg, self); peer != "" {
+		return peer
+	}
+	return broadcastConversation
+}
+
+// conversationTab returns the peer of the tab a conversation key is shown in: "" for the broadcast
+// channel
+func conversationTab(conversation string) string {
+	if conversation == broadcastConversation {
+		return ""
+	}
+	return conversation
+}
+
+// conversationPeer says which conversation a message belongs in: the node ID of the other side of
+// a direct message, the room of a room message, or empty for the broadcast channel
+func conversationPeer(msg Message, self string) string {
+	switch {
+	case msg.Room != "":
+		return msg.Room
+	case !msg.Direct:
+		return ""
+	case msg.SenderID == self:
+		return msg.To
+	default:
+		return msg.SenderID
+	}
+}
+
+// savedConversation is an open DM tab as saved: the peer's key, if it was known, and its node ID
+type savedConversation struct {
+	Peer string `json:"peer"`
+	Key  string `json:"key,omitempty"`
+}
+
+// loadConversations reads the DM peers whose tabs were open last time
+func loadConversations(path string) ([]savedConversation, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read open conversations: %w", err)
+	}
+	var saved []savedConversation
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid open conversations %s: %w", path, err)
+	}
+	return saved, nil
+}
+
+// setConversationsPath reopens the DM tabs saved at path and saves them there from now on
+func (ui *UI) setConversationsPath(path string) error {
+	ui.conversationsPath = path
+	saved, err := loadConversations(path)
+	for _, tab := range saved {
+		if tab.Peer != "" && ui.findConversation(tab.Peer) < 0 {
+			ui.conversations = append(ui.conversations, &conversation{peer: tab.Peer, key: tab.Key, follow: true})
+			if tab.Key != "" {
+				ui.fingerprints[tab.Peer] = tab.Key
+			}
+		}
+	}
+	return err
+}
+
+// saveConversations records which DM tabs are open
+func (ui *UI) saveConversations() error {
+	if ui.conversationsPath == "" {
+		return nil
+	}
+	saved := make([]savedConversation, 0, len(ui.conversations)-1)
+	for _, conv := range ui.conversations[1:] {
+		saved = append(saved, savedConversation{Peer: conv.peer, Key: conv.key})
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ui.conversationsPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to save open conversations: %w", err)
+	}
+	return nil
+}
+
+// findConversation returns the position of a peer's tab, -1 if it isn't open. The broadcast
+// channel (peer "") is always first.
+func (ui *UI) findConversation(peer string) int {
+	for i, conv := range ui.conversations {
+		if conv.peer == peer {
+			return i
+		}
+	}
+	return -1
+}
+
+// openConversation returns the position of a peer's tab, opening it at the end if needed. A tab
+// with the peer's key that was left at another node ID is moved to this one rather than opening
+// a second.
+func (ui *UI) openConversation(peer string) int {
+	if i := ui.findConversation(peer); i >= 0 {
+		return i
+	}
+	ui.followKeys()
+	if i := ui.findConversation(peer); i >= 0 {
+		return i
+	}
+	ui.conversations = append(ui.conversations, &conversation{peer: peer, key: ui.fingerprints[peer], follow: true})
+	if err := ui.saveConversations(); err != nil {
+		ui.notice(fmt.Sprintf("❌ %v", err))
+	}
+	return len(ui.conversations) - 1
+}
+
+// noteFingerprint records the key a node ID presents. The node ID it was seen at before is
+// forgotten: an address is only where a key was last seen.
+func (ui *UI) noteFingerprint(nodeID, key string) {
+	for other, known := range ui.fingerprints {
+		if known == key && other != nodeID {
+			delete(ui.fingerprints, other)
+		}
+	}
+	ui.fingerprints[nodeID] = key
+}
+
+// followKeys pins DM tabs to their peer's key once it is known, and moves a tab to the node ID its
+// key is now seen at when the peer comes back from somewhere else
+func (ui *UI) followKeys() {
+	var changed bool
+	for _, conv := range ui.conversations[1:] {
+		if conv.key == "" {
+			if conv.key = ui.fingerprints[conv.peer]; conv.key != "" {
+				changed = true
+			}
+			continue
+		}
+		if ui.fingerprints[conv.peer] == conv.key {
+			continue
+		}
+		for nodeID, key := range ui.fingerprints {
+			if key == conv.key && ui.findConversation(nodeID) < 0 {
+				conv.peer = nodeID
+				changed = true
+				break
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := ui.saveConversations(); err != nil {
+		ui.notice(fmt.Sprintf("❌ %v", err))
+	}
+}
+
+// switchConversation shows another conversation, putting the view back where it was left
+func (ui *UI) switchConversation(i int) {
+	if i == ui.active || i < 0 || i >= len(ui.conversations) {
+		return
+	}
+	if ui.search != nil {
+		ui.endSearch()
+	}
+
+	current := ui.conversations[ui.active]
+	current.messages = ui.messages
+	current.offset = ui.viewport.YOffset
+	current.follow = ui.viewport.AtBottom()
+	current.unread = 0
+
+	next := ui.conversations[i]
+	ui.messages, next.messages = next.messages, nil
+	next.unread = 0
+	ui.active = i
+	ui.unread = 0
+	ui.unreadDirect = 0
+
+	ui.updateViewport()
+	if next.follow {
+		ui.viewport.GotoBottom()
+	} else {
+		ui.viewport.SetYOffset(next.offset)
+	}
+	ui.checkRead()
+}
+
+// closeConversation handles /close, closing the DM or room tab being shown. The node's message
+// log keeps its messages, and closing a room's tab doesn't leave the room.
+func (ui *UI) closeConversation() {
+	if ui.active == 0 {
+		ui.notice("💬 The broadcast channel can't be closed; /close closes direct message and room tabs")
+		return
+	}
+	closing := ui.active
+	ui.switchConversation(0)
+	ui.conversations = append(ui.conversations[:closing], ui.conversations[closing+1:]...)
+	if err := ui.saveConversations(); err != nil {
+		ui.notice(fmt.Sprintf("❌ %v", err))
+	}
+}
+
+// fileMessage adds a message to a conversation that isn't shown, counting it as unread if a
+// peer sent it
+func (ui *UI) fileMessage(i int, msg ChatMessage, counted bool) {
+	conv := ui.conversations[i]
+	conv.messages, _ = insertMessage(conv.messages, msg)
+	conv.messages, _ = trimMessages(conv.messages, ui.maxMessages)
+	if counted {
+		conv.unread++
+	}
+}
+
+// acknowledgeRead passes the direct messages of the conversation being shown to the backend, which
+// sends the peer a read receipt for them if receipts are on. The broadcast channel has none.
+func (ui *UI) acknowledgeRead() {
+	conv := ui.conversations[ui.active]
+	if conv.peer == "" || len(conv.unacked) == 0 {
+		return
+	}
+	ids := conv.unacked
+	conv.unacked = nil
+	if err := ui.node.MarkRead(conv.peer, ids); err != nil {
+		ui.notice(fmt.Sprintf("❌ Failed to send read receipt: %v", err))
+	}
+}
+
+// markSeen marks our direct messages to a peer as seen when its read receipt arrives. Receipts
+// only ever match messages in that peer's tab, so they can't touch broadcasts or other peers'.
+func (ui *UI) markSeen(peer string, ids []string, at time.Time) {
+	i := ui.findConversation(peer)
+	if peer == "" || i < 0 {
+		return
+	}
+	read := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		read[id] = true
+	}
+	messages := ui.conversations[i].messages
+	if i == ui.active {
+		messages = ui.messages
+	}
+	var changed bool
+	for j := range messages {
+		msg := &messages[j]
+		if msg.Direct && msg.Sender == ui.node.NodeID() && msg.Seen.IsZero() && read[msg.ID] {
+			msg.Seen = at
+			changed = true
+		}
+	}
+	if changed && i == ui.active {
+		follow := ui.viewport.AtBottom()
+		ui.updateViewport()
+		if follow {
+			ui.viewport.GotoBottom()
+		}
+	}
+}
+
+// addressInput turns text typed in a DM or room tab into a /msg to that peer or room. Commands
+// are left alone; "//" still escapes a leading slash.
+func (ui *UI) addressInput(input string) string {
+	peer := ui.conversations[ui.active].peer
+	switch {
+	case peer == "":
+		return input
+	case strings.HasPrefix(input, "//"):
+		return "/msg " + peer + " " + input[1:]
+	case strings.HasPrefix(input, "/"):
+		return input
+	default:
+		return "/msg " + peer + " " + input
+	}
+}
+
+// handleConversationKey switches conversations: Ctrl+Left/Right step through the tabs and
+// Alt+1..9 pick one by position. It reports whether the key was used.
+func (ui *UI) handleConversationKey(msg tea.KeyMsg) bool {
+	count := len(ui.conversations)
+	switch {
+	case msg.Type == tea.KeyCtrlLeft:
+		ui.switchConversation((ui.active + count - 1) % count)
+	case msg.Type == tea.KeyCtrlRight:
+		ui.switchConversation((ui.active + 1) % count)
+	case msg.Alt && msg.Type == tea.KeyRunes && len(msg.Runes) == 1 && msg.Runes[0] >= '1' && msg.Runes[0] <= '9':
+		ui.switchConversation(int(msg.Runes[0] - '1'))
+	default:
+		return false
+	}
+	return true
+}
+
+// displayName is how a peer given by connection or node ID is shown: its nick if it is connected
+// and has one
+func (ui *UI) displayName(peer string) string {
+	for conn, info := range ui.peerInfo {
+		if conn == peer || info.NodeID == peer {
+			return peerName(peer, info)
+		}
+	}
+	return peer
+}
+
+// peerNodeID is the node ID of a connected peer, which DM tabs are keyed by
+func (ui *UI) peerNodeID(peer string) string {
+	if nodeID := ui.peerInfo[peer].NodeID; nodeID != "" {
+		return nodeID
+	}
+	return peer
+}
+
+// peerUnread is how many messages are waiting in a peer's DM tab
+func (ui *UI) peerUnread(peer string) int {
+	if i := ui.findConversation(ui.peerNodeID(peer)); i > 0 {
+		return ui.conversations[i].unread
+	}
+	return 0
+}
+
+// renderTabs renders the message panel title: the conversation tabs with their unread counts, or
+// just the title while the broadcast channel is the only conversation
+func (ui *UI) renderTabs() string {
+	if len(ui.conversations) == 1 {
+		return "📨 Messages"
+	}
+
+	tabs := make([]string, len(ui.conversations))
+	for i, conv := range ui.conversations {
+		label := "All"
+		if roomName.MatchString(conv.peer) {
+			label = truncateText(conv.peer, 18)
+		} else if conv.peer != "" {
+			label = "✉ " + truncateText(ui.displayName(conv.peer), 16)
+		}
+		if i == ui.active {
+			label = activeTabStyle.Render(label)
+		} else if conv.unread > 0 {
+			label += " " + mentionMessageStyle.Render(fmt.Sprintf("(%d)", conv.unread))
+		}
+		tabs[i] = label
+	}
+	return "📨 " + strings.Join(tabs, timestampStyle.Render(" │ "))
+}
+
+// notice shows a system message in the conversation being shown
+func (ui *UI) notice(content string) {
+	ui.messages = append(ui.messages, ChatMessage{
+		Sender:    "System",
+		Content:   content,
+		Timestamp: time.Now(),
+		IsSystem:  true,
+	})
+	ui.updateViewport()
+	ui.viewport.GotoBottom()
+}
@@ -2,16 +2,22 @@ package main
 
 import (
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,17 +27,42 @@ type CryptoManager struct {
 	privateKey *rsa.PrivateKey
 	publicKey  *rsa.PublicKey
 	peerKeys   map[string]*rsa.PublicKey
+	verified   map[string]bool // Peers that sent us a message signed with the key we hold
 	keysMutex  sync.RWMutex
 	keysDir    string
 }
 
-// EncryptedMessage represents an encrypted message with metadata
+// maxRSAPlaintext is the largest payload RSA-OAEP (2048-bit, SHA-256) can encrypt directly
+const maxRSAPlaintext = 2048/8 - 2*sha256.Size - 2
+
+const (
+	// encryptedKeyType marks a private key sealed with a passphrase: AES-256-GCM under a key
+	// derived with PBKDF2-SHA256, with the salt, nonce and iteration count in the PEM headers
+	encryptedKeyType     = "P2PCHAT ENCRYPTED PRIVATE KEY"
+	passphraseIterations = 600000
+	passphraseSaltSize   = 16
+	keyPassphraseEnv     = "P2PCHAT_KEY_PASSPHRASE"
+	privateKeyFile       = "private.pem"
+	publicKeyFile        = "public.pem"
+)
+
+// ErrWrongPassphrase is returned when an encrypted private key can't be opened
+var ErrWrongPassphrase = errors.New("wrong key passphrase")
+
+// errBadSignature is returned when a signature doesn't verify
+var errBadSignature = errors.New("signature verification failed")
+
+// EncryptedMessage represents an encrypted message with metadata.
+// Payloads that fit in a single RSA block are encrypted with RSA-OAEP directly; larger ones are
+// sealed with AES-256-GCM under a random key, which is itself RSA-encrypted into EncryptedKey.
 type EncryptedMessage struct {
 	Ciphertext   string `json:"ciphertext"`
 	Signature    string `json:"signature"`
 	SenderPubKey string `json:"sender_pubkey"`
 	Timestamp    int64  `json:"timestamp"`
 	MessageType  string `json:"message_type"`
+	EncryptedKey string `json:"encrypted_key,omitempty"` // RSA-encrypted AES key (hybrid mode only)
+	Nonce        string `json:"nonce,omitempty"`         // AES-GCM nonce (hybrid mode only)
 }
 
 // NewCryptoManager creates a new crypto manager
@@ -42,12 +73,13 @@ func NewCryptoManager(keysDir string) (*CryptoManager, error) {
 
 	cm := &CryptoManager{
 		peerKeys: make(map[string]*rsa.PublicKey),
+		verified: make(map[string]bool),
 		keysDir:  keysDir,
 	}
 
 	// Try to load existing keys
-	privatePath := filepath.Join(keysDir, "private.pem")
-	publicPath := filepath.Join(keysDir, "public.pem")
+	privatePath := filepath.Join(keysDir, privateKeyFile)
+	publicPath := filepath.Join(keysDir, publicKeyFile)
 
 	if _, err := os.Stat(privatePath); err == nil {
 		// Keys exist, load them
@@ -61,7 +93,7 @@ func NewCryptoManager(keysDir string) (*CryptoManager, error) {
 		}
 
 		// Save keys
-		if err := cm.saveKeys(privatePath, publicPath); err != nil {
+		if err := cm.saveKeys(privatePath, publicPath, ""); err != nil {
 			return nil, fmt.Errorf("failed to save keys: %w", err)
 		}
 	}
@@ -81,14 +113,20 @@ func (cm *CryptoManager) generateKeys() error {
 	return nil
 }
 
-// saveKeys saves the key pair to files
-func (cm *CryptoManager) saveKeys(privatePath, publicPath string) error {
+// saveKeys saves the key pair to files, sealing the private key if a passphrase is given
+func (cm *CryptoManager) saveKeys(privatePath, publicPath, passphrase string) error {
 	// Save private key
-	privateBytes := x509.MarshalPKCS1PrivateKey(cm.privateKey)
-	privatePEM := pem.EncodeToMemory(&pem.Block{
+	privateBlock := &pem.Block{
 		Type:  "RSA PRIVATE KEY",
-		Bytes: privateBytes,
-	})
+		Bytes: x509.MarshalPKCS1PrivateKey(cm.privateKey),
+	}
+	if passphrase != "" {
+		var err error
+		if privateBlock, err = sealPrivateKey(privateBlock.Bytes, passphrase); err != nil {
+			return err
+		}
+	}
+	privatePEM := pem.EncodeToMemory(privateBlock)
 
 	if err := os.WriteFile(privatePath, privatePEM, 0600); err != nil {
 		return err
@@ -121,7 +159,19 @@ func (cm *CryptoManager) loadKeys(privatePath, publicPath string) error {
 		return errors.New("failed to decode private key PEM")
 	}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	privateBytes := block.Bytes
+	if block.Type == encryptedKeyType {
+		passphrase, err := keyPassphrase()
+		if err != nil {
+			return err
+		}
+		if privateBytes, err = openPrivateKey(block, passphrase); err != nil {
+			forgetKeyPassphrase()
+			return err
+		}
+	}
+
+	privateKey, err := x509.ParsePKCS1PrivateKey(privateBytes)
 	if err != nil {
 		return fmt.Errorf("failed to parse private key: %w", err)
 	}
@@ -152,6 +202,108 @@ func (cm *CryptoManager) loadKeys(privatePath, publicPath string) error {
 	return nil
 }
 
+// sealPrivateKey encrypts a DER private key with a key derived from the passphrase
+func sealPrivateKey(der []byte, passphrase string) (*pem.Block, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, passphraseIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"KDF":        "pbkdf2-sha256",
+			"Iterations": strconv.Itoa(passphraseIterations),
+			"Salt":       hex.EncodeToString(salt),
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: gcm.Seal(nil, nonce, der, nil),
+	}, nil
+}
+
+// openPrivateKey decrypts a private key sealed by sealPrivateKey
+func openPrivateKey(block *pem.Block, passphrase string) ([]byte, error) {
+	if block.Headers["KDF"] != "pbkdf2-sha256" {
+		return nil, fmt.Errorf("unsupported key encryption %q", block.Headers["KDF"])
+	}
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("invalid iteration count in encrypted key")
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errors.New("invalid salt in encrypted key")
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, errors.New("invalid nonce in encrypted key")
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce in encrypted key")
+	}
+	der, err := gcm.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return der, nil
+}
+
+// createIdentity generates a key pair in keysDir, sealed with the passphrase if one is given, and
+// returns its fingerprint. Existing keys are never replaced.
+func createIdentity(keysDir, passphrase string) (string, error) {
+	privatePath := filepath.Join(keysDir, privateKeyFile)
+	if _, err := os.Stat(privatePath); err == nil {
+		return "", fmt.Errorf("%s already exists", privatePath)
+	}
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create keys directory: %w", err)
+	}
+
+	cm := &CryptoManager{keysDir: keysDir}
+	if err := cm.generateKeys(); err != nil {
+		return "", fmt.Errorf("failed to generate keys: %w", err)
+	}
+	if err := cm.saveKeys(privatePath, filepath.Join(keysDir, publicKeyFile), passphrase); err != nil {
+		return "", fmt.Errorf("failed to save keys: %w", err)
+	}
+	return cm.Fingerprint(), nil
+}
+
+// identityFingerprint reads the fingerprint of the public key in keysDir, without needing the
+// private key's passphrase
+func identityFingerprint(keysDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(keysDir, publicKeyFile))
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := parsePublicKeyPEM(string(data))
+	if err != nil {
+		return "", err
+	}
+	return keyFingerprint(publicKey), nil
+}
+
 // GetPublicKeyPEM returns the public key in PEM format
 func (cm *CryptoManager) GetPublicKeyPEM() (string, error) {
 	publicBytes, err := x509.MarshalPKIXPublicKey(cm.publicKey)
@@ -167,72 +319,268 @@ func (cm *CryptoManager) GetPublicKeyPEM() (string, error) {
 	return string(publicPEM), nil
 }
 
-// AddPeerKey adds a peer's public key
-func (cm *CryptoManager) AddPeerKey(peerID string, publicKeyPEM string) error {
+// parsePublicKeyPEM parses a peer's RSA public key
+func parsePublicKeyPEM(publicKeyPEM string) (*rsa.PublicKey, error) {
 	block, _ := pem.Decode([]byte(publicKeyPEM))
 	if block == nil {
-		return errors.New("failed to decode peer public key PEM")
+		return nil, errors.New("failed to decode peer public key PEM")
 	}
 
 	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return fmt.Errorf("failed to parse peer public key: %w", err)
+		return nil, fmt.Errorf("failed to parse peer public key: %w", err)
 	}
 
 	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
 	if !ok {
-		return errors.New("peer public key is not RSA")
+		return nil, errors.New("peer public key is not RSA")
+	}
+	return rsaPublicKey, nil
+}
+
+// keyFingerprint identifies a public key: the hex SHA-256 of its DER encoding
+func keyFingerprint(publicKey *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// formatFingerprint groups a fingerprint in blocks of four for reading aloud or comparing
+func formatFingerprint(fingerprint string) string {
+	var groups []string
+	for len(fingerprint) > 4 {
+		groups = append(groups, fingerprint[:4])
+		fingerprint = fingerprint[4:]
+	}
+	return strings.Join(append(groups, fingerprint), " ")
+}
+
+// Fingerprint returns the fingerprint of our own public key
+func (cm *CryptoManager) Fingerprint() string {
+	return keyFingerprint(cm.publicKey)
+}
+
+// PeerFingerprint returns the fingerprint of the key held for a peer
+func (cm *CryptoManager) PeerFingerprint(peerID string) (string, bool) {
+	cm.keysMutex.RLock()
+	defer cm.keysMutex.RUnlock()
+
+	publicKey, exists := cm.peerKeys[peerID]
+	if !exists {
+		return "", false
+	}
+	return keyFingerprint(publicKey), true
+}
+
+// AddPeerKey adds a peer's public key
+func (cm *CryptoManager) AddPeerKey(peerID string, publicKeyPEM string) error {
+	rsaPublicKey, err := parsePublicKeyPEM(publicKeyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid key for %s: %w", peerID, err)
 	}
 
 	cm.keysMutex.Lock()
 	defer cm.keysMutex.Unlock()
+	if known, exists := cm.peerKeys[peerID]; !exists || !known.Equal(rsaPublicKey) {
+		delete(cm.verified, peerID) // A new key has to prove itself again
+	}
 	cm.peerKeys[peerID] = rsaPublicKey
 
 	return nil
 }
 
-// EncryptMessage encrypts and signs a message for a specific peer
-func (cm *CryptoManager) EncryptMessage(peerID string, plaintext []byte, messageType string) (*EncryptedMessage, error) {
+// HasPeerKey reports whether a public key is known for the peer
+func (cm *CryptoManager) HasPeerKey(peerID string) bool {
 	cm.keysMutex.RLock()
-	peerPublicKey, exists := cm.peerKeys[peerID]
-	cm.keysMutex.RUnlock()
+	defer cm.keysMutex.RUnlock()
 
-	if !exists {
-		return nil, fmt.Errorf("no public key for peer: %s", peerID)
+	_, exists := cm.peerKeys[peerID]
+	return exists
+}
+
+// IsPeerKey reports whether publicKeyPEM is the key we hold for the peer
+func (cm *CryptoManager) IsPeerKey(peerID string, publicKeyPEM string) bool {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return false
 	}
 
-	// Encrypt with peer's public key
-	ciphertext, err := rsa.EncryptOAEP(
-		sha256.New(),
-		rand.Reader,
-		peerPublicKey,
-		plaintext,
-		nil,
-	)
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return nil, fmt.Errorf("encryption failed: %w", err)
+		return false
+	}
+
+	cm.keysMutex.RLock()
+	defer cm.keysMutex.RUnlock()
+
+	known, exists := cm.peerKeys[peerID]
+	return exists && known.Equal(publicKey)
+}
+
+// MarkVerified records that a message signed with publicKeyPEM arrived from the peer, if that is
+// the key we hold for it, reporting whether the peer wasn't verified before
+func (cm *CryptoManager) MarkVerified(peerID string, publicKeyPEM string) bool {
+	if cm.IsVerified(peerID) {
+		return false
 	}
 
-	// Sign with our private key
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return false
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return false
+	}
+
+	cm.keysMutex.Lock()
+	defer cm.keysMutex.Unlock()
+	if known, exists := cm.peerKeys[peerID]; exists && known.Equal(publicKey) && !cm.verified[peerID] {
+		cm.verified[peerID] = true
+		return true
+	}
+	return false
+}
+
+// markVerifiedFingerprint records that the peer proved it holds the key with this fingerprint,
+// by authenticating a connection with it, if that is the key we hold for it, reporting whether
+// the peer wasn't verified before
+func (cm *CryptoManager) markVerifiedFingerprint(peerID, fingerprint string) bool {
+	cm.keysMutex.Lock()
+	defer cm.keysMutex.Unlock()
+	if known, exists := cm.peerKeys[peerID]; exists && keyFingerprint(known) == fingerprint && !cm.verified[peerID] {
+		cm.verified[peerID] = true
+		return true
+	}
+	return false
+}
+
+// IsVerified reports whether the peer has signed a message with the key we hold for it
+func (cm *CryptoManager) IsVerified(peerID string) bool {
+	cm.keysMutex.RLock()
+	defer cm.keysMutex.RUnlock()
+
+	return cm.verified[peerID]
+}
+
+// MessageSignature is our signature over a plaintext, made once and shared by every recipient's copy
+type MessageSignature struct {
+	Signature    string // Base64 PKCS#1 v1.5 signature over the SHA-256 of the plaintext
+	PublicKeyPEM string
+}
+
+// SignPlaintext signs a message with our private key
+func (cm *CryptoManager) SignPlaintext(plaintext []byte) (MessageSignature, error) {
 	hash := sha256.Sum256(plaintext)
 	signature, err := rsa.SignPKCS1v15(rand.Reader, cm.privateKey, crypto.SHA256, hash[:])
 	if err != nil {
-		return nil, fmt.Errorf("signing failed: %w", err)
+		return MessageSignature{}, fmt.Errorf("signing failed: %w", err)
 	}
 
 	// Get our public key for verification
 	publicKeyPEM, err := cm.GetPublicKeyPEM()
+	if err != nil {
+		return MessageSignature{}, err
+	}
+
+	return MessageSignature{
+		Signature:    base64.StdEncoding.EncodeToString(signature),
+		PublicKeyPEM: publicKeyPEM,
+	}, nil
+}
+
+// EncryptMessage encrypts and signs a message for a specific peer
+func (cm *CryptoManager) EncryptMessage(peerID string, plaintext []byte, messageType string) (*EncryptedMessage, error) {
+	signature, err := cm.SignPlaintext(plaintext)
 	if err != nil {
 		return nil, err
 	}
+	return cm.EncryptSigned(peerID, plaintext, messageType, signature)
+}
 
-	return &EncryptedMessage{
+// EncryptSigned encrypts a message for a specific peer, attaching a signature from SignPlaintext
+func (cm *CryptoManager) EncryptSigned(peerID string, plaintext []byte, messageType string, signature MessageSignature) (*EncryptedMessage, error) {
+	if err := checkEnvelopeSize(plaintext, messageType); err != nil {
+		return nil, err
+	}
+
+	cm.keysMutex.RLock()
+	peerPublicKey, exists := cm.peerKeys[peerID]
+	cm.keysMutex.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("no public key for peer: %s", peerID)
+	}
+
+	var ciphertext, encryptedKey, nonce []byte
+	var err error
+	if len(plaintext) <= maxRSAPlaintext {
+		// Encrypt with peer's public key
+		ciphertext, err = rsa.EncryptOAEP(
+			sha256.New(),
+			rand.Reader,
+			peerPublicKey,
+			plaintext,
+			nil,
+		)
+	} else {
+		// Too large for RSA: seal with a fresh AES key and encrypt that key for the peer
+		ciphertext, encryptedKey, nonce, err = sealHybrid(peerPublicKey, plaintext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encryption failed: %w", err)
+	}
+
+	encMsg := &EncryptedMessage{
 		Ciphertext:   base64.StdEncoding.EncodeToString(ciphertext),
-		Signature:    base64.StdEncoding.EncodeToString(signature),
-		SenderPubKey: publicKeyPEM,
+		Signature:    signature.Signature,
+		SenderPubKey: signature.PublicKeyPEM,
 		Timestamp:    time.Now().Unix(),
 		MessageType:  messageType,
-	}, nil
+	}
+	if encryptedKey != nil {
+		encMsg.EncryptedKey = base64.StdEncoding.EncodeToString(encryptedKey)
+		encMsg.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	}
+
+	return encMsg, nil
+}
+
+// sealHybrid encrypts plaintext with a random AES-256-GCM key and RSA-OAEP encrypts that key
+func sealHybrid(publicKey *rsa.PublicKey, plaintext []byte) (ciphertext, encryptedKey, nonce []byte, err error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, nil, err
+	}
+
+	encryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return gcm.Seal(nil, nonce, plaintext, nil), encryptedKey, nonce, nil
+}
+
+// newGCM creates an AES-GCM AEAD for the given key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
 }
 
 // DecryptMessage decrypts and verifies a message
@@ -243,45 +591,73 @@ func (cm *CryptoManager) DecryptMessage(encMsg *EncryptedMessage) ([]byte, strin
 		return nil, "", fmt.Errorf("failed to decode ciphertext: %w", err)
 	}
 
-	// Decrypt with our private key
-	plaintext, err := rsa.DecryptOAEP(
-		sha256.New(),
-		rand.Reader,
-		cm.privateKey,
-		ciphertext,
-		nil,
-	)
+	var plaintext []byte
+	if encMsg.EncryptedKey != "" {
+		plaintext, err = cm.openHybrid(encMsg, ciphertext)
+	} else {
+		// Decrypt with our private key
+		plaintext, err = rsa.DecryptOAEP(
+			sha256.New(),
+			rand.Reader,
+			cm.privateKey,
+			ciphertext,
+			nil,
+		)
+	}
 	if err != nil {
 		return nil, "", fmt.Errorf("decryption failed: %w", err)
 	}
 
-	// Decode signature
-	signature, err := base64.StdEncoding.DecodeString(encMsg.Signature)
+	// Verify the signature with the sender's public key
+	senderPublicKey, err := parsePublicKeyPEM(encMsg.SenderPubKey)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to decode signature: %w", err)
+		return nil, "", err
+	}
+	if err := verifySignature(senderPublicKey, plaintext, encMsg.Signature); err != nil {
+		return nil, "", err
 	}
 
-	// Parse sender's public key
-	block, _ := pem.Decode([]byte(encMsg.SenderPubKey))
-	if block == nil {
-		return nil, "", errors.New("failed to decode sender public key")
+	return plaintext, encMsg.MessageType, nil
+}
+
+// verifySignature checks a base64 signature made by SignPlaintext
+func verifySignature(publicKey *rsa.PublicKey, data []byte, signature string) error {
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+
+	hash := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], decoded); err != nil {
+		return fmt.Errorf("%w: %v", errBadSignature, err)
+	}
+	return nil
+}
+
+// openHybrid recovers the AES key with our private key and opens the AES-GCM ciphertext
+func (cm *CryptoManager) openHybrid(encMsg *EncryptedMessage, ciphertext []byte) ([]byte, error) {
+	encryptedKey, err := base64.StdEncoding.DecodeString(encMsg.EncryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key: %w", err)
 	}
 
-	senderPublicKeyInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
+	nonce, err := base64.StdEncoding.DecodeString(encMsg.Nonce)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to parse sender public key: %w", err)
+		return nil, fmt.Errorf("failed to decode nonce: %w", err)
 	}
 
-	senderPublicKey, ok := senderPublicKeyInterface.(*rsa.PublicKey)
-	if !ok {
-		return nil, "", errors.New("sender public key is not RSA")
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, cm.privateKey, encryptedKey, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	// Verify signature
-	hash := sha256.Sum256(plaintext)
-	if err := rsa.VerifyPKCS1v15(senderPublicKey, crypto.SHA256, hash[:], signature); err != nil {
-		return nil, "", fmt.Errorf("signature verification failed: %w", err)
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce size")
 	}
 
-	return plaintext, encMsg.MessageType, nil
+	return gcm.Open(nil, nonce, ciphertext, nil)
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// runDaemon runs the node without a local UI or stdin reader, serving the control
+// API on a unix socket until SIGTERM/SIGINT or a /quit sent through the socket.
+func runDaemon(node *EnhancedNode, socketPath string) error {
+	if socketPath == "" {
+		socketPath = filepath.Join(node.dataDir, "control.sock")
+	}
+
+	control, err := NewControlSocketServer(node, socketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socketPath)
+
+	// No local UI: attached clients read the message log instead of uiChannel
+	node.uiChannel = nil
+	node.headless = true
+	control.Start()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %v, shutting down", sig)
+			node.shutdown()
+		case <-node.Shutdown:
+		}
+	}()
+
+	log.Printf("Daemon running; attach with: p2pchat attach %s", socketPath)
+	node.StartEnhanced()
+
+	// Make sure shutdown has fully completed before the socket is removed
+	node.shutdown()
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForAttached reads what client streams until it shows text from sender
+func waitForAttached(t *testing.T, client *attachClient, sender, text string) {
+	t.Helper()
+	timeout := time.After(testWait)
+	for {
+		select {
+		case msg := <-client.UIMessages():
+			if msg.SenderID == sender && string(msg.Content) == text {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("attached client never showed %q from %s", text, sender)
+		}
+	}
+}
+
+// TestDaemonAttach runs a daemon and attaches to its socket: a client sends through the daemon,
+// one that attaches later replays what came before, and /quit from a client shuts the daemon
+// down and removes the socket
+func TestDaemonAttach(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	peer := tn.nodes[0]
+	daemon := tn.newNode()
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	done := make(chan error, 1)
+	go func() { done <- runDaemon(daemon, socket) }()
+	t.Cleanup(func() {
+		daemon.shutdown()
+		<-done
+	})
+
+	var client *attachClient
+	waitFor(t, "the control socket", func() bool {
+		var err error
+		client, err = newAttachClient(socket)
+		return err == nil
+	})
+	tn.connect(daemon, peer)
+
+	if _, err := peer.SendEncryptedText("are you up?"); err != nil {
+		t.Fatal(err)
+	}
+	waitForAttached(t, client, peer.ID, "are you up?")
+	if err := client.SendInput("from the laptop"); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, peer, daemon.ID, "from the laptop")
+	client.Close()
+
+	again, err := newAttachClient(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	waitForAttached(t, again, peer.ID, "are you up?")
+
+	if err := again.SendInput("/quit"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		done <- err
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testWait):
+		t.Fatal("the daemon didn't stop on /quit")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+}
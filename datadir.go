@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Directories inside the data directory
+const (
+	keysDirName      = "keys"      // Our RSA key pair: the node's identity
+	filesDirName     = "files"     // Working space for file transfers
+	voiceDirName     = "voice"     // Recorded and received voice messages
+	downloadsDirName = "downloads" // Files received from peers
+)
+
+// defaultDataDir is the per-user directory state is kept in: $XDG_DATA_HOME/p2pchat (or
+// ~/.local/share/p2pchat) on Linux and other Unix systems, ~/Library/Application Support/p2pchat
+// on macOS and %AppData%\p2pchat on Windows. It falls back to ./data when there is no home
+// directory.
+func defaultDataDir() string {
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		if dir, err := os.UserConfigDir(); err == nil {
+			return filepath.Join(dir, "p2pchat")
+		}
+	default:
+		if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+			return filepath.Join(dir, "p2pchat")
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, ".local", "share", "p2pchat")
+		}
+	}
+	return "data"
+}
+
+// createDataDir creates the data directory and its subdirectories. The data directory holds the
+// private key and the API token, so only the user may enter it.
+func createDataDir(dataDir string) error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	for _, name := range []string{keysDirName, filesDirName, voiceDirName, downloadsDirName} {
+		perm := os.FileMode(0755)
+		if name == keysDirName {
+			perm = 0700
+		}
+		if err := os.MkdirAll(filepath.Join(dataDir, name), perm); err != nil {
+			return fmt.Errorf("failed to create %s directory: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// legacyMove is one path of the old layout in the working directory and where it belongs now
+type legacyMove struct {
+	from, to string
+}
+
+// findLegacyState looks for state that older versions kept relative to the working directory:
+// ./keys, everything in ./data, and ./downloads. It returns nothing once the data directory has a
+// key pair of its own, so an identity that is in use is never replaced.
+func findLegacyState(dataDir string) []legacyMove {
+	if _, err := os.Stat(filepath.Join(dataDir, keysDirName, privateKeyFile)); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(keysDirName, privateKeyFile)); err != nil {
+		return nil
+	}
+	if same, _ := samePath(".", dataDir); same {
+		return nil
+	}
+
+	moves := []legacyMove{{from: keysDirName, to: filepath.Join(dataDir, keysDirName)}}
+	if entries, err := os.ReadDir("data"); err == nil {
+		if same, _ := samePath("data", dataDir); !same {
+			for _, entry := range entries {
+				moves = append(moves, legacyMove{
+					from: filepath.Join("data", entry.Name()),
+					to:   filepath.Join(dataDir, entry.Name()),
+				})
+			}
+		}
+	}
+	if _, err := os.Stat(downloadsDirName); err == nil {
+		moves = append(moves, legacyMove{from: downloadsDirName, to: filepath.Join(dataDir, downloadsDirName)})
+	}
+	return moves
+}
+
+// samePath reports whether two paths name the same existing directory
+func samePath(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(infoA, infoB), nil
+}
+
+// migrateLegacyState moves the old layout into the data directory. Directories that already exist
+// there, which the node creates empty, are merged into; files that already exist are left in place
+// and reported.
+func migrateLegacyState(moves []legacyMove) error {
+	var failed []string
+	for _, move := range moves {
+		if err := moveInto(move.from, move.to); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("some old state was not moved:\n  %s", strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+// moveInto moves from to to, merging directories entry by entry when to is already a directory
+func moveInto(from, to string) error {
+	target, err := os.Stat(to)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("%s: %w", from, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", from, err)
+	}
+
+	source, err := os.Stat(from)
+	if err != nil {
+		return fmt.Errorf("%s: %w", from, err)
+	}
+	if !source.IsDir() || !target.IsDir() {
+		return fmt.Errorf("%s: %s already exists", from, to)
+	}
+
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return fmt.Errorf("%s: %w", from, err)
+	}
+	var failed []string
+	for _, entry := range entries {
+		if err := moveInto(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "\n  "))
+	}
+	// Only removed once empty, so nothing that failed to move is lost
+	os.Remove(from)
+	return nil
+}
+
+// offerMigration handles state left in the working directory by older versions. With -migrate it
+// is moved, and in an interactive session the user is asked. Otherwise starting would quietly
+// create a new identity, so an error explains what to do instead.
+func offerMigration(dataDir string, migrate, interactive bool) error {
+	moves := findLegacyState(dataDir)
+	if len(moves) == 0 {
+		return nil
+	}
+
+	if !migrate && interactive {
+		fmt.Printf("Found state from an older version in the current directory (%s).\n", legacySummary(moves))
+		fmt.Printf("Move it into %s so this identity is used wherever p2pchat starts? [y/N] ", dataDir)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Printf("Left in place; starting with a new identity in %s\n", dataDir)
+			return nil
+		}
+		migrate = true
+	}
+	if !migrate {
+		return fmt.Errorf("found state from an older version (%s) in the current directory; "+
+			"run once with -migrate to move it into %s, or pass -data-dir to choose a directory", legacySummary(moves), dataDir)
+	}
+
+	if err := migrateLegacyState(moves); err != nil {
+		return err
+	}
+	os.Remove("data") // Empty now that its contents moved
+	log.Printf("Moved old state into %s", dataDir)
+	return nil
+}
+
+// legacySummary lists the old top-level paths found, e.g. "keys, data, downloads"
+func legacySummary(moves []legacyMove) string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, move := range moves {
+		top := strings.Split(filepath.ToSlash(move.from), "/")[0]
+		if !seen[top] {
+			seen[top] = true
+			names = append(names, "./"+top)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// debugSummaryPath is where the debug server serves the /debug summary, next to net/http/pprof's
+// /debug/pprof/
+const debugSummaryPath = "/debug/node"
+
+// queueDepth is how full a channel or queue is
+type queueDepth struct {
+	Len, Cap int
+}
+
+func (d queueDepth) String() string { return fmt.Sprintf("%d/%d", d.Len, d.Cap) }
+
+// debugSummary is the node's own bookkeeping next to the runtime's, to tell a goroutine leak or a
+// stuck channel from ordinary load
+type debugSummary struct {
+	Goroutines     int
+	Peers          int
+	PeerSendQueued int        // Frames waiting in every peer's send queue together
+	PeerSendMax    queueDepth // The fullest peer's send queue
+	PeerSendMaxID  string
+	IncomingMsg    queueDepth
+	CLIInput       queueDepth
+	UIPending      int        // Messages the UI queue holds for the UI
+	UIChannel      queueDepth // The UI's own channel
+	LocalUI        bool       // False in daemon and one-shot modes, where nothing reads the UI queue
+	Transfers      map[string]int
+	PendingAcks    int
+	Redials        int
+	HeapAlloc      uint64
+}
+
+// debugSummary snapshots the summary /debug and the debug server show
+func (en *EnhancedNode) debugSummary() debugSummary {
+	summary := debugSummary{
+		Goroutines:  runtime.NumGoroutine(),
+		IncomingMsg: queueDepth{len(en.IncomingMsg), cap(en.IncomingMsg)},
+		CLIInput:    queueDepth{len(en.CLIInput), cap(en.CLIInput)},
+		UIPending:   en.uiQueue.Len(),
+		Transfers:   make(map[string]int),
+	}
+	if en.uiChannel != nil {
+		summary.UIChannel = queueDepth{len(en.uiChannel), cap(en.uiChannel)}
+		summary.LocalUI = true
+	}
+
+	en.peersMutex.RLock()
+	summary.Peers = len(en.Peers)
+	for _, peer := range en.Peers {
+		queued := len(peer.Send)
+		summary.PeerSendQueued += queued
+		if queued >= summary.PeerSendMax.Len {
+			summary.PeerSendMax = queueDepth{queued, cap(peer.Send)}
+			summary.PeerSendMaxID = peer.ID
+		}
+	}
+	en.peersMutex.RUnlock()
+
+	for _, transfer := range en.fileManager.ListTransfers() {
+		summary.Transfers[transfer.Status]++
+	}
+
+	en.pendingAcksLock.Lock()
+	summary.PendingAcks = len(en.pendingAcks)
+	en.pendingAcksLock.Unlock()
+
+	summary.Redials = len(en.redials.describe(en.wallClock.Now()))
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	summary.HeapAlloc = memStats.HeapAlloc
+	return summary
+}
+
+// String formats the summary as /debug shows it
+func (s debugSummary) String() string {
+	var content strings.Builder
+	content.WriteString("🐛 Debug:")
+	content.WriteString(fmt.Sprintf("\n  Goroutines:        %d for %d peer(s)", s.Goroutines, s.Peers))
+	content.WriteString(fmt.Sprintf("\n  Heap:              %s", formatBytes(int64(s.HeapAlloc))))
+	content.WriteString(fmt.Sprintf("\n  IncomingMsg:       %s", s.IncomingMsg))
+	content.WriteString(fmt.Sprintf("\n  CLIInput:          %s", s.CLIInput))
+	if s.LocalUI {
+		content.WriteString(fmt.Sprintf("\n  UI queue:          %d pending, channel %s", s.UIPending, s.UIChannel))
+	} else {
+		content.WriteString("\n  UI queue:          no local UI")
+	}
+	if s.Peers > 0 {
+		content.WriteString(fmt.Sprintf("\n  Peer send queues:  %d frame(s) queued, fullest %s (%s)", s.PeerSendQueued, s.PeerSendMax, s.PeerSendMaxID))
+	} else {
+		content.WriteString("\n  Peer send queues:  no peers")
+	}
+
+	transfers := "none"
+	if len(s.Transfers) > 0 {
+		var counts []string
+		for _, status := range []string{"pending", "active", "complete", "failed"} {
+			if count := s.Transfers[status]; count > 0 {
+				counts = append(counts, fmt.Sprintf("%d %s", count, status))
+			}
+		}
+		transfers = strings.Join(counts, ", ")
+	}
+	content.WriteString(fmt.Sprintf("\n  Transfers:         %s", transfers))
+	content.WriteString(fmt.Sprintf("\n  Awaiting acks:     %d", s.PendingAcks))
+	content.WriteString(fmt.Sprintf("\n  Queued redials:    %d", s.Redials))
+	return content.String()
+}
+
+// handleDebugCommand processes /debug
+func (en *EnhancedNode) handleDebugCommand() {
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(en.debugSummary().String()),
+	})
+}
+
+// validateDebugListen refuses a -debug-listen address that isn't on loopback: pprof shows command
+// lines and memory contents and takes CPU profiles on request, so it must never face the network
+func validateDebugListen(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("-debug-listen %q: %w", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("-debug-listen %q: only loopback addresses are allowed, such as 127.0.0.1:6060", addr)
+	}
+	return nil
+}
+
+// startDebugServer serves net/http/pprof and the /debug summary on addr until the node shuts down
+func (en *EnhancedNode) startDebugServer(addr string) error {
+	if err := validateDebugListen(addr); err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc(debugSummaryPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, en.debugSummary())
+	})
+	// CPU profiles and traces run for as long as asked (30 seconds by default), so there is no
+	// write timeout
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	en.wg.Add(1)
+	go func() {
+		defer en.wg.Done()
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Debug server error: %v", err)
+		}
+	}()
+
+	en.wg.Add(1)
+	go func() {
+		defer en.wg.Done()
+		<-en.Shutdown
+		server.Close()
+	}()
+
+	log.Printf("Debug server listening on http://%s/debug/pprof/ and http://%s%s", listener.Addr(), listener.Addr(), debugSummaryPath)
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Errors returned by the synchronous send paths, distinguishable by scripts via exit codes
+var (
+	ErrPeerUnreachable = errors.New("peer unreachable")
+	ErrNoPeerKey       = errors.New("no key received within timeout")
+	ErrNoAck           = errors.New("no delivery acknowledgement within timeout")
+	ErrTransferFailed  = errors.New("file transfer failed")
+)
+
+// TextEnvelope is the plaintext of an encrypted "text" message
+type TextEnvelope struct {
+	ID           string `json:"id"`
+	Text         string `json:"text"`
+	AckRequested bool   `json:"ack,omitempty"` // Ask the receiver for a delivery ack
+	Lamport      uint64 `json:"lamport,omitempty"`
+	Seq          uint64 `json:"seq,omitempty"`   // Per-sender broadcast sequence number; zero for direct messages
+	Kind         string `json:"kind,omitempty"`  // Message subtype, e.g. "action" for /me; empty for plain text
+	TTL          uint32 `json:"ttl,omitempty"`   // Seconds until an ephemeral message is removed; zero keeps it
+	Hops         uint8  `json:"hops,omitempty"`  // Hops left, this one included, for relays to count down; older senders leave it out
+	Part         int    `json:"part,omitempty"`  // Which part of a long text this is, from 1; zero if it is whole
+	Parts        int    `json:"parts,omitempty"` // Parts a long text was split into
+}
+
+// expiresAt returns when an ephemeral message received (or sent) at t disappears, or zero if it doesn't
+func (e TextEnvelope) expiresAt(t time.Time) time.Time {
+	if e.TTL == 0 {
+		return time.Time{}
+	}
+	return t.Add(time.Duration(e.TTL) * time.Second)
+}
+
+// Text message kinds
+const (
+	TextKindAction = "action" // /me: rendered as "* nick text"
+)
+
+// DeliveryAck is the plaintext of an encrypted "ack" message
+type DeliveryAck struct {
+	ID string `json:"id"`
+}
+
+// newMessageID returns a random message ID
+func newMessageID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		// Fall back to a time-based ID; uniqueness per sender is all we need
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// parseTextEnvelope decodes a text payload, treating anything that isn't an envelope as legacy raw text
+func parseTextEnvelope(plaintext []byte) TextEnvelope {
+	var envelope TextEnvelope
+	if err := json.Unmarshal(plaintext, &envelope); err != nil || envelope.ID == "" {
+		return TextEnvelope{Text: string(plaintext)}
+	}
+	return envelope
+}
+
+// handleDeliveryAck wakes up a sender waiting for the acknowledged message
+func (en *EnhancedNode) handleDeliveryAck(senderID string, plaintext []byte) {
+	var ack DeliveryAck
+	if err := json.Unmarshal(plaintext, &ack); err != nil {
+		log.Printf("Invalid ack from %s: %v", senderID, err)
+		return
+	}
+
+	en.pendingAcksLock.Lock()
+	waiter, exists := en.pendingAcks[ack.ID]
+	delete(en.pendingAcks, ack.ID)
+	en.pendingAcksLock.Unlock()
+
+	if exists {
+		close(waiter)
+	}
+}
+
+// sendDeliveryAck acknowledges a received message back to its sender
+func (en *EnhancedNode) sendDeliveryAck(senderID, messageID string) {
+	data, err := json.Marshal(DeliveryAck{ID: messageID})
+	if err != nil {
+		log.Printf("Failed to serialize ack: %v", err)
+		return
+	}
+
+	if err := en.sendEncryptedTo(senderID, data, "ack"); err != nil {
+		log.Printf("Failed to send ack to %s: %v", senderID, err)
+	}
+}
+
+// waitForPeerKey waits until the peer is connected and its public key is known, returning its node ID
+func (en *EnhancedNode) waitForPeerKey(peerID string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if _, nodeID, err := en.resolvePeer(peerID); err == nil && en.cryptoManager.HasPeerKey(nodeID) {
+			return nodeID, nil
+		}
+		if time.Now().After(deadline) {
+			return "", ErrNoPeerKey
+		}
+
+		select {
+		case <-ticker.C:
+		case <-en.Shutdown:
+			return "", fmt.Errorf("node is shutting down")
+		}
+	}
+}
+
+// SendTextAndConfirm sends a text message to one peer and blocks until the peer acknowledges it,
+// or timeout passes on the system clock, whatever clock the node was given
+func (en *EnhancedNode) SendTextAndConfirm(peerID, text string, timeout time.Duration) error {
+	return en.sendTextConfirmed(peerID, text, timeout, systemClock{}, nil)
+}
+
+// sendTextConfirmed is SendTextAndConfirm, timing the wait for the ack on clock and handing our
+// copy of the message to sent, if given, once it has gone out
+func (en *EnhancedNode) sendTextConfirmed(peerID, text string, timeout time.Duration, clock Clock, sent func(Message)) error {
+	deadline := clock.Now().Add(timeout)
+
+	if err := checkTextSize(text); err != nil {
+		return err
+	}
+	if _, err := en.waitForPeerKey(peerID, timeout); err != nil {
+		return err
+	}
+
+	envelope := en.newTextEnvelope(text, false)
+	envelope.AckRequested = true
+
+	waiter := make(chan struct{})
+	en.pendingAcksLock.Lock()
+	en.pendingAcks[envelope.ID] = waiter
+	en.pendingAcksLock.Unlock()
+
+	defer func() {
+		en.pendingAcksLock.Lock()
+		delete(en.pendingAcks, envelope.ID)
+		en.pendingAcksLock.Unlock()
+	}()
+
+	// A long text is sent in parts; the peer acknowledges it once it has them all
+	err := en.sendTextParts(envelope, func(data []byte) error {
+		return en.sendEncryptedTo(peerID, data, "text")
+	})
+	if err != nil {
+		return err
+	}
+	if sent != nil {
+		local := en.localTextMessage(envelope)
+		local.To = peerID
+		if _, nodeID, err := en.resolvePeer(peerID); err == nil {
+			local.To = nodeID
+		}
+		sent(local)
+	}
+
+	timer := clock.NewTimer(deadline.Sub(clock.Now()))
+	defer timer.Stop()
+
+	select {
+	case <-waiter:
+		return nil
+	case <-timer.Chan():
+		return ErrNoAck
+	case <-en.Shutdown:
+		return fmt.Errorf("node is shutting down")
+	}
+}
+
+// SendFileAndConfirm sends a file to one peer and blocks until the peer reports it saved
+func (en *EnhancedNode) SendFileAndConfirm(peerID, filePath string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	if _, err := en.waitForPeerKey(peerID, timeout); err != nil {
+		return err
+	}
+
+	fileID, result, err := en.fileManager.sendFileWithResult(peerID, filePath)
+	if err != nil {
+		return err
+	}
+	defer en.fileManager.forgetDeliveryWaiter(fileID)
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return ErrNoAck
+	case <-en.Shutdown:
+		return fmt.Errorf("node is shutting down")
+	}
+}
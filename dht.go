@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dhtK               = 8                // Contacts per bucket, and how many nodes a record is stored on
+	dhtAlpha           = 3                // Nodes a lookup queries at once
+	dhtRPCTimeout      = 2 * time.Second  // A node that doesn't answer in this time is dropped from the table
+	dhtRefreshInterval = 15 * time.Minute // How often we look up our own ID to keep the table fresh
+	dhtMaxPacket       = 8192             // Largest datagram; a record with its key is about 1.5KB
+	dhtMaxRecords      = 1024             // Most records stored for other nodes
+	dhtStateFile       = "dht_nodes.json" // Routing table saved in the data dir, to rejoin from after a restart
+)
+
+// DHT message types. Each request is answered by the type after it.
+const (
+	dhtPing      = "PING"
+	dhtPong      = "PONG"
+	dhtFindNode  = "FIND_NODE"
+	dhtFindValue = "FIND_VALUE"
+	dhtNodes     = "NODES" // Answers FIND_NODE, and FIND_VALUE when no record is held
+	dhtValue     = "VALUE"
+	dhtStore     = "STORE"
+	dhtStored    = "STORED"
+)
+
+// DHTConfig says how to join the DHT
+type DHTConfig struct {
+	Listen    string   // UDP address for DHT traffic; empty means the node's port
+	Bootstrap []string // UDP addresses of nodes already in the DHT
+}
+
+// WithDHT makes a node join a Kademlia DHT, publish its peer record there under its key
+// fingerprint, and resolve fingerprints given to /connect through it
+func WithDHT(config DHTConfig) NodeOption {
+	return func(options *nodeOptions) {
+		options.dht = &config
+	}
+}
+
+// dhtID is a position in the DHT keyspace. Nodes sit at their key fingerprint, and a node's
+// record is stored under the same ID, on the nodes closest to it.
+type dhtID [sha256.Size]byte
+
+// dhtIDFromFingerprint decodes a key fingerprint
+func dhtIDFromFingerprint(fingerprint string) (dhtID, error) {
+	var id dhtID
+	decoded, err := hex.DecodeString(fingerprint)
+	if err != nil || len(decoded) != len(id) {
+		return id, fmt.Errorf("invalid fingerprint %q", fingerprint)
+	}
+	copy(id[:], decoded)
+	return id, nil
+}
+
+// parseFingerprint accepts a fingerprint as shown by formatFingerprint, or without the spaces,
+// returning it in the form keyFingerprint produces
+func parseFingerprint(input string) (string, bool) {
+	fingerprint := strings.ToLower(strings.Join(strings.Fields(input), ""))
+	if _, err := dhtIDFromFingerprint(fingerprint); err != nil {
+		return "", false
+	}
+	return fingerprint, true
+}
+
+func (id dhtID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id dhtID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *dhtID) UnmarshalText(text []byte) error {
+	parsed, err := dhtIDFromFingerprint(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// distance is the XOR metric between two IDs
+func (id dhtID) distance(other dhtID) dhtID {
+	var d dhtID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// bucketIndex is the number of leading bits other shares with id, which picks the bucket other
+// goes in. It is -1 for id itself.
+func (id dhtID) bucketIndex(other dhtID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			bits := 0
+			for x&0x80 == 0 {
+				x <<= 1
+				bits++
+			}
+			return i*8 + bits
+		}
+	}
+	return -1
+}
+
+// sortByDistance orders contacts nearest to target first
+func sortByDistance(contacts []dhtContact, target dhtID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		a, b := contacts[i].ID.distance(target), contacts[j].ID.distance(target)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+}
+
+// dhtContact is a DHT node and the UDP address it answered from
+type dhtContact struct {
+	ID   dhtID  `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// routingTable holds up to dhtK contacts for each distance from us. Contacts are kept in the
+// order they were last heard from, oldest first; a full bucket keeps its old contacts, which
+// are the likeliest to stay up, until one stops answering.
+type routingTable struct {
+	mutex   sync.Mutex
+	self    dhtID
+	buckets [len(dhtID{}) * 8][]dhtContact
+}
+
+// update records that a contact was heard from
+func (rt *routingTable) update(contact dhtContact) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	index := rt.self.bucketIndex(contact.ID)
+	if index < 0 {
+		return
+	}
+	bucket := rt.buckets[index]
+	for i, known := range bucket {
+		if known.ID == contact.ID {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) < dhtK {
+		bucket = append(bucket, contact)
+	}
+	rt.buckets[index] = bucket
+}
+
+// remove drops a contact that stopped answering
+func (rt *routingTable) remove(id dhtID) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	index := rt.self.bucketIndex(id)
+	if index < 0 {
+		return
+	}
+	bucket := rt.buckets[index]
+	for i, known := range bucket {
+		if known.ID == id {
+			rt.buckets[index] = append(bucket[:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// contacts returns every contact in the table
+func (rt *routingTable) contacts() []dhtContact {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	var contacts []dhtContact
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	return contacts
+}
+
+// closest returns up to count contacts nearest to target
+func (rt *routingTable) closest(target dhtID, count int) []dhtContact {
+	contacts := rt.contacts()
+	sortByDistance(contacts, target)
+	return contacts[:min(len(contacts), count)]
+}
+
+// dhtMessage is one DHT datagram, JSON encoded. Replies carry the request's TxID.
+type dhtMessage struct {
+	Type   string       `json:"type"`
+	TxID   string       `json:"tx"`
+	Sender dhtID        `json:"sender"`
+	Target *dhtID       `json:"target,omitempty"` // FIND_NODE and FIND_VALUE
+	Record *PeerRecord  `json:"record,omitempty"` // STORE and VALUE
+	Nodes  []dhtContact `json:"nodes,omitempty"`  // NODES
+}
+
+// DHT is our part of a Kademlia overlay. Node IDs in it aren't authenticated, so the table can
+// hold contacts lying about their ID; records are, by their signatures, so a lookup can be
+// stalled that way but not misled.
+type DHT struct {
+	self      dhtID
+	conn      *net.UDPConn
+	table     *routingTable
+	traffic   *trafficCounter // The node's totals
+	statePath string
+	bootstrap []string
+
+	recordsMutex sync.Mutex
+	records      map[dhtID]PeerRecord // Records stored with us, by the fingerprint of their key
+
+	pendingMutex sync.Mutex
+	pending      map[string]chan dhtMessage // Requests awaiting a reply, by TxID
+
+	closed chan struct{}
+}
+
+// NewDHT opens the DHT socket. The node ID is the fingerprint of our key.
+func NewDHT(listenAddr, fingerprint string, bootstrap []string, statePath string, traffic *trafficCounter) (*DHT, error) {
+	self, err := dhtIDFromFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DHT address %s: %w", listenAddr, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for DHT traffic: %w", err)
+	}
+	return &DHT{
+		self:      self,
+		conn:      conn,
+		table:     &routingTable{self: self},
+		traffic:   traffic,
+		statePath: statePath,
+		bootstrap: bootstrap,
+		records:   make(map[dhtID]PeerRecord),
+		pending:   make(map[string]chan dhtMessage),
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+// newNodeDHT opens the DHT for NewNode. Unless told otherwise it listens on the UDP port
+// matching the node's TCP port, which with QUIC is taken.
+func newNodeDHT(config DHTConfig, options nodeOptions, port string, cryptoManager *CryptoManager, dataDir string, traffic *trafficCounter) (*DHT, error) {
+	if options.tor != nil {
+		return nil, errors.New("the DHT can't be used over Tor: it would publish our address")
+	}
+	if cryptoManager == nil {
+		return nil, errors.New("the DHT needs an identity key")
+	}
+	listenAddr := config.Listen
+	if listenAddr == "" {
+		if options.quic {
+			return nil, errors.New("QUIC uses the listen port's UDP side; set dht_listen in the config to give the DHT another port")
+		}
+		listenAddr = net.JoinHostPort("", port)
+	}
+	return NewDHT(listenAddr, cryptoManager.Fingerprint(), config.Bootstrap, filepath.Join(dataDir, dhtStateFile), traffic)
+}
+
+// Close stops DHT traffic
+func (d *DHT) Close() error {
+	close(d.closed)
+	return d.conn.Close()
+}
+
+// send writes a message to addr
+func (d *DHT) send(addr *net.UDPAddr, msg dhtMessage) error {
+	msg.Sender = d.self
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	sent, err := d.conn.WriteToUDP(data, addr)
+	d.traffic.out.Add(uint64(sent))
+	return err
+}
+
+// call sends a request and waits for its reply. A contact that doesn't answer, or answers as
+// another node, is dropped.
+func (d *DHT) call(contact dhtContact, msg dhtMessage) (dhtMessage, error) {
+	addr, err := net.ResolveUDPAddr("udp", contact.Addr)
+	if err != nil {
+		return dhtMessage{}, err
+	}
+
+	txID := make([]byte, 8)
+	if _, err := rand.Read(txID); err != nil {
+		return dhtMessage{}, err
+	}
+	msg.TxID = hex.EncodeToString(txID)
+	reply := make(chan dhtMessage, 1)
+	d.pendingMutex.Lock()
+	d.pending[msg.TxID] = reply
+	d.pendingMutex.Unlock()
+	defer func() {
+		d.pendingMutex.Lock()
+		delete(d.pending, msg.TxID)
+		d.pendingMutex.Unlock()
+	}()
+
+	if err := d.send(addr, msg); err != nil {
+		return dhtMessage{}, err
+	}
+
+	timer := time.NewTimer(dhtRPCTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-reply:
+		if contact.ID != (dhtID{}) && response.Sender != contact.ID {
+			// Another node has the address now
+			d.table.remove(contact.ID)
+			return dhtMessage{}, fmt.Errorf("%s is no longer %s", contact.Addr, contact.ID)
+		}
+		return response, nil
+	case <-timer.C:
+		if contact.ID != (dhtID{}) {
+			d.table.remove(contact.ID)
+		}
+		return dhtMessage{}, fmt.Errorf("%s didn't answer %s", contact.Addr, msg.Type)
+	case <-d.closed:
+		return dhtMessage{}, errors.New("DHT closed")
+	}
+}
+
+// serve reads datagrams until the socket is closed, answering requests and passing replies to
+// the calls waiting for them
+func (d *DHT) serve() {
+	buffer := make([]byte, dhtMaxPacket)
+	for {
+		length, addr, err := d.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-d.closed:
+				return
+			default:
+				log.Printf("DHT read error: %v", err)
+				continue
+			}
+		}
+		d.traffic.in.Add(uint64(length))
+
+		var msg dhtMessage
+		if err := json.Unmarshal(buffer[:length], &msg); err != nil || msg.TxID == "" {
+			continue
+		}
+		if msg.Sender == d.self {
+			continue
+		}
+		// The source address, not anything in the message, is where the sender is reachable
+		d.table.update(dhtContact{ID: msg.Sender, Addr: addr.String()})
+
+		switch msg.Type {
+		case dhtPong, dhtNodes, dhtValue, dhtStored:
+			d.pendingMutex.Lock()
+			reply, exists := d.pending[msg.TxID]
+			d.pendingMutex.Unlock()
+			if exists {
+				select {
+				case reply <- msg:
+				default:
+				}
+			}
+		default:
+			d.handleRequest(addr, msg)
+		}
+	}
+}
+
+// handleRequest answers one request
+func (d *DHT) handleRequest(addr *net.UDPAddr, msg dhtMessage) {
+	reply := dhtMessage{TxID: msg.TxID}
+	switch msg.Type {
+	case dhtPing:
+		reply.Type = dhtPong
+
+	case dhtFindNode, dhtFindValue:
+		if msg.Target == nil {
+			return
+		}
+		if msg.Type == dhtFindValue {
+			if record, exists := d.getRecord(*msg.Target); exists {
+				reply.Type = dhtValue
+				reply.Record = &record
+				break
+			}
+		}
+		reply.Type = dhtNodes
+		reply.Nodes = d.table.closest(*msg.Target, dhtK)
+
+	case dhtStore:
+		if msg.Record == nil {
+			return
+		}
+		if err := d.putRecord(*msg.Record); err != nil {
+			log.Printf("Refused DHT record from %s: %v", addr, err)
+			return
+		}
+		reply.Type = dhtStored
+
+	default:
+		return
+	}
+
+	if err := d.send(addr, reply); err != nil {
+		log.Printf("Failed to answer DHT %s from %s: %v", msg.Type, addr, err)
+	}
+}
+
+// putRecord stores a valid record unless we hold one at least as new
+func (d *DHT) putRecord(record PeerRecord) error {
+	if err := record.verify(time.Now()); err != nil {
+		return err
+	}
+	id, err := dhtIDFromFingerprint(record.Fingerprint)
+	if err != nil {
+		return err
+	}
+
+	d.recordsMutex.Lock()
+	defer d.recordsMutex.Unlock()
+
+	if known, exists := d.records[id]; exists {
+		if record.Timestamp > known.Timestamp {
+			d.records[id] = record
+		}
+		return nil
+	}
+	if len(d.records) >= dhtMaxRecords {
+		return errors.New("record store full")
+	}
+	d.records[id] = record
+	return nil
+}
+
+// getRecord returns the record stored under id, unless it has expired
+func (d *DHT) getRecord(id dhtID) (PeerRecord, bool) {
+	d.recordsMutex.Lock()
+	defer d.recordsMutex.Unlock()
+
+	record, exists := d.records[id]
+	if !exists || time.Since(record.signedAt()) > peerRecordTTL {
+		return PeerRecord{}, false
+	}
+	return record, true
+}
+
+// expireRecords drops records older than peerRecordTTL
+func (d *DHT) expireRecords(now time.Time) {
+	d.recordsMutex.Lock()
+	defer d.recordsMutex.Unlock()
+
+	for id, record := range d.records {
+		if now.Sub(record.signedAt()) > peerRecordTTL {
+			delete(d.records, id)
+		}
+	}
+}
+
+// lookup finds the dhtK nodes nearest to target by asking the nearest nodes we know for nearer
+// ones, dhtAlpha at a time, until the nearest dhtK have all answered. With findValue set it
+// stops early at the first valid record for target.
+func (d *DHT) lookup(target dhtID, findValue bool) ([]dhtContact, *PeerRecord) {
+	type candidate struct {
+		contact dhtContact
+		queried bool
+		failed  bool
+	}
+	type result struct {
+		contact dhtContact
+		reply   dhtMessage
+		err     error
+	}
+
+	candidates := make(map[dhtID]*candidate)
+	add := func(contacts []dhtContact) {
+		for _, contact := range contacts {
+			if _, known := candidates[contact.ID]; !known && contact.ID != d.self {
+				candidates[contact.ID] = &candidate{contact: contact}
+			}
+		}
+	}
+	// nearest lists the dhtK nearest candidates that haven't failed
+	nearest := func() []*candidate {
+		var alive []dhtContact
+		for _, c := range candidates {
+			if !c.failed {
+				alive = append(alive, c.contact)
+			}
+		}
+		sortByDistance(alive, target)
+		list := make([]*candidate, 0, dhtK)
+		for _, contact := range alive[:min(len(alive), dhtK)] {
+			list = append(list, candidates[contact.ID])
+		}
+		return list
+	}
+
+	add(d.table.closest(target, dhtK))
+	request := dhtFindNode
+	if findValue {
+		request = dhtFindValue
+	}
+
+	for {
+		var batch []*candidate
+		for _, c := range nearest() {
+			if !c.queried && len(batch) < dhtAlpha {
+				c.queried = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan result, len(batch))
+		for _, c := range batch {
+			go func(contact dhtContact) {
+				reply, err := d.call(contact, dhtMessage{Type: request, Target: &target})
+				results <- result{contact, reply, err}
+			}(c.contact)
+		}
+		for range batch {
+			r := <-results
+			if r.err != nil {
+				candidates[r.contact.ID].failed = true
+				continue
+			}
+			if r.reply.Record != nil && r.reply.Record.Fingerprint == target.String() &&
+				r.reply.Record.verify(time.Now()) == nil {
+				record := *r.reply.Record
+				return nil, &record
+			}
+			add(r.reply.Nodes)
+		}
+	}
+
+	var found []dhtContact
+	for _, c := range nearest() {
+		found = append(found, c.contact)
+	}
+	return found, nil
+}
+
+// join pings the bootstrap nodes and the contacts saved from our last run, then looks up our
+// own ID, which fills the table with the nodes around us and tells them about us
+func (d *DHT) join() {
+	addrs := append([]string(nil), d.bootstrap...)
+	for _, contact := range d.loadState() {
+		addrs = append(addrs, contact.Addr)
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			// A reply puts the node in the table, whatever ID it has
+			if _, err := d.call(dhtContact{Addr: addr}, dhtMessage{Type: dhtPing}); err != nil {
+				log.Printf("DHT bootstrap: %v", err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	d.lookup(d.self, false)
+	log.Printf("DHT joined with %d contact(s)", len(d.table.contacts()))
+}
+
+// publish stores a record with us and on the dhtK nodes nearest to its key
+func (d *DHT) publish(record PeerRecord) {
+	if err := d.putRecord(record); err != nil {
+		log.Printf("Failed to store own DHT record: %v", err)
+		return
+	}
+	id, _ := dhtIDFromFingerprint(record.Fingerprint)
+	nodes, _ := d.lookup(id, false)
+
+	var wg sync.WaitGroup
+	stored := make(chan struct{}, len(nodes))
+	for _, contact := range nodes {
+		wg.Add(1)
+		go func(contact dhtContact) {
+			defer wg.Done()
+			if reply, err := d.call(contact, dhtMessage{Type: dhtStore, Record: &record}); err == nil && reply.Type == dhtStored {
+				stored <- struct{}{}
+			}
+		}(contact)
+	}
+	wg.Wait()
+	log.Printf("DHT record published on %d node(s)", len(stored))
+}
+
+// resolve finds the record of the node holding the key with fingerprint
+func (d *DHT) resolve(fingerprint string) (PeerRecord, error) {
+	id, err := dhtIDFromFingerprint(fingerprint)
+	if err != nil {
+		return PeerRecord{}, err
+	}
+	if record, exists := d.getRecord(id); exists {
+		return record, nil
+	}
+	if _, record := d.lookup(id, true); record != nil {
+		return *record, nil
+	}
+	return PeerRecord{}, fmt.Errorf("no DHT record for %s", formatFingerprint(fingerprint)[:19])
+}
+
+// saveState writes the routing table, so the next run can rejoin without the bootstrap nodes
+func (d *DHT) saveState() {
+	data, err := json.MarshalIndent(d.table.contacts(), "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(d.statePath, data, 0600); err != nil {
+		log.Printf("Failed to save DHT contacts: %v", err)
+	}
+}
+
+// loadState reads the contacts saved by the last run
+func (d *DHT) loadState() []dhtContact {
+	data, err := os.ReadFile(d.statePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read DHT contacts: %v", err)
+		}
+		return nil
+	}
+	var contacts []dhtContact
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		log.Printf("Ignoring unreadable DHT contacts in %s: %v", d.statePath, err)
+		return nil
+	}
+	return contacts
+}
+
+// handleDHT serves DHT requests until shutdown
+func (n *Node) handleDHT() {
+	defer n.wg.Done()
+	n.dht.serve()
+}
+
+// maintainDHT joins the DHT, then keeps our record published and the table fresh, saving the
+// table as it goes and at shutdown
+func (n *Node) maintainDHT() {
+	defer n.wg.Done()
+	defer n.dht.saveState()
+
+	n.dht.join()
+	n.publishDHTRecord()
+	n.dht.saveState()
+
+	republish := time.NewTicker(peerRecordRefresh)
+	defer republish.Stop()
+	refresh := time.NewTicker(dhtRefreshInterval)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case now := <-republish.C:
+			n.dht.expireRecords(now)
+			n.publishDHTRecord()
+		case <-refresh.C:
+			n.dht.lookup(n.dht.self, false)
+			n.dht.saveState()
+		case <-n.Shutdown:
+			return
+		}
+	}
+}
+
+// publishDHTRecord signs a fresh record of our addresses and publishes it
+func (n *Node) publishDHTRecord() {
+	record, err := newPeerRecord(n.cryptoManager, n.ID, n.recordAddresses(), time.Now())
+	if err != nil {
+		log.Printf("Failed to sign DHT record: %v", err)
+		return
+	}
+	n.dht.publish(record)
+}
+
+// connectToFingerprint resolves a fingerprint through the DHT and connects to the node holding
+// that key. The key is taken as the one for that node, so a Noise handshake there presenting a
+// different key is refused.
+func (en *EnhancedNode) connectToFingerprint(fingerprint string) {
+	fail := func(err error) {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ %v", err)),
+		})
+	}
+	if en.dht == nil {
+		fail(errors.New("resolving a fingerprint needs the DHT; start with -dht"))
+		return
+	}
+
+	record, err := en.dht.resolve(fingerprint)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := en.checkRecordKey(record); err != nil {
+		fail(fmt.Errorf("DHT record %v", err))
+		return
+	}
+	if !en.cryptoManager.HasPeerKey(record.NodeID) {
+		en.auditPeerKey(record.NodeID, "", fingerprint, "its DHT record")
+		en.keySeen(record.NodeID, fingerprint)
+		if err := en.cryptoManager.AddPeerKey(record.NodeID, record.PublicKey); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("🔎 %s is at %s", formatFingerprint(fingerprint)[:19], strings.Join(record.Addresses, ", "))),
+	})
+	var lastErr error
+	for _, addr := range record.Addresses {
+		if lastErr = en.connectToPeer(addr); lastErr == nil {
+			return
+		}
+	}
+	fail(lastErr)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDHT opens a DHT on loopback for the index'th test key, serving until the test ends
+func newTestDHT(t *testing.T, index int, bootstrap ...string) (*DHT, *CryptoManager) {
+	t.Helper()
+	cm := testCrypto(t, index)
+	d, err := NewDHT(memoryHost+":0", cm.Fingerprint(), bootstrap, filepath.Join(t.TempDir(), dhtStateFile), &trafficCounter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		d.serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		d.Close()
+		<-done
+	})
+	return d, cm
+}
+
+// TestDHTPutGet joins several DHTs, each through the one before, and publishes one's record:
+// every other finds it by the fingerprint, whether it holds a copy or has to look it up
+func TestDHTPutGet(t *testing.T) {
+	var dhts []*DHT
+	var keys []*CryptoManager
+	for i := range 6 {
+		var bootstrap []string
+		if i > 0 {
+			bootstrap = []string{dhts[i-1].conn.LocalAddr().String()}
+		}
+		d, cm := newTestDHT(t, i, bootstrap...)
+		d.join()
+		dhts, keys = append(dhts, d), append(keys, cm)
+	}
+	if contacts := dhts[5].table.contacts(); len(contacts) < 2 {
+		t.Errorf("the last to join knows %d node(s)", len(contacts))
+	}
+
+	record, err := newPeerRecord(keys[2], memoryHost+":9002", []string{memoryHost + ":9002"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dhts[2].publish(record)
+	for i, d := range dhts {
+		found, err := d.resolve(keys[2].Fingerprint())
+		if err != nil {
+			t.Errorf("node %d: %v", i, err)
+			continue
+		}
+		if found.NodeID != record.NodeID || found.Signature != record.Signature {
+			t.Errorf("node %d found %+v", i, found)
+		}
+	}
+
+	if _, err := dhts[0].resolve(keys[4].Fingerprint()); err == nil || !strings.Contains(err.Error(), "no DHT record") {
+		t.Errorf("resolving an unpublished key: %v", err)
+	}
+}
+
+// TestDHTRecords stores only valid records, keeping the newest for each key
+func TestDHTRecords(t *testing.T) {
+	d, cm := newTestDHT(t, 0)
+	now := time.Now()
+	id, _ := dhtIDFromFingerprint(cm.Fingerprint())
+	sign := func(addr string, at time.Time) PeerRecord {
+		record, err := newPeerRecord(cm, memoryHost+":9000", []string{addr}, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+
+	current := sign(memoryHost+":9000", now.Add(-time.Minute))
+	if err := d.putRecord(current); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.putRecord(sign(memoryHost+":9001", now.Add(-2*time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := d.getRecord(id); got.Addresses[0] != memoryHost+":9000" {
+		t.Errorf("an older record replaced the newer: %v", got.Addresses)
+	}
+	if err := d.putRecord(sign(memoryHost+":9002", now)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := d.getRecord(id); got.Addresses[0] != memoryHost+":9002" {
+		t.Errorf("a newer record didn't replace the older: %v", got.Addresses)
+	}
+
+	tampered := sign(memoryHost+":9003", now.Add(time.Minute))
+	tampered.Addresses = []string{"203.0.113.9:9003"}
+	if err := d.putRecord(tampered); err == nil {
+		t.Error("stored a record whose addresses were changed after signing")
+	}
+	if err := d.putRecord(sign(memoryHost+":9004", now.Add(-peerRecordTTL-time.Minute))); err == nil {
+		t.Error("stored an expired record")
+	}
+	if got, _ := d.getRecord(id); got.Addresses[0] != memoryHost+":9002" {
+		t.Errorf("a refused record was stored: %v", got.Addresses)
+	}
+}
+
+// TestDHTRejoin saves the routing table and reads it back, so a restart needs no bootstrap node
+func TestDHTRejoin(t *testing.T) {
+	first, _ := newTestDHT(t, 0)
+	second, _ := newTestDHT(t, 1, first.conn.LocalAddr().String())
+	second.join()
+	second.saveState()
+
+	contacts := second.loadState()
+	if len(contacts) != 1 || contacts[0].ID != first.self || contacts[0].Addr != first.conn.LocalAddr().String() {
+		t.Errorf("saved %+v, want the one node joined through", contacts)
+	}
+}
+
+// TestDHTConnect starts three nodes in the DHT, the third joining through the second: it finds
+// the first by its fingerprint alone and connects to it
+func TestDHTConnect(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	var bootstrap []string
+	for range 3 {
+		node := tn.newNode(WithDHT(DHTConfig{Listen: memoryHost + ":0", Bootstrap: bootstrap}))
+		tn.start(node)
+		bootstrap = []string{node.dht.conn.LocalAddr().String()}
+	}
+	a, c := tn.nodes[0], tn.nodes[2]
+
+	fingerprint := a.cryptoManager.Fingerprint()
+	waitFor(t, "a's record to be published", func() bool {
+		_, err := c.dht.resolve(fingerprint)
+		return err == nil
+	})
+	c.handleEnhancedCLICommand("/connect "+fingerprint, c.ID)
+	waitFor(t, "c to connect to a", func() bool { return connectedTo(c, a.ID) })
+	waitForKeys(t, a, c)
+	if held, _ := c.cryptoManager.PeerFingerprint(a.ID); held != fingerprint {
+		t.Errorf("c holds key %s for a, want %s", held, fingerprint)
+	}
+}
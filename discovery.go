@@ -8,6 +8,45 @@ import (
 	"time"
 )
 
+// discoveryAddrPrefix marks an announcement field naming a further address the node listens on.
+// Older nodes take it for a capability they don't know and ignore it.
+const discoveryAddrPrefix = "addr="
+
+// discoveryAddresses is the part of our announcements listing the addresses other than our ID
+func (n *Node) discoveryAddresses() string {
+	var fields strings.Builder
+	for _, addr := range n.recordAddresses()[1:] {
+		fields.WriteString(fmt.Sprintf("%c%s%s", delimiter, discoveryAddrPrefix, addr))
+	}
+	return fields.String()
+}
+
+// announcedAddresses returns the further addresses in an announcement's fields
+func announcedAddresses(fields []string) []string {
+	var addrs []string
+	for _, field := range fields {
+		addr, found := strings.CutPrefix(strings.TrimSpace(field), discoveryAddrPrefix)
+		if !found || len(addrs) >= maxRecordAddresses {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// reachableAddr picks which of a node's addresses to dial: the one on the host its announcement
+// came from, as that route evidently works, or else its ID
+func reachableAddr(nodeID string, addrs []string, from net.IP) string {
+	for _, addr := range append([]string{nodeID}, addrs...) {
+		if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host).Equal(from) {
+			return addr
+		}
+	}
+	return nodeID
+}
+
 func (n *Node) handleDiscovery() {
 	defer n.wg.Done()
 
@@ -32,6 +71,7 @@ func (n *Node) handleDiscovery() {
 				}
 			}
 
+			n.traffic.total.in.Add(uint64(length))
 			message := string(buffer[:length])
 			parts := strings.Split(message, string(delimiter))
 
@@ -41,30 +81,40 @@ func (n *Node) handleDiscovery() {
 
 			command := parts[0]
 			peerID := parts[1]
+			if peerID != n.ID {
+				// Anything after the ID lists what the node accepts and any further addresses it
+				// listens on; older nodes send nothing
+				n.noteCapabilities(peerID, parts[2:])
+				if dialAddr := reachableAddr(peerID, announcedAddresses(parts[2:]), addr.IP); dialAddr != peerID {
+					n.noteCapabilities(dialAddr, parts[2:])
+					peerID = dialAddr
+				}
+			}
 
 			switch command {
 			case "DISCOVER":
 				// Respond to discovery
 				if peerID != n.ID {
-					n.knownMutex.Lock()
-					n.KnownPeers[peerID] = true
-					n.knownMutex.Unlock()
+					n.rememberAddr(peerID)
 
 					select {
 					case n.DiscoveredPeer <- peerID:
 					default:
 					}
 
+					if n.locked.Load() {
+						continue
+					}
 					// Send response
-					response := fmt.Sprintf("DISCOVER_RESPONSE%c%s", delimiter, n.ID)
-					n.discoveryConn.WriteToUDP([]byte(response), addr)
+					response := fmt.Sprintf("DISCOVER_RESPONSE%c%s%s%s", delimiter, n.ID, n.discoveryCapabilities(), n.discoveryAddresses())
+					if sent, err := n.discoveryConn.WriteToUDP([]byte(response), addr); err == nil {
+						n.traffic.total.out.Add(uint64(sent))
+					}
 				}
 
 			case "DISCOVER_RESPONSE":
 				if peerID != n.ID {
-					n.knownMutex.Lock()
-					n.KnownPeers[peerID] = true
-					n.knownMutex.Unlock()
+					n.rememberAddr(peerID)
 
 					select {
 					case n.DiscoveredPeer <- peerID:
@@ -76,22 +126,42 @@ func (n *Node) handleDiscovery() {
 	}
 }
 
+// announcePresence multicasts a DISCOVER message every announceInterval, give or take jitter,
+// backing off while the node has enough peers (see nextAnnounceInterval)
 func (n *Node) announcePresence() {
 	defer n.wg.Done()
 
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	interval := announceInterval
+	timer := n.wallClock.NewTimer(n.jitter(interval))
+	defer timer.Stop()
 
 	mcastAddr, _ := net.ResolveUDPAddr("udp", multicastAddr)
 
 	for {
 		select {
-		case <-ticker.C:
-			message := fmt.Sprintf("DISCOVER%c%s", delimiter, n.ID)
-			n.discoveryConn.WriteToUDP([]byte(message), mcastAddr)
+		case <-timer.Chan():
+			n.peersMutex.RLock()
+			peers := len(n.Peers)
+			n.peersMutex.RUnlock()
+			interval = nextAnnounceInterval(interval, peers)
+
+			if !n.locked.Load() {
+				message := fmt.Sprintf("DISCOVER%c%s%s%s", delimiter, n.ID, n.discoveryCapabilities(), n.discoveryAddresses())
+				if sent, err := n.discoveryConn.WriteToUDP([]byte(message), mcastAddr); err == nil {
+					n.traffic.total.out.Add(uint64(sent))
+				}
+			}
+
+		case <-n.noPeers:
+			// Don't sit out a long backoff alone
+			if interval == announceInterval {
+				continue
+			}
+			interval = announceInterval
 
 		case <-n.Shutdown:
 			return
 		}
+		timer.Reset(n.jitter(interval))
 	}
 }
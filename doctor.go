@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// multicastProbeTimeout is how long a multicast probe waits for its own packet to come back. On a
+// host where multicast works it is back within a millisecond or two.
+const multicastProbeTimeout = 500 * time.Millisecond
+
+// multicastProbePrefix starts a discovery probe. It has no delimiter, so handleDiscovery on this
+// and other nodes drops it as too short.
+const multicastProbePrefix = "PROBE"
+
+// Outcomes of a health check
+const (
+	checkPass = "pass"
+	checkWarn = "warn" // Something works less well or is off, but the node runs
+	checkFail = "fail" // Something the node needs is broken
+)
+
+// healthCheck is the outcome of one probe, with what to do about it when it didn't pass
+type healthCheck struct {
+	Name   string
+	Status string
+	Detail string
+	Hint   string
+}
+
+// healthReport is the outcome of every probe, for /doctor and -check
+type healthReport []healthCheck
+
+// Failed reports whether any check failed
+func (r healthReport) Failed() bool {
+	for _, check := range r {
+		if check.Status == checkFail {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the report, a line per check with its hint under it
+func (r healthReport) String() string {
+	icons := map[string]string{checkPass: "✅", checkWarn: "⚠️", checkFail: "❌"}
+	counts := make(map[string]int)
+	var content strings.Builder
+	content.WriteString("🩺 Health checks:")
+	for _, check := range r {
+		counts[check.Status]++
+		content.WriteString(fmt.Sprintf("\n  %s %-11s %s", icons[check.Status], check.Name, check.Detail))
+		if check.Hint != "" && check.Status != checkPass {
+			content.WriteString("\n       → " + check.Hint)
+		}
+	}
+	content.WriteString(fmt.Sprintf("\n  %d passed, %d warned, %d failed", counts[checkPass], counts[checkWarn], counts[checkFail]))
+	return content.String()
+}
+
+// checkListenAll runs checkListen on each -listen address. The node starts if any of them can be
+// bound, so while one can the others failing is only a warning.
+func checkListenAll(listenAddrs []string, portRange int) []healthCheck {
+	checks := make([]healthCheck, len(listenAddrs))
+	anyBound := false
+	for i, addr := range listenAddrs {
+		checks[i] = checkListen(addr, portRange)
+		anyBound = anyBound || checks[i].Status != checkFail
+	}
+	if anyBound {
+		for i := range checks {
+			if checks[i].Status == checkFail {
+				checks[i].Status = checkWarn
+				checks[i].Detail += "; the node would listen on the other addresses"
+			}
+		}
+	}
+	return checks
+}
+
+// checkListen tries to bind the listen address, and the ports after it that -port-range allows,
+// for -check before the node takes one
+func checkListen(listenAddr string, portRange int) healthCheck {
+	check := healthCheck{Name: "listen"}
+	candidates, err := listenCandidates(listenAddr, portRange)
+	if err != nil {
+		check.Status, check.Detail = checkFail, err.Error()
+		check.Hint = "give -listen as host:port, e.g. :9000 or 127.0.0.1:9000"
+		return check
+	}
+
+	var firstErr error
+	for i, addr := range candidates {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		bound := listener.Addr().String()
+		listener.Close()
+		if i == 0 {
+			check.Status, check.Detail = checkPass, "can listen on "+bound
+			return check
+		}
+		check.Status = checkWarn
+		check.Detail = fmt.Sprintf("%s is taken (%v); -port-range would move to %s", listenAddr, firstErr, bound)
+		check.Hint = "peers told to connect to " + listenAddr + " won't find this node; stop whatever holds the port or pick another -listen"
+		return check
+	}
+
+	check.Status, check.Detail = checkFail, fmt.Sprintf("can't listen on %s: %v", listenAddr, firstErr)
+	switch {
+	case errors.Is(firstErr, syscall.EADDRNOTAVAIL):
+		check.Hint = "no interface on this host has that address; give one of its own, or :port for all of them"
+	case errors.Is(firstErr, os.ErrPermission):
+		check.Hint = "ports under 1024 need privileges; use a higher port"
+	case len(candidates) > 1:
+		check.Hint = fmt.Sprintf("every port from %s to %s is taken; widen -port-range or pick another -listen", candidates[0], candidates[len(candidates)-1])
+	default:
+		check.Hint = "another program (or another p2pchat) holds the port; stop it, pick another -listen, or add -port-range 10"
+	}
+	return check
+}
+
+// probeMulticast sends a probe to the discovery group and waits for it to arrive on conn, which
+// must have joined the group. A host whose firewall or routes keep multicast from working fails
+// here, where discovery would otherwise just never find anyone. The probe goes out on a socket of
+// its own: ListenMulticastUDP turns off loopback on conn, so nothing it sends comes back to this host.
+func probeMulticast(conn *net.UDPConn, timeout time.Duration) error {
+	group, err := net.ResolveUDPAddr("udp", multicastAddr)
+	if err != nil {
+		return err
+	}
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	probe := multicastProbePrefix + hex.EncodeToString(token)
+
+	sender, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	if _, err := sender.WriteToUDP([]byte(probe), group); err != nil {
+		return fmt.Errorf("can't send to %s: %w", multicastAddr, err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 1024)
+	for {
+		// Other nodes' announcements may arrive first; only our own probe counts
+		length, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return fmt.Errorf("a probe sent to %s didn't come back within %v", multicastAddr, timeout)
+			}
+			return err
+		}
+		if string(buffer[:length]) == probe {
+			return nil
+		}
+	}
+}
+
+// checkMulticast joins the discovery group on a socket of its own and probes it. The node's own
+// discovery socket, if it has one, shares the port.
+func checkMulticast(discoveryOn bool) healthCheck {
+	check := healthCheck{Name: "multicast", Hint: "allow UDP " + multicastAddr + " in the firewall, or connect with /connect, -peer or -rendezvous-server"}
+	group, err := net.ResolveUDPAddr("udp", multicastAddr)
+	if err == nil {
+		var conn *net.UDPConn
+		if conn, err = net.ListenMulticastUDP("udp", nil, group); err == nil {
+			err = probeMulticast(conn, multicastProbeTimeout)
+			conn.Close()
+		}
+	}
+
+	switch {
+	case err != nil:
+		check.Status, check.Detail = checkWarn, fmt.Sprintf("discovery can't work here: %v", err)
+		if !discoveryOn {
+			check.Detail += " (discovery is off anyway)"
+		}
+	case !discoveryOn:
+		check.Status, check.Detail = checkPass, "works, but discovery is off"
+	default:
+		check.Status, check.Detail = checkPass, "discovery packets reach "+multicastAddr+" and come back"
+	}
+	return check
+}
+
+// selfTest signs a random message with the private key and verifies it with the public key, so
+// damaged or mismatched key files are found before a peer refuses our messages
+func (cm *CryptoManager) selfTest() error {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	signature, err := cm.SignPlaintext(data)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(cm.publicKey, data, signature.Signature); err != nil {
+		return fmt.Errorf("the public key doesn't match the private key: %w", err)
+	}
+	return nil
+}
+
+// checkKeys runs the key self-test on keys that are loaded
+func checkKeys(cm *CryptoManager) healthCheck {
+	check := healthCheck{Name: "keys"}
+	if err := cm.selfTest(); err != nil {
+		check.Status, check.Detail = checkFail, err.Error()
+		check.Hint = fmt.Sprintf("restore %s from a backup, or move it away to start again with a new identity", cm.keysDir)
+		return check
+	}
+	check.Status, check.Detail = checkPass, "sign and verify with "+formatFingerprint(cm.Fingerprint())[:19]
+	return check
+}
+
+// checkKeyFiles loads the keys in keysDir and runs the self-test, for -check before the node has
+// loaded them. Missing keys aren't a problem: the node generates them.
+func checkKeyFiles(keysDir string) healthCheck {
+	if _, err := os.Stat(filepath.Join(keysDir, privateKeyFile)); errors.Is(err, os.ErrNotExist) {
+		return healthCheck{Name: "keys", Status: checkPass, Detail: "none yet; a new identity is created on first start"}
+	}
+	cm, err := NewCryptoManager(keysDir)
+	if err != nil {
+		check := healthCheck{Name: "keys", Status: checkFail, Detail: err.Error()}
+		check.Hint = fmt.Sprintf("restore %s from a backup, or move it away to start again with a new identity", keysDir)
+		if errors.Is(err, ErrWrongPassphrase) || strings.Contains(err.Error(), keyPassphraseEnv) {
+			check.Hint = "give the key passphrase at the prompt or in $" + keyPassphraseEnv
+		}
+		return check
+	}
+	return checkKeys(cm)
+}
+
+// checkWritable writes, syncs, reads back and removes a file in each directory
+func checkWritable(name string, dirs ...string) healthCheck {
+	check := healthCheck{Name: name}
+	for _, dir := range dirs {
+		if err := writeProbe(dir); err != nil {
+			check.Status, check.Detail = checkFail, err.Error()
+			check.Hint = "make " + dir + " writable by this user, or free some disk space"
+			return check
+		}
+	}
+	check.Status, check.Detail = checkPass, strings.Join(dirs, ", ")+" writable"
+	return check
+}
+
+// writeProbe checks a file can be written to dir, which is created if need be, and read back
+func writeProbe(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("can't create %s: %w", dir, err)
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return fmt.Errorf("can't create a file in %s: %w", dir, err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(token)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write to %s: %w", dir, err)
+	}
+	if data, err := os.ReadFile(file.Name()); err != nil || string(data) != string(token) {
+		return fmt.Errorf("a file written to %s didn't read back intact", dir)
+	}
+	return nil
+}
+
+// checkAudio reports what voice messages can do: record, compress and play
+func checkAudio(capture captureBackend, outputErr error) []healthCheck {
+	recording := healthCheck{Name: "recording", Status: checkPass}
+	if capture == nil {
+		recording.Status, recording.Detail = checkWarn, "no microphone could be opened and no audio recorder found in PATH; /voice is disabled"
+		recording.Hint = "check a capture device is plugged in, or install ffmpeg, or parec from PulseAudio/PipeWire, arecord from alsa-utils, or sox"
+	} else {
+		recording.Detail = "records with " + capture.Name()
+	}
+
+	compression := healthCheck{Name: "compression", Status: checkPass, Detail: "ffmpeg compresses voice messages to MP3"}
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		compression.Status, compression.Detail = checkWarn, "no ffmpeg in PATH; voice messages are sent as WAV, several times larger"
+		compression.Hint = "install ffmpeg"
+	}
+
+	playback := healthCheck{Name: "playback", Status: checkPass, Detail: "audio output opens"}
+	if outputErr != nil {
+		playback.Status, playback.Detail = checkWarn, outputErr.Error()
+		playback.Hint = "check the sound server (PulseAudio, PipeWire or ALSA) is running; clips are kept for when it is"
+	}
+	return []healthCheck{recording, compression, playback}
+}
+
+// skippedOverTor is the multicast check of a node on Tor, which must not announce itself
+var skippedOverTor = healthCheck{Name: "multicast", Status: checkPass, Detail: "skipped: discovery is off over Tor"}
+
+// runHealthCheck runs every probe before a node exists, for -check
+func runHealthCheck(listenAddrs []string, portRange int, dataDir, configPath string, discoveryOn, overTor bool) healthReport {
+	configCheck := healthCheck{Name: "config", Status: checkPass, Detail: configPath}
+	downloadDir := filepath.Join(dataDir, downloadsDirName)
+	if config, err := LoadConfig(configPath); err != nil {
+		configCheck.Status, configCheck.Detail = checkFail, err.Error()
+		configCheck.Hint = "fix the JSON, or move the file away to start from the defaults"
+	} else {
+		if config.Discovery != nil && !*config.Discovery {
+			discoveryOn = false
+		}
+		if config.DownloadsDir != "" {
+			downloadDir = expandHome(config.DownloadsDir)
+		}
+		if _, err := parseDownloadsLayout(config.DownloadsLayout); err != nil {
+			configCheck.Status, configCheck.Detail = checkWarn, err.Error()
+			configCheck.Hint = "received files are saved flat until downloads_layout is fixed"
+		}
+	}
+
+	multicast := skippedOverTor
+	if !overTor {
+		multicast = checkMulticast(discoveryOn)
+	}
+	report := healthReport{configCheck}
+	report = append(report, checkListenAll(listenAddrs, portRange)...)
+	report = append(report,
+		multicast,
+		checkKeyFiles(filepath.Join(dataDir, keysDirName)),
+		checkWritable("data dir", dataDir, downloadDir),
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- openSpeaker()
+	}()
+	var outputErr error
+	select {
+	case err := <-done:
+		if err != nil {
+			outputErr = fmt.Errorf("%w (%v)", errNoAudioOutput, err)
+		}
+	case <-time.After(audioProbeTimeout):
+		outputErr = fmt.Errorf("%w: it didn't open within %v", errNoAudioOutput, audioProbeTimeout)
+	}
+	return append(report, checkAudio(findCaptureBackend(), outputErr)...)
+}
+
+// doctor runs every probe against the running node
+func (en *EnhancedNode) doctor() healthReport {
+	bound := make([]string, len(en.listeners))
+	for i, listener := range en.listeners {
+		bound[i] = listener.Addr().String()
+	}
+	listen := healthCheck{Name: "listen", Status: checkPass, Detail: "listening on " + strings.Join(bound, ", ")}
+	if len(en.listenFailures) > 0 {
+		failures := make([]string, len(en.listenFailures))
+		for i, err := range en.listenFailures {
+			failures[i] = err.Error()
+		}
+		listen.Status = checkWarn
+		listen.Detail += "; not on " + strings.Join(failures, "; ")
+		listen.Hint = "check each -listen address belongs to one of this host's interfaces, or that nothing else holds its port"
+	}
+	multicast := skippedOverTor
+	if en.tor == nil {
+		multicast = checkMulticast(en.discoveryConn != nil)
+		if en.discoveryProblem != nil {
+			multicast.Detail += fmt.Sprintf("; turned discovery off at startup: %v", en.discoveryProblem)
+		}
+	}
+
+	configCheck := healthCheck{Name: "config", Status: checkPass, Detail: en.configPath}
+	if _, err := parseDownloadsLayout(en.config.DownloadsLayout); err != nil {
+		configCheck.Status, configCheck.Detail = checkWarn, err.Error()
+		configCheck.Hint = "received files are saved flat until downloads_layout is fixed"
+	}
+	downloadDir, _, _ := en.fileManager.receiveSettings()
+	report := healthReport{
+		configCheck,
+		listen,
+		multicast,
+		checkKeys(en.cryptoManager),
+		checkWritable("data dir", en.dataDir, downloadDir),
+	}
+	return append(report, checkAudio(en.voiceManager.capture, en.voiceManager.outputError())...)
+}
+
+// handleDoctorCommand processes /doctor
+func (en *EnhancedNode) handleDoctorCommand() {
+	en.notifyUI(Message{SenderID: "System", Content: []byte(en.doctor().String())})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCheckListen fails on a port another program holds, and warns when -port-range would move
+// past it
+func TestCheckListen(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { busy.Close() })
+	addr := busy.Addr().String()
+
+	if check := checkListen(addr, 0); check.Status != checkFail || !strings.Contains(check.Hint, "another program") {
+		t.Errorf("busy port: %+v", check)
+	}
+	if check := checkListen(addr, 10); check.Status != checkWarn || !strings.Contains(check.Detail, "would move to") {
+		t.Errorf("busy port with -port-range: %+v", check)
+	}
+	if check := checkListen("127.0.0.1:0", 0); check.Status != checkPass {
+		t.Errorf("free port: %+v", check)
+	}
+	if check := checkListen("nowhere", 0); check.Status != checkFail {
+		t.Errorf("no port: %+v", check)
+	}
+
+	// One address that binds is enough to start, so the busy one is only a warning
+	checks := checkListenAll([]string{addr, "127.0.0.1:0"}, 0)
+	if checks[0].Status != checkWarn || checks[1].Status != checkPass {
+		t.Errorf("one busy address of two: %+v", checks)
+	}
+	if checks := checkListenAll([]string{addr}, 0); checks[0].Status != checkFail {
+		t.Errorf("the only address busy: %+v", checks)
+	}
+}
+
+// TestCheckWritable fails on a directory that can't be created or written, naming it in the hint
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	if check := checkWritable("data dir", dir, filepath.Join(dir, "downloads")); check.Status != checkPass {
+		t.Errorf("writable directories: %+v", check)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("left %d entries behind, want only the downloads directory", len(entries))
+	}
+
+	// A file where the directory should be can't be written into, even by root
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, unwritable := range []string{blocked, filepath.Join(blocked, "downloads")} {
+		check := checkWritable("data dir", dir, unwritable)
+		if check.Status != checkFail || !strings.Contains(check.Hint, unwritable) {
+			t.Errorf("%s: %+v", unwritable, check)
+		}
+	}
+}
+
+// TestKeySelfTest fails keys whose public half isn't the private key's, loaded or on disk
+func TestKeySelfTest(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	for i, dir := range dirs {
+		testKeys(t, i, dir)
+	}
+	keysDir := filepath.Join(dirs[0], keysDirName)
+	if check := checkKeyFiles(keysDir); check.Status != checkPass {
+		t.Fatalf("matching keys: %+v", check)
+	}
+	if check := checkKeyFiles(t.TempDir()); check.Status != checkPass {
+		t.Errorf("no keys yet: %+v", check)
+	}
+
+	cm, err := NewCryptoManager(keysDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCryptoManager(filepath.Join(dirs[1], keysDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.publicKey = other.publicKey
+	if err := cm.selfTest(); err == nil {
+		t.Error("self-test passed with another key's public half")
+	}
+	if check := checkKeys(cm); check.Status != checkFail {
+		t.Errorf("mismatched keys: %+v", check)
+	}
+
+	otherPublic, err := os.ReadFile(filepath.Join(dirs[1], keysDirName, publicKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(keysDir, publicKeyFile), otherPublic, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if check := checkKeyFiles(keysDir); check.Status != checkFail || !strings.Contains(check.Hint, keysDir) {
+		t.Errorf("mismatched key files: %+v", check)
+	}
+}
+
+// TestMulticastProbeFailure turns discovery off when a multicast probe doesn't come back, and
+// /doctor says why
+func TestMulticastProbeFailure(t *testing.T) {
+	// A socket outside the discovery group never sees the probe
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := probeMulticast(conn, 50*time.Millisecond); err == nil || !strings.Contains(err.Error(), "didn't come back") {
+		t.Errorf("probe outside the group: %v", err)
+	}
+
+	errDropped := errors.New("the firewall dropped the probe")
+	dataDir := t.TempDir()
+	testKeys(t, 0, dataDir)
+	node, err := NewEnhancedNode(memoryHost+":0", false, dataDir, WithTransport(NewMemoryNetwork()),
+		func(options *nodeOptions) {
+			options.probeMulticast = func(*net.UDPConn, time.Duration) error { return errDropped }
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, listener := range node.listeners {
+			listener.Close()
+		}
+	})
+	if node.discoveryProblem != nil && !errors.Is(node.discoveryProblem, errDropped) {
+		t.Skipf("can't join the multicast group here: %v", node.discoveryProblem)
+	}
+
+	if node.discoveryConn != nil || !errors.Is(node.discoveryProblem, errDropped) {
+		t.Fatalf("discovery connection %v, problem %v", node.discoveryConn, node.discoveryProblem)
+	}
+	for _, check := range node.doctor() {
+		if check.Name == "multicast" && !strings.Contains(check.Detail, "turned discovery off at startup: "+errDropped.Error()) {
+			t.Errorf("/doctor reports %+v", check)
+		}
+	}
+}
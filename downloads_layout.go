@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxSameNameFiles is how many numbered names ("report (2).pdf") are tried for a received file
+// before giving up
+const maxSameNameFiles = 1000
+
+// layoutToken matches a {token} in a downloads layout
+var layoutToken = regexp.MustCompile(`\{[^{}]*\}`)
+
+// layoutTokens are the tokens a downloads layout may use
+var layoutTokens = map[string]bool{
+	"{peer}":        true, // Contact alias, else nick, else the start of the key's fingerprint
+	"{fingerprint}": true, // Start of the sender's key fingerprint
+	"{room}":        true, // Room the file was sent to, without the #; empty if sent to us alone
+	"{year}":        true, // 2026
+	"{month}":       true, // 2026-10
+	"{date}":        true, // 2026-10-16
+}
+
+// downloadsLayout sorts received files into subdirectories of the downloads directory, following
+// a template such as "{peer}/{month}". The zero value keeps them flat.
+type downloadsLayout struct {
+	segments []string // Path segments of the template, tokens unexpanded
+}
+
+// fileOrigin is what a downloads layout's tokens are filled in from
+type fileOrigin struct {
+	Peer        string // Name to sort under; empty falls back to the fingerprint
+	Fingerprint string // Sender's key fingerprint; empty if not known
+	NodeID      string
+	Room        string // Room the file was sent to; empty if it was sent to us alone
+	Received    time.Time
+}
+
+// parseDownloadsLayout checks a downloads_layout template: relative, "/"-separated, with no
+// empty, "." or ".." segments, and only known tokens. An empty template is the flat layout.
+func parseDownloadsLayout(template string) (downloadsLayout, error) {
+	template = strings.Trim(strings.TrimSpace(template), "/")
+	if template == "" {
+		return downloadsLayout{}, nil
+	}
+	if filepath.IsAbs(template) || strings.Contains(template, `\`) {
+		return downloadsLayout{}, fmt.Errorf("downloads_layout %q must be a relative path with / between directories", template)
+	}
+
+	segments := strings.Split(template, "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return downloadsLayout{}, fmt.Errorf("downloads_layout %q: empty, . and .. directories aren't allowed", template)
+		}
+		for _, token := range layoutToken.FindAllString(segment, -1) {
+			if !layoutTokens[token] {
+				return downloadsLayout{}, fmt.Errorf("downloads_layout %q: unknown token %s (use {peer}, {fingerprint}, {room}, {year}, {month} or {date})", template, token)
+			}
+		}
+		if rest := layoutToken.ReplaceAllString(segment, ""); strings.ContainsAny(rest, "{}") {
+			return downloadsLayout{}, fmt.Errorf("downloads_layout %q: unmatched brace in %q", template, segment)
+		}
+	}
+	return downloadsLayout{segments: segments}, nil
+}
+
+// dir returns the subdirectory a file from origin goes in, relative to the downloads directory;
+// "" for the flat layout. What a peer chose, such as its nick, can't add or climb directories. A
+// directory that comes out empty, {room} for a file sent to us alone, is left out.
+func (l downloadsLayout) dir(origin fileOrigin) string {
+	if len(l.segments) == 0 {
+		return ""
+	}
+
+	fingerprint := "unknown"
+	if origin.Fingerprint != "" {
+		fingerprint = origin.Fingerprint[:min(16, len(origin.Fingerprint))]
+	}
+	peer := origin.Peer
+	if peer == "" {
+		peer = fingerprint
+		if origin.Fingerprint == "" {
+			peer = origin.NodeID
+		}
+	}
+	values := map[string]string{
+		"{peer}":        peer,
+		"{fingerprint}": fingerprint,
+		"{room}":        strings.TrimPrefix(origin.Room, "#"),
+		"{year}":        origin.Received.Format("2006"),
+		"{month}":       origin.Received.Format("2006-01"),
+		"{date}":        origin.Received.Format("2006-01-02"),
+	}
+
+	dirs := make([]string, len(l.segments))
+	for i, segment := range l.segments {
+		dirs[i] = layoutToken.ReplaceAllStringFunc(segment, func(token string) string {
+			if values[token] == "" {
+				return ""
+			}
+			// ":" in node IDs isn't allowed in Windows file names
+			return strings.ReplaceAll(sanitizeFileName(values[token]), ":", "_")
+		})
+	}
+	return filepath.Join(dirs...)
+}
+
+// createUnique creates a new file named name in dir. If the name is taken, "name (2).ext",
+// "name (3).ext" and so on are tried, so a received file never overwrites another.
+func createUnique(dir, name string) (*os.File, string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; i <= maxSameNameFiles; i++ {
+		candidate := name
+		if i > 1 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return file, path, err
+	}
+	return nil, "", fmt.Errorf("%d files named like %s already in %s", maxSameNameFiles, name, dir)
+}
+
+// saveReceivedFile writes a received file into the layout's subdirectory for its sender and the
+// room it was sent to, under a name no other file has, and returns where it went. If the
+// subdirectory can't be made, the file is saved in the downloads directory itself.
+func (ftm *FileTransferManager) saveReceivedFile(downloadDir string, layout downloadsLayout, peerID, room, fileName string, data []byte) (string, error) {
+	if err := os.MkdirAll(downloadDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create downloads directory: %w", err)
+	}
+
+	dir := downloadDir
+	if sub := layout.dir(ftm.fileOriginOf(peerID, room)); sub != "" {
+		dir = filepath.Join(downloadDir, sub)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("Warning: Failed to create %s, saving %s in %s: %v", dir, fileName, downloadDir, err)
+			ftm.node.notifyUI(Message{
+				SenderID:     "System",
+				Content:      []byte(fmt.Sprintf("⚠️ Couldn't create %s, so %s is saved in %s: %v", sub, fileName, downloadDir, err)),
+				Conversation: peerID,
+			})
+			dir = downloadDir
+		}
+	}
+
+	file, path, err := createUnique(dir, fileName)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// fileOriginOf says who a received file is from, and in which room, as of now
+func (ftm *FileTransferManager) fileOriginOf(peerID, room string) fileOrigin {
+	origin := fileOrigin{NodeID: peerID}
+	if ftm.origins != nil {
+		origin = ftm.origins.fileOrigin(peerID, room)
+	}
+	origin.Received = time.Now()
+	return origin
+}
+
+// fileOrigin names the peer at a node ID for sorting its files: the contact alias the user gave
+// its key, else the nick it announced, else nothing, leaving the layout to use the fingerprint.
+// The room a file was sent to is only taken from a member of a room we are in.
+func (en *EnhancedNode) fileOrigin(nodeID, room string) fileOrigin {
+	origin := fileOrigin{NodeID: nodeID, Fingerprint: en.peerFingerprint(nodeID)}
+	if en.rooms.IsMember(room, origin.Fingerprint) {
+		origin.Room = room
+	}
+	if contact, saved := en.contacts.ForKey(origin.Fingerprint); saved && origin.Fingerprint != "" {
+		origin.Peer = contact.Alias
+	} else {
+		origin.Peer = en.presence.Nick(nodeID)
+	}
+	return origin
+}
+
+// configureDownloads applies the downloads settings. A downloads_layout that doesn't parse leaves
+// received files flat in the downloads directory, with a warning, rather than refusing the config.
+func (en *EnhancedNode) configureDownloads(config *Config) {
+	downloadDir := filepath.Join(en.dataDir, downloadsDirName)
+	if config.DownloadsDir != "" {
+		downloadDir = expandHome(config.DownloadsDir)
+	}
+	layout, err := parseDownloadsLayout(config.DownloadsLayout)
+	if err != nil {
+		log.Printf("Warning: %v; saving received files flat in %s", err, downloadDir)
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("⚠️ %v; received files are saved flat in %s", err, downloadDir)),
+		})
+	}
+	en.fileManager.Configure(downloadDir, layout, en.flags.autoAccept || config.AutoAccept)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseDownloadsLayout accepts relative templates of known tokens and refuses the rest
+func TestParseDownloadsLayout(t *testing.T) {
+	tests := []struct {
+		template string
+		segments []string
+		err      string
+	}{
+		{"", nil, ""},
+		{"  / ", nil, ""},
+		{"{peer}/{month}", []string{"{peer}", "{month}"}, ""},
+		{"/{room}/{peer}/", []string{"{room}", "{peer}"}, ""},
+		{"by-date/{year}/{date}", []string{"by-date", "{year}", "{date}"}, ""},
+		{"{fingerprint}-files", []string{"{fingerprint}-files"}, ""},
+		{"{peer}//{month}", nil, "empty, . and .. directories"},
+		{"{peer}/../x", nil, "empty, . and .. directories"},
+		{"./{peer}", nil, "empty, . and .. directories"},
+		{`{peer}\{month}`, nil, "relative path"},
+		{"{nick}", nil, "unknown token {nick}"},
+		{"{peer", nil, "unmatched brace"},
+		{"peer}", nil, "unmatched brace"},
+	}
+	for _, test := range tests {
+		layout, err := parseDownloadsLayout(test.template)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: %v", test.template, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%q: error %v, want one about %q", test.template, err, test.err)
+		case strings.Join(layout.segments, "|") != strings.Join(test.segments, "|"):
+			t.Errorf("%q: segments %q, want %q", test.template, layout.segments, test.segments)
+		}
+	}
+}
+
+// TestDownloadsLayoutDir fills in the tokens, and keeps what peers chose from adding or climbing
+// directories
+func TestDownloadsLayoutDir(t *testing.T) {
+	received := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	fingerprint := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		template string
+		origin   fileOrigin
+		want     string
+	}{
+		{"", fileOrigin{Peer: "mum"}, ""},
+		{"{peer}/{month}", fileOrigin{Peer: "mum", Fingerprint: fingerprint}, filepath.Join("mum", "2026-10")},
+		{"{year}/{date}", fileOrigin{}, filepath.Join("2026", "2026-10-16")},
+		{"{peer}", fileOrigin{Fingerprint: fingerprint}, "0123456789abcdef"},
+		{"{fingerprint}", fileOrigin{Peer: "mum", Fingerprint: fingerprint}, "0123456789abcdef"},
+		{"{peer}/{fingerprint}", fileOrigin{NodeID: "10.0.0.1:9000"}, filepath.Join("10.0.0.1_9000", "unknown")},
+		{"{peer}", fileOrigin{Peer: "../x"}, "x"},
+		{"{peer}", fileOrigin{Peer: ".."}, "unnamed"},
+		{"{peer}", fileOrigin{Peer: `..\..\windows`}, "windows"},
+		{"{peer}/inbox", fileOrigin{Peer: "a/b"}, filepath.Join("b", "inbox")},
+		{"{room}/{peer}", fileOrigin{Peer: "mum", Room: "#family"}, filepath.Join("family", "mum")},
+		{"{room}/{peer}", fileOrigin{Peer: "mum"}, "mum"},
+		{"{room}", fileOrigin{Peer: "mum"}, ""},
+		{"from-{peer}{room}", fileOrigin{Peer: "mum"}, "from-mum"},
+	}
+	for _, test := range tests {
+		layout, err := parseDownloadsLayout(test.template)
+		if err != nil {
+			t.Fatalf("%q: %v", test.template, err)
+		}
+		test.origin.Received = received
+		if dir := layout.dir(test.origin); dir != test.want {
+			t.Errorf("%q with %+v: %q, want %q", test.template, test.origin, dir, test.want)
+		}
+	}
+}
+
+// TestCreateUnique numbers a received file's name rather than overwrite another
+func TestCreateUnique(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"report.pdf", "report (2).pdf"},
+		{"report.pdf", "report (3).pdf"},
+		{"notes", "notes"},
+		{"notes", "notes (2)"},
+		{"archive.tar.gz", "archive.tar.gz"},
+		{"archive.tar.gz", "archive.tar (2).gz"},
+	}
+	for _, test := range tests {
+		file, path, err := createUnique(dir, test.name)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		file.Close()
+		if path != filepath.Join(dir, test.want) {
+			t.Errorf("%s saved as %s, want %s", test.name, filepath.Base(path), test.want)
+		}
+	}
+
+	for i := 1; i <= maxSameNameFiles; i++ {
+		name := "full.txt"
+		if i > 1 {
+			name = "full (" + strconv.Itoa(i) + ").txt"
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := createUnique(dir, "full.txt"); err == nil {
+		t.Errorf("created a file once all %d names were taken", maxSameNameFiles)
+	}
+}
+
+// TestRoomFileLayout sorts a file sent to a room under the room, and one sent to the peer alone
+// without it
+func TestRoomFileLayout(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	tn.connect(a, b)
+	downloadDir := t.TempDir()
+	layout, err := parseDownloadsLayout("{room}/{fingerprint}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.fileManager.Configure(downloadDir, layout, true)
+
+	a.handleRoomCommand("create #family pass")
+	waitForNotice(t, a, "You started #family")
+	b.handleJoinCommand("#family pass")
+	waitFor(t, "a and b to admit each other", func() bool {
+		return roomMembers(a, "#family", b) && roomMembers(b, "#family", a)
+	})
+
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(path, []byte("a photo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a.handleEnhancedCLICommand("/sendfile #family "+path, a.ID)
+	waitForNotice(t, a, "Offered photo.jpg to #family")
+	a.handleEnhancedCLICommand("/sendfile "+b.ID+" "+path, a.ID)
+
+	fingerprint := a.cryptoManager.Fingerprint()[:16]
+	for _, dir := range []string{filepath.Join(downloadDir, "family", fingerprint), filepath.Join(downloadDir, fingerprint)} {
+		waitFor(t, "photo.jpg in "+dir, func() bool {
+			data, _ := os.ReadFile(filepath.Join(dir, "photo.jpg"))
+			return string(data) == "a photo"
+		})
+	}
+}
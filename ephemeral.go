@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ephemeralMaxTTL        = 24 * time.Hour // Longest lifetime /ephemeral accepts
+	ephemeralSweepInterval = time.Second    // How often expired messages are deleted from the log
+)
+
+// handleEphemeralCommand processes /ephemeral <seconds> <text>: a broadcast that every node
+// removes from its message log and TUI once the time is up
+func (en *EnhancedNode) handleEphemeralCommand(args string) {
+	secondsArg, text, _ := strings.Cut(strings.TrimSpace(args), " ")
+	text = strings.TrimSpace(text)
+
+	seconds, err := strconv.ParseUint(secondsArg, 10, 32)
+	if err != nil || seconds == 0 || time.Duration(seconds)*time.Second > ephemeralMaxTTL || text == "" {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("Usage: /ephemeral <seconds> <text> (1-%d seconds)", int(ephemeralMaxTTL.Seconds()))),
+		})
+		return
+	}
+	if err := checkTextSize(text); err != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Not sent: %v", err)),
+		})
+		return
+	}
+
+	envelope := en.newTextEnvelope(text, true)
+	envelope.TTL = uint32(seconds)
+	sent, err := en.broadcastEnvelope(envelope)
+	if !sentToAny(err) {
+		en.notifySendError("Message", err)
+		return
+	}
+	en.notifyUI(sent)
+	if err != nil {
+		en.notifySendError("Message", err)
+	}
+	if lacking := en.peersLacking(capabilityEphemeral, true); len(lacking) > 0 {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("⚠️ %s will keep this message: older versions ignore the expiry", strings.Join(lacking, ", "))),
+		})
+	}
+}
+
+// expireMessages deletes ephemeral messages from the message log when they expire
+func (en *EnhancedNode) expireMessages() {
+	defer en.wg.Done()
+
+	ticker := en.wallClock.NewTicker(ephemeralSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.Chan():
+			en.messageLog.Expire(now)
+		case <-en.Shutdown:
+			return
+		}
+	}
+}
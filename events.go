@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventReplayLimit  = 200              // Recent events kept for clients that ask for a replay
+	eventClientBuffer = 256              // Events held for each /events client; the oldest go when it falls behind
+	eventKeepalive    = 30 * time.Second // Idle time before /events sends a comment so proxies keep the stream open
+)
+
+// Event types on the /events feed
+const (
+	eventMessage          = "message"           // A message was logged, as GET /messages returns it
+	eventPeerConnected    = "peer_connected"    // A connection was registered
+	eventPeerDisconnected = "peer_disconnected" // A connection was forgotten
+	eventTransfer         = "transfer"          // A file transfer moved on a percent or changed status
+)
+
+// eventTypes are the types a client may ask /events for
+var eventTypes = map[string]bool{
+	eventMessage:          true,
+	eventPeerConnected:    true,
+	eventPeerDisconnected: true,
+	eventTransfer:         true,
+}
+
+// Event is one entry of the node's activity feed
+type Event struct {
+	ID   int64       `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// peerEvent is the data of peer_connected and peer_disconnected
+type peerEvent struct {
+	Peer string `json:"peer"`
+}
+
+// EventFeed hands node activity to /events clients as it happens. Publishing never blocks: each
+// client has its own buffer, and a client that falls behind loses its oldest events, not the node
+// its pace. The last eventReplayLimit events are kept for clients that want to catch up.
+type EventFeed struct {
+	mutex   sync.Mutex
+	clock   Clock // Where events get their time
+	nextID  int64
+	recent  []Event
+	clients map[*eventClient]bool
+}
+
+// eventClient is the buffer of one /events client
+type eventClient struct {
+	types   map[string]bool // The types it wants; nil for all
+	mutex   sync.Mutex
+	pending []Event
+	dropped int           // Events dropped since it last took some
+	ready   chan struct{} // Signalled when pending goes from empty to non-empty
+}
+
+// NewEventFeed creates a feed with no clients, stamping events with the time on clock
+func NewEventFeed(clock Clock) *EventFeed {
+	return &EventFeed{
+		clock:   clock,
+		nextID:  1,
+		clients: make(map[*eventClient]bool),
+	}
+}
+
+// Publish adds an event to the feed without blocking
+func (ef *EventFeed) Publish(eventType string, data interface{}) {
+	ef.mutex.Lock()
+	defer ef.mutex.Unlock()
+
+	event := Event{ID: ef.nextID, Type: eventType, Time: ef.clock.Now(), Data: data}
+	ef.nextID++
+
+	if len(ef.recent) >= eventReplayLimit {
+		ef.recent[0] = Event{} // Don't keep the data alive in the backing array
+		ef.recent = ef.recent[1:]
+	}
+	ef.recent = append(ef.recent, event)
+
+	for client := range ef.clients {
+		client.push(event)
+	}
+}
+
+// Subscribe registers a client for the given types (nil for all), starting it with up to replay
+// of the most recent events of those types
+func (ef *EventFeed) Subscribe(types map[string]bool, replay int) *eventClient {
+	client := &eventClient{types: types, ready: make(chan struct{}, 1)}
+
+	ef.mutex.Lock()
+	defer ef.mutex.Unlock()
+
+	var missed []Event
+	for i := len(ef.recent) - 1; i >= 0 && len(missed) < replay; i-- {
+		if client.wants(ef.recent[i].Type) {
+			missed = append(missed, ef.recent[i])
+		}
+	}
+	for i := len(missed) - 1; i >= 0; i-- {
+		client.push(missed[i])
+	}
+	ef.clients[client] = true
+	return client
+}
+
+// Unsubscribe stops delivering events to a client
+func (ef *EventFeed) Unsubscribe(client *eventClient) {
+	ef.mutex.Lock()
+	delete(ef.clients, client)
+	ef.mutex.Unlock()
+}
+
+// wants reports whether the client asked for events of this type
+func (ec *eventClient) wants(eventType string) bool {
+	return ec.types == nil || ec.types[eventType]
+}
+
+// push buffers an event the client wants, dropping its oldest one if the buffer is full
+func (ec *eventClient) push(event Event) {
+	if !ec.wants(event.Type) {
+		return
+	}
+
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	if len(ec.pending) >= eventClientBuffer {
+		ec.pending[0] = Event{}
+		ec.pending = ec.pending[1:]
+		ec.dropped++
+	}
+	ec.pending = append(ec.pending, event)
+
+	select {
+	case ec.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and clears the buffered events, with how many were dropped before them
+func (ec *eventClient) take() ([]Event, int) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	events, dropped := ec.pending, ec.dropped
+	ec.pending, ec.dropped = nil, 0
+	return events, dropped
+}
+
+// parseEventTypes reads the types parameter of /events: a comma-separated list, or empty for all
+func parseEventTypes(value string) (map[string]bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	types := make(map[string]bool)
+	for _, eventType := range strings.Split(value, ",") {
+		eventType = strings.TrimSpace(eventType)
+		if !eventTypes[eventType] {
+			return nil, fmt.Errorf("unknown event type %q (use %s, %s, %s or %s)", eventType,
+				eventMessage, eventPeerConnected, eventPeerDisconnected, eventTransfer)
+		}
+		types[eventType] = true
+	}
+	return types, nil
+}
+
+// handleEvents serves GET /events?types=<type,...>&replay=<n> as a server-sent event stream. Each
+// event is sent with its type as the SSE event name and its JSON as the data; a "dropped" event
+// says how many were lost when the client fell behind. For example:
+//
+//	curl -N -H "Authorization: Bearer $(cat api.token)" 'http://127.0.0.1:7777/events?types=message,transfer&replay=20'
+func (api *APIServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	types, err := parseEventTypes(r.URL.Query().Get("types"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var replay int
+	if value := r.URL.Query().Get("replay"); value != "" {
+		replay, err = strconv.Atoi(value)
+		if err != nil || replay < 0 {
+			writeAPIError(w, http.StatusBadRequest, "replay must be a non-negative number of events")
+			return
+		}
+		replay = min(replay, eventReplayLimit)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	client := api.node.events.Subscribe(types, replay)
+	defer api.node.events.Unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-client.ready:
+			events, dropped := client.take()
+			if dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			for _, event := range events {
+				if err := writeSSEEvent(w, event); err != nil {
+					return
+				}
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-api.node.Shutdown:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeSSEEvent writes one event in the server-sent event format
+func writeSSEEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
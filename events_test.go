@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEventFeed replays recent events of the types a client wants and drops a slow client's
+// oldest events rather than holding up the publisher. Events take their time from the clock.
+func TestEventFeed(t *testing.T) {
+	clock := newFakeClock()
+	ef := NewEventFeed(clock)
+	for i := range eventReplayLimit + 10 {
+		eventType := eventMessage
+		if i%2 == 1 {
+			eventType = eventTransfer
+		}
+		ef.Publish(eventType, i)
+	}
+
+	client := ef.Subscribe(map[string]bool{eventMessage: true}, 3)
+	all := ef.Subscribe(nil, eventReplayLimit*2)
+	events, dropped := client.take()
+	if dropped != 0 || len(events) != 3 {
+		t.Fatalf("replayed %d events, %d dropped", len(events), dropped)
+	}
+	for i, event := range events {
+		if want := eventReplayLimit + 4 + 2*i; event.Type != eventMessage || event.Data != want || event.ID != int64(want+1) {
+			t.Errorf("replayed %+v, want message %d", event, want)
+		}
+	}
+	if events, _ := all.take(); len(events) != eventReplayLimit || events[0].Data != 10 {
+		t.Errorf("replayed %d events from %v, want the last %d", len(events), events[0].Data, eventReplayLimit)
+	}
+
+	// Nothing reads the client while more than its buffer is published
+	for i := range eventClientBuffer + 5 {
+		ef.Publish(eventMessage, fmt.Sprint("live ", i))
+	}
+	ef.Publish(eventTransfer, "not wanted")
+	select {
+	case <-client.ready:
+	default:
+		t.Error("the client wasn't told events were waiting")
+	}
+	events, dropped = client.take()
+	if dropped != 5 || len(events) != eventClientBuffer || events[0].Data != "live 5" {
+		t.Errorf("took %d events from %v with %d dropped", len(events), events[0].Data, dropped)
+	}
+
+	ef.Unsubscribe(client)
+	ef.Publish(eventMessage, "after")
+	if events, _ := client.take(); len(events) != 0 {
+		t.Errorf("an unsubscribed client got %v", events)
+	}
+
+	clock.Advance(time.Hour)
+	ef.Publish(eventMessage, "an hour on")
+	if events, _ := all.take(); len(events) == 0 || !events[len(events)-1].Time.Equal(clock.Now()) {
+		t.Errorf("published at %v, want the clock's %v", events, clock.Now())
+	}
+}
+
+func TestParseEventTypes(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  []string // nil for every type
+		err   bool
+	}{
+		{"", nil, false},
+		{"message", []string{eventMessage}, false},
+		{"message, transfer", []string{eventMessage, eventTransfer}, false},
+		{"peer_connected,peer_disconnected", []string{eventPeerConnected, eventPeerDisconnected}, false},
+		{"message,nonsense", nil, true},
+		{"message,", nil, true},
+	} {
+		types, err := parseEventTypes(tc.value)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: error %v", tc.value, err)
+			continue
+		}
+		if len(types) != len(tc.want) || (tc.want == nil) != (types == nil) {
+			t.Errorf("%q: %v, want %v", tc.value, types, tc.want)
+		}
+		for _, eventType := range tc.want {
+			if !types[eventType] {
+				t.Errorf("%q: %v, want %v", tc.value, types, tc.want)
+			}
+		}
+	}
+}
+
+// sseStream reads server-sent events from a response body
+type sseStream struct {
+	t       *testing.T
+	scanner *bufio.Scanner
+}
+
+// sseEvent is one event as read off the wire
+type sseEvent struct {
+	name string
+	data string
+}
+
+// openEvents starts a GET /events stream on server with the given query
+func openEvents(t *testing.T, server *httptest.Server, token, query string) *sseStream {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/events"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	return &sseStream{t: t, scanner: bufio.NewScanner(response.Body)}
+}
+
+// next returns the next event, skipping comments. Each read gives up after testWait.
+func (s *sseStream) next() sseEvent {
+	s.t.Helper()
+	read := make(chan sseEvent, 1)
+	go func() {
+		var event sseEvent
+		for s.scanner.Scan() {
+			line := s.scanner.Text()
+			switch {
+			case line == "" && event.name != "":
+				read <- event
+				return
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		close(read)
+	}()
+	select {
+	case event, ok := <-read:
+		if !ok {
+			s.t.Fatal("the event stream ended")
+		}
+		return event
+	case <-time.After(testWait):
+		s.t.Fatal("timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+// nextOf returns the next event of the given name with its data decoded into data, failing on
+// any other event
+func (s *sseStream) nextOf(name string, data interface{}) {
+	s.t.Helper()
+	event := s.next()
+	if event.name != name {
+		s.t.Fatalf("got a %s event %s, want %s", event.name, event.data, name)
+	}
+	wrapper := Event{Data: data}
+	if err := json.Unmarshal([]byte(event.data), &wrapper); err != nil || wrapper.Type != name {
+		s.t.Fatalf("%s event %s: %v", name, event.data, err)
+	}
+}
+
+// TestEventStream watches a node over /events: a replay of what happened before, then messages,
+// peers and transfer progress as they happen, filtered to the types asked for
+func TestEventStream(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	a := tn.newNode()
+	api := startTestAPI(t, a)
+	server := httptest.NewServer(api.server.Handler)
+	t.Cleanup(server.Close)
+	tn.start(a)
+	b := tn.addNode()
+	tn.connect(b, a)
+	if err := b.SendTextAndConfirm(a.ID, "before", testWait); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, a, b.ID, "before")
+
+	chat := openEvents(t, server, api.token, "?types=message,peer_disconnected&replay=1")
+	transfers := openEvents(t, server, api.token, "?types=transfer")
+	var message LoggedMessage
+	chat.nextOf(eventMessage, &message)
+	if message.Content != "before" || message.SenderID != b.ID {
+		t.Errorf("replayed %+v", message)
+	}
+
+	if _, err := b.SendEncryptedText("live"); err != nil {
+		t.Fatal(err)
+	}
+	chat.nextOf(eventMessage, &message)
+	if message.Content != "live" {
+		t.Errorf("streamed %+v", message)
+	}
+
+	path := filepath.Join(t.TempDir(), "report.bin")
+	if err := os.WriteFile(path, make([]byte, 20*chunkSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SendFileAndConfirm(a.ID, path, testWait); err != nil {
+		t.Fatal(err)
+	}
+	var transfer TransferInfo
+	for progress := -1; transfer.Status != "complete"; progress = transfer.Progress {
+		transfers.nextOf(eventTransfer, &transfer)
+		if transfer.FileName != "report.bin" || transfer.IsOutgoing || transfer.Progress < progress {
+			t.Fatalf("transfer event %+v after %d%%", transfer, progress)
+		}
+	}
+	if transfer.Progress != 100 {
+		t.Errorf("completed at %d%%", transfer.Progress)
+	}
+
+	// The chat stream had the transfer's notices, and nothing but messages, until b left
+	if !b.shutdownWithin(testWait) {
+		t.Fatal("b didn't shut down")
+	}
+	for event := chat.next(); event.name != eventPeerDisconnected; event = chat.next() {
+		if event.name != eventMessage {
+			t.Fatalf("got a %s event on the chat stream", event.name)
+		}
+	}
+
+	for _, query := range []string{"?replay=-1", "?replay=lots", "?types=message,nonsense"} {
+		if status, body := apiCall(t, api, http.MethodGet, "/events"+query, "Bearer "+api.token, ""); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, %s", query, status, body)
+		}
+	}
+	if status, _ := apiCall(t, api, http.MethodGet, "/events", "", ""); status != http.StatusUnauthorized {
+		t.Errorf("without the token: status %d", status)
+	}
+}
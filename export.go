@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const exportTimeFormat = "20060102-150405" // Timestamp in default export file names
+
+// exportedMessage is one line of a JSONL conversation export
+type exportedMessage struct {
+	Sender    string    `json:"sender"`
+	SenderKey string    `json:"sender_key,omitempty"` // Fingerprint of the sender's key, if it was known
+	Timestamp time.Time `json:"timestamp"`
+	Content   string    `json:"content"`
+
+	Conversation string `json:"conversation,omitempty"` // Peer node ID or "broadcast", as in GET /messages
+}
+
+// exportPaths returns the plain text and JSONL files a /save writes. With no path, or a path that
+// is a directory, they get a timestamped name in that directory (dir for no path); otherwise the
+// path's extension is replaced with .txt and .jsonl.
+func exportPaths(path, dir string, now time.Time) (string, string) {
+	if path != "" {
+		info, err := os.Stat(path)
+		if (err == nil && info.IsDir()) || strings.HasSuffix(path, string(filepath.Separator)) {
+			dir, path = path, ""
+		}
+	}
+	if path == "" {
+		path = filepath.Join(dir, "conversation-"+now.Format(exportTimeFormat))
+	}
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	return base + ".txt", base + ".jsonl"
+}
+
+// writeExport saves messages as plain text and as JSONL. Neither file may exist already; nothing
+// is overwritten.
+func writeExport(path, dir string, messages []exportedMessage) (string, string, error) {
+	textPath, jsonlPath := exportPaths(path, dir, time.Now())
+	for _, p := range []string{textPath, jsonlPath} {
+		if _, err := os.Stat(p); err == nil {
+			return "", "", fmt.Errorf("%s already exists; choose another path", p)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(textPath), 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create export directory: %w", err)
+	}
+
+	var text, jsonl strings.Builder
+	for _, msg := range messages {
+		// Lines after the first are indented so each message still starts a line of its own
+		content := strings.ReplaceAll(msg.Content, "\n", "\n    ")
+		fmt.Fprintf(&text, "%s [%s] %s\n", msg.Timestamp.Format("2006-01-02 15:04:05"), msg.Sender, content)
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to serialize message: %w", err)
+		}
+		jsonl.Write(data)
+		jsonl.WriteByte('\n')
+	}
+
+	if err := createNew(textPath, text.String()); err != nil {
+		return "", "", err
+	}
+	if err := createNew(jsonlPath, jsonl.String()); err != nil {
+		os.Remove(textPath)
+		return "", "", err
+	}
+	return textPath, jsonlPath, nil
+}
+
+// createNew writes a file that must not exist yet, so one created since it was checked for is
+// left alone
+func createNew(path, content string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists; choose another path", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save conversation: %w", err)
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to save conversation: %w", err)
+	}
+	return file.Close()
+}
+
+// exportResult is the system message reporting how a /save went
+func exportResult(count int, textPath, jsonlPath string, err error) string {
+	if err != nil {
+		return fmt.Sprintf("❌ %v", err)
+	}
+	return fmt.Sprintf("💾 Saved %d messages to %s and %s", count, textPath, jsonlPath)
+}
+
+// saveConversation handles /save in the TUI, exporting the conversation being shown. Ephemeral
+// messages are left out, since the files outlive them.
+func (ui *UI) saveConversation(path string) {
+	conversation := broadcastConversation
+	if peer := ui.conversations[ui.active].peer; peer != "" {
+		conversation = peer
+	}
+	messages := make([]exportedMessage, 0, len(ui.messages))
+	for _, msg := range ui.messages {
+		if !msg.ExpiresAt.IsZero() {
+			continue
+		}
+		messages = append(messages, exportedMessage{Sender: msg.Sender, SenderKey: msg.SenderKey, Timestamp: msg.Timestamp, Content: msg.Content, Conversation: conversation})
+	}
+	textPath, jsonlPath, err := writeExport(path, ui.exportDir, messages)
+	ui.notice(exportResult(len(messages), textPath, jsonlPath, err))
+}
+
+// handleSaveCommand handles /save outside the TUI, exporting the messages in the message log
+// except ephemeral ones
+func (en *EnhancedNode) handleSaveCommand(path string) {
+	entries := en.messageLog.Since(0)
+	messages := make([]exportedMessage, 0, len(entries))
+	for _, entry := range entries {
+		if len(entry.Read) > 0 || entry.ExpiresAt != nil {
+			continue // Read receipts aren't messages, and ephemeral ones mustn't outlive their expiry
+		}
+		messages = append(messages, exportedMessage{Sender: entry.SenderID, SenderKey: entry.SenderKey, Timestamp: entry.Timestamp, Content: entry.Content, Conversation: entry.Conversation})
+	}
+	textPath, jsonlPath, err := writeExport(path, en.dataDir, messages)
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(exportResult(len(messages), textPath, jsonlPath, err)),
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSaveSkipsEphemeral has /save in the TUI and outside it write normal messages but not
+// ephemeral ones that haven't expired yet, which must not outlive their expiry on disk
+func TestSaveSkipsEphemeral(t *testing.T) {
+	const peer = "127.0.0.1:2"
+	expiresAt := time.Now().Add(time.Hour)
+	kept := Message{SenderID: peer, Content: []byte("kept for the record")}
+	ephemeral := Message{SenderID: peer, Content: []byte("door code is 4512"), ExpiresAt: expiresAt}
+
+	// readExport returns both files written for path, failing unless they hold the kept message
+	readExport := func(t *testing.T, path string) string {
+		t.Helper()
+		var both string
+		for _, ext := range []string{".txt", ".jsonl"} {
+			data, err := os.ReadFile(strings.TrimSuffix(path, filepath.Ext(path)) + ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), "kept for the record") {
+				t.Errorf("%s export is missing the normal message:\n%s", ext, data)
+			}
+			both += string(data)
+		}
+		return both
+	}
+
+	t.Run("tui", func(t *testing.T) {
+		ui, _ := newTestUI(t, 80, 20)
+		receive(ui, kept)
+		receive(ui, ephemeral)
+		path := filepath.Join(t.TempDir(), "tab.txt")
+		ui.saveConversation(path)
+		if saved := readExport(t, path); strings.Contains(saved, "4512") {
+			t.Errorf("ephemeral message saved:\n%s", saved)
+		}
+	})
+
+	t.Run("log", func(t *testing.T) {
+		tn := newTestNetwork(t, 1)
+		node := tn.nodes[0]
+		node.notifyUI(kept)
+		node.notifyUI(ephemeral)
+		path := filepath.Join(t.TempDir(), "log.txt")
+		node.handleSaveCommand(path)
+		if saved := readExport(t, path); strings.Contains(saved, "4512") {
+			t.Errorf("ephemeral message saved:\n%s", saved)
+		}
+	})
+}
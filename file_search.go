@@ -0,0 +1,575 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	searchTimeout        = 3 * time.Second // How long a /search waits for peers to answer
+	searchMaxResults     = 50              // Matches a peer sends for one query, and keeps from each peer
+	searchMaxTermBytes   = 100             // Longest search term
+	searchMaxNameBytes   = 512             // Longest shared path sent in a result
+	searchMaxScanned     = 50000           // Files and directories looked at for one query
+	searchAnswerInterval = time.Second     // Queries from a peer closer together than this are ignored
+	searchGetExpiry      = 2 * time.Minute // How long an offer answering a /get is accepted without asking
+	searchMaxHashBytes   = 64 << 20        // Larger matches only carry a hash once one was worked out for another reason
+)
+
+// fileSearchMessage is the plaintext of an encrypted "search" message. Being encrypted, it is
+// signed by its sender like every message, so a query is only answered for a key we hold.
+type fileSearchMessage struct {
+	Type    string            `json:"type"`              // "query", "results", "get", "unavailable", "have-file", "has-file" or "range"
+	ID      string            `json:"id"`                // The query, /get or multi-source download this belongs to
+	Term    string            `json:"term,omitempty"`    // Query: what file names must contain
+	Matches []sharedFileMatch `json:"matches,omitempty"` // Results: files whose names match
+	More    bool              `json:"more,omitempty"`    // Results: matches past searchMaxResults were left out
+	Name    string            `json:"name,omitempty"`    // Get and unavailable: the match asked for
+	Hash    string            `json:"sha256,omitempty"`  // Have-file, has-file and range: the file's SHA-256, hex
+	Size    int64             `json:"size,omitempty"`    // Have-file, has-file and range: the file's size
+	First   int               `json:"first,omitempty"`   // Range: the first chunk to send
+	Count   int               `json:"count,omitempty"`   // Range: how many chunks to send
+}
+
+// sharedFileMatch is a shared file that matched a query
+type sharedFileMatch struct {
+	Name string `json:"name"` // Shared directory's name, then the path inside it, "/"-separated
+	Size int64  `json:"size"`
+	Hash string `json:"sha256,omitempty"` // SHA-256, hex, if the peer had it to hand; /get downloads from every peer with the same
+
+	path string // Where the file is, on the answering side
+}
+
+// sharedDir is a directory peers may search and download from
+type sharedDir struct {
+	Name string // What peers see: the directory's base name, numbered if two are the same
+	Path string
+}
+
+// searchResult is a match from one peer, numbered for /get
+type searchResult struct {
+	NodeID string
+	Match  sharedFileMatch
+}
+
+// searchQuery is a /search waiting for peers to answer
+type searchQuery struct {
+	ID      string
+	Term    string
+	asked   map[string]bool // Node IDs queried, and whether they have answered
+	results []searchResult
+	more    []string // Peers that had more matches than they sent
+	timer   Timer
+}
+
+// requestedFile is a file asked for with /get, whose offer is accepted without asking
+type requestedFile struct {
+	NodeID  string
+	Name    string
+	Expires time.Time
+}
+
+// FileSearch answers peers' searches of our shared directories, and keeps track of ours
+type FileSearch struct {
+	mutex     sync.Mutex
+	shares    []sharedDir
+	answer    bool
+	lastQuery map[string]time.Time     // Node ID -> when we last answered it
+	lastHave  map[string]time.Time     // Node ID -> when we last looked up a have-file for it
+	lookups   int                      // Have-file lookups under way
+	pending   *searchQuery             // Our search waiting for answers; a new one replaces it
+	results   []searchResult           // Matches from our last search, for /get
+	requested map[string]requestedFile // /get ID -> file asked for
+	hashes    map[string]fileHash      // Path -> SHA-256 of a shared file, while its size and mtime last
+	byHash    map[string]string        // SHA-256 -> path of a shared file with it
+	serving   map[string]int           // Node ID -> ranges being sent to it
+}
+
+// NewFileSearch creates a file search with nothing shared
+func NewFileSearch() *FileSearch {
+	return &FileSearch{
+		lastQuery: make(map[string]time.Time),
+		lastHave:  make(map[string]time.Time),
+		requested: make(map[string]requestedFile),
+		hashes:    make(map[string]fileHash),
+		byHash:    make(map[string]string),
+		serving:   make(map[string]int),
+	}
+}
+
+// Configure sets the directories peers may search and download from, and whether their searches
+// are answered
+func (fsr *FileSearch) Configure(dirs []string, answer bool) {
+	var shares []sharedDir
+	names := make(map[string]int)
+	for _, dir := range dirs {
+		path, err := filepath.Abs(expandHome(dir))
+		if err != nil {
+			log.Printf("Warning: Not sharing %s: %v", dir, err)
+			continue
+		}
+		name := sanitizeFileName(filepath.Base(path))
+		if names[name]++; names[name] > 1 {
+			name = fmt.Sprintf("%s (%d)", name, names[name])
+		}
+		shares = append(shares, sharedDir{Name: name, Path: path})
+	}
+
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	fsr.shares = shares
+	fsr.answer = answer
+}
+
+// sharing returns the shared directories, or nothing if searches aren't answered
+func (fsr *FileSearch) sharing() []sharedDir {
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	if !fsr.answer {
+		return nil
+	}
+	return fsr.shares
+}
+
+// allowQuery reports whether a peer's query is answered: not more than one per
+// searchAnswerInterval
+func (fsr *FileSearch) allowQuery(nodeID string, now time.Time) bool {
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	return allowEvery(fsr.lastQuery, nodeID, now, searchAnswerInterval)
+}
+
+// allowEvery reports whether a peer last let through longer than interval ago may be again, and
+// notes it if so. Peers not heard from for interval are forgotten.
+func allowEvery(last map[string]time.Time, nodeID string, now time.Time, interval time.Duration) bool {
+	if at, exists := last[nodeID]; exists && now.Sub(at) < interval {
+		return false
+	}
+	for peer, at := range last {
+		if now.Sub(at) >= interval {
+			delete(last, peer)
+		}
+	}
+	last[nodeID] = now
+	return true
+}
+
+// findShared lists the files in the shared directories whose names contain term, ignoring case.
+// Hidden files and directories and symlinks are skipped, and the walk stops at searchMaxResults
+// matches or searchMaxScanned entries; more reports whether it stopped early.
+func findShared(shares []sharedDir, term string) (matches []sharedFileMatch, more bool) {
+	term = strings.ToLower(term)
+	scanned := 0
+	for _, share := range shares {
+		err := filepath.WalkDir(share.Path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // Unreadable entries are left out
+			}
+			if scanned++; scanned > searchMaxScanned || len(matches) > searchMaxResults {
+				more = true
+				return fs.SkipAll
+			}
+			if path != share.Path && strings.HasPrefix(entry.Name(), ".") {
+				if entry.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() || !strings.Contains(strings.ToLower(entry.Name()), term) {
+				return nil
+			}
+			relative, err := filepath.Rel(share.Path, path)
+			if err != nil {
+				return nil
+			}
+			name := share.Name + "/" + filepath.ToSlash(relative)
+			info, err := entry.Info()
+			if err != nil || len(name) > searchMaxNameBytes {
+				return nil
+			}
+			matches = append(matches, sharedFileMatch{Name: name, Size: info.Size(), path: path})
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to search shared directory %s: %v", share.Path, err)
+		}
+		if more {
+			break
+		}
+	}
+	if len(matches) > searchMaxResults {
+		matches, more = matches[:searchMaxResults], true
+	}
+	return matches, more
+}
+
+// resolveShared finds the file a peer asked for by a match's name. It must be a regular file
+// inside a shared directory once symlinks are resolved, so a name can't reach anything else.
+func resolveShared(shares []sharedDir, name string) (string, error) {
+	shareName, relative, found := strings.Cut(name, "/")
+	if !found || !filepath.IsLocal(filepath.FromSlash(relative)) {
+		return "", fmt.Errorf("not a shared file: %q", name)
+	}
+	// Hidden files are never found by a search, so they can't be asked for either
+	for _, segment := range strings.Split(relative, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", fmt.Errorf("not a shared file: %q", name)
+		}
+	}
+	for _, share := range shares {
+		if share.Name != shareName {
+			continue
+		}
+		root, err := filepath.EvalSymlinks(share.Path)
+		if err != nil {
+			return "", err
+		}
+		path, err := filepath.EvalSymlinks(filepath.Join(share.Path, filepath.FromSlash(relative)))
+		if err != nil {
+			return "", err
+		}
+		if inside, err := filepath.Rel(root, path); err != nil || !filepath.IsLocal(inside) {
+			return "", fmt.Errorf("not a shared file: %q", name)
+		}
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			return "", fmt.Errorf("not a shared file: %q", name)
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("no shared directory %q", shareName)
+}
+
+// handleSearchCommand processes /search <term>: it queries every connected peer that answers
+// searches and lists what they have once all have answered, or after searchTimeout
+func (en *EnhancedNode) handleSearchCommand(args string) {
+	term := strings.TrimSpace(args)
+	if term == "" || len(term) > searchMaxTermBytes {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("Usage: /search <term> (up to %d bytes), then /get <n> to download a result", searchMaxTermBytes)),
+		})
+		return
+	}
+
+	query := &searchQuery{ID: newMessageID(), Term: term, asked: make(map[string]bool)}
+	data, err := json.Marshal(fileSearchMessage{Type: "query", ID: query.ID, Term: term})
+	if err != nil {
+		log.Printf("Failed to serialize search: %v", err)
+		return
+	}
+	for _, peerID := range en.PeerIDs() {
+		_, nodeID, err := en.resolvePeer(peerID)
+		if err != nil {
+			continue
+		}
+		if capabilities, announced := en.peerCapabilities(peerID); announced && capabilities.Has(capabilitySearch) {
+			query.asked[nodeID] = false
+		}
+	}
+	if len(query.asked) == 0 {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("❌ No connected peer answers file searches"),
+		})
+		return
+	}
+
+	// Pending before the queries go out, so no answer arrives ahead of it
+	en.search.mutex.Lock()
+	if previous := en.search.pending; previous != nil {
+		previous.timer.Stop()
+	}
+	en.search.pending = query
+	query.timer = en.wallClock.AfterFunc(searchTimeout, func() { en.finishSearch(query) })
+	en.search.mutex.Unlock()
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("🔎 Searching %d peer(s) for %q...", len(query.asked), term)),
+	})
+	for nodeID := range query.asked {
+		if err := en.sendEncryptedTo(nodeID, data, "search"); err != nil {
+			log.Printf("Failed to send search to %s: %v", nodeID, err)
+		}
+	}
+}
+
+// handleFileSearch handles a "search" message from a peer
+func (en *EnhancedNode) handleFileSearch(senderID string, fromPeerKey bool, plaintext []byte) {
+	var msg fileSearchMessage
+	if err := json.Unmarshal(plaintext, &msg); err != nil {
+		log.Printf("Invalid search message from %s: %v", senderID, err)
+		return
+	}
+
+	switch msg.Type {
+	case "query":
+		en.answerSearch(senderID, fromPeerKey, msg)
+	case "results":
+		en.searchResults(senderID, msg)
+	case "get":
+		en.sendSharedFile(senderID, fromPeerKey, msg)
+	case "have-file":
+		en.answerHaveFile(senderID, fromPeerKey, msg)
+	case "has-file":
+		if fromPeerKey {
+			en.fileManager.addRangeSource(msg.ID, senderID, msg.Hash, msg.Size)
+		}
+	case "range":
+		en.serveRange(senderID, fromPeerKey, msg)
+	case "unavailable":
+		if file, asked := en.search.takeRequested(msg.ID, senderID, en.wallClock.Now()); asked {
+			en.notifyUI(Message{
+				SenderID:     "System",
+				Content:      []byte(fmt.Sprintf("❌ %s no longer shares %s", senderID, file.Name)),
+				Conversation: senderID,
+			})
+		}
+	default:
+		log.Printf("Unknown search message type from %s: %s", senderID, msg.Type)
+	}
+}
+
+// answerSearch sends a peer the shared files matching its query. Only peers whose key we hold
+// are answered, at most once per searchAnswerInterval; the directories are searched off the
+// event loop.
+func (en *EnhancedNode) answerSearch(senderID string, fromPeerKey bool, query fileSearchMessage) {
+	shares := en.search.sharing()
+	if len(shares) == 0 || !fromPeerKey || query.Term == "" || len(query.Term) > searchMaxTermBytes {
+		return
+	}
+	if !en.search.allowQuery(senderID, en.wallClock.Now()) {
+		log.Printf("Ignored search from %s: too soon after its last one", senderID)
+		return
+	}
+
+	en.wg.Add(1)
+	go func() {
+		defer en.wg.Done()
+		matches, more := findShared(shares, query.Term)
+		for i, match := range matches {
+			matches[i].Hash = en.search.quickHash(match.path, match.Size)
+		}
+		log.Printf("Search from %s for %q: %d match(es)", senderID, query.Term, len(matches))
+		data, err := json.Marshal(fileSearchMessage{Type: "results", ID: query.ID, Matches: matches, More: more})
+		if err != nil {
+			log.Printf("Failed to serialize search results: %v", err)
+			return
+		}
+		if err := en.sendEncryptedTo(senderID, data, "search"); err != nil {
+			log.Printf("Failed to send search results to %s: %v", senderID, err)
+		}
+	}()
+}
+
+// searchResults adds a peer's answer to our pending search, keeping no more than
+// searchMaxResults of its matches
+func (en *EnhancedNode) searchResults(senderID string, msg fileSearchMessage) {
+	en.search.mutex.Lock()
+	query := en.search.pending
+	if query == nil || query.ID != msg.ID {
+		en.search.mutex.Unlock()
+		log.Printf("Search results from %s for a search that is over", senderID)
+		return
+	}
+	if answered, asked := query.asked[senderID]; !asked || answered {
+		en.search.mutex.Unlock()
+		return
+	}
+	query.asked[senderID] = true
+
+	if len(msg.Matches) > searchMaxResults {
+		msg.Matches, msg.More = msg.Matches[:searchMaxResults], true
+	}
+	for _, match := range msg.Matches {
+		if match.Name == "" || len(match.Name) > searchMaxNameBytes || match.Size < 0 {
+			continue
+		}
+		match.Name = sanitizeLine(match.Name)
+		if !validFileHash(match.Hash) {
+			match.Hash = ""
+		}
+		query.results = append(query.results, searchResult{NodeID: senderID, Match: match})
+	}
+	if msg.More {
+		query.more = append(query.more, en.searchPeerName(senderID))
+	}
+
+	done := true
+	for _, answered := range query.asked {
+		done = done && answered
+	}
+	en.search.mutex.Unlock()
+
+	if done {
+		en.finishSearch(query)
+	}
+}
+
+// finishSearch lists a search's results, numbered for /get, once every peer has answered or the
+// time is up. Later answers are ignored.
+func (en *EnhancedNode) finishSearch(query *searchQuery) {
+	en.search.mutex.Lock()
+	if en.search.pending != query {
+		en.search.mutex.Unlock()
+		return
+	}
+	en.search.pending = nil
+	query.timer.Stop()
+	sort.SliceStable(query.results, func(i, j int) bool {
+		return query.results[i].Match.Name < query.results[j].Match.Name
+	})
+	en.search.results = query.results
+	var silent []string
+	for nodeID, answered := range query.asked {
+		if !answered {
+			silent = append(silent, nodeID)
+		}
+	}
+	en.search.mutex.Unlock()
+
+	var content strings.Builder
+	answered := len(query.asked) - len(silent)
+	if len(query.results) == 0 {
+		content.WriteString(fmt.Sprintf("🔎 No shared files match %q (%d of %d peer(s) answered)", query.Term, answered, len(query.asked)))
+	} else {
+		content.WriteString(fmt.Sprintf("🔎 %d shared file(s) match %q (%d of %d peer(s) answered); /get <n> to download:",
+			len(query.results), query.Term, answered, len(query.asked)))
+		for i, result := range query.results {
+			content.WriteString(fmt.Sprintf("\n  %d. %s: %s (%s)", i+1, en.searchPeerName(result.NodeID), result.Match.Name, formatBytes(result.Match.Size)))
+		}
+	}
+	if len(query.more) > 0 {
+		sort.Strings(query.more)
+		content.WriteString(fmt.Sprintf("\n  ⚠️ %s had more; search for something narrower", strings.Join(query.more, ", ")))
+	}
+	if len(silent) > 0 {
+		sort.Strings(silent)
+		content.WriteString(fmt.Sprintf("\n  No answer from %s", strings.Join(silent, ", ")))
+	}
+	en.notifyUI(Message{SenderID: "System", Content: []byte(content.String())})
+}
+
+// searchPeerName names a peer in search results: its nick, or its node ID
+func (en *EnhancedNode) searchPeerName(nodeID string) string {
+	return cmp.Or(en.presence.Nick(nodeID), nodeID)
+}
+
+// handleGetCommand processes /get <n>: it asks the peer with result n of the last search to send
+// that file. Its offer is accepted without asking.
+func (en *EnhancedNode) handleGetCommand(args string) {
+	en.search.mutex.Lock()
+	results := en.search.results
+	en.search.mutex.Unlock()
+
+	n, err := strconv.Atoi(strings.TrimSpace(args))
+	if err != nil || n < 1 || n > len(results) {
+		content := "Usage: /get <n>, a result of the last /search"
+		if len(results) == 0 {
+			content = "❌ Nothing to get: /search <term> first"
+		}
+		en.notifyUI(Message{SenderID: "System", Content: []byte(content)})
+		return
+	}
+	result := results[n-1]
+	if en.canDownloadRanges(result) {
+		en.startMultiSourceGet(result)
+		return
+	}
+
+	get := fileSearchMessage{Type: "get", ID: newMessageID(), Name: result.Match.Name}
+	data, err := json.Marshal(get)
+	if err != nil {
+		log.Printf("Failed to serialize get: %v", err)
+		return
+	}
+	now := en.wallClock.Now()
+	en.search.expect(get.ID, requestedFile{NodeID: result.NodeID, Name: result.Match.Name, Expires: now.Add(searchGetExpiry)}, now)
+	if err := en.sendEncryptedTo(result.NodeID, data, "search"); err != nil {
+		en.search.takeRequested(get.ID, result.NodeID, now)
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Couldn't ask %s for %s: %v", result.NodeID, result.Match.Name, err)),
+		})
+		return
+	}
+	en.notifyUI(Message{
+		SenderID:     "System",
+		Content:      []byte(fmt.Sprintf("📥 Asked %s for %s (%s)", en.searchPeerName(result.NodeID), result.Match.Name, formatBytes(result.Match.Size))),
+		Conversation: result.NodeID,
+	})
+}
+
+// sendSharedFile offers a peer the shared file it asked for with /get, or tells it the file is
+// no longer shared
+func (en *EnhancedNode) sendSharedFile(senderID string, fromPeerKey bool, get fileSearchMessage) {
+	shares := en.search.sharing()
+	if len(shares) == 0 || !fromPeerKey {
+		return
+	}
+
+	path, err := resolveShared(shares, get.Name)
+	if err == nil {
+		err = en.fileManager.sendRequested(senderID, path, get.ID)
+	}
+	if err != nil {
+		log.Printf("Can't send %q to %s: %v", get.Name, senderID, err)
+		data, marshalErr := json.Marshal(fileSearchMessage{Type: "unavailable", ID: get.ID, Name: get.Name})
+		if marshalErr != nil {
+			return
+		}
+		if err := en.sendEncryptedTo(senderID, data, "search"); err != nil && !errors.Is(err, ErrPeerUnreachable) {
+			log.Printf("Failed to tell %s %q is unavailable: %v", senderID, get.Name, err)
+		}
+		return
+	}
+	en.notifyUI(Message{
+		SenderID:     "System",
+		Content:      []byte(fmt.Sprintf("📤 %s asked for %s from your shared files; sending it", senderID, get.Name)),
+		Conversation: senderID,
+	})
+}
+
+// expect records a file asked for with /get, forgetting those that expired by now
+func (fsr *FileSearch) expect(id string, file requestedFile, now time.Time) {
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	for other, asked := range fsr.requested {
+		if now.After(asked.Expires) {
+			delete(fsr.requested, other)
+		}
+	}
+	fsr.requested[id] = file
+}
+
+// takeRequested reports whether a /get with this ID asked the peer for a file, and forgets it
+func (fsr *FileSearch) takeRequested(id, nodeID string, now time.Time) (requestedFile, bool) {
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	file, exists := fsr.requested[id]
+	if !exists || file.NodeID != nodeID || now.After(file.Expires) {
+		return requestedFile{}, false
+	}
+	delete(fsr.requested, id)
+	return file, true
+}
+
+// requestedBy reports whether an offer answers a /get of ours to the peer making it
+func (en *EnhancedNode) requestedBy(getID, nodeID string) bool {
+	if getID == "" {
+		return false
+	}
+	_, asked := en.search.takeRequested(getID, nodeID, en.wallClock.Now())
+	return asked
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestResolveShared only finds regular, visible files inside a shared directory, whatever a peer
+// puts in the name it asks for
+func TestResolveShared(t *testing.T) {
+	root := t.TempDir()
+	music := filepath.Join(root, "music")
+	outside := filepath.Join(root, "private")
+	for _, dir := range []string{filepath.Join(music, "albums", "live"), filepath.Join(music, ".cache"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{
+		filepath.Join(music, "song.mp3"),
+		filepath.Join(music, "albums", "live", "encore.mp3"),
+		filepath.Join(music, ".hidden.mp3"),
+		filepath.Join(music, ".cache", "cover.jpg"),
+		filepath.Join(outside, "secret.txt"),
+	}
+	for _, file := range files {
+		if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(music, "escape.mp3")); err != nil {
+		t.Skipf("can't make symlinks: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(music, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(music, "song.mp3"), filepath.Join(music, "alias.mp3")); err != nil {
+		t.Fatal(err)
+	}
+	shares := []sharedDir{{Name: "music", Path: music}}
+
+	tests := []struct {
+		name string
+		want string // Empty if the name must be refused
+	}{
+		{"music/song.mp3", filepath.Join(music, "song.mp3")},
+		{"music/albums/live/encore.mp3", filepath.Join(music, "albums", "live", "encore.mp3")},
+		{"music/alias.mp3", filepath.Join(music, "song.mp3")},
+		{"music/../private/secret.txt", ""},
+		{"music/albums/../../private/secret.txt", ""},
+		{"music/" + filepath.Join(outside, "secret.txt"), ""},
+		{"/etc/passwd", ""},
+		{"music//etc/passwd", ""},
+		{"music/.hidden.mp3", ""},
+		{"music/.cache/cover.jpg", ""},
+		{"music/escape.mp3", ""},
+		{"music/linked/secret.txt", ""},
+		{"music/albums", ""},
+		{"music/albums/live", ""},
+		{"music/missing.mp3", ""},
+		{"music", ""},
+		{"videos/song.mp3", ""},
+		{"private/secret.txt", ""},
+	}
+	for _, test := range tests {
+		path, err := resolveShared(shares, test.name)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q resolved to %s", test.name, path)
+			}
+			continue
+		}
+		want, _ := filepath.EvalSymlinks(test.want)
+		if err != nil || path != want {
+			t.Errorf("%q resolved to %q, %v; want %s", test.name, path, err, want)
+		}
+	}
+}
@@ -15,15 +15,49 @@ import (
 
 const (
 	chunkSize = 8192 // 8KB chunks
+
+	transferKindVoice = "voice" // A voice message sent as a transfer because it is too large for one message
 )
 
+// encryptedSender delivers an encrypted payload to a single peer, optionally on a stream of its
+// own where the connection has streams
+type encryptedSender interface {
+	sendEncryptedTo(peerID string, plaintext []byte, msgType string) error
+	sendEncryptedOnStream(peerID, stream string, plaintext []byte, msgType string) error
+	finishStream(peerID, stream string)
+}
+
+// voiceReceiver takes voice messages that arrived as transfers
+type voiceReceiver interface {
+	receiveVoiceTransfer(senderID string, audioData []byte, duration int, format string, direct bool)
+}
+
+// fileOriginator says who a received file is from, for sorting it into the downloads directory
+type fileOriginator interface {
+	fileOrigin(nodeID, room string) fileOrigin
+}
+
+// fileRequester says whether an offer answers a file we asked a peer for with /get
+type fileRequester interface {
+	requestedBy(getID, nodeID string) bool
+}
+
 // FileTransferManager manages all file transfers
 type FileTransferManager struct {
 	mutex           sync.RWMutex
 	activeTransfers map[string]*FileTransfer
+	deliveryWaiters map[string]chan error // File ID -> outcome of an outgoing transfer
 	crypto          *CryptoManager
 	node            *Node
+	sender          encryptedSender
+	voice           voiceReceiver
+	origins         fileOriginator
+	requests        fileRequester
+	peers           peerLookup
 	fileDir         string
+	downloadDir     string          // Where received files are saved
+	layout          downloadsLayout // Subdirectories of downloadDir received files are sorted into
+	autoAccept      bool            // Accept incoming offers without asking
 }
 
 // FileTransfer represents an active file transfer
@@ -39,153 +73,521 @@ type FileTransfer struct {
 	PeerID      string
 	IsOutgoing  bool
 	FilePath    string // For outgoing transfers
+	Kind        string // transferKindVoice for a voice message; empty for a file
+	Duration    int    // Seconds, for voice messages
+	Direct      bool   // A voice message sent to this peer alone rather than to everyone
+	Requested   string // The peer's /get this transfer answers; empty if we offered it unasked
+	Room        string // The room the file was sent to the members of; empty if sent to one peer
+
+	acks      bool          // The other side paces the transfer by acks: it sends them, or waits for them
+	acked     int           // Chunks of an outgoing transfer the receiver has acknowledged
+	ackSignal chan struct{} // Signalled when an ack for an outgoing transfer arrives
+
+	download *rangeDownload // The sources of a multi-source download; nil for a transfer a peer pushes
+	heard    time.Time      // When an incoming transfer was accepted or last received a chunk
 }
 
 // FileMessage represents a file transfer message
 type FileMessage struct {
-	Type        string `json:"type"`         // "request", "accept", "reject", "chunk", "complete"
-	FileID      string `json:"file_id"`      // Unique identifier for this transfer
-	FileName    string `json:"file_name"`    // Name of the file
-	FileSize    int64  `json:"file_size"`    // Total size in bytes
-	ChunkIndex  int    `json:"chunk_index"`  // Index of this chunk
-	TotalChunks int    `json:"total_chunks"` // Total number of chunks
-	Data        string `json:"data"`         // Base64 encoded chunk data
-	Checksum    string `json:"checksum"`     // MD5 checksum
+	Type        string `json:"type"`                // "request", "accept", "reject", "chunk", "ack", "complete", "delivered"
+	FileID      string `json:"file_id"`             // Unique identifier for this transfer
+	FileName    string `json:"file_name"`           // Name of the file
+	FileSize    int64  `json:"file_size"`           // Total size in bytes
+	ChunkIndex  int    `json:"chunk_index"`         // Index of this chunk; for an ack, the chunks received less one
+	TotalChunks int    `json:"total_chunks"`        // Total number of chunks
+	Data        string `json:"data"`                // Base64 encoded chunk data
+	Checksum    string `json:"checksum"`            // MD5 checksum
+	Kind        string `json:"kind,omitempty"`      // "voice" for a voice message; empty for a file
+	Duration    int    `json:"duration,omitempty"`  // Seconds, for voice messages
+	Direct      bool   `json:"direct,omitempty"`    // A voice message sent to the receiver alone
+	Acks        bool   `json:"acks,omitempty"`      // On a request, the sender paces by acks; on an accept, the receiver sends them
+	Requested   string `json:"requested,omitempty"` // On a request, the receiver's /get it answers
+	Room        string `json:"room,omitempty"`      // On a request, the room the file was sent to
+}
+
+// TransferInfo is a point-in-time snapshot of a file transfer
+type TransferInfo struct {
+	FileID      string `json:"file_id"`
+	FileName    string `json:"file_name"`
+	FileSize    int64  `json:"file_size"`
+	PeerID      string `json:"peer"`
+	Status      string `json:"status"`
+	Progress    int    `json:"progress"`
+	TotalChunks int    `json:"total_chunks"`
+	IsOutgoing  bool   `json:"outgoing"`
+	Kind        string `json:"kind,omitempty"`
 }
 
 // NewFileTransferManager creates a new file transfer manager
-func NewFileTransferManager(node *Node, crypto *CryptoManager, fileDir string) *FileTransferManager {
+func NewFileTransferManager(node *Node, crypto *CryptoManager, fileDir, downloadDir string) *FileTransferManager {
 	if err := os.MkdirAll(fileDir, 0755); err != nil {
 		log.Printf("Warning: Failed to create file directory: %v", err)
 	}
 
 	return &FileTransferManager{
 		activeTransfers: make(map[string]*FileTransfer),
+		deliveryWaiters: make(map[string]chan error),
 		crypto:          crypto,
 		node:            node,
 		fileDir:         fileDir,
+		downloadDir:     downloadDir,
 	}
 }
 
+// Configure sets where received files are saved, how they are sorted there, and whether offers
+// are accepted without asking. Transfers already accepted are saved to the new directory.
+func (ftm *FileTransferManager) Configure(downloadDir string, layout downloadsLayout, autoAccept bool) {
+	ftm.mutex.Lock()
+	defer ftm.mutex.Unlock()
+	ftm.downloadDir = downloadDir
+	ftm.layout = layout
+	ftm.autoAccept = autoAccept
+}
+
+// receiveSettings returns where received files are saved, how they are sorted there, and whether
+// offers are accepted without asking
+func (ftm *FileTransferManager) receiveSettings() (downloadDir string, layout downloadsLayout, autoAccept bool) {
+	ftm.mutex.RLock()
+	defer ftm.mutex.RUnlock()
+	return ftm.downloadDir, ftm.layout, ftm.autoAccept
+}
+
 // SendFile initiates a file transfer
 func (ftm *FileTransferManager) SendFile(peerID, filePath string) error {
+	return ftm.startTransfer(ftm.generateFileID(), peerID, filePath)
+}
+
+// sendFileWithResult initiates a file transfer and returns a channel that receives its outcome:
+// nil once the receiver reports the file saved, or an error if the transfer fails.
+func (ftm *FileTransferManager) sendFileWithResult(peerID, filePath string) (string, <-chan error, error) {
+	fileID := ftm.generateFileID()
+	result := make(chan error, 1)
+
+	ftm.mutex.Lock()
+	ftm.deliveryWaiters[fileID] = result
+	ftm.mutex.Unlock()
+
+	if err := ftm.startTransfer(fileID, peerID, filePath); err != nil {
+		ftm.forgetDeliveryWaiter(fileID)
+		return "", nil, err
+	}
+
+	return fileID, result, nil
+}
+
+// forgetDeliveryWaiter drops the outcome channel for a transfer
+func (ftm *FileTransferManager) forgetDeliveryWaiter(fileID string) {
+	ftm.mutex.Lock()
+	delete(ftm.deliveryWaiters, fileID)
+	ftm.mutex.Unlock()
+}
+
+// finishDelivery reports the outcome of an outgoing transfer to its waiter, if any
+func (ftm *FileTransferManager) finishDelivery(fileID string, err error) {
+	ftm.mutex.Lock()
+	result, exists := ftm.deliveryWaiters[fileID]
+	delete(ftm.deliveryWaiters, fileID)
+	ftm.mutex.Unlock()
+
+	if exists {
+		result <- err
+	}
+}
+
+// startTransfer reads the file and sends the transfer request under the given file ID
+func (ftm *FileTransferManager) startTransfer(fileID, peerID, filePath string) error {
+	transfer, err := readTransfer(fileID, peerID, filePath)
+	if err != nil {
+		return err
+	}
+	return ftm.offer(transfer)
+}
+
+// sendRequested offers a peer a file it asked for with /get, which it accepts without asking
+func (ftm *FileTransferManager) sendRequested(peerID, filePath, getID string) error {
+	transfer, err := readTransfer(ftm.generateFileID(), peerID, filePath)
+	if err != nil {
+		return err
+	}
+	transfer.Requested = getID
+	return ftm.offer(transfer)
+}
+
+// sendToRoomMember offers a file sent to a room to one of its members
+func (ftm *FileTransferManager) sendToRoomMember(peerID, filePath, room string) error {
+	transfer, err := readTransfer(ftm.generateFileID(), peerID, filePath)
+	if err != nil {
+		return err
+	}
+	transfer.Room = room
+	return ftm.offer(transfer)
+}
+
+// readTransfer reads a file into the record for sending it to a peer
+func readTransfer(fileID, peerID, filePath string) (*FileTransfer, error) {
+	if info, err := os.Stat(filePath); err == nil && info.Size() > maxFileBytes {
+		return nil, fmt.Errorf("%w: %s is %s, over the %s file limit", errMessageTooLarge,
+			filepath.Base(filePath), formatBytes(info.Size()), formatBytes(maxFileBytes))
+	}
+
 	// Read file
 	fileData, err := os.ReadFile(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	// Generate file ID
-	fileID := generateFileID()
-	fileName := filepath.Base(filePath)
+	transfer := newOutgoingTransfer(fileID, peerID, filepath.Base(filePath), fileData)
+	transfer.FilePath = filePath
+	return transfer, nil
+}
 
-	// Create transfer record
-	chunks := splitIntoChunks(fileData)
-	transfer := &FileTransfer{
+// SendVoice sends a voice message to a peer in chunks, for clips too large to go in one message.
+// The receiver accepts it without asking and stores it for /play. direct is false for a copy of a
+// message sent to everyone.
+func (ftm *FileTransferManager) SendVoice(peerID string, audioData []byte, format string, duration int, direct bool) error {
+	transfer := newOutgoingTransfer(ftm.generateFileID(), peerID, fmt.Sprintf("voice-%ds.%s", duration, format), audioData)
+	transfer.Kind = transferKindVoice
+	transfer.Duration = duration
+	transfer.Direct = direct
+	return ftm.offer(transfer)
+}
+
+// newOutgoingTransfer creates the record for sending data to a peer
+func newOutgoingTransfer(fileID, peerID, fileName string, data []byte) *FileTransfer {
+	chunks := splitIntoChunks(data)
+	return &FileTransfer{
 		FileID:      fileID,
 		FileName:    fileName,
-		FileSize:    int64(len(fileData)),
+		FileSize:    int64(len(data)),
 		Chunks:      chunks,
 		TotalChunks: len(chunks),
 		Status:      "pending",
 		Progress:    0,
 		PeerID:      peerID,
 		IsOutgoing:  true,
-		FilePath:    filePath,
+		ackSignal:   make(chan struct{}, 1),
 	}
+}
 
+// offer stores an outgoing transfer and sends the request for it. If the request can't be sent the
+// transfer is dropped and the error returned for the caller to report.
+func (ftm *FileTransferManager) offer(transfer *FileTransfer) error {
 	// Store transfer
 	ftm.mutex.Lock()
-	ftm.activeTransfers[fileID] = transfer
+	ftm.activeTransfers[transfer.FileID] = transfer
 	ftm.mutex.Unlock()
 
+	transfer.mutex.Lock()
+	ftm.publish(transfer)
+	transfer.mutex.Unlock()
+
 	// Send request message
 	requestMsg := FileMessage{
 		Type:        "request",
-		FileID:      fileID,
-		FileName:    fileName,
-		FileSize:    int64(len(fileData)),
-		TotalChunks: len(chunks),
-	}
-
-	if err := ftm.sendFileMessage(peerID, requestMsg); err != nil {
+		FileID:      transfer.FileID,
+		FileName:    transfer.FileName,
+		FileSize:    transfer.FileSize,
+		TotalChunks: transfer.TotalChunks,
+		Kind:        transfer.Kind,
+		Duration:    transfer.Duration,
+		Direct:      transfer.Direct,
+		Acks:        true,
+		Requested:   transfer.Requested,
+		Room:        transfer.Room,
+	}
+
+	if err := ftm.sendFileMessage(transfer.PeerID, requestMsg); err != nil {
 		// Cleanup on error
 		ftm.mutex.Lock()
-		delete(ftm.activeTransfers, fileID)
+		delete(ftm.activeTransfers, transfer.FileID)
 		ftm.mutex.Unlock()
 
-		// Notify UI of failure
-		if ftm.node.uiChannel != nil {
-			ftm.node.uiChannel <- Message{
-				SenderID: "SYSTEM",
-				Content:  []byte(fmt.Sprintf("Failed to send file request to %s: %v", peerID, err)),
-			}
-		}
-		return fmt.Errorf("failed to send file request: %w", err)
+		transfer.mutex.Lock()
+		transfer.Status = "failed"
+		ftm.publish(transfer)
+		transfer.mutex.Unlock()
+		return err
 	}
 
-	log.Printf("File transfer request sent: %s (%d bytes)", fileName, len(fileData))
+	log.Printf("File transfer request sent: %s (%d bytes)", transfer.FileName, transfer.FileSize)
 	return nil
 }
 
-// HandleFileMessage routes file messages based on type
-func (ftm *FileTransferManager) HandleFileMessage(peerID string, fileMsg FileMessage) {
+// ListTransfers returns a snapshot of all active transfers
+func (ftm *FileTransferManager) ListTransfers() []TransferInfo {
+	// Copy the transfer list first: handleFileComplete takes the locks in the opposite order
+	ftm.mutex.RLock()
+	active := make([]*FileTransfer, 0, len(ftm.activeTransfers))
+	for _, transfer := range ftm.activeTransfers {
+		active = append(active, transfer)
+	}
+	ftm.mutex.RUnlock()
+
+	transfers := make([]TransferInfo, 0, len(active))
+	for _, transfer := range active {
+		transfers = append(transfers, transfer.info())
+	}
+
+	return transfers
+}
+
+// info snapshots a transfer
+func (transfer *FileTransfer) info() TransferInfo {
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+
+	return transfer.snapshot()
+}
+
+// snapshot is info for a caller that holds the transfer's mutex
+func (transfer *FileTransfer) snapshot() TransferInfo {
+	return TransferInfo{
+		FileID:      transfer.FileID,
+		FileName:    transfer.FileName,
+		FileSize:    transfer.FileSize,
+		PeerID:      transfer.PeerID,
+		Status:      transfer.Status,
+		Progress:    transfer.Progress,
+		TotalChunks: transfer.TotalChunks,
+		IsOutgoing:  transfer.IsOutgoing,
+		Kind:        transfer.Kind,
+	}
+}
+
+// publish puts a transfer's state on the event feed; the caller must hold its mutex
+func (ftm *FileTransferManager) publish(transfer *FileTransfer) {
+	ftm.node.events.Publish(eventTransfer, transfer.snapshot())
+}
+
+// setProgress records how much of a transfer is done, publishing it when it reaches a new percent;
+// the caller must hold its mutex
+func (ftm *FileTransferManager) setProgress(transfer *FileTransfer, chunks int) {
+	progress := (chunks * 100) / transfer.TotalChunks
+	if progress == transfer.Progress {
+		return
+	}
+	transfer.Progress = progress
+	ftm.publish(transfer)
+}
+
+// HandleFileMessage routes file messages based on type. Messages over the size limits are
+// refused with an error wrapping errMessageTooLarge.
+func (ftm *FileTransferManager) HandleFileMessage(peerID string, fileMsg FileMessage) error {
 	switch fileMsg.Type {
 	case "request":
-		ftm.handleFileRequest(peerID, fileMsg)
+		return ftm.handleFileRequest(peerID, fileMsg)
 	case "accept":
 		ftm.handleFileAccept(peerID, fileMsg)
 	case "reject":
 		ftm.handleFileReject(peerID, fileMsg)
 	case "chunk":
-		ftm.handleFileChunk(peerID, fileMsg)
+		return ftm.handleFileChunk(peerID, fileMsg)
+	case "ack":
+		ftm.handleFileAck(peerID, fileMsg)
 	case "complete":
 		ftm.handleFileComplete(peerID, fileMsg)
+	case "delivered":
+		ftm.handleFileDelivered(peerID, fileMsg)
 	default:
 		log.Printf("Unknown file message type: %s", fileMsg.Type)
 	}
+	return nil
 }
 
-// handleFileRequest handles incoming file transfer requests
-func (ftm *FileTransferManager) handleFileRequest(peerID string, fileMsg FileMessage) {
+// handleFileRequest handles incoming file transfer requests. Offers over the size limits are
+// rejected.
+func (ftm *FileTransferManager) handleFileRequest(peerID string, fileMsg FileMessage) error {
+	// The name is used as a path in the downloads directory and shown in the UI
+	fileMsg.FileName = sanitizeFileName(fileMsg.FileName)
+
 	log.Printf("Received file transfer request from %s: %s (%d bytes)",
 		peerID, fileMsg.FileName, fileMsg.FileSize)
 
-	// Auto-accept and create transfer record
+	if err := checkFileRequest(fileMsg); err != nil {
+		if err := ftm.sendFileMessage(peerID, FileMessage{Type: "reject", FileID: fileMsg.FileID}); err != nil {
+			log.Printf("Failed to send reject message: %v", err)
+		}
+		return err
+	}
+
+	// Hold the offer until the user accepts or rejects it
 	transfer := &FileTransfer{
 		FileID:      fileMsg.FileID,
 		FileName:    fileMsg.FileName,
 		FileSize:    fileMsg.FileSize,
 		Chunks:      make(map[int][]byte),
 		TotalChunks: fileMsg.TotalChunks,
-		Status:      "active",
+		Status:      "pending",
 		Progress:    0,
 		PeerID:      peerID,
 		IsOutgoing:  false,
+		acks:        fileMsg.Acks,
+		Room:        fileMsg.Room,
+	}
+
+	if fileMsg.Kind == transferKindVoice {
+		if fileMsg.FileSize > maxVoiceTransferBytes {
+			log.Printf("Refusing %s voice message from %s", formatBytes(fileMsg.FileSize), peerID)
+			if err := ftm.sendFileMessage(peerID, FileMessage{Type: "reject", FileID: fileMsg.FileID}); err != nil {
+				log.Printf("Failed to send reject message: %v", err)
+			}
+			return nil
+		}
+		transfer.Kind = transferKindVoice
+		transfer.Duration = fileMsg.Duration
+		transfer.Direct = fileMsg.Direct
 	}
 
 	ftm.mutex.Lock()
 	ftm.activeTransfers[fileMsg.FileID] = transfer
 	ftm.mutex.Unlock()
 
-	// Send accept message
-	acceptMsg := FileMessage{
+	transfer.mutex.Lock()
+	ftm.publish(transfer)
+	transfer.mutex.Unlock()
+
+	if transfer.Kind == transferKindVoice {
+		// Voice messages are stored for /play like the short ones, so there is nothing to ask
+		if err := ftm.acceptTransfer(transfer); err != nil {
+			log.Printf("Failed to send accept message: %v", err)
+		}
+		return nil
+	}
+
+	// A file asked for with /get is taken like one auto-accepted
+	_, _, autoAccept := ftm.receiveSettings()
+	if requested := ftm.requests != nil && ftm.requests.requestedBy(fileMsg.Requested, peerID); requested || autoAccept {
+		if err := ftm.acceptTransfer(transfer); err != nil {
+			log.Printf("Failed to send accept message: %v", err)
+			return nil
+		}
+		ftm.node.notifyUI(Message{
+			SenderID:     "System",
+			Content:      []byte(fmt.Sprintf("📥 Receiving %s from %s (%s)", fileMsg.FileName, peerID, formatBytes(fileMsg.FileSize))),
+			Conversation: peerID,
+		})
+		return nil
+	}
+
+	// The TUI also lists pending offers with keys to answer them
+	ftm.node.notifyUI(Message{
+		SenderID: "System",
+		Content: []byte(fmt.Sprintf("📥 %s offers %s (%s): /accept %s to receive it, /reject %s to decline",
+			peerID, fileMsg.FileName, formatBytes(fileMsg.FileSize), fileMsg.FileID, fileMsg.FileID)),
+		Conversation: peerID,
+	})
+	return nil
+}
+
+// findOffer finds a pending incoming offer by its ID or a unique ending of it. An empty ID picks
+// the only offer, if there is just one.
+func (ftm *FileTransferManager) findOffer(id string) (*FileTransfer, error) {
+	var offers []*FileTransfer
+	ftm.mutex.RLock()
+	for _, transfer := range ftm.activeTransfers {
+		transfer.mutex.Lock()
+		pending := !transfer.IsOutgoing && transfer.Status == "pending"
+		transfer.mutex.Unlock()
+		if pending && strings.HasSuffix(transfer.FileID, id) {
+			if transfer.FileID == id {
+				ftm.mutex.RUnlock()
+				return transfer, nil
+			}
+			offers = append(offers, transfer)
+		}
+	}
+	ftm.mutex.RUnlock()
+
+	switch {
+	case len(offers) == 1:
+		return offers[0], nil
+	case len(offers) == 0 && id == "":
+		return nil, fmt.Errorf("no pending file offers")
+	case len(offers) == 0:
+		return nil, fmt.Errorf("no pending file offer %s", id)
+	case id == "":
+		return nil, fmt.Errorf("%d offers are pending; give the ID of one", len(offers))
+	default:
+		return nil, fmt.Errorf("%d offers end in %s; give more of the ID", len(offers), id)
+	}
+}
+
+// acceptTransfer starts receiving a pending offer
+func (ftm *FileTransferManager) acceptTransfer(transfer *FileTransfer) error {
+	transfer.mutex.Lock()
+	if transfer.Status != "pending" {
+		transfer.mutex.Unlock()
+		return fmt.Errorf("%s is already %s", transfer.FileName, transfer.Status)
+	}
+	transfer.Status = "active"
+	transfer.heard = ftm.node.wallClock.Now()
+	ftm.publish(transfer)
+	transfer.mutex.Unlock()
+
+	return ftm.sendFileMessage(transfer.PeerID, FileMessage{
 		Type:   "accept",
-		FileID: fileMsg.FileID,
+		FileID: transfer.FileID,
+		Acks:   transfer.acks,
+	})
+}
+
+// AcceptOffer accepts a pending file offer (see findOffer for the ID)
+func (ftm *FileTransferManager) AcceptOffer(id string) (TransferInfo, error) {
+	transfer, err := ftm.findOffer(id)
+	if err != nil {
+		return TransferInfo{}, err
 	}
+	if err := ftm.acceptTransfer(transfer); err != nil {
+		return TransferInfo{}, err
+	}
+	return transfer.info(), nil
+}
 
-	if err := ftm.sendFileMessage(peerID, acceptMsg); err != nil {
-		log.Printf("Failed to send accept message: %v", err)
-		return
+// RejectOffer declines a pending file offer (see findOffer for the ID) and tells the sender
+func (ftm *FileTransferManager) RejectOffer(id string) (TransferInfo, error) {
+	transfer, err := ftm.findOffer(id)
+	if err != nil {
+		return TransferInfo{}, err
 	}
 
-	// Notify UI
-	if ftm.node.uiChannel != nil {
-		ftm.node.uiChannel <- Message{
-			SenderID: "SYSTEM",
-			Content:  []byte(fmt.Sprintf("Receiving file from %s: %s (%d bytes)", peerID, fileMsg.FileName, fileMsg.FileSize)),
+	ftm.mutex.Lock()
+	delete(ftm.activeTransfers, transfer.FileID)
+	ftm.mutex.Unlock()
+
+	transfer.mutex.Lock()
+	transfer.Status = "failed"
+	ftm.publish(transfer)
+	transfer.mutex.Unlock()
+
+	return transfer.info(), ftm.sendFileMessage(transfer.PeerID, FileMessage{
+		Type:   "reject",
+		FileID: transfer.FileID,
+	})
+}
+
+// HandleOfferCommand handles /accept [id] and /reject [id]
+func (ftm *FileTransferManager) HandleOfferCommand(command string) {
+	name, id, _ := strings.Cut(strings.TrimSpace(command), " ")
+	id = strings.TrimSpace(id)
+
+	var content string
+	if name == "/accept" {
+		transfer, err := ftm.AcceptOffer(id)
+		content = fmt.Sprintf("📥 Receiving %s from %s", transfer.FileName, transfer.PeerID)
+		if err != nil {
+			content = fmt.Sprintf("❌ Failed to accept file: %v", err)
+		}
+	} else {
+		transfer, err := ftm.RejectOffer(id)
+		content = fmt.Sprintf("🚫 Declined %s from %s", transfer.FileName, transfer.PeerID)
+		if err != nil {
+			content = fmt.Sprintf("❌ Failed to reject file: %v", err)
 		}
 	}
+	ftm.node.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(content),
+	})
 }
 
 // handleFileAccept handles file transfer acceptance
@@ -201,6 +603,8 @@ func (ftm *FileTransferManager) handleFileAccept(peerID string, fileMsg FileMess
 
 	transfer.mutex.Lock()
 	transfer.Status = "active"
+	transfer.acks = fileMsg.Acks
+	ftm.publish(transfer)
 	transfer.mutex.Unlock()
 
 	log.Printf("File transfer accepted by %s, starting transfer", peerID)
@@ -211,30 +615,74 @@ func (ftm *FileTransferManager) handleFileAccept(peerID string, fileMsg FileMess
 
 // handleFileReject handles file transfer rejection
 func (ftm *FileTransferManager) handleFileReject(peerID string, fileMsg FileMessage) {
+	name := "a file"
 	ftm.mutex.Lock()
 	transfer, exists := ftm.activeTransfers[fileMsg.FileID]
 	if exists {
 		transfer.mutex.Lock()
+		name = transfer.FileName
+		if transfer.Kind == transferKindVoice {
+			name = "a voice message"
+		}
 		transfer.Status = "failed"
+		ftm.publish(transfer)
 		transfer.mutex.Unlock()
 		delete(ftm.activeTransfers, fileMsg.FileID)
 	}
 	ftm.mutex.Unlock()
 
 	log.Printf("File transfer rejected by %s", peerID)
+	ftm.finishDelivery(fileMsg.FileID, fmt.Errorf("%w: rejected by %s", ErrTransferFailed, peerID))
 
 	// Notify UI
-	if ftm.node.uiChannel != nil {
-		ftm.node.uiChannel <- Message{
-			SenderID: "SYSTEM",
-			Content:  []byte(fmt.Sprintf("File transfer rejected by %s", peerID)),
-		}
-	}
+	ftm.node.notifyUI(Message{
+		SenderID:     "System",
+		Content:      []byte(fmt.Sprintf("🚫 %s declined %s", peerID, name)),
+		Conversation: peerID,
+	})
 }
 
-// sendFileChunks sends all chunks of a file
+// failOutgoing ends an outgoing transfer that couldn't be sent. Nothing waits on sendFileChunks, so
+// the failure goes to the delivery waiter, if any, and the UI.
+func (ftm *FileTransferManager) failOutgoing(peerID string, transfer *FileTransfer, err error) {
+	log.Printf("Failed to send %s to %s: %v", transfer.FileName, peerID, err)
+	ftm.sender.finishStream(peerID, transfer.FileID)
+	transfer.mutex.Lock()
+	transfer.Status = "failed"
+	ftm.publish(transfer)
+	transfer.mutex.Unlock()
+
+	// Cleanup on error
+	ftm.mutex.Lock()
+	delete(ftm.activeTransfers, transfer.FileID)
+	ftm.mutex.Unlock()
+	ftm.finishDelivery(transfer.FileID, fmt.Errorf("%w: %w", ErrTransferFailed, err))
+
+	// Notify UI of failure
+	ftm.node.notifyUI(Message{
+		SenderID:     "System",
+		Content:      []byte(fmt.Sprintf("❌ %s not sent to %s: %v", transfer.FileName, peerID, err)),
+		Conversation: peerID,
+	})
+}
+
+// sendFileChunks sends all chunks of a file. A receiver that acknowledges chunks gets as many as
+// its window allows ahead of its acks (chunkWindow); older ones get a chunk every
+// legacyChunkDelay.
 func (ftm *FileTransferManager) sendFileChunks(peerID string, transfer *FileTransfer) {
+	transfer.mutex.Lock()
+	paced := transfer.acks
+	transfer.mutex.Unlock()
+	window := newChunkWindow()
+
 	for i := 0; i < transfer.TotalChunks; i++ {
+		if paced {
+			if err := ftm.waitForWindow(transfer, i, window); err != nil {
+				ftm.failOutgoing(peerID, transfer, err)
+				return
+			}
+		}
+
 		transfer.mutex.Lock()
 		chunkData := transfer.Chunks[i]
 		transfer.mutex.Unlock()
@@ -251,34 +699,27 @@ func (ftm *FileTransferManager) sendFileChunks(peerID string, transfer *FileTran
 			Checksum:    checksum,
 		}
 
-		if err := ftm.sendFileMessage(peerID, chunkMsg); err != nil {
-			log.Printf("Failed to send chunk %d: %v", i, err)
-			transfer.mutex.Lock()
-			transfer.Status = "failed"
-			transfer.mutex.Unlock()
-
-			// Cleanup on error
-			ftm.mutex.Lock()
-			delete(ftm.activeTransfers, transfer.FileID)
-			ftm.mutex.Unlock()
-
-			// Notify UI of failure
-			if ftm.node.uiChannel != nil {
-				ftm.node.uiChannel <- Message{
-					SenderID: "SYSTEM",
-					Content:  []byte(fmt.Sprintf("Failed to send file chunk to %s: %v", peerID, err)),
-				}
-			}
+		if err := ftm.sendChunk(peerID, transfer, chunkMsg, window); err != nil {
+			ftm.failOutgoing(peerID, transfer, fmt.Errorf("chunk %d: %w", i, err))
 			return
 		}
 
 		// Update progress
 		transfer.mutex.Lock()
-		transfer.Progress = ((i + 1) * 100) / transfer.TotalChunks
+		ftm.setProgress(transfer, i+1)
 		transfer.mutex.Unlock()
 
-		// Small delay between chunks to avoid overwhelming the network
-		time.Sleep(10 * time.Millisecond)
+		if !paced {
+			time.Sleep(legacyChunkDelay)
+		}
+	}
+
+	// The completion goes once every chunk is acknowledged, so none is left in flight behind it
+	if paced {
+		if err := ftm.waitForWindow(transfer, transfer.TotalChunks, &chunkWindow{size: 1}); err != nil {
+			ftm.failOutgoing(peerID, transfer, err)
+			return
+		}
 	}
 
 	// Send complete message
@@ -287,23 +728,26 @@ func (ftm *FileTransferManager) sendFileChunks(peerID string, transfer *FileTran
 		FileID: transfer.FileID,
 	}
 
-	if err := ftm.sendFileMessage(peerID, completeMsg); err != nil {
-		log.Printf("Failed to send complete message: %v", err)
+	if err := ftm.sendTransferMessage(peerID, transfer.FileID, completeMsg); err != nil {
+		ftm.failOutgoing(peerID, transfer, fmt.Errorf("completion: %w", err))
 		return
 	}
+	ftm.sender.finishStream(peerID, transfer.FileID)
 
 	transfer.mutex.Lock()
 	transfer.Status = "complete"
+	ftm.publish(transfer)
 	transfer.mutex.Unlock()
 
 	log.Printf("File transfer complete: %s", transfer.FileName)
 
-	// Notify UI
-	if ftm.node.uiChannel != nil {
-		ftm.node.uiChannel <- Message{
-			SenderID: "SYSTEM",
-			Content:  []byte(fmt.Sprintf("File sent successfully: %s", transfer.FileName)),
-		}
+	// Notify UI; /voice has already said where a voice message went
+	if transfer.Kind != transferKindVoice {
+		ftm.node.notifyUI(Message{
+			SenderID:     "System",
+			Content:      []byte(fmt.Sprintf("📤 Sent %s to %s", transfer.FileName, peerID)),
+			Conversation: peerID,
+		})
 	}
 
 	// Clean up after successful transfer
@@ -313,37 +757,68 @@ func (ftm *FileTransferManager) sendFileChunks(peerID string, transfer *FileTran
 }
 
 // handleFileChunk receives and validates file chunks
-func (ftm *FileTransferManager) handleFileChunk(peerID string, fileMsg FileMessage) {
+func (ftm *FileTransferManager) handleFileChunk(peerID string, fileMsg FileMessage) error {
 	ftm.mutex.RLock()
 	transfer, exists := ftm.activeTransfers[fileMsg.FileID]
 	ftm.mutex.RUnlock()
 
 	if !exists {
 		log.Printf("Unknown file transfer ID: %s", fileMsg.FileID)
-		return
+		return nil
+	}
+	if err := checkFileChunk(fileMsg, transfer.TotalChunks); err != nil {
+		return err
 	}
 
 	// Decode chunk data
 	chunkData, err := base64.StdEncoding.DecodeString(fileMsg.Data)
 	if err != nil {
 		log.Printf("Failed to decode chunk data: %v", err)
-		return
+		return nil
 	}
 
 	// Validate checksum
 	checksum := fmt.Sprintf("%x", md5.Sum(chunkData))
 	if checksum != fileMsg.Checksum {
 		log.Printf("Checksum mismatch for chunk %d", fileMsg.ChunkIndex)
-		return
+		return nil
 	}
 
-	// Store chunk
+	// Store chunk, unless the offer was never accepted
 	transfer.mutex.Lock()
+	if transfer.Status != "active" {
+		transfer.mutex.Unlock()
+		log.Printf("Ignoring chunk for %s transfer %s", transfer.Status, fileMsg.FileID)
+		return nil
+	}
+	if !transfer.download.accepts(peerID) {
+		transfer.mutex.Unlock()
+		log.Printf("Ignoring chunk of %s from %s, which isn't one of its sources", fileMsg.FileID, peerID)
+		return nil
+	}
+	_, duplicate := transfer.Chunks[fileMsg.ChunkIndex]
 	transfer.Chunks[fileMsg.ChunkIndex] = chunkData
-	transfer.Progress = (len(transfer.Chunks) * 100) / transfer.TotalChunks
+	transfer.heard = ftm.node.wallClock.Now()
+	ftm.setProgress(transfer, len(transfer.Chunks))
+	ack, due := chunkAck(transfer)
+	next, more := transfer.download.arrived(peerID, fileMsg.ChunkIndex, !duplicate)
+	if transfer.download != nil && len(transfer.Chunks) == transfer.TotalChunks {
+		// A multi-source download has no sender to say it is complete
+		ftm.finishRangeDownload(transfer)
+	}
 	transfer.mutex.Unlock()
 
+	if due {
+		if err := ftm.sendFileMessage(peerID, ack); err != nil {
+			log.Printf("Failed to acknowledge chunks of %s: %v", ack.FileID, err)
+		}
+	}
+	if more {
+		ftm.requestRange(transfer, next)
+	}
+
 	log.Printf("Received chunk %d/%d (%d%%)", fileMsg.ChunkIndex+1, fileMsg.TotalChunks, transfer.Progress)
+	return nil
 }
 
 // handleFileComplete assembles and saves the complete file
@@ -359,6 +834,8 @@ func (ftm *FileTransferManager) handleFileComplete(peerID string, fileMsg FileMe
 
 	transfer.mutex.Lock()
 	defer transfer.mutex.Unlock()
+	// Runs before the unlock, once the transfer has an outcome
+	defer ftm.publish(transfer)
 
 	// Check if we have all chunks
 	if len(transfer.Chunks) != transfer.TotalChunks {
@@ -379,38 +856,60 @@ func (ftm *FileTransferManager) handleFileComplete(peerID string, fileMsg FileMe
 		fileData = append(fileData, chunk...)
 	}
 
-	// Save file to downloads directory
-	downloadsDir := "downloads"
-	if err := os.MkdirAll(downloadsDir, 0755); err != nil {
-		log.Printf("Failed to create downloads directory: %v", err)
-		transfer.Status = "failed"
+	if transfer.Kind == transferKindVoice {
+		// Voice messages go to the voice directory for /play, not to downloads
+		transfer.Status = "complete"
+		log.Printf("Voice message received: %s (%d bytes)", transfer.FileName, len(fileData))
+		format := strings.TrimPrefix(filepath.Ext(transfer.FileName), ".")
+		ftm.voice.receiveVoiceTransfer(peerID, fileData, transfer.Duration, format, transfer.Direct)
+		ftm.confirmDelivery(peerID, fileMsg.FileID)
 		return
 	}
 
-	filePath := filepath.Join(downloadsDir, transfer.FileName)
-	if err := os.WriteFile(filePath, fileData, 0644); err != nil {
+	// Save file to downloads directory, in the layout's subdirectory for its sender
+	downloadDir, layout, _ := ftm.receiveSettings()
+	filePath, err := ftm.saveReceivedFile(downloadDir, layout, peerID, transfer.Room, transfer.FileName, fileData)
+	if err != nil {
 		log.Printf("Failed to save file: %v", err)
 		transfer.Status = "failed"
 		return
 	}
 
 	transfer.Status = "complete"
-	log.Printf("File received successfully: %s (%d bytes)", transfer.FileName, len(fileData))
+	log.Printf("File received successfully: %s (%d bytes)", filePath, len(fileData))
 
-	// Notify UI
-	if ftm.node.uiChannel != nil {
-		ftm.node.uiChannel <- Message{
-			SenderID: "SYSTEM",
-			Content:  []byte(fmt.Sprintf("File received successfully: %s (saved to %s)", transfer.FileName, filePath)),
-		}
+	// Notify UI with the path under the downloads directory, which is what the layout decided
+	savedAs := filePath
+	if relative, err := filepath.Rel(downloadDir, filePath); err == nil {
+		savedAs = relative
+	}
+	ftm.node.notifyUI(Message{
+		SenderID:     "System",
+		Content:      []byte(fmt.Sprintf("✅ Received %s from %s, saved as %s in %s", transfer.FileName, peerID, savedAs, downloadDir)),
+		Attachment:   filePath,
+		Conversation: peerID,
+	})
+
+	ftm.confirmDelivery(peerID, fileMsg.FileID)
+}
+
+// confirmDelivery tells the sender a transfer arrived intact and forgets it
+func (ftm *FileTransferManager) confirmDelivery(peerID, fileID string) {
+	if err := ftm.sendFileMessage(peerID, FileMessage{Type: "delivered", FileID: fileID}); err != nil {
+		log.Printf("Failed to send delivery confirmation: %v", err)
 	}
 
-	// Clean up
 	ftm.mutex.Lock()
-	delete(ftm.activeTransfers, fileMsg.FileID)
+	delete(ftm.activeTransfers, fileID)
 	ftm.mutex.Unlock()
 }
 
+// handleFileDelivered handles the receiver's confirmation that a file was saved
+func (ftm *FileTransferManager) handleFileDelivered(peerID string, fileMsg FileMessage) {
+	log.Printf("File transfer %s confirmed by %s", fileMsg.FileID, peerID)
+	ftm.finishDelivery(fileMsg.FileID, nil)
+}
+
 // sendFileMessage encrypts and sends a file message to a peer
 func (ftm *FileTransferManager) sendFileMessage(peerID string, fileMsg FileMessage) error {
 	// Serialise file message
@@ -419,35 +918,21 @@ func (ftm *FileTransferManager) sendFileMessage(peerID string, fileMsg FileMessa
 		return fmt.Errorf("failed to serialise file message: %w", err)
 	}
 
-	// Encrypt message
-	encryptedMsg, err := ftm.crypto.EncryptMessage(peerID, msgData, "file")
-	if err != nil {
-		return fmt.Errorf("failed to encrypt file message: %w", err)
+	// Encrypt and queue on the peer's connection
+	if err := ftm.sender.sendEncryptedTo(peerID, msgData, "file"); err != nil {
+		return fmt.Errorf("failed to send file %s to %s: %w", fileMsg.Type, peerID, err)
 	}
+	return nil
+}
 
-	// Serialise encrypted message
-	encryptedData, err := json.Marshal(encryptedMsg)
+// sendTransferMessage sends a chunk or completion of one transfer. Over QUIC each transfer has a
+// stream of its own, so its chunks don't hold up chat and other transfers.
+func (ftm *FileTransferManager) sendTransferMessage(peerID, fileID string, fileMsg FileMessage) error {
+	msgData, err := json.Marshal(fileMsg)
 	if err != nil {
-		return fmt.Errorf("failed to serialise encrypted message: %w", err)
-	}
-
-	// Get peer connection
-	ftm.node.peersMutex.RLock()
-	peer, exists := ftm.node.Peers[peerID]
-	ftm.node.peersMutex.RUnlock()
-
-	if !exists {
-		return fmt.Errorf("peer not found: %s", peerID)
-	}
-
-	// Send to peer
-	networkMsg := fmt.Sprintf("%s|%s", ftm.node.ID, string(encryptedData))
-	select {
-	case peer.Send <- []byte(networkMsg):
-		return nil
-	default:
-		return fmt.Errorf("peer send channel full")
+		return fmt.Errorf("failed to serialise file message: %w", err)
 	}
+	return ftm.sender.sendEncryptedOnStream(peerID, fileID, msgData, "file")
 }
 
 // HandleCLICommand parses and handles file sharing CLI commands
@@ -463,18 +948,30 @@ func (ftm *FileTransferManager) HandleCLICommand(command string) {
 
 	if err := ftm.SendFile(peerID, filePath); err != nil {
 		log.Printf("Failed to send file: %v", err)
-		if ftm.node.uiChannel != nil {
-			ftm.node.uiChannel <- Message{
-				SenderID: "System",
-				Content:  []byte(fmt.Sprintf("❌ Failed to send file: %v", err)),
-			}
-		}
+		ftm.node.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Failed to send file: %v", err)),
+		})
+	}
+}
+
+// formatBytes formats a file size for display, e.g. "1.5 MB"
+func formatBytes(size int64) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	case size < 1024*1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1024*1024*1024))
 	}
 }
 
 // generateFileID generates a unique file transfer ID
-func generateFileID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+func (ftm *FileTransferManager) generateFileID() string {
+	return fmt.Sprintf("%d", ftm.node.random.Uint64())
 }
 
 // splitIntoChunks splits data into chunks
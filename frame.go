@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+const maxPooledFrameBuffer = 64 * 1024 // Larger buffers (file chunks, voice) are left to the GC
+
+// framePool holds scratch buffers for assembling wire frames
+var framePool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// newFrame assembles the wire frame "<sender>|<content>\n".
+// Frames are never modified once built, so a broadcast builds one and queues it for every peer.
+func newFrame(senderID string, content []byte) []byte {
+	frame := make([]byte, 0, len(senderID)+1+len(content)+1)
+	frame = append(frame, senderID...)
+	frame = append(frame, delimiter)
+	frame = append(frame, content...)
+	return append(frame, '\n')
+}
+
+// newJSONFrame assembles a wire frame whose content is v serialized as JSON
+func newJSONFrame(senderID string, v any) ([]byte, error) {
+	buf := framePool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledFrameBuffer {
+			framePool.Put(buf)
+		}
+	}()
+
+	buf.Reset()
+	buf.WriteString(senderID)
+	buf.WriteByte(delimiter)
+	// Encode writes the same bytes as json.Marshal, followed by the frame's newline
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// queueFrame sends a frame to every connected peer without blocking, returning the IDs of
+// peers whose send queue was full
+func (n *Node) queueFrame(frame []byte) (dropped []string) {
+	for _, peer := range n.snapshotPeers() {
+		if peer.closed() {
+			continue
+		}
+		select {
+		case peer.Send <- frame:
+		default:
+			dropped = append(dropped, peer.ID)
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBroadcastDuringChurn broadcasts without pause while peers connect and
+// disconnect, for -race to check that broadcasts snapshot the peers rather than hold the lock or
+// read the map unguarded, and that a peer gone mid-broadcast is skipped
+func TestBroadcastDuringChurn(t *testing.T) {
+	tn, a, _ := connectedPair(t)
+
+	stop := make(chan struct{})
+	var storm sync.WaitGroup
+	storm.Add(1)
+	go func() {
+		defer storm.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Errors are expected: peers leave mid-broadcast
+			a.broadcastEncrypted([]byte(fmt.Sprintf(`{"id":"storm-%d","text":"storm %d"}`, i, i)), "text")
+			a.sendPeerListGossip(true)
+			a.broadcast(Message{SenderID: a.ID, Content: []byte("storm")})
+			// Fast enough to overlap every connect and disconnect
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for range 5 {
+		// The storm can fill the send queues, dropping key exchanges, so only the connection is
+		// waited for. a does the dialing: a node only just started may not have added its
+		// goroutines to its WaitGroup yet.
+		transient := tn.addNode()
+		a.connectToPeer(transient.ID)
+		waitFor(t, "the transient peer to be added on both ends", func() bool {
+			return hasPeer(a, transient.ID) && len(transient.snapshotPeers()) > 0
+		})
+		transient.shutdown()
+		waitFor(t, "a to notice the transient peer left", func() bool {
+			return !hasPeer(a, transient.ID)
+		})
+	}
+	close(stop)
+	storm.Wait()
+
+	// A newcomer shows a still works
+	c := tn.addNode()
+	tn.connect(a, c)
+	if err := a.SendTextAndConfirm(c.ID, "after the storm", testWait); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, c, a.ID, "after the storm")
+}
+
+// hasPeer reports whether node has a peer registered under id
+func hasPeer(node *EnhancedNode, id string) bool {
+	return slices.ContainsFunc(node.snapshotPeers(), func(peer *Peer) bool { return peer.ID == id })
+}
+
+// benchPeers registers count peers on a node that isn't running, each holding the node's own key,
+// as every test node shares one identity. Nothing writes their frames out; drainPeers empties
+// their queues.
+func benchPeers(b *testing.B, node *EnhancedNode, count int) []*Peer {
+	b.Helper()
+	keyPEM, err := node.cryptoManager.GetPublicKeyPEM()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var registered []*Peer
+	for i := range count {
+		id := fmt.Sprintf("127.0.0.1:%d", 50000+i)
+		if err := node.cryptoManager.AddPeerKey(id, keyPEM); err != nil {
+			b.Fatal(err)
+		}
+		peer := &Peer{ID: id, key: id, Send: make(chan []byte, 10), Done: make(chan struct{})}
+		peer.setNodeID(id)
+		node.peersMutex.Lock()
+		node.Peers[id] = peer
+		node.conns[id] = peer
+		node.peersMutex.Unlock()
+		node.rememberAddr(id)
+		registered = append(registered, peer)
+	}
+	return registered
+}
+
+// drainPeers discards the frames queued for peers
+func drainPeers(peers []*Peer) {
+	for _, peer := range peers {
+		for len(peer.Send) > 0 {
+			<-peer.Send
+		}
+	}
+}
+
+// BenchmarkBroadcast measures sending one message to 50 peers: the frame built once and queued
+// for all, the peer list gossip, and encrypted broadcasts (signed once, encrypted per peer)
+func BenchmarkBroadcast(b *testing.B) {
+	const peers = 50
+	plaintext := []byte(`{"id":"m","text":"a message of an ordinary length for a chat, sent to everyone"}`)
+
+	for _, bench := range []struct {
+		name string
+		send func(*EnhancedNode) error
+	}{
+		{"frame", func(node *EnhancedNode) error {
+			node.broadcast(Message{SenderID: node.ID, Content: plaintext})
+			return nil
+		}},
+		{"gossip", func(node *EnhancedNode) error {
+			node.sendPeerListGossip(true)
+			return nil
+		}},
+		{"encrypted", func(node *EnhancedNode) error {
+			return node.broadcastEncrypted(plaintext, "text")
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			tn := newTestNetwork(b, 0)
+			node := tn.newNode()
+			b.Cleanup(node.shutdown)
+			registered := benchPeers(b, node, peers)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if err := bench.send(node); err != nil {
+					b.Fatal(err)
+				}
+				drainPeers(registered)
+			}
+		})
+	}
+}
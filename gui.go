@@ -18,6 +18,6 @@ func (gui *ChatGUI) ShowAndRun() {
 	gui.node.StartEnhanced()
 }
 
-func NewNodeWithGUI(listenAddr string, disableDiscovery bool) (*EnhancedNode, error) {
-	return NewEnhancedNode(listenAddr, disableDiscovery)
+func NewNodeWithGUI(listenAddr string, disableDiscovery bool, dataDir string) (*EnhancedNode, error) {
+	return NewEnhancedNode(listenAddr, disableDiscovery, dataDir)
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWait is how long waitFor gives a condition; generous, since -race slows everything down
+const testWait = 20 * time.Second
+
+// testKeyDir holds identity keys generated once and copied into each test node's data directory,
+// as generating a 2048-bit RSA key per node would dominate the run time
+var (
+	testKeyDir   string
+	testKeyMutex sync.Mutex
+	testKeyCount int
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+
+	dir, err := os.MkdirTemp("", "p2pchat-test-keys")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testKeyDir = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testKeys copies the index'th cached identity key into dataDir, generating it on first use
+func testKeys(t testing.TB, index int, dataDir string) {
+	t.Helper()
+	source := filepath.Join(testKeyDir, fmt.Sprint(index))
+
+	testKeyMutex.Lock()
+	for testKeyCount <= index {
+		if _, err := NewCryptoManager(filepath.Join(testKeyDir, fmt.Sprint(testKeyCount))); err != nil {
+			testKeyMutex.Unlock()
+			t.Fatalf("generating test key: %v", err)
+		}
+		testKeyCount++
+	}
+	testKeyMutex.Unlock()
+
+	keysDir := filepath.Join(dataDir, keysDirName)
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{privateKeyFile, publicKeyFile} {
+		data, err := os.ReadFile(filepath.Join(source, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(keysDir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testCrypto opens a CryptoManager for the index'th test key, for tests that need a key without a node
+func testCrypto(t *testing.T, index int) *CryptoManager {
+	t.Helper()
+	dataDir := t.TempDir()
+	testKeys(t, index, dataDir)
+	cm, err := NewCryptoManager(filepath.Join(dataDir, keysDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+// testNetwork is a set of nodes on one MemoryNetwork, with discovery off and no UI, for tests of
+// what nodes do together. Every node is shut down when the test ends.
+type testNetwork struct {
+	t       testing.TB
+	network *MemoryNetwork
+	nodes   []*EnhancedNode
+}
+
+// newTestNetwork starts count nodes, none of them connected yet
+func newTestNetwork(t testing.TB, count int, opts ...NodeOption) *testNetwork {
+	t.Helper()
+	tn := &testNetwork{t: t, network: NewMemoryNetwork()}
+	for range count {
+		tn.addNode(opts...)
+	}
+	return tn
+}
+
+// addNode starts another node on the network. Files offered to it are accepted without asking.
+func (tn *testNetwork) addNode(opts ...NodeOption) *EnhancedNode {
+	tn.t.Helper()
+	node := tn.newNode(opts...)
+	tn.start(node)
+	return node
+}
+
+// newNode creates a node on the network without starting it, for tests that change it first.
+// Options after the first replace the memory transport or add to it.
+func (tn *testNetwork) newNode(opts ...NodeOption) *EnhancedNode {
+	tn.t.Helper()
+	return tn.newNodeWithKey(len(tn.nodes), opts...)
+}
+
+// newNodeWithKey creates a node like newNode, with the index'th test key rather than the next one,
+// for tests of two nodes holding the same key
+func (tn *testNetwork) newNodeWithKey(index int, opts ...NodeOption) *EnhancedNode {
+	tn.t.Helper()
+	dataDir := tn.t.TempDir()
+	testKeys(tn.t, index, dataDir)
+
+	opts = append([]NodeOption{WithTransport(tn.network)}, opts...)
+	node, err := NewEnhancedNode(memoryHost+":0", true, dataDir, opts...)
+	if err != nil {
+		tn.t.Fatalf("creating node: %v", err)
+	}
+	node.headless = true
+	node.uiChannel = nil
+	node.fileManager.autoAccept = true
+	tn.nodes = append(tn.nodes, node)
+	return node
+}
+
+// start runs a node until the test ends
+func (tn *testNetwork) start(node *EnhancedNode) {
+	done := make(chan struct{})
+	go func() {
+		node.StartEnhanced()
+		close(done)
+	}()
+	tn.t.Cleanup(func() {
+		go node.shutdown()
+		select {
+		case <-done:
+		case <-time.After(testWait):
+			tn.t.Errorf("node %s didn't shut down", node.ID)
+		}
+	})
+}
+
+// connect has from dial to, and waits until each holds the other's key
+func (tn *testNetwork) connect(from, to *EnhancedNode) {
+	tn.t.Helper()
+	from.connectToPeer(to.ID)
+	waitForKeys(tn.t, from, to)
+}
+
+// connectedPair starts two nodes and connects the first to the second
+func connectedPair(t testing.TB, opts ...NodeOption) (tn *testNetwork, a, b *EnhancedNode) {
+	t.Helper()
+	tn = newTestNetwork(t, 2, opts...)
+	a, b = tn.nodes[0], tn.nodes[1]
+	tn.connect(a, b)
+	return tn, a, b
+}
+
+// chain connects each node to the next
+func (tn *testNetwork) chain() {
+	tn.t.Helper()
+	for i := 1; i < len(tn.nodes); i++ {
+		tn.connect(tn.nodes[i-1], tn.nodes[i])
+	}
+}
+
+// waitForKeys waits until a and b each hold the other's key
+func waitForKeys(t testing.TB, a, b *EnhancedNode) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%s and %s to exchange keys", a.ID, b.ID), func() bool {
+		return a.cryptoManager.HasPeerKey(b.ID) && b.cryptoManager.HasPeerKey(a.ID)
+	})
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within testWait
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// loggedTexts returns the text of every message a node has shown from sender
+func loggedTexts(node *EnhancedNode, sender string) []string {
+	var texts []string
+	for _, msg := range node.messageLog.Since(0) {
+		if msg.SenderID == sender {
+			texts = append(texts, msg.Content)
+		}
+	}
+	return texts
+}
+
+// waitForText waits until node has shown text from sender
+func waitForText(t testing.TB, node *EnhancedNode, sender, text string) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%s to show %q from %s", node.ID, text, sender), func() bool {
+		return slices.Contains(loggedTexts(node, sender), text)
+	})
+}
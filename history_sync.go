@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	historySyncMaxMessages = 200                   // Most messages sent in one backfill
+	historySyncMaxAge      = 24 * time.Hour        // Older messages are never backfilled
+	historySyncBatchBytes  = 16 * 1024             // Text per backfill frame, well under the 64KB line limit
+	historySyncBatchDelay  = 50 * time.Millisecond // Pause between frames so the peer's send queue drains
+)
+
+// historySyncRequest is the plaintext of an encrypted "sync" message: the newest sequence number
+// the requester has from each sender
+type historySyncRequest struct {
+	Known map[string]uint64 `json:"known"`
+}
+
+// backfillMessage is one message from the responder's history
+type backfillMessage struct {
+	Sender    string    `json:"sender"`
+	Text      string    `json:"text"`
+	Lamport   uint64    `json:"lamport"`
+	Seq       uint64    `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    bool      `json:"action,omitempty"`
+}
+
+// historyBackfill is the plaintext of an encrypted "backfill" message
+type historyBackfill struct {
+	Messages []backfillMessage `json:"messages"`
+}
+
+// requestHistory asks a peer for broadcast messages newer than the ones we have
+func (en *EnhancedNode) requestHistory(peerID string) {
+	data, err := json.Marshal(historySyncRequest{Known: en.clock.Known(en.ID)})
+	if err != nil {
+		log.Printf("Failed to serialize history request: %v", err)
+		return
+	}
+
+	if err := en.sendEncryptedTo(peerID, data, "sync"); err != nil {
+		log.Printf("Failed to request history from %s: %v", peerID, err)
+	}
+}
+
+// handleHistorySyncRequest answers a peer's sync request from our message log.
+// Only broadcast messages are eligible, so direct messages never reach third parties,
+// and ephemeral messages are never replayed.
+func (en *EnhancedNode) handleHistorySyncRequest(senderID string, plaintext []byte) {
+	if !en.historySync {
+		return
+	}
+
+	var req historySyncRequest
+	if err := json.Unmarshal(plaintext, &req); err != nil {
+		log.Printf("Invalid history request from %s: %v", senderID, err)
+		return
+	}
+
+	cutoff := time.Now().Add(-historySyncMaxAge)
+	var pending []backfillMessage
+	for _, entry := range en.messageLog.Since(0) {
+		if entry.Seq == 0 || entry.Lamport == 0 || entry.ExpiresAt != nil || entry.Timestamp.Before(cutoff) {
+			continue
+		}
+		if entry.Seq <= req.Known[entry.SenderID] {
+			continue
+		}
+		pending = append(pending, backfillMessage{
+			Sender:    entry.SenderID,
+			Text:      truncateJSONText(entry.Content, textPartBytes), // Long texts aren't sent in parts here
+			Lamport:   entry.Lamport,
+			Seq:       entry.Seq,
+			Timestamp: entry.Timestamp,
+			Action:    entry.Action,
+		})
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	// Keep the most recent messages
+	if len(pending) > historySyncMaxMessages {
+		pending = pending[len(pending)-historySyncMaxMessages:]
+	}
+
+	en.wg.Add(1)
+	go en.sendBackfill(senderID, pending)
+}
+
+// sendBackfill sends messages to a peer in frames of at most historySyncBatchBytes of text, as
+// escaped in JSON
+func (en *EnhancedNode) sendBackfill(peerID string, messages []backfillMessage) {
+	defer en.wg.Done()
+
+	for len(messages) > 0 {
+		size := 0
+		n := 0
+		for n < len(messages) && (n == 0 || size+jsonTextLen(messages[n].Text) <= historySyncBatchBytes) {
+			size += jsonTextLen(messages[n].Text)
+			n++
+		}
+
+		data, err := json.Marshal(historyBackfill{Messages: messages[:n]})
+		if err != nil {
+			log.Printf("Failed to serialize backfill: %v", err)
+			return
+		}
+		if err := en.sendEncryptedTo(peerID, data, "backfill"); err != nil {
+			log.Printf("Failed to send backfill to %s: %v", peerID, err)
+			return
+		}
+		messages = messages[n:]
+
+		select {
+		case <-time.After(historySyncBatchDelay):
+		case <-en.Shutdown:
+			return
+		}
+	}
+}
+
+// handleHistoryBackfill inserts messages received from a peer's history, skipping ones we already have.
+// Nothing vouches for who wrote a backfilled message but the peer that sent it, so each is shown
+// as that peer's, quoting the sender it names when that is someone else.
+func (en *EnhancedNode) handleHistoryBackfill(senderID string, plaintext []byte) {
+	if !en.historySync {
+		return
+	}
+
+	var backfill historyBackfill
+	if err := json.Unmarshal(plaintext, &backfill); err != nil {
+		log.Printf("Invalid backfill from %s: %v", senderID, err)
+		return
+	}
+
+	added := 0
+	for _, m := range backfill.Messages {
+		if m.Seq == 0 || !en.clock.Advance(en.ID, m.Sender, m.Seq) {
+			continue
+		}
+		en.clock.Witness(m.Lamport)
+		if en.shouldSuppress(m.Sender, m.Text) || en.shouldSuppress(senderID, m.Text) {
+			continue
+		}
+
+		// A quoted message keeps no sequence number, so it is never backfilled on as the peer's
+		text, action, seq := m.Text, m.Action, m.Seq
+		if m.Sender != senderID {
+			text, action, seq = relayedText(m), false, 0
+		}
+		en.notifyUI(Message{
+			SenderID:  senderID,
+			Content:   []byte(text),
+			Lamport:   m.Lamport,
+			Seq:       seq,
+			Timestamp: m.Timestamp,
+			Backfill:  true,
+			Mention:   en.mentions.Matches(m.Text),
+			Action:    action,
+		})
+		added++
+	}
+
+	if added > 0 {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("📜 Synced %d message(s) from %s", added, senderID)),
+		})
+	}
+}
+
+// relayedText is how a backfilled message from someone other than the peer that sent it reads
+// when shown as that peer's: "<sender> text", or "* sender text" for an action
+func relayedText(m backfillMessage) string {
+	if m.Action {
+		return fmt.Sprintf("* %s %s", m.Sender, m.Text)
+	}
+	return fmt.Sprintf("<%s> %s", m.Sender, m.Text)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestHistoryBackfillAttribution shows a backfill as the sending peer's, quoting the senders it
+// names for other people's messages instead of speaking for them
+func TestHistoryBackfillAttribution(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	node := tn.nodes[0]
+	node.historySync = true
+
+	const relay, other = "127.0.0.1:9001", "127.0.0.1:9002"
+	now := time.Now()
+	data, err := json.Marshal(historyBackfill{Messages: []backfillMessage{
+		{Sender: relay, Text: "my own words", Lamport: 1, Seq: 1, Timestamp: now},
+		{Sender: other, Text: "I owe the relay money", Lamport: 2, Seq: 1, Timestamp: now},
+		{Sender: other, Text: "waves", Lamport: 3, Seq: 2, Timestamp: now, Action: true},
+		{Sender: other, Text: "said twice", Lamport: 4, Seq: 2, Timestamp: now}, // Not newer
+		{Sender: node.ID, Text: "words put in my mouth", Lamport: 5, Seq: 7, Timestamp: now},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.handleHistoryBackfill(relay, data)
+
+	want := []string{
+		"my own words",
+		"<" + other + "> I owe the relay money",
+		"* " + other + " waves",
+		"<" + node.ID + "> words put in my mouth",
+	}
+	if got := loggedTexts(node, relay); !slices.Equal(got, want) {
+		t.Errorf("shown from the relay: %q, want %q", got, want)
+	}
+	for _, sender := range []string{other, node.ID} {
+		if got := loggedTexts(node, sender); len(got) != 0 {
+			t.Errorf("shown as %s's own: %q", sender, got)
+		}
+	}
+
+	// Only the relay's own message keeps its sequence number, so quoted ones are never passed on
+	for _, entry := range node.messageLog.Since(0) {
+		if entry.SenderID != relay {
+			continue
+		}
+		if quoted := entry.Content != "my own words"; quoted == (entry.Seq != 0) || entry.Action || !entry.Backfill {
+			t.Errorf("logged %q with seq %d, action %v, backfill %v", entry.Content, entry.Seq, entry.Action, entry.Backfill)
+		}
+	}
+}
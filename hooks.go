@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxConcurrentHooks   = 4               // Hook runs in flight; further matches are dropped
+	defaultHookTimeout   = 5 * time.Second // Hook timeout if not configured
+	defaultHookMaxOutput = 4096            // Exec hook output cap in bytes if not configured
+	execHookPrefix       = "exec:"         // Names of the hooks from the config file start with this
+)
+
+// HookEvent is the message a hook is responding to
+type HookEvent struct {
+	SenderID  string
+	MessageID string
+	Text      string
+}
+
+// HookHandler handles a matching message. A non-empty reply is sent back to the sender.
+type HookHandler func(ctx context.Context, event HookEvent) (string, error)
+
+// ExecHookConfig configures a hook that runs a command with the message on stdin
+type ExecHookConfig struct {
+	Pattern   string   `json:"pattern"`              // Regular expression matched against the message text
+	Command   []string `json:"command"`              // Program and arguments (run directly, not through a shell)
+	Timeout   string   `json:"timeout,omitempty"`    // e.g. "5s"
+	MaxOutput int      `json:"max_output,omitempty"` // Bytes of stdout sent back; the rest is discarded
+}
+
+type hook struct {
+	name    string
+	pattern *regexp.Regexp
+	handler HookHandler
+	timeout time.Duration
+}
+
+// HookRegistry holds message hooks and runs them off the event loop
+type HookRegistry struct {
+	hooks     []hook
+	hooksLock sync.RWMutex
+	slots     chan struct{}
+}
+
+// NewHookRegistry creates an empty hook registry
+func NewHookRegistry() *HookRegistry {
+	return &HookRegistry{
+		slots: make(chan struct{}, maxConcurrentHooks),
+	}
+}
+
+// newHook compiles a hook's pattern
+func newHook(name, pattern string, timeout time.Duration, handler HookHandler) (hook, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return hook{}, fmt.Errorf("invalid pattern for hook %s: %w", name, err)
+	}
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	return hook{name: name, pattern: re, handler: handler, timeout: timeout}, nil
+}
+
+// Register adds a handler for messages matching pattern
+func (hr *HookRegistry) Register(name, pattern string, timeout time.Duration, handler HookHandler) error {
+	h, err := newHook(name, pattern, timeout, handler)
+	if err != nil {
+		return err
+	}
+
+	hr.hooksLock.Lock()
+	hr.hooks = append(hr.hooks, h)
+	hr.hooksLock.Unlock()
+	return nil
+}
+
+// replace swaps the hooks whose names start with prefix for hooks, keeping the others
+func (hr *HookRegistry) replace(prefix string, hooks []hook) {
+	hr.hooksLock.Lock()
+	defer hr.hooksLock.Unlock()
+
+	kept := slices.DeleteFunc(hr.hooks, func(h hook) bool { return strings.HasPrefix(h.name, prefix) })
+	hr.hooks = append(kept, hooks...)
+}
+
+// matching returns the hooks whose pattern matches text
+func (hr *HookRegistry) matching(text string) []hook {
+	hr.hooksLock.RLock()
+	defer hr.hooksLock.RUnlock()
+
+	var matched []hook
+	for _, h := range hr.hooks {
+		if h.pattern.MatchString(text) {
+			matched = append(matched, h)
+		}
+	}
+	return matched
+}
+
+// runHooks starts every hook matching a received message; it never blocks the event loop
+func (en *EnhancedNode) runHooks(event HookEvent) {
+	// Never respond to ourselves, or a reply could trigger another round
+	if event.SenderID == en.ID {
+		return
+	}
+
+	for _, h := range en.hooks.matching(event.Text) {
+		select {
+		case en.hooks.slots <- struct{}{}:
+		default:
+			log.Printf("Hook %s skipped for %s: too many hooks running", h.name, event.SenderID)
+			continue
+		}
+
+		en.wg.Add(1)
+		go en.runHook(h, event)
+	}
+}
+
+func (en *EnhancedNode) runHook(h hook, event HookEvent) {
+	defer en.wg.Done()
+	defer func() { <-en.hooks.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	// Abort the hook if the node shuts down first
+	go func() {
+		select {
+		case <-en.Shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	reply, err := h.handler(ctx, event)
+	if err != nil {
+		log.Printf("Hook %s failed for %s: %v", h.name, event.SenderID, err)
+		return
+	}
+
+	reply = strings.TrimRight(reply, "\n")
+	if reply == "" {
+		return
+	}
+
+	if _, err := en.SendEncryptedTextTo(event.SenderID, reply); err != nil {
+		log.Printf("Hook %s could not reply to %s: %v", h.name, event.SenderID, err)
+		return
+	}
+
+	en.notifyUI(Message{
+		SenderID: en.ID,
+		Content:  []byte(fmt.Sprintf("🤖 [%s → %s] %s", h.name, event.SenderID, reply)),
+	})
+}
+
+// registerBuiltinHooks adds the hooks every node answers
+func (en *EnhancedNode) registerBuiltinHooks() {
+	en.hooks.Register("ping", `^!ping$`, 0, func(ctx context.Context, event HookEvent) (string, error) {
+		return "pong", nil
+	})
+}
+
+// registerExecHooks replaces the exec hooks with those from the config file. If one of them is
+// invalid none is registered and the ones before stay.
+func (en *EnhancedNode) registerExecHooks(configs []ExecHookConfig) error {
+	hooks, err := execHooks(configs)
+	if err != nil {
+		return err
+	}
+	en.hooks.replace(execHookPrefix, hooks)
+	for _, h := range hooks {
+		log.Printf("Registered hook %s for /%s/", h.name, h.pattern)
+	}
+	return nil
+}
+
+// execHooks builds the hooks the config file describes, without registering them
+func execHooks(configs []ExecHookConfig) ([]hook, error) {
+	hooks := make([]hook, 0, len(configs))
+	for i, cfg := range configs {
+		if len(cfg.Command) == 0 {
+			return nil, fmt.Errorf("hook %d: command is required", i)
+		}
+
+		var timeout time.Duration
+		if cfg.Timeout != "" {
+			parsed, err := time.ParseDuration(cfg.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("hook %d: invalid timeout: %w", i, err)
+			}
+			timeout = parsed
+		}
+
+		maxOutput := cfg.MaxOutput
+		if maxOutput <= 0 {
+			maxOutput = defaultHookMaxOutput
+		}
+
+		h, err := newHook(execHookPrefix+cfg.Command[0], cfg.Pattern, timeout, execHook(cfg.Command, maxOutput))
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// execHook returns a handler that runs command with the message text on stdin and replies with its stdout
+func execHook(command []string, maxOutput int) HookHandler {
+	return func(ctx context.Context, event HookEvent) (string, error) {
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stdin = strings.NewReader(event.Text)
+		cmd.Env = append(os.Environ(),
+			"P2PCHAT_SENDER="+event.SenderID,
+			"P2PCHAT_MESSAGE_ID="+event.MessageID,
+		)
+
+		var stdout cappedBuffer
+		stdout.limit = maxOutput
+		cmd.Stdout = &stdout
+
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return "", fmt.Errorf("timed out: %w", ctx.Err())
+			}
+			return "", err
+		}
+
+		if stdout.truncated {
+			log.Printf("Hook %s output truncated to %d bytes", command[0], maxOutput)
+		}
+		return stdout.String(), nil
+	}
+}
+
+// cappedBuffer keeps the first limit bytes written and silently discards the rest. The buffer
+// isn't embedded: its ReadFrom would be promoted, and io.Copy would use it to bypass Write.
+type cappedBuffer struct {
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	if room := cb.limit - cb.buffer.Len(); room < len(p) {
+		cb.truncated = true
+		if room > 0 {
+			cb.buffer.Write(p[:room])
+		}
+		// Report the full length so the command isn't killed by a short write
+		return len(p), nil
+	}
+	return cb.buffer.Write(p)
+}
+
+// String returns what was kept
+func (cb *cappedBuffer) String() string {
+	return cb.buffer.String()
+}
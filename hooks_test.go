@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestExecHook runs commands directly, with the message on stdin and the sender in the
+// environment, cutting their output short and killing them at the timeout
+func TestExecHook(t *testing.T) {
+	event := HookEvent{SenderID: "alice", MessageID: "m1", Text: "$(touch pwned); echo injected"}
+
+	for _, tc := range []struct {
+		name      string
+		command   []string
+		maxOutput int
+		timeout   time.Duration
+		want      string // Reply, or what the error says when it starts with "error: "
+	}{
+		// Without a shell the arguments and stdin reach the program exactly as given
+		{"arguments", []string{"echo", "$HOME", "`id`", ";", "ls"}, 100, time.Second, "$HOME `id` ; ls\n"},
+		{"stdin", []string{"cat"}, 100, time.Second, event.Text},
+		{"environment", []string{"printenv", "P2PCHAT_SENDER", "P2PCHAT_MESSAGE_ID"}, 100, time.Second, "alice\nm1\n"},
+		{"output cap", []string{"head", "-c", "100000", "/dev/zero"}, 16, time.Second, strings.Repeat("\x00", 16)},
+		{"failure", []string{"false"}, 100, time.Second, "error: exit status 1"},
+		{"missing program", []string{"no-such-hook-program"}, 100, time.Second, "error: not found"},
+		{"timeout", []string{"sleep", "10"}, 100, 50 * time.Millisecond, "error: timed out"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+
+			start := time.Now()
+			reply, err := execHook(tc.command, tc.maxOutput)(ctx, event)
+			if elapsed := time.Since(start); elapsed > tc.timeout+2*time.Second {
+				t.Errorf("hook ran for %v", elapsed)
+			}
+			if want, isErr := strings.CutPrefix(tc.want, "error: "); isErr {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("error %v, want one saying %q", err, want)
+				}
+			} else if err != nil || reply != tc.want {
+				t.Errorf("reply %q, %v; want %q", reply, err, tc.want)
+			}
+		})
+	}
+}
+
+// TestExecHooksConfig builds hooks from the config file, refusing invalid ones
+func TestExecHooksConfig(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	node := tn.nodes[0]
+
+	if err := node.registerExecHooks([]ExecHookConfig{{Pattern: "^!echo", Command: []string{"cat"}}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		configs []ExecHookConfig
+		wantErr string
+	}{
+		{"no command", []ExecHookConfig{{Pattern: "x"}}, "command is required"},
+		{"bad pattern", []ExecHookConfig{{Pattern: "(", Command: []string{"cat"}}}, "invalid pattern"},
+		{"bad timeout", []ExecHookConfig{{Pattern: "x", Command: []string{"cat"}, Timeout: "soon"}}, "invalid timeout"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := node.registerExecHooks(tc.configs)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error %v, want one saying %q", err, tc.wantErr)
+			}
+		})
+	}
+	if hooks := node.hooks.matching("!echo hi"); len(hooks) != 1 || hooks[0].name != "exec:cat" {
+		t.Errorf("after invalid configs, !echo matches %v", hooks)
+	}
+}
+
+// TestHooksReply has a node answer !ping and exec hooks to the sender, but never its own messages
+func TestHooksReply(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	if err := a.registerExecHooks([]ExecHookConfig{{Pattern: "^!echo ", Command: []string{"cat"}}}); err != nil {
+		t.Fatal(err)
+	}
+	tn.connect(a, b)
+
+	if err := b.SendTextAndConfirm(a.ID, "!ping", testWait); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, a.ID, "pong")
+	if err := b.SendTextAndConfirm(a.ID, "!echo back to you", testWait); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, a.ID, "!echo back to you")
+
+	// A hook takes its slot before runHooks returns
+	a.runHooks(HookEvent{SenderID: a.ID, Text: "!ping"})
+	if taken := len(a.hooks.slots); taken != 0 {
+		t.Errorf("%d hooks started for the node's own message", taken)
+	}
+}
+
+// TestHookConcurrencyLimit has a peer send more matching messages than hooks may run at once: the
+// extra ones are dropped rather than queued, and hooks run again once a slot is free
+func TestHookConcurrencyLimit(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	release := make(chan struct{})
+	var running, ran atomic.Int32
+	a.hooks.Register("slow", "^slow", 0, func(ctx context.Context, event HookEvent) (string, error) {
+		ran.Add(1)
+		running.Add(1)
+		defer running.Add(-1)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return "", nil
+	})
+	tn.connect(a, b)
+
+	send := func(text string) {
+		t.Helper()
+		if err := b.SendTextAndConfirm(a.ID, text, testWait); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range maxConcurrentHooks {
+		send(fmt.Sprintf("slow %d", i))
+	}
+	waitFor(t, "every hook slot to be taken", func() bool { return running.Load() == maxConcurrentHooks })
+
+	send("slow, dropped")
+	send("slow, dropped too")
+	// Messages are handled in order, so hooks for the ones before this have been started or dropped
+	send("not a hook")
+	waitForText(t, a, b.ID, "not a hook")
+	if got := ran.Load(); got != maxConcurrentHooks {
+		t.Errorf("%d hooks ran with every slot taken, want %d", got, maxConcurrentHooks)
+	}
+
+	close(release)
+	waitFor(t, "the hooks to free their slots", func() bool { return len(a.hooks.slots) == 0 })
+	send("slow again")
+	waitFor(t, "a hook to run once slots were free", func() bool { return ran.Load() == maxConcurrentHooks+1 })
+}
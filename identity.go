@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A peer's identity is the fingerprint of its key. Its node ID (listen address) and connection ID
+// only say where it can be reached, and change when it moves networks; what the user decides about
+// a peer (contacts, mutes, reputation, notification levels) is kept by fingerprint, with the last
+// node ID alongside for display and for entries saved before the key was known.
+
+// peerFingerprint returns the fingerprint of the key held for a node ID, or "" if none is
+func (n *Node) peerFingerprint(nodeID string) string {
+	if nodeID == n.ID {
+		return n.cryptoManager.Fingerprint()
+	}
+	fingerprint, _ := n.cryptoManager.PeerFingerprint(nodeID)
+	return fingerprint
+}
+
+// keySeen moves what is kept by fingerprint along when a key is accepted from a node ID, and pins
+// entries saved by node ID before the key was known
+func (en *EnhancedNode) keySeen(nodeID, fingerprint string) {
+	if err := en.muteList.Seen(nodeID, fingerprint); err != nil {
+		log.Printf("Failed to save mute list: %v", err)
+	}
+}
+
+// knownPeer is a node we have heard of: where it was last seen, and whether it can be reached there
+type knownPeer struct {
+	Addr      string // Node ID or address it was last seen at
+	Reachable bool   // False once a discovered address fails redialAttempts dials
+}
+
+// ownKey is our key in KnownPeers: our fingerprint, or our node ID when running without keys
+func (n *Node) ownKey() string {
+	if n.cryptoManager == nil {
+		return n.ID
+	}
+	return n.cryptoManager.Fingerprint()
+}
+
+// nodeID returns the node ID a connection goes by, or "" until its handshake or a frame says
+func (p *Peer) nodeID() string {
+	if id := p.node.Load(); id != nil {
+		return *id
+	}
+	return ""
+}
+
+func (p *Peer) setNodeID(id string) {
+	p.node.Store(&id)
+}
+
+// notePeerNode records the node ID a connection's frames carry. Frames naming any other sender
+// than the one an authenticated connection proved were already dropped (spoofedSender).
+func (n *Node) notePeerNode(connID, nodeID string) {
+	n.peersMutex.RLock()
+	peer := n.conns[connID]
+	n.peersMutex.RUnlock()
+	if peer != nil && peer.nodeID() != nodeID {
+		peer.setNodeID(nodeID)
+	}
+}
+
+// identifyPeer rekeys a connection by the key its node sent in a key exchange, and reports whether
+// the connection now goes by that key. Over a legacy connection the claim isn't proven, so one
+// naming a key another connection already goes by is left under its connection ID rather than
+// taken for that node.
+func (n *Node) identifyPeer(connID, nodeID, fingerprint string) bool {
+	n.peersMutex.Lock()
+	peer := n.conns[connID]
+	if peer == nil {
+		n.peersMutex.Unlock()
+		return false
+	}
+	if other := n.Peers[fingerprint]; other != nil && other != peer {
+		n.peersMutex.Unlock()
+		log.Printf("Connection %s sent the key of %s, which is connected as %s; not taken for it", connID, nodeID, other.ID)
+		return false
+	}
+	delete(n.Peers, peer.key)
+	peer.key = fingerprint
+	n.Peers[fingerprint] = peer
+	n.peersMutex.Unlock()
+
+	n.rememberPeer(fingerprint, nodeID, connID)
+	return true
+}
+
+// rememberPeer records that the node with a key was last seen at addr. Entries for addr and the
+// other addresses given, made before the key was known there, are folded into the key's.
+func (n *Node) rememberPeer(key, addr string, earlier ...string) {
+	n.knownMutex.Lock()
+	defer n.knownMutex.Unlock()
+
+	for _, old := range append(earlier, addr) {
+		if entry := n.KnownPeers[old]; entry != nil && old != key && entry.Addr == old {
+			delete(n.KnownPeers, old)
+		}
+	}
+	n.KnownPeers[key] = &knownPeer{Addr: addr, Reachable: true}
+}
+
+// rememberAddr records an address heard of from discovery or gossip, or connected to before its
+// key is known. An address already known, under a key or not, is marked reachable again.
+func (n *Node) rememberAddr(addr string) {
+	n.knownMutex.Lock()
+	defer n.knownMutex.Unlock()
+
+	if entry := n.knownAt(addr); entry != nil {
+		entry.Reachable = true
+		return
+	}
+	n.KnownPeers[addr] = &knownPeer{Addr: addr, Reachable: true}
+}
+
+// markUnreachable records that a discovered address failed every dial
+func (n *Node) markUnreachable(addr string) {
+	n.knownMutex.Lock()
+	defer n.knownMutex.Unlock()
+
+	if entry := n.knownAt(addr); entry != nil {
+		entry.Reachable = false
+		return
+	}
+	n.KnownPeers[addr] = &knownPeer{Addr: addr}
+}
+
+// knownAddr reports whether a node was last seen at addr
+func (n *Node) knownAddr(addr string) bool {
+	n.knownMutex.RLock()
+	defer n.knownMutex.RUnlock()
+	return n.knownAt(addr) != nil
+}
+
+// knownAt returns the entry of the node last seen at addr, or nil; the caller must hold knownMutex
+func (n *Node) knownAt(addr string) *knownPeer {
+	if entry := n.KnownPeers[addr]; entry != nil {
+		return entry
+	}
+	for _, entry := range n.KnownPeers {
+		if entry.Addr == addr {
+			return entry
+		}
+	}
+	return nil
+}
+
+// dataMigration rewrites a file older versions saved by node ID, given the keys contacts were
+// last seen with at each node ID. It reports false for a file already in the current format.
+type dataMigration func(data []byte, keys map[string]string) ([]byte, bool, error)
+
+// dataMigrations are the files in the data dir that kept peers by node ID before peers were known
+// by key
+var dataMigrations = map[string]dataMigration{
+	muteListFile:      migrateMuteList,
+	conversationsFile: migrateConversations,
+}
+
+// migrateDataDir brings the files of an older version in dataDir up to date, before they are
+// loaded. A node ID a contact was last seen at is pinned to the contact's key straight away; the
+// others match by node ID until a key is seen from it (keySeen).
+func migrateDataDir(dataDir string) error {
+	keys := make(map[string]string) // Node ID -> fingerprint
+	if data, err := os.ReadFile(filepath.Join(dataDir, contactsFile)); err == nil {
+		var contacts []Contact
+		if json.Unmarshal(data, &contacts) == nil {
+			for _, contact := range contacts {
+				if contact.NodeID != "" && contact.Fingerprint != "" {
+					keys[contact.NodeID] = contact.Fingerprint
+				}
+			}
+		}
+	}
+
+	for file, migrate := range dataMigrations {
+		path := filepath.Join(dataDir, file)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		migrated, changed, err := migrate(data, keys)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", path, err)
+		}
+		if !changed {
+			continue
+		}
+		if err := os.WriteFile(path, migrated, 0600); err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", path, err)
+		}
+		log.Printf("Migrated %s to keep peers by key", path)
+	}
+	return nil
+}
+
+// migrateMuteList turns a list of muted node IDs into mutedPeer entries
+func migrateMuteList(data []byte, keys map[string]string) ([]byte, bool, error) {
+	var nodeIDs []string
+	if json.Unmarshal(data, &nodeIDs) != nil {
+		return data, false, nil
+	}
+	muted := make([]mutedPeer, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		muted = append(muted, mutedPeer{Fingerprint: keys[nodeID], NodeID: nodeID})
+	}
+	migrated, err := json.MarshalIndent(muted, "", "  ")
+	return migrated, true, err
+}
+
+// migrateConversations turns a list of the node IDs of open DM tabs into savedConversation entries
+func migrateConversations(data []byte, keys map[string]string) ([]byte, bool, error) {
+	var peers []string
+	if json.Unmarshal(data, &peers) != nil {
+		return data, false, nil
+	}
+	saved := make([]savedConversation, 0, len(peers))
+	for _, peer := range peers {
+		saved = append(saved, savedConversation{Peer: peer, Key: keys[peer]})
+	}
+	migrated, err := json.MarshalIndent(saved, "", "  ")
+	return migrated, true, err
+}
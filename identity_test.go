@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// peerByKey returns the connection a node has registered under a key fingerprint, or nil
+func peerByKey(node *EnhancedNode, fingerprint string) *Peer {
+	node.peersMutex.RLock()
+	defer node.peersMutex.RUnlock()
+	return node.Peers[fingerprint]
+}
+
+// knownEntries returns every KnownPeers entry of node for addr, by the key it is kept under
+func knownEntries(node *EnhancedNode, addr string) map[string]knownPeer {
+	node.knownMutex.RLock()
+	defer node.knownMutex.RUnlock()
+	entries := make(map[string]knownPeer)
+	for key, entry := range node.KnownPeers {
+		if key == addr || entry.Addr == addr {
+			entries[key] = *entry
+		}
+	}
+	return entries
+}
+
+// TestPeersKeyedByFingerprint registers an authenticated connection under its key, and finds it
+// by connection ID, node ID or fingerprint
+func TestPeersKeyedByFingerprint(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	fingerprint := b.cryptoManager.Fingerprint()
+
+	// Heard of by address first, as discovery would; the entry moves under the key on connecting
+	a.rememberAddr(b.ID)
+	tn.connect(a, b)
+	waitFor(t, "a to key b's connection by fingerprint", func() bool { return peerByKey(a, fingerprint) != nil })
+
+	peer := peerByKey(a, fingerprint)
+	for _, ref := range []string{peer.ID, b.ID, fingerprint} {
+		connID, nodeID, err := a.resolvePeer(ref)
+		if err != nil {
+			t.Errorf("resolvePeer(%s): %v", ref, err)
+			continue
+		}
+		if connID != peer.ID || nodeID != b.ID {
+			t.Errorf("resolvePeer(%s) = %s, %s; want %s, %s", ref, connID, nodeID, peer.ID, b.ID)
+		}
+	}
+
+	entries := knownEntries(a, b.ID)
+	if entry, ok := entries[fingerprint]; len(entries) != 1 || !ok || entry.Addr != b.ID || !entry.Reachable {
+		t.Errorf("a knows b's address as %v, want one reachable entry under %s", entries, fingerprint)
+	}
+	if !a.knownAddr(b.ID) {
+		t.Error("knownAddr doesn't find b's address under its key")
+	}
+}
+
+// TestPeerReturnsFromNewAddress has a peer come back with the same key at another address: the
+// new connection takes the key's place, and the old address is forgotten
+func TestPeerReturnsFromNewAddress(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	fingerprint := b.cryptoManager.Fingerprint()
+	tn.connect(a, b)
+
+	if !b.shutdownWithin(testWait) {
+		t.Fatal("b didn't shut down")
+	}
+	waitFor(t, "a to drop b", func() bool { return peerByKey(a, fingerprint) == nil })
+
+	// The same key, listening somewhere else
+	moved := tn.newNodeWithKey(1)
+	tn.start(moved)
+	if moved.ID == b.ID {
+		t.Fatalf("b came back on its old address %s", b.ID)
+	}
+	tn.connect(moved, a)
+	waitFor(t, "a to key the new connection by b's fingerprint", func() bool {
+		peer := peerByKey(a, fingerprint)
+		return peer != nil && peer.nodeID() == moved.ID
+	})
+
+	if _, nodeID, err := a.resolvePeer(fingerprint); err != nil || nodeID != moved.ID {
+		t.Errorf("resolvePeer(fingerprint) = %s, %v; want %s", nodeID, err, moved.ID)
+	}
+	a.knownMutex.RLock()
+	entry := a.KnownPeers[fingerprint]
+	a.knownMutex.RUnlock()
+	if entry == nil || entry.Addr != moved.ID {
+		t.Errorf("a last saw b's key at %v, want %s", entry, moved.ID)
+	}
+	if old := knownEntries(a, b.ID); len(old) != 0 {
+		t.Errorf("a still keeps b's old address apart from its key: %v", old)
+	}
+}
+
+// TestLegacyPeerRekeyedByKeyExchange moves a legacy connection from its connection ID to its key
+// once the key exchange says what that is
+func TestLegacyPeerRekeyedByKeyExchange(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	a, b := tn.newNode(), tn.newNode()
+	a.legacyOnly, b.legacyOnly = true, true
+	tn.start(a)
+	tn.start(b)
+	tn.connect(b, a)
+
+	fingerprint := b.cryptoManager.Fingerprint()
+	waitFor(t, "a to key b's legacy connection by fingerprint", func() bool { return peerByKey(a, fingerprint) != nil })
+	peer := peerByKey(a, fingerprint)
+	if _, ok := peerAuthenticatedConn(peer); ok {
+		t.Fatal("a legacy-only pair negotiated an authenticated connection")
+	}
+	if stale := peerByKey(a, peer.ID); stale != nil {
+		t.Errorf("b's connection is also still kept under its connection ID %s", peer.ID)
+	}
+	if _, nodeID, err := a.resolvePeer(b.ID); err != nil || nodeID != b.ID {
+		t.Errorf("resolvePeer(%s) = %s, %v", b.ID, nodeID, err)
+	}
+}
+
+// TestKeyExchangeClaimingConnectedKey has a second connection claim the key of a node already
+// connected: it is refused and doesn't take the key's place, and messages still go to the node
+func TestKeyExchangeClaimingConnectedKey(t *testing.T) {
+	tn, a, b := connectedPair(t)
+	fingerprint := b.cryptoManager.Fingerprint()
+	waitFor(t, "a to key b's connection by fingerprint", func() bool { return peerByKey(a, fingerprint) != nil })
+	real := peerByKey(a, fingerprint)
+
+	// A legacy connection that goes on to claim b's node ID and key, which it can't prove
+	conn, err := tn.network.Dial(a.ID, testWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "%s%c%s\n", b.ID, delimiter, "hello")
+	var spoofID string
+	waitFor(t, "a to register the second connection", func() bool {
+		for _, peer := range a.snapshotPeers() {
+			if peer != real {
+				spoofID = peer.ID
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(t, "a to take the claimed node ID", func() bool {
+		a.peersMutex.RLock()
+		defer a.peersMutex.RUnlock()
+		peer := a.conns[spoofID]
+		return peer != nil && peer.nodeID() == b.ID
+	})
+
+	keyPEM, err := b.cryptoManager.GetPublicKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b has spoken Noise to a, so the legacy connection announcing its key is refused outright
+	if err := a.handleKeyExchange(spoofID, b.ID, []byte(keyPEM)); err == nil {
+		t.Error("a key that spoke Noise was accepted over a legacy connection")
+	}
+
+	if got := peerByKey(a, fingerprint); got != real {
+		t.Fatalf("b's key went to connection %s, want %s", got.ID, real.ID)
+	}
+	if peerByKey(a, spoofID) == nil {
+		t.Error("the claiming connection is no longer kept under its connection ID")
+	}
+	for range 20 {
+		if connID, _, err := a.resolvePeer(b.ID); err != nil || connID != real.ID {
+			t.Fatalf("resolvePeer(%s) = %s, %v; want b's own connection %s", b.ID, connID, err, real.ID)
+		}
+	}
+}
+
+// TestLegacyMuteListPinnedOnConnect pins a mute of a node ID, migrated from an old mute list, to
+// the key the node turns out to have
+func TestLegacyMuteListPinnedOnConnect(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	b := tn.addNode()
+	a := tn.newNode()
+
+	// muted.json as versions that muted node IDs wrote it
+	if err := os.WriteFile(filepath.Join(a.dataDir, muteListFile), []byte(fmt.Sprintf("[%q]\n", b.ID)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDataDir(a.dataDir); err != nil {
+		t.Fatal(err)
+	}
+	muteList, err := NewMuteList(a.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.muteList = muteList
+	tn.start(a)
+	tn.connect(a, b)
+
+	fingerprint := b.cryptoManager.Fingerprint()
+	waitFor(t, "the mute to be pinned to b's key", func() bool {
+		return a.muteList.IsMuted(memoryHost+":1", fingerprint)
+	})
+	reloaded, err := NewMuteList(a.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.IsMuted(memoryHost+":1", fingerprint) {
+		t.Error("the pinned mute wasn't saved")
+	}
+	if reloaded.IsMuted(b.ID, "another key") {
+		t.Error("a different key at b's old node ID is still muted")
+	}
+}
+
+// TestMigrateDataDir loads the files a version that kept peers by node ID saved, pinning the node
+// IDs contacts were last seen at to their keys
+func TestMigrateDataDir(t *testing.T) {
+	dataDir := t.TempDir()
+	contact, stranger := "198.51.100.1:9000", "198.51.100.2:9000"
+	fingerprint := testCrypto(t, 0).Fingerprint()
+	for file, content := range map[string]string{
+		contactsFile:      fmt.Sprintf(`[{"alias": "bob", "node_id": %q, "fingerprint": %q}]`, contact, fingerprint),
+		muteListFile:      fmt.Sprintf(`[%q, %q]`, contact, stranger),
+		conversationsFile: fmt.Sprintf(`[%q, %q]`, stranger, contact),
+	} {
+		if err := os.WriteFile(filepath.Join(dataDir, file), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateDataDir(dataDir); err != nil {
+		t.Fatal(err)
+	}
+	muteList, err := NewMuteList(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !muteList.IsMuted("203.0.113.1:9000", fingerprint) {
+		t.Error("the contact's mute didn't follow its key to a new node ID")
+	}
+	if !muteList.IsMuted(stranger, "") || !muteList.IsMuted(stranger, "aaaa") {
+		t.Error("the mute of a node ID with no known key was lost")
+	}
+	conversations, err := loadConversations(filepath.Join(dataDir, conversationsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []savedConversation{{Peer: stranger}, {Peer: contact, Key: fingerprint}}
+	if !slices.Equal(conversations, want) {
+		t.Errorf("conversations %+v, want %+v", conversations, want)
+	}
+
+	// Files already in the current format are left alone
+	before, _ := os.ReadFile(filepath.Join(dataDir, muteListFile))
+	if err := migrateDataDir(dataDir); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(filepath.Join(dataDir, muteListFile)); !bytes.Equal(before, after) {
+		t.Errorf("migrating again rewrote the mute list:\n%s\n%s", before, after)
+	}
+
+	// A node started on the old data dir migrates it itself
+	old := t.TempDir()
+	testKeys(t, 1, old)
+	if err := os.WriteFile(filepath.Join(old, muteListFile), []byte(fmt.Sprintf(`[%q]`, stranger)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tn := newTestNetwork(t, 0)
+	node, err := NewEnhancedNode(memoryHost+":0", true, old, WithTransport(tn.network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.start(node)
+	if !node.muteList.IsMuted(stranger, "") {
+		t.Error("the node didn't load the old mute list")
+	}
+}
+
+// TestMigrateDataDirInputs migrates what older versions left in odd states: files left out,
+// contacts with no key, files it can't make sense of, which are left for loading to report
+func TestMigrateDataDirInputs(t *testing.T) {
+	const nodeID = "198.51.100.1:9000"
+	fingerprint := testCrypto(t, 0).Fingerprint()
+	for _, tc := range []struct {
+		name      string
+		files     map[string]string
+		wantMutes string // The mute list after migrating
+	}{
+		{
+			"no contacts",
+			map[string]string{muteListFile: fmt.Sprintf(`[%q]`, nodeID)},
+			fmt.Sprintf(`[{"node_id":%q}]`, nodeID),
+		},
+		{
+			"contact without a key",
+			map[string]string{
+				contactsFile: fmt.Sprintf(`[{"alias": "bob", "node_id": %q}]`, nodeID),
+				muteListFile: fmt.Sprintf(`[%q]`, nodeID),
+			},
+			fmt.Sprintf(`[{"node_id":%q}]`, nodeID),
+		},
+		{
+			"unreadable contacts",
+			map[string]string{contactsFile: "{not json", muteListFile: fmt.Sprintf(`[%q]`, nodeID)},
+			fmt.Sprintf(`[{"node_id":%q}]`, nodeID),
+		},
+		{
+			"contact with a key",
+			map[string]string{
+				contactsFile: fmt.Sprintf(`[{"alias": "bob", "node_id": %q, "fingerprint": %q}]`, nodeID, fingerprint),
+				muteListFile: fmt.Sprintf(`[%q]`, nodeID),
+			},
+			fmt.Sprintf(`[{"fingerprint":%q,"node_id":%q}]`, fingerprint, nodeID),
+		},
+		{"empty mute list", map[string]string{muteListFile: `[]`}, `[]`},
+		{"unreadable mute list", map[string]string{muteListFile: "{not json"}, "{not json"},
+		{"no files", nil, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			for file, content := range tc.files {
+				if err := os.WriteFile(filepath.Join(dataDir, file), []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := migrateDataDir(dataDir); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(dataDir, muteListFile))
+			if tc.wantMutes == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("a mute list appeared: %q, %v", data, err)
+				}
+				return
+			}
+			var got, want bytes.Buffer
+			if json.Compact(&got, data) != nil {
+				got.Write(data)
+			}
+			if json.Compact(&want, []byte(tc.wantMutes)) != nil {
+				want.WriteString(tc.wantMutes)
+			}
+			if got.String() != want.String() {
+				t.Errorf("mute list %s, want %s", got.String(), want.String())
+			}
+		})
+	}
+
+	// A file that can't be read at all stops the node rather than being skipped
+	dataDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dataDir, conversationsFile), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDataDir(dataDir); err == nil {
+		t.Error("migrated a data dir with a conversations file it couldn't read")
+	}
+}
+
+// TestDuplicateConnectionsAgree has both ends of two connections to the same node that came up
+// together keep the same one, whoever dialled each and whatever order each end registered them in
+func TestDuplicateConnectionsAgree(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	now := time.Now()
+
+	// survivor is the connection node keeps of the two, registered in that order
+	survivor := func(node *EnhancedNode, first, second *Peer) *Peer {
+		if node.keepNewer(first, second, now) {
+			return second
+		}
+		return first
+	}
+	for _, dialledByA := range [][2]bool{{true, true}, {false, false}, {true, false}, {false, true}} {
+		// Each connection as a and b see it
+		var atA, atB [2]*Peer
+		for i := range 2 {
+			session := &noiseConn{binding: []byte{byte(i + 1)}}
+			atA[i] = &Peer{ID: fmt.Sprint("a", i), Conn: session, key: b.cryptoManager.Fingerprint(), outbound: dialledByA[i], connectedAt: now}
+			atB[i] = &Peer{ID: fmt.Sprint("b", i), Conn: session, key: a.cryptoManager.Fingerprint(), outbound: !dialledByA[i], connectedAt: now}
+		}
+		index := func(peers [2]*Peer, peer *Peer) int { return slices.Index(peers[:], peer) }
+		for _, aFirst := range []int{0, 1} {
+			for _, bFirst := range []int{0, 1} {
+				keptByA := index(atA, survivor(a, atA[aFirst], atA[1-aFirst]))
+				keptByB := index(atB, survivor(b, atB[bFirst], atB[1-bFirst]))
+				if keptByA != keptByB {
+					t.Errorf("dialled by a %v, registered %d first at a and %d at b: a kept %d, b kept %d",
+						dialledByA, aFirst, bFirst, keptByA, keptByB)
+				}
+			}
+		}
+	}
+
+	// A connection that has been up a while is an old address and gives way either way
+	old := &Peer{Conn: &noiseConn{binding: []byte{1}}, outbound: true, connectedAt: now.Add(-duplicateGrace)}
+	if !a.keepNewer(old, &Peer{Conn: &noiseConn{binding: []byte{2}}, outbound: true}, now) {
+		t.Error("a connection up for the grace period wasn't replaced")
+	}
+}
+
+// TestConcurrentDials has a node dial another several times at once, as discovery, gossip and the
+// user might: only one dial is made, and both ends keep its connection
+func TestConcurrentDials(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := a.connectToPeer(b.ID); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	waitForKeys(t, a, b)
+	if err := a.SendTextAndConfirm(b.ID, "one connection", testWait); err != nil {
+		t.Fatal(err)
+	}
+	if peerCount(a) != 1 || peerCount(b) != 1 {
+		t.Errorf("a has %d connections and b %d, want 1 each", peerCount(a), peerCount(b))
+	}
+	if connectedTo(a, b.ID) != connectedTo(b, a.ID) || !connectedTo(a, b.ID) {
+		t.Error("the ends disagree on the connection")
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // GIF and JPEG decoders for image.Decode
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/term"
+)
+
+const (
+	previewMaxBytes  = 16 << 20 // Received images larger than this get no preview
+	previewMaxPixels = 50e6     // Images with more pixels aren't decoded, whatever their file size
+	previewRows      = 8        // Lines a preview takes in the message view
+	previewMaxCols   = 48       // Widest preview, in cells
+
+	// Cell size assumed when scaling a sixel image to the terminal, which reports only cells
+	sixelCellWidth  = 10
+	sixelCellHeight = 20
+)
+
+// Terminal graphics protocols used to show an image full size
+const (
+	graphicsNone   = ""
+	graphicsKitty  = "kitty"
+	graphicsITerm2 = "iterm2"
+	graphicsSixel  = "sixel"
+)
+
+// previewFormats are the image types sniffed from a file's content that can be previewed
+var previewFormats = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// previewSlot is where an image preview sits in the rendered messages
+type previewSlot struct {
+	line int // First line of the preview
+	path string
+}
+
+// thumbnail is a preview rendered for one message width
+type thumbnail struct {
+	width int
+	lines []string
+}
+
+// isPreviewable reports whether a received file is an image the TUI can preview: small enough, and
+// a PNG, JPEG or GIF going by its content rather than its name
+func isPreviewable(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 || info.Size() > previewMaxBytes {
+		return false
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return previewFormats[http.DetectContentType(head[:n])]
+}
+
+// decodeImage decodes an image file, refusing ones too large to decode safely
+func decodeImage(path string) (image.Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if float64(config.Width)*float64(config.Height) > previewMaxPixels {
+		return nil, fmt.Errorf("image too large (%dx%d)", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// fitImage scales width x height to fit within maxWidth x maxHeight, keeping the aspect ratio
+func fitImage(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := min(float64(maxWidth)/float64(width), float64(maxHeight)/float64(height))
+	return max(int(float64(width)*scale+0.5), 1), max(int(float64(height)*scale+0.5), 1)
+}
+
+// sampleImage averages img down to width x height pixels, looking at no more than 4x4 source
+// pixels for each so large images stay quick
+func sampleImage(img image.Image, width, height int) [][]color.RGBA {
+	bounds := img.Bounds()
+	pixels := make([][]color.RGBA, height)
+	for y := range height {
+		pixels[y] = make([]color.RGBA, width)
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, y0+1)
+		for x := range width {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/width, x0+1)
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy += max((y1-y0)/4, 1) {
+				for sx := x0; sx < x1; sx += max((x1-x0)/4, 1) {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+pr, g+pg, b+pb, a+pa, n+1
+				}
+			}
+			pixels[y][x] = color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(b / n >> 8), uint8(a / n >> 8)}
+		}
+	}
+	return pixels
+}
+
+// blockArt draws pixels with half blocks, two pixel rows to a line: the top pixel is the
+// foreground and the bottom one the background
+func blockArt(pixels [][]color.RGBA, indent string) []string {
+	hex := func(c color.RGBA) lipgloss.Color {
+		return lipgloss.Color(fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B))
+	}
+	var lines []string
+	for y := 0; y < len(pixels); y += 2 {
+		var line strings.Builder
+		line.WriteString(indent)
+		for x, top := range pixels[y] {
+			style := lipgloss.NewStyle().Foreground(hex(top))
+			if y+1 < len(pixels) {
+				style = style.Background(hex(pixels[y+1][x]))
+			}
+			line.WriteString(style.Render("▀"))
+		}
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// renderThumbnail renders an image as block art at most maxCols wide, padded to previewRows lines.
+// A file that can't be decoded gets a line saying why instead.
+func renderThumbnail(path string, maxCols int) []string {
+	var lines []string
+	img, err := decodeImage(path)
+	if err != nil {
+		lines = []string{timestampStyle.Render(fmt.Sprintf("  ⚠️ No preview of %s: %v", filepath.Base(path), err))}
+	} else {
+		bounds := img.Bounds()
+		// Each cell holds two pixels, one above the other, so pixels come out roughly square
+		width, height := fitImage(bounds.Dx(), bounds.Dy(), max(min(maxCols, previewMaxCols), 1), previewRows*2)
+		lines = blockArt(sampleImage(img, width, height), "  ")
+	}
+	for len(lines) < previewRows {
+		lines = append(lines, "")
+	}
+	return lines[:previewRows]
+}
+
+// previewPlaceholder stands in for a preview until it is scrolled into view
+func previewPlaceholder(path string) string {
+	lines := make([]string, previewRows)
+	lines[0] = timestampStyle.Render(fmt.Sprintf("  🖼️ %s: preview loads when scrolled into view", filepath.Base(path)))
+	return strings.Join(lines, "\n")
+}
+
+// writeMessage renders a message onto the end of the view, noting where its preview goes
+func (ui *UI) writeMessage(msg ChatMessage, current bool) {
+	text := ui.renderMessage(msg, current)
+	lines := strings.Count(text, "\n") + 1
+	if msg.Image != "" {
+		ui.previews = append(ui.previews, previewSlot{line: ui.renderedLines + lines - previewRows, path: msg.Image})
+	}
+	ui.rendered.WriteString(text)
+	ui.rendered.WriteString("\n")
+	ui.renderedLines += lines
+}
+
+// previewInView reports whether any of a preview's lines are on screen
+func (ui *UI) previewInView(slot previewSlot) bool {
+	return slot.line+previewRows > ui.viewport.YOffset && slot.line < ui.viewport.YOffset+ui.viewport.Height
+}
+
+// cachedThumbnail returns a preview already rendered for the current width
+func (ui *UI) cachedThumbnail(path string) ([]string, bool) {
+	thumb, found := ui.thumbnails[path]
+	if !found || thumb.width != ui.viewport.Width {
+		return nil, false
+	}
+	return thumb.lines, true
+}
+
+// fillPreviews puts rendered previews in place of their placeholders. Previews are only rendered
+// once they are scrolled into view, then kept.
+func (ui *UI) fillPreviews(content string) string {
+	if len(ui.previews) == 0 {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	for _, slot := range ui.previews {
+		thumb, found := ui.cachedThumbnail(slot.path)
+		if !found {
+			if !ui.previewInView(slot) {
+				continue
+			}
+			thumb = renderThumbnail(slot.path, ui.viewport.Width-4)
+			if ui.thumbnails == nil {
+				ui.thumbnails = make(map[string]thumbnail)
+			}
+			ui.thumbnails[slot.path] = thumbnail{width: ui.viewport.Width, lines: thumb}
+		}
+		if slot.line >= 0 && slot.line+len(thumb) <= len(lines) {
+			copy(lines[slot.line:], thumb)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// loadVisiblePreviews redraws the view when a preview that hasn't been rendered yet scrolls into it
+func (ui *UI) loadVisiblePreviews() {
+	if ui.showHelp {
+		return
+	}
+	for _, slot := range ui.previews {
+		if _, found := ui.cachedThumbnail(slot.path); !found && ui.previewInView(slot) {
+			ui.showViewport()
+			return
+		}
+	}
+}
+
+// visibleImage is the newest image whose preview is on screen
+func (ui *UI) visibleImage() (string, bool) {
+	for i := len(ui.previews) - 1; i >= 0; i-- {
+		if ui.previewInView(ui.previews[i]) {
+			return ui.previews[i].path, true
+		}
+	}
+	return "", false
+}
+
+// handleImageKey handles the keys for the image on screen while the messages have focus: v shows
+// it full size in the terminal and o opens it with the system's viewer
+func (ui *UI) handleImageKey(msg tea.KeyMsg) (bool, tea.Cmd) {
+	if msg.String() != "v" && msg.String() != "o" {
+		return false, nil
+	}
+	path, found := ui.visibleImage()
+	if !found {
+		return false, nil
+	}
+
+	if msg.String() == "o" {
+		if err := openExternally(path); err != nil {
+			ui.notice(fmt.Sprintf("❌ %v", err))
+		}
+		return true, nil
+	}
+	viewer := &imageViewer{path: path, protocol: ui.graphics}
+	return true, tea.Exec(viewer, func(err error) tea.Msg {
+		return imageViewerDoneMsg{err: err}
+	})
+}
+
+// imageViewerDoneMsg is sent when the full-size image view is closed
+type imageViewerDoneMsg struct {
+	err error
+}
+
+// detectGraphics guesses which graphics protocol the terminal speaks from its environment
+func detectGraphics() string {
+	termName := os.Getenv("TERM")
+	termProgram := os.Getenv("TERM_PROGRAM")
+	switch {
+	case os.Getenv("KITTY_WINDOW_ID") != "" || strings.Contains(termName, "kitty") || termProgram == "ghostty":
+		return graphicsKitty
+	case termProgram == "iTerm.app" || termProgram == "WezTerm" || os.Getenv("LC_TERMINAL") == "iTerm2":
+		return graphicsITerm2
+	case strings.Contains(termName, "sixel") || strings.Contains(termName, "foot") || strings.Contains(termName, "mlterm") ||
+		termProgram == "mintty" || os.Getenv("WT_SESSION") != "":
+		return graphicsSixel
+	}
+	return graphicsNone
+}
+
+// openExternally opens a file with the system's default application, without waiting for it
+func openExternally(path string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", path)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", path)
+	default:
+		cmd = exec.Command("xdg-open", path)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to open %s: %w", filepath.Base(path), err)
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// imageViewer shows an image full size while the TUI is suspended, with the terminal's graphics
+// protocol or as block art, until Enter is pressed. It is run with tea.Exec.
+type imageViewer struct {
+	path     string
+	protocol string
+	stdin    io.Reader
+	stdout   io.Writer
+}
+
+func (v *imageViewer) SetStdin(r io.Reader)  { v.stdin = r }
+func (v *imageViewer) SetStdout(w io.Writer) { v.stdout = w }
+func (v *imageViewer) SetStderr(io.Writer)   {}
+
+// Run draws the image below a cleared screen and waits for Enter
+func (v *imageViewer) Run() error {
+	cols, rows, err := term.GetSize(os.Stdout.Fd())
+	if err != nil {
+		cols, rows = 80, 24
+	}
+	rows = max(rows-2, 1) // Room for the prompt
+
+	out := bufio.NewWriter(v.stdout)
+	out.WriteString("\x1b[2J\x1b[H")
+	if err := v.draw(out, cols, rows); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\r\n%s: press Enter to return", filepath.Base(v.path))
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	_, err = bufio.NewReader(v.stdin).ReadString('\n')
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// draw writes the image fitted to cols x rows cells
+func (v *imageViewer) draw(out io.Writer, cols, rows int) error {
+	img, err := decodeImage(v.path)
+	if err != nil {
+		return err
+	}
+	bounds := img.Bounds()
+
+	switch v.protocol {
+	case graphicsKitty:
+		var encoded bytes.Buffer
+		if err := png.Encode(&encoded, img); err != nil {
+			return err
+		}
+		// Giving only one dimension keeps the aspect ratio; cells are about twice as tall as wide
+		size := fmt.Sprintf("c=%d", cols)
+		if bounds.Dy()*cols/(2*bounds.Dx()) > rows {
+			size = fmt.Sprintf("r=%d", rows)
+		}
+		return writeKittyImage(out, encoded.Bytes(), size)
+	case graphicsITerm2:
+		data, err := os.ReadFile(v.path)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "\x1b]1337;File=inline=1;size=%d;width=%d;height=%d;preserveAspectRatio=1:%s\a",
+			len(data), cols, rows, base64.StdEncoding.EncodeToString(data))
+		return err
+	case graphicsSixel:
+		width, height := fitImage(bounds.Dx(), bounds.Dy(), min(cols*sixelCellWidth, bounds.Dx()), min(rows*sixelCellHeight, bounds.Dy()))
+		return writeSixel(out, sampleImage(img, width, height))
+	default:
+		width, height := fitImage(bounds.Dx(), bounds.Dy(), cols, rows*2)
+		_, err := io.WriteString(out, strings.Join(blockArt(sampleImage(img, width, height), ""), "\r\n"))
+		return err
+	}
+}
+
+// writeKittyImage sends a PNG with the kitty graphics protocol, in the 4096-byte chunks it expects
+func writeKittyImage(out io.Writer, data []byte, size string) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for first := true; ; first = false {
+		chunk := encoded[:min(4096, len(encoded))]
+		encoded = encoded[len(chunk):]
+		more := 0
+		if encoded != "" {
+			more = 1
+		}
+		control := fmt.Sprintf("m=%d", more)
+		if first {
+			control = fmt.Sprintf("a=T,f=100,%s,%s", size, control)
+		}
+		if _, err := fmt.Fprintf(out, "\x1b_G%s;%s\x1b\\", control, chunk); err != nil {
+			return err
+		}
+		if encoded == "" {
+			return nil
+		}
+	}
+}
+
+// writeSixel draws pixels as sixels with a 6x6x6 color cube palette. Mostly transparent pixels are
+// left blank.
+func writeSixel(out io.Writer, pixels [][]color.RGBA) error {
+	level := func(v uint8) int { return (int(v)*5 + 127) / 255 }
+	index := func(c color.RGBA) int {
+		if c.A < 128 {
+			return -1
+		}
+		return level(c.R)*36 + level(c.G)*6 + level(c.B)
+	}
+
+	var sixel strings.Builder
+	height := len(pixels)
+	width := 0
+	if height > 0 {
+		width = len(pixels[0])
+	}
+	fmt.Fprintf(&sixel, "\x1bP0;1;0q\"1;1;%d;%d", width, height)
+	for i := range 216 {
+		fmt.Fprintf(&sixel, "#%d;2;%d;%d;%d", i, i/36*20, i/6%6*20, i%6*20)
+	}
+
+	for band := 0; band < height; band += 6 {
+		// The colors in this band of six rows, each drawn in its own pass over the band
+		used := make(map[int]bool)
+		for y := band; y < min(band+6, height); y++ {
+			for _, c := range pixels[y] {
+				if i := index(c); i >= 0 {
+					used[i] = true
+				}
+			}
+		}
+		for i := range 216 {
+			if !used[i] {
+				continue
+			}
+			fmt.Fprintf(&sixel, "#%d", i)
+			run, last := 0, byte(0)
+			flush := func() {
+				switch {
+				case run > 3:
+					fmt.Fprintf(&sixel, "!%d%c", run, last)
+				case run > 0:
+					sixel.WriteString(strings.Repeat(string(last), run))
+				}
+			}
+			for x := range width {
+				bits := 0
+				for dy := 0; dy < 6 && band+dy < height; dy++ {
+					if index(pixels[band+dy][x]) == i {
+						bits |= 1 << dy
+					}
+				}
+				char := byte(63 + bits)
+				if char != last {
+					flush()
+					run, last = 0, char
+				}
+				run++
+			}
+			flush()
+			sixel.WriteByte('$')
+		}
+		sixel.WriteByte('-')
+	}
+	sixel.WriteString("\x1b\\")
+	_, err := io.WriteString(out, sixel.String())
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+const (
+	inputHistoryLimit = 100 // Inputs remembered for Up/Down recall
+	inputHistoryFile  = "input_history.json"
+)
+
+// sensitiveInput matches inputs that must never be written to disk, such as passphrase commands
+var sensitiveInput = regexp.MustCompile(`(?i)^/(pass|passphrase|password|lock|unlock)\b|pass(word|phrase)|secret`)
+
+// InputHistory remembers sent inputs for recall in the TUI, oldest first. While browsing, the
+// text that was being typed is kept as a draft and comes back after the newest entry.
+type InputHistory struct {
+	entries []string
+	pos     int    // Entry being shown; len(entries) means the draft
+	draft   string // Unsent input from before browsing started
+	path    string // File the history is saved to; empty keeps it in memory only
+}
+
+// NewInputHistory creates an input history, loading it from path if path is set
+func NewInputHistory(path string) (*InputHistory, error) {
+	h := &InputHistory{path: path}
+	if path == "" {
+		return h, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, fmt.Errorf("failed to read input history: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.entries); err != nil {
+		return h, fmt.Errorf("invalid input history %s: %w", path, err)
+	}
+	if len(h.entries) > inputHistoryLimit {
+		h.entries = h.entries[len(h.entries)-inputHistoryLimit:]
+	}
+	h.pos = len(h.entries)
+	return h, nil
+}
+
+// Add records a sent input and stops browsing
+func (h *InputHistory) Add(input string) error {
+	h.pos = len(h.entries)
+	h.draft = ""
+	if input == "" || (len(h.entries) > 0 && h.entries[len(h.entries)-1] == input) {
+		return nil
+	}
+
+	h.entries = append(h.entries, input)
+	if len(h.entries) > inputHistoryLimit {
+		h.entries = h.entries[len(h.entries)-inputHistoryLimit:]
+	}
+	h.pos = len(h.entries)
+
+	if h.path == "" || sensitiveInput.MatchString(input) {
+		return nil
+	}
+	return h.save()
+}
+
+// Browsing reports whether an older entry is being shown instead of the draft
+func (h *InputHistory) Browsing() bool {
+	return h.pos < len(h.entries)
+}
+
+// Prev moves to the next older entry. current is the text being edited, kept as the draft
+// when browsing starts.
+func (h *InputHistory) Prev(current string) (string, bool) {
+	if h.pos == 0 {
+		return "", false
+	}
+	if !h.Browsing() {
+		h.draft = current
+	}
+	h.pos--
+	return h.entries[h.pos], true
+}
+
+// Next moves to the next newer entry, ending with the draft
+func (h *InputHistory) Next() (string, bool) {
+	if !h.Browsing() {
+		return "", false
+	}
+	h.pos++
+	if h.pos == len(h.entries) {
+		return h.draft, true
+	}
+	return h.entries[h.pos], true
+}
+
+// save writes the history without sensitive entries
+func (h *InputHistory) save() error {
+	entries := make([]string, 0, len(h.entries))
+	for _, entry := range h.entries {
+		if !sensitiveInput.MatchString(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(h.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save input history: %w", err)
+	}
+	return nil
+}
@@ -1,63 +1,182 @@
 package main
 
 import (
+	"cmp"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // EnhancedNode wraps the Node with additional features
 type EnhancedNode struct {
 	*Node
-	fileManager   *FileTransferManager
-	voiceManager  *VoiceMessageManager
-	featuresDir   string
-	peerIDMap     map[string]string // Maps connection peer ID -> actual node ID (listen address)
-	peerIDMapLock sync.RWMutex
+	fileManager  *FileTransferManager
+	voiceManager *VoiceMessageManager
+	dataDir      string // Root of all state: keys, files, downloads, config (-data-dir)
+	profile      string // Name given with -profile; empty for the default identity
+	headless     bool   // Don't read commands from stdin (daemon mode, or the TUI owns the terminal)
+
+	pendingAcks     map[string]chan struct{} // Message ID -> waiter for its delivery ack
+	pendingAcksLock sync.Mutex
+
+	webhook *WebhookDispatcher // Forwards received text messages; nil if not configured
+	hooks   *HookRegistry      // Automatic responses to matching messages
+	clock   *MessageClock      // Lamport time and sequence numbers for text messages
+
+	historySync bool // Exchange recent broadcast history with peers on connect (opt-in)
+
+	rendezvousServer string // Rendezvous server we register with and find peers through; empty if none
+
+	private          bool          // Only contacts' keys may connect, and dialling other keys needs confirming (-private)
+	strangersRefused atomic.Uint64 // Incoming connections refused in private mode
+
+	presence *PresenceTracker // Our presence and the latest presence of each peer
+	muteList *MuteList        // Peers whose messages are hidden locally
+	contacts *ContactBook     // Aliases for peers, pinned to their keys
+	invites  *InviteBook      // One-time invitations that add a contact when used
+	auditLog *AuditLog        // Security events, kept in the data dir
+	muteHard bool             // Hide muted peers' messages even when they mention us
+	mentions *MentionMatcher  // Nick and keyword matching for incoming messages
+	rooms    *RoomBook        // Rooms we are in and who proved their passphrase
+
+	clipboard clipboard // System clipboard for /paste and /copy; nil if no clipboard tool was found
+
+	peerStats   *PeerStats       // Round-trip latency and last activity of each peer
+	peerRecords *PeerRecordStore // Signed records of where nodes can be reached
+	seen        *SeenCache       // IDs of recent text messages, so none is handled twice
+	textParts   *TextAssembler   // Long texts from peers whose parts are still arriving
+	reputation  *Reputation      // How peers behave, to mute and disconnect spammers
+	receipts    *ReadReceipts    // Read receipts waiting to be sent, and whether they are on
+	search      *FileSearch      // Shared directories peers may search, and our own searches
+
+	config         *Config                   // Settings from the config file
+	configPath     string                    // Where config changes are saved
+	flags          configFlags               // Flags that override the config file, reapplied on /reload
+	configReloaded func(old, config *Config) // Called after /reload applies the config file; the TUI sets it
 }
 
-// NewEnhancedNode creates a new enhanced node with all features
-func NewEnhancedNode(listenAddr string, disableDiscovery bool) (*EnhancedNode, error) {
-	// Create base node
-	node, err := NewNode(listenAddr, disableDiscovery)
-	if err != nil {
+// NewEnhancedNode creates a new enhanced node with all features, keeping its state in dataDir
+func NewEnhancedNode(listenAddr string, disableDiscovery bool, dataDir string, opts ...NodeOption) (*EnhancedNode, error) {
+	// Create the data directory before anything is stored in it
+	if err := createDataDir(dataDir); err != nil {
 		return nil, err
 	}
 
-	// Create features directory
-	featuresDir := "./data"
-	if err := os.MkdirAll(featuresDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create features directory: %w", err)
+	// Create base node
+	node, err := NewNode(listenAddr, disableDiscovery, dataDir, opts...)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create crypto manager if not exists
 	if node.cryptoManager == nil {
-		crypto, err := NewCryptoManager("./keys")
+		crypto, err := NewCryptoManager(filepath.Join(dataDir, keysDirName))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create crypto manager: %w", err)
 		}
 		node.cryptoManager = crypto
 	}
+	// Damaged or mismatched key files would otherwise only show as peers refusing what we sign
+	if check := checkKeys(node.cryptoManager); check.Status == checkFail {
+		return nil, fmt.Errorf("key self-test failed: %s; %s", check.Detail, check.Hint)
+	}
 
 	// Create file manager
-	fileDir := filepath.Join(featuresDir, "files")
-	fileManager := NewFileTransferManager(node, node.cryptoManager, fileDir)
+	fileDir := filepath.Join(dataDir, filesDirName)
+	downloadDir := filepath.Join(dataDir, downloadsDirName)
+	if check := checkWritable("data dir", dataDir, downloadDir); check.Status == checkFail {
+		log.Printf("Warning: %s; received files, history and settings won't be saved (%s)", check.Detail, check.Hint)
+		node.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("⚠️ %s: received files, history and settings won't be saved; /doctor for more", check.Detail)),
+		})
+	}
+	fileManager := NewFileTransferManager(node, node.cryptoManager, fileDir, downloadDir)
 
 	// Create voice manager
-	voiceDir := filepath.Join(featuresDir, "voice")
+	voiceDir := filepath.Join(dataDir, voiceDirName)
 	voiceManager := NewVoiceMessageManager(node, node.cryptoManager, voiceDir)
 
+	if err := migrateDataDir(dataDir); err != nil {
+		return nil, err
+	}
+	muteList, err := NewMuteList(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	contacts, err := NewContactBook(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	invites, err := NewInviteBook(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	rooms, err := NewRoomBook(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := NewAuditLog(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
 	enhancedNode := &EnhancedNode{
 		Node:         node,
 		fileManager:  fileManager,
 		voiceManager: voiceManager,
-		featuresDir:  featuresDir,
-		peerIDMap:    make(map[string]string),
+		dataDir:      dataDir,
+		pendingAcks:  make(map[string]chan struct{}),
+		hooks:        NewHookRegistry(),
+		clock:        NewMessageClock(),
+		presence:     NewPresenceTracker(),
+		clipboard:    findClipboard(),
+		peerStats:    NewPeerStats(),
+		peerRecords:  NewPeerRecordStore(),
+		seen:         NewSeenCache(seenCacheSize),
+		textParts:    NewTextAssembler(node.wallClock),
+		reputation:   NewReputation(),
+		receipts:     NewReadReceipts(node.wallClock),
+		search:       NewFileSearch(),
+		muteList:     muteList,
+		contacts:     contacts,
+		invites:      invites,
+		rooms:        rooms,
+		auditLog:     auditLog,
+		mentions:     NewMentionMatcher(node.ID, "", nil),
+		config:       &Config{},
+		configPath:   defaultConfigPath(dataDir),
+	}
+	enhancedNode.registerBuiltinHooks()
+
+	// File messages are routed through the node so replies reach peers on inbound connections
+	fileManager.sender = enhancedNode
+	fileManager.voice = enhancedNode
+	fileManager.origins = enhancedNode
+	fileManager.requests = enhancedNode
+	fileManager.peers = enhancedNode
+	voiceManager.sender = enhancedNode
+	voiceManager.files = fileManager
+
+	// Send our public key to every new peer before anything else: over QUIC, replies to its key
+	// are session messages it can't check until it holds ours
+	node.greeting = enhancedNode.keyExchangeFrame
+	node.peerRemoved = enhancedNode.textParts.Drop
+	node.peerOversized = func(connID string) {
+		enhancedNode.scoreOffence(connID, "", offenceOversized)
+	}
+	node.peerPanicked = func(connID string) {
+		enhancedNode.scoreOffence(connID, "", offenceCrash)
 	}
+	node.admit = enhancedNode.admitConn
+	node.localCapabilities = enhancedNode.capabilities
 
 	// Note: processMessages is integrated into StartEnhanced event loop
 	// No separate goroutine needed to avoid race condition
@@ -65,12 +184,31 @@ func NewEnhancedNode(listenAddr string, disableDiscovery bool) (*EnhancedNode, e
 	return enhancedNode, nil
 }
 
+// applyConfig applies settings from the config file, remembering where to save changes
+func (en *EnhancedNode) applyConfig(config *Config, path string) error {
+	en.config = config
+	en.configPath = path
+	en.mentions.Set(cmp.Or(en.flags.nick, config.Nick), config.Keywords)
+	en.configureDownloads(config)
+	en.search.Configure(config.SharedDirs, config.AnswerSearches == nil || *config.AnswerSearches)
+	en.voiceManager.SetDevice(config.AudioDevice)
+	en.voiceManager.applyPlaybackConfig(config)
+	en.receipts.Configure(config.SendReadReceipts, config.ShowReadReceipts)
+	if err := en.reputation.Configure(config.Reputation); err != nil {
+		return err
+	}
+	if err := en.voiceManager.SetTranscriber(config.Transcribe); err != nil {
+		return err
+	}
+	return en.registerExecHooks(config.Hooks)
+}
+
 // processMessages handles incoming encrypted messages
 func (en *EnhancedNode) processMessages() {
 	for {
 		select {
 		case msg := <-en.IncomingMsg:
-			en.handleIncomingMessage(msg)
+			en.handleIncomingSafely(msg)
 		case <-en.Shutdown:
 			return
 		}
@@ -79,20 +217,56 @@ func (en *EnhancedNode) processMessages() {
 
 // handleIncomingMessage processes incoming messages and routes them to appropriate handlers
 func (en *EnhancedNode) handleIncomingMessage(msg Message) {
-	// Update peer ID mapping: connection ID -> actual node ID
-	// This is crucial because connections use ephemeral ports, but we need the listen address
+	// A frame read before its connection was replaced is handled as the newer connection's
+	msg.FromPeerID = en.currentConn(msg.FromPeerID)
+
+	// Connections use ephemeral ports; the node ID the frames carry is the listen address
 	if msg.FromPeerID != "" && msg.SenderID != "" && msg.SenderID != en.ID {
-		en.peerIDMapLock.Lock()
-		en.peerIDMap[msg.FromPeerID] = msg.SenderID
-		en.peerIDMapLock.Unlock()
+		en.notePeerNode(msg.FromPeerID, msg.SenderID)
 	}
 
-	// Check for unencrypted key exchange message
+	// Gossip is handled by the base node. Peers that exchange signed records still send empty
+	// lists as keepalives, but their lists are never used.
 	content := string(msg.Content)
+	if strings.HasPrefix(content, "GOSSIP_PEERS:") {
+		if !en.peerRecords.Negotiated(msg.SenderID) {
+			en.Node.handleIncomingMessage(msg)
+		}
+		return
+	}
+
+	// Check for unencrypted key exchange message
 	if strings.HasPrefix(content, "KEY_EXCHANGE:") {
-		// Extract the public key
-		publicKeyPEM := strings.TrimPrefix(content, "KEY_EXCHANGE:")
-		en.handleKeyExchange(msg.SenderID, []byte(publicKeyPEM))
+		// Extract the public key (base64 encoded so the PEM fits on one line)
+		encodedKey := strings.TrimPrefix(content, "KEY_EXCHANGE:")
+		publicKeyPEM, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			log.Printf("Invalid key exchange message from %s: %v", msg.SenderID, err)
+			return
+		}
+		if err := en.handleKeyExchange(msg.FromPeerID, msg.SenderID, publicKeyPEM); err != nil {
+			log.Printf("Key exchange failed: %v", err)
+		}
+		return
+	}
+
+	// Messages over a Noise or QUIC session have no envelope
+	if strings.HasPrefix(content, sessionPrefix) {
+		plaintext, msgType, err := en.openSessionMessage(msg)
+		if errors.Is(err, errMessageTooLarge) {
+			en.oversizedFrom(msg.FromPeerID, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Refused session message from %s: %v", msg.SenderID, err)
+			en.audit(AuditEntry{
+				Event: auditSessionRefused, Severity: auditCritical, Peer: msg.SenderID, Connection: msg.FromPeerID,
+				Detail: fmt.Sprintf("refused a message claiming to be from %s: %v", msg.SenderID, err),
+			})
+			en.scoreOffence(msg.FromPeerID, msg.SenderID, offenceSignature)
+			return
+		}
+		en.routeMessage(msg, plaintext, msgType, true)
 		return
 	}
 
@@ -103,66 +277,230 @@ func (en *EnhancedNode) handleIncomingMessage(msg Message) {
 		plaintext, msgType, err := en.cryptoManager.DecryptMessage(&encryptedMsg)
 		if err != nil {
 			log.Printf("Failed to decrypt message from %s: %v", msg.SenderID, err)
+			entry := AuditEntry{
+				Event: auditDecryptFailure, Severity: auditWarning, Peer: msg.SenderID, Connection: msg.FromPeerID,
+				Detail: fmt.Sprintf("couldn't decrypt a %q message from %s: %v", encryptedMsg.MessageType, msg.SenderID, err),
+			}
+			if errors.Is(err, errBadSignature) {
+				entry.Event, entry.Severity = auditSignatureFailure, auditCritical
+				entry.Detail = fmt.Sprintf("a %q message from %s failed signature verification; dropped it", encryptedMsg.MessageType, msg.SenderID)
+			}
+			en.audit(entry)
+			if errors.Is(err, errBadSignature) {
+				en.scoreOffence(msg.FromPeerID, msg.SenderID, offenceSignature)
+			}
 			return
 		}
+		if en.cryptoManager.MarkVerified(msg.SenderID, encryptedMsg.SenderPubKey) {
+			en.audit(AuditEntry{
+				Event: auditKeyVerified, Severity: auditInfo, Peer: msg.SenderID, Connection: msg.FromPeerID,
+				Detail: fmt.Sprintf("%s signed a message with the key we hold for it", msg.SenderID),
+			})
+		}
 
-		// Route based on message type
-		switch msgType {
-		case "text":
-			// Regular text message
-			textMsg := Message{
-				SenderID:   msg.SenderID,
-				Content:    plaintext,
-				FromPeerID: msg.FromPeerID,
-				IsGossip:   msg.IsGossip,
-			}
-			// Pass to original handler
-			en.handleDecryptedMessage(textMsg)
+		en.routeMessage(msg, plaintext, msgType, en.cryptoManager.IsPeerKey(msg.SenderID, encryptedMsg.SenderPubKey))
+	} else if _, authenticated := en.connFingerprint(msg.FromPeerID); authenticated {
+		// This is a plain text message (legacy or system message); only the connection vouches
+		// for its sender. Once we hold the sender's key it should be encrypting.
+		if en.cryptoManager.HasPeerKey(msg.SenderID) {
+			en.audit(AuditEntry{
+				Event: auditPlaintext, Severity: auditWarning, Peer: msg.SenderID, Connection: msg.FromPeerID,
+				Detail: fmt.Sprintf("received an unencrypted message from %s after exchanging keys", msg.SenderID),
+			})
+		}
+		en.handleDecryptedMessage(msg)
+	} else {
+		log.Printf("Dropped unsigned message from %s over an unauthenticated connection", msg.SenderID)
+	}
+}
+
+// routeMessage hands a decrypted message to the handler for its type. fromPeerKey says whether
+// it was signed, or sent over a connection authenticated, with the key we hold for the sender.
+func (en *EnhancedNode) routeMessage(msg Message, plaintext []byte, msgType string, fromPeerKey bool) {
+	if err := checkEnvelopeSize(plaintext, msgType); err != nil {
+		en.oversizedFrom(msg.FromPeerID, err)
+		return
+	}
 
-		case "file":
-			// File transfer message
-			var fileMsg FileMessage
-			if err := json.Unmarshal(plaintext, &fileMsg); err != nil {
-				log.Printf("Failed to parse file message: %v", err)
+	switch msgType {
+	case "text":
+		// Regular text message
+		envelope := parseTextEnvelope(plaintext)
+		if err := checkTextEnvelope(envelope); err != nil {
+			en.oversizedFrom(msg.FromPeerID, err)
+			return
+		}
+		if envelope.Parts > 0 {
+			// Part of a long text: it goes on from here once the last part is in
+			whole, complete, err := en.textParts.Add(msg.FromPeerID, msg.SenderID, envelope)
+			if err != nil {
+				en.oversizedFrom(msg.FromPeerID, err)
+			}
+			if !complete {
 				return
 			}
-			en.fileManager.HandleFileMessage(msg.SenderID, fileMsg)
-
-		case "voice":
-			// Voice message
-			var voiceMsg VoiceMessage
-			if err := json.Unmarshal(plaintext, &voiceMsg); err != nil {
-				log.Printf("Failed to parse voice message: %v", err)
+			envelope = whole
+		}
+		if envelope.AckRequested {
+			en.sendDeliveryAck(msg.SenderID, envelope.ID)
+		}
+		if envelope.ID != "" {
+			if first, replayed := en.seen.FirstOver(msg.SenderID, envelope.ID, msg.FromPeerID); !first {
+				// Already handled: it came over a second connection, or back around a loop
+				log.Printf("Suppressed duplicate message %s from %s", envelope.ID, msg.SenderID)
+				if replayed {
+					en.audit(AuditEntry{
+						Event: auditReplay, Severity: auditWarning, Peer: msg.SenderID, Connection: msg.FromPeerID,
+						Detail: fmt.Sprintf("message %s from %s arrived again over the connection it first came over; dropped it", envelope.ID, msg.SenderID),
+					})
+				}
 				return
 			}
-			en.voiceManager.HandleVoiceMessage(msg.SenderID, voiceMsg)
+		}
 
-		case "key_exchange":
-			// Encrypted key exchange message (for key rotation)
-			en.handleKeyExchange(msg.SenderID, plaintext)
+		en.clock.Witness(envelope.Lamport)
+		en.peerStats.Touch(msg.SenderID)
+		en.scoreMessage(msg.FromPeerID, msg.SenderID, envelope.Text)
+		if envelope.Seq > 0 {
+			if missed := en.clock.CheckSeq(msg.SenderID, envelope.Seq); missed > 0 {
+				en.notifyUI(Message{
+					SenderID: "System",
+					Content:  []byte(fmt.Sprintf("⚠️ Missed %d message(s) from %s", missed, msg.SenderID)),
+				})
+			}
+		}
 
-		default:
-			log.Printf("Unknown message type: %s", msgType)
+		textMsg := Message{
+			SenderID:   msg.SenderID,
+			Content:    []byte(envelope.Text),
+			FromPeerID: msg.FromPeerID,
+			IsGossip:   msg.IsGossip,
+			Lamport:    envelope.Lamport,
+			Seq:        envelope.Seq,
+			Mention:    en.mentions.Matches(envelope.Text),
+			Action:     envelope.Kind == TextKindAction,
+			ExpiresAt:  envelope.expiresAt(time.Now()),
+			ID:         envelope.ID,
+			// Broadcasts carry a sequence number; legacy messages have no Lamport time either
+			Direct: envelope.Seq == 0 && envelope.Lamport > 0,
 		}
-	} else {
-		// This is a plain text message (legacy or system message)
-		en.handleDecryptedMessage(msg)
+		// Pass to original handler, unless the sender is muted
+		if !en.shouldSuppress(msg.SenderID, envelope.Text) {
+			en.handleDecryptedMessage(textMsg)
+		}
+
+		// Ephemeral messages aren't handed to webhooks, which would keep them forever
+		if en.webhook != nil && envelope.TTL == 0 {
+			en.webhook.Enqueue(WebhookEvent{
+				Sender:    msg.SenderID,
+				Nick:      cmp.Or(en.presence.Nick(msg.SenderID), msg.SenderID),
+				Text:      envelope.Text,
+				Timestamp: time.Now().Format(time.RFC3339),
+				MessageID: envelope.ID,
+			})
+		}
+
+		en.runHooks(HookEvent{
+			SenderID:  msg.SenderID,
+			MessageID: envelope.ID,
+			Text:      envelope.Text,
+		})
+
+	case "ack":
+		// Delivery acknowledgement for a message we sent
+		en.handleDeliveryAck(msg.SenderID, plaintext)
+
+	case "presence":
+		// Peer's online/away/busy status
+		en.handlePresence(msg.SenderID, fromPeerKey, plaintext)
+
+	case "ping":
+		// Latency probe; echo it back
+		en.handlePing(msg.SenderID, plaintext)
+
+	case "pong":
+		// Answer to one of our latency probes
+		en.handlePong(msg.SenderID, plaintext)
+
+	case "sync":
+		// Peer asking for history it missed
+		en.handleHistorySyncRequest(msg.SenderID, plaintext)
+
+	case "backfill":
+		// History we asked for
+		en.handleHistoryBackfill(msg.SenderID, plaintext)
+
+	case "peer_digest":
+		// Hash of the peer's signed peer records
+		en.handlePeerDigest(msg.SenderID, plaintext)
+
+	case "peer_summary":
+		// Versions of the peer's records, so we can send the ones it lacks
+		en.handlePeerSummary(msg.SenderID, plaintext)
+
+	case "peer_records":
+		// Records we lacked
+		en.handlePeerRecords(msg.SenderID, plaintext)
+
+	case "file":
+		// File transfer message
+		var fileMsg FileMessage
+		if err := json.Unmarshal(plaintext, &fileMsg); err != nil {
+			log.Printf("Failed to parse file message: %v", err)
+			return
+		}
+		if err := en.fileManager.HandleFileMessage(msg.SenderID, fileMsg); errors.Is(err, errMessageTooLarge) {
+			en.oversizedFrom(msg.FromPeerID, err)
+		}
+
+	case "search":
+		// File search of shared directories, its results, or a /get of one
+		en.handleFileSearch(msg.SenderID, fromPeerKey, plaintext)
+
+	case "voice":
+		// Voice message
+		var voiceMsg VoiceMessage
+		if err := json.Unmarshal(plaintext, &voiceMsg); err != nil {
+			log.Printf("Failed to parse voice message: %v", err)
+			return
+		}
+		if en.shouldSuppress(msg.SenderID, "") {
+			return
+		}
+		en.voiceManager.HandleVoiceMessage(msg.SenderID, voiceMsg)
+
+	case "capabilities":
+		// What the peer supports, from peers whose connection had no Noise handshake
+		en.handleCapabilities(msg, fromPeerKey, plaintext)
+
+	case "room":
+		// Joining one of our rooms, or a member's traffic within it
+		en.handleRoomMessage(msg, fromPeerKey, plaintext)
+
+	case "read":
+		// Direct messages of ours the peer has read
+		en.handleReadReceipt(msg, fromPeerKey, plaintext)
+
+	case "version":
+		// The build the peer runs, from peers whose connection had no Noise handshake
+		en.handleVersion(msg, fromPeerKey, plaintext)
+
+	case "key_exchange":
+		// Encrypted key exchange message (for key rotation)
+		if err := en.handleKeyExchange(msg.FromPeerID, msg.SenderID, plaintext); err != nil {
+			log.Printf("Key rotation failed: %v", err)
+		}
+
+	default:
+		log.Printf("Unknown message type: %s", msgType)
 	}
 }
 
-// handleDecryptedMessage processes decrypted or plain text messages
+// handleDecryptedMessage processes decrypted or plain text messages from peers.
+// Text from peers is never interpreted as a command, even if it starts with "/".
 func (en *EnhancedNode) handleDecryptedMessage(msg Message) {
-	// Check if it's a command
-	content := string(msg.Content)
-	if strings.HasPrefix(content, "/") {
-		en.handleEnhancedCLICommand(content, msg.SenderID)
-		return
-	}
-
-	// Regular message - send to UI only (broadcasting is handled by sender)
-	if en.uiChannel != nil {
-		en.uiChannel <- msg
-	}
+	// Send to UI only (broadcasting is handled by sender)
+	en.notifyUI(msg)
 }
 
 // handleEnhancedCLICommand processes enhanced CLI commands
@@ -171,165 +509,593 @@ func (en *EnhancedNode) handleEnhancedCLICommand(input string, senderID string)
 	if senderID != en.ID {
 		return
 	}
+	input = en.expandAlias(input)
 
 	// Enhanced commands
 	switch {
 	case strings.HasPrefix(input, "/sendfile "):
-		en.fileManager.HandleCLICommand(input)
+		if fields := strings.Fields(input); len(fields) > 2 && roomName.MatchString(fields[1]) {
+			en.handleRoomSendFile(fields[1], strings.Join(fields[2:], " "))
+		} else if len(fields) < 2 || !en.refuseWithout(fields[1], capabilityFiles, "send a file to") {
+			en.fileManager.HandleCLICommand(input)
+		}
+
+	case input == "/accept" || strings.HasPrefix(input, "/accept ") || input == "/reject" || strings.HasPrefix(input, "/reject "):
+		en.fileManager.HandleOfferCommand(input)
+
+	case input == "/search" || strings.HasPrefix(input, "/search "):
+		en.handleSearchCommand(strings.TrimPrefix(input, "/search"))
+
+	case input == "/get" || strings.HasPrefix(input, "/get "):
+		en.handleGetCommand(strings.TrimPrefix(input, "/get"))
 
-	case strings.HasPrefix(input, "/voice "):
-		en.voiceManager.HandleCLICommand(input)
+	case input == "/voice" || strings.HasPrefix(input, "/voice "):
+		en.handleVoiceCommand(strings.TrimPrefix(input, "/voice"))
+
+	case input == "/play" || strings.HasPrefix(input, "/play "):
+		en.voiceManager.HandlePlayCommand(strings.TrimPrefix(input, "/play"))
+
+	case input == "/voicemsgs":
+		en.voiceManager.HandleListCommand()
+
+	case input == "/volume" || strings.HasPrefix(input, "/volume "):
+		en.handleVolumeCommand(strings.TrimPrefix(input, "/volume"))
+
+	case input == "/speed" || strings.HasPrefix(input, "/speed "):
+		en.handleSpeedCommand(strings.TrimPrefix(input, "/speed"))
+
+	case input == "/audiodevices":
+		en.handleAudioDevicesCommand()
+
+	case input == "/audiodevice" || strings.HasPrefix(input, "/audiodevice "):
+		en.handleAudioDeviceCommand(strings.TrimPrefix(input, "/audiodevice"))
 
 	case strings.HasPrefix(input, "/help"):
 		en.showEnhancedHelp()
 
+	case input == "/status" || strings.HasPrefix(input, "/status "):
+		en.handleStatusCommand(strings.TrimPrefix(input, "/status"))
+
+	case input == "/clear":
+		// The TUI clears its own view before input gets here; the plain CLI clears the terminal
+		if en.console != nil {
+			en.console.Clear()
+		}
+
+	case input == "/peers":
+		en.listPeersWithPresence(false)
+
+	case input == "/peers -v":
+		en.listPeersWithPresence(true)
+
+	case input == "/version":
+		en.handleVersionCommand()
+
+	case input == "/whois" || strings.HasPrefix(input, "/whois "):
+		en.handleWhoisCommand(strings.TrimPrefix(input, "/whois"))
+
+	case input == "/stats":
+		en.handleStatsCommand()
+
+	case input == "/debug":
+		en.handleDebugCommand()
+
+	case input == "/reload":
+		en.handleReloadCommand()
+
+	case input == "/doctor":
+		en.handleDoctorCommand()
+
+	case input == "/lock":
+		en.handleLockCommand(true)
+
+	case input == "/unlock":
+		en.handleLockCommand(false)
+
+	case input == "/myaddr":
+		en.handleMyAddrCommand()
+
+	case input == "/theme" || strings.HasPrefix(input, "/theme "):
+		// The TUI switches themes itself before input gets here
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("🎨 Themes apply to the TUI; start it with -tui -theme <name>"),
+		})
+
+	case input == "/notify" || strings.HasPrefix(input, "/notify "):
+		// The TUI handles notifications itself before input gets here
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("🔔 Desktop notifications apply to the TUI; start it with -tui -notify on"),
+		})
+
+	case input == "/notifications" || strings.HasPrefix(input, "/notifications ") || input == "/dnd" || strings.HasPrefix(input, "/dnd "):
+		// The TUI keeps notification levels and do not disturb itself
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("🔔 Notification levels and do not disturb apply to the TUI; start it with -tui"),
+		})
+
+	case input == "/close":
+		// Conversation tabs only exist in the TUI, which closes them itself
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("💬 Conversations are TUI tabs; there is nothing to close here"),
+		})
+
+	case input == "/save" || strings.HasPrefix(input, "/save "):
+		en.handleSaveCommand(strings.TrimSpace(strings.TrimPrefix(input, "/save")))
+
+	case input == "/audit" || strings.HasPrefix(input, "/audit "):
+		en.handleAuditCommand(strings.TrimPrefix(input, "/audit"))
+
+	case input == "/contact" || strings.HasPrefix(input, "/contact "):
+		en.handleContactCommand(strings.TrimPrefix(input, "/contact"))
+
+	case input == "/invite" || strings.HasPrefix(input, "/invite "):
+		en.handleInviteCommand(strings.TrimPrefix(input, "/invite"))
+
+	case input == "/share" || strings.HasPrefix(input, "/share "):
+		en.handleShareCommand(strings.TrimPrefix(input, "/share"))
+
+	case input == "/add" || strings.HasPrefix(input, "/add "):
+		en.handleAddCommand(strings.TrimPrefix(input, "/add"))
+
+	case strings.HasPrefix(input, "/connect "):
+		target := strings.TrimSpace(strings.TrimPrefix(input, "/connect "))
+		fields := strings.Fields(target)
+		if contact, exists := en.contacts.Get(target); exists {
+			go en.connectToContact(contact)
+		} else if fingerprint, ok := parseFingerprint(target); ok {
+			go en.connectToFingerprint(fingerprint)
+		} else if len(fields) == 1 {
+			go en.connectWithIntent(target, dialIntent{})
+		} else if fingerprint, ok := parseFingerprint(fields[1]); ok && len(fields) <= 3 {
+			intent := dialIntent{fingerprint: fingerprint}
+			if len(fields) == 3 {
+				intent.invite = fields[2]
+			}
+			go en.connectWithIntent(fields[0], intent)
+		} else {
+			en.notifyUI(Message{
+				SenderID: "System",
+				Content:  []byte("Usage: /connect <addr|alias|fingerprint> or /connect <addr> <fingerprint> [invitation]"),
+			})
+		}
+
+	case input == "/keywords" || strings.HasPrefix(input, "/keywords "):
+		en.handleKeywordsCommand(strings.TrimPrefix(input, "/keywords"))
+
+	case input == "/join" || strings.HasPrefix(input, "/join "):
+		en.handleJoinCommand(strings.TrimPrefix(input, "/join"))
+
+	case input == "/room" || strings.HasPrefix(input, "/room "):
+		en.handleRoomCommand(strings.TrimPrefix(input, "/room"))
+
+	case input == "/msg" || strings.HasPrefix(input, "/msg "):
+		en.handleMsgCommand(strings.TrimPrefix(input, "/msg"))
+
+	case strings.HasPrefix(input, "/me "):
+		en.sendChatText(strings.TrimSpace(strings.TrimPrefix(input, "/me ")), TextKindAction)
+
+	case input == "/shrug" || strings.HasPrefix(input, "/shrug "):
+		en.sendChatText(strings.TrimSpace(strings.TrimPrefix(input, "/shrug")+` ¯\_(ツ)_/¯`), "")
+
+	case input == "/ephemeral" || strings.HasPrefix(input, "/ephemeral "):
+		en.handleEphemeralCommand(strings.TrimPrefix(input, "/ephemeral"))
+
+	case input == "/paste" || strings.HasPrefix(input, "/paste "):
+		en.handlePasteCommand(strings.TrimPrefix(input, "/paste"))
+
+	case input == "/copy" || strings.HasPrefix(input, "/copy "):
+		en.handleCopyCommand(strings.TrimPrefix(input, "/copy"))
+
+	case strings.HasPrefix(input, "//"):
+		// Escaped slash: send the rest as text
+		en.sendChatText(input[1:], "")
+
+	case input == "/muted" || input == "/mute" || input == "/unmute" ||
+		strings.HasPrefix(input, "/mute ") || strings.HasPrefix(input, "/unmute "):
+		en.handleMuteCommand(input)
+
 	case strings.HasPrefix(input, "/"):
 		// Other commands - pass to original CLI handler
 		en.handleCLIInput(input)
 
 	default:
 		// Regular message - send encrypted
-		if err := en.SendEncryptedText(input); err != nil {
-			log.Printf("Failed to send encrypted message: %v", err)
-			return
-		}
+		en.sendChatText(input, "")
+	}
+}
+
+// sendChatText broadcasts text typed by the user and shows it locally
+func (en *EnhancedNode) sendChatText(text string, kind string) {
+	if text == "" {
+		return
+	}
+	if err := checkTextSize(text); err != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Not sent: %v", err)),
+		})
+		return
+	}
 
+	envelope := en.newTextEnvelope(text, true)
+	envelope.Kind = kind
+	sent, err := en.broadcastEnvelope(envelope)
+	if sentToAny(err) {
 		// Also send to UI
-		if en.uiChannel != nil {
-			en.uiChannel <- Message{
-				SenderID: en.ID,
-				Content:  []byte(input),
-			}
+		en.notifyUI(sent)
+	}
+	if err != nil {
+		en.notifySendError("Message", err)
+	}
+}
+
+// handleMsgCommand processes /msg <peer|#room> <text>, sending the text to that peer only, or to
+// the members of the room
+func (en *EnhancedNode) handleMsgCommand(args string) {
+	peerID, text, _ := strings.Cut(strings.TrimSpace(args), " ")
+	text = strings.TrimSpace(text)
+	if peerID == "" || text == "" {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("Usage: /msg <peer|#room> <text>"),
+		})
+		return
+	}
+	if roomName.MatchString(peerID) {
+		sent, err := en.sendRoomText(peerID, text)
+		if sentToAny(err) {
+			en.notifyUI(sent)
+		}
+		if err != nil {
+			en.notifySendError("Message", err)
 		}
+		return
 	}
+
+	sent, err := en.SendEncryptedTextTo(peerID, text)
+	if err != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Failed to send to %s: %v", peerID, err)),
+		})
+		return
+	}
+	en.notifyUI(sent)
 }
 
-// handleKeyExchange processes public key exchange
-func (en *EnhancedNode) handleKeyExchange(peerID string, keyData []byte) {
+// handleKeyExchange processes public key exchange. It returns why a key was refused or couldn't
+// be added; the caller decides whether that is worth more than a log line.
+func (en *EnhancedNode) handleKeyExchange(connID, peerID string, keyData []byte) error {
+	err := en.checkTransportKey(connID, string(keyData))
+	if err == nil {
+		err = en.checkContactKey(peerID, string(keyData))
+	}
+	if err != nil {
+		fingerprint := ""
+		if publicKey, parseErr := parsePublicKeyPEM(string(keyData)); parseErr == nil {
+			fingerprint = keyFingerprint(publicKey)
+		}
+		en.audit(AuditEntry{
+			Event: auditKeyRefused, Severity: auditCritical, Peer: peerID, Connection: connID, Fingerprint: fingerprint,
+			Detail: err.Error(),
+		})
+		return fmt.Errorf("refused key from %s: %w", peerID, err)
+	}
+	if publicKey, err := parsePublicKeyPEM(string(keyData)); err == nil {
+		en.auditPeerKey(peerID, connID, keyFingerprint(publicKey), "a key exchange")
+		en.keySeen(peerID, keyFingerprint(publicKey))
+	}
+
 	// Add peer's public key using the peer ID from the message sender
 	// This is crucial because the sender ID is their listen address,
 	// not the ephemeral connection port
 	if err := en.cryptoManager.AddPeerKey(peerID, string(keyData)); err != nil {
-		log.Printf("Failed to add peer key for %s: %v", peerID, err)
-	} else {
-		log.Printf("✅ Added public key for peer %s", peerID)
-	}
-}
-
-// sendPublicKey sends our public key to a peer (unencrypted for initial exchange)
-func (en *EnhancedNode) sendPublicKey(peerID string) error {
-	publicKeyPEM, err := en.cryptoManager.GetPublicKeyPEM()
-	if err != nil {
 		return err
 	}
-
-	// Create a special key exchange message (unencrypted)
-	// Format: KEY_EXCHANGE:<base64 encoded public key>
-	keyExchangeMsg := Message{
-		SenderID: en.ID,
-		Content:  []byte(fmt.Sprintf("KEY_EXCHANGE:%s", publicKeyPEM)),
+	log.Printf("✅ Added public key for peer %s", peerID)
+	if fingerprint, known := en.cryptoManager.PeerFingerprint(peerID); known {
+		en.identifyPeer(connID, peerID, fingerprint)
 	}
 
-	// Send to peer
-	en.peersMutex.RLock()
-	peer, exists := en.Peers[peerID]
-	en.peersMutex.RUnlock()
-
-	if !exists {
-		return fmt.Errorf("peer %s not connected", peerID)
+	if !en.handshakeCarriedCapabilities(connID) {
+		en.sendCapabilitiesTo(peerID)
+		en.sendVersionTo(peerID)
 	}
+	en.sendPresenceTo(peerID)
+	en.sendPing(peerID)
+	en.sendPeerDigest(peerID)
+	en.rejoinRooms(peerID)
 
-	// Serialize the message
-	networkMsg := fmt.Sprintf("%s%c%s", keyExchangeMsg.SenderID, delimiter, string(keyExchangeMsg.Content))
+	if en.historySync && !en.lacksCapability(peerID, capabilityHistorySync) {
+		en.requestHistory(peerID)
+	}
+	return nil
+}
 
-	select {
-	case peer.Send <- []byte(networkMsg):
-		log.Printf("Sent public key to peer %s", peerID)
+// keyExchangeFrame returns the frame sending our public key to a peer, unencrypted for the
+// initial exchange, or nil without a key
+func (en *EnhancedNode) keyExchangeFrame() []byte {
+	if en.cryptoManager == nil {
+		return nil
+	}
+	publicKeyPEM, err := en.cryptoManager.GetPublicKeyPEM()
+	if err != nil {
 		return nil
-	default:
-		return fmt.Errorf("peer send channel full")
 	}
+
+	// Format: KEY_EXCHANGE:<base64 encoded public key>
+	return newFrame(en.ID, []byte(fmt.Sprintf("KEY_EXCHANGE:%s", base64.StdEncoding.EncodeToString([]byte(publicKeyPEM)))))
 }
 
-// broadcastEncrypted broadcasts an encrypted message to all peers
+// broadcastEncrypted broadcasts an encrypted message to all peers.
+// Peers on an authenticated connection get a session message. For the rest the message is signed
+// once; only the encryption and framing are done per peer, on a snapshot of the peer list so
+// connects and disconnects aren't held up behind RSA.
 func (en *EnhancedNode) broadcastEncrypted(plaintext []byte, msgType string) error {
-	en.peersMutex.RLock()
-	defer en.peersMutex.RUnlock()
-
-	var lastError error
-	for peerID, peer := range en.Peers {
-		// Get the actual node ID (listen address) for encryption
-		// The peerID here is the connection address (ephemeral port)
-		// But we need the node's listen address for key lookup
-		en.peerIDMapLock.RLock()
-		actualNodeID, exists := en.peerIDMap[peerID]
-		en.peerIDMapLock.RUnlock()
-
-		if !exists {
-			// If we haven't received a message from this peer yet, skip encryption
+	var signature *MessageSignature
+	var failed []*PeerError
+	peers := en.snapshotPeers()
+	for _, peer := range peers {
+		peerID := peer.ID
+		// Keys are held by node ID (listen address), not by the connection's ephemeral port
+		actualNodeID := peer.nodeID()
+		if actualNodeID == "" {
+			// Neither the handshake nor a frame has said who this is yet, so skip encryption
 			log.Printf("Skipping encryption for %s: no node ID mapping yet", peerID)
+			failed = append(failed, &PeerError{Peer: peerID, Err: ErrNotIdentified})
 			continue
 		}
 
-		// Encrypt message for this peer using their actual node ID
-		encryptedMsg, err := en.cryptoManager.EncryptMessage(actualNodeID, plaintext, msgType)
-		if err != nil {
-			log.Printf("Failed to encrypt message for %s (%s): %v", peerID, actualNodeID, err)
-			lastError = err
-			continue
-		}
+		frame, secured, err := en.sessionFrame(peerID, actualNodeID, plaintext, msgType)
+		if !secured {
+			if signature == nil {
+				signed, err := en.cryptoManager.SignPlaintext(plaintext)
+				if err != nil {
+					return fmt.Errorf("failed to sign message: %w", err)
+				}
+				signature = &signed
+			}
+
+			// Encrypt message for this peer using their actual node ID
+			encryptedMsg, err := en.cryptoManager.EncryptSigned(actualNodeID, plaintext, msgType, *signature)
+			if err != nil {
+				log.Printf("Failed to encrypt message for %s (%s): %v", peerID, actualNodeID, err)
+				failed = append(failed, &PeerError{Peer: actualNodeID, Err: fmt.Errorf("failed to encrypt: %w", err)})
+				continue
+			}
 
-		// Serialize encrypted message
-		encryptedData, err := json.Marshal(encryptedMsg)
+			// Serialize encrypted message
+			frame, err = newJSONFrame(en.ID, encryptedMsg)
+		}
 		if err != nil {
 			log.Printf("Failed to serialize message for %s: %v", peerID, err)
-			lastError = err
+			failed = append(failed, &PeerError{Peer: actualNodeID, Err: fmt.Errorf("failed to serialize: %w", err)})
 			continue
 		}
 
-		// Send to peer
+		// Send to peer, unless it disconnected while we were encrypting
+		if peer.closed() {
+			failed = append(failed, &PeerError{Peer: actualNodeID, Err: ErrPeerDisconnect})
+			continue
+		}
 		select {
-		case peer.Send <- encryptedData:
+		case peer.Send <- frame:
 			// Message sent successfully
 		default:
 			log.Printf("Failed to send message to %s: channel full", peerID)
-			lastError = fmt.Errorf("channel full for %s", peerID)
+			failed = append(failed, &PeerError{Peer: actualNodeID, Err: ErrSendQueueFull})
 		}
 	}
 
-	return lastError
+	return newBroadcastError(len(peers), failed)
 }
 
-// SendEncryptedText sends an encrypted text message to all peers
-func (en *EnhancedNode) SendEncryptedText(text string) error {
-	return en.broadcastEncrypted([]byte(text), "text")
+// SendEncryptedText sends an encrypted text message to all peers.
+// It returns the message as sent, stamped for ordering, for local display.
+func (en *EnhancedNode) SendEncryptedText(text string) (Message, error) {
+	if err := checkTextSize(text); err != nil {
+		return Message{}, err
+	}
+	return en.broadcastEnvelope(en.newTextEnvelope(text, true))
 }
 
-// showEnhancedHelp displays enhanced command help
-func (en *EnhancedNode) showEnhancedHelp() {
-	helpText := `Enhanced Commands:
+// broadcastEnvelope sends a stamped text envelope to all peers, in parts if it is long,
+// returning our local copy
+func (en *EnhancedNode) broadcastEnvelope(envelope TextEnvelope) (Message, error) {
+	err := en.sendTextParts(envelope, func(data []byte) error {
+		return en.broadcastEncrypted(data, "text")
+	})
+	return en.localTextMessage(envelope), err
+}
+
+// SendEncryptedTextTo sends an encrypted text message to a single peer, in parts if it is long.
+// It returns the message as sent, stamped for ordering and addressed to the peer's node ID, for
+// local display.
+func (en *EnhancedNode) SendEncryptedTextTo(peerID string, text string) (Message, error) {
+	if err := checkTextSize(text); err != nil {
+		return Message{}, err
+	}
+	envelope := en.newTextEnvelope(text, false)
+	sent := en.localTextMessage(envelope)
+	sent.To = peerID
+	if _, nodeID, err := en.resolvePeer(peerID); err == nil {
+		sent.To = nodeID
+	}
+	return sent, en.sendTextParts(envelope, func(data []byte) error {
+		return en.sendEncryptedTo(peerID, data, "text")
+	})
+}
+
+// newTextEnvelope stamps an outgoing text message; only broadcasts consume a sequence number
+func (en *EnhancedNode) newTextEnvelope(text string, broadcast bool) TextEnvelope {
+	envelope := TextEnvelope{
+		ID:      newMessageID(),
+		Text:    text,
+		Lamport: en.clock.Tick(),
+		Hops:    defaultHopLimit,
+	}
+	if broadcast {
+		envelope.Seq = en.clock.NextSeq()
+	}
+	// Our own message coming back to us is a duplicate too
+	en.seen.First(en.ID, envelope.ID)
+	return envelope
+}
+
+// localTextMessage is our own copy of an outgoing text message
+func (en *EnhancedNode) localTextMessage(envelope TextEnvelope) Message {
+	return Message{
+		SenderID:  en.ID,
+		Content:   []byte(envelope.Text),
+		Lamport:   envelope.Lamport,
+		Seq:       envelope.Seq,
+		Action:    envelope.Kind == TextKindAction,
+		ExpiresAt: envelope.expiresAt(time.Now()),
+		Direct:    envelope.Seq == 0,
+		ID:        envelope.ID,
+	}
+}
 
-📁 File Sharing:
-  /sendfile <peer> <file_path> - Send file to specific peer
+// sendEncryptedTo encrypts a message for one peer and queues it on that peer's connection
+func (en *EnhancedNode) sendEncryptedTo(peerID string, plaintext []byte, msgType string) error {
+	connID, frame, err := en.encryptedFrameFor(peerID, plaintext, msgType)
+	if err != nil {
+		return err
+	}
+	return en.queueFrameTo(connID, peerID, frame)
+}
+
+// queueFrameTo queues a frame on a peer's connection without blocking
+func (en *EnhancedNode) queueFrameTo(connID, peerID string, frame []byte) error {
+	en.peersMutex.RLock()
+	peer, exists := en.conns[connID]
+	en.peersMutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("%w: %s not connected", ErrPeerUnreachable, peerID)
+	}
+
+	select {
+	case peer.Send <- frame:
+		return nil
+	default:
+		return fmt.Errorf("%w for %s", ErrSendQueueFull, peerID)
+	}
+}
+
+// sendEncryptedOnStream sends an encrypted message on the named stream of a peer connected over
+// QUIC, where it doesn't queue behind other traffic. Other peers get it as sendEncryptedTo does.
+func (en *EnhancedNode) sendEncryptedOnStream(peerID, stream string, plaintext []byte, msgType string) error {
+	connID, frame, err := en.encryptedFrameFor(peerID, plaintext, msgType)
+	if err != nil {
+		return err
+	}
+	if streamed, err := en.streamFrameTo(connID, stream, frame); streamed {
+		return err
+	}
+	return en.queueFrameTo(connID, peerID, frame)
+}
+
+// finishStream closes a stream opened by sendEncryptedOnStream once its data is sent
+func (en *EnhancedNode) finishStream(peerID, stream string) {
+	if connID, _, err := en.resolvePeer(peerID); err == nil {
+		en.closeStreamTo(connID, stream)
+	}
+}
+
+// encryptedFrameFor encrypts a message for one peer, returning the frame and the connection it goes on.
+// Peers on an authenticated connection get a session message instead of an envelope.
+func (en *EnhancedNode) encryptedFrameFor(peerID string, plaintext []byte, msgType string) (string, []byte, error) {
+	connID, nodeID, err := en.resolvePeer(peerID)
+	if err != nil {
+		return "", nil, err
+	}
+	if frame, secured, err := en.sessionFrame(connID, nodeID, plaintext, msgType); secured {
+		return connID, frame, err
+	}
+
+	encryptedMsg, err := en.cryptoManager.EncryptMessage(nodeID, plaintext, msgType)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encrypt message for %s: %w", nodeID, err)
+	}
 
-🎙️ Voice Messages:
-  /voice <duration> - Record and send voice message (1-60 seconds)
+	frame, err := newJSONFrame(en.ID, encryptedMsg)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to serialize message for %s: %w", nodeID, err)
+	}
+	return connID, frame, nil
+}
 
-🔒 Encryption:
-  All messages are automatically encrypted
+// resolvePeer maps a connection ID, key fingerprint or node ID to the connection ID and node ID
+// of a connected peer. A node ID is taken to be the connection that proved the key held for it,
+// ahead of any other that merely claims it.
+func (en *EnhancedNode) resolvePeer(peerID string) (string, string, error) {
+	fingerprint, _ := en.cryptoManager.PeerFingerprint(peerID)
 
-📋 Standard Commands:
-  /connect <addr> - Connect to peer
-  /peers - List connected peers
-  /discovered - List discovered peers
-  /quit - Exit application
-`
+	en.peersMutex.RLock()
+	defer en.peersMutex.RUnlock()
+
+	peer := en.conns[peerID]
+	if peer == nil {
+		peer = en.Peers[peerID]
+	}
+	if peer == nil && fingerprint != "" {
+		peer = en.Peers[fingerprint]
+	}
+	if peer == nil {
+		// Given a node ID, find the connection it is reachable on
+		for _, candidate := range en.Peers {
+			if candidate.nodeID() == peerID {
+				peer = candidate
+				break
+			}
+		}
+	}
+	if peer == nil {
+		return "", "", fmt.Errorf("%w: %s not connected", ErrPeerUnreachable, peerID)
+	}
+	return peer.ID, cmp.Or(peer.nodeID(), peer.ID), nil
+}
+
+// resolvePeerRef is resolvePeer for a peer named by the user, which may also be a nick
+func (en *EnhancedNode) resolvePeerRef(ref string) (string, string, error) {
+	connID, nodeID, err := en.resolvePeer(ref)
+	if err == nil {
+		return connID, nodeID, nil
+	}
+	if byNick, found := en.presence.NodeForNick(ref); found {
+		return en.resolvePeer(byNick)
+	}
+	return "", "", err
+}
+
+// peerLabel names a peer for the user: its nick and node ID, or just the node ID
+func (en *EnhancedNode) peerLabel(nodeID string) string {
+	if nick := en.presence.Nick(nodeID); nick != "" {
+		return fmt.Sprintf("%s (%s)", nick, nodeID)
+	}
+	return nodeID
+}
+
+// showEnhancedHelp displays enhanced command help
+func (en *EnhancedNode) showEnhancedHelp() {
+	unavailable := en.voiceManager.unavailableCommands()
+	if en.clipboard == nil {
+		unavailable["/paste"] = "no clipboard tool found"
+		unavailable["/copy"] = "no clipboard tool found"
+	}
+	helpText := "Commands:\n\n" + renderCommandHelp(unavailable) +
+		"🔒 All messages are encrypted; anything that isn't a command is sent to every peer.\n"
 
 	if en.uiChannel != nil {
-		en.uiChannel <- Message{
+		en.notifyUI(Message{
 			SenderID: "System",
 			Content:  []byte(helpText),
-		}
+		})
 	} else {
 		fmt.Println(helpText)
 	}
@@ -339,17 +1105,58 @@ func (en *EnhancedNode) showEnhancedHelp() {
 func (en *EnhancedNode) StartEnhanced() {
 	log.Printf("Starting enhanced P2P chat node %s", en.ID)
 	log.Printf("Features: 🔒 Encryption | 📁 File Sharing | 🎙️ Voice Messages")
-	fmt.Println("Commands: /help for help, /quit to exit")
+	if !en.headless && en.pipeInput == nil {
+		fmt.Println("Commands: /help for help, /quit to exit")
+	}
+
+	// Start the base node, accepting on every listen address
+	for _, listener := range en.listeners {
+		en.wg.Add(1)
+		go en.handleServer(listener)
+	}
+
+	if en.uiChannel != nil {
+		en.wg.Add(1)
+		go en.dispatchUI()
+	}
+
+	if !en.headless {
+		en.startCLI()
+	}
+
+	en.wg.Add(1)
+	go en.exchangePeerRecords()
+
+	en.wg.Add(1)
+	go en.redialDiscovered()
 
-	// Start the base node
 	en.wg.Add(1)
-	go en.handleServer()
+	go en.meterTraffic()
 
 	en.wg.Add(1)
-	go en.handleCLI()
+	go en.refreshPresence()
 
 	en.wg.Add(1)
-	go en.gossipPeerList()
+	go en.expireMessages()
+
+	en.wg.Add(1)
+	go en.fileManager.expireIncoming()
+
+	en.wg.Add(1)
+	go en.measureLatency()
+
+	if en.rendezvousServer != "" {
+		en.wg.Add(1)
+		go en.registerWithRendezvous()
+	}
+
+	if en.dht != nil {
+		en.wg.Add(1)
+		go en.handleDHT()
+
+		en.wg.Add(1)
+		go en.maintainDHT()
+	}
 
 	if en.discoveryConn != nil {
 		en.wg.Add(1)
@@ -365,17 +1172,9 @@ func (en *EnhancedNode) StartEnhanced() {
 		defer en.wg.Done()
 		for {
 			select {
-			case peer := <-en.NewPeer:
-				en.addPeer(peer)
-				// Send public key to new peer
-				go en.sendPublicKey(peer.ID)
-
-			case peerID := <-en.RemovePeer:
-				en.removePeer(peerID)
-
 			case msg := <-en.IncomingMsg:
 				// Handle incoming messages (no race condition now)
-				en.handleIncomingMessage(msg)
+				en.handleIncomingSafely(msg)
 
 			case input := <-en.CLIInput:
 				en.handleEnhancedCLICommand(input, en.ID)
@@ -383,9 +1182,6 @@ func (en *EnhancedNode) StartEnhanced() {
 			case peerAddr := <-en.DiscoveredPeer:
 				en.handleDiscoveredPeer(peerAddr)
 
-			case peerList := <-en.PeerListGossip:
-				en.handlePeerListGossip(peerList)
-
 			case <-en.Shutdown:
 				return
 			}
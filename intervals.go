@@ -0,0 +1,60 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+const (
+	announceInterval    = 5 * time.Second // Discovery announcements while the node has few peers
+	announceMaxInterval = 2 * time.Minute // Longest the announcements back off to
+	healthyPeerCount    = 3               // Connected peers from which announcements back off
+	jitterFraction      = 0.2             // Periodic work runs this fraction of its interval early or late
+)
+
+// jitter spreads an interval by up to jitterFraction either way, so nodes started together don't
+// announce and gossip in step
+func (n *Node) jitter(interval time.Duration) time.Duration {
+	spread := (n.random.Float64()*2 - 1) * jitterFraction
+	return interval + time.Duration(spread*float64(interval))
+}
+
+// nextAnnounceInterval is the wait after an announcement made with peers connected: it doubles up
+// to announceMaxInterval while the node has healthyPeerCount peers, is back to announceInterval
+// when it has none, and otherwise stays as it is
+func nextAnnounceInterval(interval time.Duration, peers int) time.Duration {
+	switch {
+	case peers == 0:
+		return announceInterval
+	case peers >= healthyPeerCount:
+		return min(2*interval, announceMaxInterval)
+	}
+	return interval
+}
+
+// gossipChanged reports whether a gossip round would tell peers anything new: whether the peer
+// list, or the peers it goes to, changed since the last time it returned true. Only the gossip
+// goroutine calls it.
+func (n *Node) gossipChanged(gossip []byte) bool {
+	n.peersMutex.RLock()
+	connected := make([]string, 0, len(n.Peers))
+	for _, peer := range n.Peers {
+		connected = append(connected, peer.ID)
+	}
+	n.peersMutex.RUnlock()
+	sort.Strings(connected)
+
+	hash := fnv.New64a()
+	hash.Write(gossip)
+	for _, id := range connected {
+		hash.Write([]byte{0})
+		hash.Write([]byte(id))
+	}
+	sum := hash.Sum64()
+	if sum == n.gossipHash {
+		return false
+	}
+	n.gossipHash = sum
+	return true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestJitter spreads an interval up to 20% either way, by the node's random source
+func TestJitter(t *testing.T) {
+	for _, tc := range []struct {
+		random float64
+		want   time.Duration
+	}{
+		{0, 8 * time.Second},
+		{0.5, 10 * time.Second},
+		{0.75, 11 * time.Second},
+		{0.9999999, 12 * time.Second},
+	} {
+		node := &Node{random: fixedRandom{tc.random}}
+		if got := node.jitter(10 * time.Second); got.Round(time.Millisecond) != tc.want {
+			t.Errorf("jitter with %v: %s, want %s", tc.random, got, tc.want)
+		}
+	}
+}
+
+// TestAnnounceBackoff doubles the announce interval while enough peers are connected, up to the
+// cap, and goes back to announcing fast once they are gone
+func TestAnnounceBackoff(t *testing.T) {
+	interval := announceInterval
+	var intervals []time.Duration
+	for _, peers := range []int{1, 3, 3, 4, 3, 3, 3, 3, 3, 2, 0, 3} {
+		interval = nextAnnounceInterval(interval, peers)
+		intervals = append(intervals, interval)
+	}
+	s := time.Second
+	want := []time.Duration{5 * s, 10 * s, 20 * s, 40 * s, 80 * s, announceMaxInterval, announceMaxInterval,
+		announceMaxInterval, announceMaxInterval, announceMaxInterval, announceInterval, 10 * s}
+	for i := range want {
+		if intervals[i] != want[i] {
+			t.Fatalf("intervals %v, want %v", intervals, want)
+		}
+	}
+}
+
+// TestGossipChanged skips a gossip round that would repeat the last one to the same peers
+func TestGossipChanged(t *testing.T) {
+	node := &Node{Peers: map[string]*Peer{"a": {ID: "a"}}}
+	gossip := []byte("GOSSIP_PEERS:a")
+	if !node.gossipChanged(gossip) {
+		t.Error("the first round was skipped")
+	}
+	if node.gossipChanged(gossip) {
+		t.Error("an unchanged round wasn't skipped")
+	}
+	if !node.gossipChanged([]byte("GOSSIP_PEERS:a,b")) {
+		t.Error("a round with a new list was skipped")
+	}
+	node.Peers["b"] = &Peer{ID: "b"}
+	if !node.gossipChanged([]byte("GOSSIP_PEERS:a,b")) {
+		t.Error("a round to a new peer was skipped")
+	}
+}
+
+// TestGossipRounds runs a node's gossip on a fake clock with the jitter at its earliest: rounds
+// come 20% before gossipInterval, and the peer list goes to a legacy peer in the first round and
+// then only once it changes
+func TestGossipRounds(t *testing.T) {
+	clock := newFakeClock()
+	tn := newTestNetwork(t, 0)
+	node := tn.newNode(WithClock(clock), WithRandom(fixedRandom{0}))
+	node.rememberAddr(memoryHost + ":7001")
+	tn.start(node)
+	conn := dialLegacy(t, tn, node)
+
+	var mutex sync.Mutex
+	var gossip []string
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			// An empty list is a keepalive
+			if _, list, ok := strings.Cut(scanner.Text(), "GOSSIP_PEERS:"); ok && list != "" {
+				mutex.Lock()
+				gossip = append(gossip, list)
+				mutex.Unlock()
+			}
+		}
+	}()
+	received := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return slices.Clone(gossip)
+	}
+
+	round := gossipInterval - time.Duration(jitterFraction*float64(gossipInterval))
+	advance := func() {
+		t.Helper()
+		clock.waitForTimer(t, round)
+		clock.Advance(round)
+	}
+	advance()
+	waitFor(t, "the first round", func() bool { return len(received()) == 1 })
+	for range 3 {
+		advance()
+	}
+
+	// Rounds go out in order, so once the changed list arrives the unchanged ones would have too
+	node.rememberAddr(memoryHost + ":7002")
+	advance()
+	waitFor(t, "the changed list", func() bool {
+		got := received()
+		return len(got) > 0 && strings.Contains(got[len(got)-1], memoryHost+":7002")
+	})
+	if got := received(); len(got) != 2 {
+		t.Errorf("gossiped %d times over five rounds, want 2: %q", len(got), got)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// sendTextTimeout is how long SendText waits for the peer's key and then its acknowledgement
+const sendTextTimeout = 30 * time.Second
+
+// Delivery is the outcome of a SendText, known once the peer acknowledges the message or the send
+// fails. It is safe to use from any goroutine.
+type Delivery struct {
+	ctx  context.Context
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the outcome is known
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns nil if the peer acknowledged the message, or why it didn't: ErrNoPeerKey,
+// ErrPeerUnreachable, ErrNoAck, or another send error. It is nil until Done is closed.
+func (d *Delivery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the outcome is known and returns Err, or until the context SendText was
+// given is done and returns its error. The send goes on either way; Done and Err still report it.
+func (d *Delivery) Wait() error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+}
+
+// SendText sends a direct text message to a peer, by connection or node ID, asking it to
+// acknowledge the message, and returns without waiting. The message is shown and logged like one
+// sent with /msg. ctx bounds only Wait: cancelling it doesn't take the message back or stop the
+// node waiting sendTextTimeout for the acknowledgement.
+func (en *EnhancedNode) SendText(ctx context.Context, target, text string) *Delivery {
+	delivery := &Delivery{ctx: ctx, done: make(chan struct{})}
+	go func() {
+		delivery.err = en.sendTextConfirmed(target, text, sendTextTimeout, en.wallClock, en.notifyUI)
+		close(delivery.done)
+	}()
+	return delivery
+}
+
+// PeerEvent is a connection to a peer opening or closing
+type PeerEvent struct {
+	Peer      string // Connection ID, as GET /peers lists it
+	Connected bool   // False when the connection closed
+	Time      time.Time
+}
+
+// OnMessage calls fn with every message the node shows, ours and system notices included, from
+// now until the returned function is called. Calls for one sender come one at a time, in the order
+// the messages were shown; calls for different senders may run at once. A subscriber that falls
+// eventClientBuffer messages behind on one sender loses the oldest of them. Calling the returned
+// function stops further calls, though one already under way finishes; it is safe to call from fn
+// and more than once.
+func (en *EnhancedNode) OnMessage(fn func(Message)) func() {
+	return en.subscribeCallbacks(map[string]bool{eventMessage: true}, func(event Event) (string, func()) {
+		logged, ok := event.Data.(LoggedMessage)
+		if !ok {
+			return "", nil
+		}
+		msg := logged.message()
+		return msg.SenderID, func() { fn(msg) }
+	})
+}
+
+// OnPeer calls fn as connections to peers open and close, with the same guarantees as OnMessage:
+// calls for one connection are serialized and in order, so a peer's disconnect is never reported
+// before its connect.
+func (en *EnhancedNode) OnPeer(fn func(PeerEvent)) func() {
+	types := map[string]bool{eventPeerConnected: true, eventPeerDisconnected: true}
+	return en.subscribeCallbacks(types, func(event Event) (string, func()) {
+		data, ok := event.Data.(peerEvent)
+		if !ok {
+			return "", nil
+		}
+		peer := PeerEvent{Peer: data.Peer, Connected: event.Type == eventPeerConnected, Time: event.Time}
+		return peer.Peer, func() { fn(peer) }
+	})
+}
+
+// subscribeCallbacks takes events of the given types from the event feed and runs the call
+// convert makes of each, serialized per the peer it names. It returns the unsubscribe function.
+func (en *EnhancedNode) subscribeCallbacks(types map[string]bool, convert func(Event) (string, func())) func() {
+	client := en.events.Subscribe(types, 0)
+	calls := &callbackQueue{pending: make(map[string][]func())}
+	stop := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-client.ready:
+				events, dropped := client.take()
+				if dropped > 0 {
+					log.Printf("Callback subscriber fell behind, %d events dropped", dropped)
+				}
+				for _, event := range events {
+					if peer, call := convert(event); call != nil {
+						calls.run(peer, call)
+					}
+				}
+			case <-stop:
+				return
+			case <-en.Shutdown:
+				calls.stop()
+				en.events.Unsubscribe(client)
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			en.events.Unsubscribe(client)
+			calls.stop()
+			close(stop)
+		})
+	}
+}
+
+// callbackQueue runs a subscriber's callbacks one at a time per peer, each peer on its own
+// goroutine for as long as it has calls waiting, so a slow callback holds up only its peer
+type callbackQueue struct {
+	mutex   sync.Mutex
+	stopped bool
+	pending map[string][]func() // Calls waiting, per peer; a peer listed here has a goroutine running them
+}
+
+// run queues a call for a peer, dropping the peer's oldest waiting call if eventClientBuffer are
+// already waiting
+func (q *callbackQueue) run(peer string, call func()) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.stopped {
+		return
+	}
+	queue, running := q.pending[peer]
+	if len(queue) >= eventClientBuffer {
+		queue[0] = nil
+		queue = queue[1:]
+		log.Printf("Callbacks for %s fell behind, dropping the oldest", peer)
+	}
+	q.pending[peer] = append(queue, call)
+	if !running {
+		go q.drain(peer)
+	}
+}
+
+// drain runs a peer's waiting calls in order until none are left or the queue is stopped
+func (q *callbackQueue) drain(peer string) {
+	for {
+		q.mutex.Lock()
+		queue := q.pending[peer]
+		if q.stopped || len(queue) == 0 {
+			delete(q.pending, peer)
+			q.mutex.Unlock()
+			return
+		}
+		call := queue[0]
+		queue[0] = nil
+		q.pending[peer] = queue[1:]
+		q.mutex.Unlock()
+
+		call()
+	}
+}
+
+// stop drops the waiting calls; no more start after it returns, though one under way finishes
+func (q *callbackQueue) stop() {
+	q.mutex.Lock()
+	q.stopped = true
+	q.mutex.Unlock()
+}
+
+// message turns a logged message back into the form the UI was given
+func (lm LoggedMessage) message() Message {
+	msg := Message{
+		SenderID:        lm.SenderID,
+		Content:         []byte(lm.Content),
+		FromPeerID:      lm.FromPeerID,
+		Lamport:         lm.Lamport,
+		Seq:             lm.Seq,
+		Timestamp:       lm.Timestamp,
+		Backfill:        lm.Backfill,
+		Mention:         lm.Mention,
+		Action:          lm.Action,
+		Direct:          lm.Direct,
+		To:              lm.To,
+		Attachment:      lm.Attachment,
+		ID:              lm.MessageID,
+		SenderKey:       lm.SenderKey,
+		ReadIDs:         lm.Read,
+		Room:            lm.Room,
+		Conversation:    lm.Conversation,
+		ConversationKey: lm.ConversationKey,
+	}
+	if lm.ExpiresAt != nil {
+		msg.ExpiresAt = *lm.ExpiresAt
+	}
+	return msg
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects what callbacks are given, from whichever goroutine calls them
+type recorder[T any] struct {
+	mutex sync.Mutex
+	got   []T
+}
+
+func (r *recorder[T]) add(v T) {
+	r.mutex.Lock()
+	r.got = append(r.got, v)
+	r.mutex.Unlock()
+}
+
+func (r *recorder[T]) all() []T {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return slices.Clone(r.got)
+}
+
+// textsFrom returns the content of the messages from sender
+func textsFrom(msgs []Message, sender string) []string {
+	var texts []string
+	for _, msg := range msgs {
+		if msg.SenderID == sender {
+			texts = append(texts, string(msg.Content))
+		}
+	}
+	return texts
+}
+
+// TestSendText sends a message through the library API: the delivery reports the ack, and both
+// ends' OnMessage subscribers are given the message
+func TestSendText(t *testing.T) {
+	_, a, b := connectedPair(t)
+
+	var sent, received recorder[Message]
+	defer a.OnMessage(sent.add)()
+	defer b.OnMessage(received.add)()
+
+	delivery := a.SendText(context.Background(), b.ID, "hello, library")
+	if err := delivery.Wait(); err != nil {
+		t.Fatalf("delivery: %v", err)
+	}
+	select {
+	case <-delivery.Done():
+	default:
+		t.Error("Wait returned before Done was closed")
+	}
+	if delivery.Err() != nil {
+		t.Errorf("Err: %v", delivery.Err())
+	}
+
+	waitFor(t, "b's callback", func() bool { return len(textsFrom(received.all(), a.ID)) == 1 })
+	msg := received.all()[slices.IndexFunc(received.all(), func(msg Message) bool { return msg.SenderID == a.ID })]
+	if string(msg.Content) != "hello, library" || !msg.Direct || msg.ID == "" {
+		t.Errorf("b was given %+v", msg)
+	}
+	waitFor(t, "a's copy", func() bool { return slices.Contains(textsFrom(sent.all(), a.ID), "hello, library") })
+	if own := sent.all()[slices.IndexFunc(sent.all(), func(msg Message) bool { return msg.SenderID == a.ID })]; own.To != b.ID {
+		t.Errorf("a's copy is to %q, want %q", own.To, b.ID)
+	}
+}
+
+// TestSendTextCancelled gives up waiting for a delivery: the wait ends, the send doesn't
+func TestSendTextCancelled(t *testing.T) {
+	_, a, b := connectedPair(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	delivery := a.SendText(ctx, b.ID, "sent anyway")
+	if err := delivery.Wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait: %v, want context.Canceled", err)
+	}
+	select {
+	case <-delivery.Done():
+	case <-time.After(testWait):
+		t.Fatal("no outcome after cancelling")
+	}
+	if err := delivery.Err(); err != nil {
+		t.Errorf("cancelling the wait failed the send: %v", err)
+	}
+	waitForText(t, b, a.ID, "sent anyway")
+
+	// A failure is reported the same way
+	delivery = a.SendText(context.Background(), b.ID, strings.Repeat("x", maxLongTextBytes+1))
+	if err := delivery.Wait(); !errors.Is(err, errMessageTooLarge) || !errors.Is(delivery.Err(), errMessageTooLarge) {
+		t.Errorf("an oversized text: %v", err)
+	}
+}
+
+// heldTransport withholds what its connections read while held, for a peer that has stopped
+// processing anything
+type heldTransport struct {
+	Transport
+	gate *sync.RWMutex
+}
+
+type heldListener struct {
+	net.Listener
+	gate *sync.RWMutex
+}
+
+type heldConn struct {
+	net.Conn
+	gate *sync.RWMutex
+}
+
+func (ht heldTransport) Listen(addr string) (net.Listener, error) {
+	listener, err := ht.Transport.Listen(addr)
+	return heldListener{listener, ht.gate}, err
+}
+
+func (hl heldListener) Accept() (net.Conn, error) {
+	conn, err := hl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return heldConn{conn, hl.gate}, nil
+}
+
+func (hc heldConn) Read(p []byte) (int, error) {
+	n, err := hc.Conn.Read(p)
+	hc.gate.RLock()
+	hc.gate.RUnlock()
+	return n, err
+}
+
+// TestSendTextNoAck sends to a peer that has stopped processing: the send times out with ErrNoAck,
+// and the message still arrives once the peer catches up
+func TestSendTextNoAck(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	a := tn.nodes[0]
+	gate := &sync.RWMutex{}
+	b := tn.addNode(WithTransport(heldTransport{tn.network, gate}))
+	tn.connect(a, b)
+
+	gate.Lock()
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			gate.Unlock()
+		}
+	}
+	t.Cleanup(release)
+
+	if err := a.SendTextAndConfirm(b.ID, "never acknowledged", 200*time.Millisecond); !errors.Is(err, ErrNoAck) {
+		t.Fatalf("got %v, want ErrNoAck", err)
+	}
+	// It did go: the peer shows it once it catches up
+	release()
+	waitForText(t, b, a.ID, "never acknowledged")
+}
+
+// TestSendTextDeliveryNoAck has SendText's delivery give up on a peer that never acknowledges,
+// after sendTextTimeout on the node's clock: Done closes and Err and Wait both say ErrNoAck
+func TestSendTextDeliveryNoAck(t *testing.T) {
+	clock := newFakeClock()
+	tn := newTestNetwork(t, 0)
+	a := tn.newNode(WithClock(clock))
+	tn.start(a)
+	gate := &sync.RWMutex{}
+	b := tn.addNode(WithTransport(heldTransport{tn.network, gate}))
+	tn.connect(a, b)
+
+	gate.Lock()
+	defer gate.Unlock()
+	delivery := a.SendText(context.Background(), b.ID, "never acknowledged")
+	clock.waitForTimer(t, sendTextTimeout)
+	clock.Advance(sendTextTimeout - time.Second)
+	select {
+	case <-delivery.Done():
+		t.Fatalf("gave up before the timeout: %v", delivery.Err())
+	case <-time.After(50 * time.Millisecond):
+	}
+	if delivery.Err() != nil {
+		t.Errorf("Err before the outcome is known: %v", delivery.Err())
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-delivery.Done():
+	case <-time.After(testWait):
+		t.Fatal("the delivery didn't time out")
+	}
+	if err := delivery.Wait(); !errors.Is(err, ErrNoAck) || !errors.Is(delivery.Err(), ErrNoAck) {
+		t.Errorf("Wait gave %v and Err %v, want ErrNoAck", err, delivery.Err())
+	}
+}
+
+// TestOnMessageSubscribers gives every subscriber every message in order, and stops calling one
+// once it unsubscribes, from its own callback or more than once
+func TestOnMessageSubscribers(t *testing.T) {
+	_, a, b := connectedPair(t)
+
+	var first, second recorder[Message]
+	unsubscribeFirst := b.OnMessage(first.add)
+	defer b.OnMessage(second.add)()
+
+	// One that unsubscribes itself from its own callback
+	var selfRemoving recorder[Message]
+	var unsubscribeSelf func()
+	var subscribed sync.WaitGroup
+	subscribed.Add(1)
+	unsubscribeSelf = b.OnMessage(func(msg Message) {
+		subscribed.Wait()
+		if msg.SenderID == a.ID {
+			selfRemoving.add(msg)
+			unsubscribeSelf()
+		}
+	})
+	subscribed.Done()
+
+	var want []string
+	for i := range 5 {
+		text := fmt.Sprintf("message %d", i)
+		want = append(want, text)
+		if _, err := a.SendEncryptedText(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, sub := range map[string]*recorder[Message]{"first": &first, "second": &second} {
+		waitFor(t, name+" subscriber's messages", func() bool { return len(textsFrom(sub.all(), a.ID)) == len(want) })
+		if got := textsFrom(sub.all(), a.ID); !slices.Equal(got, want) {
+			t.Errorf("%s subscriber got %v, want them in order", name, got)
+		}
+	}
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	if _, err := a.SendEncryptedText("after unsubscribing"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the remaining subscriber", func() bool {
+		return slices.Contains(textsFrom(second.all(), a.ID), "after unsubscribing")
+	})
+	if got := textsFrom(first.all(), a.ID); len(got) != len(want) {
+		t.Errorf("called after unsubscribing: %v", got)
+	}
+	if got := textsFrom(selfRemoving.all(), a.ID); len(got) != 1 {
+		t.Errorf("a subscriber that unsubscribed in its first call got %v", got)
+	}
+}
+
+// TestOnPeer reports a peer's connect and then its disconnect
+func TestOnPeer(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+
+	var events recorder[PeerEvent]
+	defer a.OnPeer(events.add)()
+
+	tn.connect(b, a)
+	waitFor(t, "the connect", func() bool { return len(events.all()) == 1 })
+	connected := events.all()[0]
+	if !connected.Connected || connected.Peer == "" || connected.Time.IsZero() {
+		t.Errorf("connect reported as %+v", connected)
+	}
+
+	if !b.shutdownWithin(testWait) {
+		t.Fatal("b didn't shut down")
+	}
+	waitFor(t, "the disconnect", func() bool { return len(events.all()) == 2 })
+	if disconnected := events.all()[1]; disconnected.Connected || disconnected.Peer != connected.Peer {
+		t.Errorf("disconnect reported as %+v, after %+v", disconnected, connected)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Size limits on everything peers send, and on what is sent to them. Frames are checked as they
+// are read, before a frame that is too long is buffered; the rest as soon as their size is known.
+const (
+	maxFrameBytes         = 64 * 1024       // Longest wire frame, sender and newline included
+	maxEnvelopeBytes      = 45 * 1024       // Largest message before encryption; base64 and the envelope grow it to fit a frame
+	maxTextBytes          = 16 * 1024       // Longest text in one message; longer text is sent in parts
+	maxLongTextBytes      = 1 << 20         // Longest text sent in parts, and reassembled
+	maxTextParts          = 1024            // Most parts of one text; the longest text, escaped to six bytes a character, takes 513
+	maxPendingTexts       = 8               // Texts being reassembled at once from one connection
+	maxFileBytes          = 512 << 20       // Largest file offered or accepted; both ends hold all of it in memory
+	maxChunkBytes         = chunkSize       // Largest file chunk, decoded
+	maxVoiceTransferBytes = 4 * 1024 * 1024 // Largest voice message accepted; a minute of WAV is under 2 MB
+	maxSizeViolations     = 3               // Oversized messages from one connection before it is dropped as abusive
+)
+
+// errMessageTooLarge is returned for outgoing messages over the limits, and wraps the reason
+// incoming ones were dropped
+var errMessageTooLarge = errors.New("message too large")
+
+// checkTextSize refuses text too long to send, even in parts
+func checkTextSize(text string) error {
+	if len(text) > maxLongTextBytes {
+		return fmt.Errorf("%w: %s of text, over the %s limit; send it as a file with /sendfile instead",
+			errMessageTooLarge, formatBytes(int64(len(text))), formatBytes(maxLongTextBytes))
+	}
+	return nil
+}
+
+// checkTextEnvelope refuses a received text message, or part of one, over the limits
+func checkTextEnvelope(envelope TextEnvelope) error {
+	if len(envelope.Text) > maxTextBytes {
+		return fmt.Errorf("%w: %s of text in one message, over the %s limit", errMessageTooLarge,
+			formatBytes(int64(len(envelope.Text))), formatBytes(maxTextBytes))
+	}
+	if envelope.Parts > maxTextParts || envelope.Parts < 0 || envelope.Part < 0 || envelope.Part > envelope.Parts {
+		return fmt.Errorf("%w: part %d of %d", errMessageTooLarge, envelope.Part, envelope.Parts)
+	}
+	return nil
+}
+
+// checkEnvelopeSize refuses a message too large to encrypt into one frame
+func checkEnvelopeSize(plaintext []byte, msgType string) error {
+	if len(plaintext) > maxEnvelopeBytes {
+		return fmt.Errorf("%w: %s %q message, over the %s limit", errMessageTooLarge,
+			formatBytes(int64(len(plaintext))), msgType, formatBytes(maxEnvelopeBytes))
+	}
+	return nil
+}
+
+// checkFileRequest refuses an offer for a file over the limit, or whose chunk count doesn't
+// match its size
+func checkFileRequest(fileMsg FileMessage) error {
+	if fileMsg.FileSize < 0 {
+		return fmt.Errorf("%w: offered a file of %d bytes", errMessageTooLarge, fileMsg.FileSize)
+	}
+	if fileMsg.FileSize > maxFileBytes {
+		return fmt.Errorf("%w: offered a %s file, over the %s limit", errMessageTooLarge,
+			formatBytes(fileMsg.FileSize), formatBytes(maxFileBytes))
+	}
+	if expected := (fileMsg.FileSize + maxChunkBytes - 1) / maxChunkBytes; int64(fileMsg.TotalChunks) != expected {
+		return fmt.Errorf("%w: offered %s in %d chunks, where it takes %d", errMessageTooLarge,
+			formatBytes(fileMsg.FileSize), fileMsg.TotalChunks, expected)
+	}
+	return nil
+}
+
+// checkFileChunk refuses a chunk over the chunk size, or outside the transfer, before its data
+// is decoded
+func checkFileChunk(fileMsg FileMessage, totalChunks int) error {
+	padding := len(fileMsg.Data) - len(strings.TrimRight(fileMsg.Data, "="))
+	if size := base64.StdEncoding.DecodedLen(len(fileMsg.Data)) - padding; size > maxChunkBytes {
+		return fmt.Errorf("%w: a %s file chunk, over the %s limit", errMessageTooLarge,
+			formatBytes(int64(size)), formatBytes(maxChunkBytes))
+	}
+	if fileMsg.ChunkIndex < 0 || fileMsg.ChunkIndex >= totalChunks {
+		return fmt.Errorf("%w: chunk %d of a %d-chunk file", errMessageTooLarge, fileMsg.ChunkIndex, totalChunks)
+	}
+	return nil
+}
+
+// newFrameScanner reads the newline-terminated frames of a connection. A frame longer than
+// maxFrameBytes is discarded as it arrives, never buffered whole, and oversized is called for it;
+// reading goes on with the next frame.
+func newFrameScanner(r io.Reader, oversized func()) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxFrameBytes)
+	discarding := false
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if discarding {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				discarding = false
+				return i + 1, nil, nil
+			}
+			return len(data), nil, nil
+		}
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && len(data) >= maxFrameBytes {
+			discarding = true
+			oversized()
+			return len(data), nil, nil
+		}
+		return advance, token, err
+	})
+	return scanner
+}
+
+// oversized records a message over the size limits from a connection, logging the first and
+// dropping the connection once there have been maxSizeViolations. The message itself is dropped
+// by the caller.
+func (n *Node) oversized(peer *Peer, reason error) {
+	if n.peerOversized != nil {
+		n.peerOversized(peer.ID)
+	}
+	count := peer.oversized.Add(1)
+	switch {
+	case count == 1:
+		log.Printf("Dropped a message from %s: %v (further ones aren't logged)", peer.ID, reason)
+	case count == maxSizeViolations:
+		log.Printf("Disconnecting %s: %d messages over the size limits", peer.ID, count)
+		peer.once.Do(func() {
+			close(peer.Done)
+		})
+	}
+}
+
+// oversizedFrom is oversized for a peer given by connection ID or node ID
+func (en *EnhancedNode) oversizedFrom(peerID string, reason error) {
+	connID, _, err := en.resolvePeer(peerID)
+	if err != nil {
+		log.Printf("Dropped a message from %s: %v", peerID, reason)
+		return
+	}
+	en.peersMutex.RLock()
+	peer, exists := en.conns[connID]
+	en.peersMutex.RUnlock()
+	if exists {
+		en.oversized(peer, reason)
+	}
+}
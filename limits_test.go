@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestSizeLimits checks each limit at its boundary: at the limit is accepted, one over is not
+func TestSizeLimits(t *testing.T) {
+	chunk := func(size int) string { return base64.StdEncoding.EncodeToString(make([]byte, size)) }
+	for _, tc := range []struct {
+		name string
+		err  error
+		ok   bool
+	}{
+		{"text at the limit", checkTextSize(strings.Repeat("a", maxLongTextBytes)), true},
+		{"text over the limit", checkTextSize(strings.Repeat("a", maxLongTextBytes+1)), false},
+		{"message text at the limit", checkTextEnvelope(TextEnvelope{Text: strings.Repeat("a", maxTextBytes)}), true},
+		{"message text over the limit", checkTextEnvelope(TextEnvelope{Text: strings.Repeat("a", maxTextBytes+1)}), false},
+		{"most parts", checkTextEnvelope(TextEnvelope{Part: maxTextParts, Parts: maxTextParts}), true},
+		{"too many parts", checkTextEnvelope(TextEnvelope{Part: 1, Parts: maxTextParts + 1}), false},
+		{"part past the last", checkTextEnvelope(TextEnvelope{Part: 3, Parts: 2}), false},
+		{"negative part", checkTextEnvelope(TextEnvelope{Part: -1, Parts: 2}), false},
+		{"negative parts", checkTextEnvelope(TextEnvelope{Parts: -1}), false},
+		{"envelope at the limit", checkEnvelopeSize(make([]byte, maxEnvelopeBytes), "text"), true},
+		{"envelope over the limit", checkEnvelopeSize(make([]byte, maxEnvelopeBytes+1), "text"), false},
+		{"file at the limit", checkFileRequest(FileMessage{FileSize: maxFileBytes, TotalChunks: maxFileBytes / maxChunkBytes}), true},
+		{"file over the limit", checkFileRequest(FileMessage{FileSize: maxFileBytes + 1, TotalChunks: maxFileBytes/maxChunkBytes + 1}), false},
+		{"file claiming 2^62 bytes", checkFileRequest(FileMessage{FileSize: 1 << 62, TotalChunks: 1}), false},
+		{"negative file size", checkFileRequest(FileMessage{FileSize: -1}), false},
+		{"empty file", checkFileRequest(FileMessage{}), true},
+		{"chunk count short of the size", checkFileRequest(FileMessage{FileSize: maxChunkBytes + 1, TotalChunks: 1}), false},
+		{"chunk at the limit", checkFileChunk(FileMessage{Data: chunk(maxChunkBytes)}, 1), true},
+		{"chunk over the limit", checkFileChunk(FileMessage{Data: chunk(maxChunkBytes + 1)}, 1), false},
+		{"last chunk", checkFileChunk(FileMessage{Data: chunk(1), ChunkIndex: 3}, 4), true},
+		{"chunk past the last", checkFileChunk(FileMessage{Data: chunk(1), ChunkIndex: 4}, 4), false},
+		{"negative chunk", checkFileChunk(FileMessage{Data: chunk(1), ChunkIndex: -1}, 4), false},
+	} {
+		if tc.ok && tc.err != nil {
+			t.Errorf("%s: refused: %v", tc.name, tc.err)
+		}
+		if !tc.ok && !errors.Is(tc.err, errMessageTooLarge) {
+			t.Errorf("%s: %v, want errMessageTooLarge", tc.name, tc.err)
+		}
+	}
+}
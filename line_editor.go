@@ -0,0 +1,161 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rivo/uniseg"
+)
+
+const consoleQuitWindow = 2 * time.Second // A second Ctrl+C on an empty line within this quits
+
+// editAction is what the Console has to do on the terminal after a key
+type editAction int
+
+const (
+	editRedraw   editAction = iota // The line or cursor may have changed
+	editIgnored                    // Nothing changed
+	editSubmit                     // Enter on a line: it is done
+	editEmpty                      // Enter on an empty line
+	editCancel                     // Ctrl+C threw the line away
+	editQuitHint                   // Ctrl+C on an empty line; another soon after quits
+	editQuit                       // The second Ctrl+C on an empty line
+	editEOF                        // Ctrl+D on an empty line
+	editClear                      // Ctrl+L: clear the screen
+)
+
+// lineEditor is the line being typed in the plain CLI and what the editing keys do to it, kept
+// apart from the terminal the Console reads keys from and draws it on
+type lineEditor struct {
+	line    []rune // The line being edited
+	cursor  int    // Position in line, in runes
+	history *InputHistory
+
+	interruptedAt time.Time // When Ctrl+C last cancelled an empty line
+}
+
+// newLineEditor creates an empty editor with a history kept only in memory
+func newLineEditor() *lineEditor {
+	history, _ := NewInputHistory("") // Only fails reading a file
+	return &lineEditor{history: history}
+}
+
+// key handles a key other than an escape sequence typed at now. A submitted line is returned
+// with editSubmit and added to the history.
+func (le *lineEditor) key(r rune, now time.Time) (editAction, string) {
+	if r != 3 {
+		le.interruptedAt = time.Time{}
+	}
+	switch r {
+	case '\r', '\n':
+		line := string(le.line)
+		le.line, le.cursor = nil, 0
+		if line == "" {
+			return editEmpty, ""
+		}
+		le.history.Add(line)
+		return editSubmit, line
+	case 3: // Ctrl+C
+		if len(le.line) > 0 {
+			le.line, le.cursor = nil, 0
+			return editCancel, ""
+		}
+		if !le.interruptedAt.IsZero() && now.Sub(le.interruptedAt) < consoleQuitWindow {
+			return editQuit, ""
+		}
+		le.interruptedAt = now
+		return editQuitHint, ""
+	case 4: // Ctrl+D
+		if len(le.line) == 0 {
+			return editEOF, ""
+		}
+		le.deleteAt(le.cursor)
+	case 1: // Ctrl+A
+		le.cursor = 0
+	case 5: // Ctrl+E
+		le.cursor = len(le.line)
+	case 2: // Ctrl+B
+		le.cursor = max(le.cursor-1, 0)
+	case 6: // Ctrl+F
+		le.cursor = min(le.cursor+1, len(le.line))
+	case 0x7f, 8: // Backspace
+		if le.cursor > 0 {
+			le.cursor--
+			le.deleteAt(le.cursor)
+		}
+	case 11: // Ctrl+K
+		le.line = le.line[:le.cursor]
+	case 21: // Ctrl+U
+		le.line = append([]rune(nil), le.line[le.cursor:]...)
+		le.cursor = 0
+	case 23: // Ctrl+W
+		start := le.cursor
+		for start > 0 && le.line[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && le.line[start-1] != ' ' {
+			start--
+		}
+		le.line = append(le.line[:start], le.line[le.cursor:]...)
+		le.cursor = start
+	case 12: // Ctrl+L
+		return editClear, ""
+	default:
+		if r < ' ' {
+			return editIgnored, ""
+		}
+		le.line = append(le.line[:le.cursor], append([]rune{r}, le.line[le.cursor:]...)...)
+		le.cursor++
+	}
+	return editRedraw, ""
+}
+
+// escape handles an arrow or editing key sent as an escape sequence, such as "[A" or "[3~",
+// reporting whether it is one the editor knows
+func (le *lineEditor) escape(sequence string) bool {
+	le.interruptedAt = time.Time{}
+	switch sequence {
+	case "[D", "OD": // Left
+		le.cursor = max(le.cursor-1, 0)
+	case "[C", "OC": // Right
+		le.cursor = min(le.cursor+1, len(le.line))
+	case "[H", "OH", "[1~", "[7~": // Home
+		le.cursor = 0
+	case "[F", "OF", "[4~", "[8~": // End
+		le.cursor = len(le.line)
+	case "[3~": // Delete
+		le.deleteAt(le.cursor)
+	case "[A", "OA": // Up
+		if entry, ok := le.history.Prev(string(le.line)); ok {
+			le.line = []rune(entry)
+			le.cursor = len(le.line)
+		}
+	case "[B", "OB": // Down
+		if entry, ok := le.history.Next(); ok {
+			le.line = []rune(entry)
+			le.cursor = len(le.line)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// visible returns the part of the line that fits in width columns, as rune offsets: the start
+// moves right as the cursor passes the edge, and the end is as far as there is room after it
+func (le *lineEditor) visible(width int) (start, end int) {
+	for uniseg.StringWidth(string(le.line[start:le.cursor])) > width {
+		start++
+	}
+	end = le.cursor
+	for end < len(le.line) && uniseg.StringWidth(string(le.line[start:end+1])) <= width {
+		end++
+	}
+	return start, end
+}
+
+// deleteAt removes the rune at i, if there is one
+func (le *lineEditor) deleteAt(i int) {
+	if i < len(le.line) {
+		le.line = append(le.line[:i], le.line[i+1:]...)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// typeInto feeds keys to an editor: each entry starting with ESC is one escape sequence, and any
+// other is typed a rune at a time
+func typeInto(le *lineEditor, keys ...string) (editAction, string) {
+	var action editAction
+	var line string
+	for _, key := range keys {
+		if sequence, ok := strings.CutPrefix(key, "\033"); ok {
+			le.escape(sequence)
+			continue
+		}
+		for _, r := range key {
+			action, line = le.key(r, time.Now())
+		}
+	}
+	return action, line
+}
+
+// TestLineEditorKeys edits a line with each key and checks the text and cursor left
+func TestLineEditorKeys(t *testing.T) {
+	const (
+		left, right         = "\033[D", "\033[C"
+		ctrlA, ctrlB, ctrlD = "\x01", "\x02", "\x04"
+		ctrlE, ctrlF, ctrlK = "\x05", "\x06", "\x0b"
+		ctrlU, ctrlW        = "\x15", "\x17"
+		backspace           = "\x7f"
+	)
+	for _, tc := range []struct {
+		name   string
+		keys   []string
+		line   string
+		cursor int
+	}{
+		{"typing", []string{"hello"}, "hello", 5},
+		{"insert after moving left", []string{"helo", left, "l"}, "hello", 4},
+		{"right stops at the end", []string{"ab", right, right}, "ab", 2},
+		{"left stops at the start", []string{"ab", left, left, left}, "ab", 0},
+		{"Ctrl+A inserts at the start", []string{"world", ctrlA, "hello "}, "hello world", 6},
+		{"Ctrl+E goes to the end", []string{"ab", ctrlA, ctrlE, "c"}, "abc", 3},
+		{"Ctrl+B and Ctrl+F", []string{"abc", ctrlB, ctrlB, ctrlF}, "abc", 2},
+		{"Home and End sequences", []string{"abc", "\033[H", "x", "\033OF", "y", "\033[1~", "z"}, "zxabcy", 1},
+		{"backspace in the middle", []string{"abc", left, backspace}, "ac", 1},
+		{"backspace at the start", []string{"ab", ctrlA, backspace}, "ab", 0},
+		{"Ctrl+H is backspace", []string{"ab", "\x08"}, "a", 1},
+		{"backspace takes a whole rune", []string{"héllo", left, left, left, backspace}, "hllo", 1},
+		{"Delete", []string{"abc", ctrlA, "\033[3~"}, "bc", 0},
+		{"Delete at the end", []string{"abc", "\033[3~"}, "abc", 3},
+		{"Ctrl+D deletes under the cursor", []string{"abc", ctrlA, ctrlD}, "bc", 0},
+		{"Ctrl+K cuts to the end", []string{"hello world", ctrlA, ctrlF, ctrlF, ctrlF, ctrlF, ctrlF, ctrlK}, "hello", 5},
+		{"Ctrl+U cuts to the start", []string{"hello world", ctrlA, ctrlF, ctrlF, ctrlF, ctrlF, ctrlF, ctrlU}, " world", 0},
+		{"Ctrl+W cuts a word and the spaces after it", []string{"say hello  ", ctrlW}, "say ", 4},
+		{"Ctrl+W before the cursor only", []string{"one two", left, left, left, ctrlW}, "two", 0},
+		{"Ctrl+W on an empty line", []string{ctrlW}, "", 0},
+		{"other control keys are ignored", []string{"a", "\x07\x1d"}, "a", 1},
+		{"unknown sequences are ignored", []string{"a", "\033[15~", "\033x"}, "a", 1},
+	} {
+		le := newLineEditor()
+		typeInto(le, tc.keys...)
+		if string(le.line) != tc.line || le.cursor != tc.cursor {
+			t.Errorf("%s: line %q with the cursor at %d, want %q at %d", tc.name, string(le.line), le.cursor, tc.line, tc.cursor)
+		}
+	}
+}
+
+// TestLineEditorActions checks what each key asks the console to do
+func TestLineEditorActions(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		keys   []string
+		action editAction
+		line   string
+	}{
+		{"Enter submits", []string{"hi\r"}, editSubmit, "hi"},
+		{"a newline submits", []string{"/peers\n"}, editSubmit, "/peers"},
+		{"Enter on an empty line", []string{"\r"}, editEmpty, ""},
+		{"Ctrl+C cancels a line", []string{"draft\x03"}, editCancel, ""},
+		{"Ctrl+D on an empty line", []string{"\x04"}, editEOF, ""},
+		{"Ctrl+D on a line edits it", []string{"ab", "\033[D", "\x04"}, editRedraw, ""},
+		{"Ctrl+L", []string{"ab\x0c"}, editClear, ""},
+		{"a control key with no use", []string{"\x07"}, editIgnored, ""},
+	} {
+		le := newLineEditor()
+		if action, line := typeInto(le, tc.keys...); action != tc.action || line != tc.line {
+			t.Errorf("%s: action %d with %q, want %d with %q", tc.name, action, line, tc.action, tc.line)
+		}
+	}
+
+	le := newLineEditor()
+	typeInto(le, "draft\x03")
+	if len(le.line) != 0 || le.cursor != 0 {
+		t.Errorf("Ctrl+C left %q", string(le.line))
+	}
+}
+
+// TestLineEditorQuit quits on a second Ctrl+C on an empty line within consoleQuitWindow of the first
+func TestLineEditorQuit(t *testing.T) {
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name  string
+		after time.Duration // Between the two
+		keys  []string      // Typed between the two
+		want  editAction
+	}{
+		{"twice quickly", time.Second, nil, editQuit},
+		{"twice slowly", consoleQuitWindow, nil, editQuitHint},
+		{"with typing between", time.Second, []string{"a\x7f"}, editQuitHint},
+		{"with an arrow between", time.Second, []string{"\033[A"}, editQuitHint},
+	} {
+		le := newLineEditor()
+		if action, _ := le.key(3, start); action != editQuitHint {
+			t.Fatalf("%s: the first Ctrl+C gave %d, want the hint", tc.name, action)
+		}
+		typeInto(le, tc.keys...)
+		if action, _ := le.key(3, start.Add(tc.after)); action != tc.want {
+			t.Errorf("%s: the second Ctrl+C gave %d, want %d", tc.name, action, tc.want)
+		}
+	}
+}
+
+// TestLineEditorHistory goes back through sent lines with Up and forward with Down, ending with
+// the line that was being typed
+func TestLineEditorHistory(t *testing.T) {
+	const up, down = "\033[A", "\033OB"
+	le := newLineEditor()
+	typeInto(le, "first\r", "second\r", "", "\r", "draft")
+
+	for _, step := range []struct {
+		key  string
+		want string
+	}{
+		{up, "second"},
+		{up, "first"},
+		{up, "first"},
+		{down, "second"},
+		{down, "draft"},
+		{down, "draft"},
+	} {
+		typeInto(le, step.key)
+		if string(le.line) != step.want || le.cursor != len(le.line) {
+			t.Fatalf("after %q: %q with the cursor at %d, want %q at the end", step.key, string(le.line), le.cursor, step.want)
+		}
+	}
+
+	// An entry taken from the history is edited and sent like anything typed
+	typeInto(le, up, up, "!")
+	if action, line := typeInto(le, "\r"); action != editSubmit || line != "first!" {
+		t.Errorf("sent %q with action %d, want first!", line, action)
+	}
+	typeInto(le, up)
+	if string(le.line) != "first!" {
+		t.Errorf("the newest entry is %q, want first!", string(le.line))
+	}
+}
+
+// TestLineEditorVisible scrolls a line too long for the terminal to keep the cursor in view
+func TestLineEditorVisible(t *testing.T) {
+	for _, tc := range []struct {
+		line       string
+		cursor     int
+		width      int
+		start, end int
+	}{
+		{"short", 5, 10, 0, 5},
+		{"short", 0, 10, 0, 5},
+		{"abcdefghij", 10, 4, 6, 10},
+		{"abcdefghij", 0, 4, 0, 4},
+		{"abcdefghij", 5, 4, 1, 5},
+		{"日本語テキスト", 7, 6, 4, 7},
+		{"日本語テキスト", 2, 5, 0, 2},
+	} {
+		le := &lineEditor{line: []rune(tc.line), cursor: tc.cursor}
+		if start, end := le.visible(tc.width); start != tc.start || end != tc.end {
+			t.Errorf("%q at %d in %d columns: runes %d to %d shown, want %d to %d", tc.line, tc.cursor, tc.width, start, end, tc.start, tc.end)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"golang.org/x/net/html"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	linkPreviewWorkers      = 2               // Pages fetched at once
+	linkPreviewTimeout      = 5 * time.Second // Longest a fetch may take, redirects included
+	linkPreviewMaxBytes     = 32 * 1024       // Only this much of a page is read looking for its title
+	linkPreviewMaxRedirects = 3
+	linkPreviewMaxTitle     = 120 // Longer titles are cut, in runes
+	linkPreviewsPerMessage  = 3   // Links after these in a message get no preview
+)
+
+// errPrivateAddress is returned for links, and redirects, that lead into a private network
+var errPrivateAddress = errors.New("link preview refused: private address")
+
+// cgnatRange is the carrier-grade NAT range, private in practice though net.IP.IsPrivate misses it
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// linkPreviewMsg is sent when a link's title has been fetched, or its fetch failed
+type linkPreviewMsg struct {
+	url   string
+	title string // Empty if the page had none or couldn't be fetched
+}
+
+// LinkPreviewer fetches the titles of pages peers link to, for -link-previews. Fetching tells the
+// site, and anyone watching, that the link was received, so it is off unless asked for. Only
+// http and https links are fetched, never anything on a private network, through Tor or the
+// environment's proxy when there is one. Titles are kept for the session, failures included.
+type LinkPreviewer struct {
+	client *http.Client
+	tor    bool          // Names are resolved by Tor's exit, so only literal addresses can be checked
+	slots  chan struct{} // Limits the fetches running at once to linkPreviewWorkers
+
+	mutex  sync.Mutex
+	titles map[string]string // By URL; a URL with no entry hasn't been asked for
+}
+
+// NewLinkPreviewer creates a previewer that fetches through torSOCKS, or directly (or through the
+// proxy named in the environment) if it is empty
+func NewLinkPreviewer(torSOCKS string) *LinkPreviewer {
+	lp := &LinkPreviewer{
+		tor:    torSOCKS != "",
+		slots:  make(chan struct{}, linkPreviewWorkers),
+		titles: make(map[string]string),
+	}
+	transport := &http.Transport{
+		TLSHandshakeTimeout:    linkPreviewTimeout,
+		ResponseHeaderTimeout:  linkPreviewTimeout,
+		MaxResponseHeaderBytes: linkPreviewMaxBytes,
+		DisableKeepAlives:      true,
+	}
+
+	if lp.tor {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialer, err := proxy.SOCKS5("tcp", torSOCKS, nil, &net.Dialer{Timeout: linkPreviewTimeout})
+			if err != nil {
+				return nil, err
+			}
+			return dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+		}
+	} else {
+		// Every address dialled is checked once resolved, so a name can't be pointed at a
+		// private address after the URL was checked, except the proxy's own
+		proxyConfig := httpproxy.FromEnvironment()
+		proxyFor := proxyConfig.ProxyFunc()
+		transport.Proxy = func(r *http.Request) (*url.URL, error) { return proxyFor(r.URL) }
+		proxies := proxyAddrs(proxyConfig.HTTPProxy, proxyConfig.HTTPSProxy)
+
+		direct := &net.Dialer{Timeout: linkPreviewTimeout}
+		guarded := &net.Dialer{Timeout: linkPreviewTimeout, Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if ip := net.ParseIP(host); err != nil || ip == nil || !isPublicIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		}}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if proxies[addr] {
+				return direct.DialContext(ctx, network, addr)
+			}
+			return guarded.DialContext(ctx, network, addr)
+		}
+	}
+
+	lp.client = &http.Client{
+		Transport: transport,
+		Timeout:   linkPreviewTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > linkPreviewMaxRedirects {
+				return fmt.Errorf("more than %d redirects", linkPreviewMaxRedirects)
+			}
+			return lp.checkURL(req.Context(), req.URL)
+		},
+	}
+	return lp
+}
+
+// proxyAddrs returns the host:port of each proxy URL, as the transport will dial it
+func proxyAddrs(proxyURLs ...string) map[string]bool {
+	addrs := make(map[string]bool)
+	for _, proxyURL := range proxyURLs {
+		if proxyURL == "" {
+			continue
+		}
+		if !strings.Contains(proxyURL, "://") {
+			proxyURL = "http://" + proxyURL
+		}
+		parsed, err := url.Parse(proxyURL)
+		if err != nil || parsed.Hostname() == "" {
+			continue
+		}
+		port := parsed.Port()
+		if port == "" {
+			port = map[string]string{"https": "443", "socks5": "1080", "socks5h": "1080"}[parsed.Scheme]
+			if port == "" {
+				port = "80"
+			}
+		}
+		addrs[net.JoinHostPort(parsed.Hostname(), port)] = true
+	}
+	return addrs
+}
+
+// isPublicIP reports whether ip is an ordinary internet address, not a private, loopback,
+// link-local, multicast or unspecified one
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnatRange.Contains(ip) ||
+		(ip.To4() != nil && ip.To4()[0] == 0))
+}
+
+// checkURL refuses links that aren't http or https, or that lead into a private network. Through a
+// proxy the name is resolved here too, since the proxy will resolve it where the dial can't be
+// checked; through Tor only literal addresses can be checked.
+func (lp *LinkPreviewer) checkURL(ctx context.Context, link *url.URL) error {
+	if link.Scheme != "http" && link.Scheme != "https" {
+		return fmt.Errorf("link preview refused: %s link", link.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(link.Hostname(), "."))
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateAddress
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return errPrivateAddress
+		}
+		return nil
+	}
+	if lp.tor {
+		return nil
+	}
+	if proxied, err := lp.client.Transport.(*http.Transport).Proxy(&http.Request{URL: link}); err != nil || proxied == nil {
+		return nil // Dialled directly, where the resolved address is checked
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+// Title returns the title fetched for a link, and whether it has been fetched
+func (lp *LinkPreviewer) Title(link string) (string, bool) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	title, fetched := lp.titles[link]
+	return title, fetched
+}
+
+// Request returns commands fetching the titles of the links in a message that haven't been asked
+// for yet this session
+func (lp *LinkPreviewer) Request(content string) []tea.Cmd {
+	var cmds []tea.Cmd
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	for i, span := range findURLs(content) {
+		if i == linkPreviewsPerMessage {
+			break
+		}
+		if _, requested := lp.titles[span.link]; requested {
+			continue
+		}
+		lp.titles[span.link] = ""
+		link := span.link
+		cmds = append(cmds, func() tea.Msg {
+			title := lp.fetch(link)
+			lp.mutex.Lock()
+			lp.titles[link] = title
+			lp.mutex.Unlock()
+			return linkPreviewMsg{url: link, title: title}
+		})
+	}
+	return cmds
+}
+
+// fetch returns a page's title, or "" if it has none or can't be fetched. Failures aren't
+// reported: a missing preview is all anyone sees.
+func (lp *LinkPreviewer) fetch(link string) string {
+	lp.slots <- struct{}{}
+	defer func() { <-lp.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+	defer cancel()
+	parsed, err := url.Parse(link)
+	if err != nil || lp.checkURL(ctx, parsed) != nil {
+		return ""
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("User-Agent", "p2pchat link preview")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := lp.client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+		return ""
+	}
+	return pageTitle(io.LimitReader(resp.Body, linkPreviewMaxBytes))
+}
+
+// pageTitle finds a page's og:title, or failing that its <title>, in the head of an HTML document
+func pageTitle(page io.Reader) string {
+	var title string
+	tokenizer := html.NewTokenizer(page)
+	inTitle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return cleanTitle(title) // Usually the end of what was read
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				var property, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						property = attr.Val
+					case "content":
+						content = attr.Val
+					}
+				}
+				if property == "og:title" && strings.TrimSpace(content) != "" {
+					return cleanTitle(content)
+				}
+			case "body":
+				return cleanTitle(title)
+			}
+		case html.EndTagToken:
+			switch tokenizer.Token().Data {
+			case "title":
+				inTitle = false
+			case "head":
+				return cleanTitle(title)
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+			}
+		}
+	}
+}
+
+// cleanTitle makes a title safe and short enough to show on one line
+func cleanTitle(title string) string {
+	title = strings.Join(strings.Fields(sanitizeLine(strings.ToValidUTF8(title, ""))), " ")
+	if runes := []rune(title); len(runes) > linkPreviewMaxTitle {
+		title = string(runes[:linkPreviewMaxTitle-1]) + "…"
+	}
+	return title
+}
+
+// renderLinkPreviews renders the fetched titles of the links in a message, a dim line each
+func (ui *UI) renderLinkPreviews(content string) string {
+	if ui.linkPreviews == nil {
+		return ""
+	}
+	var lines strings.Builder
+	line := lipgloss.NewStyle().MaxWidth(max(ui.viewport.Width, 1))
+	for i, span := range findURLs(content) {
+		if i == linkPreviewsPerMessage {
+			break
+		}
+		if title, _ := ui.linkPreviews.Title(span.link); title != "" {
+			lines.WriteString("\n" + line.Render(timestampStyle.Render("  ↳ "+title)))
+		}
+	}
+	return lines.String()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// TestIsPublicIP refuses every address that leads into a private network, however it is written
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"1.1.1.1", true},
+		{"172.32.0.1", true},
+		{"100.128.0.1", true},
+		{"2001:4860:4860::8888", true},
+		{"::ffff:8.8.8.8", true},
+
+		{"127.0.0.1", false},
+		{"127.255.255.254", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:100.64.0.1", false},
+		{"fc00::1", false},
+		{"fd12:3456:789a::1", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if ip == nil {
+			t.Fatalf("%s doesn't parse", test.ip)
+		}
+		if public := isPublicIP(ip); public != test.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", test.ip, public, test.public)
+		}
+	}
+}
+
+// TestCheckURL refuses links that aren't http or https, or name a private host
+func TestCheckURL(t *testing.T) {
+	lp := NewLinkPreviewer("")
+	lp.client.Transport.(*http.Transport).Proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+	for _, link := range []string{
+		"ftp://example.com/file",
+		"file:///etc/passwd",
+		"http://localhost:8080/",
+		"http://LOCALHOST./",
+		"http://admin.localhost/",
+		"http://127.0.0.1/",
+		"http://[::1]:8080/",
+		"http://[::ffff:192.168.0.1]/",
+		"http://169.254.169.254/latest/meta-data/",
+		"https://10.0.0.1/",
+		"http:///path",
+	} {
+		parsed, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := lp.checkURL(context.Background(), parsed); err == nil {
+			t.Errorf("%s allowed", link)
+		}
+	}
+	for _, link := range []string{"http://93.184.216.34/", "https://example.com/page"} {
+		parsed, _ := url.Parse(link)
+		if err := lp.checkURL(context.Background(), parsed); err != nil {
+			t.Errorf("%s refused: %v", link, err)
+		}
+	}
+}
+
+// TestLinkPreviewFetch fetches titles from a site reached by name, refusing redirects and dials to
+// loopback and reading no more of a page than linkPreviewMaxBytes
+func TestLinkPreviewFetch(t *testing.T) {
+	var internalHits atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalHits.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<title>Internal admin</title>"))
+	}))
+	t.Cleanup(internal.Close)
+	_, internalPort, _ := net.SplitHostPort(internal.Listener.Addr().String())
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/to-loopback":
+			http.Redirect(w, r, internal.URL+"/", http.StatusFound)
+			return
+		case "/to-localhost":
+			http.Redirect(w, r, "http://localhost:"+internalPort+"/", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/page":
+			w.Write([]byte("<html><head><title>A page</title></head></html>"))
+		case "/late-title":
+			w.Write([]byte("<html><head><!--" + strings.Repeat("x", linkPreviewMaxBytes) + "--><title>Too far</title></head></html>"))
+		}
+	}))
+	t.Cleanup(site.Close)
+
+	// The site is on loopback too, so only the name the tests use is let through to it; every
+	// other address goes to the previewer's own checked dial
+	lp := NewLinkPreviewer("")
+	transport := lp.client.Transport.(*http.Transport)
+	transport.Proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+	guarded := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "site.example:80" {
+			return (&net.Dialer{}).DialContext(ctx, network, site.Listener.Addr().String())
+		}
+		return guarded(ctx, network, addr)
+	}
+
+	if title := lp.fetch("http://site.example/page"); title != "A page" {
+		t.Errorf("fetched title %q, want %q", title, "A page")
+	}
+	if title := lp.fetch("http://site.example/to-loopback"); title != "" {
+		t.Errorf("followed a redirect to loopback, to %q", title)
+	}
+	if title := lp.fetch("http://site.example/to-localhost"); title != "" {
+		t.Errorf("followed a redirect to localhost, to %q", title)
+	}
+	if title := lp.fetch("http://site.example/late-title"); title != "" {
+		t.Errorf("read past %d bytes for title %q", linkPreviewMaxBytes, title)
+	}
+
+	// The dial refuses loopback itself, whatever name led there: the client is used directly here,
+	// without checkURL
+	if _, err := lp.client.Get(internal.URL); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("dialled loopback: %v", err)
+	}
+	if hits := internalHits.Load(); hits != 0 {
+		t.Errorf("the loopback server was reached %d times", hits)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	listenAddrFile = "listen.addr" // The addresses the node ended up listening on, for wrappers
+	exitPortsBusy  = 7             // Exit code when -listen and every port after it in -port-range are taken
+	maxPortRange   = 1000          // Most further ports -port-range may try
+)
+
+// errPortsBusy is returned when every port that could be tried is in use
+var errPortsBusy = errors.New("all ports in range are in use")
+
+// listenCandidates returns the addresses to listen on, in order: listenAddr itself, then with a
+// fixed port the next portRange ports up. An automatic port (:0) is never busy, so it is tried alone.
+func listenCandidates(listenAddr string, portRange int) ([]string, error) {
+	host, portText, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %s: %w", listenAddr, err)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port == 0 || portRange == 0 {
+		return []string{listenAddr}, nil
+	}
+
+	candidates := make([]string, 0, portRange+1)
+	for next := port; next <= port+portRange && next <= 65535; next++ {
+		candidates = append(candidates, net.JoinHostPort(host, strconv.Itoa(next)))
+	}
+	return candidates, nil
+}
+
+// WithListenAddrs makes a node listen on addrs as well as the address given to the constructor.
+// Every address is advertised, so peers on different networks can dial the one they can reach.
+func WithListenAddrs(addrs ...string) NodeOption {
+	return func(options *nodeOptions) {
+		options.listen = append(options.listen, addrs...)
+	}
+}
+
+// WithPortRange makes a node try up to portRange further ports when a listen port is taken
+func WithPortRange(portRange int) NodeOption {
+	return func(options *nodeOptions) {
+		options.portRange = portRange
+	}
+}
+
+// listenInRange listens on the first free port among listenCandidates. When every one of them is
+// taken the error wraps errPortsBusy as well as the last bind failure.
+func listenInRange(transport Transport, listenAddr string, portRange int) (net.Listener, error) {
+	candidates, err := listenCandidates(listenAddr, portRange)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range candidates[:len(candidates)-1] {
+		listener, err := transport.Listen(addr)
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return listener, err
+		}
+		log.Printf("%s is in use, trying the next port", addr)
+	}
+
+	last := candidates[len(candidates)-1]
+	listener, err := transport.Listen(last)
+	if len(candidates) > 1 && errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("%w (%s to %s): %w", errPortsBusy, candidates[0], last, err)
+	}
+	return listener, err
+}
+
+// listenAll binds listenAddr and the addresses from WithListenAddrs. An address that can't be
+// bound doesn't stop the others: it is logged and returned in failures, and the first address
+// that was bound is the node's main one. Only when none can be bound is the first one's error
+// returned.
+func listenAll(options nodeOptions, listenAddr string) (listeners []net.Listener, failures []error, err error) {
+	for _, addr := range append([]string{listenAddr}, options.listen...) {
+		listener, err := listenInRange(options.transport, addr, options.portRange)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, nil, failures[0]
+	}
+	for _, failure := range failures {
+		log.Printf("Warning: not listening on every address: %v", failure)
+	}
+	return listeners, failures, nil
+}
+
+// advertiseAddr is the address peers are told to dial a listener at. One listening on every
+// interface is given as loopback; /share lists its LAN addresses.
+func advertiseAddr(listener net.Listener) string {
+	addr := listener.Addr().String()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Sprintf("127.0.0.1%s", port)
+	} else if host == "::" {
+		return fmt.Sprintf("127.0.0.1:%s", port)
+	}
+	return addr
+}
+
+// recordAddresses are the addresses put in our signed peer records and registrations: every
+// advertised one, the node ID first, up to what a record may hold
+func (n *Node) recordAddresses() []string {
+	return n.advertised[:min(len(n.advertised), maxRecordAddresses)]
+}
+
+// validateListenAddrs checks each -listen address is host:port with a valid port, and that none
+// is given twice, before anything is bound
+func validateListenAddrs(addrs []string) error {
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		_, portText, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("%s is not host:port, e.g. :9000 or 192.168.1.10:9000: %w", addr, err)
+		}
+		if port, err := strconv.Atoi(portText); err != nil || port < 0 || port > 65535 {
+			return fmt.Errorf("%s: port must be a number from 0 to 65535", addr)
+		}
+		if seen[addr] {
+			return fmt.Errorf("%s is given twice", addr)
+		}
+		seen[addr] = true
+	}
+	return nil
+}
+
+// newNodeInRange creates the node on listenAddrs, the first being its main address, moving each
+// one up to portRange ports along when its port is taken
+func newNodeInRange(listenAddrs []string, portRange int, disableDiscovery bool, dataDir string, opts ...NodeOption) (*EnhancedNode, error) {
+	// A wrapper waiting for the address must not read the one from the last run
+	if err := os.Remove(filepath.Join(dataDir, listenAddrFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: failed to remove old %s: %v", listenAddrFile, err)
+	}
+
+	opts = append(opts, WithListenAddrs(listenAddrs[1:]...), WithPortRange(portRange))
+	return NewEnhancedNode(listenAddrs[0], disableDiscovery, dataDir, opts...)
+}
+
+// announceListenAddr records the addresses the node is reachable at in the data directory, one
+// per line with the node ID first, and unless stdout carries messages (-pipe) prints a
+// "LISTEN <addr>" line for each of them for wrappers
+func announceListenAddr(node *EnhancedNode, toStdout bool) {
+	path := filepath.Join(node.dataDir, listenAddrFile)
+	if err := os.WriteFile(path, []byte(strings.Join(node.advertised, "\n")+"\n"), 0600); err != nil {
+		log.Printf("Warning: failed to write %s: %v", path, err)
+	}
+	if toStdout {
+		for _, addr := range node.advertised {
+			fmt.Printf("LISTEN %s\n", addr)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestMultipleListeners starts a node on two addresses and has a peer connect on each. Both are
+// advertised, and shutting the node down closes both.
+func TestMultipleListeners(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	b, c := tn.nodes[0], tn.nodes[1]
+	a := tn.addNode(WithListenAddrs(memoryHost + ":0"))
+	if len(a.listeners) != 2 || len(a.advertised) != 2 || a.advertised[0] != a.ID {
+		t.Fatalf("listening on %d addresses, advertising %q as %s", len(a.listeners), a.advertised, a.ID)
+	}
+	if slices.Equal(a.recordAddresses(), a.advertised[:1]) {
+		t.Errorf("peer records only carry %q", a.recordAddresses())
+	}
+
+	b.connectToPeer(a.advertised[0])
+	c.connectToPeer(a.advertised[1])
+	waitForKeys(t, b, a)
+	waitForKeys(t, c, a)
+	waitFor(t, "a to have a peer on each listener", func() bool { return peerCount(a) == 2 })
+	for _, peer := range []*EnhancedNode{b, c} {
+		if _, err := peer.SendEncryptedText("hello from " + peer.ID); err != nil {
+			t.Fatal(err)
+		}
+		waitForText(t, a, peer.ID, "hello from "+peer.ID)
+	}
+
+	a.shutdown()
+	for _, addr := range a.advertised {
+		if conn, err := tn.network.Dial(addr, time.Second); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after shutdown", addr)
+		}
+	}
+}
+
+// TestListenerTaken starts a node whose second address is taken on its first alone, and fails
+// only when no address can be bound
+func TestListenerTaken(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	taken := tn.nodes[0].ID
+	a := tn.addNode(WithListenAddrs(taken))
+	if len(a.listeners) != 1 || len(a.listenFailures) != 1 || slices.Contains(a.advertised, taken) {
+		t.Errorf("listening on %q with failures %v", a.advertised, a.listenFailures)
+	}
+
+	if _, err := NewNode(taken, true, t.TempDir(), WithTransport(tn.network), WithListenAddrs(taken)); err == nil {
+		t.Error("started a node with every address taken")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Locked reports whether the node is refusing new connections (chatBackend)
+func (n *Node) Locked() bool {
+	return n.locked.Load()
+}
+
+// setLocked locks or unlocks the node, reporting whether that changed anything. While locked,
+// incoming connections are closed once their handshake is done, discovered peers aren't dialled
+// and LAN discovery is neither announced nor answered. Connected peers are unaffected, and so is
+// /connect. Locking starts a new count of refused connections.
+func (n *Node) setLocked(locked bool) bool {
+	if locked && !n.locked.Load() {
+		n.lockedRefused.Store(0)
+	}
+	if n.locked.Swap(locked) == locked {
+		return false
+	}
+	log.Printf("Locked: %v", locked)
+	return true
+}
+
+// handleLockCommand processes /lock and /unlock
+func (en *EnhancedNode) handleLockCommand(locked bool) {
+	changed := en.setLocked(locked)
+	var reply string
+	switch {
+	case !changed && locked:
+		reply = "🔐 Already locked; /unlock to accept new connections again"
+	case !changed:
+		reply = "🔓 Not locked"
+	case locked:
+		reply = fmt.Sprintf("🔐 Locked: new connections are refused and discovered peers aren't dialled; "+
+			"your %d connected peer(s) stay connected. /unlock to undo", len(en.PeerIDs()))
+	default:
+		reply = fmt.Sprintf("🔓 Unlocked: accepting new connections again (%d refused while locked)", en.lockedRefused.Load())
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
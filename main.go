@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
@@ -21,31 +26,299 @@ func (s *stringList) Set(value string) error {
 }
 
 func main() {
-	var listenAddr string
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "attach" {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, "Usage: p2pchat attach <socket>")
+			os.Exit(2)
+		}
+		runAttach(os.Args[2])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "send" {
+		os.Exit(runSend(os.Args[2:], os.Stderr))
+	}
+
+	var listenAddrs stringList
+	var portRange int
 	var peerAddrs stringList
 	var disableDiscovery bool
 	var useTUI bool
 	var useGUI bool
+	var apiListen string
+	var debugListen string
+	var daemonMode bool
+	var controlSocket string
+	var pipeMode bool
+	var pipeOneshot bool
+	var webhook WebhookConfig
+	var configPath string
+	var dataDir string
+	var profile string
+	var migrate bool
+	var noWizard bool
+	var historySync bool
+	var awayAfter time.Duration
+	var muteHard bool
+	var nick string
+	var mentionBell bool
+	var saveHistory bool
+	var maxMessages int
+	var theme string
+	var autoAccept bool
+	var autoplay bool
+	var notify string
+	var notifyHidePreview bool
+	var linkPreviews bool
+	var readTimeout time.Duration
+	var writeTimeout time.Duration
+	var useQUIC bool
+	var useTor bool
+	var torConfig TorConfig
+	var useDHT bool
+	var rendezvousMode bool
+	var rendezvousServer string
+	var private bool
+	var startLocked bool
+	var showVersion bool
+	var runCheck bool
 
-	flag.StringVar(&listenAddr, "listen", ":0", "address to listen on (:0 = auto-assign port)")
+	flag.Var(&listenAddrs, "listen", "address to listen on (:0 = auto-assign port, the default); can be specified multiple times, the first being the node's ID and every one advertised to peers")
+	flag.IntVar(&portRange, "port-range", 0, fmt.Sprintf("when the -listen port is taken, try up to this many ports after it (exit code %d if all are taken)", exitPortsBusy))
 	flag.Var(&peerAddrs, "peer", "peer address to connect to (can be specified multiple times)")
 	flag.BoolVar(&disableDiscovery, "no-discovery", false, "disable auto-discovery")
 	flag.BoolVar(&useTUI, "tui", false, "use beautiful TUI interface")
 	flag.BoolVar(&useGUI, "gui", false, "use cross-platform GUI (not yet implemented)")
+	flag.StringVar(&apiListen, "api-listen", "", "address for the local HTTP control API, e.g. 127.0.0.1:7777 (disabled if empty); stream its events with\ncurl -N -H \"Authorization: Bearer $(cat <data dir>/api.token)\" http://127.0.0.1:7777/events")
+	flag.StringVar(&debugListen, "debug-listen", "", "loopback address to serve net/http/pprof and a summary of the node's goroutines and queues on, e.g. 127.0.0.1:6060 (disabled if empty)")
+	flag.BoolVar(&daemonMode, "daemon", false, "run headless, controlled over a unix socket (see -control-socket)")
+	flag.StringVar(&controlSocket, "control-socket", "", "unix socket path for -daemon (default <data dir>/control.sock)")
+	flag.BoolVar(&pipeMode, "pipe", false, "send stdin lines as messages and write received messages to stdout as JSON")
+	flag.BoolVar(&pipeOneshot, "oneshot", false, "with -pipe, exit when stdin reaches EOF")
+	flag.StringVar(&dataDir, "data-dir", "", fmt.Sprintf("directory for keys, received files, config and other state (default %s)", defaultDataDir()))
+	flag.StringVar(&profile, "profile", "", "run as a separate identity with its own data under <data dir>/profiles/<name>, listening on a port derived from the name unless -listen is given")
+	flag.BoolVar(&migrate, "migrate", false, "move state left in the current directory by older versions (./keys, ./data, ./downloads) into -data-dir")
+	flag.BoolVar(&noWizard, "no-wizard", false, "skip the first-run setup questions when there is no config file yet")
+	flag.StringVar(&configPath, "config", "", "path to the JSON config file (default <data dir>/config.json)")
+	flag.BoolVar(&historySync, "history-sync", false, "exchange recent broadcast history with peers on connect (both sides must enable it)")
+	flag.DurationVar(&awayAfter, "away-after", defaultAwayAfter, "TUI input idle time before your status becomes away (0 disables)")
+	flag.StringVar(&nick, "nick", "", "your nickname, matched as a mention in incoming messages (overrides the config file)")
+	flag.BoolVar(&mentionBell, "mention-bell", false, "ring the terminal bell when a message mentions you or is sent only to you (TUI)")
+	flag.BoolVar(&saveHistory, "save-history", false, "keep TUI input history across sessions (passphrase commands are never saved)")
+	flag.IntVar(&maxMessages, "max-messages", 0, fmt.Sprintf("messages kept in the TUI view before the oldest are dropped (default %d, or max_messages in the config)", defaultMaxMessages))
+	flag.StringVar(&theme, "theme", "", "TUI color theme: dark, light or mono (default dark, or mono when NO_COLOR is set)")
+	flag.BoolVar(&autoAccept, "auto-accept-files", false, "receive files peers offer without asking (otherwise /accept or /reject each one)")
+	flag.BoolVar(&autoplay, "autoplay", false, "play received voice messages as they arrive (otherwise they are stored for /play)")
+	flag.StringVar(&notify, "notify", "", "TUI desktop notifications while the terminal is in the background: on (what each conversation's level lets through), mentions or off (default off, or notify in the config)")
+	flag.BoolVar(&notifyHidePreview, "notify-hide-preview", false, "leave message text out of desktop notifications")
+	flag.BoolVar(&linkPreviews, "link-previews", false, "fetch the titles of web pages peers link to and show them under their messages (TUI; tells the sites you got the link)")
+	flag.BoolVar(&muteHard, "mute-hard", false, "hide muted peers' messages even when they mention you")
+	flag.StringVar(&webhook.URL, "webhook-url", "", "POST each received text message to this URL as JSON (disabled if empty)")
+	flag.StringVar(&webhook.Secret, "webhook-secret", os.Getenv("P2PCHAT_WEBHOOK_SECRET"), "HMAC-SHA256 key for the X-P2PChat-Signature header (default $P2PCHAT_WEBHOOK_SECRET)")
+	flag.Var((*stringList)(&webhook.Peers), "webhook-peer", "only forward messages from this node ID (can be specified multiple times)")
+	flag.Var((*stringList)(&webhook.Rooms), "webhook-room", "only forward messages in this room (can be specified multiple times)")
+	flag.DurationVar(&readTimeout, "read-timeout", defaultReadTimeout, "disconnect peers that send nothing for this long, keepalives included (0 disables)")
+	flag.DurationVar(&writeTimeout, "write-timeout", defaultWriteTimeout, "disconnect peers that don't accept a message within this time (0 disables)")
+	flag.BoolVar(&useQUIC, "quic", false, "experimental: also accept QUIC on the listen port and connect to peers over QUIC when they support it, with a stream per file transfer")
+	flag.BoolVar(&useTor, "tor", false, "be reachable only as a Tor onion service and connect to peers through Tor (needs a local Tor daemon; turns discovery off)")
+	flag.StringVar(&torConfig.ControlAddr, "tor-control", defaultTorControl, "Tor control port, for -tor (a password may be given in $"+torPasswordEnv+")")
+	flag.StringVar(&torConfig.SOCKSAddr, "tor-socks", defaultTorSOCKS, "Tor SOCKS port, for -tor")
+	flag.BoolVar(&useDHT, "dht", false, "join the DHT so peers can find you by key fingerprint and /connect <fingerprint> works (bootstrap nodes come from dht_bootstrap in the config)")
+	flag.BoolVar(&rendezvousMode, "rendezvous", false, "run only a rendezvous server on -listen, where nodes register and find each other; it takes no part in chat")
+	flag.StringVar(&rendezvousServer, "rendezvous-server", "", "register with this rendezvous server (host:port or URL) and connect to the nodes it lists")
+	flag.BoolVar(&startLocked, "start-locked", false, "start as if /lock had been used: refuse new incoming connections and don't dial or announce on discovery until /unlock")
+	flag.BoolVar(&private, "private", false, "only let contacts' keys connect; connecting to other keys needs their fingerprint (see /invite)")
+	flag.BoolVar(&showVersion, "version", false, "print the version and build information and exit")
+	flag.BoolVar(&runCheck, "check", false, "run the checks /doctor runs (config, listen port, multicast, keys, data dir, audio), print the report and exit; exit code 1 if any failed")
 	flag.Parse()
 
+	if showVersion {
+		fmt.Printf("p2pchat %s\n", ownVersion())
+		return
+	}
+
+	if len(listenAddrs) == 0 {
+		listenAddrs = stringList{":0"}
+	}
+	if err := validateListenAddrs(listenAddrs); err != nil {
+		log.Fatalf("Invalid -listen: %v", err)
+	}
+	if debugListen != "" {
+		if err := validateDebugListen(debugListen); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if rendezvousMode {
+		if len(listenAddrs) > 1 {
+			log.Fatalf("-rendezvous listens on one address")
+		}
+		if err := runRendezvous(listenAddrs[0]); err != nil {
+			log.Fatalf("Rendezvous server error: %v", err)
+		}
+		return
+	}
+	if rendezvousServer != "" && useTor {
+		log.Fatalf("-rendezvous-server can't be used with -tor: the server would see our address")
+	}
+
+	if portRange < 0 || portRange > maxPortRange {
+		log.Fatalf("-port-range must be between 0 and %d", maxPortRange)
+	}
+	if readTimeout > 0 && readTimeout < 2*keepaliveInterval {
+		log.Fatalf("-read-timeout must be at least %v so keepalives can arrive in time", 2*keepaliveInterval)
+	}
+
+	// Older versions kept state in the working directory; look for it unless -data-dir or
+	// -profile says where state lives now
+	findLegacy := (dataDir == "" && profile == "") || migrate
+	if dataDir == "" {
+		dataDir = defaultDataDir()
+	}
+	listenSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "listen" {
+			listenSet = true
+		}
+	})
+	if profile != "" {
+		var err error
+		if dataDir, err = profileDataDir(dataDir, profile); err != nil {
+			log.Fatalf("Invalid -profile: %v", err)
+		}
+		if !listenSet {
+			listenAddrs = stringList{profileListenAddr(profile)}
+		}
+	}
+	if err := createDataDir(dataDir); err != nil {
+		log.Fatalf("Failed to set up data directory: %v", err)
+	}
+	if findLegacy {
+		// Stdin carries messages in pipe mode and nobody is there to answer in daemon mode
+		if err := offerMigration(dataDir, migrate, !pipeMode && !daemonMode && isTerminal(os.Stdin)); err != nil {
+			log.Fatalf("Failed to start: %v", err)
+		}
+	}
+	if configPath == "" {
+		configPath = defaultConfigPath(dataDir)
+	}
+
+	if runCheck {
+		report := runHealthCheck(listenAddrs, portRange, dataDir, configPath, !disableDiscovery && !useTor, useTor)
+		fmt.Println(report)
+		if report.Failed() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// First run: ask for a nick and the like before an identity is generated
+	if !noWizard && !pipeMode && !daemonMode && isTerminal(os.Stdin) && needsSetup(configPath) {
+		if err := runFirstRunSetup(dataDir, configPath, useTUI); errors.Is(err, errSetupCancelled) {
+			return
+		} else if err != nil {
+			log.Fatalf("First-run setup failed: %v", err)
+		}
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if config.Discovery != nil && !*config.Discovery {
+		disableDiscovery = true
+	}
+
+	var nodeOptions []NodeOption
+	if useQUIC {
+		nodeOptions = append(nodeOptions, WithQUIC())
+	}
+	if useTor {
+		torConfig.Password = os.Getenv(torPasswordEnv)
+		nodeOptions = append(nodeOptions, WithTor(torConfig))
+	}
+	if useDHT || config.DHT {
+		nodeOptions = append(nodeOptions, WithDHT(DHTConfig{Listen: config.DHTListen, Bootstrap: config.DHTBootstrap}))
+	}
+
 	// Create enhanced node
-	node, err := NewEnhancedNode(listenAddr, disableDiscovery)
+	node, err := newNodeInRange(listenAddrs, portRange, disableDiscovery, dataDir, nodeOptions...)
+	var listenErr *net.OpError
+	if profile != "" && !listenSet && errors.As(err, &listenErr) {
+		// Something else has the profile's port; any port will do
+		log.Printf("Warning: %v; listening on a random port instead", err)
+		node, err = NewEnhancedNode(":0", disableDiscovery, dataDir, nodeOptions...)
+	}
+	if errors.Is(err, errPortsBusy) {
+		log.Printf("Failed to create enhanced node: %v", err)
+		os.Exit(exitPortsBusy)
+	}
 	if err != nil {
 		log.Fatalf("Failed to create enhanced node: %v", err)
 	}
+	node.profile = profile
+	announceListenAddr(node, !pipeMode)
+
+	node.historySync = historySync
+	node.rendezvousServer = rendezvousServer
+	node.private = private
+	node.locked.Store(startLocked)
+	node.muteHard = muteHard
+	node.readTimeout = readTimeout
+	node.writeTimeout = writeTimeout
+	node.flags = configFlags{
+		nick:              nick,
+		autoAccept:        autoAccept,
+		theme:             theme,
+		mentionBell:       mentionBell,
+		notify:            notify,
+		notifyHidePreview: notifyHidePreview,
+		maxMessages:       maxMessages,
+	}
+	node.voiceManager.autoplay = autoplay
+
+	if err := node.applyConfig(config, configPath); err != nil {
+		log.Fatalf("Failed to apply config: %v", err)
+	}
+	node.reloadOnHangup()
+
+	// Forward incoming messages to the webhook if configured
+	if webhook.URL != "" {
+		node.webhook = NewWebhookDispatcher(webhook)
+		node.webhook.Start(node.Node)
+	}
+
+	// Start the control API if requested
+	if apiListen != "" {
+		api, err := NewAPIServer(node, apiListen)
+		if err != nil {
+			log.Fatalf("Failed to start control API: %v", err)
+		}
+		api.Start()
+	}
+
+	// Serve profiling endpoints if requested
+	if debugListen != "" {
+		if err := node.startDebugServer(debugListen); err != nil {
+			log.Fatalf("Failed to start debug server: %v", err)
+		}
+	}
 
 	// Connect to initial peers
 	for _, addr := range peerAddrs {
 		go node.connectToPeer(addr)
 	}
 
-	if useGUI {
+	if pipeMode {
+		// Shell pipelines: stdin -> peers, peers -> stdout (logs stay on stderr)
+		node.startPipe(os.Stdout, peerAddrs, pipeOneshot)
+		node.StartEnhanced()
+	} else if daemonMode {
+		// Run headless; clients attach over the control socket
+		if err := runDaemon(node, controlSocket); err != nil {
+			log.Fatalf("Daemon error: %v", err)
+		}
+	} else if useGUI {
 		// Start with cross-platform GUI
 		gui := NewChatGUI(node)
 
@@ -56,14 +329,40 @@ func main() {
 		gui.ShowAndRun()
 	} else if useTUI {
 		// Start with beautiful TUI (deprecated)
-		ui := NewUI(node.Node)
-		p := tea.NewProgram(ui, tea.WithAltScreen())
-
-		// Start enhanced node in background
-		go node.StartEnhanced()
+		ui := NewUI(node)
+		ui.flags = node.flags
+		if err := ui.applyConfig(nil, config, ui.flags); err != nil {
+			log.Fatalf("Failed to apply config to the TUI: %v", err)
+		}
+		ui.awayAfter = awayAfter
+		if linkPreviews {
+			torSOCKS := ""
+			if useTor {
+				torSOCKS = torConfig.SOCKSAddr
+			}
+			ui.linkPreviews = NewLinkPreviewer(torSOCKS)
+		}
+		if config.SaveHistory || saveHistory {
+			history, err := NewInputHistory(filepath.Join(node.dataDir, inputHistoryFile))
+			if err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			ui.history = history
+		}
+		if err := ui.setConversationsPath(filepath.Join(node.dataDir, conversationsFile)); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		if err := ui.setNotificationsPath(filepath.Join(node.dataDir, notificationsFile)); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		ui.exportDir = node.dataDir
+		ui.profile = profile
+		p := tea.NewProgram(ui, tea.WithAltScreen(), tea.WithReportFocus())
+		node.configReloaded = func(old, config *Config) {
+			go p.Send(configReloadedMsg{old: old, config: config})
+		}
 
-		// Run TUI
-		if _, err := p.Run(); err != nil {
+		if err := runTUI(p, node); err != nil {
 			log.Fatalf("Error running TUI: %v", err)
 		}
 	} else {
@@ -71,3 +370,16 @@ func main() {
 		node.StartEnhanced()
 	}
 }
+
+// runTUI starts the node in the background and runs the TUI until it quits, or until the node
+// shuts down and the TUI quits with it. The node is then stopped, so connections are closed
+// before the process exits.
+func runTUI(p *tea.Program, node *EnhancedNode) error {
+	// Input comes from the TUI, not a stdin reader
+	node.headless = true
+	go node.StartEnhanced()
+
+	_, err := p.Run()
+	node.shutdownWithin(shutdownTimeout)
+	return err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// textFormat is the inline style of a span of message text
+type textFormat int
+
+const (
+	formatNone   textFormat = iota
+	formatBold              // *bold*
+	formatItalic            // _italic_
+	formatCode              // `code`
+)
+
+const (
+	codeFence = "```"
+	tabWidth  = 4 // Spaces a tab in a code block is shown as
+)
+
+// formatMarkers maps each inline marker to the style it applies
+var formatMarkers = map[byte]textFormat{
+	'*': formatBold,
+	'_': formatItalic,
+	'`': formatCode,
+}
+
+// messageBlock is a run of message text shown one way: prose, wrapped and with inline formatting,
+// or a fenced code block, shown as typed
+type messageBlock struct {
+	text    string
+	code    bool
+	formats []textSpan // Inline formatting of prose, by byte range of text
+}
+
+// parseMessage splits message text into prose and fenced code blocks, and finds the inline
+// formatting in the prose. Only the TUI does this, when rendering; messages are sent and stored as
+// typed. A fence that is never closed is left as text.
+func parseMessage(content string) []messageBlock {
+	var blocks []messageBlock
+	var prose []string
+	flushProse := func() {
+		if prose != nil {
+			text, formats := parseInline(strings.Join(prose, "\n"))
+			blocks = append(blocks, messageBlock{text: text, formats: formats})
+			prose = nil
+		}
+	}
+
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), codeFence) {
+			if end := closingFence(lines, i+1); end > 0 {
+				flushProse()
+				blocks = append(blocks, messageBlock{text: strings.Join(lines[i+1:end], "\n"), code: true})
+				i = end
+				continue
+			}
+		}
+		prose = append(prose, lines[i])
+	}
+	flushProse()
+	return blocks
+}
+
+// closingFence returns the index of the first line from start on that closes a code block, or -1
+func closingFence(lines []string, start int) int {
+	for i := start; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == codeFence {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseInline removes the markers of well-formed *bold*, _italic_ and `code` spans from text,
+// returning what is left and where the spans are in it. A marker opens a span only at the start
+// of a word and closes it only at the end of one, so snake_case and 2*3*4 stay as they are.
+// Anything malformed or nested is left as typed rather than losing characters, and so are markers
+// inside URLs.
+func parseInline(text string) (string, []textSpan) {
+	urls := findURLs(text)
+	var out strings.Builder
+	var formats []textSpan
+	for i := 0; i < len(text); {
+		if url, inURL := spanAt(urls, i, new(int)); inURL {
+			out.WriteString(text[i:url.end])
+			i = url.end
+			continue
+		}
+		if end := closingMarker(text, i, urls); end > 0 {
+			start := out.Len()
+			out.WriteString(text[i+1 : end])
+			formats = append(formats, textSpan{start: start, end: out.Len(), format: formatMarkers[text[i]]})
+			i = end + 1
+			continue
+		}
+		out.WriteByte(text[i])
+		i++
+	}
+	return out.String(), formats
+}
+
+// closingMarker returns the index of the marker that closes a span opened at text[i], or -1 if
+// text[i] doesn't open a well-formed one
+func closingMarker(text string, i int, urls []textSpan) int {
+	marker := text[i]
+	format, isMarker := formatMarkers[marker]
+	if !isMarker || i+1 >= len(text) || isSpace(text[i+1]) || (i > 0 && isWordEnd(text[:i])) {
+		return -1
+	}
+	end := strings.IndexByte(text[i+1:], marker)
+	if end <= 0 {
+		return -1 // Unclosed, or empty as in **
+	}
+	end += i + 1
+	inner := text[i+1 : end]
+	switch {
+	case strings.Contains(inner, "\n"), isSpace(text[end-1]):
+		return -1
+	case format != formatCode && strings.ContainsAny(inner, "*_`"):
+		return -1 // Nested markers are shown as typed
+	case end+1 < len(text) && (formatMarkers[text[end+1]] != formatNone || isWordStart(text[end+1:])):
+		return -1
+	}
+	if _, inURL := spanAt(urls, end, new(int)); inURL {
+		return -1
+	}
+	return end
+}
+
+// isSpace reports whether a byte is white space
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+// isWordEnd reports whether text ends with a letter or digit
+func isWordEnd(text string) bool {
+	r, _ := utf8.DecodeLastRuneInString(text)
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// isWordStart reports whether text starts with a letter or digit
+func isWordStart(text string) bool {
+	r, _ := utf8.DecodeRuneInString(text)
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// codeLines returns the byte range of each line of a code block, cut to width cells, and whether
+// each was cut. Code blocks are never wrapped.
+func codeLines(text string, width int) ([][2]int, []bool) {
+	var ranges [][2]int
+	var cut []bool
+	start := 0
+	for _, line := range strings.Split(text, "\n") {
+		end := start
+		lineWidth := 0
+		state := -1
+		for end < start+len(line) {
+			cluster, _, clusterWidth, newState := uniseg.FirstGraphemeClusterInString(text[end:start+len(line)], state)
+			state = newState
+			if lineWidth+clusterWidth > width {
+				break
+			}
+			lineWidth += clusterWidth
+			end += len(cluster)
+		}
+		ranges = append(ranges, [2]int{start, end})
+		cut = append(cut, end < start+len(line))
+		start += len(line) + 1
+	}
+	return ranges, cut
+}
+
+// renderCodeBlock renders a code block as typed on a background the width of the text, with lines
+// too long for it cut and marked
+func (ui *UI) renderCodeBlock(text string, width int, current bool) []string {
+	text = strings.ReplaceAll(text, "\t", strings.Repeat(" ", tabWidth))
+	matches := ui.searchSpans(text)
+	ranges, cut := codeLines(text, max(width-1, 1)) // A cell is kept for the cut marker
+	lines := make([]string, len(ranges))
+	for i, line := range ranges {
+		rendered := ui.renderSpans(text, line[0], line[1], nil, matches, nil, codeStyle.Render, current)
+		lineWidth := uniseg.StringWidth(text[line[0]:line[1]])
+		if cut[i] {
+			rendered += codeStyle.Render("…")
+			lineWidth++
+		}
+		lines[i] = rendered + codeStyle.Render(strings.Repeat(" ", max(width-lineWidth, 0)))
+	}
+	return lines
+}
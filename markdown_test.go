@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/muesli/termenv"
+)
+
+// tagged marks the formatted spans of parseInline's output with <b>, <i> and <code> tags
+func tagged(text string, spans []textSpan) string {
+	tags := map[textFormat]string{formatBold: "b", formatItalic: "i", formatCode: "code"}
+	var out strings.Builder
+	pos := 0
+	for _, span := range spans {
+		fmt.Fprintf(&out, "%s<%s>%s</%s>", text[pos:span.start], tags[span.format], text[span.start:span.end], tags[span.format])
+		pos = span.end
+	}
+	return out.String() + text[pos:]
+}
+
+// TestParseInline formats well-formed spans and leaves everything else exactly as typed
+func TestParseInline(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"*bold* and _italic_ and `code`", "<b>bold</b> and <i>italic</i> and <code>code</code>"},
+		{"a *few bold words* here", "a <b>few bold words</b> here"},
+		{"(*bold*), _it_!", "(<b>bold</b>), <i>it</i>!"},
+		{"snake_case_name", "snake_case_name"},
+		{"2*3*4", "2*3*4"},
+		{"*unclosed", "*unclosed"},
+		{"closed*", "closed*"},
+		{"** and __", "** and __"},
+		{"* not bold *", "* not bold *"},
+		{"*not bold *", "*not bold *"},
+		{"*bold*er", "*bold*er"},
+		{"*_nested_*", "*_nested_*"},
+		{"_*nested*_", "_*nested*_"},
+		{"`*stars* in code`", "<code>*stars* in code</code>"},
+		{"**double**", "**double**"},
+		{"*across\nlines*", "*across\nlines*"},
+		{"see https://example.com/a_b_c and _this_", "see https://example.com/a_b_c and <i>this</i>"},
+		{"_https://example.com/x_", "<i>https://example.com/x</i>"}, // Around a link, not in it
+		{"*😀 émoji*", "<b>😀 émoji</b>"},
+		{"", ""},
+	} {
+		text, spans := parseInline(tc.text)
+		if got := tagged(text, spans); got != tc.want {
+			t.Errorf("parseInline(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+// TestParseMessage splits fenced code blocks from the prose around them, leaving an unclosed
+// fence as text
+func TestParseMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    []string // Each block as "prose: text" or "code: text"
+	}{
+		{"prose", "just *text*", []string{"prose: just text"}},
+		{"code block", "look:\n```\nfunc main() {\n\tprintln(\"*hi*\")\n}\n```\nnice", []string{
+			"prose: look:", "code: func main() {\n\tprintln(\"*hi*\")\n}", "prose: nice",
+		}},
+		{"language tag", "```go\nx := 1\n```", []string{"code: x := 1"}},
+		{"indented fences", "  ```\n  kept indent\n  ```", []string{"code:   kept indent"}},
+		{"empty block", "```\n```", []string{"code: "}},
+		{"unclosed", "```\nnever closed *bold*", []string{"prose: ```\nnever closed bold"}},
+		{"two blocks", "```\na\n```\n```\nb\n```", []string{"code: a", "code: b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, block := range parseMessage(tc.content) {
+				kind := "prose"
+				if block.code {
+					kind = "code"
+				}
+				got = append(got, kind+": "+block.text)
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tc.want) {
+				t.Errorf("blocks %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestCodeLines cuts code lines at the width instead of wrapping them, by cells
+func TestCodeLines(t *testing.T) {
+	text := "short\na line too long\n你好世界\n"
+	ranges, cut := codeLines(text, 6)
+	var lines []string
+	for i, line := range ranges {
+		lines = append(lines, fmt.Sprintf("%s|%v", text[line[0]:line[1]], cut[i]))
+	}
+	if got, want := strings.Join(lines, " "), "short|false a line|true 你好世|true |false"; got != want {
+		t.Errorf("lines %q, want %q", got, want)
+	}
+}
+
+// TestMarkdownGolden renders formatted messages, code blocks included, against golden files, and
+// as typed with markdown turned off or on a terminal that can't show styles
+func TestMarkdownGolden(t *testing.T) {
+	content := "Try *this*, _carefully_:\n```\nfor i := 0; i < 10; i++ {\n\tfmt.Println(\"a long line that the viewport cuts short\")\n}\n```\nthen run `go test` in snake_case_dir"
+	for _, tc := range []struct {
+		name      string
+		profile   termenv.Profile
+		plainText bool
+	}{
+		{"truecolor", termenv.TrueColor, false},
+		{"ascii", termenv.Ascii, false},
+		{"plain_text", termenv.TrueColor, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useTheme(t, themes[defaultTheme], tc.profile)
+			ui, _ := newTestUI(t, 60, 24)
+			ui.plainText = tc.plainText
+			checkGolden(t, filepath.Join("markdown", tc.name), ui.renderContent("[alice] ", content, nil, false, true, ""))
+		})
+	}
+}
+
+// TestMarkdownWithoutStyles keeps every marker when nothing can be styled, under NO_COLOR or on a
+// colorless terminal in any theme, rather than dropping them for formatting nobody sees
+func TestMarkdownWithoutStyles(t *testing.T) {
+	const content = "*bold*, _italic_ and `code`"
+	for _, name := range themeNames() {
+		for _, tc := range []struct {
+			profile termenv.Profile
+			want    string
+		}{
+			{termenv.Ascii, content},
+			{termenv.ANSI, "bold, italic and code"},
+		} {
+			t.Run(fmt.Sprintf("%s/%v", name, tc.profile), func(t *testing.T) {
+				useTheme(t, themes[name], tc.profile)
+				ui, _ := newTestUI(t, 60, 24)
+				got := ui.renderContent("", content, nil, false, true, "")
+				if plain := stripANSIKeepOSC8(got); plain != tc.want {
+					t.Errorf("rendered %q, want %q", plain, tc.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MentionMatcher finds mentions of our nick, node ID or watched keywords in message text.
+// Matching is case-insensitive and word-boundary aware, using regexps compiled when the list changes.
+type MentionMatcher struct {
+	mutex    sync.RWMutex
+	nick     string
+	nodeID   string
+	keywords []string
+	self     *regexp.Regexp // Nick and node ID
+	any      *regexp.Regexp // Nick, node ID and keywords
+}
+
+// NewMentionMatcher creates a matcher for our identity and keyword list
+func NewMentionMatcher(nodeID, nick string, keywords []string) *MentionMatcher {
+	mm := &MentionMatcher{nodeID: nodeID}
+	mm.Set(nick, keywords)
+	return mm
+}
+
+// Set replaces the nick and keyword list and recompiles the matchers
+func (mm *MentionMatcher) Set(nick string, keywords []string) {
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	mm.nick = strings.TrimSpace(nick)
+	mm.keywords = normalizeKeywords(keywords)
+
+	selfTerms := []string{mm.nodeID}
+	if mm.nick != "" {
+		selfTerms = append(selfTerms, mm.nick)
+	}
+	mm.self = compileMentionPattern(selfTerms)
+	mm.any = compileMentionPattern(append(selfTerms, mm.keywords...))
+}
+
+// Keywords returns the watched keywords
+func (mm *MentionMatcher) Keywords() []string {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	return append([]string(nil), mm.keywords...)
+}
+
+// Nick returns our nick ("" if none is set)
+func (mm *MentionMatcher) Nick() string {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	return mm.nick
+}
+
+// MentionsSelf reports whether text mentions our nick or node ID
+func (mm *MentionMatcher) MentionsSelf(text string) bool {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	return mm.self.MatchString(text)
+}
+
+// Matches reports whether text mentions us or contains a watched keyword
+func (mm *MentionMatcher) Matches(text string) bool {
+	mm.mutex.RLock()
+	defer mm.mutex.RUnlock()
+
+	return mm.any.MatchString(text)
+}
+
+// normalizeKeywords trims, lowercases, de-duplicates and sorts a keyword list
+func normalizeKeywords(keywords []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, keyword := range keywords {
+		keyword = strings.ToLower(strings.TrimSpace(keyword))
+		if keyword == "" || seen[keyword] {
+			continue
+		}
+		seen[keyword] = true
+		result = append(result, keyword)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// compileMentionPattern builds a case-insensitive regexp matching any term as a whole word.
+// The boundaries are written out because \b doesn't work for terms like "@bob" or "host:port".
+func compileMentionPattern(terms []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(terms))
+	for _, term := range terms {
+		if term != "" {
+			quoted = append(quoted, regexp.QuoteMeta(term))
+		}
+	}
+	if len(quoted) == 0 {
+		return regexp.MustCompile(`$.^`) // Matches nothing
+	}
+
+	const boundary = `[^\pL\pN_]`
+	return regexp.MustCompile(`(?i)(?:^|` + boundary + `)(?:` + strings.Join(quoted, "|") + `)(?:$|` + boundary + `)`)
+}
+
+// handleKeywordsCommand processes /keywords add|remove|list and saves the list to the config file
+func (en *EnhancedNode) handleKeywordsCommand(args string) {
+	action, keyword, _ := strings.Cut(strings.TrimSpace(args), " ")
+	keyword = strings.TrimSpace(keyword)
+	keywords := en.mentions.Keywords()
+
+	var reply string
+	switch {
+	case action == "" || action == "list":
+		if len(keywords) == 0 {
+			reply = "No keywords set"
+		} else {
+			reply = "Keywords: " + strings.Join(keywords, ", ")
+		}
+
+	case (action == "add" || action == "remove") && keyword != "":
+		if action == "add" {
+			keywords = append(keywords, keyword)
+		} else {
+			keywords = removeKeyword(keywords, keyword)
+		}
+		en.mentions.Set(en.mentions.Nick(), keywords)
+		reply = fmt.Sprintf("Keywords: %s", strings.Join(en.mentions.Keywords(), ", "))
+
+		en.config.Keywords = en.mentions.Keywords()
+		if err := SaveConfig(en.configPath, en.config); err != nil {
+			log.Printf("Failed to save config: %v", err)
+			reply += fmt.Sprintf(" (not saved: %v)", err)
+		}
+
+	default:
+		reply = "Usage: /keywords add <word> | /keywords remove <word> | /keywords list"
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
+
+// removeKeyword returns keywords without keyword (case-insensitive)
+func removeKeyword(keywords []string, keyword string) []string {
+	var result []string
+	for _, existing := range keywords {
+		if !strings.EqualFold(existing, keyword) {
+			result = append(result, existing)
+		}
+	}
+	return result
+}
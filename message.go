@@ -1,8 +1,8 @@
 package main
 
 import (
-	"fmt"
 	"log"
+	"sort"
 	"strings"
 )
 
@@ -12,59 +12,87 @@ func (n *Node) handleIncomingMessage(msg Message) {
 	if strings.HasPrefix(content, "GOSSIP_PEERS:") {
 		peerListStr := strings.TrimPrefix(content, "GOSSIP_PEERS:")
 		if peerListStr != "" {
-			peerList := strings.Split(peerListStr, ",")
-			n.PeerListGossip <- peerList
+			n.handlePeerListGossip(strings.Split(peerListStr, ","))
 		}
 		return
 	}
 
 	// Regular message - send to UI
+	n.notifyUI(msg)
+}
+
+// notifyUI records a message in the message log and forwards it to the UI.
+// Everything shown to the user passes through here, so this is where peer text is sanitized.
+func (n *Node) notifyUI(msg Message) {
+	msg.SenderID = sanitizeLine(msg.SenderID)
+	msg.Content = []byte(sanitizeText(string(msg.Content)))
+	// Attribute the message to the sender's key, which outlasts the address it came from
+	if msg.SenderKey == "" && msg.SenderID != "System" {
+		msg.SenderKey = n.peerFingerprint(msg.SenderID)
+	}
+	// The same for the conversation it belongs in, so history keeps it with that peer
+	msg.Conversation = messageConversation(msg, n.ID)
+	if peer := conversationTab(msg.Conversation); peer != "" && msg.ConversationKey == "" {
+		msg.ConversationKey = n.peerFingerprint(peer)
+	}
+
+	n.events.Publish(eventMessage, n.messageLog.Append(msg))
+
+	// Never blocks: a stalled UI must not hold up peer handling
 	if n.uiChannel != nil {
-		n.uiChannel <- msg
+		n.uiQueue.Push(msg)
 	}
 }
 
 func (n *Node) broadcast(msg Message) {
-	networkMsg := fmt.Sprintf("%s%c%s", msg.SenderID, delimiter, string(msg.Content))
+	frame := newFrame(msg.SenderID, msg.Content)
 
-	n.peersMutex.RLock()
-	defer n.peersMutex.RUnlock()
-
-	for _, peer := range n.Peers {
-		select {
-		case peer.Send <- []byte(networkMsg):
-		default:
-			log.Printf("Peer %s send channel full, dropping message", peer.ID)
-		}
+	for _, peerID := range n.queueFrame(frame) {
+		log.Printf("Peer %s send channel full, dropping message", peerID)
 	}
 }
 
-func (n *Node) sendPeerListGossip() {
-	n.peersMutex.RLock()
+// peerListGossip builds a GOSSIP_PEERS frame listing the peers we know, or nil if we know none.
+// Nodes that exchange signed peer records only send it to peers that don't.
+func (n *Node) peerListGossip() []byte {
 	n.knownMutex.RLock()
-	defer n.peersMutex.RUnlock()
-	defer n.knownMutex.RUnlock()
-
 	// Build peer list
 	peerList := make([]string, 0, len(n.KnownPeers))
-	for peer := range n.KnownPeers {
+	for _, known := range n.KnownPeers {
+		// Addresses given up on as unreachable aren't passed on
+		peer := known.Addr
+		if !known.Reachable {
+			continue
+		}
+		// Over Tor only onion addresses are shared: the rest are loopback connection addresses,
+		// or direct addresses that say who we talk to
+		if n.tor != nil && !isOnionAddr(peer) {
+			continue
+		}
 		if peer != n.ID {
 			peerList = append(peerList, peer)
 		}
 	}
+	n.knownMutex.RUnlock()
 
 	if len(peerList) == 0 {
+		return nil
+	}
+	// In a fixed order, so an unchanged list makes an unchanged frame (gossipChanged)
+	sort.Strings(peerList)
+	return newFrame(n.ID, []byte("GOSSIP_PEERS:"+strings.Join(peerList, ",")))
+}
+
+// sendPeerListGossip sends the peer list to every connected peer, unless full is unset and
+// nothing changed since the last round
+func (n *Node) sendPeerListGossip(full bool) {
+	frame := n.peerListGossip()
+	if frame == nil || (!n.gossipChanged(frame) && !full) {
 		return
 	}
 
 	// Send to all connected peers
-	gossipMsg := fmt.Sprintf("GOSSIP_PEERS:%s", strings.Join(peerList, ","))
-
-	for _, peer := range n.Peers {
-		select {
-		case peer.Send <- []byte(fmt.Sprintf("%s%c%s", n.ID, delimiter, gossipMsg)):
-		default:
-			log.Printf("Peer %s send channel full, dropping gossip", peer.ID)
-		}
+	for _, peerID := range n.queueFrame(frame) {
+		log.Printf("Peer %s send channel full, dropping gossip", peerID)
 	}
 }
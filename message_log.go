@@ -0,0 +1,178 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	messageLogLimit = 1000 // Maximum number of messages kept in memory
+)
+
+// LoggedMessage is a message that was delivered to the UI, with a local sequence ID
+type LoggedMessage struct {
+	ID         int64      `json:"id"`
+	Timestamp  time.Time  `json:"timestamp"`
+	SenderID   string     `json:"sender"`
+	SenderKey  string     `json:"sender_key,omitempty"` // Fingerprint of the sender's key, if it was known
+	Content    string     `json:"text"`
+	FromPeerID string     `json:"from_peer,omitempty"`
+	Lamport    uint64     `json:"lamport,omitempty"`
+	Seq        uint64     `json:"seq,omitempty"`
+	Backfill   bool       `json:"backfill,omitempty"`
+	Mention    bool       `json:"mention,omitempty"`
+	Action     bool       `json:"action,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // Ephemeral messages are deleted at this time
+	Direct     bool       `json:"direct,omitempty"`
+	To         string     `json:"to,omitempty"`         // Recipient of a direct message we sent
+	Room       string     `json:"room,omitempty"`       // Room a room message was sent in
+	Attachment string     `json:"attachment,omitempty"` // Path of a file we received
+	MessageID  string     `json:"message_id,omitempty"` // Sender's ID for a text message
+	Read       []string   `json:"read,omitempty"`       // A read receipt: message IDs of ours the sender has seen
+
+	Conversation    string `json:"conversation,omitempty"`     // Peer node ID, room, or "broadcast"; empty for notices not about one conversation
+	ConversationKey string `json:"conversation_key,omitempty"` // Fingerprint of that peer's key, if it was known
+}
+
+// MessageLog keeps a bounded in-memory record of recent UI messages
+type MessageLog struct {
+	mutex   sync.RWMutex
+	entries []LoggedMessage
+	nextID  int64
+	limit   int
+	updated chan struct{} // Closed and replaced on every append
+}
+
+// NewMessageLog creates a message log holding at most limit entries
+func NewMessageLog(limit int) *MessageLog {
+	return &MessageLog{
+		entries: make([]LoggedMessage, 0, limit),
+		nextID:  1,
+		limit:   limit,
+		updated: make(chan struct{}),
+	}
+}
+
+// Append records a message and returns the stored entry
+func (ml *MessageLog) Append(msg Message) LoggedMessage {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	timestamp := msg.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	entry := LoggedMessage{
+		ID:         ml.nextID,
+		Timestamp:  timestamp,
+		SenderID:   msg.SenderID,
+		SenderKey:  msg.SenderKey,
+		Content:    string(msg.Content),
+		FromPeerID: msg.FromPeerID,
+		Lamport:    msg.Lamport,
+		Seq:        msg.Seq,
+		Backfill:   msg.Backfill,
+		Mention:    msg.Mention,
+		Action:     msg.Action,
+		Direct:     msg.Direct,
+		To:         msg.To,
+		Room:       msg.Room,
+		Attachment: msg.Attachment,
+		MessageID:  msg.ID,
+		Read:       msg.ReadIDs,
+
+		Conversation:    msg.Conversation,
+		ConversationKey: msg.ConversationKey,
+	}
+	if !msg.ExpiresAt.IsZero() {
+		expiresAt := msg.ExpiresAt
+		entry.ExpiresAt = &expiresAt
+	}
+	ml.nextID++
+
+	// Evict the oldest entry once the limit is reached
+	if len(ml.entries) >= ml.limit {
+		copy(ml.entries, ml.entries[1:])
+		ml.entries = ml.entries[:len(ml.entries)-1]
+	}
+	ml.entries = append(ml.entries, entry)
+
+	// Wake up anyone waiting for new entries
+	close(ml.updated)
+	ml.updated = make(chan struct{})
+
+	return entry
+}
+
+// Updated returns a channel that is closed when the next entry is appended
+func (ml *MessageLog) Updated() <-chan struct{} {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return ml.updated
+}
+
+// Since returns all entries with an ID greater than id, oldest first
+func (ml *MessageLog) Since(id int64) []LoggedMessage {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	result := make([]LoggedMessage, 0)
+	for _, entry := range ml.entries {
+		if entry.ID > id {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// Expire deletes ephemeral entries whose expiry is at or before now, returning how many were removed
+func (ml *MessageLog) Expire(now time.Time) int {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	kept := ml.entries[:0]
+	for _, entry := range ml.entries {
+		if entry.ExpiresAt == nil || now.Before(*entry.ExpiresAt) {
+			kept = append(kept, entry)
+		}
+	}
+	removed := len(ml.entries) - len(kept)
+	ml.entries = kept
+	return removed
+}
+
+// LastID returns the ID of the most recently appended entry (0 if empty)
+func (ml *MessageLog) LastID() int64 {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return ml.nextID - 1
+}
+
+// Get returns the entry with the given ID, if it is still kept
+func (ml *MessageLog) Get(id int64) (LoggedMessage, bool) {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	for _, entry := range ml.entries {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return LoggedMessage{}, false
+}
+
+// LastFromPeer returns the most recent message a peer sent, read receipts aside
+func (ml *MessageLog) LastFromPeer() (LoggedMessage, bool) {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	for i := len(ml.entries) - 1; i >= 0; i-- {
+		if ml.entries[i].FromPeerID != "" && len(ml.entries[i].Read) == 0 {
+			return ml.entries[i], true
+		}
+	}
+	return LoggedMessage{}, false
+}
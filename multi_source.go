@@ -0,0 +1,698 @@
+package main
+
+import (
+	"cmp"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	rangeChunks       = 16               // Chunks asked of one source at a time (128 KB)
+	rangeMaxChunks    = 64               // Most chunks a source sends for one request
+	rangeStallTimeout = 10 * time.Second // A source that sends nothing for this long is dropped
+	rangeCheckEvery   = time.Second      // How often a download looks for stalled and departed sources
+	maxRangesServed   = 2                // Ranges sent to one peer at once
+	haveFileInterval  = time.Second      // Have-file questions from a peer closer together than this are ignored
+	maxHashLookups    = 2                // Have-file questions looked up at once, for all peers together
+)
+
+// peerLookup says whether a peer is still connected, so a download can drop a source that left
+type peerLookup interface {
+	connectedNode(nodeID string) bool
+}
+
+// fileHash is the SHA-256 of a shared file as it was when hashed
+type fileHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// rangeSource is a peer a multi-source download takes chunks from
+type rangeSource struct {
+	nodeID  string
+	pending map[int]bool // Chunks asked of it that haven't arrived
+	heard   time.Time    // When it last sent a chunk or was asked for a range
+}
+
+// rangeDownload is the receiving side of a download split across every peer that has a file with
+// the same SHA-256. The receiver asks each source for a range of chunks at a time; a source that
+// stalls or disconnects is dropped, and the chunks it owed go to the others. All of it is guarded
+// by the transfer's mutex.
+type rangeDownload struct {
+	hash        string
+	asked       map[string]bool         // Peers asked whether they have the file, who may join as sources
+	sources     map[string]*rangeSource // Node ID -> source still in use
+	contributed map[string]int          // Node ID -> chunks it sent, dropped sources included
+	joined      []string                // Node IDs in the order they became sources
+	unassigned  []int                   // Chunks no source has been asked for, in order
+	done        chan struct{}           // Closed when the download ends
+	clock       Clock                   // The node's, for when sources were last heard from
+}
+
+// rangeRequest is a range to ask of a source
+type rangeRequest struct {
+	nodeID string
+	first  int
+	count  int
+}
+
+// validFileHash reports whether a hash is a hex SHA-256
+func validFileHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// accepts reports whether a chunk from a peer belongs in the transfer: any peer's for a transfer
+// it pushes, only a current source's for a multi-source download
+func (d *rangeDownload) accepts(peerID string) bool {
+	return d == nil || d.sources[peerID] != nil
+}
+
+// addSource makes a peer a source and returns the first range to ask of it
+func (d *rangeDownload) addSource(nodeID string) (rangeRequest, bool) {
+	d.sources[nodeID] = &rangeSource{nodeID: nodeID, pending: make(map[int]bool)}
+	d.joined = append(d.joined, nodeID)
+	return d.assign(d.sources[nodeID])
+}
+
+// assign gives an idle source the next run of unassigned chunks, up to rangeChunks
+func (d *rangeDownload) assign(source *rangeSource) (rangeRequest, bool) {
+	if len(source.pending) > 0 || len(d.unassigned) == 0 {
+		return rangeRequest{}, false
+	}
+	count := 1
+	for count < len(d.unassigned) && count < rangeChunks && d.unassigned[count] == d.unassigned[0]+count {
+		count++
+	}
+	for _, index := range d.unassigned[:count] {
+		source.pending[index] = true
+	}
+	request := rangeRequest{nodeID: source.nodeID, first: d.unassigned[0], count: count}
+	d.unassigned = d.unassigned[count:]
+	source.heard = d.clock.Now()
+	return request, true
+}
+
+// arrived records a chunk from a source, returning the next range to ask of it once its current
+// one is in. fresh is false for a chunk that had already arrived, sent twice.
+func (d *rangeDownload) arrived(nodeID string, index int, fresh bool) (rangeRequest, bool) {
+	if d == nil || d.sources[nodeID] == nil {
+		return rangeRequest{}, false
+	}
+	source := d.sources[nodeID]
+	if fresh {
+		d.contributed[nodeID]++
+	}
+	source.heard = d.clock.Now()
+	delete(source.pending, index)
+	return d.assign(source)
+}
+
+// drop stops using a source. The chunks it owed and that haven't arrived go back to be assigned.
+func (d *rangeDownload) drop(nodeID string, received map[int][]byte) {
+	source := d.sources[nodeID]
+	if source == nil {
+		return
+	}
+	delete(d.sources, nodeID)
+	for index := range source.pending {
+		if _, have := received[index]; !have {
+			d.unassigned = append(d.unassigned, index)
+		}
+	}
+	slices.Sort(d.unassigned)
+}
+
+// startRangeDownload starts downloading a file by its hash from one peer. Others that have it too
+// join as sources with addRangeSource once they say so.
+func (ftm *FileTransferManager) startRangeDownload(fileName string, size int64, hash, nodeID string, others []string) (*FileTransfer, error) {
+	if size <= 0 || size > maxFileBytes {
+		return nil, fmt.Errorf("%w: %s is %s, outside the %s file limit", errMessageTooLarge,
+			fileName, formatBytes(size), formatBytes(maxFileBytes))
+	}
+
+	totalChunks := int((size + chunkSize - 1) / chunkSize)
+	download := &rangeDownload{
+		hash:        hash,
+		asked:       make(map[string]bool),
+		sources:     make(map[string]*rangeSource),
+		contributed: make(map[string]int),
+		unassigned:  make([]int, totalChunks),
+		done:        make(chan struct{}),
+		clock:       ftm.node.wallClock,
+	}
+	for i := range download.unassigned {
+		download.unassigned[i] = i
+	}
+	for _, other := range others {
+		download.asked[other] = true
+	}
+	transfer := &FileTransfer{
+		FileID:      ftm.generateFileID(),
+		FileName:    sanitizeFileName(fileName),
+		FileSize:    size,
+		Chunks:      make(map[int][]byte),
+		TotalChunks: totalChunks,
+		Status:      "active",
+		PeerID:      nodeID,
+		download:    download,
+	}
+
+	ftm.mutex.Lock()
+	ftm.activeTransfers[transfer.FileID] = transfer
+	ftm.mutex.Unlock()
+
+	transfer.mutex.Lock()
+	ftm.publish(transfer)
+	request, _ := download.addSource(nodeID)
+	transfer.mutex.Unlock()
+
+	ftm.requestRange(transfer, request)
+	go ftm.watchRangeDownload(transfer)
+	return transfer, nil
+}
+
+// addRangeSource adds a peer that says it has a download's file as a source, if it was asked
+func (ftm *FileTransferManager) addRangeSource(fileID, nodeID, hash string, size int64) {
+	ftm.mutex.RLock()
+	transfer, exists := ftm.activeTransfers[fileID]
+	ftm.mutex.RUnlock()
+	if !exists || transfer.download == nil {
+		log.Printf("%s has the file of unknown download %s", nodeID, fileID)
+		return
+	}
+
+	transfer.mutex.Lock()
+	download := transfer.download
+	if transfer.Status != "active" || !download.asked[nodeID] || hash != download.hash || size != transfer.FileSize {
+		transfer.mutex.Unlock()
+		return
+	}
+	delete(download.asked, nodeID)
+	request, assigned := download.addSource(nodeID)
+	transfer.mutex.Unlock()
+
+	log.Printf("%s has %s too; downloading from %d source(s)", nodeID, transfer.FileName, len(download.joined))
+	if assigned {
+		ftm.requestRange(transfer, request)
+	}
+}
+
+// requestRange asks a source for a range of chunks. A source that can't be asked is dropped.
+func (ftm *FileTransferManager) requestRange(transfer *FileTransfer, request rangeRequest) {
+	data, err := json.Marshal(fileSearchMessage{
+		Type:  "range",
+		ID:    transfer.FileID,
+		Hash:  transfer.download.hash,
+		Size:  transfer.FileSize,
+		First: request.first,
+		Count: request.count,
+	})
+	if err == nil {
+		err = ftm.sender.sendEncryptedTo(request.nodeID, data, "search")
+	}
+	if err != nil {
+		log.Printf("Failed to ask %s for chunks %d-%d of %s: %v", request.nodeID, request.first, request.first+request.count-1, transfer.FileName, err)
+		transfer.mutex.Lock()
+		transfer.download.drop(request.nodeID, transfer.Chunks)
+		transfer.mutex.Unlock()
+	}
+}
+
+// watchRangeDownload drops sources that stall or disconnect, and hands the chunks they owed to
+// the sources that are idle. The download fails when no source is left.
+func (ftm *FileTransferManager) watchRangeDownload(transfer *FileTransfer) {
+	ticker := ftm.node.wallClock.NewTicker(rangeCheckEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.Chan():
+		case <-transfer.download.done:
+			return
+		case <-ftm.node.Shutdown:
+			return
+		}
+
+		transfer.mutex.Lock()
+		if transfer.Status != "active" {
+			transfer.mutex.Unlock()
+			return
+		}
+		download := transfer.download
+		now := ftm.node.wallClock.Now()
+		var dropped []string
+		for nodeID, source := range download.sources {
+			stalled := len(source.pending) > 0 && now.Sub(source.heard) > rangeStallTimeout
+			if stalled || (ftm.peers != nil && !ftm.peers.connectedNode(nodeID)) {
+				download.drop(nodeID, transfer.Chunks)
+				dropped = append(dropped, nodeID)
+			}
+		}
+		var requests []rangeRequest
+		for _, nodeID := range download.joined {
+			if source := download.sources[nodeID]; source != nil {
+				if request, assigned := download.assign(source); assigned {
+					requests = append(requests, request)
+				}
+			}
+		}
+		failed := len(download.sources) == 0
+		if failed {
+			transfer.Status = "failed"
+			close(download.done)
+			ftm.publish(transfer)
+		}
+		transfer.mutex.Unlock()
+
+		for _, nodeID := range dropped {
+			log.Printf("Dropped %s as a source of %s: it stalled or disconnected", nodeID, transfer.FileName)
+			if !failed {
+				ftm.node.notifyUI(Message{
+					SenderID:     "System",
+					Content:      []byte(fmt.Sprintf("⚠️ %s stalled or disconnected; the rest of %s comes from the other peers", ftm.sourceName(nodeID), transfer.FileName)),
+					Conversation: transfer.PeerID,
+				})
+			}
+		}
+		if failed {
+			ftm.mutex.Lock()
+			delete(ftm.activeTransfers, transfer.FileID)
+			ftm.mutex.Unlock()
+			ftm.node.notifyUI(Message{
+				SenderID:     "System",
+				Content:      []byte(fmt.Sprintf("❌ Download of %s failed: every peer that had it stalled or disconnected", transfer.FileName)),
+				Conversation: transfer.PeerID,
+			})
+			return
+		}
+		for _, request := range requests {
+			ftm.requestRange(transfer, request)
+		}
+	}
+}
+
+// finishRangeDownload checks a multi-source download's SHA-256 and saves it; the caller must hold
+// the transfer's mutex
+func (ftm *FileTransferManager) finishRangeDownload(transfer *FileTransfer) {
+	download := transfer.download
+	close(download.done)
+	defer ftm.publish(transfer)
+	defer func() {
+		ftm.mutex.Lock()
+		delete(ftm.activeTransfers, transfer.FileID)
+		ftm.mutex.Unlock()
+	}()
+
+	fileData := make([]byte, 0, transfer.FileSize)
+	for i := 0; i < transfer.TotalChunks; i++ {
+		fileData = append(fileData, transfer.Chunks[i]...)
+	}
+	sum := sha256.Sum256(fileData)
+	if hex.EncodeToString(sum[:]) != download.hash {
+		transfer.Status = "failed"
+		log.Printf("Download of %s doesn't match its SHA-256; discarded", transfer.FileName)
+		ftm.node.notifyUI(Message{
+			SenderID:     "System",
+			Content:      []byte(fmt.Sprintf("❌ %s doesn't match the SHA-256 it was shared with; discarded it", transfer.FileName)),
+			Conversation: transfer.PeerID,
+		})
+		return
+	}
+
+	downloadDir, layout, _ := ftm.receiveSettings()
+	filePath, err := ftm.saveReceivedFile(downloadDir, layout, transfer.PeerID, "", transfer.FileName, fileData)
+	if err != nil {
+		transfer.Status = "failed"
+		log.Printf("Failed to save file: %v", err)
+		return
+	}
+	transfer.Status = "complete"
+
+	var sources []string
+	for _, nodeID := range download.joined {
+		sources = append(sources, fmt.Sprintf("%s (%d chunks)", ftm.sourceName(nodeID), download.contributed[nodeID]))
+	}
+	log.Printf("File received from %d source(s): %s (%d bytes; %s)", len(sources), filePath, len(fileData), strings.Join(sources, ", "))
+
+	savedAs := filePath
+	if relative, err := filepath.Rel(downloadDir, filePath); err == nil {
+		savedAs = relative
+	}
+	ftm.node.notifyUI(Message{
+		SenderID:     "System",
+		Content:      []byte(fmt.Sprintf("✅ Received %s from %s, saved as %s in %s", transfer.FileName, strings.Join(sources, ", "), savedAs, downloadDir)),
+		Attachment:   filePath,
+		Conversation: transfer.PeerID,
+	})
+}
+
+// sourceName names a download's source for the user: its contact alias or nick, or its node ID
+func (ftm *FileTransferManager) sourceName(nodeID string) string {
+	if ftm.origins == nil {
+		return nodeID
+	}
+	return cmp.Or(ftm.origins.fileOrigin(nodeID, "").Peer, nodeID)
+}
+
+// sendRange sends a peer chunks of a shared file for its multi-source download, waiting for room
+// when the connection's send queue is full
+func (ftm *FileTransferManager) sendRange(peerID, fileID, path string, size int64, first, count int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stream := fmt.Sprintf("%s-%d", fileID, first)
+	defer ftm.sender.finishStream(peerID, stream)
+	totalChunks := int((size + chunkSize - 1) / chunkSize)
+	buffer := make([]byte, chunkSize)
+	for index := first; index < first+count; index++ {
+		n, err := file.ReadAt(buffer, int64(index)*chunkSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		chunk := buffer[:n]
+		chunkMsg := FileMessage{
+			Type:        "chunk",
+			FileID:      fileID,
+			ChunkIndex:  index,
+			TotalChunks: totalChunks,
+			Data:        base64.StdEncoding.EncodeToString(chunk),
+			Checksum:    fmt.Sprintf("%x", md5.Sum(chunk)),
+		}
+
+		deadline := ftm.node.wallClock.Now().Add(chunkAckTimeout)
+		for {
+			err = ftm.sendTransferMessage(peerID, stream, chunkMsg)
+			if !errors.Is(err, ErrSendQueueFull) || ftm.node.wallClock.Now().After(deadline) {
+				break
+			}
+			select {
+			case <-ftm.node.wallClock.After(queueFullRetry):
+			case <-ftm.node.Shutdown:
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canDownloadRanges reports whether a search result can be downloaded by its hash, from every
+// peer that has it, rather than offered by the one peer with /get
+func (en *EnhancedNode) canDownloadRanges(result searchResult) bool {
+	if result.Match.Hash == "" || result.Match.Size <= 0 {
+		return false
+	}
+	capabilities, announced := en.peerCapabilities(result.NodeID)
+	return announced && capabilities.Has(capabilityFileRanges)
+}
+
+// startMultiSourceGet downloads a search result from its peer, and asks the other connected peers
+// that serve ranges whether they have a file with the same hash to download from too
+func (en *EnhancedNode) startMultiSourceGet(result searchResult) {
+	var others []string
+	for _, peerID := range en.PeerIDs() {
+		_, nodeID, err := en.resolvePeer(peerID)
+		if err != nil || nodeID == result.NodeID || slices.Contains(others, nodeID) {
+			continue
+		}
+		if capabilities, announced := en.peerCapabilities(peerID); announced && capabilities.Has(capabilityFileRanges) {
+			others = append(others, nodeID)
+		}
+	}
+
+	name := result.Match.Name[strings.LastIndex(result.Match.Name, "/")+1:]
+	transfer, err := en.fileManager.startRangeDownload(name, result.Match.Size, result.Match.Hash, result.NodeID, others)
+	if err != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Couldn't download %s: %v", result.Match.Name, err)),
+		})
+		return
+	}
+
+	query, err := json.Marshal(fileSearchMessage{Type: "have-file", ID: transfer.FileID, Hash: result.Match.Hash, Size: result.Match.Size})
+	if err != nil {
+		log.Printf("Failed to serialize have-file query: %v", err)
+		return
+	}
+	for _, nodeID := range others {
+		if err := en.sendEncryptedTo(nodeID, query, "search"); err != nil {
+			log.Printf("Failed to ask %s for %s: %v", nodeID, result.Match.Hash, err)
+		}
+	}
+
+	content := fmt.Sprintf("📥 Downloading %s (%s) from %s", result.Match.Name, formatBytes(result.Match.Size), en.searchPeerName(result.NodeID))
+	if len(others) > 0 {
+		content += fmt.Sprintf(", and from any of %d other peer(s) that have it too", len(others))
+	}
+	en.notifyUI(Message{SenderID: "System", Content: []byte(content), Conversation: result.NodeID})
+}
+
+// answerHaveFile tells a peer whether a shared file has the SHA-256 it asks about. Looking one up
+// may hash every shared file of that size, so a peer is answered at most once per
+// haveFileInterval, and no more than maxHashLookups are looked up at once.
+func (en *EnhancedNode) answerHaveFile(senderID string, fromPeerKey bool, query fileSearchMessage) {
+	if len(en.search.sharing()) == 0 || !fromPeerKey || !validFileHash(query.Hash) || query.Size <= 0 || query.Size > maxFileBytes {
+		return
+	}
+	if !en.search.allowHaveFile(senderID, en.wallClock.Now()) {
+		log.Printf("Ignored have-file from %s: too soon after its last one, or %d lookups under way", senderID, maxHashLookups)
+		return
+	}
+
+	en.wg.Add(1)
+	go func() {
+		defer en.wg.Done()
+		defer en.search.doneLookup()
+		if _, found := en.search.findByHash(query.Hash, query.Size); !found {
+			return
+		}
+		data, err := json.Marshal(fileSearchMessage{Type: "has-file", ID: query.ID, Hash: query.Hash, Size: query.Size})
+		if err != nil {
+			log.Printf("Failed to serialize has-file answer: %v", err)
+			return
+		}
+		if err := en.sendEncryptedTo(senderID, data, "search"); err != nil {
+			log.Printf("Failed to tell %s we have %s: %v", senderID, query.Hash, err)
+		}
+	}()
+}
+
+// serveRange sends a peer the chunks it asks for of a shared file, found by its SHA-256. A peer
+// gets at most maxRangesServed ranges at once.
+func (en *EnhancedNode) serveRange(senderID string, fromPeerKey bool, request fileSearchMessage) {
+	if len(en.search.sharing()) == 0 || !fromPeerKey || !validFileHash(request.Hash) || request.Size <= 0 || request.Size > maxFileBytes {
+		return
+	}
+	totalChunks := int((request.Size + chunkSize - 1) / chunkSize)
+	if request.First < 0 || request.Count < 1 || request.Count > rangeMaxChunks || request.First+request.Count > totalChunks {
+		log.Printf("Refused range %d+%d of a %d-chunk file from %s", request.First, request.Count, totalChunks, senderID)
+		return
+	}
+	if !en.search.startServing(senderID) {
+		log.Printf("Refused range from %s: %d already being sent", senderID, maxRangesServed)
+		return
+	}
+
+	en.wg.Add(1)
+	go func() {
+		defer en.wg.Done()
+		defer en.search.doneServing(senderID)
+		path, found := en.search.findByHash(request.Hash, request.Size)
+		if !found {
+			log.Printf("%s asked for chunks of %s, which isn't shared", senderID, request.Hash)
+			return
+		}
+		if err := en.fileManager.sendRange(senderID, request.ID, path, request.Size, request.First, request.Count); err != nil {
+			log.Printf("Failed to send chunks %d-%d of %s to %s: %v", request.First, request.First+request.Count-1, filepath.Base(path), senderID, err)
+		}
+	}()
+}
+
+// connectedNode reports whether a node is connected
+func (en *EnhancedNode) connectedNode(nodeID string) bool {
+	_, _, err := en.resolvePeer(nodeID)
+	return err == nil
+}
+
+// allowHaveFile reports whether a peer's have-file is looked up: not more than one per
+// haveFileInterval, and only while fewer than maxHashLookups are under way. One allowed is counted
+// until doneLookup.
+func (fsr *FileSearch) allowHaveFile(nodeID string, now time.Time) bool {
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	if fsr.lookups >= maxHashLookups || !allowEvery(fsr.lastHave, nodeID, now, haveFileInterval) {
+		return false
+	}
+	fsr.lookups++
+	return true
+}
+
+// doneLookup counts a have-file looked up
+func (fsr *FileSearch) doneLookup() {
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	fsr.lookups--
+}
+
+// startServing counts a range being sent to a peer, unless it already has maxRangesServed
+func (fsr *FileSearch) startServing(nodeID string) bool {
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	if fsr.serving[nodeID] >= maxRangesServed {
+		return false
+	}
+	fsr.serving[nodeID]++
+	return true
+}
+
+// doneServing counts a range sent
+func (fsr *FileSearch) doneServing(nodeID string) {
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	if fsr.serving[nodeID]--; fsr.serving[nodeID] <= 0 {
+		delete(fsr.serving, nodeID)
+	}
+}
+
+// quickHash returns a shared file's SHA-256 for a search result: the one worked out before if the
+// file hasn't changed, otherwise a new one for files up to searchMaxHashBytes, otherwise none
+func (fsr *FileSearch) quickHash(path string, size int64) string {
+	if sum, known := fsr.cachedHash(path); known || size > searchMaxHashBytes {
+		return sum
+	}
+	sum, err := fsr.hashFile(path)
+	if err != nil {
+		log.Printf("Failed to hash %s: %v", path, err)
+	}
+	return sum
+}
+
+// cachedHash returns the SHA-256 worked out for a file, if its size and mtime haven't changed
+// since. The hash of a file that has changed or gone is forgotten.
+func (fsr *FileSearch) cachedHash(path string) (string, bool) {
+	info, err := os.Stat(path)
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	cached, exists := fsr.hashes[path]
+	if !exists {
+		return "", false
+	}
+	if err != nil || cached.size != info.Size() || !cached.modTime.Equal(info.ModTime()) {
+		delete(fsr.hashes, path)
+		if fsr.byHash[cached.sum] == path {
+			delete(fsr.byHash, cached.sum)
+		}
+		return "", false
+	}
+	return cached.sum, true
+}
+
+// hashFile works out a file's SHA-256 and remembers it
+func (fsr *FileSearch) hashFile(path string) (string, error) {
+	if sum, known := fsr.cachedHash(path); known {
+		return sum, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+
+	fsr.mutex.Lock()
+	defer fsr.mutex.Unlock()
+	fsr.hashes[path] = fileHash{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	fsr.byHash[sum] = path
+	return sum, nil
+}
+
+// findByHash finds a shared file with a SHA-256 and size: the one found last time if it is still
+// shared and unchanged, otherwise by hashing the shared files of that size. Hidden files and
+// symlinks are skipped as in searches.
+func (fsr *FileSearch) findByHash(hash string, size int64) (string, bool) {
+	shares := fsr.sharing()
+	fsr.mutex.Lock()
+	path, known := fsr.byHash[hash]
+	fsr.mutex.Unlock()
+	if known && isShared(shares, path) {
+		if sum, unchanged := fsr.cachedHash(path); unchanged && sum == hash {
+			return path, true
+		}
+	}
+
+	scanned := 0
+	found := ""
+	for _, share := range shares {
+		filepath.WalkDir(share.Path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if scanned++; scanned > searchMaxScanned {
+				return fs.SkipAll
+			}
+			if path != share.Path && strings.HasPrefix(entry.Name(), ".") {
+				if entry.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			if info, err := entry.Info(); err != nil || info.Size() != size {
+				return nil
+			}
+			if sum, err := fsr.hashFile(path); err == nil && sum == hash {
+				found = path
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if found != "" {
+			return found, true
+		}
+	}
+	return "", false
+}
+
+// isShared reports whether a path is inside one of the shared directories
+func isShared(shares []sharedDir, path string) bool {
+	for _, share := range shares {
+		if inside, err := filepath.Rel(share.Path, path); err == nil && filepath.IsLocal(inside) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMultiSourceDownload downloads a file shared by two seeds: both send chunks of it, and the
+// chunks add up to the whole file
+func TestMultiSourceDownload(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	a, b, c := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+
+	// Enough chunks that the second seed joins long before the first could send them all
+	data := bytes.Repeat([]byte("multi-source chunk data "), 40*chunkSize/24)
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	for _, seed := range []*EnhancedNode{b, c} {
+		dir := filepath.Join(t.TempDir(), "share")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "album.bin"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		seed.search.Configure([]string{dir}, true)
+	}
+	tn.connect(a, b)
+	tn.connect(a, c)
+	for _, seed := range []*EnhancedNode{b, c} {
+		waitFor(t, "a to learn "+seed.ID+" serves ranges", func() bool {
+			connID, _, err := a.resolvePeer(seed.ID)
+			if err != nil {
+				return false
+			}
+			capabilities, announced := a.peerCapabilities(connID)
+			return announced && capabilities.Has(capabilityFileRanges)
+		})
+	}
+
+	result := searchResult{NodeID: b.ID, Match: sharedFileMatch{Name: "share/album.bin", Size: int64(len(data)), Hash: hash}}
+	if !a.canDownloadRanges(result) {
+		t.Fatal("result with a hash from a peer serving ranges can't be downloaded by range")
+	}
+	a.startMultiSourceGet(result)
+
+	waitForNotice(t, a, "✅ Received album.bin")
+	downloadDir, _, _ := a.fileManager.receiveSettings()
+	received, err := os.ReadFile(filepath.Join(downloadDir, "album.bin"))
+	if err != nil {
+		t.Fatalf("received file: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %d bytes that differ from the %d shared", len(received), len(data))
+	}
+	for _, notice := range loggedTexts(a, "System") {
+		if !strings.Contains(notice, "✅ Received album.bin") {
+			continue
+		}
+		// Each seed is named with the chunks it sent, and each must have sent some
+		total := 0
+		for _, seed := range []*EnhancedNode{b, c} {
+			match := regexp.MustCompile(regexp.QuoteMeta(seed.ID) + ` \((\d+) chunks\)`).FindStringSubmatch(notice)
+			if match == nil {
+				t.Errorf("%s isn't named as a source: %s", seed.ID, notice)
+				continue
+			}
+			chunks, _ := strconv.Atoi(match[1])
+			if chunks == 0 {
+				t.Errorf("%s sent no chunks: %s", seed.ID, notice)
+			}
+			total += chunks
+		}
+		if want := (len(data) + chunkSize - 1) / chunkSize; total != want {
+			t.Errorf("the seeds sent %d chunks between them, want %d", total, want)
+		}
+	}
+}
+
+// TestHaveFileLimits rate-limits have-file questions per peer and caps the lookups under way
+func TestHaveFileLimits(t *testing.T) {
+	fsr := NewFileSearch()
+	now := time.Now()
+
+	if !fsr.allowHaveFile("peer-1", now) {
+		t.Fatal("first have-file from a peer refused")
+	}
+	if fsr.allowHaveFile("peer-1", now.Add(haveFileInterval/2)) {
+		t.Error("second have-file within the interval allowed")
+	}
+	if !fsr.allowHaveFile("peer-2", now) {
+		t.Fatal("have-file from another peer refused")
+	}
+	if fsr.allowHaveFile("peer-3", now) {
+		t.Errorf("have-file allowed with %d lookups under way", maxHashLookups)
+	}
+	fsr.doneLookup()
+	if !fsr.allowHaveFile("peer-3", now) {
+		t.Error("have-file refused once a lookup finished")
+	}
+	fsr.doneLookup()
+	if !fsr.allowHaveFile("peer-1", now.Add(haveFileInterval)) {
+		t.Error("have-file refused after the interval")
+	}
+}
+
+// TestHashCache keeps a file's hash until the file changes or goes
+func TestHashCache(t *testing.T) {
+	fsr := NewFileSearch()
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := fsr.hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, known := fsr.cachedHash(path); !known || cached != sum {
+		t.Fatalf("hash not cached: %q, %v", cached, known)
+	}
+
+	// Same size, later mtime: the cached hash no longer holds
+	if err := os.WriteFile(path, []byte("again"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, known := fsr.cachedHash(path); known {
+		t.Fatal("hash of a changed file still cached")
+	}
+	if _, known := fsr.byHash[sum]; known {
+		t.Error("the old hash still leads to the changed file")
+	}
+	if resum, err := fsr.hashFile(path); err != nil || resum == sum {
+		t.Errorf("rehash gave %q, %v", resum, err)
+	}
+
+	os.Remove(path)
+	if _, known := fsr.cachedHash(path); known {
+		t.Error("hash of a removed file still cached")
+	}
+	if len(fsr.hashes) != 0 {
+		t.Errorf("%d hashes kept after the file went", len(fsr.hashes))
+	}
+}
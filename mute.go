@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const muteListFile = "muted.json"
+
+// mutedPeer is a muted peer as saved: the fingerprint of its key, which is what is muted, and the
+// node ID it was last seen at. Entries saved by versions that muted node IDs have no fingerprint
+// until a key is seen from that node ID, and match the node ID until then.
+type mutedPeer struct {
+	Fingerprint string `json:"fingerprint,omitempty"`
+	NodeID      string `json:"node_id"`
+}
+
+// MuteList holds the peers whose messages are hidden locally, persisted in the data dir.
+// Muting only affects the UI: the connection and file transfers keep working.
+type MuteList struct {
+	mutex      sync.RWMutex
+	path       string
+	muted      []*mutedPeer
+	suppressed map[string]int // Messages hidden this session, per fingerprint (node ID if unpinned)
+}
+
+// NewMuteList loads the mute list from dataDir, starting empty if there is none
+func NewMuteList(dataDir string) (*MuteList, error) {
+	ml := &MuteList{
+		path:       filepath.Join(dataDir, muteListFile),
+		suppressed: make(map[string]int),
+	}
+
+	data, err := os.ReadFile(ml.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ml, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mute list: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &ml.muted); err != nil {
+		return nil, fmt.Errorf("invalid mute list %s: %w", ml.path, err)
+	}
+	return ml, nil
+}
+
+// find returns the entry a peer matches: by key when it is known, otherwise by node ID. The
+// caller must hold the mutex.
+func (ml *MuteList) find(nodeID, fingerprint string) *mutedPeer {
+	for _, entry := range ml.muted {
+		if fingerprint != "" && entry.Fingerprint == fingerprint {
+			return entry
+		}
+		if entry.NodeID == nodeID && (entry.Fingerprint == "" || fingerprint == "") {
+			return entry
+		}
+	}
+	return nil
+}
+
+// IsMuted reports whether a peer is muted, given its node ID and its key's fingerprint if known
+func (ml *MuteList) IsMuted(nodeID, fingerprint string) bool {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return ml.find(nodeID, fingerprint) != nil
+}
+
+// Set mutes or unmutes a peer and saves the list. Without a fingerprint the node ID is muted
+// until a key is seen from it.
+func (ml *MuteList) Set(nodeID, fingerprint string, muted bool) error {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	entry := ml.find(nodeID, fingerprint)
+	switch {
+	case muted && entry == nil:
+		ml.muted = append(ml.muted, &mutedPeer{Fingerprint: fingerprint, NodeID: nodeID})
+	case muted:
+		entry.NodeID = nodeID
+		if entry.Fingerprint == "" {
+			entry.Fingerprint = fingerprint
+		}
+	case entry != nil:
+		ml.muted = slices.DeleteFunc(ml.muted, func(e *mutedPeer) bool { return e == entry })
+		delete(ml.suppressed, entry.identity())
+	}
+	return ml.save()
+}
+
+// Seen pins an unpinned entry for nodeID to the key just seen from it, and moves a muted key's
+// node ID along when it comes back from somewhere else
+func (ml *MuteList) Seen(nodeID, fingerprint string) error {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	entry := ml.find(nodeID, fingerprint)
+	if entry == nil || (entry.Fingerprint == fingerprint && entry.NodeID == nodeID) {
+		return nil
+	}
+	if suppressed, found := ml.suppressed[entry.identity()]; found {
+		delete(ml.suppressed, entry.identity())
+		ml.suppressed[fingerprint] += suppressed
+	}
+	entry.Fingerprint, entry.NodeID = fingerprint, nodeID
+	return ml.save()
+}
+
+// identity is what an entry's suppressed count is kept under
+func (entry *mutedPeer) identity() string {
+	if entry.Fingerprint != "" {
+		return entry.Fingerprint
+	}
+	return entry.NodeID
+}
+
+// Suppress counts a hidden message from a peer
+func (ml *MuteList) Suppress(nodeID, fingerprint string) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	key := fingerprint
+	if entry := ml.find(nodeID, fingerprint); entry != nil {
+		key = entry.identity()
+	} else if key == "" {
+		key = nodeID
+	}
+	ml.suppressed[key]++
+}
+
+// List returns the muted peers with how many of their messages were hidden this session, sorted
+// by node ID
+func (ml *MuteList) List() []MutedInfo {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	list := make([]MutedInfo, 0, len(ml.muted))
+	for _, entry := range ml.muted {
+		list = append(list, MutedInfo{NodeID: entry.NodeID, Fingerprint: entry.Fingerprint, Suppressed: ml.suppressed[entry.identity()]})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].NodeID < list[j].NodeID })
+	return list
+}
+
+// MutedInfo is a muted peer as /muted lists it
+type MutedInfo struct {
+	NodeID      string // Where the peer was last seen
+	Fingerprint string // Empty until a key is seen from NodeID
+	Suppressed  int
+}
+
+// save writes the list; the caller must hold the mutex
+func (ml *MuteList) save() error {
+	data, err := json.MarshalIndent(ml.muted, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ml.path, data, 0600)
+}
+
+// shouldSuppress reports whether a message from senderID is hidden by the mute list, or because
+// its reputation has it auto-muted, counting it if so. Unless -mute-hard is set, messages that
+// mention us still come through the mute list; spam that mentions us doesn't.
+func (en *EnhancedNode) shouldSuppress(senderID string, text string) bool {
+	fingerprint := en.peerFingerprint(senderID)
+	if en.reputation.Muted(en.reputationKey("", senderID)) {
+		en.muteList.Suppress(senderID, fingerprint)
+		return true
+	}
+	if !en.muteList.IsMuted(senderID, fingerprint) {
+		return false
+	}
+	if !en.muteHard && text != "" && en.mentions.MentionsSelf(text) {
+		return false
+	}
+
+	en.muteList.Suppress(senderID, fingerprint)
+	return true
+}
+
+// handleMuteCommand processes /mute, /unmute and /muted
+func (en *EnhancedNode) handleMuteCommand(input string) {
+	command, arg, _ := strings.Cut(input, " ")
+	arg = strings.TrimSpace(arg)
+
+	var reply string
+	switch {
+	case command == "/muted":
+		muted := en.muteList.List()
+		if len(muted) == 0 {
+			reply = "No muted peers"
+			break
+		}
+		var content strings.Builder
+		content.WriteString("Muted peers:")
+		for _, peer := range muted {
+			key := "key not seen yet"
+			if peer.Fingerprint != "" {
+				key = "key " + shortFingerprint(peer.Fingerprint)
+			}
+			content.WriteString(fmt.Sprintf("\n  - %s (%s; %d muted messages)", en.peerLabel(peer.NodeID), key, peer.Suppressed))
+		}
+		reply = content.String()
+
+	case arg == "":
+		reply = fmt.Sprintf("Usage: %s <peer>", command)
+
+	default:
+		// Accept a connection ID as well; the mute follows the peer's key, or its node ID until
+		// the key is known
+		nodeID := arg
+		if _, resolved, err := en.resolvePeer(arg); err == nil {
+			nodeID = resolved
+		}
+
+		muted := command == "/mute"
+		if err := en.muteList.Set(nodeID, en.peerFingerprint(nodeID), muted); err != nil {
+			log.Printf("Failed to save mute list: %v", err)
+			reply = fmt.Sprintf("❌ Failed to save mute list: %v", err)
+		} else if muted {
+			reply = fmt.Sprintf("🔇 Muted %s", nodeID)
+		} else {
+			reply = fmt.Sprintf("🔊 Unmuted %s", nodeID)
+			if en.reputation.Forgive(en.reputationKey("", nodeID)) {
+				reply += ", and cleared its spam reputation"
+			}
+		}
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
@@ -4,47 +4,120 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 )
 
-func NewNode(listenAddr string, disableDiscovery bool) (*Node, error) {
-	listener, err := net.Listen("tcp", listenAddr)
+// NewNode creates a node listening on listenAddr, with its keys in dataDir
+func NewNode(listenAddr string, disableDiscovery bool, dataDir string, opts ...NodeOption) (*Node, error) {
+	options := applyNodeOptions(opts)
+
+	// Initialize crypto manager
+	cryptoManager, err := NewCryptoManager(filepath.Join(dataDir, keysDirName))
 	if err != nil {
-		return nil, fmt.Errorf("failed to listen: %w", err)
+		log.Printf("Warning: Failed to initialize encryption: %v", err)
+		log.Printf("Continuing without encryption")
 	}
 
-	// FIX: Get proper IPv4 address
-	addr := listener.Addr().String()
-	host, port, err := net.SplitHostPort(addr)
-	if err != nil {
-		addr = fmt.Sprintf("127.0.0.1%s", port)
-	} else if host == "::" {
-		addr = fmt.Sprintf("127.0.0.1:%s", port)
+	if options.tor != nil {
+		if options.quic {
+			return nil, fmt.Errorf("QUIC can't be used over Tor")
+		}
+		if len(options.listen) > 0 {
+			return nil, fmt.Errorf("-tor listens on one address only: peers could reach the others directly")
+		}
+		// Multicast announcements and direct connections would give away our real address
+		disableDiscovery = true
+		options.transport = torTransport{socksAddr: options.tor.SOCKSAddr}
 	}
 
-	// Initialize crypto manager
-	cryptoManager, err := NewCryptoManager("./keys")
+	// QUIC certificates are made from the identity key, so it must exist first
+	var qt *quicTransport
+	if options.quic {
+		if cryptoManager == nil {
+			return nil, fmt.Errorf("QUIC needs an identity key: %w", err)
+		}
+		if qt, err = newQUICTransport(cryptoManager); err != nil {
+			return nil, err
+		}
+		options.transport = qt
+	}
+
+	listeners, listenFailures, err := listenAll(options, listenAddr)
 	if err != nil {
-		log.Printf("Warning: Failed to initialize encryption: %v", err)
-		log.Printf("Continuing without encryption")
+		return nil, fmt.Errorf("failed to listen: %w", err)
 	}
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	listener := listeners[0]
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
 
+	var advertised []string
+	for _, bound := range listeners {
+		if addr := advertiseAddr(bound); !slices.Contains(advertised, addr) {
+			advertised = append(advertised, addr)
+		}
+	}
+
+	// Over Tor the node is known only by its onion address
+	var tor *TorController
+	if options.tor != nil {
+		var onion string
+		if tor, onion, err = startOnionService(*options.tor, listener, filepath.Join(dataDir, keysDirName)); err != nil {
+			closeListeners()
+			return nil, err
+		}
+		advertised = []string{onion}
+	}
+
+	uiQueue := NewUIQueue(uiQueueLimit)
 	node := &Node{
-		ID:             addr,
+		ID:             advertised[0],
 		Listener:       listener,
+		listeners:      listeners,
+		advertised:     advertised,
+		listenFailures: listenFailures,
+		transport:      options.transport,
+		quic:           qt,
+		tor:            tor,
+		traffic:        NewTrafficMeter(dataDir),
+		wallClock:      options.clock,
+		random:         options.random,
 		Peers:          make(map[string]*Peer),
-		KnownPeers:     make(map[string]bool),
+		conns:          make(map[string]*Peer),
+		replaced:       make(map[string]*Peer),
+		KnownPeers:     make(map[string]*knownPeer),
+		redials:        NewRedialQueue(),
+		noPeers:        make(chan struct{}, 1),
 		IncomingMsg:    make(chan Message, 10),
-		NewPeer:        make(chan *Peer),
-		RemovePeer:     make(chan string),
 		CLIInput:       make(chan string),
 		Shutdown:       make(chan struct{}),
 		DiscoveredPeer: make(chan string, 10),
-		PeerListGossip: make(chan []string, 10),
-		uiChannel:      make(chan Message, 100), // Buffer for UI messages
+		uiChannel:      uiQueue.Subscribe(),
+		uiQueue:        uiQueue,
+		readTimeout:    defaultReadTimeout,
+		writeTimeout:   defaultWriteTimeout,
+		messageLog:     NewMessageLog(messageLogLimit),
+		events:         NewEventFeed(options.clock),
 		cryptoManager:  cryptoManager,
 	}
 
-	node.KnownPeers[node.ID] = true
+	node.rememberPeer(node.ownKey(), node.ID)
+
+	if options.dht != nil {
+		if node.dht, err = newNodeDHT(*options.dht, options, port, cryptoManager, dataDir, &node.traffic.total); err != nil {
+			closeListeners()
+			if tor != nil {
+				tor.Close()
+			}
+			return nil, err
+		}
+	}
 
 	// Setup UDP multicast for discovery
 	if !disableDiscovery {
@@ -57,10 +130,19 @@ func NewNode(listenAddr string, disableDiscovery bool) (*Node, error) {
 
 		conn, err := net.ListenMulticastUDP("udp", nil, mcastAddr)
 		if err != nil {
+			node.discoveryProblem = err
 			log.Printf("Warning: Failed to join multicast group %s: %v", multicastAddr, err)
 			log.Printf("Continuing without auto-discovery. Use /connect <addr> to add peers manually.")
 			return node, nil
 		}
+		// Joining can succeed on a host that then drops every packet; don't announce into the void
+		if err := options.probeMulticast(conn, multicastProbeTimeout); err != nil {
+			conn.Close()
+			node.discoveryProblem = err
+			log.Printf("Warning: multicast doesn't work here: %v", err)
+			log.Printf("Continuing without auto-discovery. Use /connect <addr> to add peers manually, or /doctor for more.")
+			return node, nil
+		}
 
 		node.discoveryConn = conn
 		log.Printf("Auto-discovery enabled on %s", multicastAddr)
@@ -72,15 +154,37 @@ func NewNode(listenAddr string, disableDiscovery bool) (*Node, error) {
 }
 
 func (n *Node) Start() {
-	log.Printf("Node listening on %s (ID: %s)", n.Listener.Addr(), n.ID)
+	bound := make([]string, len(n.listeners))
+	for i, listener := range n.listeners {
+		bound[i] = listener.Addr().String()
+	}
+	log.Printf("Node listening on %s (ID: %s)", strings.Join(bound, ", "), n.ID)
 	fmt.Println("Commands: /quit to exit, /connect <addr> to add peer, /peers to list peers, /discovered to list discovered peers")
 
 	// Start goroutines
+	for _, listener := range n.listeners {
+		n.wg.Add(1)
+		go n.handleServer(listener)
+	}
+
 	n.wg.Add(1)
-	go n.handleServer()
+	go n.dispatchUI()
 
 	n.wg.Add(1)
-	go n.handleCLI()
+	go n.meterTraffic()
+
+	n.startCLI()
+
+	n.wg.Add(1)
+	go n.redialDiscovered()
+
+	if n.dht != nil {
+		n.wg.Add(1)
+		go n.handleDHT()
+
+		n.wg.Add(1)
+		go n.maintainDHT()
+	}
 
 	if n.discoveryConn != nil {
 		n.wg.Add(1)
@@ -99,14 +203,8 @@ func (n *Node) Start() {
 func (n *Node) eventLoop() {
 	for {
 		select {
-		case peer := <-n.NewPeer:
-			n.addPeer(peer)
-
-		case peerID := <-n.RemovePeer:
-			n.removePeer(peerID)
-
 		case msg := <-n.IncomingMsg:
-			n.handleIncomingMessage(msg)
+			n.handleIncomingSafely(msg)
 
 		case input := <-n.CLIInput:
 			n.handleCLIInput(input)
@@ -114,9 +212,6 @@ func (n *Node) eventLoop() {
 		case peerAddr := <-n.DiscoveredPeer:
 			n.handleDiscoveredPeer(peerAddr)
 
-		case peerList := <-n.PeerListGossip:
-			n.handlePeerListGossip(peerList)
-
 		case <-n.Shutdown:
 			n.shutdown()
 			return
@@ -127,10 +222,18 @@ func (n *Node) eventLoop() {
 func (n *Node) shutdown() {
 	n.shutdownOnce.Do(func() {
 		close(n.Shutdown)
-		n.Listener.Close()
+		for _, listener := range n.listeners {
+			listener.Close()
+		}
+		if n.tor != nil {
+			n.tor.Close()
+		}
 		if n.discoveryConn != nil {
 			n.discoveryConn.Close()
 		}
+		if n.dht != nil {
+			n.dht.Close()
+		}
 
 		n.peersMutex.Lock()
 		for _, peer := range n.Peers {
@@ -144,3 +247,21 @@ func (n *Node) shutdown() {
 		log.Println("Node shut down")
 	})
 }
+
+// shutdownWithin shuts the node down, giving up on waiting for its goroutines after timeout.
+// It reports whether shutdown completed.
+func (n *Node) shutdownWithin(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		n.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		log.Printf("Timed out waiting for the node to shut down")
+		return false
+	}
+}
@@ -2,96 +2,226 @@ package main
 
 import (
 	"bufio"
+	"cmp"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"slices"
 	"strings"
 	"time"
 )
 
 // Node methods implementation
 
-func (n *Node) connectToPeer(addr string) {
+// connectToPeer dials a peer and hands the connection to the event loop.
+// Errors are logged as well as returned, since most callers run it in a goroutine.
+func (n *Node) connectToPeer(addr string) error {
 	if addr == n.ID || addr == "" {
 		log.Printf("Cannot connect to self or empty address")
-		return
+		return fmt.Errorf("cannot connect to self or empty address")
 	}
 
 	n.peersMutex.RLock()
-	_, exists := n.Peers[addr]
+	_, exists := n.conns[addr]
 	n.peersMutex.RUnlock()
 
 	if exists {
 		log.Printf("Already connected to %s", addr)
-		return
+		return nil
+	}
+	// Discovery, gossip and the user may all dial an address at once; the connections would be
+	// duplicates of one another (keepNewer)
+	if _, inFlight := n.dialing.LoadOrStore(addr, struct{}{}); inFlight {
+		log.Printf("Already connecting to %s", addr)
+		return nil
 	}
+	defer n.dialing.Delete(addr)
 
 	log.Printf("Connecting to %s...", addr)
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	conn, err := n.transport.Dial(addr, 5*time.Second)
 	if err != nil {
 		log.Printf("Failed to connect to %s: %v", addr, err)
-		return
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
 	}
 
+	secured, err := n.negotiateConn(conn, addr)
+	if err == nil && n.admit != nil {
+		err = n.admit(secured, addr)
+	}
+	if err != nil {
+		conn.Close()
+		log.Printf("Failed to connect to %s: %v", addr, err)
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	conn = secured
+
 	log.Printf("Connected to %s", addr)
 	peer := &Peer{
 		ID:   addr,
 		Conn: conn,
 		Send: make(chan []byte, 10),
 		Done: make(chan struct{}),
+
+		outbound: true,
 	}
 
-	n.NewPeer <- peer
+	return n.addPeer(peer)
 }
 
-func (n *Node) addPeer(peer *Peer) {
+// addPeer registers a connection and starts its reader and writer. It is called directly by
+// whoever made the connection; the peer maps are guarded by peersMutex, so nothing waits on the
+// event loop. The connection is closed if the node is shutting down or the peer already exists.
+// A connection authenticated in its handshake is registered under its key; a second one with the
+// same key replaces the first, or is refused if the two nodes dialled each other at once
+// (keepNewer). Legacy connections go under their connection ID until their key arrives
+// (identifyPeer).
+func (n *Node) addPeer(peer *Peer) error {
+	if nc, ok := peer.Conn.(*noiseConn); ok {
+		peer.setNodeID(nc.nodeID)
+		if nc.capabilities != nil {
+			n.setCapabilities(peer, nc.nodeID, nc.capabilities)
+		}
+		if nc.version != nil {
+			n.setVersion(peer, nc.nodeID, *nc.version)
+		}
+	}
+	peer.key = peer.ID
+	if key, ok := connKey(peer); ok {
+		peer.key = key
+	}
+	n.countConn(peer)
+
 	n.peersMutex.Lock()
-	defer n.peersMutex.Unlock()
+	select {
+	case <-n.Shutdown:
+		// shutdown closes Shutdown before taking peersMutex, so checking here under the lock
+		// means every added peer is one shutdown will see and close
+		n.peersMutex.Unlock()
+		peer.Conn.Close()
+		return fmt.Errorf("node is shutting down")
+	default:
+	}
 
-	if _, exists := n.Peers[peer.ID]; exists {
+	if _, exists := n.conns[peer.ID]; exists {
+		n.peersMutex.Unlock()
 		log.Printf("Peer %s already exists, closing connection", peer.ID)
 		peer.Conn.Close()
-		return
+		return fmt.Errorf("already connected to %s", peer.ID)
 	}
 
-	n.Peers[peer.ID] = peer
-	n.knownMutex.Lock()
-	n.KnownPeers[peer.ID] = true
-	n.knownMutex.Unlock()
+	now := n.wallClock.Now()
+	old := n.sameNodeAs(peer)
+	if old != nil {
+		if !n.keepNewer(old, peer, now) {
+			n.peersMutex.Unlock()
+			log.Printf("Peer %s is the node already connected as %s, closing connection", peer.ID, old.ID)
+			peer.Conn.Close()
+			return fmt.Errorf("already connected to the same node as %s", old.ID)
+		}
+		log.Printf("Peer %s is the node connected as %s, replacing the old connection", peer.ID, old.ID)
+		n.replacePeer(old, peer)
+	}
 
-	// Send to UI if available
-	if n.uiChannel != nil {
-		n.uiChannel <- Message{
-			SenderID: "System",
-			Content:  []byte(fmt.Sprintf("🔗 Peer connected: %s", peer.ID)),
+	peer.connectedAt = now
+	n.Peers[peer.key] = peer
+	n.conns[peer.ID] = peer
+	if peer.key != peer.ID {
+		n.rememberPeer(peer.key, cmp.Or(peer.nodeID(), peer.ID), peer.ID)
+	} else {
+		n.rememberAddr(peer.ID)
+	}
+
+	// Queued before anything is read, so nothing we send in reply can overtake it
+	if n.greeting != nil {
+		if frame := n.greeting(); frame != nil {
+			peer.Send <- frame
 		}
 	}
 
 	n.wg.Add(1)
 	go n.handlePeer(peer)
+	n.peersMutex.Unlock()
+
+	if old != nil {
+		n.peerMovedNotice(old, peer)
+		n.events.Publish(eventPeerDisconnected, peerEvent{Peer: old.ID})
+		if n.peerRemoved != nil {
+			n.peerRemoved(old.ID)
+		}
+	} else {
+		// Send to UI if available
+		n.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("🔗 Peer connected: %s", peer.ID)),
+		})
+	}
+	n.events.Publish(eventPeerConnected, peerEvent{Peer: peer.ID})
+	return nil
 }
 
-func (n *Node) removePeer(peerID string) {
+// removePeer forgets a connection once it has closed. A newer connection that reused the same ID
+// is left alone, and a connection replaced by a newer one to the same node is already forgotten.
+func (n *Node) removePeer(peer *Peer) {
 	n.peersMutex.Lock()
-	defer n.peersMutex.Unlock()
-
-	peer, exists := n.Peers[peerID]
-	if !exists {
+	if n.conns[peer.ID] != peer {
+		n.peersMutex.Unlock()
 		return
 	}
 
-	delete(n.Peers, peerID)
+	delete(n.conns, peer.ID)
+	if n.Peers[peer.key] == peer {
+		delete(n.Peers, peer.key)
+	}
+	for id, next := range n.replaced {
+		if next == peer {
+			delete(n.replaced, id)
+		}
+	}
 	peer.once.Do(func() {
 		close(peer.Done)
 	})
+	if len(n.Peers) == 0 {
+		select {
+		case n.noPeers <- struct{}{}:
+		default:
+		}
+	}
+	n.peersMutex.Unlock()
 
 	// Send to UI if available
-	if n.uiChannel != nil {
-		n.uiChannel <- Message{
-			SenderID: "System",
-			Content:  []byte(fmt.Sprintf("❌ Peer disconnected: %s", peerID)),
-		}
+	n.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("❌ Peer disconnected: %s", peer.ID)),
+	})
+	n.events.Publish(eventPeerDisconnected, peerEvent{Peer: peer.ID})
+
+	if n.peerRemoved != nil {
+		n.peerRemoved(peer.ID)
+	}
+}
+
+// snapshotPeers returns the currently connected peers, so callers can do slow per-peer work
+// (encryption, serialization) without holding peersMutex and blocking addPeer/removePeer
+func (n *Node) snapshotPeers() []*Peer {
+	n.peersMutex.RLock()
+	defer n.peersMutex.RUnlock()
+
+	peers := make([]*Peer, 0, len(n.Peers))
+	for _, peer := range n.Peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// closed reports whether the peer has disconnected since it was looked up
+func (p *Peer) closed() bool {
+	select {
+	case <-p.Done:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -106,40 +236,55 @@ func (n *Node) handlePeer(peer *Peer) {
 
 	<-peer.Done
 
-	// Cleanup
-	peer.once.Do(func() {
-		close(peer.Send)
-	})
+	// Cleanup (Send is left open: writePeer exits on Done, and senders may still hold it)
 	peer.Conn.Close()
-	n.RemovePeer <- peer.ID
+	n.removePeer(peer)
 }
 
 func (n *Node) readPeer(peer *Peer) {
 	defer n.wg.Done()
+	defer n.recoverPeerPanic(peer.ID, "a frame")
 
-	scanner := bufio.NewScanner(peer.Conn)
-	for scanner.Scan() {
+	ac, authenticated := peerAuthenticatedConn(peer)
+	scanner := newFrameScanner(peer.Conn, func() {
+		n.oversized(peer, fmt.Errorf("%w: a frame over %s", errMessageTooLarge, formatBytes(maxFrameBytes)))
+	})
+	for {
+		// Any frame, keepalives included, proves the peer is still there
+		if n.readTimeout > 0 {
+			peer.Conn.SetReadDeadline(time.Now().Add(n.readTimeout))
+		}
+		if !scanner.Scan() {
+			break
+		}
 		line := scanner.Text()
 
 		parts := strings.SplitN(line, string(delimiter), 2)
 		if len(parts) != 2 {
-			log.Printf("Invalid message format from %s: %s", peer.ID, line)
+			log.Printf("Invalid message format from %s: %s", peer.ID, sanitizeLine(line))
 			continue
 		}
 
-		senderID := parts[0]
+		senderID := sanitizeLine(parts[0]) // Also ends up in logs
 		content := parts[1]
+		if authenticated && n.spoofedSender(ac, senderID) {
+			n.spoofedFrames.Add(1)
+			log.Printf("Dropped frame from %s claiming to be %s", peer.ID, senderID)
+			continue
+		}
+		if content == keepaliveContent {
+			continue
+		}
 
 		msg := Message{
 			SenderID:   senderID,
 			Content:    []byte(content),
 			FromPeerID: peer.ID,
 		}
-		n.IncomingMsg <- msg
-
-		// Also send to UI
-		if n.uiChannel != nil {
-			n.uiChannel <- msg
+		select {
+		case n.IncomingMsg <- msg:
+		case <-n.Shutdown:
+			return
 		}
 	}
 
@@ -147,8 +292,14 @@ func (n *Node) readPeer(peer *Peer) {
 		select {
 		case <-n.Shutdown:
 			return
+		case <-peer.Done:
+			// The writer already dropped the peer and closed the connection
 		default:
-			log.Printf("Read error from %s: %v", peer.ID, err)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("Peer %s sent nothing for %v, disconnecting", peer.ID, n.readTimeout)
+			} else {
+				log.Printf("Read error from %s: %v", peer.ID, err)
+			}
 		}
 	}
 
@@ -157,31 +308,67 @@ func (n *Node) readPeer(peer *Peer) {
 	})
 }
 
+// writePeer writes queued frames to the connection, with a keepalive when it has been idle.
+// A write that blocks past writeTimeout (a peer that stopped reading) drops the peer; on
+// shutdown, handlePeer closes the connection, which interrupts a write in progress.
 func (n *Node) writePeer(peer *Peer) {
 	defer n.wg.Done()
 
-	for data := range peer.Send {
-		_, err := peer.Conn.Write(append(data, '\n'))
+	keepalive := n.wallClock.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	lastWrite := n.wallClock.Now()
+
+	for {
+		var data []byte
+		select {
+		case data = <-peer.Send:
+			if peer.successor.Load() != nil {
+				n.handOver(peer, data)
+				return
+			}
+		case <-keepalive.Chan():
+			if n.wallClock.Now().Sub(lastWrite) < keepaliveInterval {
+				continue
+			}
+			data = newFrame(n.ID, []byte(keepaliveContent))
+		case <-peer.Done:
+			n.handOver(peer)
+			return
+		}
+
+		// The deadline is enforced by the network, so it is on the system clock
+		if n.writeTimeout > 0 {
+			peer.Conn.SetWriteDeadline(time.Now().Add(n.writeTimeout))
+		}
+
+		// Frames already end in a newline and may be shared between peers, so they are written as-is
+		_, err := peer.Conn.Write(data)
 		if err != nil {
 			select {
 			case <-n.Shutdown:
 				return
 			default:
-				log.Printf("Write error to %s: %v", peer.ID, err)
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					log.Printf("Peer %s stopped reading (write blocked for %v), disconnecting", peer.ID, n.writeTimeout)
+				} else {
+					log.Printf("Write error to %s: %v", peer.ID, err)
+				}
 				peer.once.Do(func() {
 					close(peer.Done)
 				})
 				return
 			}
 		}
+		lastWrite = n.wallClock.Now()
 	}
 }
 
-func (n *Node) handleServer() {
+// handleServer accepts connections on one listener; each -listen address has its own
+func (n *Node) handleServer(listener net.Listener) {
 	defer n.wg.Done()
 
 	for {
-		conn, err := n.Listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-n.Shutdown:
@@ -192,39 +379,86 @@ func (n *Node) handleServer() {
 			}
 		}
 
-		remoteAddr := conn.RemoteAddr().String()
+		n.wg.Add(1)
+		go n.acceptPeer(conn)
+	}
+}
 
-		n.peersMutex.RLock()
-		_, exists := n.Peers[remoteAddr]
-		n.peersMutex.RUnlock()
+// acceptPeer negotiates an incoming connection and registers it. It runs in its own goroutine so
+// a slow handshake doesn't hold up other connections.
+func (n *Node) acceptPeer(conn net.Conn) {
+	defer n.wg.Done()
 
-		if exists {
-			log.Printf("Already connected to %s, closing new connection", remoteAddr)
-			conn.Close()
-			continue
-		}
+	remoteAddr := conn.RemoteAddr().String()
 
-		peer := &Peer{
-			ID:   remoteAddr,
-			Conn: conn,
-			Send: make(chan []byte, 10),
-			Done: make(chan struct{}),
-		}
+	n.peersMutex.RLock()
+	_, exists := n.conns[remoteAddr]
+	n.peersMutex.RUnlock()
 
-		n.NewPeer <- peer
+	if exists {
+		log.Printf("Already connected to %s, closing new connection", remoteAddr)
+		conn.Close()
+		return
+	}
+
+	secured, err := n.negotiateConn(conn, "")
+	if err == nil && n.locked.Load() {
+		// Closed once the handshake is done, so the peer sees an orderly close rather than a reset
+		n.lockedRefused.Add(1)
+		log.Printf("Refused connection from %s: locked (/unlock to accept connections)", remoteAddr)
+		conn.Close()
+		return
 	}
+	if err == nil && n.admit != nil {
+		// Refused here, before the connection is registered, a peer never gets a message handled
+		err = n.admit(secured, "")
+	}
+	if err != nil {
+		log.Printf("Rejected connection from %s: %v", remoteAddr, err)
+		conn.Close()
+		return
+	}
+
+	peer := &Peer{
+		ID:   remoteAddr,
+		Conn: secured,
+		Send: make(chan []byte, 10),
+		Done: make(chan struct{}),
+	}
+
+	if err := n.addPeer(peer); err != nil {
+		log.Printf("Rejected connection from %s: %v", remoteAddr, err)
+	}
+}
+
+// startCLI reads input from stdin: through the line editor, which also prints what the UI is
+// sent, or in pipe mode as plain lines
+func (n *Node) startCLI() {
+	if n.pipeInput == nil {
+		n.console = NewConsole(os.Stdin, os.Stdout)
+		if n.uiChannel != nil {
+			n.wg.Add(1)
+			go n.printToConsole()
+		}
+	}
+
+	n.wg.Add(1)
+	go n.handleCLI()
 }
 
 func (n *Node) handleCLI() {
 	defer n.wg.Done()
 
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print("> ")
+	if n.console != nil {
+		n.readConsole()
+		return
+	}
 
+	// In pipe mode stdout carries only message output, so there is no prompt
+	// and lines are handed over verbatim instead of being parsed as commands
+	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
-		input := scanner.Text()
-		n.CLIInput <- input
-		fmt.Print("> ")
+		n.pipeInput(scanner.Text())
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -236,20 +470,64 @@ func (n *Node) handleCLI() {
 		}
 	}
 
-	// Use shutdown() method to safely close the channel
-	n.shutdown()
+	if !n.pipeOneshot {
+		// Keep running to receive messages
+		log.Printf("End of input; still receiving (use -oneshot to exit on EOF)")
+		return
+	}
+	n.flushPeers(pipeFlushTimeout)
+
+	// Use shutdown() method to safely close the channel; run it separately since it waits for this goroutine
+	go n.shutdown()
 }
 
+// flushPeers waits until every peer's send queue has drained, or the timeout expires
+func (n *Node) flushPeers(timeout time.Duration) {
+	deadline := n.wallClock.Now().Add(timeout)
+	for n.wallClock.Now().Before(deadline) {
+		pending := 0
+		n.peersMutex.RLock()
+		for _, peer := range n.Peers {
+			pending += len(peer.Send)
+		}
+		n.peersMutex.RUnlock()
+
+		if pending == 0 {
+			return
+		}
+		<-n.wallClock.After(20 * time.Millisecond)
+	}
+	log.Printf("Timed out flushing peer send queues")
+}
+
+// submitInput queues a line of input for the event loop, as if typed at the CLI
+func (n *Node) submitInput(input string) error {
+	select {
+	case n.CLIInput <- input:
+		return nil
+	case <-n.Shutdown:
+		return fmt.Errorf("node is shutting down")
+	}
+}
+
+// gossipPeerList sends the peer list every gossipInterval, give or take jitter, when it or the
+// peers changed since the last round, and every antiEntropyInterval regardless
 func (n *Node) gossipPeerList() {
 	defer n.wg.Done()
 
-	ticker := time.NewTicker(gossipInterval)
-	defer ticker.Stop()
+	lastFull := n.wallClock.Now()
+	timer := n.wallClock.NewTimer(n.jitter(gossipInterval))
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			n.sendPeerListGossip()
+		case now := <-timer.Chan():
+			full := now.Sub(lastFull) >= antiEntropyInterval
+			if full {
+				lastFull = now
+			}
+			n.sendPeerListGossip(full)
+			timer.Reset(n.jitter(gossipInterval))
 		case <-n.Shutdown:
 			return
 		}
@@ -259,8 +537,9 @@ func (n *Node) gossipPeerList() {
 func (n *Node) handleCLIInput(input string) {
 	switch {
 	case input == "/quit":
-		// Call shutdown() which handles channel close safely via sync.Once
-		n.shutdown()
+		// Call shutdown() which handles channel close safely via sync.Once.
+		// It waits for the event loop to exit, so it must not run on the event loop itself.
+		go n.shutdown()
 
 	case strings.HasPrefix(input, "/connect "):
 		addr := strings.TrimPrefix(input, "/connect ")
@@ -275,6 +554,14 @@ func (n *Node) handleCLIInput(input string) {
 	case input == "/help":
 		n.showHelp()
 
+	case strings.HasPrefix(input, "/"):
+		// Never send a mistyped command to peers as chat
+		command, _, _ := strings.Cut(input, " ")
+		n.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Unknown command: %s (type /help for commands)", command)),
+		})
+
 	default:
 		// Send as regular message
 		msg := Message{
@@ -285,9 +572,7 @@ func (n *Node) handleCLIInput(input string) {
 		n.broadcast(msg)
 
 		// Also send to UI
-		if n.uiChannel != nil {
-			n.uiChannel <- msg
-		}
+		n.notifyUI(msg)
 	}
 }
 
@@ -300,53 +585,63 @@ func (n *Node) showHelp() {
   /quit - Exit application
 `
 	if n.uiChannel != nil {
-		n.uiChannel <- Message{
+		n.notifyUI(Message{
 			SenderID: "System",
 			Content:  []byte(helpText),
-		}
+		})
 	} else {
 		fmt.Println(helpText)
 	}
 }
 
-func (n *Node) handleDiscoveredPeer(peerAddr string) {
-	if peerAddr == n.ID {
+// handleDiscoveredPeer dials a node learned of by discovery, gossip or its signed record, unless
+// it is connected, known or already queued for a redial. Alternates are further addresses the
+// node listens on, tried if peerAddr can't be reached.
+func (n *Node) handleDiscoveredPeer(peerAddr string, alternates ...string) {
+	if peerAddr == n.ID || n.locked.Load() {
+		return
+	}
+	if n.tor != nil && !isOnionAddr(peerAddr) {
+		// Only onion services are dialled automatically over Tor; the rest are other nodes' local
+		// connection addresses or would need an exit relay
 		return
 	}
 
 	n.peersMutex.RLock()
-	_, exists := n.Peers[peerAddr]
+	_, exists := n.conns[peerAddr]
 	n.peersMutex.RUnlock()
 
 	if exists {
 		return
 	}
 
-	n.knownMutex.RLock()
-	recentlySeen := n.KnownPeers[peerAddr]
-	n.knownMutex.RUnlock()
-
-	if recentlySeen {
+	// Known addresses were connected before or have been given up on as unreachable, and queued
+	// ones already have a dial coming
+	if n.knownAddr(peerAddr) || n.redials.queued(peerAddr) {
 		return
 	}
 
 	log.Printf("Auto-discovered peer: %s", peerAddr)
 
 	// Send to UI
-	if n.uiChannel != nil {
-		n.uiChannel <- Message{
-			SenderID: "System",
-			Content:  []byte(fmt.Sprintf("🔍 Auto-discovered peer: %s", peerAddr)),
-		}
-	}
+	n.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("🔍 Auto-discovered peer: %s", peerAddr)),
+	})
 
-	n.connectToPeer(peerAddr)
+	if n.tor != nil {
+		alternates = slices.DeleteFunc(slices.Clone(alternates), func(addr string) bool { return !isOnionAddr(addr) })
+	}
+	// Dial in the background so the event loop keeps running
+	go n.dialDiscovered(peerAddr, alternates...)
 }
 
+// handlePeerListGossip runs on the event loop, so it handles each address directly rather
+// than queueing it on DiscoveredPeer, which the same loop drains
 func (n *Node) handlePeerListGossip(peerList []string) {
 	for _, peerAddr := range peerList {
 		if peerAddr != "" && peerAddr != n.ID {
-			n.DiscoveredPeer <- peerAddr
+			n.handleDiscoveredPeer(peerAddr)
 		}
 	}
 }
@@ -361,27 +656,7 @@ func (n *Node) listPeers() {
 	}
 
 	fmt.Println("Connected peers:")
-	for id := range n.Peers {
-		fmt.Printf("  - %s\n", id)
-	}
-}
-
-func (n *Node) listDiscoveredPeers() {
-	n.knownMutex.RLock()
-	defer n.knownMutex.RUnlock()
-
-	fmt.Println("All discovered peers:")
-	for peer := range n.KnownPeers {
-		status := "disconnected"
-
-		// Need to acquire peersMutex to safely read n.Peers map
-		n.peersMutex.RLock()
-		_, connected := n.Peers[peer]
-		n.peersMutex.RUnlock()
-
-		if connected {
-			status = "connected"
-		}
-		fmt.Printf("  - %s [%s]\n", peer, status)
+	for _, peer := range n.Peers {
+		fmt.Printf("  - %s\n", peer.ID)
 	}
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestShutdownDuringConnectionChurn shuts a node down while 200 inbound connections are opening,
+// handshaking, sending and closing, and checks that it terminates rather than wedging on one
+func TestShutdownDuringConnectionChurn(t *testing.T) {
+	const connections = 200
+	tn := newTestNetwork(t, 1)
+	node := tn.nodes[0]
+
+	var dialers sync.WaitGroup
+	start := make(chan struct{})
+	for i := range connections {
+		dialers.Add(1)
+		go func() {
+			defer dialers.Done()
+			<-start
+			conn, err := tn.network.Dial(node.ID, time.Second)
+			if err != nil {
+				// The listener closed under us, which is what shutdown does
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(testWait))
+			switch i % 4 {
+			case 0:
+				// Hang up at once
+			case 1:
+				// A legacy frame, then hang up
+				fmt.Fprintf(conn, "%s:%d%c%s\n", memoryHost, 20000+i, delimiter, "hello")
+			case 2:
+				// Garbage, then wait to be dropped
+				fmt.Fprintf(conn, "not a frame\n")
+				conn.Read(make([]byte, 1))
+			default:
+				// Say nothing and wait to be dropped
+				conn.Read(make([]byte, 1))
+			}
+		}()
+	}
+
+	close(start)
+	time.Sleep(10 * time.Millisecond)
+	if !node.shutdownWithin(testWait) {
+		t.Fatal("node didn't shut down while connections churned")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		dialers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(testWait):
+		t.Fatal("connections were left open after shutdown")
+	}
+
+	if left := peerCount(node); left != 0 {
+		t.Errorf("%d peers still registered after shutdown", left)
+	}
+}
+
+// peerCount is how many peers a node has registered
+func peerCount(node *EnhancedNode) int {
+	node.peersMutex.RLock()
+	defer node.peersMutex.RUnlock()
+	return len(node.Peers)
+}
+
+// connectedTo reports whether node has a peer with the given node ID
+func connectedTo(node *EnhancedNode, nodeID string) bool {
+	return slices.ContainsFunc(node.snapshotPeers(), func(peer *Peer) bool { return peer.nodeID() == nodeID })
+}
+
+// dialLegacy connects to node as a legacy peer that sends its hello and then nothing, and waits
+// until the node has registered it
+func dialLegacy(t *testing.T, tn *testNetwork, node *EnhancedNode) net.Conn {
+	t.Helper()
+	conn, err := tn.network.Dial(node.ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "%s:%d%c%s\n", memoryHost, 20000, delimiter, "hello")
+	waitFor(t, "the legacy peer to be registered", func() bool { return peerCount(node) == 1 })
+	return conn
+}
+
+// TestUnreadPeerDropped has a peer stop reading, as a laptop gone to sleep does: the node's
+// writes to it block (the in-memory connection holds nothing), and once one has blocked for the
+// write timeout the peer is dropped and its connection closed
+func TestUnreadPeerDropped(t *testing.T) {
+	const writeTimeout = 200 * time.Millisecond
+	tn := newTestNetwork(t, 0)
+	node := tn.newNode()
+	node.writeTimeout = writeTimeout
+	tn.start(node)
+	conn := dialLegacy(t, tn, node) // Never read
+
+	start := time.Now()
+	node.broadcast(Message{SenderID: node.ID, Content: []byte("into the void")})
+	waitFor(t, "the unread peer to be dropped", func() bool { return peerCount(node) == 0 })
+	if elapsed := time.Since(start); elapsed < writeTimeout {
+		t.Errorf("dropped after %v, before the write timeout of %v", elapsed, writeTimeout)
+	}
+	if _, err := conn.Write([]byte("still there?\n")); err == nil {
+		t.Error("the dropped peer's connection is still open")
+	}
+}
+
+// TestShutdownInterruptsBlockedWrite shuts a node down while it is stuck writing to a peer that
+// never reads, with no write timeout to unstick it: closing the connection has to
+func TestShutdownInterruptsBlockedWrite(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	node := tn.newNode()
+	node.writeTimeout = 0
+	node.readTimeout = 0
+	tn.start(node)
+	dialLegacy(t, tn, node) // Never read
+
+	for i := range 3 {
+		node.broadcast(Message{SenderID: node.ID, Content: fmt.Appendf(nil, "blocked %d", i)})
+	}
+	time.Sleep(50 * time.Millisecond) // For the writer to block on the first
+	if !node.shutdownWithin(testWait) {
+		t.Fatal("node didn't shut down while a write to a peer was blocked")
+	}
+}
+
+// TestSilentPeerDropped has a peer that reads but never sends, not even keepalives, dropped
+// after the read timeout
+func TestSilentPeerDropped(t *testing.T) {
+	const readTimeout = 300 * time.Millisecond
+	tn := newTestNetwork(t, 0)
+	node := tn.newNode()
+	node.readTimeout = readTimeout
+	tn.start(node)
+
+	conn := dialLegacy(t, tn, node)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		io.Copy(io.Discard, conn)
+	}()
+
+	start := time.Now()
+	select {
+	case <-closed:
+	case <-time.After(testWait):
+		t.Fatal("the silent peer is still connected long after the read timeout")
+	}
+	if elapsed := time.Since(start); elapsed < readTimeout/2 {
+		t.Errorf("dropped after %v, well before the read timeout of %v", elapsed, readTimeout)
+	}
+	if left := peerCount(node); left != 0 {
+		t.Errorf("%d peers still registered after the silent one was dropped", left)
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+const (
+	// noiseHello is sent as the first line of a connection by nodes that speak Noise. It has no
+	// frame delimiter, so older nodes log it as an invalid frame and carry on.
+	noiseHello             = "P2PCHAT-NOISE/2"
+	noisePrologue          = "p2pchat noise v2"
+	noiseNegotiateTimeout  = 5 * time.Second // Wait for the peer's first line, and for the handshake
+	noiseMaxMessage        = 65535           // Largest Noise message, tag included
+	noiseMaxPlaintext      = noiseMaxMessage - 16
+	noiseHelloLimit        = 4096 // Longest first line read while negotiating
+	noiseStaticKeyLabel    = "p2pchat noise static key"
+	noiseIdentitySignLabel = "p2pchat noise identity"
+	noiseChallengeLabel    = "p2pchat noise challenge"
+	noiseChallengeBytes    = 32
+
+	// sessionPrefix marks a message sent without an envelope over an authenticated connection
+	sessionPrefix = "SESSION:"
+)
+
+// noiseCipherSuite is Noise_XX_25519_ChaChaPoly_SHA256
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+// authenticatedConn is a connection whose transport encrypts everything on it and has proven
+// which identity key the peer holds: a Noise session, or a QUIC session. Messages on it need no
+// envelope of their own.
+type authenticatedConn interface {
+	net.Conn
+	peerFingerprint() string
+	sessionID() []byte // The same at both ends of the session, and for no other session
+}
+
+// noiseIdentity is the handshake payload binding a Noise static key to a node's identity key
+type noiseIdentity struct {
+	NodeID    string `json:"node_id"`
+	PublicKey string `json:"public_key"`       // Identity key, PEM
+	Signature string `json:"signature"`        // Identity key's signature over the static key and node ID
+	Invite    string `json:"invite,omitempty"` // Invitation token from /invite, sent by a node dialling with one
+
+	Capabilities []string     `json:"capabilities,omitempty"` // What the node supports
+	Version      *VersionInfo `json:"version,omitempty"`      // The build it runs
+}
+
+// noiseSignedData is what a noiseIdentity signature covers
+func noiseSignedData(staticKey []byte, nodeID string) []byte {
+	data := append([]byte(noiseIdentitySignLabel), staticKey...)
+	return append(data, nodeID...)
+}
+
+// noiseStaticKeypair derives the Noise static key from the identity key, so it is as long-lived
+// as the identity without being stored separately
+func (cm *CryptoManager) noiseStaticKeypair() (noise.DHKey, error) {
+	cm.keysMutex.RLock()
+	der := x509.MarshalPKCS1PrivateKey(cm.privateKey)
+	cm.keysMutex.RUnlock()
+
+	seed := sha256.Sum256(append([]byte(noiseStaticKeyLabel), der...))
+	return noise.DH25519.GenerateKeypair(bytes.NewReader(seed[:]))
+}
+
+// negotiateConn decides how a new connection is secured. Both ends send noiseHello as their
+// first line; if the peer's first line is anything else, or nothing arrives in time, it is an
+// older node and the connection carries legacy frames (with RSA envelopes) as before, unless we
+// dialled a node whose key has spoken Noise with us: that fallback is someone stripping it.
+// dialedAddr is the address we connected to, or empty for an incoming connection.
+func (n *Node) negotiateConn(conn net.Conn, dialedAddr string) (net.Conn, error) {
+	initiator := dialedAddr != ""
+	if _, secured := conn.(authenticatedConn); secured || n.cryptoManager == nil {
+		// QUIC sessions are already encrypted and authenticated
+		return conn, nil
+	}
+	if n.legacyOnly {
+		return conn, nil
+	}
+
+	reader := bufio.NewReaderSize(conn, noiseHelloLimit)
+	conn.SetDeadline(time.Now().Add(noiseNegotiateTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// Shutdown doesn't wait out the deadline: closing the connection ends the negotiation
+	negotiated := make(chan struct{})
+	defer close(negotiated)
+	go func() {
+		select {
+		case <-n.Shutdown:
+			conn.Close()
+		case <-negotiated:
+		}
+	}()
+
+	if initiator {
+		if _, err := conn.Write([]byte(noiseHello + "\n")); err != nil {
+			return nil, err
+		}
+	}
+
+	// What a legacy peer sent first is kept for readPeer, which reads it as a frame
+	line, err := reader.ReadSlice('\n')
+	first := bytes.Clone(line)
+	if err != nil || string(bytes.TrimRight(first, "\r\n")) != noiseHello {
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		if fingerprint, known := n.cryptoManager.PeerFingerprint(dialedAddr); initiator && known && n.spokeNoise(fingerprint) {
+			return nil, fmt.Errorf("%s (key %s) spoke Noise before and now doesn't; refusing legacy encryption",
+				dialedAddr, formatFingerprint(fingerprint))
+		}
+		log.Printf("Peer %s doesn't speak Noise, using legacy encryption", conn.RemoteAddr())
+		return &replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(first), reader)}, nil
+	}
+
+	if !initiator {
+		if _, err := conn.Write([]byte(noiseHello + "\n")); err != nil {
+			return nil, err
+		}
+	}
+	nc, err := n.noiseHandshake(conn, reader, dialedAddr)
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake with %s failed: %w", conn.RemoteAddr(), err)
+	}
+	n.noiseKeys.Store(nc.fingerprint, struct{}{})
+	log.Printf("Noise session with %s (%s, key %s)", conn.RemoteAddr(), nc.nodeID, formatFingerprint(nc.fingerprint))
+	return nc, nil
+}
+
+// spokeNoise reports whether the key with this fingerprint has authenticated a Noise session with
+// us since we started
+func (n *Node) spokeNoise(fingerprint string) bool {
+	_, ok := n.noiseKeys.Load(fingerprint)
+	return ok
+}
+
+// noiseHandshake runs the XX handshake, exchanging identities in the encrypted payloads of its
+// second and third messages
+func (n *Node) noiseHandshake(conn net.Conn, reader *bufio.Reader, dialedAddr string) (*noiseConn, error) {
+	initiator := dialedAddr != ""
+	staticKey, err := n.cryptoManager.noiseStaticKeypair()
+	if err != nil {
+		return nil, err
+	}
+	handshake, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   noiseCipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		Initiator:     initiator,
+		Prologue:      []byte(noisePrologue),
+		StaticKeypair: staticKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := n.cryptoManager.SignPlaintext(noiseSignedData(staticKey.Public, n.ID))
+	if err != nil {
+		return nil, err
+	}
+	ourVersion := ownVersion()
+	identity := noiseIdentity{
+		NodeID:    n.ID,
+		PublicKey: signature.PublicKeyPEM,
+		Signature: signature.Signature,
+
+		Capabilities: n.ownCapabilities(),
+		Version:      &ourVersion,
+	}
+	if intent, exists := n.dialIntents.Load(dialedAddr); exists && initiator {
+		// Only the responder reads the initiator's identity, which is sent encrypted
+		identity.Invite = intent.(dialIntent).invite
+	}
+	ourIdentity, err := json.Marshal(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	var send, receive *noise.CipherState
+	var peerIdentity []byte
+	write := func(payload []byte) error {
+		message, cs0, cs1, err := handshake.WriteMessage(nil, payload)
+		if err != nil {
+			return err
+		}
+		if cs0 != nil {
+			send, receive = cs0, cs1 // Only the initiator completes the handshake by writing
+		}
+		return writeNoiseMessage(conn, message)
+	}
+	read := func() ([]byte, error) {
+		message, err := readNoiseMessage(reader)
+		if err != nil {
+			return nil, err
+		}
+		payload, cs0, cs1, err := handshake.ReadMessage(nil, message)
+		if err != nil {
+			return nil, err
+		}
+		if cs0 != nil {
+			send, receive = cs1, cs0
+		}
+		return payload, nil
+	}
+
+	// -> e; <- e, ee, s, es (responder's identity); -> s, se (initiator's identity)
+	if initiator {
+		if err := write(nil); err != nil {
+			return nil, err
+		}
+		if peerIdentity, err = read(); err != nil {
+			return nil, err
+		}
+		if err := write(ourIdentity); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := read(); err != nil {
+			return nil, err
+		}
+		if err := write(ourIdentity); err != nil {
+			return nil, err
+		}
+		if peerIdentity, err = read(); err != nil {
+			return nil, err
+		}
+	}
+
+	peer, fingerprint, err := n.verifyNoiseIdentity(peerIdentity, handshake.PeerStatic(), dialedAddr)
+	if err != nil {
+		return nil, err
+	}
+	nc := &noiseConn{
+		Conn:        conn,
+		reader:      reader,
+		send:        send,
+		receive:     receive,
+		nodeID:      peer.NodeID,
+		fingerprint: fingerprint,
+		invite:      peer.Invite,
+		binding:     handshake.ChannelBinding(),
+
+		capabilities: peer.Capabilities,
+		version:      peer.Version,
+	}
+	if err := n.exchangeChallenges(nc, nc.binding, peer.PublicKey, initiator); err != nil {
+		return nil, fmt.Errorf("challenge failed: %w", err)
+	}
+	return nc, nil
+}
+
+// exchangeChallenges has each side sign a fresh random challenge from the other, bound to this
+// session's handshake hash, with its identity key. The identity in the handshake only covers the
+// long-lived static key; this proves the peer holds the identity key now, on this connection.
+// Messages alternate, so neither side relies on the connection buffering a write:
+// -> challenge; <- challenge; -> answer; <- answer
+func (n *Node) exchangeChallenges(nc *noiseConn, binding []byte, peerKeyPEM string, initiator bool) error {
+	publicKey, err := parsePublicKeyPEM(peerKeyPEM)
+	if err != nil {
+		return err
+	}
+
+	ours := make([]byte, noiseChallengeBytes)
+	if _, err := rand.Read(ours); err != nil {
+		return err
+	}
+	readChallenge := func() ([]byte, error) {
+		theirs, err := nc.readMessage()
+		if err == nil && len(theirs) != noiseChallengeBytes {
+			err = fmt.Errorf("challenge is %d bytes, not %d", len(theirs), noiseChallengeBytes)
+		}
+		return theirs, err
+	}
+	answer := func(theirs []byte) error {
+		signature, err := n.cryptoManager.SignPlaintext(noiseChallengeData(binding, theirs, sanitizeLine(n.ID), initiator))
+		if err != nil {
+			return err
+		}
+		return nc.writeMessage([]byte(signature.Signature))
+	}
+	checkAnswer := func() error {
+		signature, err := nc.readMessage()
+		if err != nil {
+			return err
+		}
+		if err := verifySignature(publicKey, noiseChallengeData(binding, ours, nc.nodeID, !initiator), string(signature)); err != nil {
+			return fmt.Errorf("%s didn't sign our challenge with its identity key: %w", nc.nodeID, err)
+		}
+		return nil
+	}
+
+	if initiator {
+		if err := nc.writeMessage(ours); err != nil {
+			return err
+		}
+		theirs, err := readChallenge()
+		if err != nil {
+			return err
+		}
+		if err := answer(theirs); err != nil {
+			return err
+		}
+		return checkAnswer()
+	}
+
+	theirs, err := readChallenge()
+	if err != nil {
+		return err
+	}
+	if err := nc.writeMessage(ours); err != nil {
+		return err
+	}
+	if err := checkAnswer(); err != nil {
+		return err
+	}
+	return answer(theirs)
+}
+
+// noiseChallengeData is what a challenge response signs: the session, the challenge, and who
+// answers it in which role, so an answer can't be replayed on another connection or reflected
+func noiseChallengeData(binding, challenge []byte, nodeID string, initiator bool) []byte {
+	role := "responder"
+	if initiator {
+		role = "initiator"
+	}
+	data := []byte(noiseChallengeLabel + "\x00" + role + "\x00")
+	data = append(data, binding...)
+	data = append(data, challenge...)
+	return append(data, nodeID...)
+}
+
+// verifyNoiseIdentity checks that the peer's identity key signed the static key it used in the
+// handshake, returning the identity and the key's fingerprint. A peer we dialled must also hold
+// the key we already have for its address.
+func (n *Node) verifyNoiseIdentity(payload, staticKey []byte, dialedAddr string) (noiseIdentity, string, error) {
+	var identity noiseIdentity
+	if err := json.Unmarshal(payload, &identity); err != nil {
+		return noiseIdentity{}, "", fmt.Errorf("invalid identity: %w", err)
+	}
+	publicKey, err := parsePublicKeyPEM(identity.PublicKey)
+	if err != nil {
+		return noiseIdentity{}, "", err
+	}
+	if err := verifySignature(publicKey, noiseSignedData(staticKey, identity.NodeID), identity.Signature); err != nil {
+		return noiseIdentity{}, "", fmt.Errorf("identity doesn't match the handshake key: %w", err)
+	}
+
+	fingerprint := keyFingerprint(publicKey)
+	// Node IDs are listen addresses, so the key we may hold for the dialled address is the peer's.
+	// The connection's remote address won't do: over Tor it is the SOCKS proxy.
+	if dialedAddr != "" {
+		if expected, known := n.cryptoManager.PeerFingerprint(dialedAddr); known && expected != fingerprint {
+			return noiseIdentity{}, "", fmt.Errorf("%s presented key %s, not the key we hold (%s)",
+				dialedAddr, formatFingerprint(fingerprint), formatFingerprint(expected))
+		}
+	}
+	identity.NodeID = sanitizeLine(identity.NodeID)
+	return identity, fingerprint, nil
+}
+
+// writeNoiseMessage writes a length-prefixed Noise message
+func writeNoiseMessage(w io.Writer, message []byte) error {
+	buf := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(buf, uint16(len(message)))
+	copy(buf[2:], message)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readNoiseMessage reads a length-prefixed Noise message
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// noiseConn carries frames over a Noise session. Writes are split into Noise messages; reads
+// return their plaintext in order. Only readPeer reads and only writePeer writes, so each
+// direction's cipher state has a single user.
+type noiseConn struct {
+	net.Conn
+	reader      *bufio.Reader
+	send        *noise.CipherState
+	receive     *noise.CipherState
+	pending     []byte // Plaintext of the last message not yet returned by Read
+	nodeID      string // Node ID the peer signed in the handshake
+	fingerprint string // Identity key the peer proved it holds
+	invite      string // Invitation token the peer presented, if any
+	binding     []byte // Handshake hash of the session
+
+	capabilities []string     // What the peer announced in the handshake
+	version      *VersionInfo // The build the peer announced in the handshake
+}
+
+// writeMessage sends p as one Noise message; it is only used during the handshake
+func (nc *noiseConn) writeMessage(p []byte) error {
+	message, err := nc.send.Encrypt(nil, nil, p)
+	if err != nil {
+		return err
+	}
+	return writeNoiseMessage(nc.Conn, message)
+}
+
+// readMessage returns the plaintext of one Noise message; it is only used during the handshake
+func (nc *noiseConn) readMessage() ([]byte, error) {
+	message, err := readNoiseMessage(nc.reader)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := nc.receive.Decrypt(nil, nil, message)
+	if err != nil {
+		return nil, fmt.Errorf("noise decryption failed: %w", err)
+	}
+	return plaintext, nil
+}
+
+func (nc *noiseConn) Read(p []byte) (int, error) {
+	for len(nc.pending) == 0 {
+		message, err := readNoiseMessage(nc.reader)
+		if err != nil {
+			return 0, err
+		}
+		if nc.pending, err = nc.receive.Decrypt(nil, nil, message); err != nil {
+			return 0, fmt.Errorf("noise decryption failed: %w", err)
+		}
+	}
+	n := copy(p, nc.pending)
+	nc.pending = nc.pending[n:]
+	return n, nil
+}
+
+func (nc *noiseConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), noiseMaxPlaintext)]
+		message, err := nc.send.Encrypt(nil, nil, chunk)
+		if err != nil {
+			return written, err
+		}
+		if err := writeNoiseMessage(nc.Conn, message); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (nc *noiseConn) peerFingerprint() string { return nc.fingerprint }
+func (nc *noiseConn) sessionID() []byte       { return nc.binding }
+
+// replayConn returns bytes read while negotiating before reading on from the connection
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (rc *replayConn) Read(p []byte) (int, error) { return rc.reader.Read(p) }
+
+// peerAuthenticatedConn returns a peer's connection if its transport authenticates the peer
+func peerAuthenticatedConn(peer *Peer) (authenticatedConn, bool) {
+	conn := peer.Conn
+	if counted, ok := conn.(*countingConn); ok {
+		conn = counted.Conn
+	}
+	ac, ok := conn.(authenticatedConn)
+	return ac, ok
+}
+
+// spoofedSender reports whether a frame on an authenticated connection names a sender the
+// connection wasn't authenticated as: over Noise, any node ID but the one the peer signed; over
+// QUIC, a node whose key we hold that isn't the key the connection proved
+func (n *Node) spoofedSender(ac authenticatedConn, senderID string) bool {
+	if nc, ok := ac.(*noiseConn); ok {
+		return senderID != nc.nodeID
+	}
+	if n.cryptoManager == nil {
+		return false
+	}
+	held, known := n.cryptoManager.PeerFingerprint(senderID)
+	return known && held != ac.peerFingerprint()
+}
+
+// connFingerprint returns the identity key a connection's transport authenticated, if it did
+func (n *Node) connFingerprint(connID string) (string, bool) {
+	n.peersMutex.RLock()
+	peer, exists := n.conns[connID]
+	n.peersMutex.RUnlock()
+	if !exists {
+		return "", false
+	}
+	ac, ok := peerAuthenticatedConn(peer)
+	if !ok {
+		return "", false
+	}
+	return ac.peerFingerprint(), true
+}
+
+// checkTransportKey refuses an identity key that isn't the one the connection's Noise handshake
+// or QUIC certificate proved the peer holds. Legacy connections have nothing to compare with,
+// but may not announce a key that has spoken Noise with us.
+func (n *Node) checkTransportKey(connID, publicKeyPEM string) error {
+	publicKey, err := parsePublicKeyPEM(publicKeyPEM)
+	if err != nil {
+		return err
+	}
+	fingerprint := keyFingerprint(publicKey)
+
+	authenticated, ok := n.connFingerprint(connID)
+	if !ok {
+		if n.spokeNoise(fingerprint) {
+			return fmt.Errorf("key %s spoke Noise before and is now announced over legacy connection %s",
+				formatFingerprint(fingerprint), connID)
+		}
+		return nil
+	}
+	if fingerprint != authenticated {
+		return fmt.Errorf("key %s announced over %s is not the key the connection was authenticated with (%s)",
+			formatFingerprint(fingerprint), connID, formatFingerprint(authenticated))
+	}
+	return nil
+}
+
+// SessionMessage is a message to a directly connected peer over a Noise or QUIC session. The
+// connection already encrypts it and authenticates the sender, so it carries the plaintext; the
+// RSA envelope is only needed for legacy peers.
+type SessionMessage struct {
+	MessageType string `json:"message_type"`
+	Payload     []byte `json:"payload"`
+	Compression string `json:"compression,omitempty"` // "gzip" when Payload is compressed; only for peers announcing capabilityGzip
+}
+
+// sessionFrame builds a session message for a peer whose connection authenticated the key we hold
+// for nodeID. It reports false, and the message needs an envelope, for any other connection.
+func (en *EnhancedNode) sessionFrame(connID, nodeID string, plaintext []byte, msgType string) ([]byte, bool, error) {
+	authenticated, ok := en.connFingerprint(connID)
+	if !ok {
+		return nil, false, nil
+	}
+	if held, known := en.cryptoManager.PeerFingerprint(nodeID); !known || held != authenticated {
+		return nil, false, nil
+	}
+
+	if err := checkEnvelopeSize(plaintext, msgType); err != nil {
+		return nil, true, err
+	}
+	sessionMsg := SessionMessage{MessageType: msgType, Payload: plaintext}
+	if capabilities, _ := en.peerCapabilities(connID); capabilities.Has(capabilityGzip) {
+		sessionMsg.Payload, sessionMsg.Compression = compressPayload(plaintext)
+	}
+	data, err := json.Marshal(sessionMsg)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to serialize message for %s: %w", nodeID, err)
+	}
+	return newFrame(en.ID, append([]byte(sessionPrefix), data...)), true, nil
+}
+
+// openSessionMessage returns the plaintext and type of a session message. It is only accepted over
+// a connection authenticated with the key we hold for the sender; a session peer can't speak for
+// another node. A compressed payload is expanded within decompressPayload's limits.
+func (en *EnhancedNode) openSessionMessage(msg Message) ([]byte, string, error) {
+	authenticated, ok := en.connFingerprint(msg.FromPeerID)
+	if !ok {
+		return nil, "", fmt.Errorf("session message over an unauthenticated connection")
+	}
+	if held, known := en.cryptoManager.PeerFingerprint(msg.SenderID); !known || held != authenticated {
+		return nil, "", fmt.Errorf("connection wasn't authenticated with the sender's key")
+	}
+
+	var sessionMsg SessionMessage
+	if err := json.Unmarshal(msg.Content[len(sessionPrefix):], &sessionMsg); err != nil {
+		return nil, "", fmt.Errorf("invalid session message: %w", err)
+	}
+	plaintext, err := decompressPayload(sessionMsg.Payload, sessionMsg.Compression)
+	if err != nil {
+		return nil, "", err
+	}
+	if en.cryptoManager.markVerifiedFingerprint(msg.SenderID, authenticated) {
+		en.audit(AuditEntry{
+			Event: auditKeyVerified, Severity: auditInfo, Peer: msg.SenderID, Connection: msg.FromPeerID,
+			Detail: fmt.Sprintf("%s authenticated its connection with the key we hold for it", msg.SenderID),
+		})
+	}
+	return plaintext, sessionMsg.MessageType, nil
+}
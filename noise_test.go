@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/flynn/noise"
+)
+
+// TestNoiseInterop connects nodes that speak Noise with nodes from before it, which speak only
+// legacy frames, in both directions: only two Noise nodes may end up on a Noise session, and
+// every pair must still exchange keys and messages both ways
+func TestNoiseInterop(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		dialerLegacy   bool
+		listenerLegacy bool
+	}{
+		{"noise to noise", false, false},
+		{"noise to legacy", false, true},
+		{"legacy to noise", true, false},
+		{"legacy to legacy", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tn := newTestNetwork(t, 0)
+			dialer, listener := tn.newNode(), tn.newNode()
+			dialer.legacyOnly, listener.legacyOnly = tc.dialerLegacy, tc.listenerLegacy
+			tn.start(dialer)
+			tn.start(listener)
+			tn.connect(dialer, listener)
+
+			wantSession := !tc.dialerLegacy && !tc.listenerLegacy
+			for _, node := range []*EnhancedNode{dialer, listener} {
+				peers := node.snapshotPeers()
+				if len(peers) != 1 {
+					t.Fatalf("%s has %d connections, want 1", node.ID, len(peers))
+				}
+				if _, session := peerAuthenticatedConn(peers[0]); session != wantSession {
+					t.Errorf("%s on a Noise session: %v, want %v", node.ID, session, wantSession)
+				}
+			}
+
+			if err := dialer.SendTextAndConfirm(listener.ID, "from the dialer", testWait); err != nil {
+				t.Fatalf("dialer to listener: %v", err)
+			}
+			waitForText(t, listener, dialer.ID, "from the dialer")
+			if err := listener.SendTextAndConfirm(dialer.ID, "from the listener", testWait); err != nil {
+				t.Fatalf("listener to dialer: %v", err)
+			}
+			waitForText(t, dialer, listener.ID, "from the listener")
+
+			if _, err := listener.SendEncryptedText("to everyone"); err != nil {
+				t.Fatalf("broadcast: %v", err)
+			}
+			waitForText(t, dialer, listener.ID, "to everyone")
+		})
+	}
+}
+
+// noiseSessionPair runs an XX handshake in memory and returns the two ends of the session over a
+// net.Pipe, with the handshake's channel binding, for testing what follows the handshake
+func noiseSessionPair(t *testing.T) (initiator, responder *noiseConn, binding []byte) {
+	t.Helper()
+	state := func(initiator bool) *noise.HandshakeState {
+		static, err := noise.DH25519.GenerateKeypair(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs, err := noise.NewHandshakeState(noise.Config{
+			CipherSuite: noiseCipherSuite, Random: rand.Reader, Pattern: noise.HandshakeXX,
+			Initiator: initiator, Prologue: []byte(noisePrologue), StaticKeypair: static,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hs
+	}
+	i, r := state(true), state(false)
+
+	// -> e; <- e, ee, s, es; -> s, se
+	m1, _, _, err := i.WriteMessage(nil, nil)
+	if err == nil {
+		_, _, _, err = r.ReadMessage(nil, m1)
+	}
+	var m2, m3 []byte
+	if err == nil {
+		m2, _, _, err = r.WriteMessage(nil, nil)
+	}
+	if err == nil {
+		_, _, _, err = i.ReadMessage(nil, m2)
+	}
+	var iSend, iReceive, rReceive, rSend *noise.CipherState
+	if err == nil {
+		m3, iSend, iReceive, err = i.WriteMessage(nil, nil)
+	}
+	if err == nil {
+		_, rReceive, rSend, err = r.ReadMessage(nil, m3)
+	}
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	initiator = &noiseConn{Conn: a, reader: bufio.NewReader(a), send: iSend, receive: iReceive}
+	responder = &noiseConn{Conn: b, reader: bufio.NewReader(b), send: rSend, receive: rReceive}
+	return initiator, responder, i.ChannelBinding()
+}
+
+// TestNoiseChallenge has a node challenge a peer that answers with its own identity key, and one
+// that presented another node's identity but can only sign with its own
+func TestNoiseChallenge(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	x, y, impostor := tn.newNode(), tn.newNode(), tn.newNode()
+	for _, node := range []*EnhancedNode{x, y, impostor} {
+		t.Cleanup(func() { node.shutdownWithin(testWait) })
+	}
+	yKey, err := y.cryptoManager.GetPublicKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xKey, err := x.cryptoManager.GetPublicKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		answerer *EnhancedNode
+		wantErr  string
+	}{
+		{"identity key", y, ""},
+		{"another key", impostor, "didn't sign our challenge"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ours, theirs, binding := noiseSessionPair(t)
+			ours.nodeID, theirs.nodeID = tc.answerer.ID, x.ID
+
+			answered := make(chan error, 1)
+			go func() {
+				answered <- tc.answerer.exchangeChallenges(theirs, binding, xKey, false)
+			}()
+			// x expects y's key, whoever answers
+			err := x.exchangeChallenges(ours, binding, yKey, true)
+			ours.Close()
+			<-answered
+
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("challenge answered with the identity key failed: %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("challenge answered with another key: %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestDialRefusesWrongKey dials a node whose address we hold a different key for
+func TestDialRefusesWrongKey(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+
+	dir := t.TempDir()
+	testKeys(t, 2, dir)
+	other, err := NewCryptoManager(filepath.Join(dir, keysDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := other.GetPublicKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.cryptoManager.AddPeerKey(b.ID, otherKey); err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.connectToPeer(b.ID)
+	if err == nil || !strings.Contains(err.Error(), "not the key we hold") {
+		t.Fatalf("dialling a node with another key: %v", err)
+	}
+	if peers := a.snapshotPeers(); len(peers) != 0 {
+		t.Errorf("a registered %d connection(s) to the wrong key", len(peers))
+	}
+}
+
+// TestSpoofedSenderDropped has a peer on a Noise session send a frame naming another node
+func TestSpoofedSenderDropped(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	a, b, c := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	tn.connect(a, b)
+
+	peers := b.snapshotPeers()
+	if len(peers) != 1 {
+		t.Fatalf("b has %d connections, want 1", len(peers))
+	}
+	peers[0].Send <- newFrame(c.ID, []byte("claims to be c"))
+
+	// Frames are read in order, so once this arrives the spoofed one has been dealt with
+	if err := b.SendTextAndConfirm(a.ID, "from b", testWait); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, a, b.ID, "from b")
+	if got := a.spoofedFrames.Load(); got != 1 {
+		t.Errorf("%d spoofed frames counted, want 1", got)
+	}
+	if texts := loggedTexts(a, c.ID); len(texts) != 0 {
+		t.Errorf("a showed %q as from c", texts)
+	}
+}
+
+// TestLegacyRefusedAfterNoise has a key that has spoken Noise with a node come back over legacy
+// frames, as someone stripping Noise between them would make it look: it is refused whichever
+// end dials
+func TestLegacyRefusedAfterNoise(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	tn.connect(a, b)
+	bKey, err := b.cryptoManager.GetPublicKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b's key, speaking only legacy frames
+	downgraded := tn.newNodeWithKey(1)
+	downgraded.legacyOnly = true
+	tn.start(downgraded)
+
+	if err := a.cryptoManager.AddPeerKey(downgraded.ID, bKey); err != nil {
+		t.Fatal(err)
+	}
+	err = a.connectToPeer(downgraded.ID)
+	if err == nil || !strings.Contains(err.Error(), "spoke Noise before") {
+		t.Errorf("dialling a key that spoke Noise, answered in legacy frames: %v", err)
+	}
+
+	if err := downgraded.connectToPeer(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a to refuse the key", func() bool {
+		return slices.ContainsFunc(a.auditLog.Recent(auditRecentLimit), func(entry AuditEntry) bool {
+			return entry.Event == auditKeyRefused && entry.Peer == downgraded.ID
+		})
+	})
+
+	// Keys that never spoke Noise with a still connect in legacy frames
+	legacy := tn.newNode()
+	legacy.legacyOnly = true
+	tn.start(legacy)
+	tn.connect(a, legacy)
+}
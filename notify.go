@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Desktop notification modes, chosen with -notify or /notify
+const (
+	notifyOff      = "off"
+	notifyOn       = "on"       // Whatever each conversation's notification level lets through
+	notifyMentions = "mentions" // Mentions only
+)
+
+const (
+	notifyInterval   = 5 * time.Second // At most one notification this often; the rest are counted
+	notifyPreviewLen = 100             // Characters of the message shown in a notification
+)
+
+// Notifier shows desktop notifications
+type Notifier interface {
+	Notify(title, body string) error
+}
+
+// commandNotifier shows notifications with the platform's own tool: notify-send, osascript, or a
+// PowerShell toast on Windows. Tests set the platform and run the tool themselves.
+type commandNotifier struct {
+	goos string                // runtime.GOOS, or the platform a test builds the command for
+	run  func(*exec.Cmd) error // Starts the tool: startDetached, or a test's recorder
+}
+
+func newCommandNotifier() commandNotifier {
+	return commandNotifier{goos: runtime.GOOS, run: startDetached}
+}
+
+// startDetached starts a command without waiting for it, so a slow one can't hold up the UI
+func startDetached(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// windowsToast shows a toast with the title and body passed in the environment, so neither needs
+// quoting for PowerShell
+const windowsToast = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $xml.GetElementsByTagName('text')
+$text.Item(0).AppendChild($xml.CreateTextNode($env:P2PCHAT_NOTIFY_TITLE)) > $null
+$text.Item(1).AppendChild($xml.CreateTextNode($env:P2PCHAT_NOTIFY_BODY)) > $null
+$app = '{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe'
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($app).Show([Windows.UI.Notifications.ToastNotification]::new($xml))`
+
+// Notify starts the notification tool for the platform
+func (cn commandNotifier) Notify(title, body string) error {
+	var cmd *exec.Cmd
+	switch cn.goos {
+	case "darwin":
+		// Arguments reach the script as argv, so they need no AppleScript quoting
+		cmd = exec.Command("osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title, body)
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToast)
+		cmd.Env = append(os.Environ(), "P2PCHAT_NOTIFY_TITLE="+title, "P2PCHAT_NOTIFY_BODY="+body)
+	default:
+		cmd = exec.Command("notify-send", "--app-name=p2pchat", "--", title, body)
+	}
+	if err := cn.run(cmd); err != nil {
+		return fmt.Errorf("failed to show notification: %w", err)
+	}
+	return nil
+}
+
+// parseNotifyMode checks a -notify or /notify mode
+func parseNotifyMode(mode string) (string, error) {
+	switch mode {
+	case notifyOff, notifyOn, notifyMentions:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown notification mode %q (use on, off or mentions)", mode)
+}
+
+// desktopNotifications decides which messages raise a notification and sends them, no more than
+// one per notifyInterval
+type desktopNotifications struct {
+	notifier    Notifier
+	mode        string
+	hidePreview bool // Don't put message text in notifications
+	last        time.Time
+	held        int // Messages not notified since the last notification because of the rate limit
+}
+
+// wants reports whether a peer's message that its conversation's level lets through should raise
+// a notification: all of them, or with -notify mentions only mentions
+func (dn *desktopNotifications) wants(msg Message) bool {
+	switch dn.mode {
+	case notifyOn:
+		return true
+	case notifyMentions:
+		return msg.Mention
+	}
+	return false
+}
+
+// notify shows a notification for a message from sender, or counts it if one was shown too
+// recently. The next notification says how many were held back.
+func (dn *desktopNotifications) notify(now time.Time, sender string, msg Message) error {
+	if now.Sub(dn.last) < notifyInterval {
+		dn.held++
+		return nil
+	}
+
+	var title string
+	switch {
+	case msg.Direct:
+		title = sender + " sent you a message"
+	case msg.Mention:
+		title = sender + " mentioned you"
+	default:
+		room := msg.Room
+		if room == "" {
+			room = broadcastRoom
+		}
+		title = sender + " wrote in " + room
+	}
+	if dn.held > 0 {
+		title += fmt.Sprintf(" (+%d more)", dn.held)
+	}
+	body := "Open p2pchat to read it"
+	if !dn.hidePreview {
+		body = truncateText(strings.Join(strings.Fields(string(msg.Content)), " "), notifyPreviewLen)
+	}
+
+	dn.last, dn.held = now, 0
+	return dn.notifier.Notify(title, body)
+}
+
+// notifyCommand handles /notify in the TUI: on|off|mentions picks what raises notifications and
+// preview on|off whether they show the message text
+func (ui *UI) notifyCommand(args string) {
+	fields := strings.Fields(args)
+	dn := &ui.notifications
+	switch {
+	case len(fields) == 0:
+	case len(fields) == 2 && fields[0] == "preview" && (fields[1] == "on" || fields[1] == "off"):
+		dn.hidePreview = fields[1] == "off"
+	case len(fields) == 1:
+		mode, err := parseNotifyMode(fields[0])
+		if err != nil {
+			ui.notice(fmt.Sprintf("❌ %v", err))
+			return
+		}
+		dn.mode = mode
+	default:
+		ui.notice("Usage: /notify [on|off|mentions] or /notify preview <on|off>")
+		return
+	}
+
+	preview := "with message previews"
+	if dn.hidePreview {
+		preview = "without message previews"
+	}
+	switch dn.mode {
+	case notifyOn:
+		ui.notice("🔔 Desktop notifications for what each conversation's level lets through (/notifications) while the terminal is in the background, " + preview)
+	case notifyMentions:
+		ui.notice("🔔 Desktop notifications for mentions while the terminal is in the background, " + preview)
+	default:
+		ui.notice("🔕 Desktop notifications are off (/notify on or /notify mentions turns them on)")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const notificationsFile = "notifications.json" // Per-conversation notification levels and do not disturb
+
+// Notification levels of a conversation, set with /notifications
+const (
+	levelAll      = "all"      // Every message from a peer
+	levelMentions = "mentions" // Only messages that mention us
+	levelOff      = "off"      // Nothing, not even unread counts
+)
+
+// broadcastRoom is how /notifications names the broadcast channel; no room may take the name
+const broadcastRoom = "#all"
+
+// notificationPrefs are the levels chosen for conversations, keyed by broadcastRoom, a room's name,
+// or a peer's key fingerprint so a setting follows the peer rather than its address, and the
+// do-not-disturb time. Conversations without a level get the defaults: DMs notify on every
+// message, the broadcast channel and rooms on mentions.
+type notificationPrefs struct {
+	Levels map[string]string `json:"levels,omitempty"`
+	DND    *time.Time        `json:"dnd_until,omitempty"` // Nothing notifies until then
+}
+
+// parseNotificationLevel checks a level given to /notifications; "default" clears the setting
+func parseNotificationLevel(level string) (string, error) {
+	switch level {
+	case levelAll, levelMentions, levelOff, "default":
+		return level, nil
+	case "mentions-only":
+		return levelMentions, nil
+	}
+	return "", fmt.Errorf("unknown notification level %q (use all, mentions, off or default)", level)
+}
+
+// levelWants reports whether a peer's message rings the bell or raises a notification in a
+// conversation at this level
+func levelWants(level string, msg Message) bool {
+	switch level {
+	case levelAll:
+		return true
+	case levelMentions:
+		return msg.Mention
+	}
+	return false
+}
+
+// loadNotificationPrefs reads the saved notification levels; a missing file means the defaults.
+// Levels it can't use, such as ones edited in by hand, are dropped.
+func loadNotificationPrefs(path string) (notificationPrefs, error) {
+	var prefs notificationPrefs
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return prefs, nil
+	}
+	if err != nil {
+		return prefs, fmt.Errorf("failed to read notification settings: %w", err)
+	}
+	if err := json.Unmarshal(data, &prefs); err != nil {
+		return notificationPrefs{}, fmt.Errorf("invalid notification settings %s: %w", path, err)
+	}
+	for key, level := range prefs.Levels {
+		if key == "" || (level != levelAll && level != levelMentions && level != levelOff) {
+			delete(prefs.Levels, key)
+		}
+	}
+	return prefs, nil
+}
+
+// setNotificationsPath loads the notification levels saved at path and saves them there from now on
+func (ui *UI) setNotificationsPath(path string) error {
+	ui.notifyPrefsPath = path
+	prefs, err := loadNotificationPrefs(path)
+	ui.notifyPrefs = prefs
+	return err
+}
+
+// saveNotificationPrefs records the notification levels and do-not-disturb time
+func (ui *UI) saveNotificationPrefs() error {
+	if ui.notifyPrefsPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ui.notifyPrefs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ui.notifyPrefsPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to save notification settings: %w", err)
+	}
+	return nil
+}
+
+// notificationKey is what a conversation's level is saved under: broadcastRoom, the room name, or
+// the key fingerprint of the DM's peer. It reports false for a peer whose key hasn't been seen.
+func (ui *UI) notificationKey(peer string) (string, bool) {
+	if peer == "" {
+		return broadcastRoom, true
+	}
+	if roomName.MatchString(peer) {
+		return peer, true
+	}
+	fingerprint, known := ui.fingerprints[peer]
+	return fingerprint, known
+}
+
+// notificationLevel returns the level of the conversation with peer or in a room, or of the
+// broadcast channel for ""
+func (ui *UI) notificationLevel(peer string) string {
+	if key, known := ui.notificationKey(peer); known {
+		if level, set := ui.notifyPrefs.Levels[key]; set {
+			return level
+		}
+	}
+	if peer == "" || roomName.MatchString(peer) {
+		return levelMentions
+	}
+	return levelAll
+}
+
+// dndActive reports whether do not disturb is on at now
+func (ui *UI) dndActive(now time.Time) bool {
+	return ui.notifyPrefs.DND != nil && now.Before(*ui.notifyPrefs.DND)
+}
+
+// checkDND turns do not disturb off once its time is up
+func (ui *UI) checkDND(now time.Time) {
+	if ui.notifyPrefs.DND == nil || ui.dndActive(now) {
+		return
+	}
+	ui.notifyPrefs.DND = nil
+	if err := ui.saveNotificationPrefs(); err != nil {
+		ui.notice(fmt.Sprintf("❌ %v", err))
+	}
+	ui.notice("🔔 Do not disturb is over; notifications are back on")
+}
+
+// findPeerByName returns the node ID of a connected peer given by connection ID, node ID or nick
+func (ui *UI) findPeerByName(name string) (string, bool) {
+	for conn, info := range ui.peerInfo {
+		if conn == name || info.NodeID == name || (info.Nick != "" && strings.EqualFold(info.Nick, name)) {
+			return ui.peerNodeID(conn), true
+		}
+	}
+	return "", false
+}
+
+// notificationsCommand handles /notifications: with no arguments it lists the levels in use;
+// "[#all|#room|peer] <all|mentions|off|default>" sets one, for the conversation being shown if no
+// conversation is named
+func (ui *UI) notificationsCommand(args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		ui.notice(ui.describeNotifications())
+		return
+	}
+	if len(fields) > 2 {
+		ui.notice("Usage: /notifications [#all|#room|peer] <all|mentions|off|default>")
+		return
+	}
+
+	peer, name := ui.conversations[ui.active].peer, ""
+	if len(fields) == 2 {
+		name = fields[0]
+		switch {
+		case name == broadcastRoom:
+			peer = ""
+		case roomName.MatchString(name) && ui.findConversation(name) >= 0:
+			peer = name
+		case strings.HasPrefix(name, "#"):
+			ui.notice(fmt.Sprintf("❌ No tab for room %s; the broadcast channel is %s", name, broadcastRoom))
+			return
+		default:
+			nodeID, found := ui.findPeerByName(name)
+			if !found {
+				ui.notice(fmt.Sprintf("❌ %s isn't connected", name))
+				return
+			}
+			peer = nodeID
+		}
+	}
+	level, err := parseNotificationLevel(fields[len(fields)-1])
+	if err != nil {
+		ui.notice(fmt.Sprintf("❌ %v", err))
+		return
+	}
+	key, known := ui.notificationKey(peer)
+	if !known {
+		ui.notice(fmt.Sprintf("❌ No key from %s yet; notification settings follow a peer's key", ui.displayName(peer)))
+		return
+	}
+
+	if level == "default" {
+		delete(ui.notifyPrefs.Levels, key)
+	} else {
+		if ui.notifyPrefs.Levels == nil {
+			ui.notifyPrefs.Levels = make(map[string]string)
+		}
+		ui.notifyPrefs.Levels[key] = level
+	}
+	if err := ui.saveNotificationPrefs(); err != nil {
+		ui.notice(fmt.Sprintf("❌ %v", err))
+		return
+	}
+	ui.notice(fmt.Sprintf("🔔 %s: %s", ui.conversationName(peer), describeLevel(ui.notificationLevel(peer))))
+}
+
+// conversationName is how /notifications refers to a conversation
+func (ui *UI) conversationName(peer string) string {
+	if peer == "" {
+		return broadcastRoom
+	}
+	return ui.displayName(peer)
+}
+
+// describeLevel says what a level lets through
+func describeLevel(level string) string {
+	switch level {
+	case levelAll:
+		return "every message notifies"
+	case levelMentions:
+		return "only mentions notify"
+	}
+	return "nothing notifies or counts as unread"
+}
+
+// describeNotifications lists the do-not-disturb time, the conversation being shown and every
+// saved level, naming peers that are connected and showing the others by key
+func (ui *UI) describeNotifications() string {
+	var content strings.Builder
+	content.WriteString("🔔 Notifications")
+	if ui.dndActive(time.Now()) {
+		content.WriteString(fmt.Sprintf(" (do not disturb until %s)", ui.notifyPrefs.DND.Format("15:04")))
+	}
+	peer := ui.conversations[ui.active].peer
+	content.WriteString(fmt.Sprintf("\n  This conversation (%s): %s", ui.conversationName(peer), describeLevel(ui.notificationLevel(peer))))
+
+	names := make(map[string]string, len(ui.fingerprints)+1)
+	names[broadcastRoom] = broadcastRoom
+	for nodeID, fingerprint := range ui.fingerprints {
+		names[fingerprint] = ui.displayName(nodeID)
+	}
+	keys := make([]string, 0, len(ui.notifyPrefs.Levels))
+	for key := range ui.notifyPrefs.Levels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, found := names[key]
+		if !found && roomName.MatchString(key) {
+			name = key
+		} else if !found {
+			name = "key " + shortFingerprint(key)
+		}
+		content.WriteString(fmt.Sprintf("\n  %s: %s", name, ui.notifyPrefs.Levels[key]))
+	}
+	content.WriteString("\nDefaults: direct messages notify on every message, " + broadcastRoom + " and rooms on mentions")
+	return content.String()
+}
+
+// dndCommand handles /dnd: "<duration>" silences the bell and desktop notifications until the time
+// is up, "off" ends it early, and no argument shows whether it is on
+func (ui *UI) dndCommand(args string) {
+	args = strings.TrimSpace(args)
+	now := time.Now()
+	switch args {
+	case "":
+		if ui.dndActive(now) {
+			ui.notice(fmt.Sprintf("⛔ Do not disturb until %s (/dnd off ends it)", ui.notifyPrefs.DND.Format("15:04")))
+		} else {
+			ui.notice("🔔 Do not disturb is off (/dnd 1h turns it on for an hour)")
+		}
+		return
+	case "off":
+		ui.notifyPrefs.DND = nil
+	default:
+		duration, err := time.ParseDuration(args)
+		if err != nil || duration <= 0 {
+			ui.notice(fmt.Sprintf("❌ Invalid duration %q (e.g. 30m or 2h)", args))
+			return
+		}
+		until := now.Add(duration)
+		ui.notifyPrefs.DND = &until
+	}
+	if err := ui.saveNotificationPrefs(); err != nil {
+		ui.notice(fmt.Sprintf("❌ %v", err))
+		return
+	}
+	if ui.notifyPrefs.DND == nil {
+		ui.notice("🔔 Do not disturb is off")
+		return
+	}
+	ui.notice(fmt.Sprintf("⛔ Do not disturb until %s: no bell or desktop notifications", ui.notifyPrefs.DND.Format("15:04")))
+}
+
+// renderNotificationLevel shows the level of the conversation being shown, or do not disturb, for
+// the message panel title
+func (ui *UI) renderNotificationLevel() string {
+	if ui.dndActive(time.Now()) {
+		return "  " + mentionMessageStyle.Render("⛔ DND until "+ui.notifyPrefs.DND.Format("15:04"))
+	}
+	switch ui.notificationLevel(ui.conversations[ui.active].peer) {
+	case levelAll:
+		return "  " + timestampStyle.Render("🔔 all")
+	case levelMentions:
+		return "  " + timestampStyle.Render("🔔 mentions")
+	}
+	return "  " + timestampStyle.Render("🔕 off")
+}
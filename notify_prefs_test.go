@@ -0,0 +1,207 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notifyingUI returns a TUI in the background with desktop notifications on, and a function that
+// reports whether receiving a message raised one
+func notifyingUI(t *testing.T) (*UI, func(Message) bool) {
+	ui, _ := newTestUI(t, 100, 30)
+	fake := &fakeNotifier{}
+	ui.notifications = desktopNotifications{notifier: fake, mode: notifyOn}
+	ui.blurred = true
+	return ui, func(msg Message) bool {
+		// Every message starts clear of the last notification, so none is held back
+		fake.shown = nil
+		ui.notifications.last = time.Time{}
+		receive(ui, msg)
+		return len(fake.shown) == 1
+	}
+}
+
+// TestNotificationLevelDefaults has DMs notify on every message and the broadcast channel and
+// rooms only on mentions, until /notifications says otherwise
+func TestNotificationLevelDefaults(t *testing.T) {
+	ui, notified := notifyingUI(t)
+	peer, key := "127.0.0.1:2", "bob-key"
+	direct := Message{SenderID: peer, SenderKey: key, Content: []byte("are you there?"), Direct: true}
+
+	tests := []struct {
+		name string
+		msg  Message
+		want bool
+	}{
+		{"DM", direct, true},
+		{"broadcast", Message{SenderID: peer, Content: []byte("hello all")}, false},
+		{"broadcast mention", Message{SenderID: peer, Content: []byte("hi @me"), Mention: true}, true},
+		{"room", Message{SenderID: peer, Content: []byte("hello room"), Room: "#lan"}, false},
+		{"room mention", Message{SenderID: peer, Content: []byte("hi @me"), Room: "#lan", Mention: true}, true},
+	}
+	for _, test := range tests {
+		if got := notified(test.msg); got != test.want {
+			t.Errorf("%s notified %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	ui.notificationsCommand("#all all")
+	if !notified(Message{SenderID: peer, Content: []byte("hello again")}) {
+		t.Errorf("a broadcast didn't notify with %s set to all", broadcastRoom)
+	}
+	ui.switchConversation(ui.findConversation(peer))
+	ui.notificationsCommand("mentions")
+	if notified(direct) {
+		t.Error("a DM without a mention notified with the conversation set to mentions")
+	}
+	if level := ui.notifyPrefs.Levels[key]; level != levelMentions {
+		t.Errorf("DM level saved as %q under the peer's key", level)
+	}
+	ui.notificationsCommand("default")
+	if !notified(direct) {
+		t.Error("a DM didn't notify after /notifications default")
+	}
+}
+
+// TestNotificationLevelOff leaves a conversation set to off out of the unread and mention counts
+func TestNotificationLevelOff(t *testing.T) {
+	ui, notified := notifyingUI(t)
+	peer := "127.0.0.1:2"
+	direct := Message{SenderID: peer, SenderKey: "bob-key", Content: []byte("are you there?"), Direct: true}
+	notified(direct)
+	tab := ui.findConversation(peer)
+	if unread := ui.conversations[tab].unread; unread != 1 {
+		t.Fatalf("%d unread in the DM tab, want 1", unread)
+	}
+
+	ui.switchConversation(tab)
+	ui.notificationsCommand("off")
+	ui.switchConversation(0)
+	mentions := ui.mentions
+	if notified(direct) {
+		t.Error("a DM notified with the conversation off")
+	}
+	if notified(Message{SenderID: peer, SenderKey: "bob-key", Content: []byte("@me"), Direct: true, Mention: true}) {
+		t.Error("a mention notified with the conversation off")
+	}
+	if unread := ui.conversations[tab].unread; unread != 0 {
+		t.Errorf("%d unread in a conversation set to off", unread)
+	}
+	if ui.mentions != mentions {
+		t.Errorf("mentions went from %d to %d in a conversation set to off", mentions, ui.mentions)
+	}
+
+	receive(ui, Message{SenderID: peer, Content: []byte("hello room"), Room: "#lan"})
+	if unread := ui.conversations[ui.findConversation("#lan")].unread; unread != 1 {
+		t.Errorf("%d unread in a room left at its default, want 1", unread)
+	}
+}
+
+// TestDND keeps quiet until do not disturb is over or turned off, still counting what arrives
+func TestDND(t *testing.T) {
+	ui, notified := notifyingUI(t)
+	path := filepath.Join(t.TempDir(), notificationsFile)
+	if err := ui.setNotificationsPath(path); err != nil {
+		t.Fatal(err)
+	}
+	peer := "127.0.0.1:2"
+	direct := Message{SenderID: peer, Content: []byte("are you there?"), Direct: true}
+
+	ui.dndCommand("1h")
+	if !ui.dndActive(time.Now()) {
+		t.Fatal("/dnd 1h didn't turn do not disturb on")
+	}
+	if notified(direct) {
+		t.Error("a DM notified during do not disturb")
+	}
+	if unread := ui.conversations[ui.findConversation(peer)].unread; unread != 1 {
+		t.Errorf("%d unread after a DM during do not disturb, want 1", unread)
+	}
+	ui.dndCommand("off")
+	if ui.dndActive(time.Now()) || !notified(direct) {
+		t.Error("/dnd off didn't bring notifications back")
+	}
+
+	ui.dndCommand("soon")
+	if ui.dndActive(time.Now()) {
+		t.Error("/dnd took an invalid duration")
+	}
+
+	// Do not disturb that ran out is turned off once the TUI notices, and saved so
+	ui.dndCommand("1h")
+	past := time.Now().Add(-time.Minute)
+	ui.notifyPrefs.DND = &past
+	if !notified(direct) {
+		t.Error("a DM didn't notify after do not disturb ran out")
+	}
+	ui.checkDND(time.Now())
+	if ui.notifyPrefs.DND != nil {
+		t.Error("do not disturb wasn't cleared once it ran out")
+	}
+	if last := ui.messages[len(ui.messages)-1]; !strings.Contains(last.Content, "Do not disturb is over") {
+		t.Errorf("last notice %q", last.Content)
+	}
+	if prefs, err := loadNotificationPrefs(path); err != nil || prefs.DND != nil {
+		t.Errorf("saved do not disturb %v, %v after it ran out", prefs.DND, err)
+	}
+}
+
+// TestNotificationPrefsSaved keeps levels and do not disturb in notifications.json for the next run
+func TestNotificationPrefsSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), notificationsFile)
+	ui, _ := notifyingUI(t)
+	if err := ui.setNotificationsPath(path); err != nil {
+		t.Fatalf("no settings saved yet: %v", err)
+	}
+	receive(ui, Message{SenderID: "127.0.0.1:2", SenderKey: "bob-key", Content: []byte("hi"), Direct: true})
+	receive(ui, Message{SenderID: "127.0.0.1:2", Content: []byte("hi"), Room: "#lan"})
+	ui.notificationsCommand("#all off")
+	ui.notificationsCommand("#lan all")
+	ui.switchConversation(ui.findConversation("127.0.0.1:2"))
+	ui.notificationsCommand("mentions-only")
+	ui.dndCommand("2h")
+
+	next, _ := newTestUI(t, 100, 30)
+	if err := next.setNotificationsPath(path); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{broadcastRoom: levelOff, "#lan": levelAll, "bob-key": levelMentions}
+	for key, level := range want {
+		if next.notifyPrefs.Levels[key] != level {
+			t.Errorf("%s loaded as %q, want %q", key, next.notifyPrefs.Levels[key], level)
+		}
+	}
+	if len(next.notifyPrefs.Levels) != len(want) {
+		t.Errorf("loaded levels %v, want %v", next.notifyPrefs.Levels, want)
+	}
+	if !next.dndActive(time.Now().Add(time.Hour)) || next.dndActive(time.Now().Add(3*time.Hour)) {
+		t.Errorf("loaded do not disturb until %v, want in two hours", next.notifyPrefs.DND)
+	}
+
+	if err := os.WriteFile(path, []byte("{levels"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadNotificationPrefs(path); err == nil {
+		t.Error("loaded a corrupt notifications.json")
+	}
+
+	// Hand edits: a short key that is neither a room nor a fingerprint is shown as it is, and
+	// entries that can't be used are dropped
+	edited := `{"levels": {"abc": "off", "": "all", "#lan": "loud"}}`
+	if err := os.WriteFile(path, []byte(edited), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := next.setNotificationsPath(path); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"abc": levelOff}; !maps.Equal(next.notifyPrefs.Levels, want) {
+		t.Errorf("loaded levels %v from a hand-edited file, want %v", next.notifyPrefs.Levels, want)
+	}
+	if description := next.describeNotifications(); !strings.Contains(description, "key abc: off") {
+		t.Errorf("described as %q", description)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifier records the notifications shown
+type fakeNotifier struct {
+	shown []string // "title: body"
+}
+
+func (fn *fakeNotifier) Notify(title, body string) error {
+	fn.shown = append(fn.shown, title+": "+body)
+	return nil
+}
+
+// TestCommandNotifier builds each platform's command with a runner that records it instead
+func TestCommandNotifier(t *testing.T) {
+	title, body := `bob "the builder"`, "it's $(done) & `shipped`"
+	for _, goos := range []string{"darwin", "windows", "linux"} {
+		var ran *exec.Cmd
+		notifier := commandNotifier{goos: goos, run: func(cmd *exec.Cmd) error {
+			ran = cmd
+			return nil
+		}}
+		if err := notifier.Notify(title, body); err != nil {
+			t.Fatalf("%s: %v", goos, err)
+		}
+
+		switch goos {
+		case "darwin":
+			want := []string{"osascript",
+				"-e", "on run argv",
+				"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+				"-e", "end run",
+				title, body}
+			if !slices.Equal(ran.Args, want) {
+				t.Errorf("darwin ran %q, want %q", ran.Args, want)
+			}
+		case "windows":
+			if ran.Args[0] != "powershell" || ran.Args[len(ran.Args)-1] != windowsToast {
+				t.Errorf("windows ran %q", ran.Args)
+			}
+			if strings.Contains(strings.Join(ran.Args, " "), "bob") {
+				t.Error("windows passed the title on the command line")
+			}
+			for _, want := range []string{"P2PCHAT_NOTIFY_TITLE=" + title, "P2PCHAT_NOTIFY_BODY=" + body} {
+				if !slices.Contains(ran.Env, want) {
+					t.Errorf("windows environment lacks %q", want)
+				}
+			}
+		default:
+			want := []string{"notify-send", "--app-name=p2pchat", "--", title, body}
+			if !slices.Equal(ran.Args, want) {
+				t.Errorf("linux ran %q, want %q", ran.Args, want)
+			}
+		}
+	}
+
+	failing := commandNotifier{goos: "linux", run: func(*exec.Cmd) error { return exec.ErrNotFound }}
+	if err := failing.Notify(title, body); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("tool that won't start gave %v", err)
+	}
+}
+
+// TestDesktopNotifications picks the messages that notify in each mode, titles each kind, holds
+// back those that come too soon after one, and hides previews when asked. Whether broadcasts
+// notify at all is up to their conversation's level (TestRoomNotificationLevel).
+func TestDesktopNotifications(t *testing.T) {
+	direct := Message{Content: []byte("are you   there?"), Direct: true}
+	mention := Message{Content: []byte("ping @me"), Mention: true}
+	broadcast := Message{Content: []byte("hello all")}
+
+	for mode, want := range map[string][]bool{
+		notifyOn:       {true, true, true},
+		notifyMentions: {false, true, false},
+		notifyOff:      {false, false, false},
+	} {
+		dn := desktopNotifications{mode: mode}
+		for i, msg := range []Message{direct, mention, broadcast} {
+			if got := dn.wants(msg); got != want[i] {
+				t.Errorf("%s: message %d wanted %v", mode, i, got)
+			}
+		}
+	}
+
+	fake := &fakeNotifier{}
+	dn := desktopNotifications{notifier: fake, mode: notifyOn}
+	now := time.Now()
+	dn.notify(now, "bob", direct)
+	dn.notify(now.Add(time.Second), "bob", mention)
+	dn.notify(now.Add(2*time.Second), "bob", mention)
+	dn.notify(now.Add(notifyInterval+time.Second), "carol", mention)
+	dn.hidePreview = true
+	dn.notify(now.Add(3*notifyInterval), "bob", direct)
+	dn.hidePreview = false
+	dn.notify(now.Add(4*notifyInterval), "dave", broadcast)
+	dn.notify(now.Add(5*notifyInterval), "dave", Message{Content: []byte("lunch?"), Room: "#lan"})
+	want := []string{
+		"bob sent you a message: are you there?",
+		"carol mentioned you (+2 more): ping @me",
+		"bob sent you a message: Open p2pchat to read it",
+		"dave wrote in #all: hello all",
+		"dave wrote in #lan: lunch?",
+	}
+	if !slices.Equal(fake.shown, want) {
+		t.Errorf("shown %q, want %q", fake.shown, want)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Exit codes for `p2pchat send`, so scripts can tell failures apart
+const (
+	exitOK              = 0
+	exitFailure         = 1 // Anything not covered below
+	exitUsage           = 2
+	exitPeerUnreachable = 3
+	exitNoPeerKey       = 4
+	exitNoAck           = 5
+	exitTransferFailed  = 6
+)
+
+// runSend implements `p2pchat send`: start a minimal node, deliver one message or file, and exit.
+// Flag errors and usage go to stderr.
+func runSend(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var peerAddr, message, filePath, listenAddr, dataDir, profile string
+	var timeout time.Duration
+
+	fs.StringVar(&peerAddr, "peer", "", "peer address to deliver to (required)")
+	fs.StringVar(&message, "message", "", "text message to send")
+	fs.StringVar(&filePath, "file", "", "file to send")
+	fs.StringVar(&listenAddr, "listen", ":0", "address to listen on")
+	fs.StringVar(&dataDir, "data-dir", defaultDataDir(), "directory holding keys and other state, shared with the chat")
+	fs.StringVar(&profile, "profile", "", "send as this -profile's identity")
+	fs.DurationVar(&timeout, "timeout", 30*time.Second, "how long to wait for the key exchange and delivery ack")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: p2pchat send --peer <addr> (--message <text> | --file <path>) [--timeout 30s]")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "\nExit codes: 0 delivered, 1 other error, 2 usage, 3 peer unreachable,")
+		fmt.Fprintln(fs.Output(), "            4 no key received, 5 no delivery ack, 6 file transfer failed")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if peerAddr == "" || (message == "") == (filePath == "") {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if profile != "" {
+		var err error
+		if dataDir, err = profileDataDir(dataDir, profile); err != nil {
+			log.Printf("Invalid -profile: %v", err)
+			return exitUsage
+		}
+	}
+
+	// Minimal node: no discovery, no stdin reader, no UI
+	node, err := NewEnhancedNode(listenAddr, true, dataDir)
+	if err != nil {
+		log.Printf("Failed to create node: %v", err)
+		return exitFailure
+	}
+	node.headless = true
+	node.uiChannel = nil
+
+	done := make(chan struct{})
+	go func() {
+		node.StartEnhanced()
+		close(done)
+	}()
+	defer func() {
+		node.shutdown()
+		<-done
+	}()
+
+	if err := node.connectToPeer(peerAddr); err != nil {
+		log.Printf("Send failed: %v", err)
+		return exitPeerUnreachable
+	}
+
+	if message != "" {
+		err = node.SendTextAndConfirm(peerAddr, message, timeout)
+	} else {
+		err = node.SendFileAndConfirm(peerAddr, filePath, timeout)
+	}
+	if err != nil {
+		log.Printf("Send failed: %v", err)
+		return sendExitCode(err)
+	}
+
+	log.Printf("Delivered to %s", peerAddr)
+	return exitOK
+}
+
+// sendExitCode maps a send error to its exit code
+func sendExitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrPeerUnreachable):
+		return exitPeerUnreachable
+	case errors.Is(err, ErrNoPeerKey):
+		return exitNoPeerKey
+	case errors.Is(err, ErrNoAck):
+		return exitNoAck
+	case errors.Is(err, ErrTransferFailed):
+		return exitTransferFailed
+	default:
+		return exitFailure
+	}
+}
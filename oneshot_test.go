@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestRunSend runs `p2pchat send` against a node on loopback TCP, as a script would: each
+// outcome has its exit code, and -profile sends with that profile's identity
+func TestRunSend(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	receiver := tn.addNode(WithTransport(tcpTransport{}))
+
+	file := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(file, []byte("one-shot file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	dataDir := t.TempDir()
+	send := []string{"-listen", "127.0.0.1:0", "-data-dir", dataDir, "-timeout", fmt.Sprint(testWait)}
+	for _, tc := range []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"no peer", []string{"-message", "hi"}, exitUsage},
+		{"nothing to send", []string{"-peer", receiver.ID}, exitUsage},
+		{"message and file", []string{"-peer", receiver.ID, "-message", "hi", "-file", file}, exitUsage},
+		{"unknown flag", []string{"-peer", receiver.ID, "-message", "hi", "-loud"}, exitUsage},
+		{"invalid profile", []string{"-peer", receiver.ID, "-message", "hi", "-profile", "../bob"}, exitUsage},
+		{"unreachable", []string{"-peer", closedAddr, "-message", "hi"}, exitPeerUnreachable},
+		{"missing file", []string{"-peer", receiver.ID, "-file", file + ".gone"}, exitFailure},
+		{"message", []string{"-peer", receiver.ID, "-message", "one-shot hello"}, exitOK},
+		{"file", []string{"-peer", receiver.ID, "-file", file}, exitOK},
+		{"profile", []string{"-peer", receiver.ID, "-message", "from alice", "-profile", "alice"}, exitOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := runSend(append(append([]string(nil), send...), tc.args...), io.Discard); got != tc.want {
+				t.Errorf("exit code %d, want %d", got, tc.want)
+			}
+		})
+	}
+
+	for _, text := range []string{"one-shot hello", "from alice"} {
+		waitFor(t, "the message to be logged", func() bool {
+			return slices.ContainsFunc(receiver.messageLog.Since(0), func(msg LoggedMessage) bool {
+				return msg.Content == text
+			})
+		})
+	}
+	waitFor(t, "the file to arrive", func() bool {
+		data, err := os.ReadFile(filepath.Join(receiver.dataDir, downloadsDirName, "notes.txt"))
+		return err == nil && string(data) == "one-shot file"
+	})
+}
+
+// TestSendExitCode gives each kind of send failure its exit code, however it was wrapped
+func TestSendExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{ErrPeerUnreachable, exitPeerUnreachable},
+		{fmt.Errorf("dialing 127.0.0.1:1: %w", ErrPeerUnreachable), exitPeerUnreachable},
+		{ErrNoPeerKey, exitNoPeerKey},
+		{ErrNoAck, exitNoAck},
+		{fmt.Errorf("%w: peer declined", ErrTransferFailed), exitTransferFailed},
+		{errors.New("disk full"), exitFailure},
+	} {
+		if got := sendExitCode(tc.err); got != tc.want {
+			t.Errorf("sendExitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import "sync"
+
+// MessageClock stamps outgoing messages with a Lamport time and a per-sender sequence number,
+// and tracks the sequence numbers seen from each peer to detect missed messages.
+//
+// Lamport times give every node the same order for concurrent conversations: messages are
+// ordered by (lamport, sender). Sequence numbers only count broadcast messages, so a direct
+// message to someone else never looks like a gap to a third peer.
+type MessageClock struct {
+	mu      sync.Mutex
+	lamport uint64
+	seq     uint64
+	lastSeq map[string]uint64 // Sender node ID -> highest sequence number received
+}
+
+// NewMessageClock creates a clock starting at zero
+func NewMessageClock() *MessageClock {
+	return &MessageClock{
+		lastSeq: make(map[string]uint64),
+	}
+}
+
+// Tick advances the clock for a message we are sending and returns its Lamport time
+func (mc *MessageClock) Tick() uint64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.lamport++
+	return mc.lamport
+}
+
+// NextSeq returns the sequence number for our next broadcast message
+func (mc *MessageClock) NextSeq() uint64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.seq++
+	return mc.seq
+}
+
+// Witness merges the Lamport time of a received message into the clock
+func (mc *MessageClock) Witness(remote uint64) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if remote > mc.lamport {
+		mc.lamport = remote
+	}
+	mc.lamport++
+}
+
+// CheckSeq records a sequence number received from sender and returns how many messages were skipped.
+// The first message from a sender, and a sequence that went backwards (the sender restarted), reset the baseline.
+func (mc *MessageClock) CheckSeq(sender string, seq uint64) uint64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	last, seen := mc.lastSeq[sender]
+	mc.lastSeq[sender] = seq
+
+	if !seen || seq <= last {
+		return 0
+	}
+	return seq - last - 1
+}
+
+// Known returns the highest sequence number seen from each sender, including our own under selfID
+func (mc *MessageClock) Known(selfID string) map[string]uint64 {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	known := make(map[string]uint64, len(mc.lastSeq)+1)
+	for sender, seq := range mc.lastSeq {
+		known[sender] = seq
+	}
+	known[selfID] = mc.seq
+	return known
+}
+
+// Advance records a backfilled message, returning false if it is not newer than what we have.
+// Backfilled messages of our own (from before a restart) move our sequence past them.
+func (mc *MessageClock) Advance(selfID, sender string, seq uint64) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if sender == selfID {
+		if seq <= mc.seq {
+			return false
+		}
+		mc.seq = seq
+		return true
+	}
+
+	if seq <= mc.lastSeq[sender] {
+		return false
+	}
+	mc.lastSeq[sender] = seq
+	return true
+}
+
+// messageBefore reports whether a message stamped (lamportA, senderA) sorts before (lamportB, senderB)
+func messageBefore(lamportA uint64, senderA string, lamportB uint64, senderB string) bool {
+	if lamportA != lamportB {
+		return lamportA < lamportB
+	}
+	return senderA < senderB
+}
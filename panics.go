@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// recoverPeerPanic is deferred around work on what a peer sent. A panic there is a bug the peer
+// can trigger at will, so instead of taking the process down it is logged with its stack, counted
+// for /stats, and the connection it came in on is closed; the rest of the node carries on.
+func (n *Node) recoverPeerPanic(connID, what string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	n.handlerPanics.Add(1)
+	log.Printf("Recovered from a panic handling %s from %s, disconnecting it: %v\n%s", what, connID, r, debug.Stack())
+	if n.peerPanicked != nil {
+		n.peerPanicked(connID)
+	}
+
+	n.peersMutex.RLock()
+	peer, exists := n.conns[connID]
+	n.peersMutex.RUnlock()
+	if exists {
+		peer.once.Do(func() {
+			close(peer.Done)
+		})
+	}
+}
+
+// handleIncomingSafely handles a message, keeping a panic it causes to its connection
+func (n *Node) handleIncomingSafely(msg Message) {
+	defer n.recoverPeerPanic(msg.FromPeerID, "a message")
+	n.handleIncomingMessage(msg)
+}
+
+// handleIncomingSafely handles a message, keeping a panic it causes to its connection
+func (en *EnhancedNode) handleIncomingSafely(msg Message) {
+	defer en.recoverPeerPanic(msg.FromPeerID, "a message")
+	en.handleIncomingMessage(msg)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// testAuthConn is a connection that passes for one authenticated with a key, so frames on it reach
+// the handlers a Noise session does without a handshake per input
+type testAuthConn struct {
+	net.Conn
+	fingerprint string
+}
+
+func (c testAuthConn) peerFingerprint() string { return c.fingerprint }
+func (c testAuthConn) sessionID() []byte       { return []byte(c.fingerprint) }
+
+var _ authenticatedConn = testAuthConn{}
+
+// FuzzHandleIncomingMessage feeds each input to the message handlers as a frame from a peer on an
+// authenticated connection: once as the frame's content, and once as the payload of a session
+// message of the given type. Whatever it sends, the node must carry on, and a handler that panics
+// must cost the peer only its own connection.
+func FuzzHandleIncomingMessage(f *testing.F) {
+	tn := newTestNetwork(f, 0)
+	node := tn.newNode()
+	f.Cleanup(func() { node.shutdownWithin(testWait) })
+
+	// The peer's key, held by the node as a key exchange would leave it
+	dir := f.TempDir()
+	testKeys(f, 1, dir)
+	peerKeys, err := NewCryptoManager(filepath.Join(dir, keysDirName))
+	if err != nil {
+		f.Fatal(err)
+	}
+	keyPEM, err := peerKeys.GetPublicKeyPEM()
+	if err != nil {
+		f.Fatal(err)
+	}
+	const peerNodeID = memoryHost + ":1"
+	if err := node.cryptoManager.AddPeerKey(peerNodeID, keyPEM); err != nil {
+		f.Fatal(err)
+	}
+	fingerprint := peerKeys.Fingerprint()
+
+	for _, seed := range []struct {
+		msgType string
+		payload string
+	}{
+		{"text", `{"text":"hello"}`},
+		{"text", `{"text":"x","parts":3,"part":7,"id":"m"}`},
+		{"ack", `{"id":"m"}`},
+		{"presence", `{"status":"away","nick":"\u001b[31mred"}`},
+		{"ping", `{"id":"p","sent":1}`},
+		{"pong", `{"id":"p","sent":-1}`},
+		{"sync", `{"since":-5}`},
+		{"backfill", `{"messages":[{}]}`},
+		{"peer_digest", `{"digest":""}`},
+		{"peer_summary", `{"versions":{"":1}}`},
+		{"peer_records", `[{"node_id":"","addrs":[]}]`},
+		{"file", `{"type":"offer","file_id":"f","file_size":-1,"total_chunks":0}`},
+		{"file", `{"type":"chunk","file_id":"f","chunk_index":-1}`},
+		{"search", `{"type":"range","id":"r","sha256":"00","size":1,"first":-1,"count":99}`},
+		{"search", `{"type":"results","id":"q","matches":[{"name":"","size":-1}]}`},
+		{"voice", `{"type":"voice","duration":-1}`},
+		{"capabilities", `{"capabilities":null}`},
+		{"read", `{"ids":[""]}`},
+		{"version", `{"version":""}`},
+		{"key_exchange", `not a key`},
+		{"", ``},
+	} {
+		f.Add(seed.msgType, []byte(seed.payload))
+	}
+	f.Add("text", []byte("KEY_EXCHANGE:"+base64.StdEncoding.EncodeToString([]byte(keyPEM[:40]))))
+	f.Add("text", []byte("GOSSIP_PEERS:"+memoryHost+":2,,"+memoryHost+":-1"))
+	f.Add("text", []byte(`{"ciphertext":"","signature":"","message_type":"text"}`))
+
+	inputs := 0
+	f.Fuzz(func(t *testing.T, msgType string, payload []byte) {
+		inputs++
+		ours, theirs := net.Pipe()
+		go io.Copy(io.Discard, theirs)
+		peer := &Peer{
+			ID:   fmt.Sprintf("%s:%d", memoryHost, 40000+inputs%20000),
+			Conn: testAuthConn{Conn: ours, fingerprint: fingerprint},
+			Send: make(chan []byte, 10),
+			Done: make(chan struct{}),
+		}
+		if err := node.addPeer(peer); err != nil {
+			t.Fatalf("registering the peer: %v", err)
+		}
+
+		session, err := json.Marshal(SessionMessage{MessageType: msgType, Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		panics := node.handlerPanics.Load()
+		for _, content := range [][]byte{payload, append([]byte(sessionPrefix), session...)} {
+			node.handleIncomingSafely(Message{SenderID: peerNodeID, FromPeerID: peer.ID, Content: content})
+		}
+
+		select {
+		case <-node.Shutdown:
+			t.Fatal("the node shut down")
+		default:
+		}
+		if node.handlerPanics.Load() != panics {
+			// Recovered; the peer must be gone, and nothing else with it
+			select {
+			case <-peer.Done:
+			default:
+				t.Fatal("a handler panicked and the peer's connection was left open")
+			}
+		}
+
+		// However it ended, the peer leaves no trace among the connections
+		theirs.Close()
+		waitFor(t, "the peer to be dropped", func() bool {
+			node.peersMutex.RLock()
+			defer node.peersMutex.RUnlock()
+			return len(node.Peers) == 0 && len(node.conns) == 0
+		})
+	})
+}
+
+// TestHandlerPanicDropsOnlyItsPeer has one peer trip a handler that panics: a drops that peer,
+// counts the panic, and goes on handling the others
+func TestHandlerPanicDropsOnlyItsPeer(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	a := tn.newNode()
+	// A handler bug the peer can trigger: here, any message over the limits
+	a.peerOversized = func(string) { panic("handler bug") }
+	tn.start(a)
+	b, c := tn.addNode(), tn.addNode()
+	tn.connect(b, a)
+	tn.connect(c, a)
+
+	oversized, err := json.Marshal(TextEnvelope{ID: "m", Text: "part", Part: 1, Parts: maxTextParts + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sendEncryptedTo(a.ID, oversized, "text"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a to drop b", func() bool {
+		_, _, err := a.resolvePeer(b.ID)
+		return err != nil
+	})
+	if got := a.handlerPanics.Load(); got != 1 {
+		t.Errorf("%d handler panics counted, want 1", got)
+	}
+
+	if err := c.SendTextAndConfirm(a.ID, "still here", testWait); err != nil {
+		t.Fatalf("a stopped handling other peers: %v", err)
+	}
+	waitForText(t, a, c.ID, "still here")
+}
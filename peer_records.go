@@ -0,0 +1,474 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	peerRecordTTL       = 30 * time.Minute // Records not re-signed for this long are dropped
+	peerRecordRefresh   = 10 * time.Minute // How often we re-sign our own record
+	peerRecordMaxSkew   = 5 * time.Minute  // Records dated further ahead than this are refused
+	antiEntropyInterval = 2 * time.Minute  // Digests are re-sent this often even if nothing changed
+	maxPeerRecords      = 256              // Most records held; records for further nodes are ignored
+	maxRecordAddresses  = 4                // Most addresses in one record
+	peerRecordBatchSize = 24               // Records per frame, well under the 64KB line limit
+)
+
+// PeerRecord is a node's signed statement of where it can be reached. Records are passed on
+// unchanged, so the key behind any address we learn can always be named, and a newer record for
+// a node replaces the older one.
+type PeerRecord struct {
+	NodeID      string   `json:"node_id"`
+	Addresses   []string `json:"addresses"`
+	Timestamp   int64    `json:"timestamp"`   // Unix seconds when signed
+	Fingerprint string   `json:"fingerprint"` // Of the key that signed the record
+	PublicKey   string   `json:"public_key"`  // PEM, so the record can be checked without a key exchange
+	Signature   string   `json:"signature"`   // Over signedData
+}
+
+// signedData is the part of a record covered by its signature
+func (record PeerRecord) signedData() []byte {
+	data, _ := json.Marshal(struct {
+		NodeID      string   `json:"node_id"`
+		Addresses   []string `json:"addresses"`
+		Timestamp   int64    `json:"timestamp"`
+		Fingerprint string   `json:"fingerprint"`
+	}{record.NodeID, record.Addresses, record.Timestamp, record.Fingerprint})
+	return data
+}
+
+// signedAt is when the record was signed
+func (record PeerRecord) signedAt() time.Time {
+	return time.Unix(record.Timestamp, 0)
+}
+
+// newPeerRecord signs a record of where we can be reached
+func newPeerRecord(cm *CryptoManager, nodeID string, addresses []string, now time.Time) (PeerRecord, error) {
+	record := PeerRecord{
+		NodeID:      nodeID,
+		Addresses:   addresses,
+		Timestamp:   now.Unix(),
+		Fingerprint: cm.Fingerprint(),
+	}
+	signature, err := cm.SignPlaintext(record.signedData())
+	if err != nil {
+		return PeerRecord{}, err
+	}
+	record.PublicKey = signature.PublicKeyPEM
+	record.Signature = signature.Signature
+	return record, nil
+}
+
+// verify checks a received record's contents, age and signature
+func (record PeerRecord) verify(now time.Time) error {
+	if _, _, err := net.SplitHostPort(record.NodeID); err != nil {
+		return fmt.Errorf("invalid node ID %q", record.NodeID)
+	}
+	if len(record.Addresses) == 0 || len(record.Addresses) > maxRecordAddresses {
+		return fmt.Errorf("%d addresses", len(record.Addresses))
+	}
+	for _, addr := range record.Addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address %q", addr)
+		}
+	}
+
+	signedAt := record.signedAt()
+	if now.Sub(signedAt) > peerRecordTTL {
+		return errors.New("expired")
+	}
+	if signedAt.Sub(now) > peerRecordMaxSkew {
+		return errors.New("dated in the future")
+	}
+
+	publicKey, err := parsePublicKeyPEM(record.PublicKey)
+	if err != nil {
+		return err
+	}
+	if keyFingerprint(publicKey) != record.Fingerprint {
+		return errors.New("fingerprint doesn't match the signing key")
+	}
+	return verifySignature(publicKey, record.signedData(), record.Signature)
+}
+
+// PeerRecordStore holds the newest record for each node, and the state of the exchange with
+// each peer, keyed by node ID
+type PeerRecordStore struct {
+	mutex      sync.Mutex
+	records    map[string]PeerRecord
+	negotiated map[string]bool   // Peers that exchange records; the rest are sent GOSSIP_PEERS
+	synced     map[string]string // Our digest when we last sent it to the peer or found it matched
+}
+
+// NewPeerRecordStore creates an empty store
+func NewPeerRecordStore() *PeerRecordStore {
+	return &PeerRecordStore{
+		records:    make(map[string]PeerRecord),
+		negotiated: make(map[string]bool),
+		synced:     make(map[string]string),
+	}
+}
+
+// Put stores a record unless we hold one at least as new, reporting whether it was stored
+func (ps *PeerRecordStore) Put(record PeerRecord) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if known, exists := ps.records[record.NodeID]; exists {
+		if record.Timestamp <= known.Timestamp {
+			return false
+		}
+	} else if len(ps.records) >= maxPeerRecords {
+		return false
+	}
+	ps.records[record.NodeID] = record
+	return true
+}
+
+// Get returns the record held for a node
+func (ps *PeerRecordStore) Get(nodeID string) (PeerRecord, bool) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	record, exists := ps.records[nodeID]
+	return record, exists
+}
+
+// Expire drops records older than peerRecordTTL, returning how many were dropped
+func (ps *PeerRecordStore) Expire(now time.Time) int {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	expired := 0
+	for nodeID, record := range ps.records {
+		if now.Sub(record.signedAt()) > peerRecordTTL {
+			delete(ps.records, nodeID)
+			expired++
+		}
+	}
+	return expired
+}
+
+// Digest hashes which records are held and how new they are, so two nodes can cheaply tell
+// whether they hold the same set
+func (ps *PeerRecordStore) Digest() string {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	nodeIDs := make([]string, 0, len(ps.records))
+	for nodeID := range ps.records {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+
+	hash := sha256.New()
+	for _, nodeID := range nodeIDs {
+		record := ps.records[nodeID]
+		fmt.Fprintf(hash, "%s %d %s\n", nodeID, record.Timestamp, record.Fingerprint)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Versions returns the timestamp of each record held
+func (ps *PeerRecordStore) Versions() map[string]int64 {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	versions := make(map[string]int64, len(ps.records))
+	for nodeID, record := range ps.records {
+		versions[nodeID] = record.Timestamp
+	}
+	return versions
+}
+
+// NewerThan returns the records we hold that are missing from versions or newer than listed there
+func (ps *PeerRecordStore) NewerThan(versions map[string]int64) []PeerRecord {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	var newer []PeerRecord
+	for nodeID, record := range ps.records {
+		if timestamp, exists := versions[nodeID]; !exists || record.Timestamp > timestamp {
+			newer = append(newer, record)
+		}
+	}
+	return newer
+}
+
+// Behind reports whether versions lists a record we are missing or hold an older version of
+func (ps *PeerRecordStore) Behind(versions map[string]int64) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for nodeID, timestamp := range versions {
+		if record, exists := ps.records[nodeID]; !exists || record.Timestamp < timestamp {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkNegotiated records that a peer exchanges records
+func (ps *PeerRecordStore) MarkNegotiated(nodeID string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.negotiated[nodeID] = true
+}
+
+// Negotiated reports whether a peer exchanges records. Until it does, it is sent GOSSIP_PEERS
+// and its own GOSSIP_PEERS lists are used.
+func (ps *PeerRecordStore) Negotiated(nodeID string) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.negotiated[nodeID]
+}
+
+// SetSynced remembers the digest a peer was last sent or found to match
+func (ps *PeerRecordStore) SetSynced(nodeID, digest string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.synced[nodeID] = digest
+}
+
+// Synced returns the digest a peer was last sent or found to match
+func (ps *PeerRecordStore) Synced(nodeID string) string {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.synced[nodeID]
+}
+
+// peerDigest is the plaintext of an encrypted "peer_digest" message. A peer holding a different
+// set answers with its summary.
+type peerDigest struct {
+	Digest string `json:"digest"`
+}
+
+// peerSummary is the plaintext of an encrypted "peer_summary" message: the timestamp of each
+// record the sender holds. The receiver sends back the records the sender lacks, and its own
+// summary if it lacks some itself, unless the summary was already such a reply.
+type peerSummary struct {
+	Versions map[string]int64 `json:"versions"`
+	Reply    bool             `json:"reply,omitempty"`
+}
+
+// peerRecordBatch is the plaintext of an encrypted "peer_records" message
+type peerRecordBatch struct {
+	Records []PeerRecord `json:"records"`
+}
+
+// refreshOwnRecord re-signs our record once it is due
+func (en *EnhancedNode) refreshOwnRecord(now time.Time) {
+	if own, exists := en.peerRecords.Get(en.ID); exists && now.Sub(own.signedAt()) < peerRecordRefresh {
+		return
+	}
+
+	record, err := newPeerRecord(en.cryptoManager, en.ID, en.recordAddresses(), now)
+	if err != nil {
+		log.Printf("Failed to sign peer record: %v", err)
+		return
+	}
+	en.peerRecords.Put(record)
+}
+
+// exchangePeerRecords keeps peers' records in step with ours. Peers that exchange records are
+// sent our digest when it changes, and every antiEntropyInterval in case a delta went missing;
+// older peers are still sent the GOSSIP_PEERS list.
+func (en *EnhancedNode) exchangePeerRecords() {
+	defer en.wg.Done()
+
+	en.refreshOwnRecord(en.wallClock.Now())
+	lastFull := en.wallClock.Now()
+
+	timer := en.wallClock.NewTimer(en.jitter(gossipInterval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case now := <-timer.Chan():
+			timer.Reset(en.jitter(gossipInterval))
+			if expired := en.peerRecords.Expire(now); expired > 0 {
+				log.Printf("Expired %d peer record(s)", expired)
+			}
+			en.refreshOwnRecord(now)
+
+			full := now.Sub(lastFull) >= antiEntropyInterval
+			if full {
+				lastFull = now
+			}
+			en.gossipPeerRecords(full)
+		case <-en.Shutdown:
+			return
+		}
+	}
+}
+
+// gossipPeerRecords sends our digest to peers that exchange records and haven't seen it, or to
+// all of them when full is set, and the GOSSIP_PEERS list to the rest
+func (en *EnhancedNode) gossipPeerRecords(full bool) {
+	digest := en.peerRecords.Digest()
+	legacy := en.peerListGossip()
+	if legacy != nil && !en.gossipChanged(legacy) && !full {
+		legacy = nil
+	}
+
+	for _, peer := range en.snapshotPeers() {
+		if nodeID := peer.nodeID(); nodeID != "" && en.peerRecords.Negotiated(nodeID) {
+			if full || en.peerRecords.Synced(nodeID) != digest {
+				en.sendPeerDigest(nodeID)
+			}
+			continue
+		}
+
+		if legacy == nil || peer.closed() {
+			continue
+		}
+		select {
+		case peer.Send <- legacy:
+		default:
+			log.Printf("Peer %s send channel full, dropping gossip", peer.ID)
+		}
+	}
+}
+
+// sendPeerDigest sends a peer the digest of our records. Sending it when a peer's key arrives
+// is also how peers find out that we exchange records.
+func (en *EnhancedNode) sendPeerDigest(nodeID string) {
+	digest := en.peerRecords.Digest()
+	data, err := json.Marshal(peerDigest{Digest: digest})
+	if err != nil {
+		log.Printf("Failed to serialize peer digest: %v", err)
+		return
+	}
+
+	if err := en.sendEncryptedTo(nodeID, data, "peer_digest"); err != nil {
+		log.Printf("Failed to send peer digest to %s: %v", nodeID, err)
+		return
+	}
+	en.peerRecords.SetSynced(nodeID, digest)
+}
+
+// sendPeerSummary sends a peer the timestamp of each record we hold
+func (en *EnhancedNode) sendPeerSummary(nodeID string, reply bool) {
+	data, err := json.Marshal(peerSummary{Versions: en.peerRecords.Versions(), Reply: reply})
+	if err != nil {
+		log.Printf("Failed to serialize peer summary: %v", err)
+		return
+	}
+
+	if err := en.sendEncryptedTo(nodeID, data, "peer_summary"); err != nil {
+		log.Printf("Failed to send peer summary to %s: %v", nodeID, err)
+	}
+}
+
+// sendPeerRecords sends records to a peer, a batch per frame
+func (en *EnhancedNode) sendPeerRecords(nodeID string, records []PeerRecord) {
+	for len(records) > 0 {
+		batch := records[:min(len(records), peerRecordBatchSize)]
+		records = records[len(batch):]
+
+		data, err := json.Marshal(peerRecordBatch{Records: batch})
+		if err != nil {
+			log.Printf("Failed to serialize peer records: %v", err)
+			return
+		}
+		if err := en.sendEncryptedTo(nodeID, data, "peer_records"); err != nil {
+			log.Printf("Failed to send peer records to %s: %v", nodeID, err)
+			return
+		}
+	}
+}
+
+// handlePeerDigest answers a peer's digest with our summary if our records differ
+func (en *EnhancedNode) handlePeerDigest(senderID string, plaintext []byte) {
+	var digest peerDigest
+	if err := json.Unmarshal(plaintext, &digest); err != nil {
+		log.Printf("Invalid peer digest from %s: %v", senderID, err)
+		return
+	}
+	en.peerRecords.MarkNegotiated(senderID)
+
+	if ours := en.peerRecords.Digest(); digest.Digest == ours {
+		en.peerRecords.SetSynced(senderID, ours)
+		return
+	}
+	en.sendPeerSummary(senderID, false)
+}
+
+// handlePeerSummary sends a peer the records it lacks, and asks for the ones we lack
+func (en *EnhancedNode) handlePeerSummary(senderID string, plaintext []byte) {
+	var summary peerSummary
+	if err := json.Unmarshal(plaintext, &summary); err != nil {
+		log.Printf("Invalid peer summary from %s: %v", senderID, err)
+		return
+	}
+	en.peerRecords.MarkNegotiated(senderID)
+
+	en.sendPeerRecords(senderID, en.peerRecords.NewerThan(summary.Versions))
+	if !summary.Reply && en.peerRecords.Behind(summary.Versions) {
+		en.sendPeerSummary(senderID, true)
+	}
+}
+
+// handlePeerRecords stores the valid records a peer sent and connects to nodes we learn of.
+// Refused records are logged with the peer that passed them on and the key that signed them.
+func (en *EnhancedNode) handlePeerRecords(senderID string, plaintext []byte) {
+	var batch peerRecordBatch
+	if err := json.Unmarshal(plaintext, &batch); err != nil {
+		log.Printf("Invalid peer records from %s: %v", senderID, err)
+		return
+	}
+	en.peerRecords.MarkNegotiated(senderID)
+
+	now := en.wallClock.Now()
+	for _, record := range batch.Records {
+		if record.NodeID == en.ID {
+			// We keep our own record
+			continue
+		}
+		if err := record.verify(now); err != nil {
+			log.Printf("Refused peer record for %q from %s: %v", record.NodeID, senderID, err)
+			continue
+		}
+		if err := en.checkRecordKey(record); err != nil {
+			log.Printf("Refused peer record from %s: %v", senderID, err)
+			en.notifyUI(Message{
+				SenderID: "System",
+				Content:  []byte(fmt.Sprintf("⚠️ %s passed on a peer record that %v", senderID, err)),
+			})
+			continue
+		}
+		if !en.peerRecords.Put(record) {
+			continue
+		}
+
+		if _, _, err := en.resolvePeer(record.NodeID); err == nil {
+			// Already connected
+			continue
+		}
+		en.handleDiscoveredPeer(record.Addresses[0], record.Addresses[1:]...)
+	}
+}
+
+// checkRecordKey refuses a record signed by a different key from the one we hold or have pinned
+// for its node
+func (en *EnhancedNode) checkRecordKey(record PeerRecord) error {
+	signer := formatFingerprint(record.Fingerprint)[:19]
+	if fingerprint, exists := en.cryptoManager.PeerFingerprint(record.NodeID); exists && fingerprint != record.Fingerprint {
+		return fmt.Errorf("claims %s with key %s, but %s uses %s", record.NodeID, signer,
+			record.NodeID, formatFingerprint(fingerprint)[:19])
+	}
+	if contact, conflict := en.contacts.Conflict(record.NodeID, record.Fingerprint); conflict {
+		return fmt.Errorf("claims %s with key %s, but contact %s is pinned to %s", record.NodeID, signer,
+			contact.Alias, formatFingerprint(contact.Fingerprint)[:19])
+	}
+	return nil
+}
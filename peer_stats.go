@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	latencyInterval = 30 * time.Second // How often connected peers are pinged
+	maxLatency      = time.Minute      // Longer round trips are stale pongs, not measurements
+)
+
+// Key states shown for a peer
+const (
+	KeyNone      = "none"      // We don't have the peer's public key yet
+	KeyExchanged = "exchanged" // We have the key but nothing signed with it has arrived
+	KeyVerified  = "verified"  // A message signed with the key we hold arrived from the peer
+)
+
+// pingMessage is the plaintext of encrypted "ping" and "pong" messages. The pong echoes the
+// ping's send time, so the round trip is measured on our own clock.
+type pingMessage struct {
+	Sent int64 `json:"sent"` // UnixNano on the pinging node
+}
+
+// peerStat is what we have measured about a peer
+type peerStat struct {
+	latency    time.Duration
+	lastActive time.Time
+}
+
+// PeerStats tracks round-trip latency and last chat activity per peer, keyed by node ID
+type PeerStats struct {
+	mutex sync.RWMutex
+	peers map[string]peerStat
+}
+
+// NewPeerStats creates an empty tracker
+func NewPeerStats() *PeerStats {
+	return &PeerStats{peers: make(map[string]peerStat)}
+}
+
+// SetLatency records a measured round trip
+func (ps *PeerStats) SetLatency(nodeID string, latency time.Duration) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	stat := ps.peers[nodeID]
+	stat.latency = latency
+	ps.peers[nodeID] = stat
+}
+
+// Touch records that the peer just sent a chat message
+func (ps *PeerStats) Touch(nodeID string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	stat := ps.peers[nodeID]
+	stat.lastActive = time.Now()
+	ps.peers[nodeID] = stat
+}
+
+// Get returns the last measured latency (zero if none) and last activity of a peer
+func (ps *PeerStats) Get(nodeID string) (time.Duration, time.Time) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	stat := ps.peers[nodeID]
+	return stat.latency, stat.lastActive
+}
+
+// keyStatus reports how far key exchange with a peer has got
+func (en *EnhancedNode) keyStatus(nodeID string) string {
+	switch {
+	case en.cryptoManager.IsVerified(nodeID):
+		return KeyVerified
+	case en.cryptoManager.HasPeerKey(nodeID):
+		return KeyExchanged
+	default:
+		return KeyNone
+	}
+}
+
+// sendPing asks a peer to echo our clock so we can measure the round trip
+func (en *EnhancedNode) sendPing(nodeID string) {
+	data, err := json.Marshal(pingMessage{Sent: time.Now().UnixNano()})
+	if err != nil {
+		log.Printf("Failed to serialize ping: %v", err)
+		return
+	}
+	if err := en.sendEncryptedTo(nodeID, data, "ping"); err != nil {
+		log.Printf("Failed to ping %s: %v", nodeID, err)
+	}
+}
+
+// handlePing echoes a ping back to its sender
+func (en *EnhancedNode) handlePing(senderID string, plaintext []byte) {
+	if err := en.sendEncryptedTo(senderID, plaintext, "pong"); err != nil {
+		log.Printf("Failed to answer ping from %s: %v", senderID, err)
+	}
+}
+
+// handlePong records the round trip of one of our pings
+func (en *EnhancedNode) handlePong(senderID string, plaintext []byte) {
+	var pong pingMessage
+	if err := json.Unmarshal(plaintext, &pong); err != nil {
+		log.Printf("Invalid pong from %s: %v", senderID, err)
+		return
+	}
+
+	latency := time.Since(time.Unix(0, pong.Sent))
+	if latency < 0 || latency > maxLatency {
+		return
+	}
+	en.peerStats.SetLatency(senderID, latency)
+}
+
+// measureLatency pings every peer whose key we hold, so the peer panel can show round-trip times
+func (en *EnhancedNode) measureLatency() {
+	defer en.wg.Done()
+
+	ticker := time.NewTicker(latencyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, peerID := range en.PeerIDs() {
+				_, nodeID, err := en.resolvePeer(peerID)
+				if err != nil || !en.cryptoManager.HasPeerKey(nodeID) {
+					continue
+				}
+				en.sendPing(nodeID)
+			}
+		case <-en.Shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	pipeKeyTimeout   = 30 * time.Second // How long to wait for initial peers before sending input
+	pipeFlushTimeout = 5 * time.Second  // How long -oneshot waits for queued messages on EOF
+	pipeLineInterval = time.Second / 10 // Least time between lines sent: the rate peers allow by default
+)
+
+// pipeMessage is one line of pipe-mode output
+type pipeMessage struct {
+	Sender    string `json:"sender"`
+	Timestamp string `json:"timestamp"`
+	Text      string `json:"text"`
+	Action    bool   `json:"action,omitempty"`     // /me action
+	ExpiresAt string `json:"expires_at,omitempty"` // Set for ephemeral messages
+	Direct    bool   `json:"direct,omitempty"`     // Sent only to us
+}
+
+// startPipe switches the node to pipe mode: every stdin line is sent as an encrypted message
+// and every message received from a peer is written to out as one JSON object per line.
+// Input is held back until the initial peers have completed the key exchange, and sent no faster
+// than pipeLineInterval so that a log fed in line by line doesn't get us muted as a spammer.
+func (en *EnhancedNode) startPipe(out io.Writer, initialPeers []string, oneshot bool) {
+	ready := make(chan struct{})
+	go func() {
+		defer close(ready)
+		for _, addr := range initialPeers {
+			if _, err := en.waitForPeerKey(addr, pipeKeyTimeout); err != nil {
+				log.Printf("Warning: %s not ready: %v", addr, err)
+			}
+		}
+	}()
+
+	en.pipeOneshot = oneshot
+	var next time.Time // When the next line may go
+	en.pipeInput = func(line string) {
+		<-ready
+		if line == "" {
+			return
+		}
+		if wait := next.Sub(en.wallClock.Now()); wait > 0 {
+			select {
+			case <-en.wallClock.After(wait):
+			case <-en.Shutdown:
+				return
+			}
+		}
+		next = en.wallClock.Now().Add(pipeLineInterval)
+		if _, err := en.SendEncryptedText(line); err != nil {
+			log.Printf("Failed to send line: %v", err)
+		}
+	}
+
+	en.wg.Add(1)
+	go en.writePipeOutput(out)
+}
+
+// writePipeOutput drains the UI channel, writing peer messages as JSON lines
+func (en *EnhancedNode) writePipeOutput(out io.Writer) {
+	defer en.wg.Done()
+
+	encoder := json.NewEncoder(out)
+	for {
+		select {
+		case msg := <-en.uiChannel:
+			// Only messages that arrived live from a peer; system notices, our own lines, history and
+			// read receipts are skipped
+			if msg.FromPeerID == "" || msg.Backfill || len(msg.ReadIDs) > 0 {
+				continue
+			}
+			line := pipeMessage{
+				Sender:    msg.SenderID,
+				Timestamp: en.wallClock.Now().Format(time.RFC3339),
+				Text:      string(msg.Content),
+				Action:    msg.Action,
+				Direct:    msg.Direct,
+			}
+			if !msg.ExpiresAt.IsZero() {
+				line.ExpiresAt = msg.ExpiresAt.Format(time.RFC3339)
+			}
+			if err := encoder.Encode(line); err != nil {
+				log.Printf("Failed to write output: %v", err)
+			}
+
+		case <-en.Shutdown:
+			return
+		}
+	}
+}
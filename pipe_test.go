@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestPipeMode sends each input line to the peers and writes only what peers send to the output,
+// one JSON object per line
+func TestPipeMode(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	b := tn.nodes[0]
+	a := tn.newNode()
+	a.uiChannel = a.uiQueue.Subscribe()
+
+	reader, writer := io.Pipe()
+	t.Cleanup(func() { reader.Close() })
+	lines := make(chan pipeMessage, 10)
+	go func() {
+		decoder := json.NewDecoder(reader)
+		for {
+			var line pipeMessage
+			if decoder.Decode(&line) != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	a.startPipe(writer, []string{b.ID}, false)
+	tn.start(a)
+	tn.connect(a, b)
+
+	a.pipeInput("")
+	a.pipeInput("/quit is just text here")
+	waitForText(t, b, a.ID, "/quit is just text here")
+	a.pipeInput("still here")
+	waitForText(t, b, a.ID, "still here")
+
+	a.notifyUI(Message{SenderID: "System", Content: []byte("a notice")})
+	if _, err := b.SendEncryptedText("build passed"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-lines:
+		if line.Sender != b.ID || line.Text != "build passed" || line.Timestamp == "" {
+			t.Errorf("wrote %+v", line)
+		}
+	case <-time.After(testWait):
+		t.Fatal("nothing written for the peer's message")
+	}
+	select {
+	case line := <-lines:
+		t.Errorf("wrote %+v as well", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-a.Shutdown:
+		t.Error("a line of input shut the node down")
+	default:
+	}
+	if texts := loggedTexts(b, a.ID); len(texts) != 2 {
+		t.Errorf("peer got %q; the empty line should send nothing", texts)
+	}
+}
+
+// TestPipePacing holds each line back until pipeLineInterval after the one before, and stamps
+// what it writes with the node's clock
+func TestPipePacing(t *testing.T) {
+	clock := newFakeClock()
+	tn := newTestNetwork(t, 1, WithClock(clock))
+	b := tn.nodes[0]
+	a := tn.newNode(WithClock(clock))
+	a.uiChannel = a.uiQueue.Subscribe()
+
+	reader, writer := io.Pipe()
+	t.Cleanup(func() { reader.Close() })
+	lines := make(chan pipeMessage, 10)
+	go func() {
+		decoder := json.NewDecoder(reader)
+		for {
+			var line pipeMessage
+			if decoder.Decode(&line) != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	a.startPipe(writer, nil, false)
+	tn.start(a)
+	tn.connect(a, b)
+	waitForKeys(t, a, b)
+
+	a.pipeInput("one")
+	sent := make(chan struct{})
+	go func() {
+		a.pipeInput("two")
+		close(sent)
+	}()
+	clock.waitForTimer(t, pipeLineInterval)
+	select {
+	case <-sent:
+		t.Fatal("the second line went straight after the first")
+	default:
+	}
+	clock.Advance(pipeLineInterval)
+	<-sent
+	waitForText(t, b, a.ID, "two")
+
+	// A line after a pause goes at once
+	clock.Advance(time.Second)
+	a.pipeInput("three")
+	waitForText(t, b, a.ID, "three")
+
+	if _, err := b.SendEncryptedText("ack"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-lines:
+		if want := clock.Now().Format(time.RFC3339); line.Timestamp != want {
+			t.Errorf("wrote %+v, want it stamped %s", line, want)
+		}
+	case <-time.After(testWait):
+		t.Fatal("nothing written for the peer's message")
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	presenceInterval     = 60 * time.Second     // How often presence is re-broadcast
+	presenceStaleAfter   = 3 * presenceInterval // Presence not refreshed for this long decays to "unknown"
+	defaultAwayAfter     = 10 * time.Minute     // TUI input idle time before switching to "away"
+	presenceMaxTextBytes = 140                  // Longest custom status text
+	presenceMaxNickBytes = 32                   // Longest nick shown for a peer
+)
+
+// Presence states
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusBusy    = "busy"
+	StatusUnknown = "unknown"
+)
+
+// Presence is the plaintext of an encrypted "presence" message
+type Presence struct {
+	Status string `json:"status"`
+	Text   string `json:"text,omitempty"`
+	Nick   string `json:"nick,omitempty"` // Sender's nick; only set on the wire and for peers
+}
+
+// String formats presence for display, e.g. "away (lunch)"
+func (p Presence) String() string {
+	if p.Text == "" {
+		return p.Status
+	}
+	return fmt.Sprintf("%s (%s)", p.Status, p.Text)
+}
+
+// peerPresence is the last presence received from a peer
+type peerPresence struct {
+	Presence
+	updated time.Time
+}
+
+// PresenceTracker holds our own presence and the latest presence of each peer, keyed by node ID
+type PresenceTracker struct {
+	mutex sync.RWMutex
+	own   Presence
+	peers map[string]peerPresence
+}
+
+// NewPresenceTracker creates a tracker with our presence set to online
+func NewPresenceTracker() *PresenceTracker {
+	return &PresenceTracker{
+		own:   Presence{Status: StatusOnline},
+		peers: make(map[string]peerPresence),
+	}
+}
+
+// parsePresence turns /status arguments into a Presence: a known state optionally followed by text,
+// or free text meaning "online" with that text
+func parsePresence(args string) (Presence, error) {
+	args = strings.TrimSpace(args)
+	if args == "" {
+		return Presence{}, fmt.Errorf("usage: /status <online|away|busy> [text] or /status <text>")
+	}
+
+	status, text, _ := strings.Cut(args, " ")
+	switch strings.ToLower(status) {
+	case StatusOnline, StatusAway, StatusBusy:
+		status = strings.ToLower(status)
+		text = strings.TrimSpace(text)
+	default:
+		status = StatusOnline
+		text = args
+	}
+
+	if len(text) > presenceMaxTextBytes {
+		return Presence{}, fmt.Errorf("status text is limited to %d bytes", presenceMaxTextBytes)
+	}
+	return Presence{Status: status, Text: text}, nil
+}
+
+// Own returns our current presence
+func (pt *PresenceTracker) Own() Presence {
+	pt.mutex.RLock()
+	defer pt.mutex.RUnlock()
+
+	return pt.own
+}
+
+// SetOwn updates our presence, reporting whether it changed
+func (pt *PresenceTracker) SetOwn(presence Presence) bool {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	if pt.own == presence {
+		return false
+	}
+	pt.own = presence
+	return true
+}
+
+// Update records a peer's presence
+func (pt *PresenceTracker) Update(nodeID string, presence Presence) {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	pt.peers[nodeID] = peerPresence{Presence: presence, updated: time.Now()}
+}
+
+// Get returns a peer's presence, or "unknown" if none was received recently
+func (pt *PresenceTracker) Get(nodeID string) Presence {
+	pt.mutex.RLock()
+	defer pt.mutex.RUnlock()
+
+	entry, exists := pt.peers[nodeID]
+	if !exists || time.Since(entry.updated) > presenceStaleAfter {
+		return Presence{Status: StatusUnknown}
+	}
+	return entry.Presence
+}
+
+// Nick returns the nick a peer last announced, even once its presence has gone stale
+func (pt *PresenceTracker) Nick(nodeID string) string {
+	pt.mutex.RLock()
+	defer pt.mutex.RUnlock()
+
+	return pt.peers[nodeID].Nick
+}
+
+// NodeForNick finds the peer that announced nick, ignoring case. A nick used by several peers
+// matches none of them.
+func (pt *PresenceTracker) NodeForNick(nick string) (string, bool) {
+	pt.mutex.RLock()
+	defer pt.mutex.RUnlock()
+
+	found := ""
+	for nodeID, entry := range pt.peers {
+		if entry.Nick == "" || !strings.EqualFold(entry.Nick, nick) {
+			continue
+		}
+		if found != "" {
+			return "", false
+		}
+		found = nodeID
+	}
+	return found, found != ""
+}
+
+// handleStatusCommand processes /status
+func (en *EnhancedNode) handleStatusCommand(args string) {
+	presence, err := parsePresence(args)
+	if err != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ %v", err)),
+		})
+		return
+	}
+
+	if !en.presence.SetOwn(presence) {
+		return
+	}
+	en.broadcastPresence()
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("Status set to %s", presence)),
+	})
+}
+
+// presenceData serializes our presence, with our nick, for sending
+func (en *EnhancedNode) presenceData() ([]byte, error) {
+	presence := en.presence.Own()
+	presence.Nick = en.mentions.Nick()
+	return json.Marshal(presence)
+}
+
+// broadcastPresence sends our presence to every peer
+func (en *EnhancedNode) broadcastPresence() {
+	data, err := en.presenceData()
+	if err != nil {
+		log.Printf("Failed to serialize presence: %v", err)
+		return
+	}
+
+	if err := en.broadcastEncrypted(data, "presence"); err != nil {
+		log.Printf("Failed to broadcast presence: %v", err)
+	}
+}
+
+// sendPresenceTo sends our presence to a peer that just became reachable
+func (en *EnhancedNode) sendPresenceTo(peerID string) {
+	data, err := en.presenceData()
+	if err != nil {
+		log.Printf("Failed to serialize presence: %v", err)
+		return
+	}
+
+	if err := en.sendEncryptedTo(peerID, data, "presence"); err != nil {
+		log.Printf("Failed to send presence to %s: %v", peerID, err)
+	}
+}
+
+// handlePresence records a peer's presence. It must come from the key we already hold for the
+// sender, so presence from peers whose key we don't know yet is ignored.
+func (en *EnhancedNode) handlePresence(senderID string, fromPeerKey bool, plaintext []byte) {
+	if !fromPeerKey {
+		log.Printf("Ignoring presence from %s: sender key not known", senderID)
+		return
+	}
+
+	var presence Presence
+	if err := json.Unmarshal(plaintext, &presence); err != nil {
+		log.Printf("Invalid presence from %s: %v", senderID, err)
+		return
+	}
+
+	switch presence.Status {
+	case StatusOnline, StatusAway, StatusBusy:
+	default:
+		log.Printf("Invalid presence status from %s: %q", senderID, presence.Status)
+		return
+	}
+	presence.Text = sanitizeLine(presence.Text)
+	if len(presence.Text) > presenceMaxTextBytes {
+		presence.Text = strings.ToValidUTF8(presence.Text[:presenceMaxTextBytes], "")
+	}
+	presence.Nick = sanitizeLine(strings.TrimSpace(presence.Nick))
+	if len(presence.Nick) > presenceMaxNickBytes {
+		presence.Nick = strings.ToValidUTF8(presence.Nick[:presenceMaxNickBytes], "")
+	}
+
+	en.presence.Update(senderID, presence)
+}
+
+// refreshPresence re-broadcasts our presence periodically so peers can tell we are still around
+func (en *EnhancedNode) refreshPresence() {
+	defer en.wg.Done()
+
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			en.broadcastPresence()
+		case <-en.Shutdown:
+			return
+		}
+	}
+}
+
+// PeerInfo returns what the UI shows about a connected peer, by connection or node ID (chatBackend)
+func (en *EnhancedNode) PeerInfo(peerID string) PeerInfo {
+	_, nodeID, err := en.resolvePeer(peerID)
+	if err != nil {
+		return PeerInfo{Presence: Presence{Status: StatusUnknown}, Key: KeyNone}
+	}
+	latency, lastActive := en.peerStats.Get(nodeID)
+	bytesIn, bytesOut := en.peerTraffic(peerID)
+	fingerprint, _ := en.cryptoManager.PeerFingerprint(nodeID)
+	return PeerInfo{
+		NodeID:      nodeID,
+		Nick:        en.presence.Nick(nodeID),
+		Presence:    en.presence.Get(nodeID),
+		Muted:       en.muteList.IsMuted(nodeID, fingerprint),
+		Key:         en.keyStatus(nodeID),
+		Latency:     latency,
+		LastActive:  lastActive,
+		BytesIn:     bytesIn,
+		BytesOut:    bytesOut,
+		Fingerprint: fingerprint,
+	}
+}
+
+// listPeersWithPresence shows connected peers and their presence, and with verbose the build each
+// runs and what it supports
+func (en *EnhancedNode) listPeersWithPresence(verbose bool) {
+	peerIDs := en.PeerIDs()
+	sort.Strings(peerIDs)
+
+	var content strings.Builder
+	if len(peerIDs) == 0 {
+		content.WriteString("No connected peers")
+	} else {
+		content.WriteString("Connected peers:")
+		for _, peerID := range peerIDs {
+			_, nodeID, err := en.resolvePeer(peerID)
+			if err != nil {
+				continue
+			}
+			muted := ""
+			if en.muteList.IsMuted(nodeID, en.peerFingerprint(nodeID)) {
+				muted = " 🔇 muted"
+			}
+			bytesIn, bytesOut := en.peerTraffic(peerID)
+			content.WriteString(fmt.Sprintf("\n  - %s [%s] ↓%s ↑%s%s", nodeID, en.presence.Get(nodeID),
+				formatBytes(int64(bytesIn)), formatBytes(int64(bytesOut)), muted))
+			if !verbose {
+				continue
+			}
+			if info, announced := en.peerVersion(peerID); announced {
+				content.WriteString("\n      Version: " + info.String())
+			} else {
+				content.WriteString("\n      Version: not announced (an older version)")
+			}
+			if capabilities, announced := en.peerCapabilities(peerID); announced {
+				content.WriteString("\n      Capabilities: " + capabilities.String())
+			}
+		}
+	}
+
+	if en.uiChannel != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(content.String()),
+		})
+	} else {
+		fmt.Println(content.String())
+	}
+}
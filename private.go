@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	invitesFile      = "invites.json"
+	inviteTTL        = 7 * 24 * time.Hour // How long an invitation can be used
+	inviteTokenBytes = 16
+)
+
+// Invite is a one-time invitation: a new peer that presents the token in its handshake is saved
+// as a contact under the alias
+type Invite struct {
+	Token   string    `json:"token"`
+	Alias   string    `json:"alias"`
+	Expires time.Time `json:"expires"`
+}
+
+// InviteBook holds the invitations not used yet, persisted in the data dir
+type InviteBook struct {
+	mutex   sync.Mutex
+	path    string
+	invites map[string]Invite // By token
+}
+
+// NewInviteBook loads the invitations from dataDir, dropping expired ones
+func NewInviteBook(dataDir string) (*InviteBook, error) {
+	ib := &InviteBook{
+		path:    filepath.Join(dataDir, invitesFile),
+		invites: make(map[string]Invite),
+	}
+
+	data, err := os.ReadFile(ib.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ib, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invitations: %w", err)
+	}
+
+	var invites []Invite
+	if err := json.Unmarshal(data, &invites); err != nil {
+		return nil, fmt.Errorf("invalid invitations %s: %w", ib.path, err)
+	}
+	now := time.Now()
+	for _, invite := range invites {
+		if now.Before(invite.Expires) {
+			ib.invites[invite.Token] = invite
+		}
+	}
+	return ib, nil
+}
+
+// Create makes a new invitation for alias
+func (ib *InviteBook) Create(alias string) (Invite, error) {
+	if !contactAlias.MatchString(alias) {
+		return Invite{}, fmt.Errorf("invalid alias %q (start with a letter; letters, digits, _ . - only)", alias)
+	}
+	token := make([]byte, inviteTokenBytes)
+	if _, err := rand.Read(token); err != nil {
+		return Invite{}, err
+	}
+
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+
+	invite := Invite{Token: hex.EncodeToString(token), Alias: alias, Expires: time.Now().Add(inviteTTL)}
+	ib.invites[invite.Token] = invite
+	return invite, ib.save()
+}
+
+// Redeem uses up an invitation, reporting whether the token was valid
+func (ib *InviteBook) Redeem(token string) (Invite, bool) {
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+
+	invite, exists := ib.invites[token]
+	if !exists {
+		return Invite{}, false
+	}
+	delete(ib.invites, token)
+	if err := ib.save(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return invite, time.Now().Before(invite.Expires)
+}
+
+// List returns the invitations not used yet, soonest to expire first
+func (ib *InviteBook) List() []Invite {
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+
+	now := time.Now()
+	invites := make([]Invite, 0, len(ib.invites))
+	for _, invite := range ib.invites {
+		if now.Before(invite.Expires) {
+			invites = append(invites, invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Expires.Before(invites[j].Expires) })
+	return invites
+}
+
+// save writes the invitations; the caller must hold the mutex
+func (ib *InviteBook) save() error {
+	invites := make([]Invite, 0, len(ib.invites))
+	for _, invite := range ib.invites {
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Expires.Before(invites[j].Expires) })
+
+	data, err := json.MarshalIndent(invites, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ib.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save invitations: %w", err)
+	}
+	return nil
+}
+
+// dialIntent is what /connect said about the peer being dialled: the key it must hold, and an
+// invitation to present in the handshake
+type dialIntent struct {
+	fingerprint string
+	invite      string
+}
+
+// connectWithIntent dials addr for /connect, holding the peer to the fingerprint given, if any.
+// Failures are shown, since the user is waiting on them.
+func (en *EnhancedNode) connectWithIntent(addr string, intent dialIntent) {
+	en.dialIntents.Store(addr, intent)
+	defer en.dialIntents.Delete(addr)
+
+	if err := en.connectToPeer(addr); err != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ %v", err)),
+		})
+	}
+}
+
+// admitConn decides whether a connection whose handshake is done may carry messages, recording
+// refusals in the audit log. A key other than the one given to /connect is critical: it may be
+// someone in the middle.
+func (en *EnhancedNode) admitConn(conn net.Conn, dialedAddr string) error {
+	err := en.checkAdmission(conn, dialedAddr)
+	if err == nil {
+		return nil
+	}
+
+	entry := AuditEntry{Event: auditConnectionRefused, Severity: auditWarning, Peer: dialedAddr, Detail: err.Error()}
+	if dialedAddr == "" {
+		entry.Peer = conn.RemoteAddr().String()
+	}
+	if nc, ok := conn.(*noiseConn); ok && nc.nodeID != "" {
+		entry.Peer = nc.nodeID
+	}
+	if ac, ok := conn.(authenticatedConn); ok {
+		entry.Fingerprint = ac.peerFingerprint()
+	}
+	if value, dialledByUser := en.dialIntents.Load(dialedAddr); dialledByUser {
+		if intent, _ := value.(dialIntent); intent.fingerprint != "" {
+			entry.Severity = auditCritical
+		}
+	}
+	en.audit(entry)
+	return err
+}
+
+// checkAdmission decides whether a connection may carry messages. Incoming connections
+// presenting a valid invitation are let in and saved as contacts. With -private everything else
+// must come from a contact's key; outgoing connections to other keys need the fingerprint given
+// to /connect, which is how the user confirms them. A key disconnected for spam is refused until
+// its cool-down ends, unless the user dials it.
+func (en *EnhancedNode) checkAdmission(conn net.Conn, dialedAddr string) error {
+	var fingerprint, nodeID, invite string
+	if ac, ok := conn.(authenticatedConn); ok {
+		fingerprint = ac.peerFingerprint()
+	}
+	if nc, ok := conn.(*noiseConn); ok {
+		nodeID, invite = nc.nodeID, nc.invite
+	}
+	if _, dialledByUser := en.dialIntents.Load(dialedAddr); fingerprint != "" && !dialledByUser {
+		if wait := en.reputation.CoolingDown(fingerprint); wait > 0 {
+			return fmt.Errorf("key %s was disconnected for spam; refused for another %s", formatFingerprint(fingerprint)[:19], wait.Round(time.Second))
+		}
+	}
+
+	if dialedAddr == "" {
+		if invite != "" && en.redeemInvite(invite, nodeID, fingerprint) {
+			return nil
+		}
+		if !en.private {
+			return nil
+		}
+		if fingerprint == "" {
+			en.strangersRefused.Add(1)
+			return errors.New("private mode: it didn't prove its key (a version without Noise)")
+		}
+		if _, trusted := en.contacts.ForKey(fingerprint); !trusted {
+			en.strangersRefused.Add(1)
+			return fmt.Errorf("private mode: key %s isn't a contact", formatFingerprint(fingerprint)[:19])
+		}
+		return nil
+	}
+
+	value, dialledByUser := en.dialIntents.Load(dialedAddr)
+	intent, _ := value.(dialIntent)
+	if intent.fingerprint != "" {
+		if fingerprint != intent.fingerprint {
+			return fmt.Errorf("%s presented key %s, not %s", dialedAddr, formatFingerprint(fingerprint), formatFingerprint(intent.fingerprint))
+		}
+		return nil
+	}
+	if !en.private {
+		return nil
+	}
+	if fingerprint == "" {
+		return errors.New("private mode: it didn't prove its key (a version without Noise)")
+	}
+	if _, trusted := en.contacts.ForKey(fingerprint); !trusted {
+		if dialledByUser {
+			return fmt.Errorf("private mode: %s has key %s, which isn't a contact; if that is who you expect, /connect %s %s",
+				dialedAddr, formatFingerprint(fingerprint), dialedAddr, fingerprint)
+		}
+		return fmt.Errorf("private mode: key %s isn't a contact", formatFingerprint(fingerprint)[:19])
+	}
+	return nil
+}
+
+// redeemInvite saves a peer that presented a valid invitation as a contact, reporting whether
+// the invitation was valid
+func (en *EnhancedNode) redeemInvite(token, nodeID, fingerprint string) bool {
+	if fingerprint == "" || nodeID == "" {
+		return false
+	}
+	invite, valid := en.invites.Redeem(token)
+	if !valid {
+		log.Printf("Refused invitation from %s: unknown, used or expired", nodeID)
+		return false
+	}
+
+	content := fmt.Sprintf("🎟️ %s accepted your invitation; saved as contact %s, pinned to key %s",
+		nodeID, invite.Alias, formatFingerprint(fingerprint))
+	if err := en.contacts.Add(invite.Alias, nodeID, fingerprint); err != nil {
+		if _, saved := en.contacts.ForKey(fingerprint); !saved {
+			log.Printf("Refused invitation from %s: %v", nodeID, err)
+			return false
+		}
+		content = fmt.Sprintf("🎟️ %s accepted your invitation (already a contact)", nodeID)
+	}
+	en.audit(AuditEntry{
+		Event: auditContactAdded, Severity: auditInfo, Peer: nodeID, Fingerprint: fingerprint,
+		Detail: fmt.Sprintf("%s used invitation %s", nodeID, invite.Alias),
+	})
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(content),
+	})
+	return true
+}
+
+// handleInviteCommand processes /invite
+func (en *EnhancedNode) handleInviteCommand(args string) {
+	alias := strings.TrimSpace(args)
+	var reply string
+	if alias == "" {
+		invites := en.invites.List()
+		if len(invites) == 0 {
+			reply = "No open invitations; create one with /invite <alias>"
+		} else {
+			var content strings.Builder
+			content.WriteString("🎟️ Open invitations:")
+			for _, invite := range invites {
+				content.WriteString(fmt.Sprintf("\n  %s (until %s)", invite.Alias, invite.Expires.Format("2006-01-02 15:04")))
+			}
+			reply = content.String()
+		}
+	} else if invite, err := en.invites.Create(alias); err != nil {
+		reply = fmt.Sprintf("❌ %v", err)
+	} else {
+		reply = fmt.Sprintf("🎟️ Invitation for %s, usable once until %s. Send them this line to enter:\n  /connect %s %s %s",
+			alias, invite.Expires.Format("2006-01-02 15:04"), en.ID, en.cryptoManager.Fingerprint(), invite.Token)
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPrivateNode starts a node on the network in -private mode
+func newPrivateNode(tn *testNetwork) *EnhancedNode {
+	node := tn.newNode()
+	node.private = true
+	tn.start(node)
+	return node
+}
+
+// TestPrivateAdmission admits a contact's key to a private node and refuses a stranger's
+func TestPrivateAdmission(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	a := newPrivateNode(tn)
+	contact, stranger := tn.addNode(), tn.addNode()
+	if err := a.contacts.Add("bob", contact.ID, contact.cryptoManager.Fingerprint()); err != nil {
+		t.Fatal(err)
+	}
+
+	stranger.connectToPeer(a.ID)
+	waitFor(t, "a to refuse the stranger", func() bool { return a.strangersRefused.Load() == 1 })
+	if _, _, err := a.resolvePeer(stranger.ID); err == nil {
+		t.Error("a connected to a stranger")
+	}
+
+	tn.connect(contact, a)
+	if refused := a.strangersRefused.Load(); refused != 1 {
+		t.Errorf("refused %d strangers, want only the one", refused)
+	}
+}
+
+// TestInvite lets a stranger into a private node once with an invitation, saving it as a contact,
+// and refuses the invitation used again or after it expired
+func TestInvite(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	a := newPrivateNode(tn)
+	b, c := tn.addNode(), tn.addNode()
+	fingerprint := a.cryptoManager.Fingerprint()
+
+	invite, err := a.invites.Create("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.handleEnhancedCLICommand(strings.Join([]string{"/connect", a.ID, fingerprint, invite.Token}, " "), b.ID)
+	waitForKeys(t, a, b)
+	waitForNotice(t, a, "accepted your invitation; saved as contact bob")
+	if contact, saved := a.contacts.Get("bob"); !saved || contact.Fingerprint != b.cryptoManager.Fingerprint() {
+		t.Errorf("saved contact %+v, want bob pinned to b's key", contact)
+	}
+	if invites := a.invites.List(); len(invites) != 0 {
+		t.Errorf("invitations %v still open after use", invites)
+	}
+
+	// c presents the same invitation
+	c.handleEnhancedCLICommand(strings.Join([]string{"/connect", a.ID, fingerprint, invite.Token}, " "), c.ID)
+	waitFor(t, "a to refuse the used invitation", func() bool { return a.strangersRefused.Load() == 1 })
+
+	expired, err := a.invites.Create("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.invites.mutex.Lock()
+	expired.Expires = time.Now().Add(-time.Minute)
+	a.invites.invites[expired.Token] = expired
+	a.invites.mutex.Unlock()
+	c.handleEnhancedCLICommand(strings.Join([]string{"/connect", a.ID, fingerprint, expired.Token}, " "), c.ID)
+	waitFor(t, "a to refuse the expired invitation", func() bool { return a.strangersRefused.Load() == 2 })
+
+	if _, _, err := a.resolvePeer(c.ID); err == nil {
+		t.Error("a connected to c")
+	}
+	if _, saved := a.contacts.Get("carol"); saved {
+		t.Error("an expired invitation saved a contact")
+	}
+}
+
+// TestConnectFingerprintMismatch refuses a peer that doesn't hold the key given to /connect, and
+// records it in the audit log as critical
+func TestConnectFingerprintMismatch(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	a, b, c := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+
+	a.handleEnhancedCLICommand("/connect "+b.ID+" "+c.cryptoManager.Fingerprint(), a.ID)
+	waitForNotice(t, a, "presented key")
+	if _, _, err := a.resolvePeer(b.ID); err == nil {
+		t.Error("a connected to the wrong key")
+	}
+
+	var refusals []AuditEntry
+	for _, entry := range a.auditLog.Recent(auditRecentLimit) {
+		if entry.Event == auditConnectionRefused {
+			refusals = append(refusals, entry)
+		}
+	}
+	if len(refusals) != 1 || refusals[0].Severity != auditCritical || refusals[0].Fingerprint != b.cryptoManager.Fingerprint() {
+		t.Errorf("audited refusals %+v, want one critical refusal of b's key", refusals)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"regexp"
+)
+
+const (
+	profilesDirName  = "profiles" // Profile data directories, inside the data directory
+	profilePortBase  = 42000      // First port profiles listen on by default
+	profilePortRange = 1000       // Ports profiles are spread over
+)
+
+// profileName is what a -profile name may look like; it becomes a directory name
+var profileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,31}$`)
+
+// profileDataDir is the data directory of a profile: its own keys, downloads, config and other
+// state, under the profiles directory of the shared data directory
+func profileDataDir(dataDir, profile string) (string, error) {
+	if !profileName.MatchString(profile) {
+		return "", fmt.Errorf("invalid profile name %q (use up to 32 letters, digits, - and _)", profile)
+	}
+	return filepath.Join(dataDir, profilesDirName, profile), nil
+}
+
+// profileListenAddr is the address a profile listens on when -listen isn't given. The port is
+// derived from the name, so each profile keeps the same port and peers can find it again.
+func profileListenAddr(profile string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(profile))
+	return fmt.Sprintf(":%d", profilePortBase+hash.Sum32()%profilePortRange)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestProfileDataDir puts each profile's data in a directory of its own under the data
+// directory, refusing names that wouldn't make a single plain directory name
+func TestProfileDataDir(t *testing.T) {
+	for _, tc := range []struct {
+		profile string
+		valid   bool
+	}{
+		{"alice", true},
+		{"Bob_2", true},
+		{"work-laptop", true},
+		{"7", true},
+		{strings.Repeat("a", 32), true},
+		{strings.Repeat("a", 33), false},
+		{"", false},
+		{"-alice", false},
+		{"_alice", false},
+		{".alice", false},
+		{"..", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"alice bob", false},
+		{"élodie", false},
+	} {
+		dir, err := profileDataDir("/data", tc.profile)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("profile %q was accepted as %s", tc.profile, dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("profile %q: %v", tc.profile, err)
+			continue
+		}
+		if want := filepath.Join("/data", profilesDirName, tc.profile); dir != want {
+			t.Errorf("profile %q has data dir %s, want %s", tc.profile, dir, want)
+		}
+	}
+}
+
+// TestProfileListenAddr gives each profile a port of its own in the profile range, the same
+// every time
+func TestProfileListenAddr(t *testing.T) {
+	ports := make(map[string]int)
+	for _, profile := range []string{"alice", "bob", "carol", "dave", "a", "b"} {
+		addr := profileListenAddr(profile)
+		if again := profileListenAddr(profile); again != addr {
+			t.Errorf("profile %s listens on %s, then %s", profile, addr, again)
+		}
+		host, portText, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatalf("profile %s: %v", profile, err)
+		}
+		port, _ := strconv.Atoi(portText)
+		if host != "" || port < profilePortBase || port >= profilePortBase+profilePortRange {
+			t.Errorf("profile %s listens on %s, outside :%d-%d", profile, addr, profilePortBase, profilePortBase+profilePortRange-1)
+		}
+		ports[profile] = port
+	}
+	// Fixed, so peers that knew a profile's address find it again after an upgrade
+	if ports["alice"] != 42479 || ports["bob"] != 42244 {
+		t.Errorf("alice and bob listen on %d and %d, want 42479 and 42244", ports["alice"], ports["bob"])
+	}
+	used := make(map[int]bool)
+	for _, port := range ports {
+		used[port] = true
+	}
+	if len(used) != len(ports) {
+		t.Errorf("profiles share ports: %v", ports)
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	quicCapability      = "quic"           // Advertised in discovery messages by nodes that accept QUIC
+	quicALPN            = "p2pchat"        // TLS application protocol of peer sessions
+	quicProbeTimeout    = 2 * time.Second  // How long to try QUIC with a peer not known to support it
+	quicStreamTimeout   = 10 * time.Second // How long a new session may take to open its control stream
+	quicKeepAlivePeriod = 15 * time.Second
+	quicMaxIdleTimeout  = 2 * defaultReadTimeout // Sessions outlive silent peers; readPeer drops those first
+
+	// Every stream starts with a byte saying what it carries
+	quicControlStream = 'c' // Frames written to the connection: chat, control, everything but transfers
+	quicFileStream    = 'f' // Frames of one file transfer, opened by its sender
+
+	quicSessionIDLabel = "p2pchat session id" // TLS exporter label of quicConn.sessionID
+)
+
+// errQUICConnClosed is returned by reads from a QUIC connection once it is closed
+var errQUICConnClosed = errors.New("quic connection closed")
+
+// WithQUIC makes a node accept QUIC sessions as well as TCP connections on its port, and dial
+// peers over QUIC unless discovery says they only speak TCP. Sessions are authenticated with a
+// certificate made from the node's identity key.
+func WithQUIC() NodeOption {
+	return func(options *nodeOptions) {
+		options.quic = true
+	}
+}
+
+// quicTransport carries peer connections over QUIC, with TCP as the fallback. Each session has a
+// control stream for frames written to the connection, plus a stream per file transfer so chunks
+// never hold up chat.
+type quicTransport struct {
+	crypto *CryptoManager
+	cert   tls.Certificate
+	tcp    tcpTransport
+
+	mutex   sync.RWMutex
+	capable map[string]bool // Node ID -> whether its discovery messages advertise QUIC
+}
+
+// newQUICTransport creates a QUIC transport authenticated with the identity key in cm
+func newQUICTransport(cm *CryptoManager) (*quicTransport, error) {
+	cert, err := identityCertificate(cm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create QUIC certificate: %w", err)
+	}
+	return &quicTransport{
+		crypto:  cm,
+		cert:    cert,
+		capable: make(map[string]bool),
+	}, nil
+}
+
+// identityCertificate creates a self-signed certificate for the identity key. Peers don't check
+// the certificate chain, only that the key in it is the one the peer identifies with.
+func identityCertificate(cm *CryptoManager) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "p2pchat " + cm.Fingerprint()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, cm.publicKey, cm.privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: cm.privateKey}, nil
+}
+
+// certFingerprint returns the identity fingerprint of the key in a peer's certificate
+func certFingerprint(rawCerts [][]byte) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("peer sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid peer certificate: %w", err)
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return "", errors.New("peer certificate is not for an RSA identity key")
+	}
+	return keyFingerprint(publicKey), nil
+}
+
+// tlsConfig returns the TLS settings for a session. When dialling a peer whose key we already
+// hold, its certificate must carry that key.
+func (qt *quicTransport) tlsConfig(expectedFingerprint string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{qt.cert},
+		NextProtos:   []string{quicALPN},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+		// Identity keys are self-signed; VerifyPeerCertificate checks the key instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			fingerprint, err := certFingerprint(rawCerts)
+			if err != nil {
+				return err
+			}
+			if expectedFingerprint != "" && fingerprint != expectedFingerprint {
+				return fmt.Errorf("peer certificate key %s does not match the key we hold (%s)",
+					formatFingerprint(fingerprint), formatFingerprint(expectedFingerprint))
+			}
+			return nil
+		},
+	}
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod: quicKeepAlivePeriod,
+		MaxIdleTimeout:  quicMaxIdleTimeout,
+	}
+}
+
+// setCapable records whether a node's discovery messages advertise QUIC
+func (qt *quicTransport) setCapable(nodeID string, capable bool) {
+	qt.mutex.Lock()
+	qt.capable[nodeID] = capable
+	qt.mutex.Unlock()
+}
+
+// Listen accepts TCP connections and QUIC sessions on the same port
+func (qt *quicTransport) Listen(addr string) (net.Listener, error) {
+	tcpListener, err := qt.tcp.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// With port 0 the TCP listener picked the port; QUIC takes the same one over UDP
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		tcpListener.Close()
+		return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+	}
+	_, port, _ := net.SplitHostPort(tcpListener.Addr().String())
+	sessions, err := quic.ListenAddr(net.JoinHostPort(host, port), qt.tlsConfig(""), quicConfig())
+	if err != nil {
+		tcpListener.Close()
+		return nil, fmt.Errorf("failed to listen for QUIC: %w", err)
+	}
+
+	listener := &quicListener{
+		tcp:    tcpListener,
+		quic:   sessions,
+		conns:  make(chan net.Conn),
+		errs:   make(chan error, 1),
+		closed: make(chan struct{}),
+	}
+	go listener.acceptTCP()
+	go listener.acceptQUIC()
+	return listener, nil
+}
+
+// Dial opens a QUIC session to addr, falling back to TCP when discovery says the peer doesn't
+// accept QUIC or the session can't be set up. Peers not heard from over discovery (addresses
+// given with -peer or /connect) get a short QUIC attempt first.
+func (qt *quicTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	qt.mutex.RLock()
+	capable, known := qt.capable[addr]
+	qt.mutex.RUnlock()
+
+	if known && !capable {
+		return qt.tcp.Dial(addr, timeout)
+	}
+	quicTimeout := timeout
+	if !known {
+		quicTimeout = min(timeout, quicProbeTimeout)
+	}
+
+	conn, err := qt.dialQUIC(addr, quicTimeout)
+	if err == nil {
+		return conn, nil
+	}
+	log.Printf("QUIC connection to %s failed, using TCP: %v", addr, err)
+	return qt.tcp.Dial(addr, timeout)
+}
+
+// dialQUIC opens a session and its control stream
+func (qt *quicTransport) dialQUIC(addr string, timeout time.Duration) (*quicConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Node IDs are listen addresses, so the key we may hold for addr is the peer's identity
+	expected, _ := qt.crypto.PeerFingerprint(addr)
+	session, err := quic.DialAddr(ctx, addr, qt.tlsConfig(expected), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	control, err := session.OpenStreamSync(ctx)
+	if err == nil {
+		_, err = control.Write([]byte{quicControlStream})
+	}
+	if err != nil {
+		session.CloseWithError(0, "")
+		return nil, fmt.Errorf("failed to open control stream: %w", err)
+	}
+	return newQUICConn(session, control)
+}
+
+// quicListener merges TCP connections and QUIC sessions into one net.Listener
+type quicListener struct {
+	tcp       net.Listener
+	quic      *quic.Listener
+	conns     chan net.Conn
+	errs      chan error // Accept errors from the TCP listener
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ql *quicListener) acceptTCP() {
+	for {
+		conn, err := ql.tcp.Accept()
+		if err != nil {
+			select {
+			case ql.errs <- err:
+			case <-ql.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		ql.deliver(conn)
+	}
+}
+
+func (ql *quicListener) acceptQUIC() {
+	for {
+		session, err := ql.quic.Accept(context.Background())
+		if err != nil {
+			select {
+			case <-ql.closed:
+			default:
+				log.Printf("QUIC accept error: %v", err)
+			}
+			return
+		}
+		go ql.acceptSession(session)
+	}
+}
+
+// acceptSession waits for a new session's control stream before handing the session out
+func (ql *quicListener) acceptSession(session *quic.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicStreamTimeout)
+	defer cancel()
+
+	control, err := session.AcceptStream(ctx)
+	if err != nil {
+		log.Printf("QUIC session from %s opened no control stream: %v", session.RemoteAddr(), err)
+		session.CloseWithError(0, "")
+		return
+	}
+	control.SetReadDeadline(time.Now().Add(quicStreamTimeout))
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(control, kind); err != nil || kind[0] != quicControlStream {
+		log.Printf("QUIC session from %s opened an unexpected first stream", session.RemoteAddr())
+		session.CloseWithError(0, "")
+		return
+	}
+	control.SetReadDeadline(time.Time{})
+
+	conn, err := newQUICConn(session, control)
+	if err != nil {
+		session.CloseWithError(0, "")
+		return
+	}
+	ql.deliver(conn)
+}
+
+func (ql *quicListener) deliver(conn net.Conn) {
+	select {
+	case ql.conns <- conn:
+	case <-ql.closed:
+		conn.Close()
+	}
+}
+
+func (ql *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ql.conns:
+		return conn, nil
+	case err := <-ql.errs:
+		return nil, err
+	case <-ql.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ql *quicListener) Close() error {
+	ql.closeOnce.Do(func() {
+		close(ql.closed)
+		ql.tcp.Close()
+		ql.quic.Close()
+	})
+	return nil
+}
+
+// Addr is the TCP address; QUIC listens on the same port
+func (ql *quicListener) Addr() net.Addr { return ql.tcp.Addr() }
+
+// quicConn presents a QUIC session as a net.Conn. Writes go to the control stream; reads return
+// whole frames from the control stream and every file stream the peer opens, so a frame never
+// waits behind another stream's data.
+type quicConn struct {
+	session     *quic.Conn
+	control     *quic.Stream
+	fingerprint string // Identity fingerprint from the peer's certificate
+	id          []byte // Exported from the TLS session, so both ends have the same
+
+	frames  chan []byte
+	pending []byte // Rest of a frame only partly returned by Read
+
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+
+	streamsMutex sync.Mutex
+	streams      map[string]*quic.Stream // Open file streams, by transfer
+
+	done      chan struct{} // Closed when the control stream ends or the connection is closed
+	doneOnce  sync.Once
+	doneError error
+}
+
+// newQUICConn starts reading the control stream and accepting file streams
+func newQUICConn(session *quic.Conn, control *quic.Stream) (*quicConn, error) {
+	fingerprint, err := certFingerprint(peerCertificates(session))
+	if err != nil {
+		return nil, err
+	}
+	tlsState := session.ConnectionState().TLS
+	id, err := tlsState.ExportKeyingMaterial(quicSessionIDLabel, nil, 32)
+	if err != nil {
+		return nil, err
+	}
+	qc := &quicConn{
+		session:     session,
+		control:     control,
+		fingerprint: fingerprint,
+		id:          id,
+		frames:      make(chan []byte),
+		streams:     make(map[string]*quic.Stream),
+		done:        make(chan struct{}),
+	}
+	go qc.readStream(control, true)
+	go qc.acceptStreams()
+	return qc, nil
+}
+
+// peerCertificates returns the raw certificates the peer presented
+func peerCertificates(session *quic.Conn) [][]byte {
+	var rawCerts [][]byte
+	for _, cert := range session.ConnectionState().TLS.PeerCertificates {
+		rawCerts = append(rawCerts, cert.Raw)
+	}
+	return rawCerts
+}
+
+// finish marks the connection done, keeping the first reason
+func (qc *quicConn) finish(err error) {
+	qc.doneOnce.Do(func() {
+		qc.doneError = err
+		close(qc.done)
+	})
+}
+
+// readStream passes each frame on a stream to Read. The control stream ending ends the connection,
+// as does a frame over maxFrameBytes on it.
+func (qc *quicConn) readStream(stream *quic.Stream, control bool) {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(nil, maxFrameBytes)
+	for scanner.Scan() {
+		// The scanner reuses its buffer, so each frame is copied out
+		line := scanner.Bytes()
+		frame := append(make([]byte, 0, len(line)+1), line...)
+		frame = append(frame, '\n')
+		select {
+		case qc.frames <- frame:
+		case <-qc.done:
+			return
+		}
+	}
+	if !control {
+		if err := scanner.Err(); err != nil {
+			stream.CancelRead(0)
+		}
+		return
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	qc.finish(err)
+}
+
+// acceptStreams reads the file streams the peer opens
+func (qc *quicConn) acceptStreams() {
+	for {
+		stream, err := qc.session.AcceptStream(qc.session.Context())
+		if err != nil {
+			qc.finish(err)
+			return
+		}
+		go func() {
+			kind := make([]byte, 1)
+			if _, err := io.ReadFull(stream, kind); err != nil || kind[0] != quicFileStream {
+				stream.CancelRead(0)
+				return
+			}
+			qc.readStream(stream, false)
+		}()
+	}
+}
+
+func (qc *quicConn) Read(p []byte) (int, error) {
+	if len(qc.pending) == 0 {
+		var timeout <-chan time.Time
+		qc.deadlineMutex.Lock()
+		deadline := qc.readDeadline
+		qc.deadlineMutex.Unlock()
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case qc.pending = <-qc.frames:
+		case <-qc.done:
+			return 0, qc.doneError
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(p, qc.pending)
+	qc.pending = qc.pending[n:]
+	return n, nil
+}
+
+func (qc *quicConn) Write(p []byte) (int, error) {
+	return qc.control.Write(p)
+}
+
+// Close ends the session and every stream on it
+func (qc *quicConn) Close() error {
+	qc.finish(errQUICConnClosed)
+	return qc.session.CloseWithError(0, "")
+}
+
+func (qc *quicConn) peerFingerprint() string { return qc.fingerprint }
+func (qc *quicConn) sessionID() []byte       { return qc.id }
+
+func (qc *quicConn) LocalAddr() net.Addr  { return qc.session.LocalAddr() }
+func (qc *quicConn) RemoteAddr() net.Addr { return qc.session.RemoteAddr() }
+
+func (qc *quicConn) SetDeadline(t time.Time) error {
+	qc.SetReadDeadline(t)
+	return qc.SetWriteDeadline(t)
+}
+
+func (qc *quicConn) SetReadDeadline(t time.Time) error {
+	qc.deadlineMutex.Lock()
+	qc.readDeadline = t
+	qc.deadlineMutex.Unlock()
+	return nil
+}
+
+func (qc *quicConn) SetWriteDeadline(t time.Time) error {
+	return qc.control.SetWriteDeadline(t)
+}
+
+// writeStream writes a frame to the file stream for key, opening it on first use. Flow control
+// applies per stream, so a slow transfer blocks only its own writes.
+func (qc *quicConn) writeStream(key string, frame []byte, timeout time.Duration) error {
+	qc.streamsMutex.Lock()
+	stream, exists := qc.streams[key]
+	if !exists {
+		var err error
+		if stream, err = qc.session.OpenStream(); err != nil {
+			qc.streamsMutex.Unlock()
+			return fmt.Errorf("failed to open stream: %w", err)
+		}
+		qc.streams[key] = stream
+		frame = append([]byte{quicFileStream}, frame...)
+	}
+	qc.streamsMutex.Unlock()
+
+	if timeout > 0 {
+		stream.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := stream.Write(frame)
+	return err
+}
+
+// closeStream finishes the file stream for key once everything written to it is sent
+func (qc *quicConn) closeStream(key string) {
+	qc.streamsMutex.Lock()
+	stream, exists := qc.streams[key]
+	delete(qc.streams, key)
+	qc.streamsMutex.Unlock()
+	if exists {
+		stream.Close()
+	}
+}
+
+// peerQUICConn returns the QUIC session a peer is connected over, if it is
+func peerQUICConn(peer *Peer) (*quicConn, bool) {
+	conn := peer.Conn
+	if counted, ok := conn.(*countingConn); ok {
+		conn = counted.Conn
+	}
+	qc, ok := conn.(*quicConn)
+	return qc, ok
+}
+
+// streamFrameTo writes a frame to a peer on the stream for key when the peer is connected over
+// QUIC, counting it like any other traffic. It reports false, having sent nothing, otherwise.
+func (n *Node) streamFrameTo(connID, key string, frame []byte) (bool, error) {
+	n.peersMutex.RLock()
+	peer, exists := n.conns[connID]
+	n.peersMutex.RUnlock()
+	if !exists {
+		return false, nil
+	}
+	qc, ok := peerQUICConn(peer)
+	if !ok {
+		return false, nil
+	}
+
+	if err := qc.writeStream(key, frame, n.writeTimeout); err != nil {
+		return true, err
+	}
+	peer.traffic.out.Add(uint64(len(frame)))
+	n.traffic.total.out.Add(uint64(len(frame)))
+	return true, nil
+}
+
+// closeStreamTo finishes the stream for key to a peer, if one was opened
+func (n *Node) closeStreamTo(connID, key string) {
+	n.peersMutex.RLock()
+	peer, exists := n.conns[connID]
+	n.peersMutex.RUnlock()
+	if !exists {
+		return
+	}
+	if qc, ok := peerQUICConn(peer); ok {
+		qc.closeStream(key)
+	}
+}
+
+// discoveryCapabilities returns the suffix advertising what this node accepts, for discovery messages
+func (n *Node) discoveryCapabilities() string {
+	if n.quic == nil {
+		return ""
+	}
+	return string(delimiter) + quicCapability
+}
+
+// noteCapabilities records what a discovered node advertises
+func (n *Node) noteCapabilities(nodeID string, capabilities []string) {
+	if n.quic == nil {
+		return
+	}
+	capable := false
+	for _, capability := range capabilities {
+		if strings.TrimSpace(capability) == quicCapability {
+			capable = true
+		}
+	}
+	n.quic.setCapable(nodeID, capable)
+}
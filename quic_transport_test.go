@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// overQUIC reports whether node's connection to nodeID is a QUIC session
+func overQUIC(node *EnhancedNode, nodeID string) bool {
+	i := slices.IndexFunc(node.snapshotPeers(), func(peer *Peer) bool { return peer.nodeID() == nodeID })
+	if i < 0 {
+		return false
+	}
+	_, ok := peerQUICConn(node.snapshotPeers()[i])
+	return ok
+}
+
+// TestQUICSession connects two QUIC nodes over loopback: they use a session, not TCP, and chat
+// over it both ways
+func TestQUICSession(t *testing.T) {
+	_, a, b := connectedPair(t, WithQUIC())
+
+	if !overQUIC(a, b.ID) || !overQUIC(b, a.ID) {
+		t.Fatal("the nodes connected without QUIC")
+	}
+	a.sendChatText("over quic", "")
+	waitForText(t, b, a.ID, "over quic")
+	b.sendChatText("and back", "")
+	waitForText(t, a, b.ID, "and back")
+}
+
+// TestQUICFallsBackToTCP connects QUIC nodes to and from a node with TCP only, and dials TCP
+// straight away once discovery says a peer doesn't accept QUIC
+func TestQUICFallsBackToTCP(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	quicNode := tn.addNode(WithQUIC())
+	tcpNode := tn.addNode(WithTransport(tcpTransport{}))
+	other := tn.addNode(WithQUIC())
+
+	tn.connect(quicNode, tcpNode)
+	if overQUIC(quicNode, tcpNode.ID) {
+		t.Error("a session to a node without QUIC")
+	}
+	quicNode.sendChatText("over tcp", "")
+	waitForText(t, tcpNode, quicNode.ID, "over tcp")
+
+	tn.connect(tcpNode, other)
+	if overQUIC(other, tcpNode.ID) {
+		t.Error("a TCP connection from a node without QUIC was taken for a session")
+	}
+
+	// Known not to accept QUIC: no probe first, even when it would succeed
+	other.noteCapabilities(quicNode.ID, []string{"relay"})
+	start := time.Now()
+	conn, err := other.quic.Dial(quicNode.ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*quicConn); ok {
+		t.Error("dialled QUIC to a node whose discovery messages don't advertise it")
+	}
+	if elapsed := time.Since(start); elapsed > quicProbeTimeout/2 {
+		t.Errorf("dialling TCP took %v", elapsed)
+	}
+}
+
+// TestQUICChecksFingerprint refuses a session whose certificate isn't for the key we expect
+func TestQUICChecksFingerprint(t *testing.T) {
+	tn := newTestNetwork(t, 2, WithQUIC())
+	a, b := tn.nodes[0], tn.nodes[1]
+
+	ctx, cancel := context.WithTimeout(context.Background(), testWait)
+	defer cancel()
+	if _, err := quic.DialAddr(ctx, b.ID, a.quic.tlsConfig(a.cryptoManager.Fingerprint()), quicConfig()); err == nil {
+		t.Error("a session opened to a node with a different key")
+	}
+	session, err := quic.DialAddr(ctx, b.ID, a.quic.tlsConfig(b.cryptoManager.Fingerprint()), quicConfig())
+	if err != nil {
+		t.Fatalf("no session with the right key: %v", err)
+	}
+	session.CloseWithError(0, "")
+}
+
+// TestQUICStreamPerKey gives each transfer its own stream beside the control stream, with
+// frames on all of them reaching the other end, and closes each stream when its transfer ends
+func TestQUICStreamPerKey(t *testing.T) {
+	tn := newTestNetwork(t, 2, WithQUIC())
+	a, b := tn.nodes[0], tn.nodes[1]
+
+	listener, err := b.quic.Listen(memoryHost + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	dialled, err := a.quic.dialQUIC(listener.Addr().String(), testWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialled.Close()
+	server := <-accepted
+	defer server.Close()
+	if server.(*quicConn).peerFingerprint() != a.cryptoManager.Fingerprint() {
+		t.Error("the session isn't authenticated with the dialler's key")
+	}
+
+	for _, key := range []string{"file1", "file2", "file1"} {
+		if err := dialled.writeStream(key, []byte(key+"\n"), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dialled.Write([]byte("chat\n")); err != nil {
+		t.Fatal(err)
+	}
+	dialled.streamsMutex.Lock()
+	open := len(dialled.streams)
+	dialled.streamsMutex.Unlock()
+	if open != 2 {
+		t.Errorf("%d streams open for two transfers", open)
+	}
+
+	frames := make(map[string]int)
+	server.SetReadDeadline(time.Now().Add(testWait))
+	buf := make([]byte, 64)
+	for read := ""; len(frames) < 3 || frames["file1"] < 2; {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("read %v: %v", frames, err)
+		}
+		for read += string(buf[:n]); bytes.IndexByte([]byte(read), '\n') >= 0; {
+			frame, rest, _ := bytes.Cut([]byte(read), []byte("\n"))
+			frames[string(frame)]++
+			read = string(rest)
+		}
+	}
+
+	dialled.closeStream("file1")
+	dialled.closeStream("file2")
+	if len(dialled.streams) != 0 {
+		t.Errorf("%d streams left open after the transfers", len(dialled.streams))
+	}
+}
+
+// TestQUICFileTransfer sends a file over a session while chatting: the message overtakes the
+// transfer rather than queueing behind its chunks, and the file still arrives whole
+func TestQUICFileTransfer(t *testing.T) {
+	_, a, b := connectedPair(t, WithQUIC())
+
+	content := bytes.Repeat([]byte("quic file chunk "), 128<<10) // 2 MiB
+	path := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.fileManager.SendFile(b.ID, path); err != nil {
+		t.Fatal(err)
+	}
+	a.sendChatText("during the transfer", "")
+	waitForText(t, b, a.ID, "during the transfer")
+
+	received := filepath.Join(b.dataDir, downloadsDirName, "big.bin")
+	if data, err := os.ReadFile(received); err == nil && bytes.Equal(data, content) {
+		t.Error("the message waited for the whole file")
+	}
+	waitFor(t, "the file to arrive", func() bool {
+		data, err := os.ReadFile(received)
+		return err == nil && bytes.Equal(data, content)
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	readReceiptDelay = 2 * time.Second // Reads are gathered this long so one frame acknowledges them all
+	maxReceiptIDs    = 256             // Most message IDs in one "read" frame; more are sent in several
+	maxReceiptIDLen  = 64              // Longest message ID kept from a receipt
+)
+
+// ReadReceipt is the plaintext of an encrypted "read" message: direct messages the peer has seen
+type ReadReceipt struct {
+	IDs []string `json:"ids"`
+}
+
+// apiReadRequest is the body of POST /read
+type apiReadRequest struct {
+	Peer string   `json:"peer"`
+	IDs  []string `json:"ids"`
+}
+
+// ReadReceipts gathers the direct messages the user has read, per peer, and sends them as one
+// "read" frame each once reads stop coming in. Sending receipts and showing the ones peers send
+// are separate settings, both off by default.
+type ReadReceipts struct {
+	mutex   sync.Mutex
+	clock   Clock
+	pending map[string][]string // Node ID -> message IDs read since the last flush
+	timer   Timer
+	send    atomic.Bool // Tell peers when we read their direct messages
+	show    atomic.Bool // Mark our direct messages seen when peers say so
+}
+
+// NewReadReceipts creates a receipt queue with both directions off, gathering reads on clock
+func NewReadReceipts(clock Clock) *ReadReceipts {
+	return &ReadReceipts{clock: clock, pending: make(map[string][]string)}
+}
+
+// Configure sets whether receipts are sent and whether received ones are shown
+func (rr *ReadReceipts) Configure(send, show bool) {
+	rr.send.Store(send)
+	rr.show.Store(show)
+}
+
+// add queues message IDs read from a peer, scheduling flush unless it already is
+func (rr *ReadReceipts) add(peer string, ids []string, flush func()) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	rr.pending[peer] = append(rr.pending[peer], ids...)
+	if rr.timer == nil {
+		rr.timer = rr.clock.AfterFunc(readReceiptDelay, flush)
+	}
+}
+
+// take returns and clears everything queued
+func (rr *ReadReceipts) take() map[string][]string {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	pending := rr.pending
+	rr.pending = make(map[string][]string)
+	rr.timer = nil
+	return pending
+}
+
+// MarkRead reports that the user has seen a peer's direct messages, to send a read receipt for them
+// if receipts are on (chatBackend). Receipts for the reads of the next few seconds go together.
+func (en *EnhancedNode) MarkRead(peerID string, ids []string) error {
+	if !en.receipts.send.Load() || len(ids) == 0 {
+		return nil
+	}
+	en.receipts.add(peerID, ids, en.flushReadReceipts)
+	return nil
+}
+
+// flushReadReceipts sends each peer one frame acknowledging the messages read since the last
+// flush. Peers that left in the meantime, or whose version doesn't know receipts, are skipped.
+func (en *EnhancedNode) flushReadReceipts() {
+	for peer, ids := range en.receipts.take() {
+		if en.lacksCapability(peer, capabilityReadReceipts) {
+			continue
+		}
+		for len(ids) > 0 {
+			batch := ids[:min(len(ids), maxReceiptIDs)]
+			ids = ids[len(batch):]
+
+			data, err := json.Marshal(ReadReceipt{IDs: batch})
+			if err != nil {
+				log.Printf("Failed to serialize read receipt: %v", err)
+				return
+			}
+			if err := en.sendEncryptedTo(peer, data, "read"); err != nil {
+				log.Printf("Failed to send read receipt to %s: %v", peer, err)
+				break
+			}
+		}
+	}
+}
+
+// handleReadReceipt passes the messages a peer says it has read to the UI, which marks our direct
+// messages to that peer among them as seen. Receipts are dropped unless showing them is on.
+func (en *EnhancedNode) handleReadReceipt(msg Message, fromPeerKey bool, plaintext []byte) {
+	if !fromPeerKey {
+		log.Printf("Ignoring read receipt from %s: sender key not known", msg.SenderID)
+		return
+	}
+	if !en.receipts.show.Load() {
+		return
+	}
+	var receipt ReadReceipt
+	if err := json.Unmarshal(plaintext, &receipt); err != nil {
+		log.Printf("Invalid read receipt from %s: %v", msg.SenderID, err)
+		return
+	}
+	if len(receipt.IDs) > maxReceiptIDs {
+		en.oversizedFrom(msg.FromPeerID, fmt.Errorf("read receipt for %d messages, over the limit of %d", len(receipt.IDs), maxReceiptIDs))
+		return
+	}
+
+	ids := make([]string, 0, len(receipt.IDs))
+	for _, id := range receipt.IDs {
+		if id != "" && len(id) <= maxReceiptIDLen {
+			ids = append(ids, sanitizeLine(id))
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	en.notifyUI(Message{
+		SenderID:   msg.SenderID,
+		FromPeerID: msg.FromPeerID,
+		Timestamp:  en.wallClock.Now(),
+		Direct:     true,
+		ReadIDs:    ids,
+	})
+}
+
+// handleRead serves POST /read, which an attached TUI uses to report direct messages it showed
+func (api *APIServer) handleRead(w http.ResponseWriter, r *http.Request) {
+	var req apiReadRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Peer) == "" || len(req.IDs) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "peer and ids are required")
+		return
+	}
+
+	if err := api.node.MarkRead(req.Peer, req.IDs); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAPIJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+}
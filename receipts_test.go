@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// receiptsShown lists the read receipts node has passed to its UI from sender, one string of IDs each
+func receiptsShown(node *EnhancedNode, sender string) []string {
+	var receipts []string
+	for _, msg := range node.messageLog.Since(0) {
+		if msg.SenderID == sender && len(msg.Read) > 0 {
+			receipts = append(receipts, strings.Join(msg.Read, " "))
+		}
+	}
+	return receipts
+}
+
+// waitForReceipts waits until node has shown want, and only want, as sender's receipts
+func waitForReceipts(t *testing.T, node *EnhancedNode, sender string, want ...string) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%s to show receipts %q", node.ID, want), func() bool {
+		return len(receiptsShown(node, sender)) >= len(want)
+	})
+	if got := receiptsShown(node, sender); !slices.Equal(got, want) {
+		t.Fatalf("%s showed receipts %q, want %q", node.ID, got, want)
+	}
+}
+
+// TestReadReceiptSettings starts with both settings off, then sends receipts only where b sends
+// them and a shows them
+func TestReadReceiptSettings(t *testing.T) {
+	clock := newFakeClock()
+	_, a, b := connectedPair(t, WithClock(clock))
+	waitForKeys(t, a, b)
+	if b.receipts.send.Load() || a.receipts.show.Load() {
+		t.Fatal("read receipts are on by default")
+	}
+	if err := b.MarkRead(a.ID, []string{"m1"}); err != nil {
+		t.Fatal(err)
+	}
+	if pending := b.receipts.take(); len(pending) != 0 {
+		t.Errorf("queued %v with sending off", pending)
+	}
+
+	// A receipt a doesn't show is dropped; with showing on it reaches the UI
+	a.handleReadReceipt(Message{SenderID: b.ID, FromPeerID: b.ID}, true, []byte(`{"ids":["m2"]}`))
+	if shown := receiptsShown(a, b.ID); len(shown) != 0 {
+		t.Errorf("showed %q with showing off", shown)
+	}
+	a.receipts.Configure(false, true)
+	b.receipts.Configure(true, false)
+	b.MarkRead(a.ID, []string{"m3"})
+	clock.Advance(readReceiptDelay)
+	waitForReceipts(t, a, b.ID, "m3")
+
+	// Shown but no longer sent
+	b.receipts.Configure(false, false)
+	b.MarkRead(a.ID, []string{"m4"})
+	if pending := b.receipts.take(); len(pending) != 0 {
+		t.Errorf("queued %v after sending was turned off", pending)
+	}
+}
+
+// TestReadReceiptsCoalesce sends the reads of readReceiptDelay in one frame, and splits a frame
+// with more than maxReceiptIDs
+func TestReadReceiptsCoalesce(t *testing.T) {
+	clock := newFakeClock()
+	_, a, b := connectedPair(t, WithClock(clock))
+	waitForKeys(t, a, b)
+	a.receipts.Configure(false, true)
+	b.receipts.Configure(true, false)
+
+	b.MarkRead(a.ID, []string{"m1"})
+	clock.Advance(readReceiptDelay / 2)
+	b.receipts.mutex.Lock()
+	pending := b.receipts.pending[a.ID]
+	b.receipts.mutex.Unlock()
+	if !slices.Equal(pending, []string{"m1"}) {
+		t.Fatalf("pending %q before the delay was up, want m1", pending)
+	}
+	b.MarkRead(a.ID, []string{"m2", "m3"})
+	clock.Advance(readReceiptDelay / 2)
+	waitForReceipts(t, a, b.ID, "m1 m2 m3")
+
+	var ids []string
+	for i := range maxReceiptIDs + 10 {
+		ids = append(ids, fmt.Sprintf("n%d", i))
+	}
+	b.MarkRead(a.ID, ids)
+	clock.Advance(readReceiptDelay)
+	waitForReceipts(t, a, b.ID, "m1 m2 m3", strings.Join(ids[:maxReceiptIDs], " "), strings.Join(ids[maxReceiptIDs:], " "))
+}
+
+// TestReadReceiptsInTUI reports a direct message read once its tab is shown in a focused
+// terminal, never a broadcast or room message, and shows when a peer has seen ours
+func TestReadReceiptsInTUI(t *testing.T) {
+	ui, backend := newTestUI(t, 100, 30)
+	peer := memoryHost + ":2"
+	reads := func() []string {
+		backend.mutex.Lock()
+		defer backend.mutex.Unlock()
+		return append([]string(nil), backend.read...)
+	}
+
+	receive(ui, Message{SenderID: peer, Content: []byte("hello all"), ID: "b1"})
+	receive(ui, Message{SenderID: peer, Content: []byte("hello room"), ID: "r1", Room: "#lan"})
+	ui.switchConversation(ui.findConversation("#lan"))
+	ui.switchConversation(0)
+	if got := reads(); len(got) != 0 {
+		t.Errorf("broadcast and room messages reported read: %q", got)
+	}
+
+	receive(ui, Message{SenderID: peer, Content: []byte("psst"), ID: "d1", Direct: true})
+	if got := reads(); len(got) != 0 {
+		t.Errorf("a direct message in a tab not shown reported read: %q", got)
+	}
+	ui.Update(tea.BlurMsg{})
+	ui.switchConversation(ui.findConversation(peer))
+	receive(ui, Message{SenderID: peer, Content: []byte("still there?"), ID: "d2", Direct: true})
+	if got := reads(); len(got) != 0 {
+		t.Errorf("direct messages reported read in a terminal in the background: %q", got)
+	}
+	ui.Update(tea.FocusMsg{})
+	receive(ui, Message{SenderID: peer, Content: []byte("ah, there"), ID: "d3", Direct: true})
+	if got, want := reads(), []string{peer + ": d1 d2", peer + ": d3"}; !slices.Equal(got, want) {
+		t.Errorf("reported read %q, want %q", got, want)
+	}
+
+	receive(ui, Message{SenderID: backend.id, To: peer, Content: []byte("yes"), ID: "o1", Direct: true})
+	seen := time.Date(2026, 10, 16, 14, 32, 0, 0, time.Local)
+	receive(ui, Message{SenderID: peer, Direct: true, ReadIDs: []string{"o1", "d3"}, Timestamp: seen})
+	if view := ui.View(); strings.Count(view, "seen 14:32") != 1 {
+		t.Errorf("want our message, and only ours, marked seen 14:32:\n%s", view)
+	}
+}
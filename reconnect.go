@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+)
+
+// duplicateGrace is how long after a connection is registered a second one authenticated with the
+// same key is taken for the two nodes dialling each other at once, rather than the peer having
+// moved to another address
+const duplicateGrace = 10 * time.Second
+
+// connKey returns the identity key a peer's connection authenticated in its handshake. Legacy
+// connections carry none, so they are never taken for one another when they connect.
+func connKey(peer *Peer) (string, bool) {
+	ac, ok := peerAuthenticatedConn(peer)
+	if !ok || ac.peerFingerprint() == "" {
+		return "", false
+	}
+	return ac.peerFingerprint(), true
+}
+
+// sameNodeAs returns the registered connection with the same key as peer, if any; the caller must
+// hold peersMutex
+func (n *Node) sameNodeAs(peer *Peer) *Peer {
+	if peer.key == peer.ID {
+		return nil
+	}
+	return n.Peers[peer.key]
+}
+
+// keepNewer decides which of two connections to the same node stays. One that has been up a while
+// is the peer's old address, such as a laptop that went from Wi-Fi to Ethernet, and gives way. Two
+// that came up together are duplicates, and both ends must keep the same one rather than each
+// close a different one, whatever order they registered them in. When the nodes dialled each
+// other at once, that is the one dialled by the node with the lower key. When one node dialled
+// twice, as when it heard of the other from two peers, it is the one with the lower session ID,
+// which both ends share.
+func (n *Node) keepNewer(old, peer *Peer, now time.Time) bool {
+	if now.Sub(old.connectedAt) >= duplicateGrace {
+		return true
+	}
+	if old.outbound != peer.outbound && n.cryptoManager != nil {
+		weDial := n.cryptoManager.Fingerprint() < peer.key
+		return peer.outbound == weDial
+	}
+	oldConn, _ := peerAuthenticatedConn(old)
+	newConn, _ := peerAuthenticatedConn(peer)
+	return oldConn != nil && newConn != nil && bytes.Compare(newConn.sessionID(), oldConn.sessionID()) < 0
+}
+
+// replacePeer swaps a connection for the one that superseded it; the caller must hold peersMutex.
+// The old one is forgotten at once, so nothing more is sent on it, and closed; its writer hands
+// the frames still queued to the new one, and frames still arriving on it count as the new one's.
+// The node ID it went by carries over, so direct messages to the node reach it before it has sent
+// anything on the new connection.
+func (n *Node) replacePeer(old, peer *Peer) {
+	delete(n.Peers, old.key)
+	delete(n.conns, old.ID)
+	if peer.nodeID() == "" && old.nodeID() != "" {
+		peer.setNodeID(old.nodeID())
+	}
+	old.successor.Store(peer)
+	for id, next := range n.replaced {
+		if next == old {
+			n.replaced[id] = peer
+		}
+	}
+	n.replaced[old.ID] = peer
+	old.once.Do(func() {
+		close(old.Done)
+	})
+}
+
+// currentConn returns the connection now standing for connID: connID itself, or the connection
+// that replaced it. Frames the peer wrote on the old connection before it knew, and frames already
+// read from it, are still handled, as if from the new one, which authenticated the same key.
+func (n *Node) currentConn(connID string) string {
+	n.peersMutex.RLock()
+	defer n.peersMutex.RUnlock()
+	if next, ok := n.replaced[connID]; ok {
+		return next.ID
+	}
+	return connID
+}
+
+// handOver moves the frames still queued for a replaced connection, and frames already taken off
+// its queue, to the connection that replaced it. It waits for room rather than drop any.
+func (n *Node) handOver(peer *Peer, frames ...[]byte) {
+	next := peer.successor.Load()
+	if next == nil {
+		return
+	}
+	// The writer is the only reader of Send, so this never blocks
+	for len(peer.Send) > 0 {
+		frames = append(frames, <-peer.Send)
+	}
+	for i, frame := range frames {
+		select {
+		case next.Send <- frame:
+		case <-next.Done:
+			log.Printf("Connection %s closed too, %d queued frame(s) for %s dropped", next.ID, len(frames)-i, peer.ID)
+			return
+		case <-n.Shutdown:
+			return
+		}
+	}
+	if len(frames) > 0 {
+		log.Printf("Moved %d queued frame(s) from %s to %s", len(frames), peer.ID, next.ID)
+	}
+}
+
+// peerMovedNotice tells the UI a node's connection was replaced by a newer one
+func (n *Node) peerMovedNotice(old, peer *Peer) {
+	n.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("🔀 Peer %s reconnected as %s; the old connection is closed", old.ID, peer.ID)),
+	})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// forward listens on the network at addr (a new one for port 0) and relays each connection to
+// target, so a node can be reached at a second address as if it had moved
+func forward(t *testing.T, network *MemoryNetwork, addr, target string) string {
+	t.Helper()
+	listener, err := network.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := network.Dial(target, time.Second)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			relay := func(dst, src net.Conn) {
+				io.Copy(dst, src)
+				dst.Close()
+				src.Close()
+			}
+			go relay(conn, upstream)
+			go relay(upstream, conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// countOf returns how many times node has shown text from sender
+func countOf(node *EnhancedNode, sender, text string) int {
+	count := 0
+	for _, logged := range loggedTexts(node, sender) {
+		if logged == text {
+			count++
+		}
+	}
+	return count
+}
+
+// TestPeerMovesAddress has b reconnect to a at another address while the first connection is
+// still up, as a laptop switching from Wi-Fi to Ethernet does: both keep only the new one, and
+// every message arrives once
+func TestPeerMovesAddress(t *testing.T) {
+	clock := newFakeClock()
+	tn := newTestNetwork(t, 2, WithClock(clock))
+	a, b := tn.nodes[0], tn.nodes[1]
+	tn.connect(b, a)
+
+	if _, err := a.SendEncryptedText("before the move"); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, a.ID, "before the move")
+
+	first := a.snapshotPeers()[0].ID
+	clock.Advance(duplicateGrace)
+	moved := forward(t, tn.network, memoryHost+":0", a.ID)
+	if err := b.connectToPeer(moved); err != nil {
+		t.Fatal(err)
+	}
+	// Whichever end replaces its connection first closes the old one, which the other may see
+	// go before the new one is up, so only the outcome is the same on both
+	waitFor(t, "b to keep only the new connection", func() bool {
+		peers := b.snapshotPeers()
+		return len(peers) == 1 && peers[0].ID == moved && peers[0].nodeID() == a.ID
+	})
+	waitFor(t, "a to keep only the new connection", func() bool {
+		peers := a.snapshotPeers()
+		return len(peers) == 1 && peers[0].nodeID() == b.ID && peers[0].ID != first
+	})
+
+	if err := b.SendTextAndConfirm(a.ID, "to a, after the move", testWait); err != nil {
+		t.Fatalf("direct message after the move: %v", err)
+	}
+	if _, err := a.SendEncryptedText("after the move"); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, a.ID, "after the move")
+	if _, err := a.SendEncryptedText("last"); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, a.ID, "last")
+
+	for _, text := range []string{"before the move", "after the move", "last"} {
+		if count := countOf(b, a.ID, text); count != 1 {
+			t.Errorf("b showed %q %d times", text, count)
+		}
+	}
+	if count := countOf(a, b.ID, "to a, after the move"); count != 1 {
+		t.Errorf("a showed the direct message %d times", count)
+	}
+}
+
+// TestSimultaneousDial has two nodes dial each other at once: both ends settle on the same single
+// connection rather than each closing a different one
+func TestSimultaneousDial(t *testing.T) {
+	tn := newTestNetwork(t, 2, WithClock(newFakeClock()))
+	a, b := tn.nodes[0], tn.nodes[1]
+
+	done := make(chan error, 2)
+	go func() { done <- a.connectToPeer(b.ID) }()
+	go func() { done <- b.connectToPeer(a.ID) }()
+	<-done
+	<-done
+	waitForKeys(t, a, b)
+	waitFor(t, "one connection each", func() bool { return peerCount(a) == 1 && peerCount(b) == 1 })
+
+	if err := a.SendTextAndConfirm(b.ID, "one way", testWait); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SendTextAndConfirm(a.ID, "the other", testWait); err != nil {
+		t.Fatal(err)
+	}
+	aPeer, bPeer := a.snapshotPeers()[0], b.snapshotPeers()[0]
+	if aPeer.outbound == bPeer.outbound {
+		t.Errorf("a and b each kept a different connection")
+	}
+	// The ack goes before the message is shown, so wait for it to be shown before counting
+	waitForText(t, b, a.ID, "one way")
+	waitForText(t, a, b.ID, "the other")
+	if countOf(b, a.ID, "one way") != 1 || countOf(a, b.ID, "the other") != 1 {
+		t.Error("a message arrived other than once")
+	}
+}
+
+// TestFramesOnReplacedConnection handles a frame read from a connection after a newer one to the
+// same node replaced it as if from the newer one: the peer sent it before it switched, with the
+// same key
+func TestFramesOnReplacedConnection(t *testing.T) {
+	clock := newFakeClock()
+	node := newTestNetwork(t, 0).newNode(WithClock(clock))
+	t.Cleanup(func() { node.shutdownWithin(testWait) })
+	peerKeys := testCrypto(t, 1)
+	keyPEM, err := peerKeys.GetPublicKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const peerNodeID = memoryHost + ":1"
+	if err := node.cryptoManager.AddPeerKey(peerNodeID, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	register := func(id string) *Peer {
+		t.Helper()
+		ours, theirs := net.Pipe()
+		go io.Copy(io.Discard, theirs)
+		t.Cleanup(func() { theirs.Close() })
+		peer := &Peer{
+			ID:   id,
+			Conn: testAuthConn{Conn: ours, fingerprint: peerKeys.Fingerprint()},
+			Send: make(chan []byte, 10),
+			Done: make(chan struct{}),
+		}
+		if err := node.addPeer(peer); err != nil {
+			t.Fatalf("registering %s: %v", id, err)
+		}
+		return peer
+	}
+	old := register(memoryHost + ":40001")
+	clock.Advance(duplicateGrace)
+	next := register(memoryHost + ":40002")
+	if old.successor.Load() != next {
+		t.Fatal("the newer connection didn't replace the old one")
+	}
+
+	envelope, err := json.Marshal(TextEnvelope{ID: "late", Text: "sent before the switch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := json.Marshal(SessionMessage{MessageType: "text", Payload: envelope})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.handleIncomingSafely(Message{SenderID: peerNodeID, FromPeerID: old.ID, Content: append([]byte(sessionPrefix), session...)})
+	waitForText(t, node, peerNodeID, "sent before the switch")
+	if info := node.reputation.Get(peerKeys.Fingerprint()); info.Score < reputationMax {
+		t.Errorf("the peer lost reputation for it: %s", info)
+	}
+
+	// Once the newer connection goes too, the old one stands for nothing
+	node.removePeer(next)
+	if got := node.currentConn(old.ID); got != old.ID {
+		t.Errorf("%s still stands for %s after both closed", got, old.ID)
+	}
+}
+
+// TestHandOver moves the frames queued for a replaced connection to its successor, in order and
+// without dropping any
+func TestHandOver(t *testing.T) {
+	node := newTestNetwork(t, 1).nodes[0]
+	newPeer := func(id string, capacity int) *Peer {
+		return &Peer{ID: id, Send: make(chan []byte, capacity), Done: make(chan struct{})}
+	}
+	frames := func(peer *Peer) []string {
+		var got []string
+		for len(peer.Send) > 0 {
+			got = append(got, string(<-peer.Send))
+		}
+		return got
+	}
+
+	// Not replaced: the frames stay where they are
+	old := newPeer("old", 10)
+	old.Send <- []byte("queued")
+	node.handOver(old, []byte("taken"))
+	if got := frames(old); !slices.Equal(got, []string{"queued"}) {
+		t.Errorf("without a successor, queue left as %v", got)
+	}
+
+	// The frame already taken off the queue goes first, then the rest in order
+	old = newPeer("old", 10)
+	next := newPeer("next", 10)
+	old.Send <- []byte("second")
+	old.Send <- []byte("third")
+	old.successor.Store(next)
+	node.handOver(old, []byte("first"))
+	if got := frames(next); !slices.Equal(got, []string{"first", "second", "third"}) {
+		t.Errorf("handed over %v", got)
+	}
+
+	// It waits for room on the new queue rather than drop anything
+	old = newPeer("old", 10)
+	next = newPeer("next", 1)
+	next.Send <- []byte("already there")
+	old.Send <- []byte("one")
+	old.Send <- []byte("two")
+	old.successor.Store(next)
+	done := make(chan struct{})
+	go func() {
+		node.handOver(old)
+		close(done)
+	}()
+	var got []string
+	for range 3 {
+		got = append(got, string(<-next.Send))
+	}
+	<-done
+	if !slices.Equal(got, []string{"already there", "one", "two"}) {
+		t.Errorf("handed over %v to a full queue", got)
+	}
+
+	// ... unless the new connection closes too
+	old = newPeer("old", 10)
+	next = newPeer("next", 1)
+	next.Send <- []byte("already there")
+	old.Send <- []byte("dropped")
+	old.successor.Store(next)
+	close(next.Done)
+	node.handOver(old)
+	if got := frames(next); !slices.Equal(got, []string{"already there"}) {
+		t.Errorf("handed over %v to a closed connection", got)
+	}
+}
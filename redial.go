@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redialFirstDelay = 2 * time.Second // Wait before a discovered peer is dialled again; it doubles after each failure
+	redialMaxDelay   = time.Minute     // Longest wait between dials of a discovered peer
+	redialAttempts   = 5               // Failed dials after which a discovered address is marked unreachable
+)
+
+// redialEntry is a discovered address whose dial failed, waiting to be dialled again
+type redialEntry struct {
+	attempts   int       // Failed dials so far
+	next       time.Time // When it is dialled again
+	dialing    bool      // A dial is in progress
+	alternates []string  // Further addresses the node listens on, tried when this one fails
+	lastErr    error
+}
+
+// RedialQueue holds discovered addresses that couldn't be dialled, so they are tried again with
+// backoff rather than only when discovery or gossip happens to name them again. Two nodes that
+// start together often find each other before either is listening.
+type RedialQueue struct {
+	mutex   sync.Mutex
+	pending map[string]*redialEntry
+	wake    chan struct{} // Signalled when an address is queued, so the drain loop rechecks its timer
+}
+
+// NewRedialQueue creates an empty queue
+func NewRedialQueue() *RedialQueue {
+	return &RedialQueue{
+		pending: make(map[string]*redialEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// queued reports whether an address is waiting for another dial
+func (rq *RedialQueue) queued(addr string) bool {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+
+	_, exists := rq.pending[addr]
+	return exists
+}
+
+// failed records a dial that failed at now, its alternates included, and schedules the next one.
+// It reports true when the address has failed redialAttempts times, in which case it is dropped
+// from the queue.
+func (rq *RedialQueue) failed(addr string, alternates []string, err error, now time.Time) bool {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+
+	entry, exists := rq.pending[addr]
+	if !exists {
+		entry = &redialEntry{}
+		rq.pending[addr] = entry
+	}
+	entry.attempts++
+	if entry.attempts >= redialAttempts {
+		delete(rq.pending, addr)
+		return true
+	}
+
+	entry.dialing = false
+	entry.alternates = alternates
+	entry.lastErr = err
+	entry.next = now.Add(min(redialFirstDelay<<(entry.attempts-1), redialMaxDelay))
+	select {
+	case rq.wake <- struct{}{}:
+	default:
+	}
+	return false
+}
+
+// succeeded forgets an address once a dial to it worked
+func (rq *RedialQueue) succeeded(addr string) {
+	rq.mutex.Lock()
+	delete(rq.pending, addr)
+	rq.mutex.Unlock()
+}
+
+// due returns the addresses whose next dial is at or before now, with their alternates, marking
+// them as being dialled
+func (rq *RedialQueue) due(now time.Time) map[string][]string {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+
+	addrs := make(map[string][]string)
+	for addr, entry := range rq.pending {
+		if !entry.dialing && !entry.next.After(now) {
+			entry.dialing = true
+			addrs[addr] = entry.alternates
+		}
+	}
+	return addrs
+}
+
+// untilNext returns how long until the next dial is due, or redialMaxDelay if none is waiting
+func (rq *RedialQueue) untilNext(now time.Time) time.Duration {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+
+	wait := redialMaxDelay
+	for _, entry := range rq.pending {
+		if !entry.dialing {
+			wait = min(wait, entry.next.Sub(now))
+		}
+	}
+	return max(wait, 0)
+}
+
+// describe returns a line for each queued address, for /discovered
+func (rq *RedialQueue) describe(now time.Time) map[string]string {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+
+	lines := make(map[string]string, len(rq.pending))
+	for addr, entry := range rq.pending {
+		next := "dialling now"
+		if !entry.dialing {
+			next = fmt.Sprintf("next at %s (in %s)", entry.next.Format("15:04:05"), entry.next.Sub(now).Round(time.Second))
+		}
+		lines[addr] = fmt.Sprintf("retrying, %d/%d attempts failed, %s: %v", entry.attempts, redialAttempts, next, entry.lastErr)
+	}
+	return lines
+}
+
+// dialDiscovered dials an address found by discovery or gossip, then in turn any alternates the
+// node listens on, queueing it to be dialled again if none of them connects. An address that
+// keeps failing stays in KnownPeers marked unreachable, so it is neither dialled automatically
+// nor gossiped until it connects or /connect is used.
+func (n *Node) dialDiscovered(addr string, alternates ...string) {
+	err := n.connectToPeer(addr)
+	for _, alternate := range alternates {
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to connect to %s, trying its other address %s: %v", addr, alternate, err)
+		err = n.connectToPeer(alternate)
+	}
+	if err == nil {
+		n.redials.succeeded(addr)
+		return
+	}
+	if !n.redials.failed(addr, alternates, err, n.wallClock.Now()) {
+		return
+	}
+
+	n.markUnreachable(addr)
+	log.Printf("Giving up on %s after %d failed attempts; marked unreachable", addr, redialAttempts)
+}
+
+// redialDiscovered drains the redial queue, dialling each address when its backoff is up
+func (n *Node) redialDiscovered() {
+	defer n.wg.Done()
+
+	timer := n.wallClock.NewTimer(redialMaxDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.Chan():
+		case <-n.redials.wake:
+		case <-n.Shutdown:
+			return
+		}
+
+		// Locked nodes don't dial; the queue waits until /unlock
+		if n.locked.Load() {
+			timer.Reset(redialFirstDelay)
+			continue
+		}
+		now := n.wallClock.Now()
+		for addr, alternates := range n.redials.due(now) {
+			go n.dialDiscovered(addr, alternates...)
+		}
+		timer.Reset(n.redials.untilNext(now))
+	}
+}
+
+// listDiscoveredPeers handles /discovered: every address known from discovery, gossip or a
+// connection, whether it is connected, and the redial state of those that failed to connect
+func (n *Node) listDiscoveredPeers() {
+	status := make(map[string]string)
+
+	// peersMutex before knownMutex, the order addPeer takes them in
+	n.peersMutex.RLock()
+	n.knownMutex.RLock()
+	for key, known := range n.KnownPeers {
+		if key == n.ownKey() {
+			continue
+		}
+		switch {
+		case n.Peers[key] != nil || n.conns[known.Addr] != nil:
+			status[known.Addr] = "connected"
+		case !known.Reachable:
+			status[known.Addr] = fmt.Sprintf("unreachable after %d attempts", redialAttempts)
+		default:
+			status[known.Addr] = "disconnected"
+		}
+	}
+	n.knownMutex.RUnlock()
+	n.peersMutex.RUnlock()
+
+	for peer, line := range n.redials.describe(n.wallClock.Now()) {
+		status[peer] = line
+	}
+
+	if len(status) == 0 {
+		n.notifyUI(Message{SenderID: "System", Content: []byte("No discovered peers")})
+		return
+	}
+	peers := make([]string, 0, len(status))
+	for peer := range status {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	var content strings.Builder
+	content.WriteString("🔍 Discovered peers:")
+	for _, peer := range peers {
+		content.WriteString(fmt.Sprintf("\n  - %s [%s]", peer, status[peer]))
+	}
+	n.notifyUI(Message{SenderID: "System", Content: []byte(content.String())})
+}
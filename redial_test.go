@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRedialBackoff has a node redial an address nobody listens on, on a fake clock: each dial
+// comes exactly when its backoff is up, doubling to redialMaxDelay, and after redialAttempts the
+// address is given up on
+func TestRedialBackoff(t *testing.T) {
+	clock := newFakeClock()
+	network := NewMemoryNetwork()
+	dials := &dialRecorder{Transport: network, clock: clock}
+	tn := &testNetwork{t: t, network: network}
+	node := tn.addNode(WithClock(clock), WithTransport(dials))
+
+	// Nobody listens here, so every dial fails
+	const addr = memoryHost + ":1"
+	start := clock.Now()
+	node.dialDiscovered(addr)
+
+	delay := redialFirstDelay
+	for attempt := 1; attempt < redialAttempts; attempt++ {
+		clock.waitForTimer(t, delay)
+		clock.Advance(delay - time.Nanosecond)
+		if dials.count() != attempt {
+			t.Fatalf("dialled %d times before the backoff of %v was up, want %d", dials.count(), delay, attempt)
+		}
+		clock.Advance(time.Nanosecond)
+		waitFor(t, fmt.Sprintf("dial %d", attempt+1), func() bool { return dials.count() == attempt+1 })
+		delay = min(2*delay, redialMaxDelay)
+	}
+
+	waitFor(t, "the address to be given up on", func() bool {
+		node.knownMutex.RLock()
+		defer node.knownMutex.RUnlock()
+		known := node.knownAt(addr)
+		return known != nil && !known.Reachable
+	})
+	if node.redials.queued(addr) {
+		t.Error("address still queued after its last attempt")
+	}
+
+	dials.mutex.Lock()
+	var got []time.Duration
+	for _, at := range dials.dials {
+		got = append(got, at.Sub(start))
+	}
+	dials.mutex.Unlock()
+	want := []time.Duration{0}
+	for delay, at := redialFirstDelay, time.Duration(0); len(want) < redialAttempts; delay *= 2 {
+		at += min(delay, redialMaxDelay)
+		want = append(want, at)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("dialled at %v, want %v", got, want)
+	}
+}
+
+// TestRedialRecovers has a discovered address come up after two failed dials: the third dial
+// connects and the address leaves the queue
+func TestRedialRecovers(t *testing.T) {
+	clock := newFakeClock()
+	tn := newTestNetwork(t, 1, WithClock(clock))
+	b := tn.nodes[0]
+	dials := &dialRecorder{Transport: tn.network, clock: clock}
+	a := tn.addNode(WithClock(clock), WithTransport(dials))
+
+	const addr = memoryHost + ":7000"
+	a.dialDiscovered(addr)
+	line := a.redials.describe(clock.Now())[addr]
+	if !strings.HasPrefix(line, fmt.Sprintf("retrying, 1/%d attempts failed, next at", redialAttempts)) || !strings.Contains(line, "(in 2s)") {
+		t.Errorf("queued as %q", line)
+	}
+
+	clock.waitForTimer(t, redialFirstDelay)
+	clock.Advance(redialFirstDelay)
+	waitFor(t, "the second dial", func() bool { return dials.count() == 2 })
+	clock.waitForTimer(t, 2*redialFirstDelay)
+
+	forward(t, tn.network, addr, b.ID)
+	clock.Advance(2 * redialFirstDelay)
+	waitForKeys(t, a, b)
+	waitFor(t, "the address to leave the queue", func() bool { return !a.redials.queued(addr) })
+
+	clock.Advance(redialMaxDelay)
+	if dials.count() != 3 {
+		t.Errorf("dialled %d times, want 3", dials.count())
+	}
+	if peerCount(a) != 1 {
+		t.Errorf("%d peers", peerCount(a))
+	}
+}
+
+// TestRedialAlternates dials a node's other address when the one discovered fails, queueing
+// nothing if that connects
+func TestRedialAlternates(t *testing.T) {
+	clock := newFakeClock()
+	tn := newTestNetwork(t, 1, WithClock(clock))
+	b := tn.nodes[0]
+	dials := &dialRecorder{Transport: tn.network, clock: clock}
+	a := tn.addNode(WithClock(clock), WithTransport(dials))
+
+	const addr = memoryHost + ":7000"
+	a.dialDiscovered(addr, b.ID)
+	waitForKeys(t, a, b)
+	if a.redials.queued(addr) || dials.count() != 2 {
+		t.Errorf("queued %v after %d dials", a.redials.queued(addr), dials.count())
+	}
+}
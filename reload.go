@@ -0,0 +1,212 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// restartSettings are the config file settings only read at startup, by their JSON names. The
+// rest take effect on /reload. Flags such as -listen and -data-dir, and the keys, are never
+// reloaded.
+var restartSettings = map[string]bool{
+	"discovery":     true, // The multicast socket is joined at startup
+	"dht":           true,
+	"dht_listen":    true,
+	"dht_bootstrap": true,
+	"save_history":  true, // The input history file is opened at startup
+}
+
+// configFlags are the command-line flags that override config file settings, kept so a reload
+// doesn't undo them
+type configFlags struct {
+	nick              string
+	autoAccept        bool
+	theme             string
+	mentionBell       bool
+	notify            string
+	notifyHidePreview bool
+	maxMessages       int
+}
+
+// configReloadedMsg tells the TUI the config file was reloaded
+type configReloadedMsg struct {
+	old, config *Config
+}
+
+// diffConfig returns the JSON names of the settings that differ between two configs: those
+// that apply at once, and those that need a restart
+func diffConfig(old, config *Config) (live, restart []string) {
+	oldValue, newValue := reflect.ValueOf(*old), reflect.ValueOf(*config)
+	for i := range oldValue.NumField() {
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		name, _, _ := strings.Cut(oldValue.Type().Field(i).Tag.Get("json"), ",")
+		if restartSettings[name] {
+			restart = append(restart, name)
+		} else {
+			live = append(live, name)
+		}
+	}
+	return live, restart
+}
+
+// validateConfig checks every setting applyConfig could refuse, so a bad config is refused
+// before anything changes
+func validateConfig(config *Config) error {
+	if _, err := config.Reputation.settings(); err != nil {
+		return err
+	}
+	if config.Transcribe != nil {
+		if _, err := newVoiceTranscriber(config.Transcribe); err != nil {
+			return err
+		}
+	}
+	if _, err := execHooks(config.Hooks); err != nil {
+		return err
+	}
+	if config.Theme != "" || len(config.ThemeColors) > 0 {
+		if _, err := loadTheme(cmp.Or(config.Theme, defaultTheme), config.ThemeColors); err != nil {
+			return err
+		}
+	}
+	if config.Notify != "" {
+		if _, err := parseNotifyMode(config.Notify); err != nil {
+			return err
+		}
+	}
+	if config.MaxMessages < 0 {
+		return fmt.Errorf("max_messages must not be negative")
+	}
+	if config.Volume != nil && (*config.Volume < 0 || *config.Volume > 100) {
+		return fmt.Errorf("volume must be between 0 and 100")
+	}
+	return nil
+}
+
+// reloadConfig re-reads the config file and applies what changed. A file that can't be read or
+// holds an invalid setting is refused as a whole, leaving every setting as it was.
+func (en *EnhancedNode) reloadConfig() (live, restart []string, err error) {
+	config, err := LoadConfig(en.configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, nil, err
+	}
+	if config.DownloadsDir != "" {
+		if err := writeProbe(expandHome(config.DownloadsDir)); err != nil {
+			return nil, nil, fmt.Errorf("downloads_dir: %w", err)
+		}
+	}
+
+	old := en.config
+	live, restart = diffConfig(old, config)
+	// The whole file is taken on, restart-only settings included, so a command that saves the
+	// config (/volume, /keyword) doesn't write the old values back
+	if err := en.applyConfig(config, en.configPath); err != nil {
+		return nil, nil, err
+	}
+	if en.configReloaded != nil {
+		en.configReloaded(old, config)
+	}
+	return live, restart, nil
+}
+
+// handleReloadCommand processes /reload, and SIGHUP
+func (en *EnhancedNode) handleReloadCommand() {
+	live, restart, err := en.reloadConfig()
+	if err != nil {
+		log.Printf("Config not reloaded: %v", err)
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Config not reloaded, the current settings stay: %v", err)),
+		})
+		return
+	}
+
+	log.Printf("Reloaded %s: applied %v, restart needed for %v", en.configPath, live, restart)
+	content := fmt.Sprintf("🔄 Reloaded %s: nothing changed", en.configPath)
+	if len(live) > 0 {
+		content = fmt.Sprintf("🔄 Reloaded %s, applied: %s", en.configPath, strings.Join(live, ", "))
+	}
+	if len(restart) > 0 {
+		content += fmt.Sprintf("\n  ⚠️ Changed, but only take effect after a restart: %s", strings.Join(restart, ", "))
+	}
+	en.notifyUI(Message{SenderID: "System", Content: []byte(content)})
+}
+
+// reloadOnHangup reloads the config file on SIGHUP, on the event loop like a typed /reload
+func (en *EnhancedNode) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hangups)
+		for {
+			select {
+			case <-hangups:
+				log.Printf("SIGHUP: reloading %s", en.configPath)
+				if err := en.submitInput("/reload"); err != nil {
+					return
+				}
+			case <-en.Shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// applyConfig applies the TUI's settings from the config file, those flags don't override. With
+// old set only the settings that differ from it are applied, so a reload keeps a /theme or
+// /notify choice made since unless the file changed that setting too.
+func (ui *UI) applyConfig(old, config *Config, flags configFlags) error {
+	changed := func(get func(*Config) any) bool {
+		return old == nil || !reflect.DeepEqual(get(old), get(config))
+	}
+
+	if changed(func(c *Config) any { return []any{c.Theme, c.ThemeColors} }) {
+		if err := ui.setTheme(pickTheme(flags.theme, config.Theme), config.ThemeColors); err != nil {
+			return err
+		}
+	}
+	ui.mentionBell = config.MentionBell || flags.mentionBell
+	ui.plainText = config.Markdown != nil && !*config.Markdown
+
+	// -notify wins over the file, so on a reload only a change to the file without it counts
+	if old == nil || (flags.notify == "" && changed(func(c *Config) any { return c.Notify })) {
+		mode := notifyOff
+		if notify := cmp.Or(flags.notify, config.Notify); notify != "" {
+			var err error
+			if mode, err = parseNotifyMode(notify); err != nil {
+				return err
+			}
+		}
+		ui.notifications.mode = mode
+	}
+	ui.notifications.hidePreview = config.NotifyHidePreview || flags.notifyHidePreview
+
+	switch {
+	case flags.maxMessages > 0:
+		ui.maxMessages = flags.maxMessages
+	case config.MaxMessages > 0:
+		ui.maxMessages = config.MaxMessages
+	default:
+		ui.maxMessages = defaultMaxMessages
+	}
+	return nil
+}
+
+// handleConfigReloaded applies a reloaded config to the TUI
+func (ui *UI) handleConfigReloaded(msg configReloadedMsg) {
+	if err := ui.applyConfig(msg.old, msg.config, ui.flags); err != nil {
+		log.Printf("Failed to apply reloaded config to the TUI: %v", err)
+	}
+	ui.updateViewport()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+// TestDiffConfig sorts changed settings into those applied at once and those that wait for a
+// restart
+func TestDiffConfig(t *testing.T) {
+	off := false
+	for _, tc := range []struct {
+		name          string
+		old, config   Config
+		live, restart []string
+	}{
+		{"unchanged", Config{Nick: "alice"}, Config{Nick: "alice"}, nil, nil},
+		{"live", Config{Nick: "alice"}, Config{Nick: "bob", Keywords: []string{"deploy"}}, []string{"nick", "keywords"}, nil},
+		{"restart", Config{}, Config{Discovery: &off, SaveHistory: true}, nil, []string{"save_history", "discovery"}},
+		{"both", Config{Theme: "dark"}, Config{Theme: "light", Discovery: &off}, []string{"theme"}, []string{"discovery"}},
+		{"pointer to the same value", Config{Discovery: &off}, Config{Discovery: new(bool)}, nil, nil},
+	} {
+		live, restart := diffConfig(&tc.old, &tc.config)
+		if !slices.Equal(live, tc.live) || !slices.Equal(restart, tc.restart) {
+			t.Errorf("%s: live %v, restart %v; want %v, %v", tc.name, live, restart, tc.live, tc.restart)
+		}
+	}
+}
+
+// TestReloadConfig edits a running node's config file: /reload applies what can change at once,
+// names what needs a restart, and refuses a file with any bad setting without changing anything
+func TestReloadConfig(t *testing.T) {
+	node := newTestNetwork(t, 1).nodes[0]
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(node.configPath, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func(notice string) {
+		t.Helper()
+		node.handleEnhancedCLICommand("/reload", node.ID)
+		waitForNotice(t, node, notice)
+	}
+
+	write(`{"nick": "alice", "keywords": ["deploy"], "reputation": {"mute_below": 90}}`)
+	reload("🔄 Reloaded " + node.configPath + ", applied: nick, keywords, reputation")
+	if node.mentions.Nick() != "alice" || !slices.Equal(node.mentions.Keywords(), []string{"deploy"}) {
+		t.Errorf("nick %q, keywords %v", node.mentions.Nick(), node.mentions.Keywords())
+	}
+	if !node.mentions.Matches("the deploy is done") || node.reputation.config.muteBelow != 90 {
+		t.Error("the keywords or the reputation thresholds weren't applied")
+	}
+
+	write(`{"nick": "alice", "keywords": ["deploy"], "reputation": {"mute_below": 90}, "discovery": false, "save_history": true}`)
+	reload("🔄 Reloaded " + node.configPath + ": nothing changed\n  ⚠️ Changed, but only take effect after a restart: save_history, discovery")
+	reload("🔄 Reloaded " + node.configPath + ": nothing changed")
+
+	applied := node.config
+	for _, tc := range []struct {
+		config string
+		reason string
+	}{
+		{`{"nick": "bob", "reputation": {"mute_below": 101}}`, "every peer would be muted"},
+		{`{"nick": "bob", "theme": "neon"}`, "neon"},
+		{`{"nick": "bob", "notify": "sometimes"}`, "sometimes"},
+		{`{"nick": "bob", "volume": 150}`, "volume must be between 0 and 100"},
+		{`{"nick": "bob", "max_messages": -1}`, "max_messages"},
+		{`{"nick": "bob"`, "config"},
+	} {
+		write(tc.config)
+		reload("❌ Config not reloaded, the current settings stay: ")
+		waitForNotice(t, node, tc.reason)
+		if node.config != applied || node.mentions.Nick() != "alice" || node.reputation.config.muteBelow != 90 {
+			t.Errorf("%s changed the settings", tc.config)
+		}
+	}
+}
+
+// TestReloadTUI applies a reloaded file to the TUI: settings the file changed, keeping what a
+// flag or a command set otherwise
+func TestReloadTUI(t *testing.T) {
+	ui, _ := newTestUI(t, 100, 30)
+	ui.flags = configFlags{notify: notifyMentions}
+	old := &Config{Theme: "dark", Notify: notifyOn}
+	if err := ui.applyConfig(nil, old, ui.flags); err != nil {
+		t.Fatal(err)
+	}
+	if ui.theme != "dark" || ui.notifications.mode != notifyMentions || ui.maxMessages != defaultMaxMessages {
+		t.Fatalf("at startup: theme %s, notify %s, %d messages", ui.theme, ui.notifications.mode, ui.maxMessages)
+	}
+
+	// /theme since startup; the file changes other things
+	if err := ui.setTheme("mono", nil); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Theme: "dark", Notify: notifyOff, MentionBell: true, MaxMessages: 100}
+	ui.Update(configReloadedMsg{old: old, config: config})
+	if ui.theme != "mono" || ui.notifications.mode != notifyMentions || !ui.mentionBell || ui.maxMessages != 100 {
+		t.Errorf("after the first reload: theme %s, notify %s, bell %v, %d messages", ui.theme, ui.notifications.mode, ui.mentionBell, ui.maxMessages)
+	}
+
+	changed := &Config{Theme: "light", Markdown: new(bool)}
+	ui.Update(configReloadedMsg{old: config, config: changed})
+	if ui.theme != "light" || !ui.plainText || ui.mentionBell || ui.maxMessages != defaultMaxMessages {
+		t.Errorf("after the second reload: theme %s, plain text %v, bell %v, %d messages", ui.theme, ui.plainText, ui.mentionBell, ui.maxMessages)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	rendezvousInterval         = 5 * time.Minute                                  // How often clients register and fetch the peer list
+	rendezvousTTL              = 3 * rendezvousInterval                           // How long a client asks to stay listed
+	rendezvousMaxTTL           = time.Hour                                        // Longest a server keeps a registration
+	rendezvousMaxRegistrations = 4096                                             // Most nodes a server lists; further ones are refused
+	rendezvousMaxListed        = 200                                              // Most registrations in one /peers answer
+	rendezvousRequestTimeout   = 10 * time.Second                                 // Client-side limit on each request
+	rendezvousRateBurst        = 10                                               // Requests an address may make at once
+	rendezvousRateInterval     = 6 * time.Second                                  // After the burst, one request per address this often
+	rendezvousMaxBodySize      = 16 * 1024                                        // A registration with its key is about 1.5KB
+	rendezvousLimiterMaxIdle   = 2 * rendezvousRateBurst * rendezvousRateInterval // Full buckets idle this long are forgotten
+)
+
+// RendezvousRegistration is a node's signed request to be listed by a rendezvous server. The
+// server only stores and hands out registrations; clients check the signatures themselves, so a
+// server can leave nodes out but can't put words in their mouth.
+type RendezvousRegistration struct {
+	NodeID      string   `json:"node_id"`
+	Addresses   []string `json:"addresses"`
+	Fingerprint string   `json:"fingerprint"` // Of the key that signed the registration
+	Timestamp   int64    `json:"timestamp"`   // Unix seconds when signed
+	TTL         int64    `json:"ttl"`         // Seconds to stay listed after Timestamp
+	PublicKey   string   `json:"public_key"`  // PEM
+	Signature   string   `json:"signature"`   // Over signedData
+}
+
+// signedData is the part of a registration covered by its signature
+func (reg RendezvousRegistration) signedData() []byte {
+	data, _ := json.Marshal(struct {
+		Purpose     string   `json:"purpose"` // Keeps the signature from passing as a peer record's
+		NodeID      string   `json:"node_id"`
+		Addresses   []string `json:"addresses"`
+		Fingerprint string   `json:"fingerprint"`
+		Timestamp   int64    `json:"timestamp"`
+		TTL         int64    `json:"ttl"`
+	}{"rendezvous", reg.NodeID, reg.Addresses, reg.Fingerprint, reg.Timestamp, reg.TTL})
+	return data
+}
+
+// expiresAt is when the registration stops being listed
+func (reg RendezvousRegistration) expiresAt() time.Time {
+	return time.Unix(reg.Timestamp+reg.TTL, 0)
+}
+
+// newRendezvousRegistration signs a registration of where we can be reached
+func newRendezvousRegistration(cm *CryptoManager, nodeID string, addresses []string, ttl time.Duration, now time.Time) (RendezvousRegistration, error) {
+	reg := RendezvousRegistration{
+		NodeID:      nodeID,
+		Addresses:   addresses,
+		Fingerprint: cm.Fingerprint(),
+		Timestamp:   now.Unix(),
+		TTL:         int64(ttl / time.Second),
+	}
+	signature, err := cm.SignPlaintext(reg.signedData())
+	if err != nil {
+		return RendezvousRegistration{}, err
+	}
+	reg.PublicKey = signature.PublicKeyPEM
+	reg.Signature = signature.Signature
+	return reg, nil
+}
+
+// verify checks a registration's contents, lifetime and signature
+func (reg RendezvousRegistration) verify(now time.Time) error {
+	if _, _, err := net.SplitHostPort(reg.NodeID); err != nil {
+		return fmt.Errorf("invalid node ID %q", reg.NodeID)
+	}
+	if len(reg.Addresses) == 0 || len(reg.Addresses) > maxRecordAddresses {
+		return fmt.Errorf("%d addresses", len(reg.Addresses))
+	}
+	for _, addr := range reg.Addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address %q", addr)
+		}
+	}
+
+	if reg.TTL <= 0 || reg.TTL > int64(rendezvousMaxTTL/time.Second) {
+		return fmt.Errorf("TTL must be between 1 and %d seconds", int64(rendezvousMaxTTL/time.Second))
+	}
+	if time.Unix(reg.Timestamp, 0).Sub(now) > peerRecordMaxSkew {
+		return errors.New("dated in the future")
+	}
+	if !now.Before(reg.expiresAt()) {
+		return errors.New("expired")
+	}
+
+	publicKey, err := parsePublicKeyPEM(reg.PublicKey)
+	if err != nil {
+		return err
+	}
+	if keyFingerprint(publicKey) != reg.Fingerprint {
+		return errors.New("fingerprint doesn't match the signing key")
+	}
+	return verifySignature(publicKey, reg.signedData(), reg.Signature)
+}
+
+// rendezvousPeers is the answer to GET /peers
+type rendezvousPeers struct {
+	Registrations []RendezvousRegistration `json:"registrations"`
+}
+
+// tokenBucket is one address's allowance of requests
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter allows each address rendezvousRateBurst requests at once, then one every
+// rendezvousRateInterval
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// allow takes a token from key's bucket, reporting whether there was one
+func (rl *rateLimiter) allow(key string, now time.Time) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	bucket, exists := rl.buckets[key]
+	if !exists {
+		if len(rl.buckets) >= rendezvousMaxRegistrations {
+			rl.forgetIdle(now)
+		}
+		bucket = &tokenBucket{tokens: rendezvousRateBurst, last: now}
+		rl.buckets[key] = bucket
+	}
+
+	bucket.tokens = min(rendezvousRateBurst, bucket.tokens+float64(now.Sub(bucket.last))/float64(rendezvousRateInterval))
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// forgetIdle drops buckets that have refilled, which are no different from new ones; the caller
+// must hold the mutex
+func (rl *rateLimiter) forgetIdle(now time.Time) {
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.last) > rendezvousLimiterMaxIdle {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// RendezvousServer lists nodes that register with it so they can find each other across
+// networks. It never takes part in chat, so it never sees a message.
+type RendezvousServer struct {
+	server   *http.Server
+	listener net.Listener
+	limiter  *rateLimiter
+
+	mutex         sync.Mutex
+	registrations map[string]RendezvousRegistration // By fingerprint; a newer registration replaces the older
+}
+
+// NewRendezvousServer binds the rendezvous server's listener
+func NewRendezvousServer(listenAddr string) (*RendezvousServer, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+	}
+
+	rs := &RendezvousServer{
+		listener:      listener,
+		limiter:       &rateLimiter{buckets: make(map[string]*tokenBucket)},
+		registrations: make(map[string]RendezvousRegistration),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", rs.handleRegister)
+	mux.HandleFunc("/peers", rs.handlePeers)
+	rs.server = &http.Server{
+		Handler:           rs.rateLimit(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return rs, nil
+}
+
+// rateLimit refuses requests from addresses that have used up their allowance
+func (rs *RendezvousServer) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if !rs.limiter.allow(host, time.Now()) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(rendezvousRateInterval/time.Second)))
+			writeAPIError(w, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleRegister stores a valid registration
+func (rs *RendezvousServer) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var reg RendezvousRegistration
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, rendezvousMaxBodySize)).Decode(&reg); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid registration: %v", err))
+		return
+	}
+	now := time.Now()
+	if err := reg.verify(now); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid registration: %v", err))
+		return
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	known, exists := rs.registrations[reg.Fingerprint]
+	if exists && reg.Timestamp < known.Timestamp {
+		writeAPIError(w, http.StatusConflict, "a newer registration is held")
+		return
+	}
+	if !exists && len(rs.registrations) >= rendezvousMaxRegistrations {
+		rs.expire(now)
+		if len(rs.registrations) >= rendezvousMaxRegistrations {
+			writeAPIError(w, http.StatusServiceUnavailable, "server full")
+			return
+		}
+	}
+	rs.registrations[reg.Fingerprint] = reg
+	writeAPIJSON(w, http.StatusOK, map[string]int64{"expires": reg.expiresAt().Unix()})
+}
+
+// handlePeers lists the registrations that haven't expired, most recent first
+func (rs *RendezvousServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	rs.mutex.Lock()
+	rs.expire(time.Now())
+	listed := make([]RendezvousRegistration, 0, len(rs.registrations))
+	for _, reg := range rs.registrations {
+		listed = append(listed, reg)
+	}
+	rs.mutex.Unlock()
+
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Timestamp > listed[j].Timestamp })
+	writeAPIJSON(w, http.StatusOK, rendezvousPeers{Registrations: listed[:min(len(listed), rendezvousMaxListed)]})
+}
+
+// expire drops registrations past their TTL; the caller must hold the mutex
+func (rs *RendezvousServer) expire(now time.Time) {
+	for fingerprint, reg := range rs.registrations {
+		if !now.Before(reg.expiresAt()) {
+			delete(rs.registrations, fingerprint)
+		}
+	}
+}
+
+// runRendezvous runs a rendezvous server until SIGTERM or SIGINT
+func runRendezvous(listenAddr string) error {
+	rs, err := NewRendezvousServer(listenAddr)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		rs.server.Close()
+	}()
+
+	log.Printf("Rendezvous server listening on %s", rs.listener.Addr())
+	if err := rs.server.Serve(rs.listener); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// rendezvousURL turns a -rendezvous-server address into the URL of one of its endpoints.
+// A bare host:port means plain HTTP; a URL, e.g. behind a TLS proxy, is used as given.
+func rendezvousURL(server, endpoint string) string {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	return strings.TrimRight(server, "/") + endpoint
+}
+
+// registerWithRendezvous keeps us listed on the rendezvous server and passes the nodes listed
+// there to DiscoveredPeer
+func (en *EnhancedNode) registerWithRendezvous() {
+	defer en.wg.Done()
+
+	client := &http.Client{Timeout: rendezvousRequestTimeout}
+	en.rendezvousRound(client)
+
+	ticker := time.NewTicker(rendezvousInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			en.rendezvousRound(client)
+		case <-en.Shutdown:
+			return
+		}
+	}
+}
+
+// rendezvousRound registers with the rendezvous server, then fetches its list
+func (en *EnhancedNode) rendezvousRound(client *http.Client) {
+	if err := en.rendezvousRegister(client); err != nil {
+		log.Printf("Rendezvous registration failed: %v", err)
+	}
+
+	registrations, err := en.rendezvousFetch(client)
+	if err != nil {
+		log.Printf("Rendezvous lookup failed: %v", err)
+		return
+	}
+
+	now := time.Now()
+	own := en.cryptoManager.Fingerprint()
+	for _, reg := range registrations {
+		if reg.Fingerprint == own || reg.NodeID == en.ID {
+			continue
+		}
+		if err := reg.verify(now); err != nil {
+			log.Printf("Ignoring rendezvous registration for %q: %v", reg.NodeID, err)
+			continue
+		}
+		if _, _, err := en.resolvePeer(reg.NodeID); err == nil {
+			// Already connected
+			continue
+		}
+
+		select {
+		case en.DiscoveredPeer <- reg.Addresses[0]:
+		case <-en.Shutdown:
+			return
+		}
+	}
+}
+
+// rendezvousRegister sends the server a fresh registration
+func (en *EnhancedNode) rendezvousRegister(client *http.Client) error {
+	reg, err := newRendezvousRegistration(en.cryptoManager, en.ID, en.recordAddresses(), rendezvousTTL, time.Now())
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(rendezvousURL(en.rendezvousServer, "/register"), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return rendezvousError(resp)
+	}
+	return nil
+}
+
+// rendezvousFetch gets the server's list of registrations
+func (en *EnhancedNode) rendezvousFetch(client *http.Client) ([]RendezvousRegistration, error) {
+	resp, err := client.Get(rendezvousURL(en.rendezvousServer, "/peers"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, rendezvousError(resp)
+	}
+
+	var peers rendezvousPeers
+	if err := json.NewDecoder(io.LimitReader(resp.Body, rendezvousMaxListed*rendezvousMaxBodySize)).Decode(&peers); err != nil {
+		return nil, fmt.Errorf("invalid answer: %w", err)
+	}
+	return peers.Registrations, nil
+}
+
+// rendezvousError describes a failed request from the server's error body
+func rendezvousError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, rendezvousMaxBodySize)).Decode(&body) == nil && body.Error != "" {
+		return fmt.Errorf("%s: %s", resp.Status, body.Error)
+	}
+	return errors.New(resp.Status)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestRendezvous runs a rendezvous server on loopback until the test ends
+func startTestRendezvous(t *testing.T) *RendezvousServer {
+	t.Helper()
+	rs, err := NewRendezvousServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rs.server.Serve(rs.listener)
+	t.Cleanup(func() { rs.server.Close() })
+	return rs
+}
+
+// postRegistration sends reg to the server, returning the status
+func postRegistration(t *testing.T, rs *RendezvousServer, reg RendezvousRegistration) int {
+	t.Helper()
+	data, _ := json.Marshal(reg)
+	resp, err := http.Post(rendezvousURL(rs.listener.Addr().String(), "/register"), "application/json", strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestRendezvousServer lists valid registrations, newest for each key, and refuses the rest
+func TestRendezvousServer(t *testing.T) {
+	rs := startTestRendezvous(t)
+	alice, bob := testCrypto(t, 0), testCrypto(t, 1)
+	now := time.Now()
+	register := func(cm *CryptoManager, addr string, ttl time.Duration, at time.Time) RendezvousRegistration {
+		reg, err := newRendezvousRegistration(cm, addr, []string{addr}, ttl, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reg
+	}
+
+	tampered := register(bob, "198.51.100.2:9000", time.Hour, now)
+	tampered.Addresses = []string{"203.0.113.66:9000"}
+	for _, tc := range []struct {
+		name string
+		reg  RendezvousRegistration
+		want int
+	}{
+		{"alice", register(alice, "198.51.100.1:9000", time.Hour, now.Add(-time.Minute)), http.StatusOK},
+		{"alice again", register(alice, "198.51.100.1:9001", time.Hour, now), http.StatusOK},
+		{"alice older", register(alice, "198.51.100.1:9002", time.Hour, now.Add(-2*time.Minute)), http.StatusConflict},
+		{"bob tampered", tampered, http.StatusBadRequest},
+		{"bob expired", register(bob, "198.51.100.2:9000", time.Minute, now.Add(-2*time.Minute)), http.StatusBadRequest},
+		{"bob too long", register(bob, "198.51.100.2:9000", 2*rendezvousMaxTTL, now), http.StatusBadRequest},
+		{"bob", register(bob, "198.51.100.2:9000", time.Minute, now), http.StatusOK},
+	} {
+		if got := postRegistration(t, rs, tc.reg); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	resp, err := http.Get(rendezvousURL(rs.listener.Addr().String(), "/peers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peers rendezvousPeers
+	json.NewDecoder(resp.Body).Decode(&peers)
+	resp.Body.Close()
+	var listed []string
+	for _, reg := range peers.Registrations {
+		listed = append(listed, reg.Addresses[0])
+	}
+	slices.Sort(listed)
+	if strings.Join(listed, " ") != "198.51.100.1:9001 198.51.100.2:9000" {
+		t.Errorf("listed %v, want alice's newest and bob's", listed)
+	}
+
+	// Bob's registration lapses after its minute
+	rs.mutex.Lock()
+	rs.expire(now.Add(2 * time.Minute))
+	remaining := len(rs.registrations)
+	rs.mutex.Unlock()
+	if remaining != 1 {
+		t.Errorf("%d registrations left after bob's expired", remaining)
+	}
+
+	resp, err = http.Post(rendezvousURL(rs.listener.Addr().String(), "/peers"), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /peers: status %d", resp.StatusCode)
+	}
+}
+
+// TestRendezvousRateLimit answers each address's burst of requests, then one request per interval
+func TestRendezvousRateLimit(t *testing.T) {
+	rl := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	for i := range rendezvousRateBurst {
+		if !rl.allow("198.51.100.1", now) {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	if rl.allow("198.51.100.1", now) {
+		t.Error("a request past the burst was allowed")
+	}
+	if !rl.allow("198.51.100.2", now) {
+		t.Error("another address was limited too")
+	}
+	if rl.allow("198.51.100.1", now.Add(rendezvousRateInterval/2)) {
+		t.Error("allowed before a token was back")
+	}
+	if !rl.allow("198.51.100.1", now.Add(rendezvousRateInterval)) {
+		t.Error("refused after an interval")
+	}
+
+	// Over HTTP the limit comes with when to retry
+	rs := startTestRendezvous(t)
+	server := httptest.NewServer(rs.server.Handler)
+	defer server.Close()
+	for range rendezvousRateBurst {
+		resp, err := http.Get(server.URL + "/peers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	resp, err := http.Get(server.URL + "/peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "6" {
+		t.Errorf("past the burst: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+// TestRendezvousClientChecksSignatures passes on only the nodes whose registrations verify: the
+// server isn't trusted to vouch for anyone
+func TestRendezvousClientChecksSignatures(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	node := tn.newNode() // Not started, so what it discovers stays queued
+	genuine, err := newRendezvousRegistration(testCrypto(t, 1), "198.51.100.1:9000", []string{"198.51.100.1:9000"}, time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := genuine
+	forged.NodeID, forged.Addresses = "203.0.113.66:9000", []string{"203.0.113.66:9000"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/peers" {
+			writeAPIJSON(w, http.StatusOK, rendezvousPeers{Registrations: []RendezvousRegistration{forged, genuine}})
+		}
+	}))
+	defer server.Close()
+	node.rendezvousServer = server.URL
+	node.rendezvousRound(server.Client())
+
+	select {
+	case addr := <-node.DiscoveredPeer:
+		if addr != "198.51.100.1:9000" {
+			t.Errorf("discovered %s", addr)
+		}
+	default:
+		t.Fatal("the genuine registration wasn't passed on")
+	}
+	select {
+	case addr := <-node.DiscoveredPeer:
+		t.Errorf("also discovered %s", addr)
+	default:
+	}
+}
+
+// TestRendezvousFindsPeers has two nodes register with one server: the second finds the first
+// there and they connect
+func TestRendezvousFindsPeers(t *testing.T) {
+	rs := startTestRendezvous(t)
+	tn := newTestNetwork(t, 0)
+	for range 2 {
+		node := tn.newNode()
+		node.rendezvousServer = rs.listener.Addr().String()
+		tn.start(node)
+	}
+	a, b := tn.nodes[0], tn.nodes[1]
+	waitFor(t, "a and b to connect", func() bool { return connectedTo(a, b.ID) && connectedTo(b, a.ID) })
+	waitForKeys(t, a, b)
+
+	rs.mutex.Lock()
+	registered := len(rs.registrations)
+	rs.mutex.Unlock()
+	if registered != 2 {
+		t.Errorf("%d nodes registered", registered)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reputation scores run from reputationMax, a peer that has done nothing wrong, down. Offences
+// take points off; what was taken comes back over time, halving every half-life.
+const (
+	reputationMax           = 100.0
+	reputationFloor         = -100.0 // Lowest a score goes, so a flood doesn't take forever to recover from
+	reputationRecentLimit   = 64     // Recent messages per peer kept to spot repeats
+	reputationForgetAfter   = time.Hour
+	reputationNodeKeyPrefix = "node:" // Keys peers without a known fingerprint by node ID
+)
+
+// Offences that cost reputation
+const (
+	offenceRepeat    = "repeated message"
+	offenceRate      = "message over the rate limit"
+	offenceSignature = "failed signature"
+	offenceOversized = "oversized message"
+	offenceCrash     = "message that crashed its handler"
+)
+
+// ReputationConfig tunes spam detection, in the config file's "reputation" section. Zero fields
+// take the defaults.
+type ReputationConfig struct {
+	Off              bool    `json:"off,omitempty"`               // Don't score peers at all
+	MuteBelow        float64 `json:"mute_below,omitempty"`        // Score under which a peer's messages are hidden; default 50
+	DisconnectBelow  float64 `json:"disconnect_below,omitempty"`  // Score under which a peer is disconnected; default 0
+	Cooldown         string  `json:"cooldown,omitempty"`          // How long a disconnected peer is refused, e.g. "10m"
+	HalfLife         string  `json:"half_life,omitempty"`         // How fast lost points come back, e.g. "5m"
+	RatePerMinute    float64 `json:"rate_per_minute,omitempty"`   // Text messages a minute a peer may keep up; default 600
+	Burst            int     `json:"burst,omitempty"`             // Text messages a peer may send at once; default 100
+	RepeatWindow     string  `json:"repeat_window,omitempty"`     // How long identical messages count as repeats, e.g. "1m"
+	RepeatsAllowed   int     `json:"repeats_allowed,omitempty"`   // Identical messages allowed in the window; default 3
+	RepeatPenalty    float64 `json:"repeat_penalty,omitempty"`    // Points per repeat over the allowance; default 10
+	RatePenalty      float64 `json:"rate_penalty,omitempty"`      // Points per message over the rate; default 5
+	SignaturePenalty float64 `json:"signature_penalty,omitempty"` // Points per failed signature; default 25
+	OversizedPenalty float64 `json:"oversized_penalty,omitempty"` // Points per oversized message; default 20
+	CrashPenalty     float64 `json:"crash_penalty,omitempty"`     // Points per message that made a handler panic; default 40
+}
+
+// reputationSettings is a ReputationConfig with the defaults filled in and durations parsed
+type reputationSettings struct {
+	off              bool
+	muteBelow        float64
+	disconnectBelow  float64
+	cooldown         time.Duration
+	halfLife         time.Duration
+	ratePerMinute    float64
+	burst            int
+	repeatWindow     time.Duration
+	repeatsAllowed   int
+	repeatPenalty    float64
+	ratePenalty      float64
+	signaturePenalty float64
+	oversizedPenalty float64
+	crashPenalty     float64
+}
+
+// defaultReputationSettings is what an empty "reputation" section means. Someone pasting a burst
+// of lines, chatting fast for minutes on end, or piping in a log at ten lines a second, stays well
+// clear of it; nine identical messages in a minute, or a few dozen past the rate, do not. A peer
+// whose messages crash a handler three times in quick succession is refused for the cooldown.
+var defaultReputationSettings = reputationSettings{
+	muteBelow:        50,
+	disconnectBelow:  0,
+	cooldown:         10 * time.Minute,
+	halfLife:         5 * time.Minute,
+	ratePerMinute:    600,
+	burst:            100,
+	repeatWindow:     time.Minute,
+	repeatsAllowed:   3,
+	repeatPenalty:    10,
+	ratePenalty:      5,
+	signaturePenalty: 25,
+	oversizedPenalty: 20,
+	crashPenalty:     40,
+}
+
+// settings fills in the fields left zero and checks the thresholds make sense
+func (rc *ReputationConfig) settings() (reputationSettings, error) {
+	settings := defaultReputationSettings
+	if rc == nil {
+		return settings, nil
+	}
+	settings.off = rc.Off
+	setFloat := func(field *float64, value float64) {
+		if value != 0 {
+			*field = value
+		}
+	}
+	setInt := func(field *int, value int) {
+		if value != 0 {
+			*field = value
+		}
+	}
+	var durationErr error
+	setDuration := func(field *time.Duration, name, value string) {
+		if value == "" {
+			return
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			durationErr = fmt.Errorf("reputation: invalid %s %q", name, value)
+			return
+		}
+		*field = parsed
+	}
+	setFloat(&settings.muteBelow, rc.MuteBelow)
+	setFloat(&settings.disconnectBelow, rc.DisconnectBelow)
+	setDuration(&settings.cooldown, "cooldown", rc.Cooldown)
+	setDuration(&settings.halfLife, "half_life", rc.HalfLife)
+	setFloat(&settings.ratePerMinute, rc.RatePerMinute)
+	setInt(&settings.burst, rc.Burst)
+	setDuration(&settings.repeatWindow, "repeat_window", rc.RepeatWindow)
+	setInt(&settings.repeatsAllowed, rc.RepeatsAllowed)
+	setFloat(&settings.repeatPenalty, rc.RepeatPenalty)
+	setFloat(&settings.ratePenalty, rc.RatePenalty)
+	setFloat(&settings.signaturePenalty, rc.SignaturePenalty)
+	setFloat(&settings.oversizedPenalty, rc.OversizedPenalty)
+	setFloat(&settings.crashPenalty, rc.CrashPenalty)
+
+	switch {
+	case durationErr != nil:
+		return settings, durationErr
+	case settings.muteBelow > reputationMax:
+		return settings, fmt.Errorf("reputation: mute_below is over %v, so every peer would be muted", reputationMax)
+	case settings.disconnectBelow >= settings.muteBelow:
+		return settings, fmt.Errorf("reputation: disconnect_below (%v) must be under mute_below (%v)", settings.disconnectBelow, settings.muteBelow)
+	case settings.disconnectBelow <= reputationFloor:
+		return settings, fmt.Errorf("reputation: disconnect_below must be over %v, the lowest a score goes", reputationFloor)
+	case settings.ratePerMinute < 0 || settings.burst < 0 || settings.repeatsAllowed < 0:
+		return settings, fmt.Errorf("reputation: rates and counts can't be negative")
+	case settings.repeatPenalty < 0 || settings.ratePenalty < 0 || settings.signaturePenalty < 0 ||
+		settings.oversizedPenalty < 0 || settings.crashPenalty < 0:
+		return settings, fmt.Errorf("reputation: penalties can't be negative")
+	}
+	return settings, nil
+}
+
+// reputationAction is what an offence calls for
+type reputationAction int
+
+const (
+	reputationNone reputationAction = iota
+	reputationMute
+	reputationDisconnect
+)
+
+// recentMessage is a message a peer sent lately, by a hash of its text
+type recentMessage struct {
+	hash uint64
+	at   time.Time
+}
+
+// peerReputation is the standing of one peer
+type peerReputation struct {
+	score        float64
+	updated      time.Time // When score was last brought up to date
+	tokens       float64   // Messages the peer may send before it is over the rate
+	recent       []recentMessage
+	muted        bool      // Muted for its score, and told so
+	cooldownEnds time.Time // Refused until then after being disconnected
+	offences     map[string]int
+}
+
+// ReputationInfo is a peer's standing, for /whois
+type ReputationInfo struct {
+	Score        float64        `json:"score"`
+	Muted        bool           `json:"muted,omitempty"`
+	CooldownEnds time.Time      `json:"cooldown_ends,omitzero"`
+	Offences     map[string]int `json:"offences,omitempty"`
+}
+
+// String formats the standing on one line
+func (info ReputationInfo) String() string {
+	line := fmt.Sprintf("%.0f/%.0f", info.Score, reputationMax)
+	if len(info.Offences) > 0 {
+		names := make([]string, 0, len(info.Offences))
+		for name := range info.Offences {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		counts := make([]string, len(names))
+		for i, name := range names {
+			counts[i] = fmt.Sprintf("%d× %s", info.Offences[name], name)
+		}
+		line += " (" + strings.Join(counts, ", ") + ")"
+	}
+	if info.Muted {
+		line += ", auto-muted"
+	}
+	if !info.CooldownEnds.IsZero() {
+		line += fmt.Sprintf(", refused until %s", info.CooldownEnds.Format("15:04:05"))
+	}
+	return line
+}
+
+// Reputation tracks how peers behave, keyed by fingerprint where one is known and node ID
+// otherwise, so a peer can't shed a bad score by reconnecting. It is kept for this run only.
+type Reputation struct {
+	mutex  sync.Mutex
+	config reputationSettings
+	peers  map[string]*peerReputation
+	now    func() time.Time // Tests can substitute their own clock
+}
+
+// NewReputation creates a tracker with the default settings
+func NewReputation() *Reputation {
+	return &Reputation{
+		config: defaultReputationSettings,
+		peers:  make(map[string]*peerReputation),
+		now:    time.Now,
+	}
+}
+
+// Configure applies the config file's settings, keeping the scores peers have
+func (r *Reputation) Configure(config *ReputationConfig) error {
+	settings, err := config.settings()
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.config = settings
+	return nil
+}
+
+// get returns a peer's standing brought up to date, creating it if needed. The caller must hold
+// the mutex.
+func (r *Reputation) get(key string) *peerReputation {
+	now := r.now()
+	pr, exists := r.peers[key]
+	if !exists {
+		pr = &peerReputation{
+			score:    reputationMax,
+			updated:  now,
+			tokens:   float64(r.config.burst),
+			offences: make(map[string]int),
+		}
+		r.peers[key] = pr
+		r.forgetIdle(now)
+		return pr
+	}
+
+	elapsed := now.Sub(pr.updated)
+	if elapsed <= 0 {
+		return pr
+	}
+	if r.config.halfLife > 0 {
+		halfLives := elapsed.Seconds() / r.config.halfLife.Seconds()
+		pr.score = reputationMax - (reputationMax-pr.score)*math.Pow(0.5, halfLives)
+	}
+	pr.tokens = min(pr.tokens+elapsed.Minutes()*r.config.ratePerMinute, float64(r.config.burst))
+	pr.updated = now
+	if pr.muted && pr.score >= r.config.muteBelow {
+		pr.muted = false
+		log.Printf("Reputation of %s recovered to %.0f; no longer auto-muted", key, pr.score)
+	}
+	return pr
+}
+
+// forgetIdle drops peers that have nothing against them and haven't been heard from in a while.
+// The caller must hold the mutex.
+func (r *Reputation) forgetIdle(now time.Time) {
+	for key, pr := range r.peers {
+		if now.Sub(pr.updated) > reputationForgetAfter && now.After(pr.cooldownEnds) {
+			delete(r.peers, key)
+		}
+	}
+}
+
+// penalize takes points off a peer for an offence, returning what its new score calls for. A peer
+// is muted, or disconnected, once each time it drops under the threshold. The caller must hold
+// the mutex.
+func (r *Reputation) penalize(key string, pr *peerReputation, offence string, points float64) reputationAction {
+	pr.offences[offence]++
+	pr.score = max(pr.score-points, reputationFloor)
+	switch {
+	case pr.score < r.config.disconnectBelow && pr.cooldownEnds.Before(r.now()):
+		pr.cooldownEnds = r.now().Add(r.config.cooldown)
+		pr.muted = true
+		log.Printf("Reputation of %s fell to %.0f after a %s; disconnecting", key, pr.score, offence)
+		return reputationDisconnect
+	case pr.score < r.config.muteBelow && !pr.muted:
+		pr.muted = true
+		log.Printf("Reputation of %s fell to %.0f after a %s; auto-muting", key, pr.score, offence)
+		return reputationMute
+	}
+	return reputationNone
+}
+
+// Message scores a text message from a peer: for being one too many identical messages within
+// the repeat window, and for going over the rate once the burst allowance is spent
+func (r *Reputation) Message(key, text string) reputationAction {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.config.off {
+		return reputationNone
+	}
+	pr := r.get(key)
+	action := reputationNone
+	if !pr.cooldownEnds.IsZero() && r.now().Before(pr.cooldownEnds) {
+		action = reputationDisconnect // A connection admission couldn't stop, such as a legacy one
+	}
+
+	hasher := fnv.New64a()
+	hasher.Write([]byte(strings.TrimSpace(text)))
+	hash := hasher.Sum64()
+	now := r.now()
+	kept := pr.recent[:0]
+	repeats := 0
+	for _, recent := range pr.recent {
+		if now.Sub(recent.at) <= r.config.repeatWindow {
+			kept = append(kept, recent)
+			if recent.hash == hash {
+				repeats++
+			}
+		}
+	}
+	pr.recent = append(kept, recentMessage{hash: hash, at: now})
+	if len(pr.recent) > reputationRecentLimit {
+		pr.recent = pr.recent[len(pr.recent)-reputationRecentLimit:]
+	}
+
+	if repeats >= r.config.repeatsAllowed {
+		action = max(action, r.penalize(key, pr, offenceRepeat, r.config.repeatPenalty))
+	}
+	if pr.tokens >= 1 {
+		pr.tokens--
+	} else {
+		action = max(action, r.penalize(key, pr, offenceRate, r.config.ratePenalty))
+	}
+	return action
+}
+
+// Offence scores a failed signature, an oversized message or a message that crashed a handler
+func (r *Reputation) Offence(key, offence string) reputationAction {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.config.off {
+		return reputationNone
+	}
+	points := r.config.signaturePenalty
+	switch offence {
+	case offenceOversized:
+		points = r.config.oversizedPenalty
+	case offenceCrash:
+		points = r.config.crashPenalty
+	}
+	return r.penalize(key, r.get(key), offence, points)
+}
+
+// Muted reports whether a peer's score has it muted
+func (r *Reputation) Muted(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.config.off {
+		return false
+	}
+	if _, exists := r.peers[key]; !exists {
+		return false
+	}
+	return r.get(key).muted
+}
+
+// CoolingDown returns how much longer a disconnected peer is refused, or zero
+func (r *Reputation) CoolingDown(key string) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	pr, exists := r.peers[key]
+	if r.config.off || !exists {
+		return 0
+	}
+	return max(pr.cooldownEnds.Sub(r.now()), 0)
+}
+
+// Get returns a peer's standing; a peer never scored has a clean one
+func (r *Reputation) Get(key string) ReputationInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.peers[key]; !exists {
+		return ReputationInfo{Score: reputationMax}
+	}
+	pr := r.get(key)
+	info := ReputationInfo{Score: pr.score, Muted: pr.muted && !r.config.off}
+	if pr.cooldownEnds.After(r.now()) {
+		info.CooldownEnds = pr.cooldownEnds
+	}
+	if len(pr.offences) > 0 {
+		info.Offences = make(map[string]int, len(pr.offences))
+		for name, count := range pr.offences {
+			info.Offences[name] = count
+		}
+	}
+	return info
+}
+
+// Forgive clears a peer's record, for /unmute
+func (r *Reputation) Forgive(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, exists := r.peers[key]
+	delete(r.peers, key)
+	return exists
+}
+
+// reputationKey is what a peer's reputation is kept under: the key its connection proved or the
+// one we hold for its node ID, or failing both the node ID
+func (en *EnhancedNode) reputationKey(connID, nodeID string) string {
+	if fingerprint, authenticated := en.connFingerprint(connID); authenticated {
+		return fingerprint
+	}
+	if fingerprint, known := en.cryptoManager.PeerFingerprint(nodeID); known {
+		return fingerprint
+	}
+	return reputationNodeKeyPrefix + nodeID
+}
+
+// scoreMessage scores a text message from a peer
+func (en *EnhancedNode) scoreMessage(connID, nodeID, text string) {
+	key := en.reputationKey(connID, nodeID)
+	en.applyReputation(connID, nodeID, key, en.reputation.Message(key, text))
+}
+
+// scoreOffence scores a failed signature, an oversized message or a crash from a connection
+func (en *EnhancedNode) scoreOffence(connID, nodeID, offence string) {
+	if nodeID == "" {
+		if _, resolved, err := en.resolvePeer(connID); err == nil {
+			nodeID = resolved
+		}
+	}
+	key := en.reputationKey(connID, nodeID)
+	en.applyReputation(connID, nodeID, key, en.reputation.Offence(key, offence))
+}
+
+// applyReputation mutes or disconnects a peer whose score calls for it, saying so in the UI and
+// the audit log
+func (en *EnhancedNode) applyReputation(connID, nodeID, key string, action reputationAction) {
+	if action == reputationNone {
+		return
+	}
+	info := en.reputation.Get(key)
+	cooldownEnds := info.CooldownEnds
+	info.Muted, info.CooldownEnds = false, time.Time{} // Said in the message instead
+	label := en.peerLabel(nodeID)
+	switch action {
+	case reputationMute:
+		en.audit(AuditEntry{
+			Event: auditSpamMuted, Severity: auditWarning, Peer: nodeID, Connection: connID,
+			Detail: fmt.Sprintf("auto-muted %s: reputation %s", nodeID, info),
+		})
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content: []byte(fmt.Sprintf("🔇 Auto-muted %s for looking like spam, reputation %s; it lifts as the score "+
+				"recovers, or /unmute %s now", label, info, nodeID)),
+		})
+	case reputationDisconnect:
+		en.audit(AuditEntry{
+			Event: auditSpamDisconnected, Severity: auditWarning, Peer: nodeID, Connection: connID,
+			Detail: fmt.Sprintf("disconnected %s: reputation %s", nodeID, info),
+		})
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content: []byte(fmt.Sprintf("⛔ Disconnected %s for spam, reputation %s; it is refused until %s, or /unmute %s to let it back",
+				label, info, cooldownEnds.Format("15:04:05"), nodeID)),
+		})
+		en.disconnectKey(key, connID)
+	}
+}
+
+// disconnectKey closes every connection of the peer a reputation is kept for, connID included
+func (en *EnhancedNode) disconnectKey(key, connID string) {
+	for _, peer := range en.snapshotPeers() {
+		nodeID := ""
+		if _, resolved, err := en.resolvePeer(peer.ID); err == nil {
+			nodeID = resolved
+		}
+		if peer.ID == connID || en.reputationKey(peer.ID, nodeID) == key {
+			peer.once.Do(func() {
+				close(peer.Done)
+			})
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReputation is a tracker with the default settings on a fake clock
+func testReputation() (*Reputation, *fakeClock) {
+	clock := newFakeClock()
+	r := NewReputation()
+	r.now = clock.Now
+	return r, clock
+}
+
+// TestReputationHonestTraffic plays the traffic of people chatting, however fast or repetitive,
+// and checks none of it costs them anything that shows
+func TestReputationHonestTraffic(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		messages func(send func(text string, after time.Duration))
+	}{
+		{"pasted lines", func(send func(string, time.Duration)) {
+			for i := range 20 {
+				send(fmt.Sprintf("line %d of a stack trace", i), 0)
+			}
+		}},
+		{"fast chat for ten minutes", func(send func(string, time.Duration)) {
+			for i := range 300 {
+				send(fmt.Sprintf("message %d", i), 2*time.Second)
+			}
+		}},
+		{"the same reply now and then", func(send func(string, time.Duration)) {
+			for i := range 60 {
+				send("lol", 20*time.Second)
+				send(fmt.Sprintf("and %d", i), time.Second)
+			}
+		}},
+		{"bursts of pasting between chat", func(send func(string, time.Duration)) {
+			for burst := range 5 {
+				for i := range 15 {
+					send(fmt.Sprintf("burst %d line %d", burst, i), 0)
+				}
+				for i := range 10 {
+					send(fmt.Sprintf("chat %d", i), 6*time.Second)
+				}
+			}
+		}},
+		{"a log piped in at ten lines a second for 30 seconds", func(send func(string, time.Duration)) {
+			for i := range 300 {
+				send(fmt.Sprintf("GET /api/items/%d 200", i), 100*time.Millisecond)
+			}
+		}},
+		{"a few identical messages in a row", func(send func(string, time.Duration)) {
+			for range 3 {
+				send("ok", time.Second)
+			}
+		}},
+	} {
+		r, clock := testReputation()
+		tc.messages(func(text string, after time.Duration) {
+			clock.Advance(after)
+			if action := r.Message("peer", text); action != reputationNone {
+				t.Fatalf("%s: %q after %s cost action %d", tc.name, text, after, action)
+			}
+		})
+		if info := r.Get("peer"); info.Score < defaultReputationSettings.muteBelow || info.Muted {
+			t.Errorf("%s: reputation %s", tc.name, info)
+		}
+	}
+}
+
+// TestReputationSpam mutes a peer repeating itself, then disconnects it, refuses it for the
+// cooldown and lets the score come back
+func TestReputationSpam(t *testing.T) {
+	r, clock := testReputation()
+	var actions []reputationAction
+	for range 14 {
+		actions = append(actions, r.Message("spammer", "buy now"))
+	}
+	// Three identical messages are allowed; the next five take it to 50, the next under it, and five more
+	// under 0
+	want := []reputationAction{0, 0, 0, 0, 0, 0, 0, 0, reputationMute, 0, 0, 0, 0, reputationDisconnect}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Errorf("actions %v, want %v", actions, want)
+	}
+	info := r.Get("spammer")
+	if !info.Muted || info.Offences[offenceRepeat] != 11 || info.CooldownEnds.IsZero() {
+		t.Errorf("after the flood: %+v", info)
+	}
+	if !strings.HasPrefix(info.String(), "-10/100 (11× repeated message), auto-muted, refused until ") {
+		t.Errorf("standing shown as %q", info.String())
+	}
+	if !r.Muted("spammer") || r.CoolingDown("spammer") != defaultReputationSettings.cooldown {
+		t.Errorf("muted %v, cooling down for %s", r.Muted("spammer"), r.CoolingDown("spammer"))
+	}
+	if action := r.Message("spammer", "something else"); action != reputationDisconnect {
+		t.Errorf("a message during the cooldown: action %d, want a disconnect", action)
+	}
+
+	// Half the points come back in a half-life, leaving it muted; by the end of the cooldown,
+	// two half-lives on, it is over the threshold again
+	clock.Advance(defaultReputationSettings.halfLife)
+	if !r.Muted("spammer") || r.CoolingDown("spammer") != defaultReputationSettings.cooldown/2 {
+		t.Errorf("a half-life on: %s", r.Get("spammer"))
+	}
+	clock.Advance(defaultReputationSettings.cooldown / 2)
+	if r.Muted("spammer") || r.CoolingDown("spammer") != 0 {
+		t.Errorf("after the cooldown: %s", r.Get("spammer"))
+	}
+
+	if !r.Forgive("spammer") || r.Get("spammer").Score != reputationMax || r.Forgive("spammer") {
+		t.Error("forgiving didn't clear the record")
+	}
+	if r.Muted("stranger") || r.CoolingDown("stranger") != 0 || r.Get("stranger").Score != reputationMax {
+		t.Error("a peer never scored doesn't have a clean record")
+	}
+}
+
+// TestReputationRate mutes a peer sending distinct messages at ten times the rate, once its burst
+// allowance is spent
+func TestReputationRate(t *testing.T) {
+	r, clock := testReputation()
+	muted, disconnected := 0, 0
+	for i := range 300 {
+		switch r.Message("flooder", fmt.Sprintf("message %d", i)) {
+		case reputationMute:
+			muted = i + 1
+		case reputationDisconnect:
+			disconnected = i + 1
+		}
+		clock.Advance(10 * time.Millisecond)
+	}
+	if muted <= defaultReputationSettings.burst || disconnected <= muted {
+		t.Errorf("muted at message %d, disconnected at %d", muted, disconnected)
+	}
+	if info := r.Get("flooder"); info.Offences[offenceRate] == 0 || info.Offences[offenceRepeat] != 0 {
+		t.Errorf("offences %v", info.Offences)
+	}
+}
+
+// TestReputationOffences costs each kind of offence its penalty
+func TestReputationOffences(t *testing.T) {
+	for _, tc := range []struct {
+		offence    string
+		mute, kick int // The offence that mutes, and that disconnects
+	}{
+		{offenceSignature, 3, 5},
+		{offenceOversized, 3, 6},
+		{offenceCrash, 2, 3},
+	} {
+		r, _ := testReputation()
+		for i := 1; i <= tc.kick; i++ {
+			action := r.Offence("peer", tc.offence)
+			want := reputationNone
+			switch i {
+			case tc.mute:
+				want = reputationMute
+			case tc.kick:
+				want = reputationDisconnect
+			}
+			if action != want {
+				t.Errorf("%s %d: action %d, want %d", tc.offence, i, action, want)
+			}
+		}
+	}
+
+	r, _ := testReputation()
+	if err := r.Configure(&ReputationConfig{Off: true}); err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		if r.Offence("peer", offenceCrash) != reputationNone || r.Message("peer", "spam") != reputationNone {
+			t.Fatal("scored a peer with reputation off")
+		}
+	}
+}
+
+// TestReputationConfig takes thresholds from the config file and refuses ones that can't work
+func TestReputationConfig(t *testing.T) {
+	r, _ := testReputation()
+	if err := r.Configure(&ReputationConfig{MuteBelow: 95, RepeatsAllowed: 1, Cooldown: "1m"}); err != nil {
+		t.Fatal(err)
+	}
+	r.Message("peer", "hi")
+	if r.Message("peer", "hi") != reputationMute || r.CoolingDown("peer") != 0 {
+		t.Error("a repeat over an allowance of 1 didn't mute under a threshold of 95")
+	}
+
+	for _, tc := range []struct {
+		config ReputationConfig
+		want   string
+	}{
+		{ReputationConfig{MuteBelow: 101}, "every peer would be muted"},
+		{ReputationConfig{MuteBelow: 20, DisconnectBelow: 30}, "must be under mute_below"},
+		{ReputationConfig{DisconnectBelow: -100}, "lowest a score goes"},
+		{ReputationConfig{Burst: -1}, "can't be negative"},
+		{ReputationConfig{CrashPenalty: -1}, "can't be negative"},
+		{ReputationConfig{Cooldown: "soon"}, `invalid cooldown "soon"`},
+		{ReputationConfig{HalfLife: "-1m"}, "invalid half_life"},
+	} {
+		if err := r.Configure(&tc.config); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%+v: %v, want an error saying %q", tc.config, err, tc.want)
+		}
+	}
+}
+
+// TestSpammerMutedAndDisconnected floods a node with one message until it mutes the sender, then
+// drops it and refuses it until the user forgives it with /unmute
+func TestSpammerMutedAndDisconnected(t *testing.T) {
+	tn, a, b := connectedPair(t)
+
+	for range 14 {
+		if _, err := b.SendEncryptedText("buy now"); err != nil {
+			t.Fatal(err)
+		}
+		// Faster than a reads, but not so fast b's queue overflows
+		waitFor(t, "b's send queue to drain", func() bool {
+			for _, peer := range b.snapshotPeers() {
+				if len(peer.Send) > 0 {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	waitForNotice(t, a, "🔇 Auto-muted "+b.ID)
+	waitForNotice(t, a, "⛔ Disconnected "+b.ID+" for spam")
+	waitFor(t, "a to drop b", func() bool { return peerCount(a) == 0 && peerCount(b) == 0 })
+	if shown := len(loggedTexts(a, b.ID)); shown != 8 {
+		t.Errorf("a showed %d of b's messages, want the 8 before it was muted", shown)
+	}
+	a.handleEnhancedCLICommand("/whois "+b.ID, a.ID)
+	waitForNotice(t, a, "(11× repeated message), auto-muted, refused until")
+	events := map[string]bool{}
+	for _, entry := range a.auditLog.Recent(auditRecentLimit) {
+		if entry.Peer == b.ID {
+			events[entry.Event] = true
+		}
+	}
+	if !events[auditSpamMuted] || !events[auditSpamDisconnected] {
+		t.Errorf("audit log events for b: %v", events)
+	}
+
+	// b coming back is refused; once a forgives it, it is let in
+	_ = b.connectToPeer(a.ID)
+	waitFor(t, "a to refuse b", func() bool {
+		for _, entry := range a.auditLog.Recent(auditRecentLimit) {
+			if entry.Event == auditConnectionRefused && strings.Contains(entry.Detail, "disconnected for spam") {
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(t, "b to be dropped", func() bool { return peerCount(b) == 0 })
+	a.handleEnhancedCLICommand("/unmute "+b.ID, a.ID)
+	waitForNotice(t, a, "🔊 Unmuted "+b.ID+", and cleared its spam reputation")
+	tn.connect(b, a)
+	waitFor(t, "b to be let back in", func() bool {
+		peers := b.snapshotPeers()
+		if len(peers) != 1 || peerCount(a) != 1 {
+			return false
+		}
+		return peers[0].nodeID() == a.ID
+	})
+	if _, err := b.SendEncryptedText("sorry"); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, a, b.ID, "sorry")
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxRoomControls    = 24              // Controls a room keeps: its creation, op grants, kicks, the topic and its keys
+	maxRoomMembers     = 128             // Member keys a room keeps, so its state fits one message
+	maxRoomTopicBytes  = 200             // Longest topic
+	roomControlMaxSkew = 5 * time.Minute // Controls dated further ahead than this are refused
+)
+
+// RoomControl is an op's signed change to a room: its creation, which makes the creator the
+// first op, a topic, op granted to another key, a member kicked, or new room keys. Members pass
+// controls on unchanged, so each can check the signature, and that the signer is an op, before
+// applying one.
+type RoomControl struct {
+	Room        string `json:"room"`
+	Action      string `json:"action"`           // create, topic, op, kick or rekey
+	Target      string `json:"target,omitempty"` // Fingerprint made an op or kicked, or the roomKeyID of new keys
+	Topic       string `json:"topic,omitempty"`
+	Timestamp   int64  `json:"timestamp"`   // Unix milliseconds when signed
+	Fingerprint string `json:"fingerprint"` // Of the key that signed the control
+	PublicKey   string `json:"public_key"`  // PEM, so ops we never connected to can be checked
+	Signature   string `json:"signature"`   // Over signedData
+}
+
+// signedData is the part of a control covered by its signature
+func (c RoomControl) signedData() []byte {
+	data, _ := json.Marshal(struct {
+		Room        string `json:"room"`
+		Action      string `json:"action"`
+		Target      string `json:"target"`
+		Topic       string `json:"topic"`
+		Timestamp   int64  `json:"timestamp"`
+		Fingerprint string `json:"fingerprint"`
+	}{c.Room, c.Action, c.Target, c.Topic, c.Timestamp, c.Fingerprint})
+	return data
+}
+
+// newRoomControl signs a control of ours
+func newRoomControl(cm *CryptoManager, room, action, target, topic string, now time.Time) (RoomControl, error) {
+	control := RoomControl{
+		Room:        room,
+		Action:      action,
+		Target:      target,
+		Topic:       topic,
+		Timestamp:   now.UnixMilli(),
+		Fingerprint: cm.Fingerprint(),
+	}
+	signature, err := cm.SignPlaintext(control.signedData())
+	if err != nil {
+		return RoomControl{}, err
+	}
+	control.PublicKey = signature.PublicKeyPEM
+	control.Signature = signature.Signature
+	return control, nil
+}
+
+// verify checks a received control's contents, date and signature; whether its signer may make
+// it depends on the controls before it (joinedRoom.addControl)
+func (c RoomControl) verify(now time.Time) error {
+	switch c.Action {
+	case "create":
+	case "topic":
+		if len(c.Topic) > maxRoomTopicBytes {
+			return fmt.Errorf("topic of %d bytes", len(c.Topic))
+		}
+	case "op", "kick":
+		if fingerprint, ok := parseFingerprint(c.Target); !ok || fingerprint != c.Target {
+			return fmt.Errorf("invalid target %q", c.Target)
+		}
+	case "rekey":
+		if id, err := hex.DecodeString(c.Target); err != nil || len(id) != sha256.Size || hex.EncodeToString(id) != c.Target {
+			return fmt.Errorf("invalid key ID %q", c.Target)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", c.Action)
+	}
+	if time.UnixMilli(c.Timestamp).Sub(now) > roomControlMaxSkew {
+		return errors.New("dated in the future")
+	}
+
+	publicKey, err := parsePublicKeyPEM(c.PublicKey)
+	if err != nil {
+		return err
+	}
+	if keyFingerprint(publicKey) != c.Fingerprint {
+		return errors.New("fingerprint doesn't match the signing key")
+	}
+	return verifySignature(publicKey, c.signedData(), c.Signature)
+}
+
+// before reports whether a control was signed before another, the fingerprint breaking ties
+func (c RoomControl) before(other RoomControl) bool {
+	if c.Timestamp != other.Timestamp {
+		return c.Timestamp < other.Timestamp
+	}
+	return c.Fingerprint < other.Fingerprint
+}
+
+// roomKeyID names a room key in a rekey control without giving it away
+func roomKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("p2pchat room key "), key...))
+	return hex.EncodeToString(sum[:])
+}
+
+// roomModeration is what a room's controls come to
+type roomModeration struct {
+	creator string
+	ops     map[string]string // Fingerprint -> the op that granted it; the creator granted itself
+	kicked  map[string]string // Fingerprint -> the op that kicked it
+	topic   RoomControl       // The newest topic; Action is empty until one is set
+	rekey   RoomControl       // The newest keys an op gave the room; Action is empty while it has those of its passphrase
+}
+
+// moderate applies a room's controls in order, skipping those whose signer wasn't an op by then
+func moderate(controls []RoomControl) roomModeration {
+	m := roomModeration{ops: make(map[string]string), kicked: make(map[string]string)}
+	for _, control := range controls {
+		if control.Action == "create" {
+			if m.creator == "" {
+				m.creator = control.Fingerprint
+				m.ops[control.Fingerprint] = control.Fingerprint
+			}
+			continue
+		}
+		if m.ops[control.Fingerprint] == "" {
+			continue
+		}
+		switch control.Action {
+		case "op":
+			if m.ops[control.Target] == "" && m.kicked[control.Target] == "" {
+				m.ops[control.Target] = control.Fingerprint
+			}
+		case "kick":
+			if m.ops[control.Target] == "" && m.kicked[control.Target] == "" {
+				m.kicked[control.Target] = control.Fingerprint
+			}
+		case "topic":
+			if control.Timestamp >= m.topic.Timestamp {
+				m.topic = control
+			}
+		case "rekey":
+			if m.rekey.Action == "" || m.rekey.before(control) {
+				m.rekey = control
+			}
+		}
+	}
+	return m
+}
+
+// addControl takes a control that verified, reporting whether it took effect. A creation takes
+// the place of another that no op has used yet if it is older: two peers may start a room while
+// apart, and this has them settle on the same creator when they meet.
+func (jr *joinedRoom) addControl(control RoomControl) bool {
+	for _, held := range jr.controls {
+		if held.Signature == control.Signature {
+			return false
+		}
+	}
+
+	m := moderate(jr.controls)
+	switch {
+	case control.Action == "create" && m.creator == "":
+		jr.controls = []RoomControl{control}
+		return true
+	case control.Action == "create":
+		if len(jr.controls) > 1 || !control.before(jr.controls[0]) {
+			return false
+		}
+		jr.controls = []RoomControl{control}
+		return true
+	case m.ops[control.Fingerprint] == "":
+		return false
+	case control.Action == "op" || control.Action == "kick":
+		if m.ops[control.Target] != "" || m.kicked[control.Target] != "" {
+			return false
+		}
+	case control.Action == "topic":
+		if m.topic.Action != "" && control.Timestamp < m.topic.Timestamp {
+			return false
+		}
+		// Only the newest topic counts, so only it is kept
+		jr.controls = slices.DeleteFunc(jr.controls, func(held RoomControl) bool { return held.Action == "topic" })
+	case control.Action == "rekey":
+		if m.rekey.Action != "" && !m.rekey.before(control) {
+			return false
+		}
+		jr.controls = slices.DeleteFunc(jr.controls, func(held RoomControl) bool { return held.Action == "rekey" })
+	}
+	if len(jr.controls) >= maxRoomControls {
+		log.Printf("%s holds %d controls; dropped one more", jr.Name, len(jr.controls))
+		return false
+	}
+
+	jr.controls = append(jr.controls, control)
+	if control.Action == "kick" {
+		delete(jr.members, control.Target)
+		delete(jr.known, control.Target)
+	}
+	return true
+}
+
+// Moderation returns what the controls of a room we are in come to
+func (rb *RoomBook) Moderation(name string) (roomModeration, bool) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[name]
+	if !exists {
+		return roomModeration{}, false
+	}
+	return moderate(joined.controls), true
+}
+
+// Kicked reports whether an op kicked a key from a room
+func (rb *RoomBook) Kicked(name, fingerprint string) bool {
+	moderation, _ := rb.Moderation(name)
+	return moderation.kicked[fingerprint] != ""
+}
+
+// AddControls takes, in order, the controls of a room that verify, returning those that took
+// effect. A kicked member stops being one.
+func (rb *RoomBook) AddControls(name string, controls []RoomControl, now time.Time) []RoomControl {
+	var verified []RoomControl
+	for _, control := range controls {
+		if control.Room != name {
+			continue
+		}
+		if err := control.verify(now); err != nil {
+			log.Printf("Invalid %s control for %s: %v", control.Action, name, err)
+			continue
+		}
+		verified = append(verified, control)
+	}
+
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[name]
+	if !exists {
+		return nil
+	}
+	var added []RoomControl
+	for _, control := range verified {
+		if joined.addControl(control) {
+			added = append(added, control)
+		}
+	}
+	if len(added) > 0 {
+		if err := rb.save(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return added
+}
+
+// AddKnown records member keys another member knows of, reporting whether any were new
+func (rb *RoomBook) AddKnown(name, self string, fingerprints []string) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[name]
+	if !exists {
+		return false
+	}
+	kicked := moderate(joined.controls).kicked
+	learned := false
+	for _, fingerprint := range fingerprints {
+		if parsed, ok := parseFingerprint(fingerprint); !ok || parsed != fingerprint {
+			continue
+		}
+		if fingerprint == self || joined.known[fingerprint] || kicked[fingerprint] != "" || len(joined.known) >= maxRoomMembers {
+			continue
+		}
+		joined.known[fingerprint] = true
+		learned = true
+	}
+	if learned {
+		if err := rb.save(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return learned
+}
+
+// State returns what we know of a room to send its members: we are one of the member keys
+func (rb *RoomBook) State(name, self string) (roomState, bool) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[name]
+	if !exists {
+		return roomState{}, false
+	}
+	members := joined.knownKeys()
+	if !joined.known[self] {
+		members = append(members, self)
+		sort.Strings(members)
+	}
+	return roomState{Controls: slices.Clone(joined.controls), Members: members}, true
+}
+
+// roomState is what members gossip of a room, sealed with its key: the ops' controls, in order,
+// and the member keys they know of
+type roomState struct {
+	Controls []RoomControl `json:"controls,omitempty"`
+	Members  []string      `json:"members,omitempty"`
+}
+
+// RoomInfo is a room we are in, as the TUI and the control API show it
+type RoomInfo struct {
+	Name      string   `json:"name"`
+	Topic     string   `json:"topic,omitempty"`
+	Protected bool     `json:"protected"`
+	Op        bool     `json:"op"`      // We are one of its ops
+	Members   []string `json:"members"` // Node IDs of the members connected that proved the passphrase
+}
+
+// Rooms returns the rooms we are in (chatBackend)
+func (en *EnhancedNode) Rooms() []RoomInfo {
+	self := en.cryptoManager.Fingerprint()
+	names := en.rooms.Names()
+	rooms := make([]RoomInfo, 0, len(names))
+	for _, name := range names {
+		room, joined := en.rooms.Get(name)
+		moderation, _ := en.rooms.Moderation(name)
+		if !joined {
+			continue // Left meanwhile
+		}
+		rooms = append(rooms, RoomInfo{
+			Name:      name,
+			Topic:     sanitizeLine(moderation.topic.Topic),
+			Protected: room.Protected,
+			Op:        moderation.ops[self] != "",
+			Members:   en.rooms.Members(name),
+		})
+	}
+	return rooms
+}
+
+// mergeRoomState takes what a member knows of a room, and passes on to the other members
+// connected whatever was news to us
+func (en *EnhancedNode) mergeRoomState(nodeID, name string, plaintext []byte) {
+	var state roomState
+	if err := json.Unmarshal(plaintext, &state); err != nil || len(state.Controls) > maxRoomControls || len(state.Members) > maxRoomMembers {
+		log.Printf("Invalid state of %s from %s", name, nodeID)
+		return
+	}
+	added := en.rooms.AddControls(name, state.Controls, en.wallClock.Now())
+	learned := en.rooms.AddKnown(name, en.cryptoManager.Fingerprint(), state.Members)
+	en.announceRoomControls(name, added)
+	if len(added) > 0 || learned {
+		en.sendRoomState(name, en.rooms.Members(name), nodeID)
+	}
+}
+
+// announceRoomControls tells the user about the controls of other ops that took effect; new keys
+// are told of as they arrive. Kicked ourselves, we leave the room: its members no longer take our
+// messages or send us theirs.
+func (en *EnhancedNode) announceRoomControls(name string, controls []RoomControl) {
+	self := en.cryptoManager.Fingerprint()
+	for _, control := range controls {
+		if control.Fingerprint == self {
+			continue
+		}
+		by := en.keyLabel(control.Fingerprint)
+		switch control.Action {
+		case "create":
+			en.roomNotice(name, fmt.Sprintf("👑 %s started %s and is its first op", by, name))
+		case "topic":
+			en.roomNotice(name, fmt.Sprintf("📌 %s set the topic of %s: %s", by, name, sanitizeLine(control.Topic)))
+		case "op":
+			target := en.keyLabel(control.Target)
+			if control.Target == self {
+				target = "you"
+			}
+			en.roomNotice(name, fmt.Sprintf("⭐ %s made %s an op of %s", by, target, name))
+		case "kick":
+			if control.Target != self {
+				en.roomNotice(name, fmt.Sprintf("👢 %s kicked %s from %s", by, en.keyLabel(control.Target), name))
+				continue
+			}
+			en.rooms.Leave(name)
+			en.roomNotice(name, fmt.Sprintf("👢 %s kicked you from %s; its members no longer send you its messages", by, name))
+			return
+		}
+	}
+}
+
+// sendRoomState sends what we know of a room to those of the given members that are connected
+func (en *EnhancedNode) sendRoomState(name string, nodeIDs []string, except string) {
+	room, joined := en.rooms.Get(name)
+	state, _ := en.rooms.State(name, en.cryptoManager.Fingerprint())
+	if !joined {
+		return
+	}
+	data, err := json.Marshal(state)
+	var sealed []byte
+	if err == nil {
+		sealed, err = room.seal(data)
+	}
+	if err != nil {
+		log.Printf("Failed to seal the state of %s: %v", name, err)
+		return
+	}
+	for _, nodeID := range nodeIDs {
+		if nodeID == except {
+			continue
+		}
+		if _, _, err := en.resolvePeer(nodeID); err == nil {
+			en.sendRoomMessage(nodeID, roomMessage{Type: "state", Room: name, Sealed: sealed})
+		}
+	}
+}
+
+// publishRoomControl signs a control of ours, takes it, and sends the room's state to the members
+// connected, a member it kicks included
+func (en *EnhancedNode) publishRoomControl(name, action, target, topic string) error {
+	control, err := newRoomControl(en.cryptoManager, name, action, target, topic, en.wallClock.Now())
+	if err != nil {
+		return err
+	}
+	members := en.rooms.Members(name)
+	if added := en.rooms.AddControls(name, []RoomControl{control}, en.wallClock.Now()); len(added) == 0 {
+		return fmt.Errorf("%s holds as many ops and kicks as it can (%d changes)", name, maxRoomControls)
+	}
+	en.sendRoomState(name, members, "")
+	return nil
+}
+
+// createRoom makes us the creator, and first op, of a room we start
+func (en *EnhancedNode) createRoom(name string) {
+	if err := en.publishRoomControl(name, "create", "", ""); err != nil {
+		en.roomNotice(name, fmt.Sprintf("❌ Failed to start %s: %v", name, err))
+		return
+	}
+	en.roomNotice(name, fmt.Sprintf("👑 You started %s and are its op: /room topic, /room op and /room kick are yours to use", name))
+}
+
+// moderateRoom handles /room topic, op and kick, returning the reply
+func (en *EnhancedNode) moderateRoom(action, name, arg string) string {
+	moderation, joined := en.rooms.Moderation(name)
+	if !joined || arg == "" {
+		what := "<peer>"
+		if action == "topic" {
+			what = "<text>"
+		}
+		return fmt.Sprintf("Usage: /room %s <#room> %s (in a room you are an op of)", action, what)
+	}
+	self := en.cryptoManager.Fingerprint()
+	if moderation.ops[self] == "" {
+		return fmt.Sprintf("❌ Only ops of %s can do that; /room list shows who they are", name)
+	}
+
+	var target, topic, label string
+	if action == "topic" {
+		topic = sanitizeLine(arg)
+		if len(topic) > maxRoomTopicBytes {
+			return fmt.Sprintf("❌ A topic is at most %d bytes", maxRoomTopicBytes)
+		}
+	} else {
+		var err error
+		if target, label, err = en.roomTarget(arg); err != nil {
+			return fmt.Sprintf("❌ %v", err)
+		}
+		switch {
+		case target == self:
+			return fmt.Sprintf("❌ You are an op of %s already", name)
+		case moderation.ops[target] != "" && action == "op":
+			return fmt.Sprintf("❌ %s is an op of %s already", label, name)
+		case moderation.ops[target] != "":
+			return fmt.Sprintf("❌ %s is an op of %s, and ops can't be kicked", label, name)
+		case moderation.kicked[target] != "":
+			return fmt.Sprintf("❌ %s was kicked from %s", label, name)
+		}
+	}
+
+	if err := en.publishRoomControl(name, action, target, topic); err != nil {
+		return fmt.Sprintf("❌ %v", err)
+	}
+	switch action {
+	case "topic":
+		return fmt.Sprintf("📌 Set the topic of %s: %s", name, topic)
+	case "op":
+		return fmt.Sprintf("⭐ Made %s an op of %s", label, name)
+	}
+	// The kicked member holds the room key, so the members left change to one it doesn't
+	if err := en.rotateRoomKey(name); err != nil {
+		return fmt.Sprintf("👢 Kicked %s from %s, but failed to change its key: %v", label, name, err)
+	}
+	return fmt.Sprintf("👢 Kicked %s from %s and changed its key", label, name)
+}
+
+// roomTarget finds the key of a peer named to /room op or kick: connected, a contact, or given by
+// its fingerprint
+func (en *EnhancedNode) roomTarget(ref string) (string, string, error) {
+	if _, nodeID, err := en.resolvePeerRef(ref); err == nil {
+		if fingerprint := en.peerFingerprint(nodeID); fingerprint != "" {
+			return fingerprint, en.peerLabel(nodeID), nil
+		}
+		return "", "", fmt.Errorf("no key from %s yet", nodeID)
+	}
+	if contact, exists := en.contacts.Get(ref); exists && contact.Fingerprint != "" {
+		return contact.Fingerprint, contact.Alias, nil
+	}
+	if fingerprint, ok := parseFingerprint(ref); ok {
+		return fingerprint, en.keyLabel(fingerprint), nil
+	}
+	return "", "", fmt.Errorf("%s isn't connected, a contact or a key fingerprint", ref)
+}
+
+// keyLabel names the holder of a key for the user: the peer connected with it, its contact, or
+// the key itself
+func (en *EnhancedNode) keyLabel(fingerprint string) string {
+	en.peersMutex.RLock()
+	peer := en.Peers[fingerprint]
+	en.peersMutex.RUnlock()
+	if peer != nil && peer.nodeID() != "" {
+		return en.peerLabel(peer.nodeID())
+	}
+	if contact, exists := en.contacts.ForKey(fingerprint); exists {
+		return contact.Alias
+	}
+	return "key " + formatFingerprint(fingerprint)[:19]
+}
+
+// describeRoomModeration lists a room's topic, ops and kicked keys for /room list
+func (en *EnhancedNode) describeRoomModeration(name string) string {
+	moderation, _ := en.rooms.Moderation(name)
+	self := en.cryptoManager.Fingerprint()
+	labels := func(keys map[string]string) string {
+		names := make([]string, 0, len(keys))
+		for fingerprint := range keys {
+			if fingerprint == self {
+				names = append(names, "you")
+			} else {
+				names = append(names, en.keyLabel(fingerprint))
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, ", ")
+	}
+
+	var content strings.Builder
+	if moderation.topic.Action != "" {
+		content.WriteString(fmt.Sprintf("\n    Topic: %s", sanitizeLine(moderation.topic.Topic)))
+	}
+	if len(moderation.ops) > 0 {
+		content.WriteString(fmt.Sprintf("\n    Ops: %s", labels(moderation.ops)))
+	}
+	if len(moderation.kicked) > 0 {
+		content.WriteString(fmt.Sprintf("\n    Kicked: %s", labels(moderation.kicked)))
+	}
+	if state, joined := en.rooms.State(name, self); joined {
+		content.WriteString(fmt.Sprintf("\n    Member keys known: %d, yours included", len(state.Members)))
+	}
+	return content.String()
+}
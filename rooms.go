@@ -0,0 +1,1034 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	roomsFile          = "rooms.json"
+	roomKeyBytes       = 32
+	roomNonceBytes     = 32
+	roomJoinWait       = 10 * time.Second // How long /join waits for a member to confirm the passphrase before giving up
+	maxPendingRoomJoin = 64               // Join handshakes under way at once, ours and peers'
+)
+
+// roomName is what a room name may look like. The "#" keeps it apart from peers wherever a peer
+// is expected, such as /msg and conversation tabs.
+var roomName = regexp.MustCompile(`^#[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+// Room is a room we are in, as saved: the keys derived from its passphrase, or the newer message
+// key an op gave it. An open room has an empty passphrase, so anyone who knows its name can join.
+type Room struct {
+	Name      string `json:"name"`
+	AuthKey   []byte `json:"auth_key"` // Proves the passphrase to members, in HMACs over their challenges
+	Key       []byte `json:"key"`      // AES-256-GCM key room messages are sealed with; ops change it on a kick
+	Protected bool   `json:"protected,omitempty"`
+}
+
+// newRoom derives a room's keys from its passphrase. The name salts the derivation, so everyone
+// who joins with the same passphrase gets the same keys; PBKDF2 makes guessing it slow.
+func newRoom(name, passphrase string) (Room, error) {
+	secret, err := pbkdf2.Key(sha256.New, passphrase, []byte("p2pchat room "+name), passphraseIterations, roomKeyBytes)
+	if err != nil {
+		return Room{}, err
+	}
+	authKey, err := hkdf.Expand(sha256.New, secret, "room auth", roomKeyBytes)
+	if err != nil {
+		return Room{}, err
+	}
+	key, err := hkdf.Expand(sha256.New, secret, "room messages", roomKeyBytes)
+	if err != nil {
+		return Room{}, err
+	}
+	return Room{Name: name, AuthKey: authKey, Key: key, Protected: passphrase != ""}, nil
+}
+
+// valid reports whether a room received from a member has keys of the right size
+func (r Room) valid() bool {
+	return roomName.MatchString(r.Name) && len(r.AuthKey) == roomKeyBytes && len(r.Key) == roomKeyBytes
+}
+
+// proof is the HMAC that shows a peer knows the room's passphrase: over the step of the join it
+// answers, the nonces of both sides and both keys, so it can't be replayed elsewhere
+func (r Room) proof(step string, challenge, response []byte, prover, verifier string) []byte {
+	mac := hmac.New(sha256.New, r.AuthKey)
+	for _, part := range [][]byte{[]byte(step), []byte(r.Name), challenge, response, []byte(prover), []byte(verifier)} {
+		mac.Write(binary.BigEndian.AppendUint32(nil, uint32(len(part))))
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// seal encrypts room traffic with the room key; the room name is authenticated with it
+func (r Room) seal(plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, []byte(r.Name)), nil
+}
+
+// open decrypts room traffic sealed with the room key
+func (r Room) open(sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed room message too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(r.Name))
+}
+
+// savedRoom is a room as rooms.json holds it: its keys, and what its members told each other
+type savedRoom struct {
+	Room
+	Controls []RoomControl `json:"controls,omitempty"`
+	Members  []string      `json:"members,omitempty"` // Fingerprints, sorted
+}
+
+// joinedRoom is a room we are in, who has proved its passphrase to us this session, and what is
+// known of it: the ops' controls and the keys of its members, which members gossip
+type joinedRoom struct {
+	Room
+	members  map[string]string // Fingerprint -> node ID
+	known    map[string]bool   // Fingerprints of members, proved to us or gossiped by members
+	controls []RoomControl     // Taken in order, each signed by an op of the room at the time
+}
+
+func newJoinedRoom(room Room) *joinedRoom {
+	return &joinedRoom{Room: room, members: make(map[string]string), known: make(map[string]bool)}
+}
+
+// roomPeer is a join handshake under way: with one peer, for one room
+type roomPeer struct {
+	room   string
+	nodeID string
+}
+
+// roomNonces are the nonces of a join handshake: ours and the peer's once it sent one
+type roomNonces struct {
+	ours    []byte
+	theirs  []byte
+	started time.Time
+}
+
+// RoomBook holds the rooms we are in, persisted in the data dir, and the join handshakes under
+// way. Members are only known for the session: they prove the passphrase again on every connect.
+type RoomBook struct {
+	mutex      sync.Mutex
+	path       string
+	rooms      map[string]*joinedRoom  // By name
+	joins      map[roomPeer]roomNonces // Joins we sent, until the peer welcomes us
+	challenges map[roomPeer]roomNonces // Challenges we sent peers joining our rooms, until they prove the passphrase
+}
+
+// NewRoomBook loads the rooms from dataDir, starting with none
+func NewRoomBook(dataDir string) (*RoomBook, error) {
+	rb := &RoomBook{
+		path:       filepath.Join(dataDir, roomsFile),
+		rooms:      make(map[string]*joinedRoom),
+		joins:      make(map[roomPeer]roomNonces),
+		challenges: make(map[roomPeer]roomNonces),
+	}
+
+	data, err := os.ReadFile(rb.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rb, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rooms: %w", err)
+	}
+
+	var rooms []savedRoom
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return nil, fmt.Errorf("invalid rooms %s: %w", rb.path, err)
+	}
+	for _, saved := range rooms {
+		if !saved.valid() {
+			continue
+		}
+		joined := newJoinedRoom(saved.Room)
+		joined.controls = saved.Controls
+		for _, fingerprint := range saved.Members {
+			joined.known[fingerprint] = true
+		}
+		rb.rooms[saved.Name] = joined
+	}
+	return rb, nil
+}
+
+// Join adds a room we aren't in yet
+func (rb *RoomBook) Join(room Room) error {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	if _, exists := rb.rooms[room.Name]; exists {
+		return fmt.Errorf("already in %s", room.Name)
+	}
+	rb.rooms[room.Name] = newJoinedRoom(room)
+	return rb.save()
+}
+
+// Rekey changes a room's keys, keeping its members and what is known of it. Only the keys the
+// newest rekey control of an op names are taken.
+func (rb *RoomBook) Rekey(room Room) error {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[room.Name]
+	if !exists {
+		return fmt.Errorf("not in %s", room.Name)
+	}
+	if moderate(joined.controls).rekey.Target != roomKeyID(room.Key) {
+		return fmt.Errorf("no op of %s gave it those keys", room.Name)
+	}
+	joined.Room = room
+	return rb.save()
+}
+
+// Leave forgets a room, returning the node IDs of its members
+func (rb *RoomBook) Leave(name string) ([]string, bool) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[name]
+	if !exists {
+		return nil, false
+	}
+	delete(rb.rooms, name)
+	if err := rb.save(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return joined.nodeIDs(), true
+}
+
+// Get returns a room we are in
+func (rb *RoomBook) Get(name string) (Room, bool) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[name]
+	if !exists {
+		return Room{}, false
+	}
+	return joined.Room, true
+}
+
+// Names returns the rooms we are in, sorted
+func (rb *RoomBook) Names() []string {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	names := make([]string, 0, len(rb.rooms))
+	for name := range rb.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Members returns the node IDs of the peers that proved a room's passphrase to us, sorted
+func (rb *RoomBook) Members(name string) []string {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	if joined, exists := rb.rooms[name]; exists {
+		return joined.nodeIDs()
+	}
+	return nil
+}
+
+// IsMember reports whether the key proved a room's passphrase to us
+func (rb *RoomBook) IsMember(name, fingerprint string) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[name]
+	if !exists || fingerprint == "" {
+		return false
+	}
+	_, member := joined.members[fingerprint]
+	return member
+}
+
+// AddMember records a key that proved a room's passphrase, at the node ID it is at, reporting
+// whether it is new to the room. A kicked key isn't admitted.
+func (rb *RoomBook) AddMember(name, fingerprint, nodeID string) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[name]
+	if !exists || moderate(joined.controls).kicked[fingerprint] != "" {
+		return false
+	}
+	_, member := joined.members[fingerprint]
+	joined.members[fingerprint] = nodeID
+	if !joined.known[fingerprint] && len(joined.known) < maxRoomMembers {
+		joined.known[fingerprint] = true
+		if err := rb.save(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return !member
+}
+
+// RemoveMember forgets a member of a room that left, reporting whether it was one
+func (rb *RoomBook) RemoveMember(name, fingerprint string) bool {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	joined, exists := rb.rooms[name]
+	if !exists {
+		return false
+	}
+	_, member := joined.members[fingerprint]
+	delete(joined.members, fingerprint)
+	if joined.known[fingerprint] {
+		delete(joined.known, fingerprint)
+		if err := rb.save(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return member
+}
+
+// startJoin returns the nonce of a join we send a peer for a room we are in
+func (rb *RoomBook) startJoin(name, nodeID string, now time.Time) ([]byte, bool) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	if _, exists := rb.rooms[name]; !exists {
+		return nil, false
+	}
+	nonce, err := roomNonce()
+	if err != nil || !rb.pending(rb.joins, now) {
+		return nil, false
+	}
+	rb.joins[roomPeer{name, nodeID}] = roomNonces{ours: nonce, started: now}
+	return nonce, true
+}
+
+// challenge returns the nonce to challenge a peer's join with. Every join gets one, whether or
+// not we are in the room, so a peer can't tell from the answer; only challenges for our rooms
+// are kept to check the proof against.
+func (rb *RoomBook) challenge(name, nodeID string, theirs []byte, now time.Time) ([]byte, error) {
+	nonce, err := roomNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	if _, exists := rb.rooms[name]; exists && rb.pending(rb.challenges, now) {
+		rb.challenges[roomPeer{name, nodeID}] = roomNonces{ours: nonce, theirs: theirs, started: now}
+	}
+	return nonce, nil
+}
+
+// challenged records the nonce a peer challenged our join with, returning the room and both
+// nonces to prove the passphrase with
+func (rb *RoomBook) challenged(name, nodeID string, theirs []byte) (Room, roomNonces, bool) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	key := roomPeer{name, nodeID}
+	join, sent := rb.joins[key]
+	joined, exists := rb.rooms[name]
+	if !sent || !exists || join.theirs != nil {
+		return Room{}, roomNonces{}, false
+	}
+	join.theirs = theirs
+	rb.joins[key] = join
+	return joined.Room, join, true
+}
+
+// takeChallenge returns, once, the challenge we sent a peer joining one of our rooms
+func (rb *RoomBook) takeChallenge(name, nodeID string) (Room, roomNonces, bool) {
+	return rb.take(rb.challenges, name, nodeID)
+}
+
+// takeJoin returns, once, a join we sent that the peer challenged
+func (rb *RoomBook) takeJoin(name, nodeID string) (Room, roomNonces, bool) {
+	return rb.take(rb.joins, name, nodeID)
+}
+
+func (rb *RoomBook) take(handshakes map[roomPeer]roomNonces, name, nodeID string) (Room, roomNonces, bool) {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	key := roomPeer{name, nodeID}
+	nonces, found := handshakes[key]
+	delete(handshakes, key)
+	joined, exists := rb.rooms[name]
+	if !found || !exists || nonces.theirs == nil {
+		return Room{}, roomNonces{}, false
+	}
+	return joined.Room, nonces, true
+}
+
+// pending drops handshakes that took too long and reports whether there is room for another.
+// The caller must hold the mutex.
+func (rb *RoomBook) pending(handshakes map[roomPeer]roomNonces, now time.Time) bool {
+	for key, nonces := range handshakes {
+		if now.Sub(nonces.started) > roomJoinWait {
+			delete(handshakes, key)
+		}
+	}
+	return len(handshakes) < maxPendingRoomJoin
+}
+
+// save writes the rooms; the caller must hold the mutex. They hold the room keys, so only we
+// may read them.
+func (rb *RoomBook) save() error {
+	rooms := make([]savedRoom, 0, len(rb.rooms))
+	for _, joined := range rb.rooms {
+		rooms = append(rooms, savedRoom{Room: joined.Room, Controls: joined.controls, Members: joined.knownKeys()})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+
+	data, err := json.MarshalIndent(rooms, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(rb.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save rooms: %w", err)
+	}
+	return nil
+}
+
+// nodeIDs returns the node IDs of the room's members, sorted
+func (jr *joinedRoom) nodeIDs() []string {
+	nodeIDs := make([]string, 0, len(jr.members))
+	for _, nodeID := range jr.members {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs
+}
+
+// knownKeys returns the fingerprints of the room's known members, sorted
+func (jr *joinedRoom) knownKeys() []string {
+	fingerprints := make([]string, 0, len(jr.known))
+	for fingerprint := range jr.known {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+	return fingerprints
+}
+
+func roomNonce() ([]byte, error) {
+	nonce := make([]byte, roomNonceBytes)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// roomMessage is a "room" message: a step of joining a room, or traffic within it. Joining takes
+// four: the joiner sends a nonce; the peer answers with its own, member or not; the joiner
+// proves the passphrase over both; and a member that checked the proof welcomes it with its own,
+// the room's controls and its message key, which a kick may have changed since the joiner was
+// last in. The two then send each other what they know of the room (roomState).
+type roomMessage struct {
+	Type     string        `json:"type"` // join, challenge, proof, welcome, text, rekey, state or leave
+	Room     string        `json:"room"`
+	Nonce    []byte        `json:"nonce,omitempty"`    // The join's or challenge's nonce
+	Proof    []byte        `json:"proof,omitempty"`    // Room.proof over both nonces
+	Key      []byte        `json:"key,omitempty"`      // A welcome's room key
+	Controls []RoomControl `json:"controls,omitempty"` // A welcome's controls, which name the key if an op changed it
+	Sealed   []byte        `json:"sealed,omitempty"`   // Room traffic, sealed with the room key
+}
+
+// roomRekey is what a rekey message holds: an op's new keys for the room, and the control that
+// names them
+type roomRekey struct {
+	Room    Room        `json:"room"`
+	Control RoomControl `json:"control"`
+}
+
+// handleRoomMessage handles a "room" message. Only peers whose key we hold take part: the
+// proofs are bound to it, and it is what membership is kept by.
+func (en *EnhancedNode) handleRoomMessage(msg Message, fromPeerKey bool, plaintext []byte) {
+	var rm roomMessage
+	if err := json.Unmarshal(plaintext, &rm); err != nil {
+		log.Printf("Invalid room message from %s: %v", msg.SenderID, err)
+		return
+	}
+	fingerprint := en.peerFingerprint(msg.SenderID)
+	if !fromPeerKey || fingerprint == "" || !roomName.MatchString(rm.Room) {
+		log.Printf("Ignored room message from %s", msg.SenderID)
+		return
+	}
+
+	switch rm.Type {
+	case "join":
+		en.challengeRoomJoin(msg.SenderID, rm)
+	case "challenge":
+		en.proveRoomPassphrase(msg.SenderID, fingerprint, rm)
+	case "proof":
+		en.checkRoomProof(msg.SenderID, fingerprint, rm)
+	case "welcome":
+		en.checkRoomWelcome(msg.SenderID, fingerprint, rm)
+	case "text", "rekey", "state", "leave":
+		// Room traffic is only taken from members; strays from anyone else are dropped unread
+		room, joined := en.rooms.Get(rm.Room)
+		if !joined || !en.rooms.IsMember(rm.Room, fingerprint) {
+			log.Printf("Dropped %s for %s from %s, which isn't a member", rm.Type, rm.Room, msg.SenderID)
+			return
+		}
+		en.handleRoomTraffic(msg, fingerprint, room, rm)
+	default:
+		log.Printf("Unknown room message type from %s: %s", msg.SenderID, rm.Type)
+	}
+}
+
+// challengeRoomJoin answers a peer's join with a challenge. Peers outside the room answer the
+// same way, so a wrong passphrase can't tell whether the room exists.
+func (en *EnhancedNode) challengeRoomJoin(nodeID string, rm roomMessage) {
+	if len(rm.Nonce) != roomNonceBytes {
+		return
+	}
+	nonce, err := en.rooms.challenge(rm.Room, nodeID, rm.Nonce, en.wallClock.Now())
+	if err != nil {
+		log.Printf("Failed to challenge %s joining a room: %v", nodeID, err)
+		return
+	}
+	en.sendRoomMessage(nodeID, roomMessage{Type: "challenge", Room: rm.Room, Nonce: nonce})
+}
+
+// proveRoomPassphrase answers the challenge to a join we sent
+func (en *EnhancedNode) proveRoomPassphrase(nodeID, fingerprint string, rm roomMessage) {
+	if len(rm.Nonce) != roomNonceBytes {
+		return
+	}
+	room, nonces, joining := en.rooms.challenged(rm.Room, nodeID, rm.Nonce)
+	if !joining {
+		return
+	}
+	proof := room.proof("join", nonces.theirs, nonces.ours, en.cryptoManager.Fingerprint(), fingerprint)
+	en.sendRoomMessage(nodeID, roomMessage{Type: "proof", Room: rm.Room, Proof: proof})
+}
+
+// checkRoomProof admits a peer that proved the passphrase of one of our rooms, and proves it in
+// turn. A wrong proof gets no answer, as a join to a room we aren't in doesn't, and nor does a
+// kicked key.
+func (en *EnhancedNode) checkRoomProof(nodeID, fingerprint string, rm roomMessage) {
+	room, nonces, challenged := en.rooms.takeChallenge(rm.Room, nodeID)
+	if !challenged || en.rooms.Kicked(rm.Room, fingerprint) {
+		return
+	}
+	ours := en.cryptoManager.Fingerprint()
+	if !hmac.Equal(rm.Proof, room.proof("join", nonces.ours, nonces.theirs, fingerprint, ours)) {
+		log.Printf("%s failed to prove the passphrase of %s", nodeID, rm.Room)
+		return
+	}
+	proof := room.proof("welcome", nonces.theirs, nonces.ours, ours, fingerprint)
+	state, _ := en.rooms.State(rm.Room, ours)
+	en.sendRoomMessage(nodeID, roomMessage{Type: "welcome", Room: rm.Room, Proof: proof, Key: room.Key, Controls: state.Controls})
+	en.admitRoomMember(rm.Room, fingerprint, nodeID, fmt.Sprintf("🚪 %s joined %s", en.peerLabel(nodeID), rm.Room))
+}
+
+// checkRoomWelcome admits a member that welcomed our join, once it too proved the passphrase,
+// and takes the room key it sent if an op's control names it
+func (en *EnhancedNode) checkRoomWelcome(nodeID, fingerprint string, rm roomMessage) {
+	room, nonces, joining := en.rooms.takeJoin(rm.Room, nodeID)
+	if !joining || en.rooms.Kicked(rm.Room, fingerprint) {
+		return
+	}
+	if !hmac.Equal(rm.Proof, room.proof("welcome", nonces.ours, nonces.theirs, fingerprint, en.cryptoManager.Fingerprint())) {
+		log.Printf("%s welcomed us to %s without proving its passphrase", nodeID, rm.Room)
+		return
+	}
+	var added []RoomControl
+	if len(rm.Controls) <= maxRoomControls {
+		added = en.rooms.AddControls(rm.Room, rm.Controls, en.wallClock.Now())
+	}
+	if len(rm.Key) == roomKeyBytes && !hmac.Equal(rm.Key, room.Key) {
+		rekeyed := room
+		rekeyed.Key = rm.Key
+		if err := en.rooms.Rekey(rekeyed); err != nil {
+			log.Printf("Kept our key for %s, not the one %s sent: %v", rm.Room, nodeID, err)
+		}
+	}
+	en.admitRoomMember(rm.Room, fingerprint, nodeID, fmt.Sprintf("👥 %s is in %s", en.peerLabel(nodeID), rm.Room))
+	en.announceRoomControls(rm.Room, added)
+}
+
+// admitRoomMember adds a member that proved the passphrase and sends it what we know of the
+// room. A member new to us is news to the others connected too.
+func (en *EnhancedNode) admitRoomMember(name, fingerprint, nodeID, notice string) {
+	if !en.rooms.AddMember(name, fingerprint, nodeID) {
+		en.sendRoomState(name, []string{nodeID}, "")
+		return
+	}
+	en.roomNotice(name, notice)
+	en.sendRoomState(name, en.rooms.Members(name), "")
+}
+
+// handleRoomTraffic handles what a member sends within a room
+func (en *EnhancedNode) handleRoomTraffic(msg Message, fingerprint string, room Room, rm roomMessage) {
+	if rm.Type == "leave" {
+		if en.rooms.RemoveMember(rm.Room, fingerprint) {
+			en.roomNotice(rm.Room, fmt.Sprintf("👋 %s left %s", en.peerLabel(msg.SenderID), rm.Room))
+		}
+		return
+	}
+
+	plaintext, err := room.open(rm.Sealed)
+	if err != nil {
+		log.Printf("Failed to open %s for %s from %s: %v", rm.Type, rm.Room, msg.SenderID, err)
+		return
+	}
+
+	if rm.Type == "state" {
+		en.mergeRoomState(msg.SenderID, rm.Room, plaintext)
+		return
+	}
+
+	if rm.Type == "rekey" {
+		// Only an op changes the keys: on a kick, or with a new passphrase
+		if moderation, _ := en.rooms.Moderation(rm.Room); moderation.ops[fingerprint] == "" {
+			log.Printf("Dropped new keys for %s from %s, which isn't an op", rm.Room, msg.SenderID)
+			return
+		}
+		var rekey roomRekey
+		if err := json.Unmarshal(plaintext, &rekey); err != nil || !rekey.Room.valid() || rekey.Room.Name != rm.Room {
+			log.Printf("Invalid new keys for %s from %s", rm.Room, msg.SenderID)
+			return
+		}
+		en.rooms.AddControls(rm.Room, []RoomControl{rekey.Control}, en.wallClock.Now())
+		if err := en.rooms.Rekey(rekey.Room); err != nil {
+			log.Printf("Failed to change the keys of %s: %v", rm.Room, err)
+			return
+		}
+		if !hmac.Equal(rekey.Room.AuthKey, room.AuthKey) {
+			en.roomNotice(rm.Room, fmt.Sprintf("🔑 %s changed the passphrase of %s", en.peerLabel(msg.SenderID), rm.Room))
+		}
+		return
+	}
+
+	envelope := parseTextEnvelope(plaintext)
+	if err := checkTextEnvelope(envelope); err != nil {
+		en.oversizedFrom(msg.FromPeerID, err)
+		return
+	}
+	if envelope.Parts > 0 {
+		en.oversizedFrom(msg.FromPeerID, fmt.Errorf("%w: room text in parts", errMessageTooLarge))
+		return
+	}
+	if envelope.ID == "" || !en.seen.First(msg.SenderID, envelope.ID) {
+		return
+	}
+	en.clock.Witness(envelope.Lamport)
+	en.peerStats.Touch(msg.SenderID)
+	en.scoreMessage(msg.FromPeerID, msg.SenderID, envelope.Text)
+
+	// As with other text, ephemeral messages aren't handed to webhooks
+	if en.webhook != nil && envelope.TTL == 0 {
+		en.webhook.Enqueue(WebhookEvent{
+			Sender:    msg.SenderID,
+			Nick:      cmp.Or(en.presence.Nick(msg.SenderID), msg.SenderID),
+			Room:      rm.Room,
+			Text:      envelope.Text,
+			Timestamp: time.Now().Format(time.RFC3339),
+			MessageID: envelope.ID,
+		})
+	}
+
+	if en.shouldSuppress(msg.SenderID, envelope.Text) {
+		return
+	}
+	en.notifyUI(Message{
+		SenderID:   msg.SenderID,
+		Content:    []byte(envelope.Text),
+		FromPeerID: msg.FromPeerID,
+		Lamport:    envelope.Lamport,
+		Mention:    en.mentions.Matches(envelope.Text),
+		Action:     envelope.Kind == TextKindAction,
+		ExpiresAt:  envelope.expiresAt(time.Now()),
+		ID:         envelope.ID,
+		Room:       rm.Room,
+	})
+}
+
+// sendRoomMessage sends a room message to one peer
+func (en *EnhancedNode) sendRoomMessage(nodeID string, rm roomMessage) error {
+	data, err := json.Marshal(rm)
+	if err != nil {
+		return err
+	}
+	if err := en.sendEncryptedTo(nodeID, data, "room"); err != nil {
+		log.Printf("Failed to send %s for %s to %s: %v", rm.Type, rm.Room, nodeID, err)
+		return err
+	}
+	return nil
+}
+
+// sendToRoom sends a room message to every member of the room that is connected
+func (en *EnhancedNode) sendToRoom(rm roomMessage) error {
+	var members []string
+	for _, nodeID := range en.rooms.Members(rm.Room) {
+		if _, _, err := en.resolvePeer(nodeID); err == nil {
+			members = append(members, nodeID)
+		}
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("%w: nobody else in %s is connected", ErrPeerUnreachable, rm.Room)
+	}
+
+	data, err := json.Marshal(rm)
+	if err != nil {
+		return err
+	}
+	if err := checkEnvelopeSize(data, "room"); err != nil {
+		return err
+	}
+	var failed []*PeerError
+	for _, nodeID := range members {
+		if err := en.sendEncryptedTo(nodeID, data, "room"); err != nil {
+			failed = append(failed, &PeerError{Peer: nodeID, Err: err})
+		}
+	}
+	return newBroadcastError(len(members), failed)
+}
+
+// sendRoomText sends text to the members of a room, sealed with the room key, returning our copy
+// for local display
+func (en *EnhancedNode) sendRoomText(name, text string) (Message, error) {
+	room, joined := en.rooms.Get(name)
+	if !joined {
+		return Message{}, fmt.Errorf("not in %s; /join %s first", name, name)
+	}
+	if len(text) > maxTextBytes {
+		return Message{}, fmt.Errorf("%w: %s of text, over the %s limit for a room; send it as a file with /sendfile instead",
+			errMessageTooLarge, formatBytes(int64(len(text))), formatBytes(maxTextBytes))
+	}
+
+	envelope := en.newTextEnvelope(text, false)
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return Message{}, err
+	}
+	sealed, err := room.seal(data)
+	if err != nil {
+		return Message{}, err
+	}
+	sent := en.localTextMessage(envelope)
+	sent.Direct = false
+	sent.Room = name
+	return sent, en.sendToRoom(roomMessage{Type: "text", Room: name, Sealed: sealed})
+}
+
+// sendRoomFile offers a file to each connected member of a room, naming the room in the offers so
+// members can sort it with {room} in downloads_layout
+func (en *EnhancedNode) sendRoomFile(name, filePath string) error {
+	if _, joined := en.rooms.Get(name); !joined {
+		return fmt.Errorf("not in %s; /join %s first", name, name)
+	}
+	var failed []*PeerError
+	offered := 0
+	for _, nodeID := range en.rooms.Members(name) {
+		if _, _, err := en.resolvePeer(nodeID); err != nil || en.lacksCapability(nodeID, capabilityFiles) {
+			continue
+		}
+		offered++
+		if err := en.fileManager.sendToRoomMember(nodeID, filePath, name); err != nil {
+			failed = append(failed, &PeerError{Peer: nodeID, Err: err})
+		}
+	}
+	if offered == 0 {
+		return fmt.Errorf("%w: nobody else in %s is connected", ErrPeerUnreachable, name)
+	}
+	return newBroadcastError(offered, failed)
+}
+
+// handleRoomSendFile processes /sendfile #room <path>
+func (en *EnhancedNode) handleRoomSendFile(name, filePath string) {
+	err := en.sendRoomFile(name, filePath)
+	if sentToAny(err) {
+		en.roomNotice(name, fmt.Sprintf("📤 Offered %s to %s", filepath.Base(filePath), name))
+	}
+	if err != nil {
+		en.notifySendError("File", err)
+	}
+}
+
+// joinRoom derives a room's keys from the passphrase and asks connected peers to confirm it.
+// Starting the room, we are its creator and first op straight away. Joining it, we leave again
+// if no member welcomed us within roomJoinWait: either none is connected, or the passphrase is
+// wrong, and members don't say which. Peers that only missed the room for a while don't start
+// another with ops of its own.
+func (en *EnhancedNode) joinRoom(name, passphrase string, start bool) {
+	defer en.wg.Done()
+
+	what := "join"
+	if start {
+		what = "start"
+	}
+	room, err := newRoom(name, passphrase)
+	if err == nil {
+		err = en.rooms.Join(room)
+	}
+	if err != nil {
+		en.roomNotice(name, fmt.Sprintf("❌ Failed to %s %s: %v", what, name, err))
+		return
+	}
+	if start {
+		en.createRoom(name)
+	} else {
+		en.roomNotice(name, fmt.Sprintf("🚪 Joining %s; asking connected peers to confirm the passphrase", name))
+	}
+	// Members of a room we start with its passphrase settle on the older start (addControl)
+	for _, peer := range en.snapshotPeers() {
+		if nodeID := peer.nodeID(); nodeID != "" {
+			en.sendRoomJoin(name, nodeID)
+		}
+	}
+	if start {
+		return
+	}
+
+	select {
+	case <-en.wallClock.After(roomJoinWait):
+	case <-en.Shutdown:
+		return
+	}
+	// A welcome brings the room's controls, so a member that went away since still counts
+	if moderation, joined := en.rooms.Moderation(name); joined && moderation.creator == "" && len(en.rooms.Members(name)) == 0 {
+		en.rooms.Leave(name)
+		en.roomNotice(name, fmt.Sprintf("❌ Couldn't join %s: no connected peer confirmed the passphrase. Either no member is connected or the passphrase is wrong; /room create %s starts a new room", name, name))
+	}
+}
+
+// sendRoomJoin starts joining a room we are in with one peer
+func (en *EnhancedNode) sendRoomJoin(name, nodeID string) {
+	if en.lacksCapability(nodeID, capabilityRooms) {
+		return
+	}
+	if nonce, joined := en.rooms.startJoin(name, nodeID, en.wallClock.Now()); joined {
+		en.sendRoomMessage(nodeID, roomMessage{Type: "join", Room: name, Nonce: nonce})
+	}
+}
+
+// rejoinRooms proves the passphrases of our rooms to a peer that connected, and has it prove
+// them to us, so members find each other again
+func (en *EnhancedNode) rejoinRooms(nodeID string) {
+	for _, name := range en.rooms.Names() {
+		en.sendRoomJoin(name, nodeID)
+	}
+}
+
+// roomNotice shows a system notice in a room's conversation
+func (en *EnhancedNode) roomNotice(name, content string) {
+	en.notifyUI(Message{
+		SenderID:     "System",
+		Content:      []byte(content),
+		Conversation: name,
+	})
+}
+
+// handleJoinCommand processes /join <#room> [passphrase]
+func (en *EnhancedNode) handleJoinCommand(args string) {
+	en.enterRoom(args, false)
+}
+
+// enterRoom joins or starts the room named to /join or /room create
+func (en *EnhancedNode) enterRoom(args string, start bool) {
+	usage := "Usage: /join <#room> [passphrase]"
+	if start {
+		usage = "Usage: /room create <#room> [passphrase]"
+	}
+	name, passphrase, _ := strings.Cut(strings.TrimSpace(args), " ")
+	if name == broadcastRoom {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ %s is the broadcast channel; pick another name for a room", broadcastRoom)),
+		})
+		return
+	}
+	if !roomName.MatchString(name) {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(usage + " (a room name is # and up to 32 lowercase letters, digits, _ . -)"),
+		})
+		return
+	}
+	if _, joined := en.rooms.Get(name); joined {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ You are in %s already; /room leave %s first to join it with another passphrase", name, name)),
+		})
+		return
+	}
+	// Deriving the keys takes a moment; the event loop carries on meanwhile
+	en.wg.Add(1)
+	go en.joinRoom(name, strings.TrimSpace(passphrase), start)
+}
+
+// handleRoomCommand processes /room: list, create, setpass, topic, op, kick and leave
+func (en *EnhancedNode) handleRoomCommand(args string) {
+	subcommand, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	name, arg, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	arg = strings.TrimSpace(arg)
+
+	var reply string
+	switch subcommand {
+	case "", "list":
+		names := en.rooms.Names()
+		if len(names) == 0 {
+			reply = "Not in any room; /join <#room> [passphrase] joins one, /room create <#room> [passphrase] starts one"
+			break
+		}
+		var content strings.Builder
+		content.WriteString("🚪 Rooms:")
+		for _, name := range names {
+			room, _ := en.rooms.Get(name)
+			lock := ""
+			if room.Protected {
+				lock = " 🔒"
+			}
+			members := en.rooms.Members(name)
+			labels := make([]string, len(members))
+			for i, nodeID := range members {
+				labels[i] = en.peerLabel(nodeID)
+			}
+			if len(labels) == 0 {
+				labels = []string{"nobody else yet"}
+			}
+			content.WriteString(fmt.Sprintf("\n  %s%s: %s", name, lock, strings.Join(labels, ", ")))
+			content.WriteString(en.describeRoomModeration(name))
+		}
+		reply = content.String()
+
+	case "create":
+		en.enterRoom(rest, true)
+		return
+
+	case "setpass":
+		moderation, joined := en.rooms.Moderation(name)
+		if !joined {
+			reply = "Usage: /room setpass <#room> [passphrase] (in a room you are an op of; no passphrase opens it)"
+			break
+		}
+		if moderation.ops[en.cryptoManager.Fingerprint()] == "" {
+			reply = fmt.Sprintf("❌ Only ops of %s can do that; /room list shows who they are", name)
+			break
+		}
+		en.wg.Add(1)
+		go en.setRoomPassphrase(name, arg)
+		return
+
+	case "topic", "op", "kick":
+		reply = en.moderateRoom(subcommand, name, arg)
+
+	case "leave":
+		members, joined := en.rooms.Leave(name)
+		if !joined {
+			reply = "Usage: /room leave <#room>"
+			break
+		}
+		for _, nodeID := range members {
+			en.sendRoomMessage(nodeID, roomMessage{Type: "leave", Room: name})
+		}
+		reply = fmt.Sprintf("👋 Left %s", name)
+
+	default:
+		reply = "Usage: /room [list|create <#room> [passphrase]|setpass <#room> [passphrase]|topic <#room> <text>|op <#room> <peer>|kick <#room> <peer>|leave <#room>]"
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
+
+// setRoomPassphrase changes a room's passphrase. Members away at the time need the new one to
+// /join again.
+func (en *EnhancedNode) setRoomPassphrase(name, passphrase string) {
+	defer en.wg.Done()
+
+	room, err := newRoom(name, passphrase)
+	var sent error
+	if err == nil {
+		sent, err = en.changeRoomKeys(room)
+	}
+	if err != nil {
+		en.roomNotice(name, fmt.Sprintf("❌ Failed to change the passphrase of %s: %v", name, err))
+		return
+	}
+
+	content := fmt.Sprintf("🔑 Changed the passphrase of %s", name)
+	if !room.Protected {
+		content = fmt.Sprintf("🔓 %s is open now: anyone can /join it", name)
+	}
+	if sent != nil && !sentToAny(sent) {
+		content += "; no member was told, so each needs it to /join again"
+	} else if sent != nil {
+		content += "; members that didn't get it need it to /join again"
+	}
+	en.roomNotice(name, content)
+}
+
+// rotateRoomKey gives a room a new random message key, keeping its passphrase. Members away at
+// the time are sent it in the welcome to their next join.
+func (en *EnhancedNode) rotateRoomKey(name string) error {
+	room, joined := en.rooms.Get(name)
+	if !joined {
+		return fmt.Errorf("not in %s", name)
+	}
+	room.Key = make([]byte, roomKeyBytes)
+	if _, err := rand.Read(room.Key); err != nil {
+		return err
+	}
+	_, err := en.changeRoomKeys(room)
+	return err
+}
+
+// changeRoomKeys names new keys of a room in a rekey control of ours and sends them to the members
+// connected, sealed with the old ones, before taking them. It returns how sending went apart from
+// whether the keys changed.
+func (en *EnhancedNode) changeRoomKeys(room Room) (sent, err error) {
+	old, joined := en.rooms.Get(room.Name)
+	if !joined {
+		return nil, fmt.Errorf("not in %s", room.Name)
+	}
+	control, err := newRoomControl(en.cryptoManager, room.Name, "rekey", roomKeyID(room.Key), "", en.wallClock.Now())
+	if err != nil {
+		return nil, err
+	}
+	if added := en.rooms.AddControls(room.Name, []RoomControl{control}, en.wallClock.Now()); len(added) == 0 {
+		return nil, fmt.Errorf("%s holds as many ops and kicks as it can (%d changes)", room.Name, maxRoomControls)
+	}
+
+	data, err := json.Marshal(roomRekey{Room: room, Control: control})
+	var sealed []byte
+	if err == nil {
+		sealed, err = old.seal(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sent = en.sendToRoom(roomMessage{Type: "rekey", Room: room.Name, Sealed: sealed})
+	return sent, en.rooms.Rekey(room)
+}
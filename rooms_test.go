@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roomMembers reports whether node counts exactly the given nodes as members of a room
+func roomMembers(node *EnhancedNode, room string, members ...*EnhancedNode) bool {
+	var want []string
+	for _, member := range members {
+		want = append(want, member.ID)
+	}
+	slices.Sort(want)
+	return slices.Equal(node.rooms.Members(room), want)
+}
+
+// roomTexts returns the texts node has shown from sender in a room
+func roomTexts(node *EnhancedNode, sender, room string) []string {
+	var texts []string
+	for _, msg := range node.messageLog.Since(0) {
+		if msg.SenderID == sender && msg.Room == room {
+			texts = append(texts, msg.Content)
+		}
+	}
+	return texts
+}
+
+// answered reports whether a peer answered node's join to a room with a challenge
+func answered(node *EnhancedNode, room string, peer *EnhancedNode) bool {
+	node.rooms.mutex.Lock()
+	defer node.rooms.mutex.Unlock()
+	return node.rooms.joins[roomPeer{room, peer.ID}].theirs != nil
+}
+
+// waitForNotice waits until node has shown a system notice containing text
+func waitForNotice(t testing.TB, node *EnhancedNode, text string) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%s to show %q", node.ID, text), func() bool {
+		return slices.ContainsFunc(loggedTexts(node, "System"), func(notice string) bool {
+			return strings.Contains(notice, text)
+		})
+	})
+}
+
+// TestRoomNotificationLevel has a room tab notify on mentions until /notifications names the room
+func TestRoomNotificationLevel(t *testing.T) {
+	ui, _ := newTestUI(t, 100, 30)
+	receive(ui, Message{SenderID: memoryHost + ":2", Content: []byte("hello"), Room: "#lan"})
+	if ui.findConversation("#lan") < 0 {
+		t.Fatal("no tab opened for the room")
+	}
+	if level := ui.notificationLevel("#lan"); level != levelMentions {
+		t.Errorf("room level %q by default, want %q", level, levelMentions)
+	}
+	ui.notificationsCommand("#lan off")
+	if level := ui.notificationLevel("#lan"); level != levelOff {
+		t.Errorf("room level %q after /notifications #lan off", level)
+	}
+	if level := ui.notificationLevel(""); level != levelMentions {
+		t.Errorf("setting a room changed %s to %q", broadcastRoom, level)
+	}
+}
+
+// roomTopic returns the topic node shows for a room
+func roomTopic(node *EnhancedNode, room string) string {
+	for _, info := range node.Rooms() {
+		if info.Name == room {
+			return info.Topic
+		}
+	}
+	return ""
+}
+
+func TestRoomKeys(t *testing.T) {
+	room, err := newRoom("#lan", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := newRoom("#lan", "correct horse")
+	wrong, _ := newRoom("#lan", "battery staple")
+	elsewhere, _ := newRoom("#attic", "correct horse")
+
+	if !room.Protected || !bytes.Equal(room.Key, again.Key) || !bytes.Equal(room.AuthKey, again.AuthKey) {
+		t.Fatal("the same name and passphrase gave different keys")
+	}
+	if bytes.Equal(room.Key, room.AuthKey) {
+		t.Error("the message key is the auth key")
+	}
+	for _, other := range []Room{wrong, elsewhere} {
+		if bytes.Equal(room.Key, other.Key) || bytes.Equal(room.AuthKey, other.AuthKey) {
+			t.Errorf("%s with another passphrase or name has the same keys", other.Name)
+		}
+	}
+
+	sealed, err := room.seal([]byte("for members"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := again.open(sealed); err != nil || string(opened) != "for members" {
+		t.Errorf("member opened %q, %v", opened, err)
+	}
+	if _, err := wrong.open(sealed); err == nil {
+		t.Error("a room message opened with the wrong passphrase's key")
+	}
+
+	challenge, response := []byte("challenge"), []byte("response")
+	proof := room.proof("join", challenge, response, "joiner", "member")
+	for name, other := range map[string][]byte{
+		"wrong passphrase": wrong.proof("join", challenge, response, "joiner", "member"),
+		"other step":       room.proof("welcome", challenge, response, "joiner", "member"),
+		"other keys":       room.proof("join", challenge, response, "member", "joiner"),
+		"other nonces":     room.proof("join", response, challenge, "joiner", "member"),
+	} {
+		if bytes.Equal(proof, other) {
+			t.Errorf("proof with %s is the same", name)
+		}
+	}
+}
+
+func TestRoomBookSaved(t *testing.T) {
+	dir := t.TempDir()
+	rb, err := NewRoomBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, err := newRoom("#lan", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rb.Join(room); err != nil {
+		t.Fatal(err)
+	}
+	rb.AddMember("#lan", "fingerprint", "peer:1")
+	if err := rb.Join(room); err == nil {
+		t.Error("joined a room twice")
+	}
+	unnamed := room
+	unnamed.Key = bytes.Repeat([]byte{1}, roomKeyBytes)
+	if err := rb.Rekey(unnamed); err == nil {
+		t.Error("took a key no op's control names")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, roomsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("rooms saved with mode %o, want 600", mode)
+	}
+
+	loaded, err := NewRoomBook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, joined := loaded.Get("#lan")
+	if !joined || !bytes.Equal(saved.Key, room.Key) || !saved.Protected {
+		t.Errorf("room not loaded as saved: %+v", saved)
+	}
+	if members := loaded.Members("#lan"); len(members) != 0 {
+		t.Errorf("members %v kept across sessions; they must prove the passphrase again", members)
+	}
+}
+
+// TestRoomPassphrase has a member, a peer with the passphrase and a peer with a wrong one join a
+// room. The wrong passphrase gets the same answers from a member as from a peer outside the
+// room, and no room traffic.
+func TestRoomPassphrase(t *testing.T) {
+	tn := newTestNetwork(t, 4)
+	a, b, c, outsider := tn.nodes[0], tn.nodes[1], tn.nodes[2], tn.nodes[3]
+	tn.connect(a, b)
+	tn.connect(c, a)
+	tn.connect(c, outsider)
+
+	a.handleRoomCommand("create #lan correct horse")
+	waitForNotice(t, a, "You started #lan")
+	b.handleJoinCommand("#lan correct horse")
+	waitFor(t, "a and b to admit each other", func() bool {
+		return roomMembers(a, "#lan", b) && roomMembers(b, "#lan", a)
+	})
+
+	c.handleJoinCommand("#lan battery staple")
+	waitFor(t, "a member and an outsider to challenge c", func() bool {
+		return answered(c, "#lan", a) && answered(c, "#lan", outsider)
+	})
+	waitFor(t, "a to check c's proof", func() bool {
+		a.rooms.mutex.Lock()
+		defer a.rooms.mutex.Unlock()
+		_, pending := a.rooms.challenges[roomPeer{"#lan", c.ID}]
+		return !pending
+	})
+	waitForNotice(t, c, "Couldn't join #lan")
+	if _, joined := c.rooms.Get("#lan"); joined || !roomMembers(a, "#lan", b) {
+		t.Fatalf("wrong passphrase admitted: a has %v, c still in the room %v", a.rooms.Members("#lan"), joined)
+	}
+
+	a.handleMsgCommand("#lan hello members")
+	waitFor(t, "b to show the room message", func() bool {
+		return slices.Contains(roomTexts(b, a.ID, "#lan"), "hello members")
+	})
+
+	// A stray sealed with the room key reaches c, which isn't in the room and doesn't take it from a
+	room, _ := a.rooms.Get("#lan")
+	envelope := a.newTextEnvelope("stray", false)
+	data, _ := json.Marshal(envelope)
+	sealed, err := room.seal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.sendRoomMessage(c.ID, roomMessage{Type: "text", Room: "#lan", Sealed: sealed}); err != nil {
+		t.Fatal(err)
+	}
+	// Nor does a take room text from c
+	if err := c.sendRoomMessage(a.ID, roomMessage{Type: "text", Room: "#lan", Sealed: sealed}); err != nil {
+		t.Fatal(err)
+	}
+	b.handleMsgCommand("#lan after the strays")
+	waitFor(t, "a to show b's room message", func() bool {
+		return slices.Contains(roomTexts(a, b.ID, "#lan"), "after the strays")
+	})
+	if texts := loggedTexts(c, a.ID); len(texts) != 0 {
+		t.Errorf("c showed %q from a", texts)
+	}
+	if texts := loggedTexts(a, c.ID); len(texts) != 0 {
+		t.Errorf("a showed %q from c", texts)
+	}
+}
+
+// TestRoomPassphraseChange has the op of a room change its passphrase, which a member may not,
+// neither with /room setpass nor by sending new keys itself
+func TestRoomPassphraseChange(t *testing.T) {
+	_, a, b := connectedPair(t)
+	a.handleRoomCommand("create #lan old")
+	waitForNotice(t, a, "You started #lan")
+	b.handleJoinCommand("#lan old")
+	waitFor(t, "a and b to admit each other", func() bool {
+		return roomMembers(a, "#lan", b) && roomMembers(b, "#lan", a)
+	})
+	old, _ := a.rooms.Get("#lan")
+
+	b.handleRoomCommand("setpass #lan mine")
+	waitForNotice(t, b, "Only ops of #lan can do that")
+	forged, err := newRoom("#lan", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	control, err := newRoomControl(b.cryptoManager, "#lan", "rekey", roomKeyID(forged.Key), "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(roomRekey{Room: forged, Control: control})
+	sealed, err := old.seal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.sendRoomMessage(a.ID, roomMessage{Type: "rekey", Room: "#lan", Sealed: sealed}); err != nil {
+		t.Fatal(err)
+	}
+	b.handleMsgCommand("#lan after my keys")
+	waitFor(t, "a to show b's room message", func() bool {
+		return slices.Contains(roomTexts(a, b.ID, "#lan"), "after my keys")
+	})
+	if room, _ := a.rooms.Get("#lan"); !bytes.Equal(room.Key, old.Key) || !bytes.Equal(room.AuthKey, old.AuthKey) {
+		t.Fatal("a took new keys from b, which isn't an op")
+	}
+
+	a.handleRoomCommand("setpass #lan new")
+	waitForNotice(t, a, "Changed the passphrase of #lan")
+	waitForNotice(t, b, "changed the passphrase of #lan")
+	want, err := newRoom("#lan", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range []*EnhancedNode{a, b} {
+		if room, _ := node.rooms.Get("#lan"); !bytes.Equal(room.Key, want.Key) || !bytes.Equal(room.AuthKey, want.AuthKey) {
+			t.Errorf("%s doesn't have the new passphrase's keys", node.ID)
+		}
+	}
+	a.handleMsgCommand("#lan under the new key")
+	waitFor(t, "b to show the room message", func() bool {
+		return slices.Contains(roomTexts(b, a.ID, "#lan"), "under the new key")
+	})
+
+	b.handleRoomCommand("leave #lan")
+	waitForNotice(t, a, "left #lan")
+	if !roomMembers(a, "#lan") {
+		t.Errorf("b still a member after leaving: %v", a.rooms.Members("#lan"))
+	}
+	if _, joined := b.rooms.Get("#lan"); joined {
+		t.Error("b still in the room after leaving")
+	}
+}
+
+// TestRoomModeration has the creator of a room set its topic and make another member an op, who
+// kicks a third member
+func TestRoomModeration(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	a, b, c := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	tn.connect(a, b)
+	tn.connect(b, c)
+	tn.connect(c, a)
+	aKey, bKey, cKey := a.cryptoManager.Fingerprint(), b.cryptoManager.Fingerprint(), c.cryptoManager.Fingerprint()
+
+	a.handleRoomCommand("create #lan pass")
+	waitForNotice(t, a, "You started #lan")
+	b.handleJoinCommand("#lan pass")
+	waitFor(t, "b to admit a", func() bool { return roomMembers(b, "#lan", a) })
+	c.handleJoinCommand("#lan pass")
+	waitFor(t, "c to admit a and b", func() bool {
+		return roomMembers(a, "#lan", b, c) && roomMembers(b, "#lan", a, c) && roomMembers(c, "#lan", a, b)
+	})
+	waitFor(t, "c to hear who started the room", func() bool {
+		moderation, _ := c.rooms.Moderation("#lan")
+		return moderation.creator == aKey
+	})
+
+	c.handleRoomCommand("topic #lan from a member")
+	waitForNotice(t, c, "Only ops of #lan can do that")
+	a.handleRoomCommand("topic #lan Friday build party")
+	waitForNotice(t, a, "Set the topic of #lan")
+	waitFor(t, "the topic to reach c", func() bool {
+		return roomTopic(c, "#lan") == "Friday build party"
+	})
+
+	a.handleRoomCommand("op #lan " + b.ID)
+	waitForNotice(t, b, "made you an op of #lan")
+	waitFor(t, "c to learn b is an op", func() bool {
+		moderation, _ := c.rooms.Moderation("#lan")
+		return moderation.ops[bKey] == aKey
+	})
+	before, _ := a.rooms.Get("#lan")
+	b.handleRoomCommand("kick #lan " + c.ID)
+	waitForNotice(t, b, "Kicked")
+	waitForNotice(t, c, "kicked you from #lan")
+	waitFor(t, "a to learn c was kicked", func() bool { return a.rooms.Kicked("#lan", cKey) })
+	if _, joined := c.rooms.Get("#lan"); joined {
+		t.Error("c still in the room after being kicked")
+	}
+	if !roomMembers(a, "#lan", b) || !roomMembers(b, "#lan", a) {
+		t.Errorf("c still a member: a has %v, b has %v", a.rooms.Members("#lan"), b.rooms.Members("#lan"))
+	}
+
+	// The kick changed the key c holds, and only an op's new key is taken
+	waitFor(t, "a to take b's new key", func() bool {
+		room, _ := a.rooms.Get("#lan")
+		return !bytes.Equal(room.Key, before.Key)
+	})
+	aRoom, _ := a.rooms.Get("#lan")
+	bRoom, _ := b.rooms.Get("#lan")
+	if !bytes.Equal(aRoom.Key, bRoom.Key) || !bytes.Equal(aRoom.AuthKey, before.AuthKey) {
+		t.Fatal("a and b differ on the new key, or the kick changed the passphrase")
+	}
+	a.handleMsgCommand("#lan without c")
+	waitFor(t, "b to show the message under the new key", func() bool {
+		return slices.Contains(roomTexts(b, a.ID, "#lan"), "without c")
+	})
+
+	// c knows the passphrase, but isn't welcomed back
+	c.handleJoinCommand("#lan pass")
+	waitFor(t, "a and b to challenge c", func() bool { return answered(c, "#lan", a) && answered(c, "#lan", b) })
+	waitForNotice(t, c, "Couldn't join #lan")
+	if !roomMembers(a, "#lan", b) || !roomMembers(b, "#lan", a) {
+		t.Errorf("c admitted again: a has %v, b has %v", a.rooms.Members("#lan"), b.rooms.Members("#lan"))
+	}
+
+	// What the members learned is saved
+	saved, err := NewRoomBook(filepath.Dir(a.rooms.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moderation, _ := saved.Moderation("#lan"); moderation.topic.Topic != "Friday build party" || moderation.ops[bKey] == "" || moderation.kicked[cKey] == "" {
+		t.Errorf("a saved topic %q, ops %v, kicked %v", moderation.topic.Topic, moderation.ops, moderation.kicked)
+	}
+}
+
+// TestRoomControls checks controls are only taken signed, from ops, and in an order that keeps
+// every member on the same ops
+func TestRoomControls(t *testing.T) {
+	var keys []*CryptoManager
+	for range 3 {
+		cm, err := NewCryptoManager(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, cm)
+	}
+	creator, op, member := keys[0], keys[1], keys[2]
+	now := time.Now()
+	sign := func(cm *CryptoManager, action, target, topic string, at time.Time) RoomControl {
+		t.Helper()
+		control, err := newRoomControl(cm, "#lan", action, target, topic, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := control.verify(now); err != nil {
+			t.Fatalf("%s control doesn't verify: %v", action, err)
+		}
+		return control
+	}
+
+	forged := sign(creator, "topic", "", "real", now)
+	forged.Topic = "forged"
+	impostor := sign(member, "topic", "", "real", now)
+	impostor.Fingerprint = creator.Fingerprint()
+	for name, control := range map[string]RoomControl{"changed topic": forged, "another key": impostor} {
+		if err := control.verify(now); err == nil {
+			t.Errorf("control with %s verified", name)
+		}
+	}
+	if future, err := newRoomControl(creator, "#lan", "topic", "", "later", now.Add(time.Hour)); err != nil || future.verify(now) == nil {
+		t.Errorf("control dated an hour ahead verified (%v)", err)
+	}
+
+	room := newJoinedRoom(Room{Name: "#lan"})
+	room.members[member.Fingerprint()] = "member:1"
+	room.known[member.Fingerprint()] = true
+	for _, step := range []struct {
+		name    string
+		control RoomControl
+		want    bool
+	}{
+		{"topic before the room was created", sign(creator, "topic", "", "early", now), false},
+		{"creation", sign(creator, "create", "", "", now), true},
+		{"topic from a member", sign(member, "topic", "", "mine", now), false},
+		{"rekey from a member", sign(member, "rekey", roomKeyID([]byte("mine")), "", now), false},
+		{"op from a member", sign(member, "op", member.Fingerprint(), "", now), false},
+		{"op from the creator", sign(creator, "op", op.Fingerprint(), "", now), true},
+		{"topic from the new op", sign(op, "topic", "", "from op", now.Add(time.Second)), true},
+		{"older topic", sign(creator, "topic", "", "stale", now), false},
+		{"kick of an op", sign(op, "kick", creator.Fingerprint(), "", now), false},
+		{"kick of a member", sign(op, "kick", member.Fingerprint(), "", now), true},
+		{"op for a kicked member", sign(creator, "op", member.Fingerprint(), "", now), false},
+		{"second creation", sign(member, "create", "", "", now.Add(-time.Hour)), false},
+		{"rekey from the op", sign(op, "rekey", roomKeyID([]byte("first")), "", now), true},
+		{"older rekey", sign(creator, "rekey", roomKeyID([]byte("stale")), "", now.Add(-time.Second)), false},
+		{"newer rekey", sign(creator, "rekey", roomKeyID([]byte("second")), "", now.Add(time.Second)), true},
+	} {
+		if got := room.addControl(step.control); got != step.want {
+			t.Errorf("%s: taken %v, want %v", step.name, got, step.want)
+		}
+	}
+	moderation := moderate(room.controls)
+	if moderation.creator != creator.Fingerprint() || moderation.topic.Topic != "from op" || len(moderation.ops) != 2 {
+		t.Errorf("creator %s, topic %q, ops %v", moderation.creator, moderation.topic.Topic, moderation.ops)
+	}
+	rekeys := slices.DeleteFunc(slices.Clone(room.controls), func(control RoomControl) bool { return control.Action != "rekey" })
+	if moderation.rekey.Target != roomKeyID([]byte("second")) || len(rekeys) != 1 {
+		t.Errorf("rekey names %s, with %d rekey controls kept", moderation.rekey.Target, len(rekeys))
+	}
+	if invalid, err := newRoomControl(creator, "#lan", "rekey", "not a key ID", "", now); err != nil || invalid.verify(now) == nil {
+		t.Errorf("rekey control without a key ID verified (%v)", err)
+	}
+	if _, admitted := room.members[member.Fingerprint()]; admitted || room.known[member.Fingerprint()] {
+		t.Error("kicked member still a member")
+	}
+
+	// Two creations apart: the older wins while the newer is unused, and only then
+	newer := newJoinedRoom(Room{Name: "#lan"})
+	newer.addControl(sign(member, "create", "", "", now))
+	if !newer.addControl(sign(creator, "create", "", "", now.Add(-time.Minute))) || moderate(newer.controls).creator != creator.Fingerprint() {
+		t.Error("an older creation didn't take the place of an unused one")
+	}
+	used := newJoinedRoom(Room{Name: "#lan"})
+	used.addControl(sign(member, "create", "", "", now))
+	used.addControl(sign(member, "topic", "", "set", now))
+	if used.addControl(sign(creator, "create", "", "", now.Add(-time.Minute))) {
+		t.Error("an older creation took the place of one an op had used")
+	}
+}
+
+// TestRoomTopicHeader shows a room's topic in the header while its tab is open
+func TestRoomTopicHeader(t *testing.T) {
+	ui, _ := newTestUI(t, 100, 30)
+	receive(ui, Message{SenderID: memoryHost + ":2", Content: []byte("hello"), Room: "#lan"})
+	ui.rooms = []RoomInfo{{Name: "#lan", Topic: "Friday build party"}}
+	if header := ui.renderHeader(); strings.Contains(header, "Friday") {
+		t.Errorf("the broadcast tab shows the room's topic: %q", header)
+	}
+	ui.switchConversation(ui.findConversation("#lan"))
+	if header := ui.renderHeader(); !strings.Contains(header, "#lan: Friday build party") {
+		t.Errorf("header %q doesn't show the topic", header)
+	}
+}
+
+// TestRoomWebhook posts room messages with their room, and leaves everything else out once the
+// webhook is narrowed to a room
+func TestRoomWebhook(t *testing.T) {
+	endpoint := &webhookEndpoint{status: http.StatusNoContent}
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+
+	tn := newTestNetwork(t, 1)
+	a := tn.nodes[0]
+	a.mentions.Set("alice", nil)
+	b := tn.newNode()
+	b.webhook = NewWebhookDispatcher(WebhookConfig{URL: server.URL, Rooms: []string{"#lan"}})
+	b.webhook.Start(b.Node)
+	tn.start(b)
+	tn.connect(a, b)
+	waitFor(t, "b to learn a's nick", func() bool { return b.presence.Nick(a.ID) == "alice" })
+
+	a.handleRoomCommand("create #lan pass")
+	waitForNotice(t, a, "You started #lan")
+	b.handleJoinCommand("#lan pass")
+	waitFor(t, "a and b to admit each other", func() bool {
+		return roomMembers(a, "#lan", b) && roomMembers(b, "#lan", a)
+	})
+
+	if _, err := a.SendEncryptedText("outside the room"); err != nil {
+		t.Fatal(err)
+	}
+	a.handleMsgCommand("#lan inside the room")
+	waitFor(t, "the room message to be posted", func() bool { return b.webhook.Stats().Delivered == 1 })
+	events := endpoint.received()
+	if len(events) != 1 {
+		t.Fatalf("posted %+v, want only the room message", events)
+	}
+	if event := events[0]; event.Sender != a.ID || event.Nick != "alice" || event.Room != "#lan" || event.Text != "inside the room" {
+		t.Errorf("posted %+v", event)
+	}
+}
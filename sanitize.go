@@ -0,0 +1,133 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// sanitizeText makes peer-supplied text safe to print to a terminal. Invalid UTF-8 is replaced,
+// escape sequences (CSI, OSC, DCS and friends, in 7-bit and 8-bit form) are removed whole, and
+// every other C0/C1 control character except newline and tab is dropped, as are the Unicode
+// bidi overrides that can make text display differently from what it says.
+func sanitizeText(s string) string {
+	if isPlainText(s) {
+		return s
+	}
+	s = strings.ToValidUTF8(s, "�")
+
+	var out strings.Builder
+	out.Grow(len(s))
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\n' || r == '\t':
+			out.WriteRune(r)
+
+		case r == 0x1b: // ESC
+			i = skipEscape(runes, i)
+
+		case r == 0x9b: // 8-bit CSI
+			i = skipCSI(runes, i+1)
+
+		case r == 0x90 || r == 0x98 || r == 0x9d || r == 0x9e || r == 0x9f: // 8-bit DCS, SOS, OSC, PM, APC
+			i = skipString(runes, i+1)
+
+		case r < 0x20 || (r >= 0x7f && r <= 0x9f):
+			// Other control characters are dropped
+
+		case isBidiControl(r):
+			// Dropped
+
+		default:
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+// sanitizeLine is sanitizeText for single-line fields such as node IDs and nicknames
+func sanitizeLine(s string) string {
+	s = sanitizeText(s)
+	if strings.ContainsAny(s, "\n\t") {
+		s = strings.NewReplacer("\n", " ", "\t", " ").Replace(s)
+	}
+	return s
+}
+
+// sanitizeFileName reduces a peer-supplied file name to a safe base name
+func sanitizeFileName(name string) string {
+	name = sanitizeLine(name)
+	name = strings.ReplaceAll(name, "\\", "/") // Windows separators from the peer's side
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return "unnamed"
+	}
+	return name
+}
+
+// isPlainText reports whether s is valid UTF-8 without any characters sanitizeText would change
+func isPlainText(s string) bool {
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if (c < 0x20 && c != '\n' && c != '\t') || c == 0x7f {
+				return false
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError || (r >= 0x80 && r <= 0x9f) || isBidiControl(r) {
+			return false
+		}
+		i += size
+	}
+	return true
+}
+
+// skipEscape returns the index of the last rune of the escape sequence starting at runes[i]
+func skipEscape(runes []rune, i int) int {
+	if i+1 >= len(runes) {
+		return i
+	}
+	switch runes[i+1] {
+	case '[':
+		return skipCSI(runes, i+2)
+	case ']', 'P', 'X', '^', '_':
+		return skipString(runes, i+2)
+	default:
+		// Two-character sequence such as ESC c (reset)
+		return i + 1
+	}
+}
+
+// skipCSI skips CSI parameters up to and including the final byte (0x40-0x7e)
+func skipCSI(runes []rune, i int) int {
+	for ; i < len(runes); i++ {
+		if runes[i] >= 0x40 && runes[i] <= 0x7e {
+			return i
+		}
+	}
+	return len(runes) - 1
+}
+
+// skipString skips an OSC/DCS-style string up to its terminator: BEL, ST (ESC \) or 8-bit ST
+func skipString(runes []rune, i int) int {
+	for ; i < len(runes); i++ {
+		switch {
+		case runes[i] == 0x07 || runes[i] == 0x9c:
+			return i
+		case runes[i] == 0x1b && i+1 < len(runes) && runes[i+1] == '\\':
+			return i + 1
+		}
+	}
+	return len(runes) - 1
+}
+
+// isBidiControl reports whether r is a bidi embedding, override or isolate
+func isBidiControl(r rune) bool {
+	return (r >= 0x202a && r <= 0x202e) || (r >= 0x2066 && r <= 0x2069)
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestSanitizeText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello, world", "hello, world"},
+		{"newline and tab kept", "a\tb\nc", "a\tb\nc"},
+		{"unicode kept", "héllo 👋 日本", "héllo 👋 日本"},
+		{"CSI colour", "\x1b[31mred\x1b[0m", "red"},
+		{"CSI clear screen", "before\x1b[2J\x1b[Hafter", "beforeafter"},
+		{"CSI unterminated", "text\x1b[1;31", "text"},
+		{"OSC title with BEL", "\x1b]0;pwned\x07hi", "hi"},
+		{"OSC hyperlink with ST", "\x1b]8;;http://evil\x1b\\click\x1b]8;;\x1b\\", "click"},
+		{"OSC 52 clipboard write", "\x1b]52;c;cm0gLXJmIH4K\x07ok", "ok"},
+		{"DCS", "\x1bPq#0;2;0;0;0\x1b\\after", "after"},
+		{"APC and PM", "\x1b_payload\x1b\\a\x1b^payload\x1b\\b", "ab"},
+		{"two-character escape", "x\x1bcy", "xy"},
+		{"lone ESC at end", "x\x1b", "x"},
+		{"8-bit CSI", "a\u009b31mb", "ab"},
+		{"8-bit OSC with 8-bit ST", "a\u009d0;title\u009cb", "ab"},
+		{"C0 controls dropped", "a\x00b\x07c\rd\x08e", "abcde"},
+		{"DEL and C1 dropped", "a\x7fb\u0085c", "abc"},
+		{"bidi override", "abc\u202edcba\u202c", "abcdcba"},
+		{"bidi isolate", "\u2066x\u2069", "x"},
+		{"invalid UTF-8", "a\xffb", "a�b"},
+		{"invalid UTF-8 hiding C1", "a\xc2\x9b31mb", "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeText(tt.in); got != tt.want {
+				t.Errorf("sanitizeText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeLine(t *testing.T) {
+	if got := sanitizeLine("one\ntwo\tthree\x1b[2K"); got != "one two three" {
+		t.Errorf("sanitizeLine = %q, want %q", got, "one two three")
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\windows\system.ini`, "system.ini"},
+		{"..", "unnamed"},
+		{"", "unnamed"},
+		{"\x1b[31mred.txt", "red.txt"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFileName(tt.in); got != tt.want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// messageSearch is a search of the messages in the TUI. While the prompt is open the query is
+// matched as it is typed; after Enter, n and N move between the matches.
+type messageSearch struct {
+	prompt   textinput.Model
+	editing  bool           // The prompt has the keyboard
+	regex    bool           // The query is a regular expression rather than plain text
+	pattern  *regexp.Regexp // Compiled query; nil while it is empty or invalid
+	err      error          // Why the query doesn't compile
+	matches  []int          // Positions in ui.messages of the matching messages, oldest first
+	current  int            // The selected match, an index into matches
+	selected ChatMessage    // The selected message, to keep it selected as messages come and go
+	offset   int            // Viewport offset to go back to when the search ends
+	follow   bool           // The viewport was following new messages when the search started
+}
+
+// compileSearch turns a query into a case-insensitive pattern. Plain queries match as substrings.
+func compileSearch(query string, regex bool) (*regexp.Regexp, error) {
+	if query == "" {
+		return nil, nil
+	}
+	if !regex {
+		query = regexp.QuoteMeta(query)
+	}
+	return regexp.Compile("(?i)" + query)
+}
+
+// startSearch opens the search prompt, or reopens it to change the query
+func (ui *UI) startSearch() {
+	if ui.search == nil {
+		prompt := textinput.New()
+		prompt.Prompt = "🔍 "
+		prompt.Placeholder = "Search messages..."
+		// Ctrl+H toggles help, as in the input
+		prompt.KeyMap.DeleteCharacterBackward.SetKeys("backspace")
+		ui.search = &messageSearch{
+			prompt: prompt,
+			offset: ui.viewport.YOffset,
+			follow: ui.viewport.AtBottom(),
+		}
+	}
+	ui.search.editing = true
+	ui.search.prompt.Width = max(ui.width-10, 1)
+	ui.search.prompt.Focus()
+	ui.textarea.Blur()
+}
+
+// endSearch closes the search, clears the highlights and goes back to where the view was
+func (ui *UI) endSearch() {
+	s := ui.search
+	ui.search = nil
+	ui.setFocus(ui.focus)
+	ui.updateViewport()
+	if s.follow {
+		ui.viewport.GotoBottom()
+	} else {
+		ui.viewport.SetYOffset(s.offset)
+	}
+	ui.checkRead()
+}
+
+// handleSearchKey handles keys while a search is open. Keys that work anywhere (quit, help,
+// paging) are left to the caller. It reports whether the key was used.
+func (ui *UI) handleSearchKey(msg tea.KeyMsg) (bool, tea.Cmd) {
+	s := ui.search
+	switch msg.Type {
+	case tea.KeyCtrlC, tea.KeyCtrlH, tea.KeyCtrlG, tea.KeyPgUp, tea.KeyPgDown, tea.KeyHome, tea.KeyEnd:
+		return false, nil
+	case tea.KeyEsc:
+		ui.endSearch()
+		return true, nil
+	case tea.KeyCtrlR:
+		s.regex = !s.regex
+		ui.runSearch()
+		return true, nil
+	}
+
+	if s.editing {
+		switch msg.Type {
+		case tea.KeyEnter:
+			s.editing = false
+			s.prompt.Blur()
+			return true, nil
+		case tea.KeyUp:
+			ui.stepMatch(-1)
+			return true, nil
+		case tea.KeyDown:
+			ui.stepMatch(1)
+			return true, nil
+		}
+		query := s.prompt.Value()
+		var cmd tea.Cmd
+		s.prompt, cmd = s.prompt.Update(msg)
+		if s.prompt.Value() != query {
+			ui.runSearch()
+		}
+		return true, cmd
+	}
+
+	switch {
+	case msg.Type == tea.KeyCtrlF || msg.String() == "/":
+		ui.startSearch()
+	case msg.String() == "n":
+		ui.stepMatch(-1)
+	case msg.String() == "N":
+		ui.stepMatch(1)
+	case msg.Type == tea.KeyUp:
+		ui.viewport.ScrollUp(1)
+	case msg.Type == tea.KeyDown:
+		ui.viewport.ScrollDown(1)
+	}
+	// Anything else is swallowed, so stray typing doesn't end up in the hidden input
+	return true, nil
+}
+
+// runSearch compiles the query, finds every matching message and selects the newest match
+func (ui *UI) runSearch() {
+	s := ui.search
+	s.pattern, s.err = compileSearch(s.prompt.Value(), s.regex)
+	s.matches = s.matches[:0]
+	s.current = 0
+	if s.pattern != nil {
+		for i, msg := range ui.messages {
+			if s.pattern.MatchString(msg.Content) {
+				s.matches = append(s.matches, i)
+			}
+		}
+	}
+	if len(s.matches) > 0 {
+		s.current = len(s.matches) - 1
+		s.selected = ui.messages[s.matches[s.current]]
+	}
+	ui.updateViewport()
+	ui.showMatch()
+}
+
+// refreshMatches finds the matches again after messages were inserted or dropped, keeping the
+// same message selected if it is still there
+func (ui *UI) refreshMatches() {
+	s := ui.search
+	s.matches = s.matches[:0]
+	if s.pattern == nil {
+		return
+	}
+	s.current = -1
+	for i, msg := range ui.messages {
+		if !s.pattern.MatchString(msg.Content) {
+			continue
+		}
+		if sameMessage(msg, s.selected) {
+			s.current = len(s.matches)
+		}
+		s.matches = append(s.matches, i)
+	}
+	if s.current < 0 {
+		s.current = max(len(s.matches)-1, 0)
+		if len(s.matches) > 0 {
+			s.selected = ui.messages[s.matches[s.current]]
+		}
+	}
+}
+
+// sameMessage reports whether two messages are the same one
+func sameMessage(a, b ChatMessage) bool {
+	return a.Sender == b.Sender && a.Timestamp.Equal(b.Timestamp) && a.Lamport == b.Lamport && a.Content == b.Content
+}
+
+// stepMatch selects an older (-1) or newer (+1) match, wrapping around at either end
+func (ui *UI) stepMatch(delta int) {
+	s := ui.search
+	if len(s.matches) == 0 {
+		return
+	}
+	s.current = (s.current + delta + len(s.matches)) % len(s.matches)
+	s.selected = ui.messages[s.matches[s.current]]
+	ui.updateViewport()
+	ui.showMatch()
+}
+
+// showMatch scrolls the selected match to the middle of the viewport
+func (ui *UI) showMatch() {
+	s := ui.search
+	if len(s.matches) == 0 {
+		return
+	}
+	line := 0
+	for _, msg := range ui.messages[:s.matches[s.current]] {
+		line += lipgloss.Height(ui.renderMessage(msg, false))
+	}
+	ui.viewport.SetYOffset(line - ui.viewport.Height/2)
+}
+
+// isCurrentMatch reports whether the message at position i is the selected match
+func (ui *UI) isCurrentMatch(i int) bool {
+	s := ui.search
+	return s != nil && len(s.matches) > 0 && s.matches[s.current] == i
+}
+
+// searchSpans returns where the search query matches text, for highlighting
+func (ui *UI) searchSpans(text string) []textSpan {
+	if ui.search == nil || ui.search.pattern == nil {
+		return nil
+	}
+
+	var spans []textSpan
+	for _, loc := range ui.search.pattern.FindAllStringIndex(text, -1) {
+		if loc[0] == loc[1] {
+			continue // Empty matches have nothing to highlight
+		}
+		spans = append(spans, textSpan{start: loc[0], end: loc[1]})
+	}
+	return spans
+}
+
+// renderSearchStatus describes the search for the status bar, e.g. "match 3/17"
+func (ui *UI) renderSearchStatus() string {
+	s := ui.search
+	if s == nil {
+		return ""
+	}
+
+	status := "🔍 "
+	switch {
+	case s.err != nil:
+		status += "invalid regex"
+	case s.pattern == nil:
+		status += "type to search"
+	case len(s.matches) == 0:
+		status += "no matches"
+	default:
+		status += fmt.Sprintf("match %d/%d", s.current+1, len(s.matches))
+	}
+	if s.regex {
+		status += " (regex)"
+	}
+	return searchMatchStyle.Render(status)
+}
+
+// renderSearchPrompt renders the search prompt in place of the input box
+func (ui *UI) renderSearchPrompt(style lipgloss.Style) string {
+	title := "🔍 Search (Enter: browse, ↑/↓: older/newer, Ctrl+R: regex, Esc: cancel)"
+	if !ui.search.editing {
+		title = "🔍 Search (n/N: older/newer, /: edit, Ctrl+R: regex, Esc: done)"
+	}
+	title = lipgloss.NewStyle().MaxWidth(ui.width - 4).Render(title)
+	return style.Width(ui.width - 2).Render(fmt.Sprintf("%s\n%s", title, ui.search.prompt.View()))
+}
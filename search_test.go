@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/muesli/termenv"
+)
+
+// TestCompileSearch matches plain queries as case-insensitive substrings, and regex ones as
+// case-insensitive patterns
+func TestCompileSearch(t *testing.T) {
+	for _, tc := range []struct {
+		query   string
+		regex   bool
+		text    string
+		match   bool
+		wantErr bool
+	}{
+		{"hello", false, "well, HELLO there", true, false},
+		{"hello", false, "help", false, false},
+		{"a.b", false, "a.b", true, false},
+		{"a.b", false, "axb", false, false},
+		{"(", false, "smile (", true, false},
+		{"a.b", true, "AXB", true, false},
+		{"^id [0-9]+$", true, "id 42", true, false},
+		{"^id [0-9]+$", true, "my id 42", false, false},
+		{"(", true, "", false, true},
+	} {
+		pattern, err := compileSearch(tc.query, tc.regex)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("compileSearch(%q, regex=%v) compiled", tc.query, tc.regex)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("compileSearch(%q, regex=%v): %v", tc.query, tc.regex, err)
+			continue
+		}
+		if got := pattern.MatchString(tc.text); got != tc.match {
+			t.Errorf("%q (regex=%v) matching %q: %v, want %v", tc.query, tc.regex, tc.text, got, tc.match)
+		}
+	}
+	if pattern, err := compileSearch("", true); pattern != nil || err != nil {
+		t.Errorf("an empty query compiled to %v, %v", pattern, err)
+	}
+}
+
+// TestSearchMessages searches the scrollback as a query is typed, steps through the matches
+// either way round, and puts the view back when the search ends
+func TestSearchMessages(t *testing.T) {
+	useTheme(t, themes[defaultTheme], termenv.TrueColor) // For highlights to show
+	ui, _ := newTestUI(t, 100, 30)
+	for _, text := range []string{"the deploy is done", "lunch?", "Deploy again", "the build broke", "deploying a fix"} {
+		receive(ui, Message{SenderID: "127.0.0.1:2", Content: []byte(text)})
+	}
+	typeKeys := func(keys ...tea.KeyMsg) {
+		for _, key := range keys {
+			ui.Update(key)
+		}
+	}
+	status := func() string { return stripANSIKeepOSC8(ui.renderSearchStatus()) }
+
+	typeKeys(tea.KeyMsg{Type: tea.KeyCtrlF})
+	if ui.search == nil || !strings.Contains(status(), "type to search") {
+		t.Fatalf("Ctrl+F didn't open the search; status %q", status())
+	}
+	typeKeys(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("deploy")})
+	if got := status(); !strings.Contains(got, "match 3/3") {
+		t.Errorf("after typing the query the status is %q, want the newest of 3 matches", got)
+	}
+	if selected := ui.search.selected.Content; selected != "deploying a fix" {
+		t.Errorf("selected %q, want the newest match", selected)
+	}
+	if view := ui.viewport.View(); !strings.Contains(view, currentMatchStyle.Render("deploy")) || !strings.Contains(view, searchMatchStyle.Render("Deploy")) {
+		t.Error("the matches aren't highlighted")
+	}
+
+	// Enter browses: n is older, N newer, both wrapping around
+	typeKeys(tea.KeyMsg{Type: tea.KeyEnter}, tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("n")})
+	if got := status(); !strings.Contains(got, "match 2/3") {
+		t.Errorf("after n the status is %q", got)
+	}
+	typeKeys(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("N")}, tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("N")})
+	if got := status(); !strings.Contains(got, "match 1/3") || ui.search.selected.Content != "the deploy is done" {
+		t.Errorf("N past the newest match went to %q, %q", got, ui.search.selected.Content)
+	}
+
+	// A message arriving keeps the same match selected
+	receive(ui, Message{SenderID: "127.0.0.1:2", Content: []byte("deploy number four")})
+	if got := status(); !strings.Contains(got, "match 1/4") || ui.search.selected.Content != "the deploy is done" {
+		t.Errorf("after a new match arrived: %q, selected %q", got, ui.search.selected.Content)
+	}
+
+	// Regex queries, and ones that don't compile
+	typeKeys(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("/")}, tea.KeyMsg{Type: tea.KeyCtrlR})
+	for range len("deploy") {
+		typeKeys(tea.KeyMsg{Type: tea.KeyBackspace})
+	}
+	typeKeys(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("^(lunch|the)")})
+	if got := status(); !strings.Contains(got, "match 3/3") || !strings.Contains(got, "(regex)") {
+		t.Errorf("regex search status %q", got)
+	}
+	typeKeys(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("(")})
+	if got := status(); !strings.Contains(got, "invalid regex") {
+		t.Errorf("status %q for a query that doesn't compile", got)
+	}
+
+	typeKeys(tea.KeyMsg{Type: tea.KeyEsc})
+	if ui.search != nil || ui.searchSpans("deploy") != nil {
+		t.Error("Esc left the search open")
+	}
+	if !ui.viewport.AtBottom() {
+		t.Error("the view following new messages was left scrolled to a match")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultHopLimit = 3    // Hops a text message may travel: the first to each peer, the rest once relays exist
+	seenCacheSize   = 4096 // Message IDs remembered for duplicate suppression
+)
+
+// SeenCache remembers the IDs of recent text messages, ours included, so that none is processed
+// or forwarded twice: not when it arrives over a second connection to the same peer, and not when
+// it comes back around a loop of peers. Once full, the oldest ID is forgotten.
+type SeenCache struct {
+	mutex      sync.Mutex
+	ids        map[string]string // Connection each message first came over; empty for our own
+	order      []string          // Ring of remembered IDs; the oldest is at next
+	next       int
+	duplicates atomic.Uint64
+}
+
+// NewSeenCache creates a cache remembering up to size IDs
+func NewSeenCache(size int) *SeenCache {
+	return &SeenCache{
+		ids:   make(map[string]string, size),
+		order: make([]string, size),
+	}
+}
+
+// First records a message ID from a sender, reporting whether it is new. Repeats are counted.
+func (sc *SeenCache) First(senderID, messageID string) bool {
+	first, _ := sc.FirstOver(senderID, messageID, "")
+	return first
+}
+
+// FirstOver is First for a message that arrived over a connection. replayed reports a repeat
+// over the connection the first copy came over: a peer relays a message once, so neither a loop
+// nor a second connection explains that.
+func (sc *SeenCache) FirstOver(senderID, messageID, connID string) (first, replayed bool) {
+	key := senderID + "/" + messageID
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if firstConn, seen := sc.ids[key]; seen {
+		sc.duplicates.Add(1)
+		return false, connID != "" && firstConn == connID
+	}
+	if oldest := sc.order[sc.next]; oldest != "" {
+		delete(sc.ids, oldest)
+	}
+	sc.order[sc.next] = key
+	sc.next = (sc.next + 1) % len(sc.order)
+	sc.ids[key] = connID
+	return true, false
+}
+
+// Duplicates returns how many repeated messages were suppressed
+func (sc *SeenCache) Duplicates() uint64 {
+	return sc.duplicates.Load()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestSeenCache reports each sender's message ID as new once, counting the repeats, and forgets
+// the oldest ID once full
+func TestSeenCache(t *testing.T) {
+	sc := NewSeenCache(3)
+	if !sc.First("alice", "m1") || sc.First("alice", "m1") {
+		t.Fatal("m1 wasn't new exactly once")
+	}
+	if !sc.First("bob", "m1") {
+		t.Error("bob's m1 was taken for alice's")
+	}
+	sc.First("alice", "m2")
+	sc.First("alice", "m3") // Full: alice's m1 goes
+	if !sc.First("alice", "m1") {
+		t.Error("the oldest ID wasn't forgotten once the cache was full")
+	}
+	if sc.First("alice", "m3") {
+		t.Error("a recent ID was forgotten")
+	}
+	if got := sc.Duplicates(); got != 2 {
+		t.Errorf("counted %d duplicates, want 2", got)
+	}
+
+	// Over connections, only a repeat over the first copy's connection is a replay
+	if first, replayed := sc.FirstOver("carol", "m1", "conn1"); !first || replayed {
+		t.Errorf("a new message: first %v, replayed %v", first, replayed)
+	}
+	if first, replayed := sc.FirstOver("carol", "m1", "conn2"); first || replayed {
+		t.Errorf("over a second connection: first %v, replayed %v", first, replayed)
+	}
+	if first, replayed := sc.FirstOver("carol", "m1", "conn1"); first || !replayed {
+		t.Errorf("again over the first connection: first %v, replayed %v", first, replayed)
+	}
+}
+
+// TestTriangleDeliversOnce connects three nodes to each other and has each broadcast, twice over
+// for the same message: every node shows every message exactly once, and /stats counts the
+// repeats it suppressed
+func TestTriangleDeliversOnce(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	nodes := tn.nodes
+	tn.connect(nodes[0], nodes[1])
+	tn.connect(nodes[1], nodes[2])
+	// Peer exchange may connect the last pair first
+	if err := nodes[2].connectToPeer(nodes[0].ID); err != nil && !connectedTo(nodes[2], nodes[0].ID) {
+		t.Fatal(err)
+	}
+	waitForKeys(t, nodes[2], nodes[0])
+
+	for i, sender := range nodes {
+		text := fmt.Sprintf("hello from %d", i)
+		envelope := sender.newTextEnvelope(text, true)
+		for range 2 {
+			if _, err := sender.broadcastEnvelope(envelope); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, node := range nodes {
+			if node != sender {
+				waitForText(t, node, sender.ID, text)
+			}
+		}
+	}
+	for _, node := range nodes {
+		waitFor(t, node.ID+" to suppress the repeats", func() bool { return node.seen.Duplicates() == 2 })
+	}
+	time.Sleep(100 * time.Millisecond) // For any further copy to arrive
+	for _, node := range nodes {
+		for i, sender := range nodes {
+			if node == sender {
+				continue
+			}
+			text := fmt.Sprintf("hello from %d", i)
+			if n := len(slices.DeleteFunc(loggedTexts(node, sender.ID), func(got string) bool { return got != text })); n != 1 {
+				t.Errorf("%s showed %q %d times", node.ID, text, n)
+			}
+		}
+		if got := node.seen.Duplicates(); got != 2 {
+			t.Errorf("%s suppressed %d duplicates, want 2", node.ID, got)
+		}
+	}
+	nodes[0].handleEnhancedCLICommand("/stats", nodes[0].ID)
+	waitForNotice(t, nodes[0], "Duplicates suppressed: 2")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Errors for a message that couldn't be handed to a peer's connection
+var (
+	ErrNotIdentified  = errors.New("peer hasn't sent its node ID yet, so there is no key to encrypt for")
+	ErrSendQueueFull  = errors.New("send queue full")
+	ErrPeerDisconnect = errors.New("peer disconnected while the message was being encrypted")
+)
+
+// PeerError is why a message didn't go to one peer
+type PeerError struct {
+	Peer string
+	Err  error
+}
+
+func (e *PeerError) Error() string { return fmt.Sprintf("%s: %v", e.Peer, e.Err) }
+func (e *PeerError) Unwrap() error { return e.Err }
+
+// BroadcastError is returned when a message sent to every peer didn't go to some of them. It
+// names each peer it missed and why; errors.Is and errors.As see through to the reasons.
+type BroadcastError struct {
+	Peers  int // Peers the message was for
+	Failed []*PeerError
+}
+
+// newBroadcastError returns a BroadcastError for the failures, or nil if there were none
+func newBroadcastError(peers int, failed []*PeerError) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return &BroadcastError{Peers: peers, Failed: failed}
+}
+
+func (e *BroadcastError) Error() string {
+	reasons := make([]string, len(e.Failed))
+	for i, failure := range e.Failed {
+		reasons[i] = failure.Error()
+	}
+	return fmt.Sprintf("not sent to %d of %d peers (%s)", len(e.Failed), e.Peers, strings.Join(reasons, "; "))
+}
+
+func (e *BroadcastError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, failure := range e.Failed {
+		errs[i] = failure
+	}
+	return errs
+}
+
+// FailedPeers returns the IDs of the peers the message didn't go to
+func (e *BroadcastError) FailedPeers() []string {
+	peers := make([]string, len(e.Failed))
+	for i, failure := range e.Failed {
+		peers[i] = failure.Peer
+	}
+	return peers
+}
+
+// sentToAny reports whether a send that returned err reached at least one peer: it succeeded, or
+// it was a broadcast that only some peers missed. The sender then shows what was sent as well as
+// the error.
+func sentToAny(err error) bool {
+	var broadcast *BroadcastError
+	if errors.As(err, &broadcast) {
+		return len(broadcast.Failed) < broadcast.Peers
+	}
+	return err == nil
+}
+
+// notifySendError tells the user what a send failed with. A broadcast lists the peers it missed,
+// as a warning if it reached the others.
+func (n *Node) notifySendError(what string, err error) {
+	log.Printf("Failed to send %s: %v", strings.ToLower(what), err)
+
+	var broadcast *BroadcastError
+	if !errors.As(err, &broadcast) {
+		n.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ %s not sent: %v", what, err)),
+		})
+		return
+	}
+
+	var content strings.Builder
+	if sentToAny(err) {
+		content.WriteString(fmt.Sprintf("⚠️ %s not delivered to %d of %d peers:", what, len(broadcast.Failed), broadcast.Peers))
+	} else {
+		content.WriteString(fmt.Sprintf("❌ %s not sent to any of the %d peers:", what, broadcast.Peers))
+	}
+	for _, failure := range broadcast.Failed {
+		content.WriteString(fmt.Sprintf("\n  - %s: %v", failure.Peer, failure.Err))
+	}
+	n.notifyUI(Message{SenderID: "System", Content: []byte(content.String())})
+}
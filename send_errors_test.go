@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSendErrors checks what each kind of send failure says, which reasons errors.Is sees through
+// it, whether it counts as sent, and how the user is told
+func TestSendErrors(t *testing.T) {
+	encryptFailed := &PeerError{Peer: "198.51.100.2:9000", Err: fmt.Errorf("failed to encrypt: %w", errors.New("no key"))}
+	queueFull := &PeerError{Peer: "198.51.100.1:9000", Err: ErrSendQueueFull}
+	node := newTestNetwork(t, 1).nodes[0]
+
+	for _, tc := range []struct {
+		name    string
+		err     error
+		is      []error
+		failed  []string // FailedPeers, for a broadcast
+		sent    bool
+		message string
+		notice  string
+	}{
+		{
+			name: "sent", err: nil, sent: true,
+		},
+		{
+			name: "no peers", err: newBroadcastError(0, nil), sent: true,
+		},
+		{
+			name: "one peer of two missed", err: newBroadcastError(2, []*PeerError{queueFull}),
+			is: []error{ErrSendQueueFull}, failed: []string{queueFull.Peer}, sent: true,
+			message: "not sent to 1 of 2 peers (198.51.100.1:9000: send queue full)",
+			notice:  "⚠️ Message not delivered to 1 of 2 peers:\n  - 198.51.100.1:9000: send queue full",
+		},
+		{
+			name: "every peer missed", err: newBroadcastError(2, []*PeerError{queueFull, encryptFailed}),
+			is: []error{ErrSendQueueFull}, failed: []string{queueFull.Peer, encryptFailed.Peer}, sent: false,
+			message: "not sent to 2 of 2 peers (198.51.100.1:9000: send queue full; 198.51.100.2:9000: failed to encrypt: no key)",
+			notice:  "❌ Message not sent to any of the 2 peers:\n  - 198.51.100.1:9000: send queue full\n  - 198.51.100.2:9000: failed to encrypt: no key",
+		},
+		{
+			name: "unidentified peer", err: newBroadcastError(1, []*PeerError{{Peer: "conn-1", Err: ErrNotIdentified}}),
+			is: []error{ErrNotIdentified}, failed: []string{"conn-1"}, sent: false,
+			message: "not sent to 1 of 1 peers (conn-1: " + ErrNotIdentified.Error() + ")",
+			notice:  "❌ Message not sent to any of the 1 peers:\n  - conn-1: " + ErrNotIdentified.Error(),
+		},
+		{
+			name: "direct message, queue full", err: fmt.Errorf("%w for %s", ErrSendQueueFull, "198.51.100.1:9000"),
+			is: []error{ErrSendQueueFull}, sent: false,
+			message: "send queue full for 198.51.100.1:9000",
+			notice:  "❌ Message not sent: send queue full for 198.51.100.1:9000",
+		},
+		{
+			name: "disconnected mid-send", err: newBroadcastError(1, []*PeerError{{Peer: "198.51.100.3:9000", Err: ErrPeerDisconnect}}),
+			is: []error{ErrPeerDisconnect}, failed: []string{"198.51.100.3:9000"}, sent: false,
+			message: "not sent to 1 of 1 peers (198.51.100.3:9000: " + ErrPeerDisconnect.Error() + ")",
+		},
+	} {
+		if sentToAny(tc.err) != tc.sent {
+			t.Errorf("%s: sentToAny is %v", tc.name, !tc.sent)
+		}
+		if tc.err == nil {
+			continue
+		}
+		if tc.message != "" && tc.err.Error() != tc.message {
+			t.Errorf("%s: %q, want %q", tc.name, tc.err.Error(), tc.message)
+		}
+		for _, reason := range tc.is {
+			if !errors.Is(tc.err, reason) {
+				t.Errorf("%s: errors.Is doesn't see %v", tc.name, reason)
+			}
+		}
+		var broadcast *BroadcastError
+		if errors.As(tc.err, &broadcast) != (tc.failed != nil) {
+			t.Errorf("%s: errors.As finds a BroadcastError: %v", tc.name, broadcast != nil)
+		} else if broadcast != nil && !slices.Equal(broadcast.FailedPeers(), tc.failed) {
+			t.Errorf("%s: failed peers %v, want %v", tc.name, broadcast.FailedPeers(), tc.failed)
+		}
+		if tc.failed != nil {
+			var peerErr *PeerError
+			if !errors.As(tc.err, &peerErr) || peerErr.Peer != tc.failed[0] {
+				t.Errorf("%s: errors.As finds the PeerError %v", tc.name, peerErr)
+			}
+		}
+		if tc.notice != "" {
+			node.notifySendError("Message", tc.err)
+			waitForNotice(t, node, tc.notice)
+		}
+	}
+}
+
+// TestPartialBroadcastNamesPeers broadcasts to a peer holding our key and a legacy one whose key
+// we don't have: the message reaches the first, and the error, and the notice, name the second
+func TestPartialBroadcastNamesPeers(t *testing.T) {
+	tn, a, b := connectedPair(t)
+	legacy, err := tn.network.Dial(a.ID, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { legacy.Close() })
+	go io.Copy(io.Discard, legacy)
+	const legacyID = memoryHost + ":20000"
+	fmt.Fprintf(legacy, "%s%c%s\n", legacyID, delimiter, "hello")
+	waitFor(t, "the legacy peer to be registered", func() bool { return connectedTo(a, legacyID) })
+
+	_, err = a.SendEncryptedText("to everyone")
+	var broadcast *BroadcastError
+	if !errors.As(err, &broadcast) || broadcast.Peers != 2 || !slices.Equal(broadcast.FailedPeers(), []string{legacyID}) {
+		t.Fatalf("broadcast returned %v", err)
+	}
+	if !sentToAny(err) {
+		t.Error("a broadcast that reached b counts as not sent")
+	}
+	waitForText(t, b, a.ID, "to everyone")
+
+	a.handleEnhancedCLICommand("typed to everyone", a.ID)
+	waitForText(t, b, a.ID, "typed to everyone")
+	waitForText(t, a, a.ID, "typed to everyone")
+	waitForNotice(t, a, "⚠️ Message not delivered to 1 of 2 peers:\n  - "+legacyID+": failed to encrypt")
+
+	a.handleEnhancedCLICommand("/msg "+legacyID+" just you", a.ID)
+	waitFor(t, "the failed direct message to be reported", func() bool {
+		return slices.ContainsFunc(loggedTexts(a, "System"), func(notice string) bool {
+			return strings.HasPrefix(notice, "❌ Failed to send to "+legacyID+":")
+		})
+	})
+}
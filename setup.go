@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/term"
+)
+
+// errSetupCancelled is returned when the user quits the first-run setup instead of finishing it
+var errSetupCancelled = errors.New("setup cancelled")
+
+// setupAnswers is what the first-run setup asks for. Every answer has a default, so any question
+// can be skipped.
+type setupAnswers struct {
+	Nick         string
+	Discovery    bool
+	DownloadsDir string // Empty means <data dir>/downloads
+	Passphrase   string // Only asked for when no key exists yet; empty leaves the key unencrypted
+}
+
+// needsSetup reports whether this is a first run: there is no config file yet
+func needsSetup(configPath string) bool {
+	_, err := os.Stat(configPath)
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// hasIdentity reports whether the data directory already holds a key pair
+func hasIdentity(dataDir string) bool {
+	_, err := os.Stat(filepath.Join(dataDir, keysDirName, privateKeyFile))
+	return err == nil
+}
+
+// finishSetup writes the config file and, if there is no key pair yet, generates one. It returns
+// the fingerprint of the identity, for the user to share.
+func finishSetup(dataDir, configPath string, answers setupAnswers) (string, error) {
+	config := &Config{
+		Nick:      answers.Nick,
+		Discovery: &answers.Discovery,
+	}
+	if answers.DownloadsDir != "" {
+		dir, err := filepath.Abs(expandHome(answers.DownloadsDir))
+		if err != nil {
+			return "", fmt.Errorf("invalid downloads directory: %w", err)
+		}
+		if dir != filepath.Join(dataDir, downloadsDirName) {
+			config.DownloadsDir = dir
+		}
+	}
+
+	keysDir := filepath.Join(dataDir, keysDirName)
+	var fingerprint string
+	var err error
+	if hasIdentity(dataDir) {
+		fingerprint, err = identityFingerprint(keysDir)
+	} else {
+		fingerprint, err = createIdentity(keysDir, answers.Passphrase)
+		if answers.Passphrase != "" {
+			// The node opens the key next; don't ask for what was just typed
+			setKeyPassphrase(answers.Passphrase)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := SaveConfig(configPath, config); err != nil {
+		return "", err
+	}
+	return fingerprint, nil
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// runSetupPrompts asks the first-run questions on a plain terminal. An empty answer takes the
+// default shown in brackets.
+func runSetupPrompts(in *bufio.Reader, out io.Writer, dataDir string) (setupAnswers, error) {
+	ask := func(question string) (string, error) {
+		fmt.Fprint(out, question)
+		answer, err := in.ReadString('\n')
+		if err != nil && (answer == "" || !errors.Is(err, io.EOF)) {
+			return "", err
+		}
+		return strings.TrimSpace(answer), nil
+	}
+
+	answers := setupAnswers{Discovery: true}
+	fmt.Fprintln(out, "Welcome to p2pchat! A few questions to get started; press Enter to take the default.")
+
+	var err error
+	if answers.Nick, err = ask("Nickname (shown to peers) []: "); err != nil {
+		return answers, err
+	}
+
+	discovery, err := ask("Find peers on the local network automatically? [Y/n]: ")
+	if err != nil {
+		return answers, err
+	}
+	answers.Discovery = !strings.HasPrefix(strings.ToLower(discovery), "n")
+
+	defaultDownloads := filepath.Join(dataDir, downloadsDirName)
+	if answers.DownloadsDir, err = ask(fmt.Sprintf("Save received files in [%s]: ", defaultDownloads)); err != nil {
+		return answers, err
+	}
+
+	if !hasIdentity(dataDir) {
+		for {
+			passphrase, err := readPassphrase(in, out, "Passphrase to protect your key (empty for none): ")
+			if err != nil || passphrase == "" {
+				return answers, err
+			}
+			confirm, err := readPassphrase(in, out, "Repeat the passphrase: ")
+			if err != nil {
+				return answers, err
+			}
+			if passphrase == confirm {
+				answers.Passphrase = passphrase
+				break
+			}
+			fmt.Fprintln(out, "The passphrases don't match; try again.")
+		}
+	}
+	return answers, nil
+}
+
+// readPassphrase reads a line without echoing it when stdin is a terminal
+func readPassphrase(in *bufio.Reader, out io.Writer, prompt string) (string, error) {
+	fmt.Fprint(out, prompt)
+	if isTerminal(os.Stdin) {
+		passphrase, err := term.ReadPassword(os.Stdin.Fd())
+		fmt.Fprintln(out)
+		return string(passphrase), err
+	}
+	line, err := in.ReadString('\n')
+	if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// setupStep is one question of the TUI setup form
+type setupStep int
+
+const (
+	stepNick setupStep = iota
+	stepDiscovery
+	stepDownloads
+	stepPassphrase
+	stepConfirm
+	stepSaving // Writing the config and generating the key
+	stepDone   // Showing the fingerprint
+)
+
+// setupSavedMsg reports the outcome of finishSetup to the form
+type setupSavedMsg struct {
+	fingerprint string
+	err         error
+}
+
+// setupForm is the first-run setup as a bubbletea form, used when starting the TUI
+type setupForm struct {
+	dataDir     string
+	configPath  string
+	askPassword bool // No key exists yet, so a passphrase can be set
+	step        setupStep
+	input       textinput.Model
+	answers     setupAnswers
+	problem     string // Shown under the question, e.g. mismatched passphrases
+	fingerprint string
+	err         error
+	cancelled   bool
+}
+
+// runSetupForm runs the setup form and returns the fingerprint of the identity
+func runSetupForm(dataDir, configPath string) (string, error) {
+	form := &setupForm{
+		dataDir:     dataDir,
+		configPath:  configPath,
+		askPassword: !hasIdentity(dataDir),
+		input:       textinput.New(),
+		answers:     setupAnswers{Discovery: true},
+	}
+	form.enter(stepNick)
+
+	if _, err := tea.NewProgram(form).Run(); err != nil {
+		return "", err
+	}
+	if form.cancelled {
+		return "", errSetupCancelled
+	}
+	return form.fingerprint, form.err
+}
+
+// enter moves the form to a step, preparing the input for its question
+func (f *setupForm) enter(step setupStep) {
+	if (step == stepPassphrase || step == stepConfirm) && !f.askPassword {
+		step = stepSaving
+	}
+	f.step = step
+	f.input.Reset()
+	f.input.EchoMode = textinput.EchoNormal
+	f.input.Placeholder = ""
+
+	switch step {
+	case stepNick:
+		f.input.Placeholder = "no nickname"
+	case stepDiscovery:
+		f.input.Placeholder = "Y/n"
+	case stepDownloads:
+		f.input.Placeholder = filepath.Join(f.dataDir, downloadsDirName)
+	case stepPassphrase, stepConfirm:
+		f.input.EchoMode = textinput.EchoPassword
+		if step == stepPassphrase {
+			f.input.Placeholder = "none"
+		}
+	}
+	f.input.Focus()
+}
+
+func (f *setupForm) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (f *setupForm) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case setupSavedMsg:
+		f.fingerprint, f.err = msg.fingerprint, msg.err
+		if f.err != nil {
+			return f, tea.Quit
+		}
+		f.step = stepDone
+		return f, nil
+
+	case tea.KeyMsg:
+		switch msg.Type {
+		case tea.KeyCtrlC:
+			f.cancelled = true
+			return f, tea.Quit
+		}
+		switch {
+		case f.step == stepSaving:
+			return f, nil
+		case f.step == stepDone:
+			return f, tea.Quit
+		}
+		switch msg.Type {
+		case tea.KeyEsc:
+			// Defaults for everything not answered yet
+			return f, f.save()
+		case tea.KeyEnter:
+			return f, f.answer(strings.TrimSpace(f.input.Value()))
+		}
+	}
+
+	var cmd tea.Cmd
+	f.input, cmd = f.input.Update(msg)
+	return f, cmd
+}
+
+// answer records the answer to the current question and moves on
+func (f *setupForm) answer(value string) tea.Cmd {
+	f.problem = ""
+	switch f.step {
+	case stepNick:
+		f.answers.Nick = value
+		f.enter(stepDiscovery)
+	case stepDiscovery:
+		f.answers.Discovery = !strings.HasPrefix(strings.ToLower(value), "n")
+		f.enter(stepDownloads)
+	case stepDownloads:
+		f.answers.DownloadsDir = value
+		f.enter(stepPassphrase)
+	case stepPassphrase:
+		f.answers.Passphrase = f.input.Value()
+		if f.answers.Passphrase == "" {
+			return f.save()
+		}
+		f.enter(stepConfirm)
+	case stepConfirm:
+		if f.input.Value() != f.answers.Passphrase {
+			f.answers.Passphrase = ""
+			f.enter(stepPassphrase)
+			f.problem = "The passphrases don't match; try again."
+			return nil
+		}
+		return f.save()
+	}
+
+	if f.step == stepSaving {
+		return f.save()
+	}
+	return nil
+}
+
+// save writes the answers and generates the key in the background
+func (f *setupForm) save() tea.Cmd {
+	f.step = stepSaving
+	answers := f.answers
+	return func() tea.Msg {
+		fingerprint, err := finishSetup(f.dataDir, f.configPath, answers)
+		return setupSavedMsg{fingerprint: fingerprint, err: err}
+	}
+}
+
+func (f *setupForm) View() string {
+	title := lipgloss.NewStyle().Bold(true).Render("🚀 Welcome to p2pchat")
+	hint := lipgloss.NewStyle().Faint(true)
+
+	var body string
+	switch f.step {
+	case stepNick:
+		body = "Nickname, shown to peers and matched as a mention:"
+	case stepDiscovery:
+		body = "Find peers on the local network automatically?"
+	case stepDownloads:
+		body = "Where should received files be saved?"
+	case stepPassphrase:
+		body = "Passphrase to protect your key (asked for at each start):"
+	case stepConfirm:
+		body = "Repeat the passphrase:"
+	case stepSaving:
+		return title + "\n\nSaving settings and generating your key...\n"
+	case stepDone:
+		return fmt.Sprintf("%s\n\nYour key fingerprint is\n\n  %s\n\n"+
+			"Share it so peers can check they are talking to you.\n"+
+			"Settings are in %s.\n\n%s\n",
+			title, formatFingerprint(f.fingerprint), f.configPath, hint.Render("Press any key to start chatting"))
+	}
+
+	if f.problem != "" {
+		body += "\n" + f.problem
+	}
+	return fmt.Sprintf("%s\n\n%s\n\n%s\n\n%s\n", title, body, f.input.View(),
+		hint.Render("Enter takes the default • Esc skips the rest • Ctrl+C quits"))
+}
+
+var (
+	passphraseMutex sync.Mutex
+	passphraseSet   bool
+	passphrase      string
+)
+
+// keyPassphrase returns the passphrase for an encrypted private key: from $P2PCHAT_KEY_PASSPHRASE,
+// or asked for on the terminal. It is asked for once per run.
+func keyPassphrase() (string, error) {
+	passphraseMutex.Lock()
+	defer passphraseMutex.Unlock()
+
+	if passphraseSet {
+		return passphrase, nil
+	}
+	if value, exists := os.LookupEnv(keyPassphraseEnv); exists {
+		passphrase, passphraseSet = value, true
+		return passphrase, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return "", fmt.Errorf("the private key is protected by a passphrase; set %s", keyPassphraseEnv)
+	}
+
+	value, err := readPassphrase(bufio.NewReader(os.Stdin), os.Stderr, "Key passphrase: ")
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	passphrase, passphraseSet = value, true
+	return passphrase, nil
+}
+
+// setKeyPassphrase remembers a passphrase the user already gave, so it isn't asked for again
+func setKeyPassphrase(value string) {
+	passphraseMutex.Lock()
+	defer passphraseMutex.Unlock()
+	passphrase, passphraseSet = value, true
+}
+
+// forgetKeyPassphrase drops a passphrase that turned out to be wrong
+func forgetKeyPassphrase() {
+	passphraseMutex.Lock()
+	defer passphraseMutex.Unlock()
+	passphrase, passphraseSet = "", false
+}
+
+// runFirstRunSetup asks the first-run questions, as a form when starting the TUI and as plain
+// prompts otherwise, then saves the answers and shows the key fingerprint
+func runFirstRunSetup(dataDir, configPath string, useTUI bool) error {
+	if useTUI {
+		_, err := runSetupForm(dataDir, configPath)
+		return err
+	}
+
+	answers, err := runSetupPrompts(bufio.NewReader(os.Stdin), os.Stdout, dataDir)
+	if err != nil {
+		return fmt.Errorf("setup: %w", err)
+	}
+	fingerprint, err := finishSetup(dataDir, configPath, answers)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nYour key fingerprint is\n\n  %s\n\nShare it so peers can check they are talking to you. Settings are in %s.\n\n",
+		formatFingerprint(fingerprint), configPath)
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	shareBlobPrefix       = "p2pchat:"
+	shareBlobVersion      = 1
+	shareFingerprintBytes = 32 // A SHA-256 fingerprint, raw
+	shareMaxAddresses     = maxContactAddresses
+	shareChecksumBytes    = 4
+)
+
+// Errors parsing a share blob, so a mistyped or cut-off paste says what is wrong with it
+var (
+	errShareTruncated = errors.New("share blob is incomplete; copy all of it")
+	errShareChecksum  = errors.New("share blob is corrupted (checksum mismatch); copy it again")
+)
+
+// shareBlob is what /share hands out and /add reads: enough to reach a node and know its key
+type shareBlob struct {
+	NodeID      string
+	Fingerprint string   // Hex, as keyFingerprint returns it
+	Addresses   []string // Where the node may be reached, best first
+}
+
+// encodeShareBlob packs a blob as "p2pchat:" and URL-safe base64 of: a version byte, the raw
+// fingerprint, the node ID and each address as a length byte and the text, preceded by their
+// count, and a CRC-32 of all that so a damaged paste is caught rather than dialled
+func encodeShareBlob(blob shareBlob) (string, error) {
+	fingerprint, err := hex.DecodeString(blob.Fingerprint)
+	if err != nil || len(fingerprint) != shareFingerprintBytes {
+		return "", fmt.Errorf("invalid fingerprint %q", blob.Fingerprint)
+	}
+	if len(blob.Addresses) > shareMaxAddresses {
+		return "", fmt.Errorf("at most %d addresses fit in a share blob", shareMaxAddresses)
+	}
+
+	var data bytes.Buffer
+	data.WriteByte(shareBlobVersion)
+	data.Write(fingerprint)
+	writeString := func(s string) error {
+		if s == "" || len(s) > 255 {
+			return fmt.Errorf("%q doesn't fit in a share blob", s)
+		}
+		data.WriteByte(byte(len(s)))
+		data.WriteString(s)
+		return nil
+	}
+	if err := writeString(blob.NodeID); err != nil {
+		return "", err
+	}
+	data.WriteByte(byte(len(blob.Addresses)))
+	for _, addr := range blob.Addresses {
+		if err := writeString(addr); err != nil {
+			return "", err
+		}
+	}
+	data.Write(binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(data.Bytes())))
+	return shareBlobPrefix + base64.RawURLEncoding.EncodeToString(data.Bytes()), nil
+}
+
+// parseShareBlob reads a blob made by encodeShareBlob. White space, such as a line break added
+// when it was pasted, is ignored, and so is base64 padding.
+func parseShareBlob(text string) (shareBlob, error) {
+	text = strings.Join(strings.Fields(text), "")
+	if !strings.HasPrefix(text, shareBlobPrefix) {
+		return shareBlob{}, fmt.Errorf("not a share blob (they start with %q)", shareBlobPrefix)
+	}
+	encoded := strings.TrimRight(strings.TrimPrefix(text, shareBlobPrefix), "=")
+	if len(encoded)%4 == 1 {
+		return shareBlob{}, errShareTruncated // No whole blob is this long
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return shareBlob{}, fmt.Errorf("share blob is corrupted: %w", err)
+	}
+	if len(data) == 0 {
+		return shareBlob{}, errShareTruncated
+	}
+	if data[0] != shareBlobVersion {
+		return shareBlob{}, fmt.Errorf("share blob version %d isn't supported (this node reads version %d)", data[0], shareBlobVersion)
+	}
+
+	// The fields are read before the checksum is checked, so a blob cut short can be told from
+	// one that was changed
+	reader := bytes.NewReader(data[1:])
+	fingerprint := make([]byte, shareFingerprintBytes)
+	if _, err := io.ReadFull(reader, fingerprint); err != nil {
+		return shareBlob{}, errShareTruncated
+	}
+	readString := func() (string, error) {
+		length, err := reader.ReadByte()
+		if err != nil || int(length) > reader.Len() {
+			return "", errShareTruncated
+		}
+		s := make([]byte, length)
+		reader.Read(s)
+		return string(s), nil
+	}
+	blob := shareBlob{Fingerprint: hex.EncodeToString(fingerprint)}
+	if blob.NodeID, err = readString(); err != nil {
+		return shareBlob{}, err
+	}
+	count, err := reader.ReadByte()
+	if err != nil {
+		return shareBlob{}, errShareTruncated
+	}
+	for range count {
+		addr, err := readString()
+		if err != nil {
+			return shareBlob{}, err
+		}
+		blob.Addresses = append(blob.Addresses, addr)
+	}
+	switch {
+	case reader.Len() < shareChecksumBytes:
+		return shareBlob{}, errShareTruncated
+	case reader.Len() > shareChecksumBytes:
+		return shareBlob{}, errors.New("share blob is malformed: unexpected data at the end")
+	}
+	body := data[:len(data)-shareChecksumBytes]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(body):]) {
+		return shareBlob{}, errShareChecksum
+	}
+
+	if blob.NodeID == "" || len(blob.Addresses) == 0 || len(blob.Addresses) > shareMaxAddresses {
+		return shareBlob{}, errors.New("share blob is malformed: no node ID, or no addresses or too many")
+	}
+	for _, addr := range blob.Addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return shareBlob{}, fmt.Errorf("share blob is malformed: bad address %q", addr)
+		}
+	}
+	return blob, nil
+}
+
+// shareAddresses lists where peers may reach this node: over Tor only the onion address, which
+// is the node ID, so the real one isn't given away. Otherwise each advertised address that is
+// routable, the node ID first, then the addresses of this host's interfaces on the ports of
+// listeners on every interface, public ones before LAN ones.
+func (en *EnhancedNode) shareAddresses() []string {
+	if en.tor != nil {
+		return []string{en.ID}
+	}
+
+	var addresses []string
+	for _, addr := range en.advertised {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip == nil || !(ip.IsLoopback() || ip.IsUnspecified()) {
+			addresses = append(addresses, addr)
+		}
+	}
+
+	var public, lan []string
+	for _, listener := range en.listeners {
+		listenHost, port, err := net.SplitHostPort(listener.Addr().String())
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(listenHost); ip != nil && ip.IsUnspecified() {
+			interfaceAddrs, _ := net.InterfaceAddrs()
+			for _, interfaceAddr := range interfaceAddrs {
+				ipNet, ok := interfaceAddr.(*net.IPNet)
+				if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() || (ipNet.IP.To4() == nil && ip.To4() != nil) {
+					continue
+				}
+				addr := net.JoinHostPort(ipNet.IP.String(), port)
+				if isPublicIP(ipNet.IP) {
+					public = append(public, addr)
+				} else {
+					lan = append(lan, addr)
+				}
+			}
+		}
+	}
+	for _, addr := range append(public, lan...) {
+		if !slices.Contains(addresses, addr) {
+			addresses = append(addresses, addr)
+		}
+	}
+	if len(addresses) == 0 {
+		addresses = append(addresses, en.ID) // Only reachable from this host, but that is all there is
+	}
+	return addresses[:min(len(addresses), shareMaxAddresses)]
+}
+
+// handleShareCommand processes /share [qr], printing a blob with this node's addresses and key
+// for /add on the other side, and with qr the same as a QR code
+func (en *EnhancedNode) handleShareCommand(args string) {
+	arg := strings.TrimSpace(args)
+	if arg != "" && arg != "qr" {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("Usage: /share [qr]"),
+		})
+		return
+	}
+	if en.cryptoManager == nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("❌ Sharing needs an identity key, and encryption isn't available"),
+		})
+		return
+	}
+
+	addresses := en.shareAddresses()
+	blob, err := encodeShareBlob(shareBlob{NodeID: en.ID, Fingerprint: en.cryptoManager.Fingerprint(), Addresses: addresses})
+	if err != nil {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ %v", err)),
+		})
+		return
+	}
+
+	var content strings.Builder
+	content.WriteString("🪪 Send this to whoever should connect to you; they paste it after /add:\n")
+	content.WriteString(blob)
+	content.WriteString(fmt.Sprintf("\n  Key %s\n  At %s", formatFingerprint(en.cryptoManager.Fingerprint()), strings.Join(addresses, ", ")))
+	if en.tor != nil {
+		content.WriteString("\n  🧅 Reachable over Tor only; share it with people you trust")
+	}
+	if arg == "qr" {
+		code, err := qrcode.New(blob, qrcode.Low)
+		if err != nil {
+			content.WriteString(fmt.Sprintf("\n❌ No QR code: %v", err))
+		} else {
+			// Light modules are drawn, for terminals with a dark background. A code block isn't
+			// wrapped by the TUI, which would break the code.
+			content.WriteString("\n" + codeFence + "\n" + strings.TrimRight(code.ToSmallString(false), "\n") + "\n" + codeFence)
+		}
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(content.String()),
+	})
+}
+
+// handleAddCommand processes /add <blob> [alias], saving the node in a blob from /share as a
+// contact pinned to its key and connecting to it
+func (en *EnhancedNode) handleAddCommand(args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("Usage: /add <blob from /share> [alias]"),
+		})
+		return
+	}
+
+	var reply string
+	blob, err := parseShareBlob(fields[0])
+	alias := ""
+	if err == nil {
+		alias = "peer-" + blob.Fingerprint[:8]
+		if len(fields) == 2 {
+			alias = fields[1]
+		}
+	}
+	switch {
+	case err != nil:
+		reply = fmt.Sprintf("❌ %v", err)
+	case en.cryptoManager != nil && blob.Fingerprint == en.cryptoManager.Fingerprint():
+		reply = "❌ That is your own share blob"
+	default:
+		if err := en.contacts.Add(alias, blob.NodeID, blob.Fingerprint, blob.Addresses...); err != nil {
+			reply = fmt.Sprintf("❌ %v", err)
+			break
+		}
+		en.audit(AuditEntry{
+			Event: auditContactAdded, Severity: auditInfo, Peer: blob.NodeID, Fingerprint: blob.Fingerprint,
+			Detail: fmt.Sprintf("pinned %s's key as contact %s, from a share blob", blob.NodeID, alias),
+		})
+		reply = fmt.Sprintf("📇 Saved %s as %s, pinned to key %s; connecting…", blob.NodeID, alias, formatFingerprint(blob.Fingerprint))
+		contact, _ := en.contacts.Get(alias)
+		go en.connectToShared(contact)
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
+
+// connectToShared tries the addresses of a contact added from a share blob in order, holding each
+// to the contact's key, as /connect <addr> <fingerprint> does
+func (en *EnhancedNode) connectToShared(contact Contact) {
+	var lastErr error
+	for _, addr := range contact.Addresses {
+		en.dialIntents.Store(addr, dialIntent{fingerprint: contact.Fingerprint})
+		lastErr = en.connectToPeer(addr)
+		en.dialIntents.Delete(addr)
+		if lastErr == nil {
+			return
+		}
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("❌ Couldn't reach %s at any address in the blob: %v (/connect %s to try again)", contact.Alias, lastErr, contact.Alias)),
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testShareBlob is a blob with every field used
+var testShareBlob = shareBlob{
+	NodeID:      "198.51.100.7:9000",
+	Fingerprint: strings.Repeat("ab", shareFingerprintBytes),
+	Addresses:   []string{"198.51.100.7:9000", "[2001:db8::7]:9000", "192.168.1.7:9000"},
+}
+
+// TestShareBlobRoundTrip reads back what it encodes, however the blob was pasted
+func TestShareBlobRoundTrip(t *testing.T) {
+	encoded, err := encodeShareBlob(testShareBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pasted := range []string{
+		encoded,
+		"  " + encoded + "\n",
+		encoded[:20] + "\n" + encoded[20:40] + " " + encoded[40:], // Broken across lines
+		encoded + strings.Repeat("=", (4-len(encoded[len(shareBlobPrefix):])%4)%4),
+	} {
+		blob, err := parseShareBlob(pasted)
+		if err != nil {
+			t.Errorf("parsing %q: %v", pasted, err)
+			continue
+		}
+		if blob.NodeID != testShareBlob.NodeID || blob.Fingerprint != testShareBlob.Fingerprint || !slices.Equal(blob.Addresses, testShareBlob.Addresses) {
+			t.Errorf("read back %+v, want %+v", blob, testShareBlob)
+		}
+	}
+}
+
+// TestShareBlobTruncated says a blob cut short anywhere is incomplete
+func TestShareBlobTruncated(t *testing.T) {
+	encoded, err := encodeShareBlob(testShareBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for length := len(shareBlobPrefix); length < len(encoded); length++ {
+		if _, err := parseShareBlob(encoded[:length]); !errors.Is(err, errShareTruncated) {
+			t.Errorf("cut to %d of %d characters: %v", length, len(encoded), err)
+		}
+	}
+}
+
+// TestShareBlobCorrupted refuses a blob with any byte changed, and says why
+func TestShareBlobCorrupted(t *testing.T) {
+	encoded, err := encodeShareBlob(testShareBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(encoded, shareBlobPrefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		corrupted := slices.Clone(data)
+		corrupted[i] ^= 0x20
+		if blob, err := parseShareBlob(shareBlobPrefix + base64.RawURLEncoding.EncodeToString(corrupted)); err == nil {
+			t.Errorf("byte %d changed, yet read as %+v", i, blob)
+		}
+	}
+	// A changed address has the checksum to catch it
+	at := strings.Index(string(data), "192.168")
+	corrupted := slices.Clone(data)
+	corrupted[at] = '8'
+	if _, err := parseShareBlob(shareBlobPrefix + base64.RawURLEncoding.EncodeToString(corrupted)); !errors.Is(err, errShareChecksum) {
+		t.Errorf("changed address: %v, want a checksum mismatch", err)
+	}
+
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{"p2pchat", "not a share blob"},
+		{"http://example.com", "not a share blob"},
+		{shareBlobPrefix + "not*base64!", "corrupted"},
+		{shareBlobPrefix, "incomplete"},
+		{shareBlobPrefix + base64.RawURLEncoding.EncodeToString(append([]byte{2}, data[1:]...)), "version 2 isn't supported"},
+		{encoded + "AAAA", "unexpected data at the end"},
+	} {
+		if _, err := parseShareBlob(tc.text); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("parsing %q: %v, want an error saying %q", tc.text, err, tc.want)
+		}
+	}
+}
+
+// TestEncodeShareBlobLimits refuses what the format can't hold
+func TestEncodeShareBlobLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		blob shareBlob
+	}{
+		{"short fingerprint", shareBlob{NodeID: "a:1", Fingerprint: "abcd", Addresses: []string{"a:1"}}},
+		{"fingerprint not hex", shareBlob{NodeID: "a:1", Fingerprint: strings.Repeat("zz", shareFingerprintBytes), Addresses: []string{"a:1"}}},
+		{"too many addresses", shareBlob{NodeID: "a:1", Fingerprint: testShareBlob.Fingerprint, Addresses: slices.Repeat([]string{"a:1"}, shareMaxAddresses+1)}},
+		{"long address", shareBlob{NodeID: "a:1", Fingerprint: testShareBlob.Fingerprint, Addresses: []string{strings.Repeat("a", 256) + ":1"}}},
+		{"no node ID", shareBlob{Fingerprint: testShareBlob.Fingerprint, Addresses: []string{"a:1"}}},
+	} {
+		if encoded, err := encodeShareBlob(tc.blob); err == nil {
+			t.Errorf("%s: encoded as %s", tc.name, encoded)
+		}
+	}
+}
+
+// sharedBlob runs /share on node and returns the blob it printed
+func sharedBlob(t *testing.T, node *EnhancedNode) string {
+	t.Helper()
+	node.handleEnhancedCLICommand("/share", node.ID)
+	var blob string
+	waitFor(t, "the share blob", func() bool {
+		for _, text := range loggedTexts(node, "System") {
+			for _, line := range strings.Split(text, "\n") {
+				if strings.HasPrefix(line, shareBlobPrefix) {
+					blob = line
+				}
+			}
+		}
+		return blob != ""
+	})
+	return blob
+}
+
+// TestShareAndAdd passes a node's blob to another with /add, which saves it as a contact pinned
+// to the key in the blob and connects
+func TestShareAndAdd(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	blob := sharedBlob(t, a)
+
+	b.handleEnhancedCLICommand("/add "+blob+" alice", b.ID)
+	waitForNotice(t, b, "📇 Saved "+a.ID+" as alice")
+	waitFor(t, "b to connect to a", func() bool { return connectedTo(b, a.ID) })
+	contact, found := b.contacts.Get("alice")
+	if !found || contact.Fingerprint != a.cryptoManager.Fingerprint() || contact.NodeID != a.ID {
+		t.Errorf("saved %+v", contact)
+	}
+
+	a.handleEnhancedCLICommand("/add "+blob, a.ID)
+	waitForNotice(t, a, "❌ That is your own share blob")
+	b.handleEnhancedCLICommand("/add "+blob[:len(blob)-6], b.ID)
+	waitForNotice(t, b, "❌ share blob is incomplete")
+}
+
+// TestAddRefusesOtherKey adds a blob pinning a key the node at its address doesn't hold: the
+// connection is refused rather than trusted
+func TestAddRefusesOtherKey(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	a, b, c := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	forged, err := encodeShareBlob(shareBlob{NodeID: a.ID, Fingerprint: c.cryptoManager.Fingerprint(), Addresses: []string{a.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.handleEnhancedCLICommand("/add "+forged+" carol", b.ID)
+	waitForNotice(t, b, "❌ Couldn't reach carol at any address in the blob")
+	if connectedTo(b, a.ID) {
+		t.Error("b connected to a node presenting another key than the blob's")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// handleStatsCommand processes /stats
+func (en *EnhancedNode) handleStatsCommand() {
+	var content strings.Builder
+	content.WriteString("📊 Stats:")
+	content.WriteString(fmt.Sprintf("\n  Messages logged:       %d", en.messageLog.LastID()))
+	content.WriteString(fmt.Sprintf("\n  Duplicates suppressed: %d", en.seen.Duplicates()))
+
+	traffic := en.Traffic()
+	content.WriteString(fmt.Sprintf("\n  Traffic:               ↓%s ↑%s since start (↓%s ↑%s)",
+		formatBytes(int64(traffic.In)), formatBytes(int64(traffic.Out)), formatRate(traffic.InRate), formatRate(traffic.OutRate)))
+	for _, day := range en.traffic.History(trafficShownDays) {
+		content.WriteString(fmt.Sprintf("\n    %s:          ↓%s ↑%s", day.Day, formatBytes(int64(day.In)), formatBytes(int64(day.Out))))
+	}
+
+	content.WriteString(fmt.Sprintf("\n  Spoofed frames:        %d", en.spoofedFrames.Load()))
+	content.WriteString(fmt.Sprintf("\n  Handler crashes:       %d", en.handlerPanics.Load()))
+	if en.Locked() {
+		content.WriteString(fmt.Sprintf("\n  Locked:                yes, %d connection(s) refused (/unlock)", en.lockedRefused.Load()))
+	} else {
+		content.WriteString("\n  Locked:                no")
+	}
+	if en.private {
+		content.WriteString(fmt.Sprintf("\n  Strangers refused:     %d", en.strangersRefused.Load()))
+	}
+
+	if en.webhook != nil {
+		stats := en.webhook.Stats()
+		content.WriteString(fmt.Sprintf("\n  Webhook:               %d delivered, %d failed, %d dropped",
+			stats.Delivered, stats.Failed, stats.Dropped))
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(content.String()),
+	})
+}
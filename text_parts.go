@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	textPartBytes       = 12 * 1024             // Text in one part, as escaped in JSON, leaving room under maxTextBytes
+	textPartDelay       = 10 * time.Millisecond // Pause between parts so peers' send queues drain
+	textAssemblyTimeout = 2 * time.Minute       // Parts of a text not complete by then are discarded
+	textPartMarker      = "…"                   // Ends every part but the last
+)
+
+// splitText cuts text into parts of at most textPartBytes once escaped in JSON, so that no part
+// can grow past maxTextBytes. Every part but the last ends with textPartMarker, so an older
+// version, which shows only the first part and drops the rest as duplicates, shows it cut short
+// rather than as if it were whole. Text that fits is returned as it is.
+func splitText(text string) []string {
+	var parts []string
+	for jsonTextLen(text) > textPartBytes {
+		head, rest := cutText(text, textPartBytes-len(textPartMarker))
+		parts = append(parts, head+textPartMarker)
+		text = rest
+	}
+	return append(parts, text)
+}
+
+// cutText splits text where it would take more than budget bytes escaped in JSON, at a rune
+// boundary. Either part may be empty.
+func cutText(text string, budget int) (string, string) {
+	size := 0
+	for i, r := range text {
+		size += jsonRuneLen(r, text[i:])
+		if size > budget {
+			return text[:i], text[i:]
+		}
+	}
+	return text, ""
+}
+
+// truncateJSONText cuts text that takes more than budget bytes escaped in JSON, ending it with
+// textPartMarker
+func truncateJSONText(text string, budget int) string {
+	if jsonTextLen(text) <= budget {
+		return text
+	}
+	head, _ := cutText(text, budget-len(textPartMarker))
+	return head + textPartMarker
+}
+
+// jsonTextLen is how many bytes text takes in a JSON string, quotes aside
+func jsonTextLen(text string) int {
+	size := 0
+	for i, r := range text {
+		size += jsonRuneLen(r, text[i:])
+	}
+	return size
+}
+
+// jsonRuneLen is how many bytes encoding/json writes for the rune at the start of text
+func jsonRuneLen(r rune, text string) int {
+	switch {
+	case r == '"' || r == '\\' || r == '\n' || r == '\r' || r == '\t':
+		return 2
+	case r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029':
+		return 6
+	case r == utf8.RuneError:
+		if _, size := utf8.DecodeRuneInString(text); size == 1 {
+			return 6 // An invalid byte, written as \ufffd
+		}
+	}
+	return utf8.RuneLen(r)
+}
+
+// textParts returns the envelopes to send a text message in: the envelope itself if its text
+// fits in one, or else one per part under the same ID, sequence number and Lamport time
+func (envelope TextEnvelope) textParts() []TextEnvelope {
+	texts := splitText(envelope.Text)
+	if len(texts) == 1 {
+		return []TextEnvelope{envelope}
+	}
+	parts := make([]TextEnvelope, len(texts))
+	for i, text := range texts {
+		parts[i] = envelope
+		parts[i].Text = text
+		parts[i].Part = i + 1
+		parts[i].Parts = len(texts)
+	}
+	return parts
+}
+
+// sendTextParts sends a text envelope with send, in parts if it is long, pausing between them.
+// Text is checked against checkTextSize before it gets here.
+func (en *EnhancedNode) sendTextParts(envelope TextEnvelope, send func(data []byte) error) error {
+	var missed error
+	for i, part := range envelope.textParts() {
+		if i > 0 {
+			select {
+			case <-time.After(textPartDelay):
+			case <-en.Shutdown:
+				return fmt.Errorf("shutting down")
+			}
+		}
+		data, err := json.Marshal(part)
+		if err != nil {
+			return fmt.Errorf("failed to serialize message: %w", err)
+		}
+		// Peers a broadcast part reached still get the rest
+		if err := send(data); err != nil {
+			if !sentToAny(err) {
+				return err
+			}
+			missed = err
+		}
+	}
+	return missed
+}
+
+// textAssemblyKey identifies a long text being reassembled: its message ID, from one sender over
+// one connection
+type textAssemblyKey struct {
+	connID   string
+	senderID string
+	id       string
+}
+
+// textAssembly is a long text whose parts are arriving
+type textAssembly struct {
+	parts    []string // By part, from 0; valid where received is set
+	received []bool
+	count    int          // Parts received
+	size     int          // Bytes of text received
+	envelope TextEnvelope // The first part received, for everything but the text
+	started  time.Time
+}
+
+// TextAssembler reassembles long texts sent in parts. Texts are held per connection, which are
+// dropped when it closes, and discarded if they aren't complete within textAssemblyTimeout.
+type TextAssembler struct {
+	mutex      sync.Mutex
+	assemblies map[textAssemblyKey]*textAssembly
+	clock      Clock // The node's, for the timeout
+}
+
+// NewTextAssembler creates an empty assembler that times texts out by clock
+func NewTextAssembler(clock Clock) *TextAssembler {
+	return &TextAssembler{assemblies: make(map[textAssemblyKey]*textAssembly), clock: clock}
+}
+
+// Add takes a part of a long text, returning the whole text once its last part is in. Parts that
+// don't agree with the others, or that take the text, or the texts pending from the connection,
+// over the limits are refused and the text is discarded.
+func (ta *TextAssembler) Add(connID, senderID string, part TextEnvelope) (TextEnvelope, bool, error) {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+
+	now := ta.clock.Now()
+	pending := 0
+	for key, assembly := range ta.assemblies {
+		if now.Sub(assembly.started) > textAssemblyTimeout {
+			delete(ta.assemblies, key)
+		} else if key.connID == connID {
+			pending++
+		}
+	}
+
+	key := textAssemblyKey{connID: connID, senderID: senderID, id: part.ID}
+	assembly, exists := ta.assemblies[key]
+	if !exists {
+		if part.ID == "" || part.Parts < 2 || part.Parts > maxTextParts || part.Part < 1 || part.Part > part.Parts {
+			return TextEnvelope{}, false, fmt.Errorf("%w: part %d of %d", errMessageTooLarge, part.Part, part.Parts)
+		}
+		if pending >= maxPendingTexts {
+			return TextEnvelope{}, false, fmt.Errorf("%w: more than %d long texts at once", errMessageTooLarge, maxPendingTexts)
+		}
+		assembly = &textAssembly{
+			parts:    make([]string, part.Parts),
+			received: make([]bool, part.Parts),
+			envelope: part,
+			started:  now,
+		}
+		ta.assemblies[key] = assembly
+	}
+	if part.Parts != len(assembly.parts) || part.Part < 1 || part.Part > part.Parts {
+		delete(ta.assemblies, key)
+		return TextEnvelope{}, false, fmt.Errorf("%w: part %d of %d, of a text in %d parts", errMessageTooLarge,
+			part.Part, part.Parts, len(assembly.parts))
+	}
+	index := part.Part - 1
+	if assembly.received[index] {
+		return TextEnvelope{}, false, nil // Sent twice; the first one counts
+	}
+	// Counted without the markers, as the sender counted it before splitting it
+	text := part.Text
+	if part.Part < part.Parts {
+		text = strings.TrimSuffix(text, textPartMarker)
+	}
+	if assembly.size+len(text) > maxLongTextBytes {
+		delete(ta.assemblies, key)
+		return TextEnvelope{}, false, fmt.Errorf("%w: a text of more than %s in parts", errMessageTooLarge, formatBytes(maxLongTextBytes))
+	}
+
+	assembly.parts[index] = text
+	assembly.received[index] = true
+	assembly.count++
+	assembly.size += len(text)
+	if assembly.count < len(assembly.parts) {
+		return TextEnvelope{}, false, nil
+	}
+
+	delete(ta.assemblies, key)
+	whole := assembly.envelope
+	whole.Text = strings.Join(assembly.parts, "")
+	whole.Part, whole.Parts = 0, 0
+	return whole, true, nil
+}
+
+// Drop discards the texts being reassembled from a connection that closed
+func (ta *TextAssembler) Drop(connID string) {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	for key := range ta.assemblies {
+		if key.connID == connID {
+			delete(ta.assemblies, key)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSplitText keeps every part of a long text within the limits, however much of it JSON
+// escapes, and the assembler puts them back together in any order
+func TestSplitText(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+	}{
+		{"short", "hello"},
+		{"ASCII", strings.Repeat("lorem ipsum ", 20000)},
+		{"escaped", strings.Repeat("<&>\"\n", 50000)},
+		{"multibyte", strings.Repeat("日本語🙂", 30000)},
+		{"longest, escaped to six bytes", strings.Repeat("<", maxLongTextBytes)},
+	} {
+		parts := TextEnvelope{ID: "m1", Text: tc.text, Lamport: 7}.textParts()
+		if len(parts) > maxTextParts {
+			t.Errorf("%s: %d parts", tc.name, len(parts))
+		}
+		for _, part := range parts {
+			data, _ := json.Marshal(part)
+			if err := checkTextEnvelope(parseTextEnvelope(data)); err != nil {
+				t.Errorf("%s: part %d of %d: %v", tc.name, part.Part, part.Parts, err)
+			}
+		}
+		if len(parts) == 1 {
+			if parts[0].Text != tc.text || parts[0].Parts != 0 {
+				t.Errorf("%s: sent in one part as %+v", tc.name, parts[0])
+			}
+			continue
+		}
+
+		assembler := NewTextAssembler(newFakeClock())
+		rand.Shuffle(len(parts), func(i, j int) { parts[i], parts[j] = parts[j], parts[i] })
+		for i, part := range parts {
+			whole, complete, err := assembler.Add("conn", "sender", part)
+			if err != nil {
+				t.Fatalf("%s: part %d: %v", tc.name, part.Part, err)
+			}
+			if complete != (i == len(parts)-1) {
+				t.Fatalf("%s: complete after %d of %d parts", tc.name, i+1, len(parts))
+			}
+			if complete && (whole.Text != tc.text || whole.ID != "m1" || whole.Lamport != 7 || whole.Parts != 0) {
+				t.Errorf("%s: reassembled %d bytes, want %d", tc.name, len(whole.Text), len(tc.text))
+			}
+		}
+	}
+}
+
+// TestTextAssemblerLimits refuses parts that don't fit the text they claim to be part of, and
+// more texts, or more text, than the limits allow
+func TestTextAssemblerLimits(t *testing.T) {
+	clock := newFakeClock()
+	ta := NewTextAssembler(clock)
+	part := func(id string, part, parts int, text string) TextEnvelope {
+		return TextEnvelope{ID: id, Text: text, Part: part, Parts: parts}
+	}
+	for _, tc := range []struct {
+		name string
+		part TextEnvelope
+	}{
+		{"no ID", part("", 1, 2, "a")},
+		{"one part", part("m", 1, 1, "a")},
+		{"part zero", part("m", 0, 2, "a")},
+		{"part past the last", part("m", 3, 2, "a")},
+		{"too many parts", part("m", 1, maxTextParts+1, "a")},
+	} {
+		if _, _, err := ta.Add("conn", "sender", tc.part); !errors.Is(err, errMessageTooLarge) {
+			t.Errorf("%s: %v, want errMessageTooLarge", tc.name, err)
+		}
+	}
+
+	// A part disagreeing with the text it continues discards the text
+	if _, _, err := ta.Add("conn", "sender", part("m", 1, 3, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ta.Add("conn", "sender", part("m", 4, 3, "a")); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("part 4 of a text in 3: %v", err)
+	}
+	if _, _, err := ta.Add("conn", "sender", part("m", 2, 2, "a")); err != nil {
+		t.Errorf("a new text under the discarded one's ID: %v", err)
+	}
+	if _, complete, err := ta.Add("conn", "sender", part("m", 2, 2, "b")); complete || err != nil {
+		t.Errorf("a part sent twice: complete %v, %v", complete, err)
+	}
+	ta.Drop("conn")
+
+	// More than the longest text, in parts each within the limit
+	big := strings.Repeat("a", maxLongTextBytes/2+1)
+	if _, _, err := ta.Add("conn", "sender", part("big", 1, 3, big)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ta.Add("conn", "sender", part("big", 2, 3, big)); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("%d bytes in parts: %v", 2*len(big), err)
+	}
+
+	// Texts pending from one connection, which other connections don't count toward
+	for i := range maxPendingTexts {
+		if _, _, err := ta.Add("conn", "sender", part(string(rune('a'+i)), 1, 2, "x")); err != nil {
+			t.Fatalf("text %d: %v", i+1, err)
+		}
+	}
+	if _, _, err := ta.Add("conn", "sender", part("z", 1, 2, "x")); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("text %d pending at once: %v", maxPendingTexts+1, err)
+	}
+	if _, _, err := ta.Add("other", "sender", part("z", 1, 2, "x")); err != nil {
+		t.Errorf("a text from another connection: %v", err)
+	}
+	if whole, complete, err := ta.Add("conn", "sender", part("a", 2, 2, "y")); !complete || err != nil || whole.Text != "xy" {
+		t.Errorf("finishing a pending text: %q, %v, %v", whole.Text, complete, err)
+	}
+
+	// Texts not finished in time are discarded, freeing their places
+	clock.Advance(textAssemblyTimeout + time.Second)
+	for i := range maxPendingTexts {
+		if _, _, err := ta.Add("conn", "sender", part(string(rune('A'+i)), 1, 2, "x")); err != nil {
+			t.Fatalf("text %d after the others timed out: %v", i+1, err)
+		}
+	}
+	if _, complete, _ := ta.Add("conn", "sender", part("b", 2, 2, "y")); complete {
+		t.Error("a text completed after timing out")
+	}
+}
+
+// TestLongTextBetweenNodes sends a text too long for one message, which arrives whole, and one
+// too long even in parts, which is refused before anything is sent
+func TestLongTextBetweenNodes(t *testing.T) {
+	_, a, b := connectedPair(t)
+	text := strings.Repeat("<long> \"text\" ", 5000)
+
+	if _, err := a.SendEncryptedText(text); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, a.ID, text)
+	if _, err := a.SendEncryptedTextTo(b.ID, strings.Repeat("a", maxLongTextBytes+1)); !errors.Is(err, errMessageTooLarge) {
+		t.Errorf("sending %d bytes of text: %v", maxLongTextBytes+1, err)
+	}
+	if _, err := a.SendEncryptedText("marker"); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, b, a.ID, "marker")
+	if texts := loggedTexts(b, a.ID); len(texts) != 2 {
+		t.Errorf("b shows %d texts from a, want 2", len(texts))
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+const defaultTheme = "dark"
+
+// Theme is a TUI palette, one color per kind of element. Built-in colors carry 256- and
+// 16-color fallbacks so they degrade sensibly on terminals without true color.
+type Theme struct {
+	Name       string
+	NoColor    bool                   // Use reverse video and heavy borders instead of colors
+	Primary    lipgloss.TerminalColor // Title and your own messages
+	Accent     lipgloss.TerminalColor // Focused panels, system messages, online peers
+	Warning    lipgloss.TerminalColor // Mentions, search matches, away peers
+	Error      lipgloss.TerminalColor // Busy peers
+	Muted      lipgloss.TerminalColor // Borders, timestamps and the status bar text
+	Background lipgloss.TerminalColor // Status bar background
+	Peer       lipgloss.TerminalColor // Messages from peers
+}
+
+// Built-in themes, selected with -theme, "theme" in the config or /theme
+var themes = map[string]Theme{
+	"dark": {
+		Name:       "dark",
+		Primary:    lipgloss.CompleteColor{TrueColor: "#7C3AED", ANSI256: "99", ANSI: "5"},
+		Accent:     lipgloss.CompleteColor{TrueColor: "#10B981", ANSI256: "36", ANSI: "2"},
+		Warning:    lipgloss.CompleteColor{TrueColor: "#F59E0B", ANSI256: "214", ANSI: "3"},
+		Error:      lipgloss.CompleteColor{TrueColor: "#EF4444", ANSI256: "203", ANSI: "1"},
+		Muted:      lipgloss.CompleteColor{TrueColor: "#6B7280", ANSI256: "243", ANSI: "8"},
+		Background: lipgloss.CompleteColor{TrueColor: "#1F2937", ANSI256: "235", ANSI: "0"},
+		Peer:       lipgloss.CompleteColor{TrueColor: "#3B82F6", ANSI256: "69", ANSI: "4"},
+	},
+	"light": {
+		Name:       "light",
+		Primary:    lipgloss.CompleteColor{TrueColor: "#6D28D9", ANSI256: "56", ANSI: "5"},
+		Accent:     lipgloss.CompleteColor{TrueColor: "#047857", ANSI256: "29", ANSI: "2"},
+		Warning:    lipgloss.CompleteColor{TrueColor: "#B45309", ANSI256: "130", ANSI: "3"},
+		Error:      lipgloss.CompleteColor{TrueColor: "#B91C1C", ANSI256: "124", ANSI: "1"},
+		Muted:      lipgloss.CompleteColor{TrueColor: "#4B5563", ANSI256: "240", ANSI: "8"},
+		Background: lipgloss.CompleteColor{TrueColor: "#E5E7EB", ANSI256: "254", ANSI: "7"},
+		Peer:       lipgloss.CompleteColor{TrueColor: "#1D4ED8", ANSI256: "26", ANSI: "4"},
+	},
+	"mono": {
+		Name:       "mono",
+		NoColor:    true,
+		Primary:    lipgloss.NoColor{},
+		Accent:     lipgloss.NoColor{},
+		Warning:    lipgloss.NoColor{},
+		Error:      lipgloss.NoColor{},
+		Muted:      lipgloss.NoColor{},
+		Background: lipgloss.NoColor{},
+		Peer:       lipgloss.NoColor{},
+	},
+}
+
+// colorPattern accepts "#RGB", "#RRGGBB" or an ANSI color number
+var colorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6}|[0-9]{1,3})$`)
+
+// themeNames lists the built-in themes
+func themeNames() []string {
+	names := make([]string, 0, len(themes))
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pickTheme chooses the theme name: the -theme flag, then NO_COLOR, then the config file
+func pickTheme(flagTheme, configTheme string) string {
+	switch {
+	case flagTheme != "":
+		return flagTheme
+	case os.Getenv("NO_COLOR") != "":
+		return "mono"
+	case configTheme != "":
+		return configTheme
+	default:
+		return defaultTheme
+	}
+}
+
+// loadTheme returns a built-in theme with per-element color overrides applied. Override keys are
+// the element names: primary, accent, warning, error, muted, background and peer.
+func loadTheme(name string, overrides map[string]string) (Theme, error) {
+	theme, exists := themes[name]
+	if !exists {
+		return Theme{}, fmt.Errorf("unknown theme %q (choose from %s)", name, strings.Join(themeNames(), ", "))
+	}
+
+	for element, value := range overrides {
+		if !colorPattern.MatchString(value) {
+			return Theme{}, fmt.Errorf("invalid color %q for %s: use #RRGGBB or an ANSI color number", value, element)
+		}
+		color := lipgloss.Color(value)
+		switch element {
+		case "primary":
+			theme.Primary = color
+		case "accent":
+			theme.Accent = color
+		case "warning":
+			theme.Warning = color
+		case "error":
+			theme.Error = color
+		case "muted":
+			theme.Muted = color
+		case "background":
+			theme.Background = color
+		case "peer":
+			theme.Peer = color
+		default:
+			return Theme{}, fmt.Errorf("unknown theme element %q", element)
+		}
+	}
+	return theme, nil
+}
+
+// applyTheme rebuilds the TUI styles from a theme
+func applyTheme(theme Theme) {
+	primaryColor = theme.Primary
+	accentColor = theme.Accent
+	warningColor = theme.Warning
+	errorColor = theme.Error
+	mutedColor = theme.Muted
+	backgroundColor = theme.Background
+
+	panel := lipgloss.NewStyle().
+		BorderStyle(lipgloss.RoundedBorder()).
+		BorderForeground(mutedColor).
+		Padding(0, 1)
+
+	// Without colors the focused panel is told apart by a heavier border
+	focusBorder = lipgloss.RoundedBorder()
+	if theme.NoColor {
+		focusBorder = lipgloss.ThickBorder()
+	}
+
+	headerStyle = panel.Bold(true).Foreground(primaryColor).BorderForeground(primaryColor)
+	peerPanelStyle = panel
+	messagePanelStyle = panel
+	inputStyle = focusStyle(panel)
+
+	statusBarStyle = lipgloss.NewStyle().
+		Foreground(mutedColor).
+		Background(backgroundColor).
+		Padding(0, 1).
+		Reverse(theme.NoColor)
+
+	systemMessageStyle = lipgloss.NewStyle().Foreground(accentColor).Italic(true)
+	userMessageStyle = lipgloss.NewStyle().Foreground(primaryColor).Bold(true)
+	peerMessageStyle = lipgloss.NewStyle().Foreground(theme.Peer)
+	timestampStyle = lipgloss.NewStyle().Foreground(mutedColor).Faint(true)
+	mentionMessageStyle = lipgloss.NewStyle().Foreground(warningColor).Bold(true)
+
+	linkStyle = lipgloss.NewStyle().Foreground(accentColor).Underline(true)
+	activeTabStyle = lipgloss.NewStyle().Foreground(accentColor).Bold(true).Underline(true)
+	if theme.NoColor {
+		activeTabStyle = lipgloss.NewStyle().Reverse(true)
+	}
+
+	codeStyle = lipgloss.NewStyle().Background(backgroundColor)
+	if theme.NoColor {
+		codeStyle = lipgloss.NewStyle().Reverse(true)
+	}
+
+	searchMatchStyle = lipgloss.NewStyle().Foreground(warningColor).Underline(true)
+	currentMatchStyle = lipgloss.NewStyle().Foreground(backgroundColor).Background(warningColor).Bold(true)
+	if theme.NoColor {
+		currentMatchStyle = lipgloss.NewStyle().Reverse(true).Bold(true)
+	}
+
+	peerConnectedStyle = lipgloss.NewStyle().Foreground(accentColor)
+	peerDisconnectedStyle = lipgloss.NewStyle().Foreground(errorColor)
+}
+
+// canStyle reports whether the terminal shows any styling at all, which it doesn't under NO_COLOR
+// or when it isn't a terminal. Markdown is then left as typed, since without styling the markers
+// are all that shows the formatting.
+func canStyle() bool {
+	return lipgloss.ColorProfile() != termenv.Ascii
+}
+
+// focusStyle highlights the border of the focused panel
+func focusStyle(style lipgloss.Style) lipgloss.Style {
+	return style.BorderForeground(accentColor).BorderStyle(focusBorder)
+}
+
+// setTheme switches the TUI to a theme and redraws the messages in it
+func (ui *UI) setTheme(name string, overrides map[string]string) error {
+	theme, err := loadTheme(name, overrides)
+	if err != nil {
+		return err
+	}
+	applyTheme(theme)
+	ui.theme = name
+	ui.themeColors = overrides
+	ui.updateViewport()
+	return nil
+}
+
+// themeCommand handles /theme: with a name it switches theme, without one it shows the choices
+func (ui *UI) themeCommand(name string) {
+	content := fmt.Sprintf("🎨 Theme: %s (available: %s)", ui.theme, strings.Join(themeNames(), ", "))
+	if name != "" {
+		content = fmt.Sprintf("🎨 Theme set to %s", name)
+		if err := ui.setTheme(name, ui.themeColors); err != nil {
+			content = fmt.Sprintf("❌ %v", err)
+		}
+	}
+	ui.messages = append(ui.messages, ChatMessage{
+		Sender:    "System",
+		Content:   content,
+		Timestamp: time.Now(),
+		IsSystem:  true,
+	})
+	ui.updateViewport()
+	ui.viewport.GotoBottom()
+}
+
+func init() {
+	applyTheme(themes[defaultTheme])
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// useTheme applies a theme and color profile until the test ends, then goes back to the defaults
+func useTheme(t *testing.T, theme Theme, profile termenv.Profile) {
+	t.Helper()
+	previous := lipgloss.ColorProfile()
+	lipgloss.SetColorProfile(profile)
+	applyTheme(theme)
+	t.Cleanup(func() {
+		lipgloss.SetColorProfile(previous)
+		applyTheme(themes[defaultTheme])
+	})
+}
+
+// checkGolden compares got with testdata/<name>.golden, or rewrites the file with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("rendering differs from %s (run with -update if the change is intended)\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// themeMessages is the message list every theme is checked on: a system notice, a peer's message
+// with markdown and a link, and our own
+func themeMessages(ui *UI, backend *fakeBackend) {
+	receive(ui, Message{SenderID: "System", Content: []byte("Connected to 127.0.0.1:2")})
+	receive(ui, Message{SenderID: "127.0.0.1:2", Content: []byte("hello with **bold**, `code` and https://example.com")})
+	receive(ui, Message{SenderID: backend.id, Content: []byte("my own reply")})
+}
+
+// TestThemeGolden renders the same messages in each built-in theme on true-color, 256-color,
+// 16-color and colorless terminals, against golden files
+func TestThemeGolden(t *testing.T) {
+	profiles := map[string]termenv.Profile{
+		"truecolor": termenv.TrueColor,
+		"ansi256":   termenv.ANSI256,
+		"ansi":      termenv.ANSI,
+		"ascii":     termenv.Ascii,
+	}
+	for _, name := range themeNames() {
+		for profileName, profile := range profiles {
+			t.Run(name+"/"+profileName, func(t *testing.T) {
+				useTheme(t, themes[name], profile)
+				ui, backend := newTestUI(t, 80, 24)
+				themeMessages(ui, backend)
+				checkGolden(t, filepath.Join("themes", name+"_"+profileName), ui.viewport.View())
+			})
+		}
+	}
+}
+
+// TestThemeCommand switches theme with /theme, which redraws the messages already shown
+func TestThemeCommand(t *testing.T) {
+	useTheme(t, themes[defaultTheme], termenv.TrueColor)
+	ui, backend := newTestUI(t, 80, 24)
+	themeMessages(ui, backend)
+	dark := ui.viewport.View()
+
+	ui.textarea.SetValue("/theme light")
+	ui.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if ui.theme != "light" {
+		t.Fatalf("theme is %q after /theme light", ui.theme)
+	}
+	light := ui.viewport.View()
+	if !strings.Contains(light, "Theme set to light") {
+		t.Errorf("no confirmation in %q", light)
+	}
+	// Peers' messages are in each theme's peer color, as 24-bit SGR parameters
+	darkPeer, lightPeer := "38;2;59;130;246", "38;2;29;78;216"
+	if !strings.Contains(dark, darkPeer) || strings.Contains(light, darkPeer) || !strings.Contains(light, lightPeer) {
+		t.Error("messages shown before /theme weren't redrawn in the new colors")
+	}
+
+	ui.textarea.SetValue("/theme neon")
+	ui.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if ui.theme != "light" || !strings.Contains(ui.viewport.View(), `unknown theme "neon"`) {
+		t.Errorf("after /theme neon the theme is %q, shown: %q", ui.theme, ui.viewport.View())
+	}
+}
+
+// TestPickTheme chooses the -theme flag over NO_COLOR over the config file
+func TestPickTheme(t *testing.T) {
+	for _, tc := range []struct {
+		flag, noColor, config string
+		want                  string
+	}{
+		{"", "", "", defaultTheme},
+		{"", "", "light", "light"},
+		{"", "1", "light", "mono"},
+		{"light", "1", "dark", "light"},
+		{"dark", "", "light", "dark"},
+	} {
+		t.Setenv("NO_COLOR", tc.noColor)
+		if got := pickTheme(tc.flag, tc.config); got != tc.want {
+			t.Errorf("pickTheme(%q, %q) with NO_COLOR=%q = %q, want %q", tc.flag, tc.config, tc.noColor, got, tc.want)
+		}
+	}
+}
+
+// TestLoadTheme applies per-element overrides to a built-in theme, refusing unknown names,
+// elements and colors
+func TestLoadTheme(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		theme     string
+		overrides map[string]string
+		wantErr   string
+		check     func(Theme) bool
+	}{
+		{"built-in", "light", nil, "", func(theme Theme) bool { return theme.Peer == themes["light"].Peer }},
+		{"hex override", "dark", map[string]string{"peer": "#00AAFF"}, "", func(theme Theme) bool { return theme.Peer == lipgloss.Color("#00AAFF") }},
+		{"short hex", "dark", map[string]string{"accent": "#0af"}, "", func(theme Theme) bool { return theme.Accent == lipgloss.Color("#0af") }},
+		{"ansi number", "mono", map[string]string{"primary": "201"}, "", func(theme Theme) bool {
+			return theme.Primary == lipgloss.Color("201") && theme.NoColor
+		}},
+		{"unknown theme", "neon", nil, `unknown theme "neon" (choose from dark, light, mono)`, nil},
+		{"unknown element", "dark", map[string]string{"sparkle": "#fff"}, `unknown theme element "sparkle"`, nil},
+		{"color name", "dark", map[string]string{"peer": "blue"}, `invalid color "blue" for peer`, nil},
+		{"long hex", "dark", map[string]string{"peer": "#00AAFF00"}, "invalid color", nil},
+		{"big number", "dark", map[string]string{"peer": "1000"}, "invalid color", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			theme, err := loadTheme(tc.theme, tc.overrides)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("error %v, want one saying %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.check(theme) {
+				t.Errorf("loaded %+v", theme)
+			}
+		})
+	}
+}
+
+// TestLoadConfig reads the config file, with a missing file meaning the defaults
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		content string // Empty: no file
+		wantErr string
+		check   func(*Config) bool
+	}{
+		{"missing", "", "", func(config *Config) bool { return config.Theme == "" && config.ThemeColors == nil }},
+		{"theme", `{"theme": "light", "theme_colors": {"peer": "#00AAFF"}}`, "", func(config *Config) bool {
+			return config.Theme == "light" && config.ThemeColors["peer"] == "#00AAFF"
+		}},
+		{"unset fields", `{"nick": "sam", "future_setting": true}`, "", func(config *Config) bool {
+			return config.Nick == "sam" && config.MaxMessages == 0
+		}},
+		{"not json", `theme = "light"`, "invalid config", nil},
+		{"wrong type", `{"theme_colors": ["#00AAFF"]}`, "invalid config", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name+".json")
+			if tc.content != "" {
+				if err := os.WriteFile(path, []byte(tc.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config, err := LoadConfig(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("error %v, want one saying %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.check(config) {
+				t.Errorf("loaded %+v", config)
+			}
+		})
+	}
+
+	// What SaveConfig writes loads back the same
+	path := filepath.Join(dir, "saved", defaultConfigFile)
+	saved := &Config{Theme: "mono", ThemeColors: map[string]string{"accent": "42"}, Keywords: []string{"sam"}}
+	if err := SaveConfig(path, saved); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Theme != "mono" || loaded.ThemeColors["accent"] != "42" || len(loaded.Keywords) != 1 {
+		t.Errorf("saved %+v, loaded %+v", saved, loaded)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	defaultTorControl  = "127.0.0.1:9051"
+	defaultTorSOCKS    = "127.0.0.1:9050"
+	torPasswordEnv     = "P2PCHAT_TOR_PASSWORD"
+	onionKeyFile       = "onion.key" // Onion service key in the keys dir, so the .onion address is kept
+	torControlTimeout  = 30 * time.Second
+	torDialTimeout     = time.Minute // Building a circuit to an onion service can take a while
+	onionAddressSuffix = ".onion"
+)
+
+// TorConfig says how to reach the local Tor daemon
+type TorConfig struct {
+	ControlAddr string // Control port, for creating the onion service
+	SOCKSAddr   string // SOCKS port every peer connection is dialled through
+	Password    string // Control port password; cookie or no authentication is used if empty
+}
+
+// WithTor makes a node reachable only as a Tor onion service. Its node ID becomes the .onion
+// address, it listens on loopback only, every connection it makes goes through Tor, and discovery
+// is off, so peers never learn its real address.
+func WithTor(config TorConfig) NodeOption {
+	return func(options *nodeOptions) {
+		options.tor = &config
+	}
+}
+
+// isOnionAddr reports whether addr is a .onion host and port
+func isOnionAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && strings.HasSuffix(strings.ToLower(host), onionAddressSuffix)
+}
+
+// torTransport dials every peer through Tor's SOCKS port, which resolves names itself, so .onion
+// addresses work and nothing is looked up or connected to directly
+type torTransport struct {
+	socksAddr string
+	tcp       tcpTransport
+}
+
+// Listen only accepts connections from this machine, which is where Tor forwards the onion service
+func (tt torTransport) Listen(addr string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+	}
+	return tt.tcp.Listen(net.JoinHostPort("127.0.0.1", port))
+}
+
+func (tt torTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5("tcp", tt.socksAddr, nil, &net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	// The timeout is for reaching the SOCKS port; the circuit beyond it gets torDialTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), torDialTimeout)
+	defer cancel()
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+// TorController is a connection to Tor's control port. The onion service it creates lasts as
+// long as the connection, so closing it takes the service down.
+type TorController struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// DialTorController connects to the control port and authenticates
+func DialTorController(config TorConfig) (*TorController, error) {
+	conn, err := net.DialTimeout("tcp", config.ControlAddr, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the Tor control port at %s: %w", config.ControlAddr, err)
+	}
+	tc := &TorController{conn: conn, reader: bufio.NewReader(conn)}
+	if err := tc.authenticate(config.Password); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to authenticate to Tor: %w", err)
+	}
+	return tc, nil
+}
+
+// command sends one command and returns the lines of a successful reply, without their status codes
+func (tc *TorController) command(line string) ([]string, error) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	tc.conn.SetDeadline(time.Now().Add(torControlTimeout))
+	defer tc.conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(tc.conn, "%s\r\n", line); err != nil {
+		return nil, err
+	}
+
+	var reply []string
+	for {
+		text, err := tc.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		text = strings.TrimRight(text, "\r\n")
+		if len(text) < 4 {
+			return nil, fmt.Errorf("malformed reply %q", text)
+		}
+		code, separator, rest := text[:3], text[3], text[4:]
+		if code != "250" {
+			return nil, fmt.Errorf("tor: %s %s", code, rest)
+		}
+		reply = append(reply, rest)
+		if separator == ' ' {
+			return reply, nil
+		}
+	}
+}
+
+// authenticate uses the password if given, else whatever PROTOCOLINFO offers: no authentication
+// or the cookie file
+func (tc *TorController) authenticate(password string) error {
+	if password != "" {
+		_, err := tc.command("AUTHENTICATE " + strconv.Quote(password))
+		return err
+	}
+
+	reply, err := tc.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	var methods []string
+	var cookieFile string
+	for _, line := range reply {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "AUTH ")) {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "METHODS":
+				methods = strings.Split(value, ",")
+			case "COOKIEFILE":
+				if cookieFile, err = strconv.Unquote(value); err != nil {
+					return fmt.Errorf("malformed cookie file %s", value)
+				}
+			}
+		}
+	}
+
+	has := func(method string) bool {
+		for _, m := range methods {
+			if m == method {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("NULL"):
+		_, err = tc.command("AUTHENTICATE")
+	case has("COOKIE"):
+		cookie, readErr := os.ReadFile(cookieFile)
+		if readErr != nil {
+			return fmt.Errorf("failed to read the control cookie: %w", readErr)
+		}
+		_, err = tc.command("AUTHENTICATE " + hex.EncodeToString(cookie))
+	default:
+		return fmt.Errorf("no supported method among %s; set %s to use a control password",
+			strings.Join(methods, ","), torPasswordEnv)
+	}
+	return err
+}
+
+// addOnion creates an onion service forwarding virtualPort to target, with the key in keyPath,
+// or a new key that is then saved there. It returns the service's .onion host name.
+func (tc *TorController) addOnion(keyPath string, virtualPort int, target string) (string, error) {
+	key := "NEW:ED25519-V3"
+	data, err := os.ReadFile(keyPath)
+	switch {
+	case err == nil:
+		key = strings.TrimSpace(string(data))
+	case !errors.Is(err, os.ErrNotExist):
+		return "", fmt.Errorf("failed to read the onion key: %w", err)
+	}
+
+	reply, err := tc.command(fmt.Sprintf("ADD_ONION %s Port=%d,%s", key, virtualPort, target))
+	if err != nil {
+		return "", err
+	}
+	var serviceID, privateKey string
+	for _, line := range reply {
+		if value, found := strings.CutPrefix(line, "ServiceID="); found {
+			serviceID = value
+		} else if value, found := strings.CutPrefix(line, "PrivateKey="); found {
+			privateKey = value
+		}
+	}
+	if serviceID == "" {
+		return "", errors.New("tor returned no service ID")
+	}
+
+	if privateKey != "" {
+		if err := os.WriteFile(keyPath, []byte(privateKey+"\n"), 0600); err != nil {
+			return "", fmt.Errorf("failed to save the onion key: %w", err)
+		}
+	}
+	return serviceID + onionAddressSuffix, nil
+}
+
+// Close ends the control connection, taking the onion service down
+func (tc *TorController) Close() error {
+	return tc.conn.Close()
+}
+
+// startOnionService publishes the listener as an onion service on the same port, returning the
+// node ID peers reach it at
+func startOnionService(config TorConfig, listener net.Listener, keysDir string) (*TorController, string, error) {
+	_, portStr, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return nil, "", err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	controller, err := DialTorController(config)
+	if err != nil {
+		return nil, "", err
+	}
+	host, err := controller.addOnion(filepath.Join(keysDir, onionKeyFile), port, listener.Addr().String())
+	if err != nil {
+		controller.Close()
+		return nil, "", fmt.Errorf("failed to create the onion service: %w", err)
+	}
+
+	addr := net.JoinHostPort(host, portStr)
+	log.Printf("Onion service %s published; it may take a minute to become reachable", addr)
+	return controller, addr, nil
+}
+
+// handleMyAddrCommand processes /myaddr
+func (en *EnhancedNode) handleMyAddrCommand() {
+	content := fmt.Sprintf("📍 Your address: %s\n  Peers connect with /connect %s", en.ID, en.ID)
+	for _, addr := range en.advertised[1:] {
+		content += fmt.Sprintf("\n  Or, on another network, with /connect %s", addr)
+	}
+	for _, listener := range en.listeners {
+		content += fmt.Sprintf("\n  👂 Listening on %s", listener.Addr())
+	}
+	for _, err := range en.listenFailures {
+		content += fmt.Sprintf("\n  ⚠️ Not listening: %v", err)
+	}
+	if en.tor != nil {
+		content += "\n  🧅 Reachable over Tor only; share it with people you trust"
+	}
+	if en.dht != nil {
+		content += fmt.Sprintf("\n  🔎 Or, through the DHT, with /connect %s", en.cryptoManager.Fingerprint())
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(content),
+	})
+}
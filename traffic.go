@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	trafficFile         = "traffic.json"
+	trafficSampleEvery  = time.Second  // How often the counters are sampled for rates and daily totals
+	trafficWindow       = 5            // Samples the shown rate is averaged over
+	trafficSaveInterval = time.Minute  // How often daily totals are written to the data dir
+	trafficHistoryDays  = 90           // Days of totals kept in the traffic file
+	trafficDayFormat    = "2006-01-02" // Key of each day's totals, in local time
+	trafficShownDays    = 7            // Days listed by /stats
+)
+
+// trafficCounter counts bytes in each direction. It is only ever touched with atomics, so
+// counting adds no locking to the read and write paths.
+type trafficCounter struct {
+	in  atomic.Uint64
+	out atomic.Uint64
+}
+
+// countingConn counts a peer connection's traffic, both for the peer and for the node
+type countingConn struct {
+	net.Conn
+	peer  *trafficCounter
+	total *trafficCounter
+}
+
+func (cc *countingConn) Read(p []byte) (int, error) {
+	n, err := cc.Conn.Read(p)
+	cc.peer.in.Add(uint64(n))
+	cc.total.in.Add(uint64(n))
+	return n, err
+}
+
+func (cc *countingConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	cc.peer.out.Add(uint64(n))
+	cc.total.out.Add(uint64(n))
+	return n, err
+}
+
+// DailyTraffic is the data used on one day
+type DailyTraffic struct {
+	In  uint64 `json:"in"`
+	Out uint64 `json:"out"`
+}
+
+// TrafficInfo is the node's data usage, for /stats and the TUI status bar
+type TrafficInfo struct {
+	In      uint64       `json:"in"`  // Bytes received since start, peer connections and discovery
+	Out     uint64       `json:"out"` // Bytes sent since start
+	InRate  float64      `json:"in_rate"`
+	OutRate float64      `json:"out_rate"` // Bytes per second over the last few seconds
+	Today   DailyTraffic `json:"today"`    // Including earlier runs today
+}
+
+// trafficSample is the totals at one moment
+type trafficSample struct {
+	at      time.Time
+	in, out uint64
+}
+
+// TrafficMeter tracks the node's traffic. The totals are counted with atomics as data moves; a
+// sampler works out rates from them and adds them up per day, saving the days in the data dir.
+type TrafficMeter struct {
+	total trafficCounter
+
+	mutex   sync.Mutex // Guards the rest; taken by the sampler and readers, never when counting
+	samples []trafficSample
+	days    map[string]DailyTraffic
+	counted trafficSample // Totals already added to days
+	path    string
+}
+
+// NewTrafficMeter loads earlier daily totals from dataDir. A missing or unreadable file starts
+// the history afresh; usage stats aren't worth refusing to start over.
+func NewTrafficMeter(dataDir string) *TrafficMeter {
+	tm := &TrafficMeter{
+		days: make(map[string]DailyTraffic),
+		path: filepath.Join(dataDir, trafficFile),
+	}
+
+	data, err := os.ReadFile(tm.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: failed to read traffic totals: %v", err)
+		}
+		return tm
+	}
+	if err := json.Unmarshal(data, &tm.days); err != nil {
+		log.Printf("Warning: invalid traffic totals %s, starting afresh: %v", tm.path, err)
+		tm.days = make(map[string]DailyTraffic)
+	}
+	return tm
+}
+
+// sample records the current totals and adds what was used since the last sample to today
+func (tm *TrafficMeter) sample(now time.Time) {
+	current := trafficSample{at: now, in: tm.total.in.Load(), out: tm.total.out.Load()}
+
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	tm.samples = append(tm.samples, current)
+	if len(tm.samples) > trafficWindow+1 {
+		tm.samples = tm.samples[1:]
+	}
+
+	day := now.Format(trafficDayFormat)
+	today := tm.days[day]
+	today.In += current.in - tm.counted.in
+	today.Out += current.out - tm.counted.out
+	tm.days[day] = today
+	tm.counted = current
+}
+
+// save writes the daily totals, dropping days older than trafficHistoryDays
+func (tm *TrafficMeter) save(now time.Time) error {
+	tm.mutex.Lock()
+	oldest := now.AddDate(0, 0, -trafficHistoryDays).Format(trafficDayFormat)
+	for day := range tm.days {
+		if day < oldest {
+			delete(tm.days, day)
+		}
+	}
+	data, err := json.MarshalIndent(tm.days, "", "  ")
+	tm.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := tm.path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to save traffic totals: %w", err)
+	}
+	if err := os.Rename(tmpPath, tm.path); err != nil {
+		return fmt.Errorf("failed to save traffic totals: %w", err)
+	}
+	return nil
+}
+
+// Info returns the totals since start, the current rates and today's usage
+func (tm *TrafficMeter) Info() TrafficInfo {
+	info := TrafficInfo{In: tm.total.in.Load(), Out: tm.total.out.Load()}
+
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if len(tm.samples) > 1 {
+		oldest, newest := tm.samples[0], tm.samples[len(tm.samples)-1]
+		if elapsed := newest.at.Sub(oldest.at).Seconds(); elapsed > 0 {
+			info.InRate = float64(newest.in-oldest.in) / elapsed
+			info.OutRate = float64(newest.out-oldest.out) / elapsed
+		}
+	}
+	info.Today = tm.days[time.Now().Format(trafficDayFormat)]
+	return info
+}
+
+// dayTraffic is one day's totals, for listing
+type dayTraffic struct {
+	Day string
+	DailyTraffic
+}
+
+// History returns the totals of the latest days with any usage, newest first
+func (tm *TrafficMeter) History(days int) []dayTraffic {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	history := make([]dayTraffic, 0, len(tm.days))
+	for day, totals := range tm.days {
+		history = append(history, dayTraffic{Day: day, DailyTraffic: totals})
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Day > history[j].Day })
+	if len(history) > days {
+		history = history[:days]
+	}
+	return history
+}
+
+// meterTraffic samples the traffic counters every second and saves daily totals every minute
+// and at shutdown
+func (n *Node) meterTraffic() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(trafficSampleEvery)
+	defer ticker.Stop()
+	lastSave := time.Now()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			n.traffic.sample(now)
+			if now.Sub(lastSave) < trafficSaveInterval {
+				continue
+			}
+			lastSave = now
+			if err := n.traffic.save(now); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		case <-n.Shutdown:
+			now := time.Now()
+			n.traffic.sample(now)
+			if err := n.traffic.save(now); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// countConn wraps a peer connection so its traffic is counted
+func (n *Node) countConn(peer *Peer) {
+	peer.Conn = &countingConn{Conn: peer.Conn, peer: &peer.traffic, total: &n.traffic.total}
+}
+
+// peerTraffic returns the bytes received from and sent to a connected peer
+func (n *Node) peerTraffic(connID string) (uint64, uint64) {
+	n.peersMutex.RLock()
+	peer, exists := n.conns[connID]
+	n.peersMutex.RUnlock()
+	if !exists {
+		return 0, 0
+	}
+	return peer.traffic.in.Load(), peer.traffic.out.Load()
+}
+
+// Traffic returns the node's data usage (chatBackend)
+func (n *Node) Traffic() TrafficInfo {
+	return n.traffic.Info()
+}
+
+// formatRate formats a transfer rate in KB/s
+func formatRate(bytesPerSecond float64) string {
+	return fmt.Sprintf("%.1f KB/s", bytesPerSecond/1024)
+}
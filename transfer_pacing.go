@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	chunkAckEvery      = 4                      // The receiver acknowledges every this many chunks, and the last
+	minChunkWindow     = chunkAckEvery          // Any smaller and the sender would wait for an ack that never comes
+	initialChunkWindow = 8                      // Unacknowledged chunks a transfer starts with
+	maxChunkWindow     = 64                     // 512 KB in flight at most
+	slowChunkAck       = 500 * time.Millisecond // Waiting this long for room in the window halves it
+	chunkAckTimeout    = 30 * time.Second       // A receiver that acknowledges nothing for this long has stalled
+	legacyChunkDelay   = 10 * time.Millisecond  // Pause between chunks for receivers that don't acknowledge them
+	queueFullRetry     = 50 * time.Millisecond  // Wait before queueing a chunk again when the send queue was full
+	incomingIdleLimit  = 2 * chunkAckTimeout    // An incoming transfer that receives nothing for this long is dropped
+	transferSweepEvery = 10 * time.Second       // How often incoming transfers are checked for that
+)
+
+// errAckTimeout is returned when a receiver stops acknowledging chunks
+var errAckTimeout = errors.New("receiver stopped acknowledging chunks")
+
+// chunkWindow is how many chunks of a transfer may be sent ahead of the receiver's
+// acknowledgments. It grows by one for each ack that comes in time and halves when the sender
+// waits too long for one or finds the connection's send queue full.
+type chunkWindow struct {
+	size int
+}
+
+func newChunkWindow() *chunkWindow {
+	return &chunkWindow{size: initialChunkWindow}
+}
+
+// acked adjusts the window for an ack that took waited to arrive
+func (w *chunkWindow) acked(waited time.Duration) {
+	if waited >= slowChunkAck {
+		w.congested()
+		return
+	}
+	w.size = min(w.size+1, maxChunkWindow)
+}
+
+// congested halves the window
+func (w *chunkWindow) congested() {
+	w.size = max(w.size/2, minChunkWindow)
+}
+
+// waitForWindow blocks until chunk next may be sent: until fewer than the window's size of the
+// chunks before it are unacknowledged
+func (ftm *FileTransferManager) waitForWindow(transfer *FileTransfer, next int, window *chunkWindow) error {
+	clock := ftm.node.wallClock
+	started := clock.Now()
+	timeout := clock.NewTimer(chunkAckTimeout)
+	defer timeout.Stop()
+
+	for {
+		transfer.mutex.Lock()
+		outstanding := next - transfer.acked
+		transfer.mutex.Unlock()
+		if outstanding < window.size {
+			return nil
+		}
+
+		select {
+		case <-transfer.ackSignal:
+			now := clock.Now()
+			window.acked(now.Sub(started))
+			started = now
+			timeout.Reset(chunkAckTimeout)
+		case <-timeout.Chan():
+			return fmt.Errorf("%w for %v after chunk %d", errAckTimeout, chunkAckTimeout, next-outstanding)
+		case <-ftm.node.Shutdown:
+			return fmt.Errorf("node is shutting down")
+		}
+	}
+}
+
+// sendChunk queues a chunk, waiting and trying again while the connection's send queue is full
+// rather than failing the transfer. A full queue means the path is slower than the window
+// assumed, so the window is halved too.
+func (ftm *FileTransferManager) sendChunk(peerID string, transfer *FileTransfer, chunkMsg FileMessage, window *chunkWindow) error {
+	deadline := ftm.node.wallClock.Now().Add(chunkAckTimeout)
+	for {
+		err := ftm.sendTransferMessage(peerID, transfer.FileID, chunkMsg)
+		if !errors.Is(err, ErrSendQueueFull) || ftm.node.wallClock.Now().After(deadline) {
+			return err
+		}
+		window.congested()
+
+		select {
+		case <-ftm.node.wallClock.After(queueFullRetry):
+		case <-ftm.node.Shutdown:
+			return err
+		}
+	}
+}
+
+// handleFileAck records how many chunks of an outgoing transfer the receiver has, and wakes the
+// sender if it is waiting for room in its window
+func (ftm *FileTransferManager) handleFileAck(peerID string, fileMsg FileMessage) {
+	ftm.mutex.RLock()
+	transfer, exists := ftm.activeTransfers[fileMsg.FileID]
+	ftm.mutex.RUnlock()
+	if !exists || !transfer.IsOutgoing {
+		log.Printf("Ack from %s for unknown transfer %s", peerID, fileMsg.FileID)
+		return
+	}
+
+	transfer.mutex.Lock()
+	// An ack never covers more than the file, nor takes back an earlier one
+	if received := min(fileMsg.ChunkIndex+1, transfer.TotalChunks); received > transfer.acked {
+		transfer.acked = received
+	}
+	transfer.mutex.Unlock()
+
+	select {
+	case transfer.ackSignal <- struct{}{}:
+	default:
+	}
+}
+
+// chunkAck returns the ack due for an incoming transfer: one every chunkAckEvery chunks and one
+// once all have arrived. The caller must hold the transfer's mutex. Senders that predate acks
+// never asked for them, and get none.
+func chunkAck(transfer *FileTransfer) (FileMessage, bool) {
+	received := len(transfer.Chunks)
+	if !transfer.acks || (received%chunkAckEvery != 0 && received != transfer.TotalChunks) {
+		return FileMessage{}, false
+	}
+	return FileMessage{Type: "ack", FileID: transfer.FileID, ChunkIndex: received - 1}, true
+}
+
+// expireIncoming drops incoming transfers that stopped receiving chunks: a sender that went away
+// or whose completion was lost would otherwise leave them active, holding their chunks, forever.
+// Multi-source downloads are left to watchRangeDownload.
+func (ftm *FileTransferManager) expireIncoming() {
+	defer ftm.node.wg.Done()
+
+	ticker := ftm.node.wallClock.NewTicker(transferSweepEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.Chan():
+			ftm.dropIdleIncoming(now)
+		case <-ftm.node.Shutdown:
+			return
+		}
+	}
+}
+
+// dropIdleIncoming fails the incoming transfers that have received nothing for incomingIdleLimit
+func (ftm *FileTransferManager) dropIdleIncoming(now time.Time) {
+	// Copy the transfer list first, as ListTransfers does, for the lock order
+	ftm.mutex.RLock()
+	active := make([]*FileTransfer, 0, len(ftm.activeTransfers))
+	for _, transfer := range ftm.activeTransfers {
+		active = append(active, transfer)
+	}
+	ftm.mutex.RUnlock()
+
+	var idle []*FileTransfer
+	for _, transfer := range active {
+		transfer.mutex.Lock()
+		if !transfer.IsOutgoing && transfer.download == nil && transfer.Status == "active" &&
+			now.Sub(transfer.heard) > incomingIdleLimit {
+			transfer.Status = "failed"
+			ftm.publish(transfer)
+			idle = append(idle, transfer)
+		}
+		transfer.mutex.Unlock()
+	}
+
+	for _, transfer := range idle {
+		ftm.mutex.Lock()
+		delete(ftm.activeTransfers, transfer.FileID)
+		ftm.mutex.Unlock()
+		log.Printf("Gave up on %s from %s: nothing received for %v", transfer.FileName, transfer.PeerID, incomingIdleLimit)
+		ftm.node.notifyUI(Message{
+			SenderID:     "System",
+			Content:      []byte(fmt.Sprintf("❌ Gave up on %s from %s: nothing arrived for %v", transfer.FileName, transfer.PeerID, incomingIdleLimit)),
+			Conversation: transfer.PeerID,
+		})
+	}
+}
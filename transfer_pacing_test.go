@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestChunkWindow grows the window on timely acks, halves it on a slow one, and never shrinks it
+// below the minimum
+func TestChunkWindow(t *testing.T) {
+	window := newChunkWindow()
+	for range maxChunkWindow {
+		window.acked(slowChunkAck - time.Millisecond)
+	}
+	if window.size != maxChunkWindow {
+		t.Errorf("grew to %d on timely acks, want %d", window.size, maxChunkWindow)
+	}
+
+	window.acked(slowChunkAck)
+	if window.size != maxChunkWindow/2 {
+		t.Errorf("%d after a slow ack, want %d", window.size, maxChunkWindow/2)
+	}
+	for range 10 {
+		window.congested()
+	}
+	if window.size != minChunkWindow {
+		t.Errorf("shrank to %d, want no less than %d", window.size, minChunkWindow)
+	}
+}
+
+// TestChunkAck acks every chunkAckEvery chunks and the last, and never for a sender that doesn't
+// want acks
+func TestChunkAck(t *testing.T) {
+	for _, tc := range []struct {
+		received, total int
+		acks            bool
+		want            int // Index acknowledged, -1 for no ack
+	}{
+		{1, 10, true, -1},
+		{chunkAckEvery, 10, true, chunkAckEvery - 1},
+		{chunkAckEvery + 1, 10, true, -1},
+		{2 * chunkAckEvery, 10, true, 2*chunkAckEvery - 1},
+		{10, 10, true, 9},
+		{chunkAckEvery, 10, false, -1},
+		{10, 10, false, -1},
+	} {
+		transfer := &FileTransfer{FileID: "f", TotalChunks: tc.total, Chunks: make(map[int][]byte), acks: tc.acks}
+		for i := range tc.received {
+			transfer.Chunks[i] = nil
+		}
+		ack, due := chunkAck(transfer)
+		switch {
+		case tc.want < 0 && due:
+			t.Errorf("%d/%d (acks %v): acked %d, want none", tc.received, tc.total, tc.acks, ack.ChunkIndex)
+		case tc.want >= 0 && (!due || ack.Type != "ack" || ack.FileID != "f" || ack.ChunkIndex != tc.want):
+			t.Errorf("%d/%d: got %+v (due %v), want an ack of %d", tc.received, tc.total, ack, due, tc.want)
+		}
+	}
+}
+
+// pacedTransfer registers an outgoing transfer waiting for acks
+func pacedTransfer(node *EnhancedNode, total int) *FileTransfer {
+	transfer := &FileTransfer{FileID: "paced", IsOutgoing: true, TotalChunks: total, acks: true, ackSignal: make(chan struct{}, 1)}
+	node.fileManager.mutex.Lock()
+	node.fileManager.activeTransfers[transfer.FileID] = transfer
+	node.fileManager.mutex.Unlock()
+	return transfer
+}
+
+// TestHandleFileAck counts acked chunks forward only, and wakes the sender on each ack
+func TestHandleFileAck(t *testing.T) {
+	node := newTestNetwork(t, 1).nodes[0]
+	transfer := pacedTransfer(node, 10)
+	ack := func(index int) int {
+		node.fileManager.handleFileAck("peer", FileMessage{Type: "ack", FileID: transfer.FileID, ChunkIndex: index})
+		transfer.mutex.Lock()
+		defer transfer.mutex.Unlock()
+		return transfer.acked
+	}
+
+	if got := ack(3); got != 4 {
+		t.Errorf("acked %d after an ack of chunk 3", got)
+	}
+	select {
+	case <-transfer.ackSignal:
+	default:
+		t.Error("the ack didn't wake the sender")
+	}
+	if got := ack(1); got != 4 {
+		t.Errorf("an earlier ack took it back to %d", got)
+	}
+	if got := ack(99); got != 10 {
+		t.Errorf("an ack past the end made it %d", got)
+	}
+}
+
+// TestWaitForWindow drives the sender's wait for acks on the fake clock: a timely ack lets it go
+// on and grows the window, a slow one halves it, and none at all fails the transfer
+func TestWaitForWindow(t *testing.T) {
+	clock := newFakeClock()
+	node := newTestNetwork(t, 1, WithClock(clock)).nodes[0]
+	ftm := node.fileManager
+	transfer := pacedTransfer(node, 100)
+	window := newChunkWindow()
+
+	// Room in the window: no waiting
+	if err := ftm.waitForWindow(transfer, initialChunkWindow-1, window); err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(next int) chan error {
+		done := make(chan error, 1)
+		go func() { done <- ftm.waitForWindow(transfer, next, window) }()
+		clock.waitForTimer(t, chunkAckTimeout)
+		return done
+	}
+	ackThrough := func(index int) {
+		ftm.handleFileAck("peer", FileMessage{Type: "ack", FileID: transfer.FileID, ChunkIndex: index})
+	}
+
+	next := initialChunkWindow
+	done := wait(next)
+	clock.Advance(slowChunkAck / 2)
+	ackThrough(chunkAckEvery - 1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if window.size != initialChunkWindow+1 {
+		t.Errorf("window %d after a timely ack, want %d", window.size, initialChunkWindow+1)
+	}
+
+	// The window shrinks before the ack counts, so this one has to cover every chunk sent
+	next = chunkAckEvery + window.size
+	done = wait(next)
+	clock.Advance(slowChunkAck)
+	ackThrough(next - 1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if want := (initialChunkWindow + 1) / 2; window.size != max(want, minChunkWindow) {
+		t.Errorf("window %d after a slow ack, want %d", window.size, max(want, minChunkWindow))
+	}
+
+	done = wait(next + window.size)
+	clock.Advance(chunkAckTimeout - time.Nanosecond)
+	select {
+	case err := <-done:
+		t.Fatalf("gave up early: %v", err)
+	default:
+	}
+	clock.Advance(time.Nanosecond)
+	if err := <-done; !errors.Is(err, errAckTimeout) {
+		t.Errorf("got %v, want errAckTimeout", err)
+	}
+}
+
+// slowTransport delays every read on its connections, for a receiver that can't keep up
+type slowTransport struct {
+	Transport
+	delay time.Duration
+}
+
+type slowListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (st slowTransport) Listen(addr string) (net.Listener, error) {
+	listener, err := st.Transport.Listen(addr)
+	return slowListener{listener, st.delay}, err
+}
+
+func (sl slowListener) Accept() (net.Conn, error) {
+	conn, err := sl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return slowConn{conn, sl.delay}, nil
+}
+
+func (sc slowConn) Read(p []byte) (int, error) {
+	time.Sleep(sc.delay)
+	// Small reads, so the delay adds up over a chunk
+	return sc.Conn.Read(p[:min(len(p), 1024)])
+}
+
+// TestSlowReceiver sends a file to a node that reads slower than the sender writes: the window
+// keeps the sender's queue from filling, and the file arrives whole
+func TestSlowReceiver(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	a := tn.nodes[0]
+	b := tn.addNode(WithTransport(slowTransport{tn.network, time.Millisecond}))
+	tn.connect(a, b)
+
+	data := bytes.Repeat([]byte("slow receiver "), 40*chunkSize/14)
+	path := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SendFileAndConfirm(b.ID, path, testWait); err != nil {
+		t.Fatalf("sending file: %v", err)
+	}
+
+	downloadDir, _, _ := b.fileManager.receiveSettings()
+	received, err := os.ReadFile(filepath.Join(downloadDir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %d bytes that differ from the %d sent", len(received), len(data))
+	}
+	for _, notice := range loggedTexts(a, "System") {
+		if strings.Contains(notice, "❌") {
+			t.Errorf("sender: %s", notice)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	maxTransferRows  = 4  // Transfers listed below the messages; the rest are counted
+	progressBarWidth = 20 // Cells in a transfer's progress bar
+)
+
+// isOffer reports whether a transfer is a file offered to us that hasn't been answered yet
+func isOffer(transfer TransferInfo) bool {
+	return !transfer.IsOutgoing && transfer.Status == "pending"
+}
+
+// updateTransfers refreshes the file transfers, offers first and then oldest first, keeping the
+// same offer selected. The panel is resized when its height changes.
+func (ui *UI) updateTransfers() {
+	selected := ""
+	if offer, ok := ui.selectedOffer(); ok {
+		selected = offer.FileID
+	}
+
+	transfers := ui.node.Transfers()
+	sort.Slice(transfers, func(i, j int) bool {
+		if isOffer(transfers[i]) != isOffer(transfers[j]) {
+			return isOffer(transfers[i])
+		}
+		return transfers[i].FileID < transfers[j].FileID
+	})
+	ui.transfers = transfers
+
+	ui.offerCursor = min(ui.offerCursor, max(ui.offerCount()-1, 0))
+	for i, transfer := range transfers {
+		if transfer.FileID == selected && isOffer(transfer) {
+			ui.offerCursor = i
+		}
+	}
+	if ui.focus == focusTransfers && ui.offerCount() == 0 {
+		ui.setFocus(focusInput)
+	}
+
+	if height := ui.transferPanelHeight(); height != ui.transferHeight {
+		ui.transferHeight = height
+		ui.layout()
+	}
+}
+
+// offerCount is how many offers are waiting; they come first in ui.transfers
+func (ui *UI) offerCount() int {
+	count := 0
+	for count < len(ui.transfers) && isOffer(ui.transfers[count]) {
+		count++
+	}
+	return count
+}
+
+// selectedOffer is the offer the cursor is on
+func (ui *UI) selectedOffer() (TransferInfo, bool) {
+	if ui.offerCursor < ui.offerCount() {
+		return ui.transfers[ui.offerCursor], true
+	}
+	return TransferInfo{}, false
+}
+
+// selectOffer handles keys while the transfer panel has focus: Up/Down pick an offer, a accepts
+// it and r rejects it
+func (ui *UI) selectOffer(msg tea.KeyMsg) bool {
+	switch {
+	case msg.Type == tea.KeyUp:
+		if ui.offerCursor > 0 {
+			ui.offerCursor--
+		}
+	case msg.Type == tea.KeyDown:
+		if ui.offerCursor < ui.offerCount()-1 {
+			ui.offerCursor++
+		}
+	case msg.String() == "a" || msg.String() == "r":
+		if offer, ok := ui.selectedOffer(); ok {
+			command := "/accept "
+			if msg.String() == "r" {
+				command = "/reject "
+			}
+			if err := ui.node.SendInput(command + offer.FileID); err != nil {
+				ui.notice(fmt.Sprintf("❌ %v", err))
+			}
+		}
+		if ui.offerCount() <= 1 {
+			ui.setFocus(focusInput)
+		}
+	case msg.Type == tea.KeyEsc:
+		ui.setFocus(focusInput)
+	case msg.Type == tea.KeyRunes, msg.Type == tea.KeySpace, msg.Type == tea.KeyBackspace:
+		ui.setFocus(focusInput)
+		return false
+	default:
+		return false
+	}
+	return true
+}
+
+// transferPanelHeight is the height of the transfer panel, 0 while there is nothing to show
+func (ui *UI) transferPanelHeight() int {
+	if len(ui.transfers) == 0 {
+		return 0
+	}
+	return lipgloss.Height(ui.renderTransfers())
+}
+
+// renderTransfers renders the transfer panel: offers waiting for an answer, highlighted with the
+// keys to answer them, and a progress bar for each transfer under way
+func (ui *UI) renderTransfers() string {
+	width := ui.width - 2 - messagePanelStyle.GetHorizontalFrameSize()
+	offers := ui.offerCount()
+
+	var rows []string
+	for i, transfer := range ui.transfers {
+		if i == maxTransferRows && len(ui.transfers) > maxTransferRows+1 {
+			rows = append(rows, timestampStyle.Render(fmt.Sprintf("… and %d more (/accept <id> or /reject <id>)", len(ui.transfers)-i)))
+			break
+		}
+		row := ui.renderTransfer(transfer)
+		if ui.focus == focusTransfers && i == ui.offerCursor && isOffer(transfer) {
+			row = lipgloss.NewStyle().Reverse(true).Render(row)
+		}
+		rows = append(rows, lipgloss.NewStyle().MaxWidth(width).Render(row))
+	}
+
+	if offers > 0 {
+		hint := "Ctrl+O to answer, or /accept <id> · /reject <id>"
+		if ui.focus == focusTransfers {
+			hint = "a: accept · r: reject · ↑/↓: choose · Esc: back"
+		}
+		rows = append(rows, lipgloss.NewStyle().MaxWidth(width).Render(timestampStyle.Render(hint)))
+	}
+
+	style := messagePanelStyle
+	switch {
+	case ui.focus == focusTransfers:
+		style = focusStyle(style)
+	case offers > 0:
+		style = style.BorderForeground(warningColor)
+	}
+	return style.Width(ui.width - 2).Render(strings.Join(rows, "\n"))
+}
+
+// renderTransfer renders one row of the transfer panel
+func (ui *UI) renderTransfer(transfer TransferInfo) string {
+	peer := ui.displayName(transfer.PeerID)
+	size := formatBytes(transfer.FileSize)
+	name := transfer.FileName
+	if transfer.Kind == transferKindVoice {
+		name = "🎙️ voice message"
+	}
+
+	switch {
+	case isOffer(transfer):
+		return mentionMessageStyle.Render(fmt.Sprintf("📥 %s offers %s (%s)", peer, transfer.FileName, size)) +
+			timestampStyle.Render("  id "+transfer.FileID)
+	case transfer.Status == "failed":
+		return peerDisconnectedStyle.Render(fmt.Sprintf("❌ %s (%s) failed", name, peer))
+	case transfer.IsOutgoing && transfer.Status == "pending":
+		return fmt.Sprintf("📤 %s (%s) to %s ", name, size, peer) + timestampStyle.Render("waiting for them to accept")
+	}
+
+	arrow := "📥 " + name + " from " + peer
+	if transfer.IsOutgoing {
+		arrow = "📤 " + name + " to " + peer
+	}
+	return fmt.Sprintf("%s %s %3d%% of %s", arrow, progressBar(transfer.Progress), transfer.Progress, size)
+}
+
+// progressBar draws a percentage as a bar of progressBarWidth cells
+func progressBar(percent int) string {
+	filled := min(max(percent, 0), 100) * progressBarWidth / 100
+	return peerConnectedStyle.Render(strings.Repeat("█", filled)) +
+		timestampStyle.Render(strings.Repeat("░", progressBarWidth-filled))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transport is how a node accepts and makes peer connections. Nodes use TCP unless created with
+// WithTransport; a MemoryNetwork connects nodes inside one process.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// NodeOption changes how NewNode and NewEnhancedNode set up a node
+type NodeOption func(*nodeOptions)
+
+// nodeOptions collects the NodeOptions given to a constructor
+type nodeOptions struct {
+	transport Transport
+	quic      bool       // Use a QUIC transport made from the node's identity key (WithQUIC)
+	tor       *TorConfig // Run as an onion service, dialling through Tor (WithTor)
+	dht       *DHTConfig // Join the DHT (WithDHT)
+	clock     Clock      // Time and timers (WithClock)
+	random    Random     // Jitter and file IDs (WithRandom)
+	listen    []string   // Further addresses to listen on (WithListenAddrs)
+	portRange int        // Further ports to try when one is taken (WithPortRange)
+
+	probeMulticast func(conn *net.UDPConn, timeout time.Duration) error // Checks multicast works before discovery uses it
+}
+
+// WithTransport makes a node use transport instead of TCP for peer connections
+func WithTransport(transport Transport) NodeOption {
+	return func(options *nodeOptions) {
+		options.transport = transport
+	}
+}
+
+// applyNodeOptions fills in the defaults and applies opts
+func applyNodeOptions(opts []NodeOption) nodeOptions {
+	options := nodeOptions{transport: tcpTransport{}, clock: systemClock{}, random: systemRandom{}, probeMulticast: probeMulticast}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// tcpTransport is the default transport
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// memoryHost is the host part of every address on a MemoryNetwork
+const memoryHost = "127.0.0.1"
+
+// errMemoryListenerClosed is returned by Accept once a memory listener is closed
+var errMemoryListenerClosed = errors.New("memory listener closed")
+
+// MemoryNetwork is a Transport whose connections are in-process pipes. Listening on port 0 picks
+// a free port, as with TCP, so addresses look like 127.0.0.1:<port> and node IDs work unchanged.
+// There is no multicast, so nodes on it should be created with discovery disabled.
+type MemoryNetwork struct {
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+	nextPort  int
+}
+
+// NewMemoryNetwork creates an empty in-process network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners: make(map[string]*memoryListener),
+		nextPort:  10000,
+	}
+}
+
+// allocatePort returns a port nothing on the network uses. The caller holds the mutex.
+func (mn *MemoryNetwork) allocatePort() int {
+	for {
+		mn.nextPort++
+		if _, used := mn.listeners[memoryAddr(mn.nextPort).String()]; !used {
+			return mn.nextPort
+		}
+	}
+}
+
+func (mn *MemoryNetwork) Listen(addr string) (net.Listener, error) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	mn.mutex.Lock()
+	defer mn.mutex.Unlock()
+	if port == 0 {
+		port = mn.allocatePort()
+	}
+	local := memoryAddr(port)
+	if _, used := mn.listeners[local.String()]; used {
+		return nil, fmt.Errorf("address %s already in use", local)
+	}
+
+	listener := &memoryListener{
+		network: mn,
+		addr:    local,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	mn.listeners[local.String()] = listener
+	return listener, nil
+}
+
+func (mn *MemoryNetwork) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	mn.mutex.Lock()
+	listener, ok := mn.listeners[addr]
+	local := memoryAddr(mn.allocatePort())
+	mn.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+
+	var err error
+	client, server := net.Pipe()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case listener.conns <- &memoryConn{Conn: server, local: listener.addr, remote: local}:
+		return &memoryConn{Conn: client, local: local, remote: listener.addr}, nil
+	case <-listener.closed:
+		err = fmt.Errorf("dial %s: connection refused", addr)
+	case <-timer.C:
+		err = fmt.Errorf("dial %s: timed out", addr)
+	}
+	// Nobody took the server end, so neither end will ever be used
+	client.Close()
+	server.Close()
+	return nil, err
+}
+
+// memoryAddr is the address of a port on a MemoryNetwork
+type memoryAddr int
+
+func (memoryAddr) Network() string { return "memory" }
+
+func (addr memoryAddr) String() string {
+	return net.JoinHostPort(memoryHost, strconv.Itoa(int(addr)))
+}
+
+// memoryListener hands out the server ends of pipes dialled to its address
+type memoryListener struct {
+	network   *MemoryNetwork
+	addr      memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ml *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.conns:
+		return conn, nil
+	case <-ml.closed:
+		return nil, errMemoryListenerClosed
+	}
+}
+
+func (ml *memoryListener) Close() error {
+	ml.closeOnce.Do(func() {
+		ml.network.mutex.Lock()
+		delete(ml.network.listeners, ml.addr.String())
+		ml.network.mutex.Unlock()
+		close(ml.closed)
+	})
+	return nil
+}
+
+func (ml *memoryListener) Addr() net.Addr { return ml.addr }
+
+// memoryConn is one end of a pipe, reporting network addresses so peers can be told apart
+type memoryConn struct {
+	net.Conn
+	local, remote memoryAddr
+}
+
+func (mc *memoryConn) LocalAddr() net.Addr  { return mc.local }
+func (mc *memoryConn) RemoteAddr() net.Addr { return mc.remote }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMemoryNetworkListenAndDial has two listeners get their own ports and a dial reach one, with
+// each end seeing the other's address
+func TestMemoryNetworkListenAndDial(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	first, err := network.Listen(memoryHost + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := network.Listen(memoryHost + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if first.Addr().String() == second.Addr().String() {
+		t.Fatalf("two listeners on port 0 both got %s", first.Addr())
+	}
+	if _, err := network.Listen(first.Addr().String()); err == nil {
+		t.Fatalf("listening twice on %s succeeded", first.Addr())
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := first.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	client, err := network.Dial(first.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+	defer server.Close()
+
+	if server.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("server sees the client as %s, the client is %s", server.RemoteAddr(), client.LocalAddr())
+	}
+	if client.RemoteAddr().String() != first.Addr().String() {
+		t.Errorf("client sees the server as %s, it listens on %s", client.RemoteAddr(), first.Addr())
+	}
+
+	go client.Write([]byte("hello\n"))
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello\n" {
+		t.Errorf("server read %q, %v", buf, err)
+	}
+}
+
+// TestMemoryNetworkDialFailures refuses dials to no listener, a listener nobody accepts on and a
+// closed one
+func TestMemoryNetworkDialFailures(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	if _, err := network.Dial(memoryHost+":1", time.Second); err == nil {
+		t.Error("dialling an address nobody listens on succeeded")
+	}
+
+	listener, err := network.Listen(memoryHost + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+
+	// Nobody accepts, so the dial times out; the pipe it made must not be handed out later
+	if _, err := network.Dial(addr, 10*time.Millisecond); err == nil {
+		t.Fatal("dial that nobody accepted succeeded")
+	}
+	select {
+	case conn := <-listener.(*memoryListener).conns:
+		t.Fatalf("timed-out dial left a connection from %s to accept", conn.RemoteAddr())
+	default:
+	}
+
+	listener.Close()
+	if _, err := listener.Accept(); err != errMemoryListenerClosed {
+		t.Errorf("Accept on a closed listener returned %v", err)
+	}
+	if _, err := network.Dial(addr, time.Second); err == nil {
+		t.Error("dialling a closed listener succeeded")
+	}
+}
+
+// TestKeyExchange has two connected nodes hold each other's keys, over a session authenticated
+// with them
+func TestKeyExchange(t *testing.T) {
+	_, a, b := connectedPair(t)
+
+	if got, _ := a.cryptoManager.PeerFingerprint(b.ID); got != b.cryptoManager.Fingerprint() {
+		t.Errorf("a holds key %s for b, b's key is %s", got, b.cryptoManager.Fingerprint())
+	}
+	if got, _ := b.cryptoManager.PeerFingerprint(a.ID); got != a.cryptoManager.Fingerprint() {
+		t.Errorf("b holds key %s for a, a's key is %s", got, a.cryptoManager.Fingerprint())
+	}
+	for _, peer := range a.snapshotPeers() {
+		ac, ok := peerAuthenticatedConn(peer)
+		if !ok {
+			t.Fatalf("connection %s isn't authenticated", peer.ID)
+		}
+		if ac.peerFingerprint() != b.cryptoManager.Fingerprint() {
+			t.Errorf("connection %s authenticated key %s, want b's", peer.ID, ac.peerFingerprint())
+		}
+	}
+}
+
+// TestTextMessages sends a direct message and a broadcast among three nodes; only the broadcast
+// reaches the third
+func TestTextMessages(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	a, b, c := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	tn.connect(a, b)
+	tn.connect(a, c)
+
+	if err := a.SendTextAndConfirm(b.ID, "just for b", testWait); err != nil {
+		t.Fatalf("direct message: %v", err)
+	}
+	waitForText(t, b, a.ID, "just for b")
+
+	sent, err := a.SendEncryptedText("for everyone")
+	if err != nil {
+		t.Fatalf("broadcast: %v", err)
+	}
+	if sent.Direct {
+		t.Error("a broadcast was returned as a direct message")
+	}
+	waitForText(t, b, a.ID, "for everyone")
+	waitForText(t, c, a.ID, "for everyone")
+
+	for _, text := range loggedTexts(c, a.ID) {
+		if text == "just for b" {
+			t.Error("c saw a direct message meant for b")
+		}
+	}
+}
+
+// TestFileTransfer sends a file of several chunks and checks what arrives
+func TestFileTransfer(t *testing.T) {
+	_, a, b := connectedPair(t)
+
+	// Several chunks, so pacing and reassembly are exercised
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*chunkSize/16+7)
+	path := filepath.Join(t.TempDir(), "report.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.SendFileAndConfirm(b.ID, path, testWait); err != nil {
+		t.Fatalf("sending file: %v", err)
+	}
+	downloadDir, _, _ := b.fileManager.receiveSettings()
+	received, err := os.ReadFile(filepath.Join(downloadDir, "report.bin"))
+	if err != nil {
+		t.Fatalf("received file: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Errorf("received %d bytes that differ from the %d sent", len(received), len(data))
+	}
+}
+
+// TestGossipIntroducesPeers has a node learn of its neighbour's peer from gossip and connect to it
+func TestGossipIntroducesPeers(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	a, b, c := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	tn.chain()
+
+	// b learns c's record when they connect; a hears of it at b's next gossip round
+	waitFor(t, "b to hold c's record", func() bool {
+		_, ok := b.peerRecords.Get(c.ID)
+		return ok
+	})
+	b.gossipPeerRecords(true)
+
+	waitFor(t, "a to hold c's record", func() bool {
+		_, ok := a.peerRecords.Get(c.ID)
+		return ok
+	})
+	waitFor(t, "a to connect to c", func() bool {
+		_, _, err := a.resolvePeer(c.ID)
+		return err == nil
+	})
+	waitForKeys(t, a, c)
+}
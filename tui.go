@@ -2,75 +2,57 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/textarea"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
 
-// Styles for the TUI
+// Styles for the TUI, built from the current theme by applyTheme
 var (
 	// Color scheme
-	primaryColor   = lipgloss.Color("#7C3AED") // Purple
-	accentColor    = lipgloss.Color("#10B981") // Green
-	warningColor   = lipgloss.Color("#F59E0B") // Amber
-	errorColor     = lipgloss.Color("#EF4444") // Red
-	mutedColor     = lipgloss.Color("#6B7280") // Gray
-	backgroundColor = lipgloss.Color("#1F2937") // Dark gray
+	primaryColor    lipgloss.TerminalColor
+	accentColor     lipgloss.TerminalColor
+	warningColor    lipgloss.TerminalColor
+	errorColor      lipgloss.TerminalColor
+	mutedColor      lipgloss.TerminalColor
+	backgroundColor lipgloss.TerminalColor
+	focusBorder     lipgloss.Border // Border of the focused panel
 
 	// Component styles
-	headerStyle = lipgloss.NewStyle().
-			Bold(true).
-			Foreground(primaryColor).
-			BorderStyle(lipgloss.RoundedBorder()).
-			BorderForeground(primaryColor).
-			Padding(0, 1)
-
-	peerPanelStyle = lipgloss.NewStyle().
-			BorderStyle(lipgloss.RoundedBorder()).
-			BorderForeground(mutedColor).
-			Padding(0, 1)
-
-	messagePanelStyle = lipgloss.NewStyle().
-				BorderStyle(lipgloss.RoundedBorder()).
-				BorderForeground(mutedColor).
-				Padding(0, 1)
-
-	statusBarStyle = lipgloss.NewStyle().
-			Foreground(mutedColor).
-			Background(backgroundColor).
-			Padding(0, 1)
-
-	inputStyle = lipgloss.NewStyle().
-			BorderStyle(lipgloss.RoundedBorder()).
-			BorderForeground(accentColor).
-			Padding(0, 1)
+	headerStyle       lipgloss.Style
+	peerPanelStyle    lipgloss.Style
+	messagePanelStyle lipgloss.Style
+	statusBarStyle    lipgloss.Style
+	inputStyle        lipgloss.Style
 
 	// Message styles
-	systemMessageStyle = lipgloss.NewStyle().
-				Foreground(accentColor).
-				Italic(true)
+	systemMessageStyle  lipgloss.Style
+	userMessageStyle    lipgloss.Style
+	peerMessageStyle    lipgloss.Style
+	timestampStyle      lipgloss.Style
+	mentionMessageStyle lipgloss.Style
 
-	userMessageStyle = lipgloss.NewStyle().
-				Foreground(primaryColor).
-				Bold(true)
+	// Links in messages, and the label of the conversation tab being shown
+	linkStyle      lipgloss.Style
+	activeTabStyle lipgloss.Style
 
-	peerMessageStyle = lipgloss.NewStyle().
-				Foreground(lipgloss.Color("#3B82F6"))
+	// Inline code and code blocks in messages
+	codeStyle lipgloss.Style
 
-	timestampStyle = lipgloss.NewStyle().
-			Foreground(mutedColor).
-			Faint(true)
+	// Search highlights; the selected match stands out from the rest
+	searchMatchStyle  lipgloss.Style
+	currentMatchStyle lipgloss.Style
 
 	// Peer status styles
-	peerConnectedStyle = lipgloss.NewStyle().
-				Foreground(accentColor)
-
-	peerDisconnectedStyle = lipgloss.NewStyle().
-				Foreground(errorColor)
+	peerConnectedStyle    lipgloss.Style
+	peerDisconnectedStyle lipgloss.Style
 )
 
 // Message represents a chat message with timestamp
@@ -79,20 +61,138 @@ type ChatMessage struct {
 	Content   string
 	Timestamp time.Time
 	IsSystem  bool
+	Lamport   uint64    // Zero for messages without ordering information
+	Mention   bool      // Mentions our nick or a watched keyword
+	Action    bool      // /me action
+	Direct    bool      // Sent only to us, or by us to one peer
+	ExpiresAt time.Time // Ephemeral messages are removed at this time; zero keeps them
+	Image     string    // Received image file shown with a preview below the message
+	ID        string    // Sender's message ID, which read receipts refer to
+	Seen      time.Time // When the peer read our direct message; zero until a receipt arrives
+	SenderKey string    // Fingerprint of the sender's key, if it was known
+}
+
+// PeerInfo is what the peer panel shows about a peer
+type PeerInfo struct {
+	NodeID      string // Node ID learned from the peer's messages; the connection ID until then
+	Nick        string // Nick the peer announced, if any
+	Presence    Presence
+	Muted       bool
+	Key         string        // KeyNone, KeyExchanged or KeyVerified
+	Latency     time.Duration // Last measured round trip; zero if not measured yet
+	LastActive  time.Time     // When the peer last sent a chat message
+	BytesIn     uint64        // Received over this connection
+	BytesOut    uint64        // Sent over this connection
+	Fingerprint string        // Fingerprint of the peer's key; empty until it is known
+}
+
+// chatBackend is what the TUI needs from a node: either the in-process node or a daemon reached over its control socket
+type chatBackend interface {
+	NodeID() string
+	UIMessages() <-chan Message // Subscribes; recent messages are replayed before live ones
+	PeerIDs() []string
+	PeerInfo(peerID string) PeerInfo
+	SendInput(input string) error
+	MarkRead(peerID string, ids []string) error // Direct messages from a peer the user has seen, for read receipts
+	Transfers() []TransferInfo                  // File transfers in progress and offers waiting for an answer
+	Playback() PlaybackInfo                     // Voice message volume and speed, and whether one is playing
+	Traffic() TrafficInfo                       // Data usage and current rates
+	Rooms() []RoomInfo                          // Rooms we are in, with their topics
+	Locked() bool                               // Refusing new connections (/lock)
+	Done() <-chan struct{}                      // Closed when the backend goes away; the TUI exits
 }
 
+const (
+	defaultMaxMessages = 5000 // Messages kept in the TUI before the oldest are dropped
+	maxInputChars      = 4000 // Longest message that can be typed; within maxTextBytes however wide its characters
+	maxInputLines      = 6    // The input box grows with its content up to this many lines
+)
+
+// Layout limits, in terminal cells
+const (
+	peerPanelMinTerminal = 80 // Narrower terminals hide the peer panel unless it is toggled on
+	minPeerPanelWidth    = 26
+	maxPeerPanelWidth    = 40
+	minMessageWidth      = 20 // The peer panel is dropped rather than squeeze messages below this
+	minTerminalWidth     = 30
+	minTerminalHeight    = 14
+)
+
+// uiFocus is the pane that receives keys
+type uiFocus int
+
+const (
+	focusInput uiFocus = iota
+	focusMessages
+	focusPeers
+	focusTransfers // Only while file offers are waiting for an answer
+)
+
 // UI represents the TUI model
 type UI struct {
-	node         *Node
-	messages     []ChatMessage
-	peers        []string
-	viewport     viewport.Model
-	textarea     textarea.Model
-	ready        bool
-	width        int
-	height       int
-	lastUpdate   time.Time
-	showHelp     bool
+	node          chatBackend
+	messages      []ChatMessage
+	peers         []string
+	viewport      viewport.Model
+	textarea      textarea.Model
+	ready         bool
+	width         int
+	height        int
+	lastUpdate    time.Time
+	showHelp      bool
+	lastInput     time.Time            // When the user last typed, for auto-away
+	awayAfter     time.Duration        // Input idle time before auto-away (0 disables)
+	autoAway      bool                 // We set "away" automatically and should undo it on input
+	manualStatus  bool                 // The user chose a status other than online; leave it alone
+	mentions      int                  // Mentions since the user last sent something
+	mentionBell   bool                 // Ring the terminal bell on mentions
+	notifications desktopNotifications // Desktop notifications while the terminal is in the background
+	history       *InputHistory        // Sent inputs, recalled with Up/Down
+	completion    *tabCompletion       // Tab completion being cycled through, if any
+	focus         uiFocus              // Pane receiving keys; Shift+Tab switches
+	peerInfo      map[string]PeerInfo  // Details of each connected peer, refreshed every tick
+	peerCursor    int                  // Selected row in the peer panel
+	peerOffset    int                  // First peer shown when the list doesn't fit
+	peerWidth     int                  // Peer panel width; 0 when hidden
+	messageWidth  int                  // Message panel width
+	wide          bool                 // Wide enough to show the peer panel by default
+	peersToggled  bool                 // Ctrl+G flipped the peer panel from its default for this width
+	unread        int                  // Peer messages that arrived while scrolled up or unfocused
+	unreadDirect  int                  // How many of the unread were sent only to us
+	blurred       bool                 // The terminal window doesn't have focus
+	maxMessages   int                  // Messages kept in the view (0 keeps all); the oldest go first
+	rendered      strings.Builder      // Rendered messages, appended to as messages arrive
+	search        *messageSearch       // Open search (Ctrl+F), if any
+	incoming      <-chan Message       // Messages from the node, subscribed to in Init
+	theme         string               // Name of the theme in use
+	themeColors   map[string]string    // Color overrides from the config, kept across /theme
+	flags         configFlags          // Flags that override the config file, reapplied on /reload
+
+	conversations     []*conversation // Tabs: the broadcast channel first, then one per DM peer
+	active            int             // The conversation being shown, whose messages are ui.messages
+	conversationsPath string          // File the open DM tabs are saved to; empty keeps them in memory
+	exportDir         string          // Where /save writes when given no path
+	profile           string          // -profile the node runs as, shown in the status bar
+
+	notifyPrefs     notificationPrefs // Notification level of each conversation, and do not disturb
+	notifyPrefsPath string            // File notifyPrefs are saved to; empty keeps them in memory
+	fingerprints    map[string]string // Node ID -> key fingerprint of peers seen this session
+
+	transfers      []TransferInfo // File transfers, offers waiting for an answer first
+	playback       PlaybackInfo   // Voice playback, shown in the status bar while a clip plays
+	traffic        TrafficInfo    // Data usage; the current rates are shown in the status bar
+	rooms          []RoomInfo     // Rooms we are in; the active one's topic is shown in the header
+	locked         bool           // The node is refusing new connections; shown in the status bar
+	offerCursor    int            // Selected offer in the transfer panel
+	transferHeight int            // Height of the transfer panel; 0 when hidden
+	hyperlinks     bool           // The terminal makes OSC 8 links clickable
+	plainText      bool           // Show *bold*, `code` and code fences as typed instead of formatting them
+
+	renderedLines int                  // Lines in rendered
+	previews      []previewSlot        // Where image previews sit in rendered
+	thumbnails    map[string]thumbnail // Previews rendered so far, by file
+	graphics      string               // Graphics protocol for showing images full size; empty for block art
+	linkPreviews  *LinkPreviewer       // Fetches the titles of links peers send (-link-previews); nil when off
 }
 
 // tickMsg is sent periodically to update the UI
@@ -101,34 +201,68 @@ type tickMsg time.Time
 // messageMsg wraps incoming messages
 type messageMsg Message
 
+// backendDoneMsg is sent when the node shuts down under the TUI
+type backendDoneMsg struct{}
+
 // NewUI creates a new TUI instance
-func NewUI(node *Node) *UI {
+func NewUI(node chatBackend) *UI {
 	ta := textarea.New()
 	ta.Placeholder = "Type a message or /help for commands..."
 	ta.Focus()
 	ta.Prompt = "┃ "
-	ta.CharLimit = 500
+	ta.CharLimit = maxInputChars
 	ta.SetWidth(80)
 	ta.SetHeight(1)
 	ta.FocusedStyle.CursorLine = lipgloss.NewStyle()
 	ta.ShowLineNumbers = false
+	// Enter sends; Alt+Enter (or Ctrl+J) starts a new line
+	ta.KeyMap.InsertNewline.SetKeys("alt+enter", "ctrl+j")
+	// Ctrl+H toggles help, so it must not also delete a character
+	ta.KeyMap.DeleteCharacterBackward.SetKeys("backspace")
+	// Home/End scroll the messages
+	ta.KeyMap.LineStart.SetKeys("ctrl+a")
+	ta.KeyMap.LineEnd.SetKeys("ctrl+e")
+	// Ctrl+Left/Right switch conversations; Alt moves by word
+	ta.KeyMap.WordBackward.SetKeys("alt+left", "alt+b")
+	ta.KeyMap.WordForward.SetKeys("alt+right", "alt+f")
 
 	vp := viewport.New(80, 20)
 	vp.SetContent("")
+	// Letter keys and Up/Down belong to the input; the viewport only pages
+	vp.KeyMap = viewport.KeyMap{
+		PageUp:   key.NewBinding(key.WithKeys("pgup")),
+		PageDown: key.NewBinding(key.WithKeys("pgdown")),
+	}
+
+	history, _ := NewInputHistory("") // In memory until a path is set
 
 	return &UI{
-		node:       node,
-		messages:   []ChatMessage{},
-		peers:      []string{},
-		viewport:   vp,
-		textarea:   ta,
-		lastUpdate: time.Now(),
-		showHelp:   false,
+		node:        node,
+		messages:    []ChatMessage{},
+		peers:       []string{},
+		viewport:    vp,
+		textarea:    ta,
+		lastUpdate:  time.Now(),
+		showHelp:    false,
+		lastInput:   time.Now(),
+		awayAfter:   defaultAwayAfter,
+		history:     history,
+		maxMessages: defaultMaxMessages,
+		theme:       defaultTheme,
+
+		notifications: desktopNotifications{notifier: newCommandNotifier(), mode: notifyOff},
+		fingerprints:  make(map[string]string),
+
+		conversations: []*conversation{{follow: true}},
+		hyperlinks:    supportsHyperlinks(),
+		graphics:      detectGraphics(),
 	}
 }
 
-// Init initializes the TUI
+// Init initializes the TUI and subscribes to the node's messages, starting with the ones sent
+// before the TUI was running
 func (ui *UI) Init() tea.Cmd {
+	ui.incoming = ui.node.UIMessages()
 	return tea.Batch(
 		textarea.Blink,
 		ui.listenForMessages(),
@@ -139,8 +273,12 @@ func (ui *UI) Init() tea.Cmd {
 // listenForMessages listens for messages from the node
 func (ui *UI) listenForMessages() tea.Cmd {
 	return func() tea.Msg {
-		msg := <-ui.node.uiChannel
-		return messageMsg(msg)
+		select {
+		case msg := <-ui.incoming:
+			return messageMsg(msg)
+		case <-ui.node.Done():
+			return backendDoneMsg{}
+		}
 	}
 }
 
@@ -153,16 +291,94 @@ func (ui *UI) tickCmd() tea.Cmd {
 
 // Update handles messages and updates the model
 func (ui *UI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	model, cmd := ui.update(msg)
+	ui.fitInput()
+	ui.loadVisiblePreviews()
+	return model, cmd
+}
+
+// fitInput grows or shrinks the input box to its content, giving the lines back to the messages.
+// Short terminals keep it smaller so the message panel isn't squeezed out.
+func (ui *UI) fitInput() {
+	if !ui.ready {
+		return
+	}
+
+	// Word-wrap each line the way the textarea does to count the rows it takes
+	wrap := lipgloss.NewStyle().Width(max(ui.textarea.Width(), 1))
+	lines := 0
+	for _, line := range strings.Split(ui.textarea.Value(), "\n") {
+		lines += lipgloss.Height(wrap.Render(line))
+	}
+	limit := max(min(maxInputLines, ui.height-minTerminalHeight+1), 1)
+	if height := min(lines, limit); height != ui.textarea.Height() {
+		ui.textarea.SetHeight(height)
+		ui.layout()
+	}
+}
+
+// update does the work of Update
+func (ui *UI) update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var (
 		tiCmd tea.Cmd
 		vpCmd tea.Cmd
 	)
 
+	// An open search takes the keyboard
+	if keyMsg, ok := msg.(tea.KeyMsg); ok && ui.search != nil {
+		if used, cmd := ui.handleSearchKey(keyMsg); used {
+			ui.noteInput()
+			return ui, cmd
+		}
+	}
+	if keyMsg, ok := msg.(tea.KeyMsg); ok && keyMsg.Type == tea.KeyCtrlF {
+		ui.startSearch()
+		ui.noteInput()
+		return ui, nil
+	}
+
+	// Tab completes the word being typed; any other key ends the completion
+	if keyMsg, ok := msg.(tea.KeyMsg); ok {
+		if keyMsg.Type == tea.KeyTab {
+			ui.setFocus(focusInput)
+			ui.completeInput()
+			ui.noteInput()
+			return ui, nil
+		}
+		ui.completion = nil
+	}
+
+	if keyMsg, ok := msg.(tea.KeyMsg); ok && ui.handleConversationKey(keyMsg) {
+		ui.noteInput()
+		return ui, nil
+	}
+
+	if keyMsg, ok := msg.(tea.KeyMsg); ok && ui.focus == focusMessages {
+		if used, cmd := ui.handleImageKey(keyMsg); used {
+			ui.noteInput()
+			return ui, cmd
+		}
+	}
+
+	if keyMsg, ok := msg.(tea.KeyMsg); ok && ui.handlePaneKey(keyMsg) {
+		ui.noteInput()
+		return ui, nil
+	}
+
+	// Up/Down on the first/last input line recall history instead of moving the cursor
+	if keyMsg, ok := msg.(tea.KeyMsg); ok && ui.recallHistory(keyMsg) {
+		ui.noteInput()
+		return ui, nil
+	}
+
 	ui.textarea, tiCmd = ui.textarea.Update(msg)
 	ui.viewport, vpCmd = ui.viewport.Update(msg)
+	ui.checkRead()
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		ui.noteInput()
+
 		switch msg.Type {
 		case tea.KeyCtrlC, tea.KeyEsc:
 			// Quit the application
@@ -171,10 +387,19 @@ func (ui *UI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case tea.KeyCtrlH:
 			// Toggle help
 			ui.showHelp = !ui.showHelp
-			ui.updateViewport()
+			ui.showViewport()
+			return ui, nil
+
+		case tea.KeyCtrlG:
+			// Show or hide the peer panel
+			ui.peersToggled = !ui.peersToggled
+			ui.layout()
 			return ui, nil
 
 		case tea.KeyEnter:
+			if msg.Alt {
+				break // Alt+Enter inserted a newline
+			}
 			// Send message
 			input := strings.TrimSpace(ui.textarea.Value())
 			if input != "" {
@@ -182,14 +407,89 @@ func (ui *UI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				if strings.HasPrefix(input, "/quit") || strings.HasPrefix(input, "/exit") {
 					return ui, tea.Quit
 				}
+				if input == "/theme" || strings.HasPrefix(input, "/theme ") {
+					ui.history.Add(input)
+					ui.themeCommand(strings.TrimSpace(strings.TrimPrefix(input, "/theme")))
+					ui.textarea.Reset()
+					return ui, nil
+				}
+				if input == "/notify" || strings.HasPrefix(input, "/notify ") {
+					ui.history.Add(input)
+					ui.notifyCommand(strings.TrimPrefix(input, "/notify"))
+					ui.textarea.Reset()
+					return ui, nil
+				}
+				if input == "/notifications" || strings.HasPrefix(input, "/notifications ") {
+					ui.history.Add(input)
+					ui.notificationsCommand(strings.TrimPrefix(input, "/notifications"))
+					ui.textarea.Reset()
+					return ui, nil
+				}
+				if input == "/dnd" || strings.HasPrefix(input, "/dnd ") {
+					ui.history.Add(input)
+					ui.dndCommand(strings.TrimPrefix(input, "/dnd"))
+					ui.textarea.Reset()
+					return ui, nil
+				}
+				if input == "/close" {
+					ui.history.Add(input)
+					ui.closeConversation()
+					ui.textarea.Reset()
+					return ui, nil
+				}
+				if input == "/save" || strings.HasPrefix(input, "/save ") {
+					ui.history.Add(input)
+					ui.saveConversation(strings.TrimSpace(strings.TrimPrefix(input, "/save")))
+					ui.textarea.Reset()
+					return ui, nil
+				}
+				if input == "/clear" {
+					ui.history.Add(input)
+					ui.clearMessages()
+					ui.textarea.Reset()
+					return ui, nil
+				}
+				if input == "/status" || strings.HasPrefix(input, "/status ") {
+					// An explicit status turns auto-away off until the user goes back online
+					presence, err := parsePresence(strings.TrimPrefix(input, "/status"))
+					if err == nil {
+						ui.manualStatus = presence.Status != StatusOnline
+						ui.autoAway = false
+					}
+				}
+
+				// Replying counts as having seen the mentions, and jumps back to the latest messages
+				ui.mentions = 0
+				ui.viewport.GotoBottom()
+				ui.checkRead()
+
+				if err := ui.history.Add(input); err != nil {
+					ui.messages = append(ui.messages, ChatMessage{
+						Sender:    "System",
+						Content:   fmt.Sprintf("❌ %v", err),
+						Timestamp: time.Now(),
+						IsSystem:  true,
+					})
+				}
 
-				// Send to CLI input channel
-				ui.node.CLIInput <- input
+				// Send to CLI input channel; text typed in a DM tab goes to that peer
+				if err := ui.node.SendInput(ui.addressInput(input)); err != nil {
+					ui.messages = append(ui.messages, ChatMessage{
+						Sender:    "System",
+						Content:   fmt.Sprintf("❌ %v", err),
+						Timestamp: time.Now(),
+						IsSystem:  true,
+					})
+					ui.updateViewport()
+				}
 				ui.textarea.Reset()
 			}
 			return ui, nil
 		}
 
+	case configReloadedMsg:
+		ui.handleConfigReloaded(msg)
+
 	case tea.WindowSizeMsg:
 		ui.width = msg.Width
 		ui.height = msg.Height
@@ -198,84 +498,515 @@ func (ui *UI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			ui.ready = true
 		}
 
-		// Update viewport size
-		headerHeight := 3
-		footerHeight := 5
-		statusBarHeight := 1
-		ui.viewport.Width = ui.width - 35 // Leave space for peer panel
-		ui.viewport.Height = ui.height - headerHeight - footerHeight - statusBarHeight
-		ui.textarea.SetWidth(ui.width - 4)
-
+		ui.layout()
 		ui.updateViewport()
 
 	case messageMsg:
 		// Add message to history
+		timestamp := msg.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		if len(msg.ReadIDs) > 0 {
+			ui.markSeen(msg.SenderID, msg.ReadIDs, timestamp)
+			return ui, ui.listenForMessages()
+		}
 		chatMsg := ChatMessage{
 			Sender:    msg.SenderID,
 			Content:   string(msg.Content),
-			Timestamp: time.Now(),
+			Timestamp: timestamp,
 			IsSystem:  msg.SenderID == "System",
+			Lamport:   msg.Lamport,
+			Mention:   msg.Mention,
+			Action:    msg.Action,
+			Direct:    msg.Direct,
+			ExpiresAt: msg.ExpiresAt,
+			ID:        msg.ID,
+			SenderKey: msg.SenderKey,
+		}
+		if msg.Attachment != "" && isPreviewable(msg.Attachment) {
+			chatMsg.Image = msg.Attachment
+		}
+		// History replayed from peers is highlighted but doesn't count as new, and neither do
+		// system notices such as peers joining or leaving, or messages an earlier TUI was shown
+		fromPeer := !chatMsg.IsSystem && msg.SenderID != ui.node.NodeID() && !msg.Backfill && !msg.Replayed
+		if !chatMsg.IsSystem && msg.SenderID != ui.node.NodeID() && msg.SenderKey != "" {
+			ui.noteFingerprint(msg.SenderID, msg.SenderKey)
+		}
+		// A notice about a file or voice message goes in that conversation and counts there like a
+		// message from the peer
+		peer := conversationPeer(Message(msg), ui.node.NodeID())
+		routed := chatMsg.IsSystem && msg.Conversation != ""
+		if routed {
+			peer = conversationTab(msg.Conversation)
+			if peer != "" && msg.ConversationKey != "" {
+				ui.noteFingerprint(peer, msg.ConversationKey)
+			}
+		}
+		// A conversation set to off doesn't count as unread either; do not disturb only keeps quiet
+		level := ui.notificationLevel(peer)
+		counted := (fromPeer || (routed && !msg.Replayed)) && level != levelOff
+		alert := fromPeer && levelWants(level, Message(msg)) && !ui.dndActive(time.Now())
+		if msg.Mention && !msg.Backfill && !msg.Replayed && level != levelOff {
+			ui.mentions++
+		}
+		if ui.mentionBell && alert {
+			fmt.Fprint(os.Stdout, "\a")
+		}
+		if alert && ui.blurred && ui.notifications.wants(Message(msg)) {
+			if err := ui.notifications.notify(time.Now(), ui.displayName(msg.SenderID), Message(msg)); err != nil {
+				ui.notifications.mode = notifyOff
+				ui.notice(fmt.Sprintf("❌ %v; desktop notifications are off", err))
+			}
 		}
-		ui.messages = append(ui.messages, chatMsg)
-		ui.updateViewport()
 
-		// Auto-scroll to bottom
-		ui.viewport.GotoBottom()
+		// Other system notices show wherever the user is. Direct and room messages go to their
+		// tab, opening it if needed, but only our own bring it to the front.
+		target := ui.active
+		if !chatMsg.IsSystem || routed {
+			target = ui.openConversation(peer)
+		}
+		if target != ui.active && msg.SenderID == ui.node.NodeID() && !msg.Replayed {
+			ui.switchConversation(target)
+		}
+		if fromPeer && msg.Direct && msg.ID != "" {
+			ui.conversations[target].unacked = append(ui.conversations[target].unacked, msg.ID)
+		}
+		cmds := []tea.Cmd{ui.listenForMessages()}
+		if ui.linkPreviews != nil && !chatMsg.IsSystem && msg.SenderID != ui.node.NodeID() {
+			cmds = append(cmds, ui.linkPreviews.Request(chatMsg.Content)...)
+		}
+		if target != ui.active {
+			ui.fileMessage(target, chatMsg, counted)
+			return ui, tea.Batch(cmds...)
+		}
+
+		// Only follow new messages if the user hasn't scrolled up to read older ones
+		follow := ui.viewport.AtBottom()
+		var pos int
+		ui.messages, pos = insertMessage(ui.messages, chatMsg)
+		var trimmed bool
+		ui.messages, trimmed = trimMessages(ui.messages, ui.maxMessages)
+
+		if counted && (!follow || ui.blurred) {
+			ui.unread++
+			if msg.Direct {
+				ui.unreadDirect++
+			}
+		}
+		if pos == len(ui.messages)-1 && !trimmed {
+			ui.appendToViewport(chatMsg)
+		} else {
+			ui.updateViewport()
+		}
+
+		if follow {
+			ui.viewport.GotoBottom()
+			ui.checkRead()
+		}
 
 		// Continue listening for messages
-		return ui, ui.listenForMessages()
+		return ui, tea.Batch(cmds...)
+
+	case linkPreviewMsg:
+		if msg.title != "" {
+			follow := ui.viewport.AtBottom()
+			ui.updateViewport()
+			if follow {
+				ui.viewport.GotoBottom()
+			}
+		}
+
+	case imageViewerDoneMsg:
+		if msg.err != nil {
+			ui.notice(fmt.Sprintf("❌ Can't show the image: %v", msg.err))
+		}
+
+	case backendDoneMsg:
+		// The node was shut down from elsewhere, e.g. over the control API
+		return ui, tea.Quit
+
+	case tea.FocusMsg:
+		ui.blurred = false
+		ui.checkRead()
+
+	case tea.BlurMsg:
+		ui.blurred = true
 
 	case tickMsg:
 		// Update peer list periodically
 		ui.updatePeerList()
+		ui.updateTransfers()
+		ui.playback = ui.node.Playback()
+		ui.traffic = ui.node.Traffic()
+		ui.rooms = ui.node.Rooms()
+		ui.locked = ui.node.Locked()
 		ui.lastUpdate = time.Time(msg)
+		ui.checkIdle()
+		ui.checkDND(time.Time(msg))
+		if ui.expireMessages(time.Time(msg)) {
+			ui.updateViewport()
+		}
 		return ui, ui.tickCmd()
 	}
 
 	return ui, tea.Batch(tiCmd, vpCmd)
 }
 
+// handlePaneKey handles keys that switch focus, scroll the message viewport or move through the
+// peer panel. Home/End scroll from any pane; with the messages focused, Up/Down and Ctrl+U/Ctrl+D
+// scroll too, and typing switches back to the input. It reports whether the key was used.
+func (ui *UI) handlePaneKey(msg tea.KeyMsg) bool {
+	switch msg.Type {
+	case tea.KeyShiftTab:
+		next := ui.focus
+		for {
+			next = (next + 1) % (focusTransfers + 1)
+			if ui.canFocus(next) {
+				break
+			}
+		}
+		ui.setFocus(next)
+		return true
+	case tea.KeyCtrlO:
+		if ui.offerCount() == 0 {
+			return false
+		}
+		ui.setFocus(focusTransfers)
+		return true
+	case tea.KeyHome:
+		ui.viewport.GotoTop()
+		return true
+	case tea.KeyEnd:
+		ui.viewport.GotoBottom()
+		ui.checkRead()
+		return true
+	}
+
+	switch ui.focus {
+	case focusPeers:
+		return ui.selectPeer(msg)
+	case focusTransfers:
+		return ui.selectOffer(msg)
+	case focusMessages:
+	default:
+		return false
+	}
+
+	switch msg.Type {
+	case tea.KeyUp:
+		ui.viewport.ScrollUp(1)
+	case tea.KeyDown:
+		ui.viewport.ScrollDown(1)
+	case tea.KeyCtrlU:
+		ui.viewport.HalfPageUp()
+	case tea.KeyCtrlD:
+		ui.viewport.HalfPageDown()
+	case tea.KeyEsc:
+		ui.setFocus(focusInput)
+	case tea.KeyRunes, tea.KeySpace, tea.KeyEnter, tea.KeyBackspace:
+		// Start typing without having to switch back first
+		ui.setFocus(focusInput)
+		return false
+	default:
+		return false
+	}
+
+	ui.checkRead()
+	return true
+}
+
+// selectPeer moves through the peer panel with Up/Down. Enter opens the conversation with the
+// selected peer.
+func (ui *UI) selectPeer(msg tea.KeyMsg) bool {
+	switch msg.Type {
+	case tea.KeyUp:
+		if ui.peerCursor > 0 {
+			ui.peerCursor--
+		}
+	case tea.KeyDown:
+		if ui.peerCursor < len(ui.peers)-1 {
+			ui.peerCursor++
+		}
+	case tea.KeyEnter:
+		if ui.peerCursor < len(ui.peers) {
+			ui.switchConversation(ui.openConversation(ui.peerNodeID(ui.peers[ui.peerCursor])))
+		}
+		ui.setFocus(focusInput)
+	case tea.KeyEsc:
+		ui.setFocus(focusInput)
+	case tea.KeyRunes, tea.KeySpace, tea.KeyBackspace:
+		ui.setFocus(focusInput)
+		return false
+	default:
+		return false
+	}
+	return true
+}
+
+// checkRead clears the unread counters once the latest messages are on screen in a focused
+// terminal, and reports the direct messages shown for read receipts
+func (ui *UI) checkRead() {
+	if ui.viewport.AtBottom() && !ui.blurred {
+		ui.unread = 0
+		ui.unreadDirect = 0
+		ui.acknowledgeRead()
+	}
+}
+
+// canFocus reports whether a pane can take focus: hidden panels and an empty offer list can't
+func (ui *UI) canFocus(focus uiFocus) bool {
+	switch focus {
+	case focusPeers:
+		return ui.peerWidth > 0
+	case focusTransfers:
+		return ui.offerCount() > 0
+	default:
+		return true
+	}
+}
+
+// setFocus gives keys to a pane; the input only takes them while it has focus
+func (ui *UI) setFocus(focus uiFocus) {
+	ui.focus = focus
+	if focus == focusInput {
+		ui.textarea.Focus()
+	} else {
+		ui.textarea.Blur()
+	}
+}
+
+// recallHistory handles Up on the first input line and Down on the last one by swapping in an
+// older or newer input. It reports whether the key was used.
+func (ui *UI) recallHistory(msg tea.KeyMsg) bool {
+	var value string
+	var ok bool
+	switch msg.Type {
+	case tea.KeyUp:
+		if ui.textarea.Line() != 0 {
+			return false
+		}
+		value, ok = ui.history.Prev(ui.textarea.Value())
+	case tea.KeyDown:
+		if ui.textarea.Line() != ui.textarea.LineCount()-1 || !ui.history.Browsing() {
+			return false
+		}
+		value, ok = ui.history.Next()
+	default:
+		return false
+	}
+
+	if ok {
+		ui.textarea.SetValue(value)
+		ui.textarea.CursorEnd()
+	}
+	return true
+}
+
+// insertMessage adds a message to a conversation's backlog, keeping stamped messages in
+// (lamport, sender) order so every node shows a conversation the same way. Unstamped messages are
+// appended and act as barriers: a late message is never moved above a system notice that was
+// shown before it. It returns the backlog and the message's position.
+func insertMessage(messages []ChatMessage, msg ChatMessage) ([]ChatMessage, int) {
+	pos := len(messages)
+	if msg.Lamport > 0 {
+		for pos > 0 {
+			prev := messages[pos-1]
+			if prev.Lamport == 0 || !messageBefore(msg.Lamport, msg.Sender, prev.Lamport, prev.Sender) {
+				break
+			}
+			pos--
+		}
+	}
+
+	messages = append(messages, ChatMessage{})
+	copy(messages[pos+1:], messages[pos:])
+	messages[pos] = msg
+	return messages, pos
+}
+
+// trimMessages drops the oldest messages once there are more than limit (0 keeps all). It drops a
+// tenth extra so the view is rebuilt once per batch rather than on every message. It reports
+// whether anything was dropped.
+func trimMessages(messages []ChatMessage, limit int) ([]ChatMessage, bool) {
+	if limit <= 0 || len(messages) <= limit {
+		return messages, false
+	}
+	drop := len(messages) - limit + limit/10
+	// Copy so the dropped messages can be freed
+	return append([]ChatMessage(nil), messages[drop:]...), true
+}
+
+// clearMessages empties the view; the node's message log is untouched
+func (ui *UI) clearMessages() {
+	ui.messages = nil
+	ui.updateViewport()
+	ui.checkRead()
+}
+
+// expireMessages drops ephemeral messages that have expired from every conversation. It reports
+// whether the viewport needs redrawing: something shown was removed, or one of our own countdowns
+// changed.
+func (ui *UI) expireMessages(now time.Time) bool {
+	for i, conv := range ui.conversations {
+		if i != ui.active {
+			conv.messages, _ = dropExpired(conv.messages, now)
+		}
+	}
+	var changed bool
+	ui.messages, changed = dropExpired(ui.messages, now)
+	return changed
+}
+
+// dropExpired drops expired ephemeral messages from a backlog, reporting whether it holds any
+func dropExpired(messages []ChatMessage, now time.Time) ([]ChatMessage, bool) {
+	changed := false
+	kept := messages[:0]
+	for _, msg := range messages {
+		if msg.ExpiresAt.IsZero() {
+			kept = append(kept, msg)
+			continue
+		}
+		changed = true
+		if now.Before(msg.ExpiresAt) {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, changed
+}
+
+// noteInput records user activity, returning from auto-away
+func (ui *UI) noteInput() {
+	ui.lastInput = time.Now()
+	if ui.autoAway {
+		ui.autoAway = false
+		ui.node.SendInput("/status " + StatusOnline)
+	}
+}
+
+// checkIdle switches to "away" after awayAfter without input, unless the user picked a status
+func (ui *UI) checkIdle() {
+	if ui.awayAfter <= 0 || ui.autoAway || ui.manualStatus {
+		return
+	}
+	if time.Since(ui.lastInput) >= ui.awayAfter {
+		ui.autoAway = true
+		ui.node.SendInput("/status " + StatusAway)
+	}
+}
+
 // updatePeerList updates the list of connected peers
 func (ui *UI) updatePeerList() {
-	ui.node.peersMutex.RLock()
-	defer ui.node.peersMutex.RUnlock()
+	peers := ui.node.PeerIDs()
+	info := make(map[string]PeerInfo, len(peers))
+	for _, peer := range peers {
+		info[peer] = ui.node.PeerInfo(peer)
+	}
+
+	// Recently active peers first, then by name
+	sort.Slice(peers, func(i, j int) bool {
+		a, b := info[peers[i]], info[peers[j]]
+		if !a.LastActive.Equal(b.LastActive) {
+			return a.LastActive.After(b.LastActive)
+		}
+		return peerName(peers[i], a) < peerName(peers[j], b)
+	})
+
+	// Keep the same peer selected as the order changes
+	if ui.peerCursor < len(ui.peers) {
+		selected := ui.peers[ui.peerCursor]
+		for i, peer := range peers {
+			if peer == selected {
+				ui.peerCursor = i
+			}
+		}
+	}
+	if ui.peerCursor >= len(peers) {
+		ui.peerCursor = max(len(peers)-1, 0)
+	}
+
+	ui.peers = peers
+	ui.peerInfo = info
+	for _, peerInfo := range info {
+		if peerInfo.Fingerprint != "" {
+			ui.noteFingerprint(peerInfo.NodeID, peerInfo.Fingerprint)
+		}
+	}
+	ui.followKeys()
+}
 
-	ui.peers = make([]string, 0, len(ui.node.Peers))
-	for peerID := range ui.node.Peers {
-		ui.peers = append(ui.peers, peerID)
+// peerName is how a peer is shown: its nick, or its node ID or address
+func peerName(peer string, info PeerInfo) string {
+	if info.Nick != "" {
+		return info.Nick
+	}
+	if info.NodeID != "" {
+		return info.NodeID
 	}
+	return peer
 }
 
-// updateViewport updates the viewport content with all messages
+// updateViewport re-renders every message, for changes other than a message arriving at the end
 func (ui *UI) updateViewport() {
-	var content strings.Builder
+	if ui.search != nil {
+		ui.refreshMatches()
+	}
+	ui.rendered.Reset()
+	ui.renderedLines = 0
+	ui.previews = nil
+	for i, msg := range ui.messages {
+		ui.writeMessage(msg, ui.isCurrentMatch(i))
+	}
+	ui.showViewport()
+}
+
+// appendToViewport renders just the newest message onto the existing content
+func (ui *UI) appendToViewport(msg ChatMessage) {
+	if s := ui.search; s != nil && s.pattern != nil && s.pattern.MatchString(msg.Content) {
+		s.matches = append(s.matches, len(ui.messages)-1)
+	}
+	ui.writeMessage(msg, false)
+	ui.showViewport()
+}
 
+// showViewport shows the rendered messages, or the help screen in their place
+func (ui *UI) showViewport() {
 	if ui.showHelp {
-		content.WriteString(ui.renderHelp())
-	} else {
-		for _, msg := range ui.messages {
-			content.WriteString(ui.renderMessage(msg))
-			content.WriteString("\n")
-		}
+		ui.viewport.SetContent(ui.renderHelp())
+		return
 	}
+	ui.viewport.SetContent(ui.fillPreviews(ui.rendered.String()))
+}
 
-	ui.viewport.SetContent(content.String())
+// renderMessage renders a single message, with any search matches highlighted, the titles of its
+// links and room for its image preview. current marks the selected search match.
+func (ui *UI) renderMessage(msg ChatMessage, current bool) string {
+	text := ui.renderText(msg, current)
+	if !msg.IsSystem {
+		text += ui.renderLinkPreviews(msg.Content)
+	}
+	if !msg.Seen.IsZero() {
+		// Under the text, lined up with it rather than the timestamp
+		text += "\n" + strings.Repeat(" ", len("15:04:05 ")) + timestampStyle.Render("seen "+msg.Seen.Format("15:04"))
+	}
+	if msg.Image != "" {
+		return text + "\n" + previewPlaceholder(msg.Image)
+	}
+	return text
 }
 
-// renderMessage renders a single message
-func (ui *UI) renderMessage(msg ChatMessage) string {
+// renderText renders a message's sender and text
+func (ui *UI) renderText(msg ChatMessage, current bool) string {
 	timestamp := timestampStyle.Render(msg.Timestamp.Format("15:04:05"))
 
 	if msg.IsSystem {
-		return fmt.Sprintf("%s %s",
-			timestamp,
-			systemMessageStyle.Render(msg.Content))
+		return ui.renderContent(timestamp+" ", msg.Content, systemMessageStyle.Render, current, false, "")
 	}
 
 	var senderStyle lipgloss.Style
 	senderPrefix := ""
 
-	if msg.Sender == ui.node.ID {
+	if msg.Sender == ui.node.NodeID() {
 		senderStyle = userMessageStyle
 		senderPrefix = "You"
 	} else {
@@ -283,51 +1014,142 @@ func (ui *UI) renderMessage(msg ChatMessage) string {
 		senderPrefix = msg.Sender
 	}
 
-	sender := senderStyle.Render(fmt.Sprintf("[%s]", senderPrefix))
-	return fmt.Sprintf("%s %s %s", timestamp, sender, msg.Content)
+	// Our own ephemeral messages show how long they have left
+	countdown := ""
+	if msg.Sender == ui.node.NodeID() && !msg.ExpiresAt.IsZero() {
+		remaining := time.Until(msg.ExpiresAt).Round(time.Second)
+		countdown = " " + timestampStyle.Render(fmt.Sprintf("⏳ %s", remaining))
+	}
+
+	if msg.Action {
+		actionStyle := senderStyle.Italic(true)
+		prefix := fmt.Sprintf("%s %s", timestamp, actionStyle.Render(fmt.Sprintf("* %s ", senderPrefix)))
+		return ui.renderContent(prefix, msg.Content, actionStyle.Render, current, true, countdown)
+	}
+
+	if msg.Direct {
+		senderPrefix += " ✉" // Not broadcast: only we (or the one peer we sent it to) got it
+	}
+	prefix := fmt.Sprintf("%s %s ", timestamp, senderStyle.Render(fmt.Sprintf("[%s]", senderPrefix)))
+	if msg.Mention {
+		prefix += mentionMessageStyle.Render("» ")
+		return ui.renderContent(prefix, msg.Content, mentionMessageStyle.Render, current, true, countdown)
+	}
+	return ui.renderContent(prefix, msg.Content, nil, current, true, countdown)
 }
 
 // renderHelp renders the help screen
 func (ui *UI) renderHelp() string {
-	help := `
+	return `
 ╔══════════════════════════════════════════════════════════════════╗
 ║                        P2P CHAT - HELP                           ║
 ╚══════════════════════════════════════════════════════════════════╝
 
-🔗 CONNECTION COMMANDS:
-  /connect <addr>     Connect to a peer (e.g., /connect 127.0.0.1:8080)
-  /peers              List all connected peers
-  /discovered         List discovered peers via multicast
-
-📁 FILE SHARING:
-  /sendfile <peer> <path>  Send a file to a specific peer
-                           Example: /sendfile 127.0.0.1:8080 ./file.txt
-
-🎙️  VOICE MESSAGES:
-  /voice <seconds>    Record and send voice message (1-60 seconds)
-                      Example: /voice 10
-
-🔒 ENCRYPTION:
+` + renderCommandHelp(nil) + `🔒 ENCRYPTION:
   All messages are automatically encrypted with RSA 2048-bit encryption
   Public keys are exchanged automatically when peers connect
 
 💬 MESSAGING:
   Just type and press Enter to send a message to all connected peers
+  Presence turns to away after idle time (-away-after)
 
 ⌨️  KEYBOARD SHORTCUTS:
   Ctrl+H              Toggle this help screen
   Ctrl+C / Esc        Quit application
   Enter               Send message
+  Alt+Enter / Ctrl+J  Start a new line in the message
+  Tab                 Complete commands, peers and file paths (repeat to cycle)
+  ↑ / ↓               Recall previous inputs
+  PgUp / PgDn         Scroll messages
+  Home / End          Jump to the oldest / latest message
+  Ctrl+F              Search messages (n/N: older/newer match, Ctrl+R: regex,
+                      Esc: back to where you were)
+  Shift+Tab           Switch between the input, the messages and the peers
+                      (messages: ↑/↓, Ctrl+U/Ctrl+D scroll; Esc or typing returns;
+                      peers: Enter opens a direct conversation;
+                      messages: v shows the image on screen full size, o opens it)
+  Ctrl+G              Show or hide the peer panel
+  Ctrl+O              Answer a file offer (a: accept, r: reject, ↑/↓: choose)
+  Ctrl+← / Ctrl+→     Switch between the broadcast channel and direct messages
+  Alt+1..9            Go to a conversation tab by position (/close closes one)
 
 📊 STATUS:
-  The right panel shows all connected peers in real-time
+  The right panel shows all connected peers in real-time (hidden below 80 columns)
   System messages appear in green italics
   Your messages appear in purple
   Peer messages appear in blue
 
 Press Ctrl+H to close this help screen
 `
-	return help
+}
+
+// layout sizes the panels for the terminal. The peer panel takes a quarter of the width within
+// limits, and the message viewport gets whatever height the other components leave.
+func (ui *UI) layout() {
+	wide := ui.width >= peerPanelMinTerminal
+	if wide != ui.wide {
+		ui.wide = wide
+		ui.peersToggled = false // Crossing the threshold restores the default
+	}
+
+	// Outer widths: each panel adds a 2-cell border to its style width
+	ui.peerWidth = 0
+	if wide != ui.peersToggled {
+		width := min(max(ui.width/4, minPeerPanelWidth), maxPeerPanelWidth)
+		if ui.width-width-4 >= minMessageWidth {
+			ui.peerWidth = width
+		}
+	}
+	ui.messageWidth = ui.width - 2
+	if ui.peerWidth > 0 {
+		ui.messageWidth = ui.width - ui.peerWidth - 4
+	}
+
+	ui.textarea.SetWidth(max(ui.width-4, 1))
+	if ui.search != nil {
+		ui.search.prompt.Width = max(ui.width-10, 1)
+	}
+	// Messages are wrapped to the viewport, so a new width means rendering them again
+	width := max(ui.messageWidth-2, 1)
+	rewrap := width != ui.viewport.Width
+	ui.viewport.Width = width
+
+	// Everything but the viewport: header, transfers, status bar, input, and the panel border and title
+	chrome := lipgloss.Height(ui.renderHeader()) + ui.transferPanelHeight() + 1 + lipgloss.Height(ui.renderInput(inputStyle)) + 3
+	ui.viewport.Height = max(ui.height-chrome, 1)
+	if ui.peerWidth == 0 && ui.focus == focusPeers {
+		ui.setFocus(focusInput)
+	}
+	if rewrap {
+		ui.updateViewport()
+	} else {
+		ui.showViewport()
+	}
+}
+
+// renderHeader renders the title bar, shortened to fit narrow terminals. A room's tab shows the
+// room and its topic instead.
+func (ui *UI) renderHeader() string {
+	title := "🚀 P2P Chat - Encrypted Peer-to-Peer Messaging"
+	room := ui.conversations[ui.active].peer
+	for _, info := range ui.rooms {
+		if info.Name == room && info.Topic != "" {
+			title = truncateText(fmt.Sprintf("🚪 %s: %s", room, info.Topic), max(ui.width-headerStyle.GetHorizontalFrameSize()-1, 2))
+		}
+	}
+	if lipgloss.Width(title)+headerStyle.GetHorizontalFrameSize() > ui.width {
+		title = "🚀 P2P Chat"
+	}
+	return headerStyle.MaxWidth(ui.width).Render(title)
+}
+
+// renderInput renders the input box across the full width
+func (ui *UI) renderInput(style lipgloss.Style) string {
+	if ui.search != nil {
+		return ui.renderSearchPrompt(style)
+	}
+	return style.Width(ui.width - 2).Render(
+		fmt.Sprintf("💬 Input (Ctrl+H for help)\n%s", ui.textarea.View()))
 }
 
 // View renders the TUI
@@ -335,91 +1157,291 @@ func (ui *UI) View() string {
 	if !ui.ready {
 		return "\n  Initializing P2P Chat TUI...\n"
 	}
+	if ui.width < minTerminalWidth || ui.height < minTerminalHeight {
+		return lipgloss.NewStyle().MaxWidth(ui.width).Render(
+			fmt.Sprintf("Terminal too small (%dx%d)\nNeed at least %dx%d", ui.width, ui.height, minTerminalWidth, minTerminalHeight))
+	}
 
 	// Header
-	header := headerStyle.Render("🚀 P2P Chat - Encrypted Peer-to-Peer Messaging")
+	header := ui.renderHeader()
 
-	// Message panel (left side)
-	messagePanel := messagePanelStyle.Width(ui.width - 35).Height(ui.viewport.Height + 2).Render(
-		fmt.Sprintf("📨 Messages\n%s", ui.viewport.View()))
+	// The focused pane gets the highlighted border
+	messageStyle, inputBoxStyle := messagePanelStyle, inputStyle
+	title := ui.renderTabs() + ui.renderNotificationLevel()
+	if ui.focus != focusInput {
+		inputBoxStyle = messagePanelStyle
+	}
+	if ui.focus == focusMessages {
+		messageStyle = focusStyle(messagePanelStyle)
+		title += timestampStyle.Render("  (↑/↓ scroll, Shift+Tab to type)")
+		if _, found := ui.visibleImage(); found {
+			title += timestampStyle.Render("  v: view image · o: open it")
+		}
+	}
+	if ui.unread > 0 && !ui.viewport.AtBottom() {
+		title += "  " + mentionMessageStyle.Render(fmt.Sprintf("%d new messages ↓", ui.unread))
+	}
 
-	// Peer panel (right side)
-	peerPanel := ui.renderPeerPanel()
+	// Message panel (left side); a title too long for the panel is cut rather than wrapped
+	title = lipgloss.NewStyle().MaxWidth(ui.viewport.Width).Render(title)
+	messagePanel := messageStyle.Width(ui.messageWidth).Height(ui.viewport.Height + 1).Render(
+		fmt.Sprintf("%s\n%s", title, ui.viewport.View()))
 
-	// Combine panels side by side
-	mainContent := lipgloss.JoinHorizontal(lipgloss.Top, messagePanel, peerPanel)
+	// Peer panel (right side), unless the terminal is too narrow or it was toggled off
+	mainContent := messagePanel
+	if ui.peerWidth > 0 {
+		mainContent = lipgloss.JoinHorizontal(lipgloss.Top, messagePanel, ui.renderPeerPanel())
+	}
 
-	// Status bar
-	statusBar := ui.renderStatusBar()
+	// File offers and transfers under way, between the messages and the status bar
+	sections := []string{header, mainContent}
+	if len(ui.transfers) > 0 {
+		sections = append(sections, ui.renderTransfers())
+	}
 
-	// Input area
-	inputArea := inputStyle.Width(ui.width - 4).Render(
-		fmt.Sprintf("💬 Input (Ctrl+H for help)\n%s", ui.textarea.View()))
+	// Status bar and input area
+	sections = append(sections, ui.renderStatusBar(), ui.renderInput(inputBoxStyle))
 
 	// Combine all sections
-	return lipgloss.JoinVertical(
-		lipgloss.Left,
-		header,
-		mainContent,
-		statusBar,
-		inputArea,
-	)
+	return lipgloss.JoinVertical(lipgloss.Left, sections...)
 }
 
-// renderPeerPanel renders the peer list panel
+// renderPeerPanel renders the peer list panel, as many peers as fit the panel height
 func (ui *UI) renderPeerPanel() string {
 	var content strings.Builder
 
+	panelHeight := ui.viewport.Height + 1 // Same as the message panel: title plus viewport
+
 	content.WriteString("👥 Connected Peers\n")
-	content.WriteString(strings.Repeat("─", 28) + "\n")
+	content.WriteString(strings.Repeat("─", ui.peerWidth-2) + "\n")
 
 	if len(ui.peers) == 0 {
-		content.WriteString(messagePanelStyle.Render("  No peers connected\n"))
-		content.WriteString("\n")
-		content.WriteString(messagePanelStyle.Render("  Use /connect <addr>\n"))
-		content.WriteString(messagePanelStyle.Render("  to add peers\n"))
+		content.WriteString(timestampStyle.Render("  No peers connected") + "\n\n")
+		content.WriteString(timestampStyle.Render("  Use /connect <addr>") + "\n")
+		content.WriteString(timestampStyle.Render("  to add peers") + "\n")
 	} else {
-		for i, peer := range ui.peers {
-			peerStatus := peerConnectedStyle.Render("●")
-			content.WriteString(fmt.Sprintf("  %s %s\n", peerStatus, peer))
-			if i >= 15 { // Limit display to 15 peers
-				remaining := len(ui.peers) - 15
-				content.WriteString(fmt.Sprintf("  ... and %d more\n", remaining))
-				break
-			}
+		content.WriteString(ui.peerRows(panelHeight - 2)) // Below the title and rule
+	}
+
+	style := peerPanelStyle
+	if ui.focus == focusPeers {
+		style = focusStyle(style)
+	}
+	return style.Width(ui.peerWidth).Height(panelHeight).Render(strings.TrimSuffix(content.String(), "\n"))
+}
+
+// peerRows renders peers into at most height lines, scrolled so the selected peer is shown.
+// Lines saying how many peers are above or below stand in for the ones that don't fit.
+func (ui *UI) peerRows(height int) string {
+	if ui.peerCursor < ui.peerOffset {
+		ui.peerOffset = ui.peerCursor
+	}
+	for {
+		rows, last := ui.renderPeerRows(ui.peerOffset, height)
+		if ui.peerCursor <= last || ui.peerOffset >= ui.peerCursor {
+			return rows
 		}
+		ui.peerOffset++
 	}
+}
 
-	// Fill remaining space
-	panelHeight := ui.viewport.Height + 2
-	currentLines := len(ui.peers) + 2
-	if len(ui.peers) == 0 {
-		currentLines = 6
+// renderPeerRows renders peers from offset on, returning the rows and the index of the last peer shown
+func (ui *UI) renderPeerRows(offset, height int) (string, int) {
+	var rows strings.Builder
+	used := 0
+	if offset > 0 {
+		rows.WriteString(timestampStyle.Render(fmt.Sprintf("  ↑ %d more", offset)) + "\n")
+		used++
 	}
-	for i := currentLines; i < panelHeight; i++ {
-		content.WriteString("\n")
+
+	last := offset - 1
+	for i := offset; i < len(ui.peers); i++ {
+		peer := ui.peers[i]
+		info := ui.peerInfo[peer]
+
+		need := 1
+		if info.Presence.Text != "" {
+			need++
+		}
+		reserve := 0
+		if i < len(ui.peers)-1 {
+			reserve = 1 // Room for the "more" line
+		}
+		if used+need+reserve > height && i > offset {
+			rows.WriteString(fmt.Sprintf("  ... and %d more\n", len(ui.peers)-i))
+			break
+		}
+
+		// The name gets what the dot, key icon, latency, mute marker and unread count leave
+		badge := ""
+		if unread := ui.peerUnread(peer); unread > 0 {
+			badge = " " + mentionMessageStyle.Render(fmt.Sprintf("(%d)", unread))
+		}
+		nameWidth := max(ui.peerWidth-18-lipgloss.Width(badge), 4)
+		row := fmt.Sprintf("%s %s", presenceStyle(info.Presence.Status).Render("●"), truncateText(peerName(peer, info), nameWidth)+badge)
+		row += " " + keyIcon(info.Key)
+		if info.Latency > 0 {
+			row += " " + timestampStyle.Render(formatLatency(info.Latency))
+		}
+		if info.Muted {
+			row += " 🔇"
+		}
+		if ui.focus == focusPeers && i == ui.peerCursor {
+			row = lipgloss.NewStyle().Reverse(true).Render(row)
+		}
+		rows.WriteString("  " + row + "\n")
+		if info.Presence.Text != "" {
+			rows.WriteString(timestampStyle.Render(fmt.Sprintf("    %s", truncateText(info.Presence.Text, max(ui.peerWidth-6, 4)))) + "\n")
+		}
+		used += need
+		last = i
 	}
+	return rows.String(), last
+}
 
-	return peerPanelStyle.Width(30).Height(panelHeight).Render(content.String())
+// keyIcon shows how far key exchange with a peer has got
+func keyIcon(status string) string {
+	switch status {
+	case KeyVerified:
+		return "🔒"
+	case KeyExchanged:
+		return "🔑"
+	default:
+		return "🔓"
+	}
+}
+
+// formatLatency formats a round trip for the peer panel
+func formatLatency(latency time.Duration) string {
+	switch {
+	case latency < time.Millisecond:
+		return "<1ms"
+	case latency < time.Second:
+		return fmt.Sprintf("%dms", latency.Milliseconds())
+	default:
+		return fmt.Sprintf("%.1fs", latency.Seconds())
+	}
+}
+
+// presenceStyle picks the peer dot color for a presence state
+func presenceStyle(status string) lipgloss.Style {
+	switch status {
+	case StatusOnline:
+		return peerConnectedStyle
+	case StatusAway:
+		return lipgloss.NewStyle().Foreground(warningColor)
+	case StatusBusy:
+		return peerDisconnectedStyle
+	default:
+		return lipgloss.NewStyle().Foreground(mutedColor)
+	}
+}
+
+// truncateText shortens text to at most max runes, marking the cut with an ellipsis
+func truncateText(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-1]) + "…"
 }
 
 // renderStatusBar renders the bottom status bar
 func (ui *UI) renderStatusBar() string {
-	nodeInfo := fmt.Sprintf("Node: %s", ui.node.ID)
+	nodeInfo := fmt.Sprintf("Node: %s", ui.node.NodeID())
 	peerCount := fmt.Sprintf("Peers: %d", len(ui.peers))
 	encryption := "🔒 Encrypted"
 	timestamp := ui.lastUpdate.Format("15:04:05")
 
 	leftSection := nodeInfo
-	rightSection := fmt.Sprintf("%s | %s | %s", peerCount, encryption, timestamp)
+	if ui.profile != "" {
+		leftSection = activeTabStyle.Render("👤 "+ui.profile) + " | " + nodeInfo
+	}
+	rate := fmt.Sprintf("↓%s ↑%s", formatRate(ui.traffic.InRate), formatRate(ui.traffic.OutRate))
+	rightSection := fmt.Sprintf("%s | %s | %s | %s", rate, peerCount, encryption, timestamp)
+	if ui.playback.Playing {
+		rightSection = renderPlayback(ui.playback) + " | " + rightSection
+	}
+	if ui.locked {
+		rightSection = mentionMessageStyle.Render("🔐 Locked") + " | " + rightSection
+	}
+	if ui.mentions > 0 {
+		rightSection = mentionMessageStyle.Render(fmt.Sprintf("🔔 Mentions: %d", ui.mentions)) + " | " + rightSection
+	}
+	if search := ui.renderSearchStatus(); search != "" {
+		rightSection = search + " | " + rightSection
+	}
+	if ui.unread > 0 {
+		unread := fmt.Sprintf("✉ Unread: %d", ui.unread)
+		if ui.unreadDirect > 0 {
+			unread += fmt.Sprintf(" (%d direct)", ui.unreadDirect)
+		}
+		rightSection = unread + " | " + rightSection
+	}
 
 	// Calculate spacing
-	totalWidth := ui.width - 4
+	totalWidth := ui.width - statusBarStyle.GetHorizontalFrameSize()
+	// Completion candidates replace the node ID while Tab is cycling through them
+	if completions := ui.renderCompletions(); completions != "" {
+		if room := totalWidth - lipgloss.Width(rightSection) - 1; room > 1 {
+			leftSection = truncateText(completions, room)
+		}
+	}
 	spacing := totalWidth - lipgloss.Width(leftSection) - lipgloss.Width(rightSection)
 	if spacing < 0 {
 		spacing = 0
 	}
 
-	statusText := leftSection + strings.Repeat(" ", spacing) + rightSection
-	return statusBarStyle.Width(ui.width - 4).Render(statusText)
+	// Cut rather than wrap when the terminal is too narrow for both sections
+	statusText := lipgloss.NewStyle().MaxWidth(totalWidth).Render(leftSection + strings.Repeat(" ", spacing) + rightSection)
+	return statusBarStyle.Width(ui.width).Render(statusText)
+}
+
+// renderPlayback shows the volume and speed of the voice message being played
+func renderPlayback(info PlaybackInfo) string {
+	status := fmt.Sprintf("🔊 %d%%", info.Volume)
+	if info.Muted {
+		status = "🔇 Muted"
+	}
+	if info.Speed != 1 {
+		status += fmt.Sprintf(" %gx", info.Speed)
+	}
+	return status
+}
+
+// NodeID returns the node's ID (chatBackend)
+func (n *Node) NodeID() string {
+	return n.ID
+}
+
+// UIMessages subscribes to the node's UI messages, replacing the previous subscriber (chatBackend)
+func (n *Node) UIMessages() <-chan Message {
+	return n.uiQueue.Subscribe()
+}
+
+// PeerIDs returns the IDs of all connected peers (chatBackend)
+func (n *Node) PeerIDs() []string {
+	n.peersMutex.RLock()
+	defer n.peersMutex.RUnlock()
+
+	peers := make([]string, 0, len(n.Peers))
+	for _, peer := range n.Peers {
+		peers = append(peers, peer.ID)
+	}
+	return peers
+}
+
+// SendInput queues a line of user input (chatBackend)
+func (n *Node) SendInput(input string) error {
+	return n.submitInput(input)
+}
+
+// Transfers returns the node's file transfers (chatBackend)
+func (en *EnhancedNode) Transfers() []TransferInfo {
+	return en.fileManager.ListTransfers()
+}
+
+// Done returns a channel closed when the node shuts down (chatBackend)
+func (n *Node) Done() <-chan struct{} {
+	return n.Shutdown
 }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// fakeBackend is a chatBackend without a node behind it, noting what the TUI sends
+type fakeBackend struct {
+	mutex     sync.Mutex
+	id        string
+	peers     []string
+	info      map[string]PeerInfo
+	transfers []TransferInfo
+	sent      []string
+	read      []string // "peer: id id" for each MarkRead
+	done      chan struct{}
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{id: "127.0.0.1:1", info: make(map[string]PeerInfo), done: make(chan struct{})}
+}
+
+func (b *fakeBackend) NodeID() string { return b.id }
+
+func (b *fakeBackend) UIMessages() <-chan Message { return make(chan Message) }
+
+func (b *fakeBackend) MarkRead(peerID string, ids []string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.read = append(b.read, peerID+": "+strings.Join(ids, " "))
+	return nil
+}
+
+func (b *fakeBackend) Playback() PlaybackInfo { return PlaybackInfo{} }
+
+func (b *fakeBackend) Traffic() TrafficInfo { return TrafficInfo{} }
+
+func (b *fakeBackend) Rooms() []RoomInfo { return nil }
+
+func (b *fakeBackend) Locked() bool { return false }
+
+func (b *fakeBackend) Done() <-chan struct{} { return b.done }
+
+func (b *fakeBackend) PeerIDs() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.peers...)
+}
+
+func (b *fakeBackend) Transfers() []TransferInfo {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]TransferInfo(nil), b.transfers...)
+}
+
+func (b *fakeBackend) PeerInfo(peerID string) PeerInfo {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.info[peerID]
+}
+
+func (b *fakeBackend) SendInput(input string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.sent = append(b.sent, input)
+	return nil
+}
+
+// newTestUI returns a TUI on a fake backend, laid out for a terminal of the given size
+func newTestUI(t testing.TB, width, height int) (*UI, *fakeBackend) {
+	t.Helper()
+	backend := newFakeBackend()
+	ui := NewUI(backend)
+	ui.Update(tea.WindowSizeMsg{Width: width, Height: height})
+	return ui, backend
+}
+
+// receive has the TUI show a message as if the node had sent it
+func receive(ui *UI, msg Message) {
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	}
+	ui.Update(messageMsg(msg))
+}
+
+// fillScrollback gives the TUI a full scrollback of broadcast messages with a mix of links,
+// formatting and wrapping, as a busy channel would leave it
+func fillScrollback(ui *UI) {
+	for i := range ui.maxMessages {
+		text := fmt.Sprintf("message %d with **bold**, `code` and a link to https://example.com/%d", i, i)
+		if i%7 == 0 {
+			text += " and enough words after it to wrap onto a second line of the message panel at this width"
+		}
+		receive(ui, Message{SenderID: fmt.Sprintf("127.0.0.1:%d", 2+i%5), Content: []byte(text)})
+	}
+}
+
+// withPeers has the backend report count connected peers and the TUI pick them up
+func withPeers(ui *UI, backend *fakeBackend, count int) {
+	backend.mutex.Lock()
+	backend.peers = backend.peers[:0]
+	for i := range count {
+		backend.peers = append(backend.peers, fmt.Sprintf("127.0.0.1:%d", 100+i))
+	}
+	backend.mutex.Unlock()
+	ui.updatePeerList()
+}
+
+// viewSize is the width of the widest line of a rendered view, and its height
+func viewSize(view string) (int, int) {
+	width := 0
+	for _, line := range strings.Split(view, "\n") {
+		width = max(width, lipgloss.Width(line))
+	}
+	return width, lipgloss.Height(view)
+}
+
+// TestViewFitsTerminal renders the TUI at sizes from too small to very large, with no peers, a
+// few and more than fit, and the peer panel toggled both ways: the view fills the terminal
+// exactly, and the peer panel is only shown where it leaves the messages room
+func TestViewFitsTerminal(t *testing.T) {
+	for _, tc := range []struct {
+		width, height int
+		tooSmall      bool
+		peerPanel     bool // Shown by default
+	}{
+		{10, 5, true, false},
+		{29, 40, true, false},
+		{80, 13, true, false},
+		{30, 14, false, false},
+		{60, 20, false, false},
+		{79, 24, false, false},
+		{80, 24, false, true},
+		{120, 40, false, true},
+		{250, 80, false, true},
+		{1000, 300, false, true},
+	} {
+		for _, peers := range []int{0, 3, 50} {
+			for _, toggled := range []bool{false, true} {
+				name := fmt.Sprintf("%dx%d %d peers toggled=%v", tc.width, tc.height, peers, toggled)
+				t.Run(name, func(t *testing.T) {
+					ui, backend := newTestUI(t, tc.width, tc.height)
+					withPeers(ui, backend, peers)
+					receive(ui, Message{SenderID: "127.0.0.1:2", Content: []byte(strings.Repeat("long words ", 40))})
+					if toggled {
+						ui.Update(tea.KeyMsg{Type: tea.KeyCtrlG})
+					}
+
+					view := ui.View()
+					if tc.tooSmall {
+						if !strings.HasPrefix(view, "Terminal") { // Cut to the width
+							t.Errorf("no \"too small\" notice in %q", view)
+						}
+						if width, _ := viewSize(view); width > tc.width {
+							t.Errorf("notice is %d wide, over the terminal's %d", width, tc.width)
+						}
+						return
+					}
+					if width, height := viewSize(view); width != tc.width || height != tc.height {
+						t.Errorf("view is %dx%d, want %dx%d", width, height, tc.width, tc.height)
+					}
+					// Toggling shows the panel where it is hidden by default, if the messages keep their minimum
+					wantPanel := tc.peerPanel != toggled && tc.width-minPeerPanelWidth-4 >= minMessageWidth
+					if shown := ui.peerWidth > 0; shown != wantPanel {
+						t.Errorf("peer panel shown: %v, want %v", shown, wantPanel)
+					}
+					if shown := strings.Contains(view, "Connected Peers"); shown != wantPanel {
+						t.Errorf("peer panel rendered: %v, want %v", shown, wantPanel)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestResizeDuringSession resizes a TUI with a full scrollback through every width and a range
+// of heights, as dragging a window corner does: nothing panics and each view fills the terminal
+func TestResizeDuringSession(t *testing.T) {
+	ui, backend := newTestUI(t, 120, 40)
+	withPeers(ui, backend, 5)
+	ui.maxMessages = 200 // Each resize rewraps them all
+	fillScrollback(ui)
+	ui.Update(tea.KeyMsg{Type: tea.KeyShiftTab})
+	ui.Update(tea.KeyMsg{Type: tea.KeyShiftTab}) // The peer panel has focus, until it is hidden
+
+	for width := 200; width >= minTerminalWidth; width -= 3 {
+		height := minTerminalHeight + width%30
+		ui.Update(tea.WindowSizeMsg{Width: width, Height: height})
+		if w, h := viewSize(ui.View()); w != width || h != height {
+			t.Fatalf("after resizing to %dx%d the view is %dx%d", width, height, w, h)
+		}
+		if ui.peerWidth == 0 && ui.focus == focusPeers {
+			t.Fatalf("at %dx%d the hidden peer panel has focus", width, height)
+		}
+	}
+	ui.Update(tea.WindowSizeMsg{Width: 5, Height: 2})
+	ui.View()
+	ui.Update(tea.WindowSizeMsg{Width: 120, Height: 40})
+	if w, h := viewSize(ui.View()); w != 120 || h != 40 {
+		t.Errorf("back at 120x40 the view is %dx%d", w, h)
+	}
+}
+
+// runTestTUI runs a TUI on node with runTUI, without a terminal, returning its program and a
+// channel that yields runTUI's error once it returns. It waits until the node accepts connections.
+func runTestTUI(t *testing.T, tn *testNetwork, node *EnhancedNode) (*tea.Program, <-chan error) {
+	t.Helper()
+	p := tea.NewProgram(NewUI(node), tea.WithInput(nil), tea.WithOutput(io.Discard))
+	done := make(chan error, 1)
+	go func() { done <- runTUI(p, node) }()
+	t.Cleanup(func() {
+		p.Kill()
+		node.shutdownWithin(testWait)
+	})
+	waitFor(t, "the node to accept connections", func() bool {
+		conn, err := tn.network.Dial(node.ID, 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return p, done
+}
+
+// waitForTUI waits for runTUI to return, failing the test if it doesn't
+func waitForTUI(t *testing.T, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("TUI exited with %v", err)
+		}
+	case <-time.After(testWait):
+		t.Fatal("TUI still running")
+	}
+}
+
+// TestQuittingTUIShutsNodeDown quits the TUI with Ctrl+C and with /quit: by the time runTUI
+// returns the node has closed its listener and its peers have seen it go
+func TestQuittingTUIShutsNodeDown(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		keys []tea.Msg
+	}{
+		{"ctrl+c", []tea.Msg{tea.KeyMsg{Type: tea.KeyCtrlC}}},
+		{"/quit", []tea.Msg{tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("/quit")}, tea.KeyMsg{Type: tea.KeyEnter}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tn := newTestNetwork(t, 1)
+			peer := tn.nodes[0]
+			node := tn.newNode()
+			p, done := runTestTUI(t, tn, node)
+			tn.connect(peer, node)
+
+			for _, key := range tc.keys {
+				p.Send(key)
+			}
+			waitForTUI(t, done)
+
+			if conn, err := tn.network.Dial(node.ID, 100*time.Millisecond); err == nil {
+				conn.Close()
+				t.Error("the node still accepts connections after the TUI quit")
+			}
+			waitFor(t, "the peer to see the node go", func() bool { return !hasPeer(peer, node.ID) })
+		})
+	}
+}
+
+// TestNodeShutdownQuitsTUI shuts the node down from elsewhere, as /quit over the control API
+// does: the TUI exits rather than staying up on a dead node
+func TestNodeShutdownQuitsTUI(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	node := tn.newNode()
+	_, done := runTestTUI(t, tn, node)
+
+	go node.shutdown()
+	waitForTUI(t, done)
+}
+
+// BenchmarkUpdateViewport measures redrawing the whole scrollback, as a resize or search does,
+// with defaultMaxMessages messages kept
+func BenchmarkUpdateViewport(b *testing.B) {
+	ui, _ := newTestUI(b, 120, 40)
+	fillScrollback(ui)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		ui.updateViewport()
+	}
+}
+
+// BenchmarkAppendMessage measures a message arriving on a full scrollback, which renders only the
+// new message
+func BenchmarkAppendMessage(b *testing.B) {
+	ui, _ := newTestUI(b, 120, 40)
+	fillScrollback(ui)
+	msg := Message{SenderID: "127.0.0.1:2", Content: []byte("one more message")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		receive(ui, msg)
+	}
+}
@@ -3,41 +3,102 @@ package main
 import (
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	multicastAddr  = "239.255.255.250:9999"
 	delimiter      = '|'
-	gossipInterval = 10 * 1000000000 // 10 seconds in nanoseconds
+	gossipInterval = 10 * 1000000000 // 10 seconds in nanoseconds, give or take jitter
+
+	defaultReadTimeout  = 90 * time.Second // Peers that send nothing for this long are dropped
+	defaultWriteTimeout = 30 * time.Second // A single frame that can't be written in this time drops the peer
+	keepaliveInterval   = 20 * time.Second // Idle connections get a keepalive this often
+	shutdownTimeout     = 5 * time.Second  // How long quitting a UI waits for the node to stop
+
+	// keepaliveContent is an empty peer list: every version of the protocol ignores it
+	keepaliveContent = "GOSSIP_PEERS:"
 )
 
 type Node struct {
-	ID             string
-	Listener       net.Listener
-	Peers          map[string]*Peer
-	peersMutex     sync.RWMutex
-	KnownPeers     map[string]bool
-	knownMutex     sync.RWMutex
-	IncomingMsg    chan Message
-	NewPeer        chan *Peer
-	RemovePeer     chan string
-	CLIInput       chan string
-	Shutdown       chan struct{}
-	shutdownOnce   sync.Once
-	wg             sync.WaitGroup
-	discoveryConn  *net.UDPConn
-	DiscoveredPeer chan string
-	PeerListGossip chan []string
-	uiChannel      chan Message
-	cryptoManager  *CryptoManager
+	ID               string
+	Listener         net.Listener
+	listeners        []net.Listener        // Every address bound from -listen, Listener first
+	advertised       []string              // The address peers reach each listener at, the ID first
+	listenFailures   []error               // -listen addresses that couldn't be bound while others could
+	transport        Transport             // Makes outgoing peer connections
+	quic             *quicTransport        // The transport, when running with QUIC
+	tor              *TorController        // Control connection keeping our onion service up, with -tor
+	dht              *DHT                  // Our part of the DHT, with -dht
+	traffic          *TrafficMeter         // Bytes in and out over peer connections and discovery
+	wallClock        Clock                 // Time and timers for announcing, gossip and redials (WithClock)
+	random           Random                // Jitter and file IDs (WithRandom)
+	Peers            map[string]*Peer      // By key fingerprint; by connection ID until a legacy peer's key arrives
+	conns            map[string]*Peer      // The same peers by connection ID, which frames are routed by
+	replaced         map[string]*Peer      // Replaced connections by ID -> the one that took over, for frames still on their way
+	peersMutex       sync.RWMutex          // Guards Peers, conns, replaced and each peer's key
+	KnownPeers       map[string]*knownPeer // Nodes heard of, by key fingerprint; by address until a key is seen there
+	knownMutex       sync.RWMutex          // Guards KnownPeers; taken after peersMutex when both are
+	redials          *RedialQueue          // Discovered addresses to dial again after a failure
+	noPeers          chan struct{}         // Signalled when the last peer disconnects, to announce quickly again
+	gossipHash       uint64                // What the last gossip round sent and to whom (gossipChanged)
+	IncomingMsg      chan Message
+	CLIInput         chan string
+	Shutdown         chan struct{}
+	shutdownOnce     sync.Once
+	wg               sync.WaitGroup
+	discoveryConn    *net.UDPConn
+	discoveryProblem error // Why discovery was turned off at startup when it was meant to be on
+	DiscoveredPeer   chan string
+	uiChannel        <-chan Message // First UI subscription; nil when there is no local UI
+	uiQueue          *UIQueue       // Where notifyUI puts messages for dispatchUI
+	console          *Console       // The plain CLI's line editor; nil in the other modes
+	messageLog       *MessageLog
+	events           *EventFeed // Activity streamed to /events clients
+	cryptoManager    *CryptoManager
+	pipeInput        func(line string)   // When set, handleCLI runs in pipe mode: no prompt, lines go here verbatim
+	pipeOneshot      bool                // In pipe mode, shut down after stdin EOF instead of staying up to receive
+	greeting         func() []byte       // First frame for every new connection, queued ahead of any reply to it; nil sends none
+	peerRemoved      func(peerID string) // Called after a connection is forgotten, outside peersMutex
+	peerOversized    func(peerID string) // Called for each message over the size limits a connection sends
+	peerPanicked     func(peerID string) // Called when handling what a connection sent panicked
+	readTimeout      time.Duration       // Drop peers silent for this long (0 disables)
+	writeTimeout     time.Duration       // Drop peers that can't take a frame within this time (0 disables)
+	legacyOnly       bool                // Skip Noise and speak only legacy frames, as nodes from before it do; for interop tests
+
+	// admit decides whether a connection, once secured, may be registered; nil admits all
+	admit             func(conn net.Conn, dialedAddr string) error
+	dialIntents       sync.Map        // Address -> dialIntent, while /connect dials it
+	dialing           sync.Map        // Addresses being dialled, which aren't dialled again meanwhile
+	localCapabilities func() []string // What we announce to peers; nil announces nothing
+	versionWarned     sync.Map        // Node IDs warned about as needing capabilities we lack
+	noiseKeys         sync.Map        // Fingerprints that have authenticated a Noise session; never accepted over legacy frames
+
+	spoofedFrames atomic.Uint64 // Frames dropped for naming a sender their connection wasn't authenticated as
+	handlerPanics atomic.Uint64 // Panics recovered while handling what a peer sent (recoverPeerPanic)
+
+	locked        atomic.Bool   // Refusing new incoming connections and not dialling or announcing (/lock)
+	lockedRefused atomic.Uint64 // Incoming connections refused while locked
 }
 
 type Peer struct {
-	ID   string
+	ID   string // Connection ID: the address we dialled, or the remote address of an incoming connection
 	Conn net.Conn
 	Send chan []byte
 	Done chan struct{}
 	once sync.Once
+
+	key         string                 // Its key's fingerprint once known, else ID: its key in Peers, guarded by peersMutex
+	node        atomic.Pointer[string] // The node ID (listen address) it goes by; nil until the handshake or a frame says
+	outbound    bool                   // We dialled the connection
+	connectedAt time.Time              // When the connection was registered
+
+	traffic      trafficCounter               // Bytes read from and written to Conn
+	capabilities atomic.Pointer[Capabilities] // What the peer announced; nil until it does
+	version      atomic.Pointer[VersionInfo]  // The build the peer announced; nil until it does
+	oversized    atomic.Int32                 // Messages over the size limits it sent
+	successor    atomic.Pointer[Peer]         // The newer connection to the same node that replaced it
 }
 
 type Message struct {
@@ -45,4 +106,27 @@ type Message struct {
 	Content    []byte
 	FromPeerID string
 	IsGossip   bool
+	Lamport    uint64    // Sender's Lamport time; zero for system and legacy messages
+	Seq        uint64    // Sender's broadcast sequence number; zero if not a broadcast
+	Timestamp  time.Time // When the message was originally received; zero means now
+	Backfill   bool      // Replayed from a peer's history rather than received live
+	Mention    bool      // Mentions our nick or a watched keyword
+	Action     bool      // /me action, rendered as "* sender text"
+	ExpiresAt  time.Time // When an ephemeral message disappears; zero for normal messages
+	Direct     bool      // Sent to one peer rather than broadcast
+	To         string    // Node ID our direct message went to; empty for everything else
+	Replayed   bool      // Already delivered to an earlier UI subscriber and sent again
+	Room       string    // Room a room message was sent in, e.g. "#lan"; empty for everything else
+	Attachment string    // Path of a file we received, for the TUI to preview; empty for everything else
+	ID         string    // Sender's ID for a text message, which read receipts refer to
+	SenderKey  string    // Fingerprint of the sender's key when the message was shown; empty for system notices
+	ReadIDs    []string  // A read receipt: our direct messages SenderID has seen; nothing else is shown
+
+	// Conversation is where the message belongs: a peer's node ID for its direct messages, the
+	// room for room messages, or broadcastConversation. notifyUI fills it in from Direct, To and
+	// Room; a system notice about a file, a voice message or a room sets it, and other notices
+	// leave it empty to be shown wherever the user is. ConversationKey is that peer's key
+	// fingerprint, once known.
+	Conversation    string
+	ConversationKey string
 }
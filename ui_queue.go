@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	uiQueueLimit    = 1000 // Most UI events held while the UI isn't reading
+	uiReplayLimit   = 200  // Recent UI events replayed to a UI that subscribes
+	uiChannelBuffer = 100  // Buffer of each subscriber's channel
+)
+
+// UIQueue buffers messages between the node and the UI so producers never block on a slow or
+// absent reader. When full it drops the oldest system notice (or, failing that, the oldest
+// message) and counts it; every message is still in the message log.
+//
+// It also remembers the most recent messages, so a UI that subscribes late (or is restarted)
+// is shown them before anything newer.
+type UIQueue struct {
+	mutex   sync.Mutex
+	pending []Message
+	recent  []Message // The last uiReplayLimit messages pushed, delivered or not
+	limit   int
+	dropped int
+	ready   chan struct{} // Signalled when pending goes from empty to non-empty
+	out     chan Message  // The current subscriber's channel
+	cancel  chan struct{} // Closed when the current subscriber is replaced
+}
+
+// NewUIQueue creates a queue holding at most limit undelivered messages
+func NewUIQueue(limit int) *UIQueue {
+	return &UIQueue{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Subscribe returns a new channel for the UI to read, replacing any earlier one. Recent messages
+// that were already delivered are sent again first, marked Replayed, then the undelivered ones,
+// so the order is the order they were pushed in.
+func (q *UIQueue) Subscribe() <-chan Message {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.cancel != nil {
+		close(q.cancel)
+	}
+	q.out = make(chan Message, uiChannelBuffer)
+	q.cancel = make(chan struct{})
+
+	// The undelivered messages are the newest ones pushed, so they are the tail of recent
+	if delivered := len(q.recent) - len(q.pending); delivered > 0 {
+		replay := make([]Message, 0, len(q.recent))
+		for _, msg := range q.recent[:delivered] {
+			msg.Replayed = true
+			replay = append(replay, msg)
+		}
+		q.pending = append(replay, q.pending...)
+		q.signal()
+	}
+	return q.out
+}
+
+// Push adds a message without blocking
+func (q *UIQueue) Push(msg Message) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Stamp it now, so a replay shows when it happened rather than when it was replayed
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	if len(q.recent) >= uiReplayLimit {
+		q.recent[0] = Message{} // Don't keep the content alive in the backing array
+		q.recent = q.recent[1:]
+	}
+	q.recent = append(q.recent, msg)
+
+	if len(q.pending) >= q.limit {
+		q.dropOldest()
+	}
+	q.pending = append(q.pending, msg)
+	q.signal()
+}
+
+// Len returns how many messages are waiting for the UI
+func (q *UIQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.pending)
+}
+
+// signal wakes the dispatcher; the caller must hold the mutex
+func (q *UIQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dropOldest removes the oldest system notice, or the oldest message if there are none;
+// the caller must hold the mutex
+func (q *UIQueue) dropOldest() {
+	drop := 0
+	for i, msg := range q.pending {
+		if msg.SenderID == "System" {
+			drop = i
+			break
+		}
+	}
+	q.pending = append(q.pending[:drop], q.pending[drop+1:]...)
+	q.dropped++
+}
+
+// pop takes the next message to deliver, with the subscriber to deliver it to and a channel that
+// is closed if that subscriber is replaced first. After drops, the first message is a notice
+// saying how many.
+func (q *UIQueue) pop() (Message, chan<- Message, <-chan struct{}, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.dropped > 0 {
+		notice := Message{
+			SenderID:  "System",
+			Content:   []byte(fmt.Sprintf("⚠️ %d UI events dropped (the UI fell behind)", q.dropped)),
+			Timestamp: time.Now(),
+		}
+		q.dropped = 0
+		return notice, q.out, q.cancel, true
+	}
+
+	if len(q.pending) == 0 {
+		return Message{}, nil, nil, false
+	}
+	msg := q.pending[0]
+	q.pending[0] = Message{} // Don't keep the content alive in the backing array
+	q.pending = q.pending[1:]
+	return msg, q.out, q.cancel, true
+}
+
+// dispatchUI is the only writer to UI channels: it feeds queued messages to the current
+// subscriber at whatever pace it reads them
+func (n *Node) dispatchUI() {
+	defer n.wg.Done()
+
+	for {
+		msg, out, cancel, ok := n.uiQueue.pop()
+		if !ok {
+			select {
+			case <-n.uiQueue.ready:
+				continue
+			case <-n.Shutdown:
+				return
+			}
+		}
+
+		select {
+		case out <- msg:
+		case <-cancel:
+			// A new subscriber replaced this one; it gets the message in its replay
+		case <-n.Shutdown:
+			return
+		}
+	}
+}
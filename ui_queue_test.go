@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// uiText is a message as a test pushes it: a peer's, or a notice from "System"
+func uiText(sender, text string) Message {
+	return Message{SenderID: sender, Content: []byte(text)}
+}
+
+// popAll drains a queue without a dispatcher, returning the contents in delivery order
+func popAll(q *UIQueue) []string {
+	var texts []string
+	for {
+		msg, _, _, ok := q.pop()
+		if !ok {
+			return texts
+		}
+		texts = append(texts, string(msg.Content))
+	}
+}
+
+// TestUIQueueDropsNoticesFirst fills a queue: system notices go before peers' messages, the
+// oldest first, and a notice of how many went comes before the rest
+func TestUIQueueDropsNoticesFirst(t *testing.T) {
+	q := NewUIQueue(4)
+	for _, msg := range []Message{
+		uiText("peer", "m1"),
+		uiText("System", "n1"),
+		uiText("peer", "m2"),
+		uiText("System", "n2"),
+		uiText("peer", "m3"), // Drops n1
+		uiText("peer", "m4"), // Drops n2
+		uiText("peer", "m5"), // No notices left: drops m1
+	} {
+		q.Push(msg)
+	}
+	if len(q.pending) != 4 {
+		t.Fatalf("%d pending, want the limit of 4", len(q.pending))
+	}
+
+	want := []string{"⚠️ 3 UI events dropped (the UI fell behind)", "m2", "m3", "m4", "m5"}
+	if got := popAll(q); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+	if got := popAll(q); len(got) != 0 {
+		t.Errorf("delivered %q after the queue emptied", got)
+	}
+}
+
+// TestUIQueueReplay subscribes again after some messages were read: they are replayed, marked,
+// before the ones never delivered, in the order they were pushed
+func TestUIQueueReplay(t *testing.T) {
+	q := NewUIQueue(uiQueueLimit)
+	q.Subscribe()
+	q.Push(uiText("peer", "read"))
+	popAll(q)
+	q.Push(uiText("peer", "unread"))
+
+	q.Subscribe()
+	var got []string
+	for {
+		msg, _, _, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, fmt.Sprintf("%s replayed=%v", msg.Content, msg.Replayed))
+		if msg.Timestamp.IsZero() {
+			t.Errorf("%s has no timestamp", msg.Content)
+		}
+	}
+	want := []string{"read replayed=true", "unread replayed=false"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after resubscribing got %q, want %q", got, want)
+	}
+
+	// Only the last uiReplayLimit are remembered
+	for i := range uiReplayLimit + 10 {
+		q.Push(uiText("peer", strconv.Itoa(i)))
+	}
+	popAll(q)
+	q.Subscribe()
+	if replayed := popAll(q); len(replayed) != uiReplayLimit || replayed[0] != "10" {
+		t.Errorf("replayed %d messages from %q, want %d from 10", len(replayed), replayed[0], uiReplayLimit)
+	}
+}
+
+// TestUIQueueSlowConsumer pushes far more than the queue holds to a UI that reads slowly: pushing
+// never waits, what arrives is in order, and the drop notices account for everything else
+func TestUIQueueSlowConsumer(t *testing.T) {
+	const pushed = 5 * uiQueueLimit
+	n := &Node{uiQueue: NewUIQueue(uiQueueLimit), Shutdown: make(chan struct{})}
+	out := n.uiQueue.Subscribe()
+	n.wg.Add(1)
+	go n.dispatchUI()
+	defer func() {
+		close(n.Shutdown)
+		n.wg.Wait()
+	}()
+
+	pushing := make(chan struct{})
+	go func() {
+		defer close(pushing)
+		for i := range pushed {
+			n.uiQueue.Push(uiText("peer", strconv.Itoa(i)))
+		}
+	}()
+	select {
+	case <-pushing:
+	case <-time.After(testWait):
+		t.Fatal("pushing to an unread queue blocked")
+	}
+
+	dropNotice := regexp.MustCompile(`^⚠️ (\d+) UI events dropped`)
+	last, received, dropped := -1, 0, 0
+	for received+dropped < pushed {
+		select {
+		case msg := <-out:
+			text := string(msg.Content)
+			if match := dropNotice.FindStringSubmatch(text); match != nil {
+				count, _ := strconv.Atoi(match[1])
+				dropped += count
+				continue
+			}
+			i, err := strconv.Atoi(text)
+			if err != nil || i <= last {
+				t.Fatalf("received %q after %d", text, last)
+			}
+			last = i
+			received++
+			time.Sleep(10 * time.Microsecond) // A UI busy redrawing
+		case <-time.After(testWait):
+			t.Fatalf("received %d and %d dropped of %d, then nothing", received, dropped, pushed)
+		}
+	}
+	if last != pushed-1 || dropped == 0 {
+		t.Errorf("last received %d with %d dropped, want the newest (%d) kept and some dropped", last, dropped, pushed-1)
+	}
+}
+
+// TestUnreadUIDoesntBlockPeers floods a node whose UI never reads: peers' messages keep being
+// handled, logged and acknowledged, and the UI queue stays within its limit
+func TestUnreadUIDoesntBlockPeers(t *testing.T) {
+	tn := newTestNetwork(t, 0)
+	a := tn.newNode()
+	a.uiChannel = a.uiQueue.Subscribe() // Never read
+	if err := a.reputation.Configure(&ReputationConfig{Off: true}); err != nil {
+		t.Fatal(err) // The flood is far over the rate a peer may keep up
+	}
+	tn.start(a)
+	b := tn.addNode()
+	tn.connect(b, a)
+
+	const flood = uiChannelBuffer + uiQueueLimit + 100
+	for i := range flood {
+		if _, err := b.SendEncryptedTextTo(a.ID, fmt.Sprintf("flood %d", i)); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if i%5 == 4 {
+			// Keep b's send queue from overflowing; a must keep up to acknowledge this
+			if err := b.SendTextAndConfirm(a.ID, fmt.Sprintf("checkpoint %d", i), testWait); err != nil {
+				t.Fatalf("checkpoint %d: %v", i, err)
+			}
+		}
+	}
+	waitForText(t, a, b.ID, fmt.Sprintf("flood %d", flood-1))
+	a.uiQueue.mutex.Lock()
+	pending := len(a.uiQueue.pending)
+	a.uiQueue.mutex.Unlock()
+	if pending > uiQueueLimit {
+		t.Errorf("%d UI events pending, over the limit of %d", pending, uiQueueLimit)
+	}
+	if len(a.uiChannel) != uiChannelBuffer {
+		t.Errorf("UI channel holds %d, want it full at %d", len(a.uiChannel), uiChannelBuffer)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Build information, set at build time:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without them the commit and time Go stamps into builds from a git checkout are used.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+const (
+	// protocolVersion is raised when the wire protocol changes in a way that older nodes should
+	// know about. A peer on a newer protocol that requires capabilities this version doesn't know
+	// is warned about once.
+	protocolVersion = 1
+
+	maxVersionField = 64 // Longest version, commit, date or platform kept from a peer
+)
+
+// pseudoVersion matches the version Go gives a build of an untagged commit
+var pseudoVersion = regexp.MustCompile(`-(0\.)?\d{14}-[0-9a-f]{12}`)
+
+// requiredCapabilities are the capabilities peers must have to talk to this version; none yet
+var requiredCapabilities []string
+
+// VersionInfo is the build a node runs, as exchanged with peers and shown by /version and /whois
+type VersionInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	BuildDate string   `json:"build_date,omitempty"`
+	Go        string   `json:"go,omitempty"`       // Go release it was built with
+	Platform  string   `json:"platform,omitempty"` // GOOS/GOARCH
+	Protocol  int      `json:"protocol"`
+	Required  []string `json:"required,omitempty"` // Capabilities its peers must have
+}
+
+// ownVersion is this build's version information, worked out once
+var ownVersion = sync.OnceValue(func() VersionInfo {
+	info := VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		Go:        runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Protocol:  protocolVersion,
+		Required:  requiredCapabilities,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		// A tagged release, as go install <module>@<version> or a build at a tag stamps it; the
+		// pseudo-version of an untagged commit says no more than the commit does
+		if main := build.Main.Version; info.Version == "dev" && main != "" && main != "(devel)" && !pseudoVersion.MatchString(main) {
+			info.Version = main
+		}
+		var modified bool
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value[:min(len(setting.Value), 12)]
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if modified && commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	return info
+})
+
+// parseVersion keeps what a peer announced about its build, shortened and safe to display
+func parseVersion(announced VersionInfo) VersionInfo {
+	field := func(s string) string {
+		s = sanitizeLine(strings.TrimSpace(s))
+		if len(s) > maxVersionField {
+			s = strings.ToValidUTF8(s[:maxVersionField], "")
+		}
+		return s
+	}
+	info := VersionInfo{
+		Version:   field(announced.Version),
+		Commit:    field(announced.Commit),
+		BuildDate: field(announced.BuildDate),
+		Go:        field(announced.Go),
+		Platform:  field(announced.Platform),
+		Protocol:  max(announced.Protocol, 0),
+		Required:  parseCapabilities(announced.Required),
+	}
+	if info.Version == "" {
+		info.Version = "unknown"
+	}
+	return info
+}
+
+// String formats the information on one line, for /whois and /peers -v
+func (info VersionInfo) String() string {
+	var details []string
+	if info.Commit != "" {
+		details = append(details, info.Commit)
+	}
+	if info.BuildDate != "" {
+		details = append(details, "built "+info.BuildDate)
+	}
+	if info.Go != "" || info.Platform != "" {
+		details = append(details, strings.TrimSpace(info.Go+" "+info.Platform))
+	}
+	line := info.Version
+	if len(details) > 0 {
+		line += " (" + strings.Join(details, ", ") + ")"
+	}
+	line += fmt.Sprintf(", protocol %d", info.Protocol)
+	if len(info.Required) > 0 {
+		line += ", requires " + Capabilities(info.Required).String()
+	}
+	return line
+}
+
+// unknownRequired returns the capabilities a peer on a newer protocol requires that this version
+// doesn't know. Requirements from peers on our protocol or an older one are ours or ones we met.
+func (info VersionInfo) unknownRequired() []string {
+	if info.Protocol <= protocolVersion {
+		return nil
+	}
+	var unknown []string
+	for _, name := range info.Required {
+		if !knownCapabilities[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown
+}
+
+// setVersion records the build a connected peer announced, warning the first time a node turns
+// out to need capabilities this version lacks
+func (n *Node) setVersion(peer *Peer, nodeID string, announced VersionInfo) {
+	info := parseVersion(announced)
+	peer.version.Store(&info)
+	log.Printf("Peer %s runs %s", nodeID, info)
+
+	unknown := info.unknownRequired()
+	if len(unknown) == 0 {
+		return
+	}
+	if _, warned := n.versionWarned.LoadOrStore(nodeID, true); warned {
+		return
+	}
+	log.Printf("Peer %s is on protocol %d and requires %s, which this version lacks", nodeID, info.Protocol, strings.Join(unknown, ", "))
+	n.notifyUI(Message{
+		SenderID: "System",
+		Content: []byte(fmt.Sprintf("⚠️ %s runs a newer version (%s, protocol %d; this is %d) that requires %s, which this version "+
+			"doesn't support: some things may not work with it until you upgrade", nodeID, info.Version, info.Protocol,
+			protocolVersion, strings.Join(unknown, ", "))),
+	})
+}
+
+// peerVersion returns the build a connected peer announced. It reports false for peers that
+// announced none: versions from before the exchange, or ones whose announcement hasn't arrived.
+func (en *EnhancedNode) peerVersion(peerID string) (VersionInfo, bool) {
+	connID, _, err := en.resolvePeer(peerID)
+	if err != nil {
+		return VersionInfo{}, false
+	}
+	en.peersMutex.RLock()
+	peer, exists := en.conns[connID]
+	en.peersMutex.RUnlock()
+	if !exists {
+		return VersionInfo{}, false
+	}
+	info := peer.version.Load()
+	if info == nil {
+		return VersionInfo{}, false
+	}
+	return *info, true
+}
+
+// sendVersionTo announces our build to a peer on a connection that had no Noise handshake to
+// carry it (QUIC or legacy). Versions that predate the exchange ignore it.
+func (en *EnhancedNode) sendVersionTo(peerID string) {
+	data, err := json.Marshal(ownVersion())
+	if err != nil {
+		log.Printf("Failed to serialize version: %v", err)
+		return
+	}
+	if err := en.sendEncryptedTo(peerID, data, "version"); err != nil {
+		log.Printf("Failed to send version to %s: %v", peerID, err)
+	}
+}
+
+// handleVersion records the build a peer announced after key exchange
+func (en *EnhancedNode) handleVersion(msg Message, fromPeerKey bool, plaintext []byte) {
+	if !fromPeerKey {
+		log.Printf("Ignoring version from %s: sender key not known", msg.SenderID)
+		return
+	}
+	var announced VersionInfo
+	if err := json.Unmarshal(plaintext, &announced); err != nil {
+		log.Printf("Invalid version from %s: %v", msg.SenderID, err)
+		return
+	}
+
+	en.peersMutex.RLock()
+	peer, exists := en.conns[msg.FromPeerID]
+	en.peersMutex.RUnlock()
+	if exists {
+		en.setVersion(peer, msg.SenderID, announced)
+	}
+}
+
+// handleVersionCommand processes /version, showing this node's build
+func (en *EnhancedNode) handleVersionCommand() {
+	info := ownVersion()
+	var content strings.Builder
+	content.WriteString("🏷️ p2pchat " + info.Version)
+	line := func(label, value string) {
+		if value != "" {
+			content.WriteString(fmt.Sprintf("\n  %-10s %s", label+":", value))
+		}
+	}
+	line("Commit", info.Commit)
+	line("Built", info.BuildDate)
+	line("Go", info.Go)
+	line("Platform", info.Platform)
+	line("Protocol", fmt.Sprint(info.Protocol))
+	line("Features", parseCapabilities(en.capabilities()).String())
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(content.String()),
+	})
+}
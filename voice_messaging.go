@@ -4,13 +4,12 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,15 +21,40 @@ import (
 	"github.com/faiface/beep/wav"
 )
 
+// maxInlineVoiceBytes is the largest clip sent as a single message. Encoded twice over, it still
+// fits in the 64 KB a peer will read as one line; larger clips are sent as a chunked transfer.
+const maxInlineVoiceBytes = 24 * 1024
+
+// voiceSender delivers an encrypted voice message to one peer or to all of them
+type voiceSender interface {
+	encryptedSender
+	broadcastEncrypted(plaintext []byte, msgType string) error
+}
+
 // VoiceMessageManager handles voice recording and playback
 type VoiceMessageManager struct {
 	node            *Node
 	crypto          *CryptoManager
+	sender          voiceSender
+	files           *FileTransferManager // Carries clips too large for one message
 	isRecording     bool
 	recordMutex     sync.Mutex
+	capture         captureBackend // Recorder found at startup; nil disables /voice
+	device          string         // Capture device chosen with /audiodevice; empty for the default
 	voiceDir        string
 	speakerInitOnce sync.Once
 	speakerInitErr  error
+	speakerReady    chan struct{} // Closed once the audio output has been opened, or failed to open
+	autoplay        bool          // Play received messages straight away, as well as storing them
+	playMutex       sync.Mutex    // Held while a clip plays, so clips don't play over each other
+
+	playback      PlaybackInfo    // Volume, mute and speed, and whether a clip is playing
+	playing       *activePlayback // Effects of the clip being played; nil when none is
+	playbackMutex sync.Mutex
+
+	stored      []StoredVoiceMessage // Received messages in the voice directory, by ID - 1
+	transcriber *voiceTranscriber    // Transcribes received messages; nil unless configured
+	storedMutex sync.Mutex
 }
 
 // VoiceMessage represents a voice message
@@ -39,7 +63,8 @@ type VoiceMessage struct {
 	AudioData  string `json:"audio_data"` // base64 encoded
 	Duration   int    `json:"duration"`   // in seconds
 	SampleRate int    `json:"sample_rate"`
-	Format     string `json:"format"` // "mp3" or "wav"
+	Format     string `json:"format"`           // "mp3" or "wav"
+	Direct     bool   `json:"direct,omitempty"` // Sent to the receiver alone rather than to everyone
 }
 
 // NewVoiceMessageManager creates a new voice message manager
@@ -48,20 +73,101 @@ func NewVoiceMessageManager(node *Node, crypto *CryptoManager, voiceDir string)
 		log.Printf("Warning: Failed to create voice directory: %v", err)
 	}
 
-	return &VoiceMessageManager{
-		node:        node,
-		crypto:      crypto,
-		isRecording: false,
-		voiceDir:    voiceDir,
+	vm := &VoiceMessageManager{
+		node:         node,
+		crypto:       crypto,
+		isRecording:  false,
+		voiceDir:     voiceDir,
+		capture:      findCaptureBackend(),
+		playback:     PlaybackInfo{Volume: defaultVolume, Speed: 1.0},
+		speakerReady: make(chan struct{}),
+	}
+	if vm.capture == nil {
+		log.Printf("Warning: %v", errNoCaptureBackend)
+		node.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("⚠️ " + errNoCaptureBackend.Error()),
+		})
+	}
+	vm.probeAudioOutput()
+	vm.loadStoredVoiceMessages()
+	return vm
+}
+
+// probeAudioOutput opens the audio output, so a missing one is reported at startup rather than
+// when the first message plays. Startup waits for it at most audioProbeTimeout; a slower output
+// carries on opening in the background.
+func (vm *VoiceMessageManager) probeAudioOutput() {
+	done := make(chan error, 1)
+	go func() {
+		done <- vm.initSpeaker()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			err = fmt.Errorf("%w (%v)", errNoAudioOutput, err)
+			log.Printf("Warning: %v", err)
+			vm.node.notifyUI(Message{
+				SenderID: "System",
+				Content:  []byte("⚠️ " + err.Error()),
+			})
+		}
+	case <-time.After(audioProbeTimeout):
+		log.Printf("Audio output is slow to open; carrying on without waiting for it")
 	}
 }
 
-// RecordVoiceMessage records a voice message and broadcasts it
-func (vm *VoiceMessageManager) RecordVoiceMessage(durationStr string) error {
+// initSpeaker opens the audio output the first time it is called; later calls return the outcome
+func (vm *VoiceMessageManager) initSpeaker() error {
+	vm.speakerInitOnce.Do(func() {
+		vm.speakerInitErr = openSpeaker()
+		close(vm.speakerReady)
+	})
+	return vm.speakerInitErr
+}
+
+// openSpeaker opens the audio output; only initSpeaker and -check call it
+func openSpeaker() error {
+	return speaker.Init(playbackSampleRate, playbackSampleRate.N(time.Second/10))
+}
+
+// outputError is why voice messages can't be played, or nil if they can or the output is still opening
+func (vm *VoiceMessageManager) outputError() error {
+	select {
+	case <-vm.speakerReady:
+		return vm.speakerInitErr
+	default:
+		return nil
+	}
+}
+
+// unavailableCommands says which voice commands can't work on this system, and why, for /help
+func (vm *VoiceMessageManager) unavailableCommands() map[string]string {
+	unavailable := make(map[string]string)
+	if vm.capture == nil {
+		for _, name := range []string{"/voice", "/audiodevices", "/audiodevice"} {
+			unavailable[name] = "no microphone or recorder found"
+		}
+	}
+	if vm.outputError() != nil {
+		unavailable["/play"] = "no audio output"
+	}
+	return unavailable
+}
+
+// RecordVoiceMessage records a voice message and sends it to peerID, or to every peer if peerID is "".
+// It returns what was sent, for the chat entry. Once the clip is recorded it is returned even with an
+// error, which wraps a *BroadcastError when only some peers missed it.
+func (vm *VoiceMessageManager) RecordVoiceMessage(durationStr string, peerID string) (StoredVoiceMessage, error) {
+	if vm.capture == nil {
+		return StoredVoiceMessage{}, errNoCaptureBackend
+	}
+
 	vm.recordMutex.Lock()
 	if vm.isRecording {
 		vm.recordMutex.Unlock()
-		return fmt.Errorf("already recording")
+		return StoredVoiceMessage{}, fmt.Errorf("already recording")
 	}
 	vm.isRecording = true
 	vm.recordMutex.Unlock()
@@ -75,29 +181,46 @@ func (vm *VoiceMessageManager) RecordVoiceMessage(durationStr string) error {
 	// Parse duration
 	duration, err := strconv.Atoi(durationStr)
 	if err != nil || duration <= 0 || duration > 60 {
-		return fmt.Errorf("invalid duration: must be between 1 and 60 seconds")
+		return StoredVoiceMessage{}, fmt.Errorf("invalid duration: must be between 1 and 60 seconds")
 	}
 
-	log.Printf("Recording voice message for %d seconds...", duration)
+	device := vm.recordingDevice()
+	deviceName := device
+	if deviceName == "" {
+		deviceName = "the default device"
+	}
+	log.Printf("Recording voice message for %d seconds from %s with %s...", duration, deviceName, vm.capture.Name())
+	vm.node.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("🎙️ Recording %ds from %s...", duration, deviceName)),
+	})
 
-	// Record audio to WAV
-	wavPath := filepath.Join(vm.voiceDir, fmt.Sprintf("recording_%d.wav", time.Now().Unix()))
-	if err := vm.recordAudio(wavPath, duration); err != nil {
-		return fmt.Errorf("failed to record audio: %w", err)
+	pcm, err := vm.capture.Record(device, duration)
+	if err != nil {
+		return StoredVoiceMessage{}, fmt.Errorf("failed to record audio: %w", err)
 	}
-	defer os.Remove(wavPath)
 
-	// Convert to MP3
-	mp3Path := filepath.Join(vm.voiceDir, fmt.Sprintf("recording_%d.mp3", time.Now().Unix()))
-	if err := vm.convertToMP3(wavPath, mp3Path); err != nil {
-		return fmt.Errorf("failed to convert to MP3: %w", err)
+	// Compress with ffmpeg when it is there; otherwise the WAV is sent as it is
+	audioData, format := encodeWAV(pcm, voiceSampleRate), "wav"
+	if mp3Data, err := encodeMP3(audioData); err == nil {
+		audioData, format = mp3Data, "mp3"
+	} else if !errors.Is(err, exec.ErrNotFound) {
+		log.Printf("Sending uncompressed: %v", err)
+	}
+	sent := StoredVoiceMessage{
+		SenderID: vm.node.ID,
+		Received: time.Now(),
+		Duration: duration,
+		Format:   format,
+		Size:     int64(len(audioData)),
 	}
-	defer os.Remove(mp3Path)
 
-	// Read MP3 file
-	audioData, err := os.ReadFile(mp3Path)
-	if err != nil {
-		return fmt.Errorf("failed to read MP3 file: %w", err)
+	if len(audioData) > maxInlineVoiceBytes {
+		if err := vm.sendVoiceTransfer(peerID, audioData, format, duration); err != nil {
+			return sent, fmt.Errorf("failed to send voice message: %w", err)
+		}
+		log.Println("Voice message recorded, sending in chunks")
+		return sent, nil
 	}
 
 	// Create voice message
@@ -105,20 +228,24 @@ func (vm *VoiceMessageManager) RecordVoiceMessage(durationStr string) error {
 		Type:       "voice",
 		AudioData:  base64.StdEncoding.EncodeToString(audioData),
 		Duration:   duration,
-		SampleRate: 44100,
-		Format:     "mp3",
+		SampleRate: voiceSampleRate,
+		Format:     format,
+		Direct:     peerID != "",
 	}
 
-	// Broadcast voice message
-	if err := vm.broadcastVoiceMessage(voiceMsg); err != nil {
-		return fmt.Errorf("failed to broadcast voice message: %w", err)
+	if peerID != "" {
+		if err := vm.sendVoiceMessageTo(peerID, voiceMsg); err != nil {
+			return StoredVoiceMessage{}, fmt.Errorf("failed to send voice message to %s: %w", peerID, err)
+		}
+	} else if err := vm.broadcastVoiceMessage(voiceMsg); err != nil {
+		return sent, fmt.Errorf("failed to broadcast voice message: %w", err)
 	}
 
 	log.Println("Voice message recorded and sent successfully")
-	return nil
+	return sent, nil
 }
 
-// HandleVoiceMessage processes incoming voice messages
+// HandleVoiceMessage stores an incoming voice message for /play
 func (vm *VoiceMessageManager) HandleVoiceMessage(senderID string, voiceMsg VoiceMessage) {
 	log.Printf("Received voice message from %s (duration: %d seconds)", senderID, voiceMsg.Duration)
 
@@ -128,99 +255,41 @@ func (vm *VoiceMessageManager) HandleVoiceMessage(senderID string, voiceMsg Voic
 		log.Printf("Failed to decode audio data: %v", err)
 		return
 	}
-
-	// Play the voice message
-	if err := vm.playVoiceMessage(audioData, voiceMsg.Format); err != nil {
-		log.Printf("Failed to play voice message: %v", err)
-		return
-	}
-
-	// Notify UI
-	if vm.node.uiChannel != nil {
-		vm.node.uiChannel <- Message{
-			SenderID: "System",
-			Content:  []byte(fmt.Sprintf("🔊 Played voice message from %s", senderID)),
-		}
-	}
+	vm.receiveVoice(senderID, audioData, voiceMsg.Duration, voiceMsg.Format, voiceMsg.Direct)
 }
 
-// recordAudio records audio using ffmpeg with platform-specific settings
-func (vm *VoiceMessageManager) recordAudio(outputPath string, duration int) error {
-	var args []string
-
-	// Platform-specific audio input configuration
-	switch runtime.GOOS {
-	case "windows":
-		args = []string{
-			"-f", "dshow",
-			"-i", "audio=Microphone",
-			"-t", strconv.Itoa(duration),
-			"-ar", "44100",
-			"-ac", "1",
-			outputPath,
-		}
-	case "darwin":
-		args = []string{
-			"-f", "avfoundation",
-			"-i", ":0",
-			"-t", strconv.Itoa(duration),
-			"-ar", "44100",
-			"-ac", "1",
-			outputPath,
-		}
-	case "linux":
-		args = []string{
-			"-f", "pulse",
-			"-i", "default",
-			"-t", strconv.Itoa(duration),
-			"-ar", "44100",
-			"-ac", "1",
-			outputPath,
-		}
-	default:
-		return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
-	}
-
-	cmd := exec.Command("ffmpeg", args...)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("ffmpeg recording failed: %w, stderr: %s", err, stderr.String())
+// receiveVoice stores a received clip, however it arrived, and adds an entry for it to the
+// conversation. It is only played straight away with -autoplay, and then in the background, so
+// the event loop never waits for a clip. A direct message goes in the sender's conversation,
+// like a direct text message.
+func (vm *VoiceMessageManager) receiveVoice(senderID string, audioData []byte, duration int, format string, direct bool) {
+	stored, err := vm.storeVoiceMessage(senderID, audioData, duration, format, direct)
+	if err != nil {
+		log.Printf("Failed to store voice message from %s: %v", senderID, err)
+		vm.node.notifyUI(Message{
+			SenderID:     "System",
+			Content:      []byte(fmt.Sprintf("❌ Voice message from %s couldn't be saved: %v", senderID, err)),
+			Conversation: stored.conversation(),
+		})
+		return
 	}
 
-	return nil
-}
-
-// convertToMP3 converts a WAV file to MP3 using ffmpeg
-func (vm *VoiceMessageManager) convertToMP3(wavPath, mp3Path string) error {
-	cmd := exec.Command("ffmpeg",
-		"-i", wavPath,
-		"-codec:a", "libmp3lame",
-		"-qscale:a", "2",
-		mp3Path,
-	)
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("ffmpeg conversion failed: %w, stderr: %s", err, stderr.String())
+	vm.node.notifyUI(Message{
+		SenderID: senderID,
+		Content: []byte(fmt.Sprintf("🎙️ Voice message #%d (%s): /play %d · saved as %s",
+			stored.ID, stored.summary(), stored.ID, stored.Path)),
+		Direct: direct,
+	})
+	vm.transcribe(stored)
+	if vm.autoplay {
+		go vm.play(stored)
 	}
-
-	return nil
 }
 
 // playVoiceMessage plays a voice message using the beep library
 func (vm *VoiceMessageManager) playVoiceMessage(audioData []byte, format string) error {
-	// Initialise speaker once
-	vm.speakerInitOnce.Do(func() {
-		sampleRate := beep.SampleRate(44100)
-		vm.speakerInitErr = speaker.Init(sampleRate, sampleRate.N(time.Second/10))
-	})
-
-	if vm.speakerInitErr != nil {
-		return fmt.Errorf("failed to initialise speaker: %w", vm.speakerInitErr)
+	if err := vm.initSpeaker(); err != nil {
+		return fmt.Errorf("%w (%v); the clip is saved in %s", errNoAudioOutput, err, vm.voiceDir)
 	}
 
 	// Create a reader from audio data
@@ -244,12 +313,13 @@ func (vm *VoiceMessageManager) playVoiceMessage(audioData []byte, format string)
 	}
 	defer streamer.Close()
 
-	// Resample if necessary
-	resampled := beep.Resample(4, streamFormat.SampleRate, beep.SampleRate(44100), streamer)
+	// Resample to the speaker's rate, with the volume and speed settings applied
+	playing := vm.startPlayback(streamer, streamFormat.SampleRate)
+	defer vm.stopPlayback()
 
 	// Play audio
 	done := make(chan bool)
-	speaker.Play(beep.Seq(resampled, beep.Callback(func() {
+	speaker.Play(beep.Seq(playing, beep.Callback(func() {
 		done <- true
 	})))
 
@@ -260,66 +330,95 @@ func (vm *VoiceMessageManager) playVoiceMessage(audioData []byte, format string)
 
 // broadcastVoiceMessage encrypts and sends a voice message to all peers
 func (vm *VoiceMessageManager) broadcastVoiceMessage(voiceMsg VoiceMessage) error {
-	// Marshal voice message
 	data, err := json.Marshal(voiceMsg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal voice message: %w", err)
 	}
+	return vm.sender.broadcastEncrypted(data, "voice")
+}
 
-	// Broadcast to all connected peers
-	vm.node.peersMutex.RLock()
-	defer vm.node.peersMutex.RUnlock()
-
-	var lastError error
-	for peerID, peer := range vm.node.Peers {
-		// Encrypt message for this specific peer
-		encryptedMsg, err := vm.crypto.EncryptMessage(peerID, data, "voice")
-		if err != nil {
-			log.Printf("Failed to encrypt voice message for %s: %v", peerID, err)
-			lastError = err
-			continue
-		}
-
-		// Serialize encrypted message
-		encryptedData, err := json.Marshal(encryptedMsg)
-		if err != nil {
-			log.Printf("Failed to serialize voice message for %s: %v", peerID, err)
-			lastError = err
-			continue
-		}
+// sendVoiceMessageTo encrypts and sends a voice message to a single peer
+func (vm *VoiceMessageManager) sendVoiceMessageTo(peerID string, voiceMsg VoiceMessage) error {
+	data, err := json.Marshal(voiceMsg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal voice message: %w", err)
+	}
+	return vm.sender.sendEncryptedTo(peerID, data, "voice")
+}
 
-		// Format as network message
-		networkMsg := fmt.Sprintf("%s%c%s", vm.node.ID, delimiter, string(encryptedData))
+// sendVoiceTransfer sends a clip as a chunked transfer to peerID, or to every peer if peerID is ""
+func (vm *VoiceMessageManager) sendVoiceTransfer(peerID string, audioData []byte, format string, duration int) error {
+	if peerID != "" {
+		return vm.files.SendVoice(peerID, audioData, format, duration, true)
+	}
 
-		// Send to peer
-		select {
-		case peer.Send <- []byte(networkMsg):
-			// Message sent successfully
-		default:
-			log.Printf("Failed to send voice message to %s: channel full", peerID)
-			lastError = fmt.Errorf("channel full for %s", peerID)
+	var failed []*PeerError
+	peers := vm.node.snapshotPeers()
+	for _, peer := range peers {
+		if err := vm.files.SendVoice(peer.ID, audioData, format, duration, false); err != nil {
+			log.Printf("Failed to send voice message to %s: %v", peer.ID, err)
+			failed = append(failed, &PeerError{Peer: peer.ID, Err: err})
 		}
 	}
+	return newBroadcastError(len(peers), failed)
+}
 
-	return lastError
+// receiveVoiceTransfer handles a voice message that arrived as a chunked transfer
+func (en *EnhancedNode) receiveVoiceTransfer(senderID string, audioData []byte, duration int, format string, direct bool) {
+	log.Printf("Received voice message from %s (duration: %d seconds)", senderID, duration)
+	if en.shouldSuppress(senderID, "") {
+		return
+	}
+	en.voiceManager.receiveVoice(senderID, audioData, duration, format, direct)
 }
 
-// HandleCLICommand processes voice-related CLI commands
-func (vm *VoiceMessageManager) HandleCLICommand(command string) {
-	parts := strings.Fields(command)
-	if len(parts) < 2 {
-		log.Println("Usage: /voice <duration_in_seconds> (1-60)")
+// handleVoiceCommand processes /voice <seconds> [peer]. Without a peer the message goes to everyone.
+func (en *EnhancedNode) handleVoiceCommand(args string) {
+	fields := strings.Fields(args)
+	if len(fields) < 1 || len(fields) > 2 {
+		en.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("Usage: /voice <seconds> [peer] (1-60 seconds)"),
+		})
 		return
 	}
 
-	durationStr := parts[1]
-	if err := vm.RecordVoiceMessage(durationStr); err != nil {
-		log.Printf("Failed to record voice message: %v", err)
-		if vm.node.uiChannel != nil {
-			vm.node.uiChannel <- Message{
+	nodeID, recipient := "", ""
+	if len(fields) == 2 {
+		_, resolved, err := en.resolvePeerRef(fields[1])
+		if err != nil {
+			en.notifyUI(Message{
 				SenderID: "System",
-				Content:  []byte(fmt.Sprintf("❌ Failed to record voice message: %v", err)),
-			}
+				Content:  []byte(fmt.Sprintf("❌ Can't send a voice message to %s: %v", fields[1], err)),
+			})
+			return
+		}
+		if en.refuseWithout(resolved, capabilityVoice, "send a voice message to") {
+			return
 		}
+		nodeID, recipient = resolved, en.peerLabel(resolved)
+		if en.lacksCapability(resolved, capabilityVoicePlayback) {
+			recipient += ", which has no audio output and will only keep it"
+		}
+	} else {
+		recipient = fmt.Sprintf("everyone (%d connected)", len(en.snapshotPeers()))
+		if lacking := en.peersLacking(capabilityVoice, false); len(lacking) > 0 {
+			recipient += fmt.Sprintf("; %s can't receive it", strings.Join(lacking, ", "))
+		}
+	}
+
+	sent, err := en.voiceManager.RecordVoiceMessage(fields[0], nodeID)
+	if !sentToAny(err) {
+		en.notifySendError("Voice message", err)
+		return
+	}
+	en.notifyUI(Message{
+		SenderID: en.ID,
+		Content:  []byte(fmt.Sprintf("🎙️ Voice message (%s) sent to %s", sent.summary(), recipient)),
+		Direct:   nodeID != "",
+		To:       nodeID,
+	})
+	if err != nil {
+		en.notifySendError("Voice message", err)
 	}
 }
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/effects"
+	"github.com/faiface/beep/speaker"
+)
+
+const (
+	playbackSampleRate = beep.SampleRate(44100) // Rate the speaker is opened at
+	defaultVolume      = 100
+)
+
+// playbackSpeeds are the speeds /speed accepts
+var playbackSpeeds = []float64{1.0, 1.5, 2.0}
+
+// PlaybackInfo is the voice playback state, shown in the TUI status bar while a clip plays
+type PlaybackInfo struct {
+	Playing bool    `json:"playing"`
+	Volume  int     `json:"volume"` // 0-100
+	Muted   bool    `json:"muted"`
+	Speed   float64 `json:"speed"`
+}
+
+// activePlayback holds the effects of the clip being played, so settings apply to it straight away
+type activePlayback struct {
+	resampler *beep.Resampler
+	volume    *effects.Volume
+	ratio     float64 // Resampling ratio at normal speed
+}
+
+// apply sets the effects of a playing clip from the settings. The caller holds the speaker lock.
+func (playback *activePlayback) apply(info PlaybackInfo) {
+	playback.resampler.SetRatio(playback.ratio * info.Speed)
+	playback.volume.Silent = info.Muted || info.Volume == 0
+	if info.Volume > 0 {
+		// The volume effect works in powers of Base; 100 is unchanged and 50 is half the amplitude
+		playback.volume.Volume = math.Log2(float64(info.Volume) / 100)
+	}
+}
+
+// startPlayback wraps a decoded clip in the resampler and volume effects and registers it as the
+// clip being played
+func (vm *VoiceMessageManager) startPlayback(streamer beep.Streamer, sampleRate beep.SampleRate) beep.Streamer {
+	ratio := float64(sampleRate) / float64(playbackSampleRate)
+	playback := &activePlayback{
+		resampler: beep.ResampleRatio(4, ratio, streamer),
+		ratio:     ratio,
+	}
+	playback.volume = &effects.Volume{Streamer: playback.resampler, Base: 2}
+
+	vm.playbackMutex.Lock()
+	defer vm.playbackMutex.Unlock()
+	playback.apply(vm.playback)
+	vm.playing = playback
+	vm.playback.Playing = true
+	return playback.volume
+}
+
+// stopPlayback forgets the clip that finished playing
+func (vm *VoiceMessageManager) stopPlayback() {
+	vm.playbackMutex.Lock()
+	defer vm.playbackMutex.Unlock()
+	vm.playing = nil
+	vm.playback.Playing = false
+}
+
+// Playback returns the playback settings and whether a clip is playing
+func (vm *VoiceMessageManager) Playback() PlaybackInfo {
+	vm.playbackMutex.Lock()
+	defer vm.playbackMutex.Unlock()
+	return vm.playback
+}
+
+// SetPlayback changes the playback settings, including for a clip that is already playing
+func (vm *VoiceMessageManager) SetPlayback(volume int, muted bool, speed float64) {
+	vm.playbackMutex.Lock()
+	defer vm.playbackMutex.Unlock()
+
+	vm.playback.Volume = min(max(volume, 0), 100)
+	vm.playback.Muted = muted
+	vm.playback.Speed = speed
+	if vm.playing != nil {
+		speaker.Lock()
+		vm.playing.apply(vm.playback)
+		speaker.Unlock()
+	}
+}
+
+// applyPlaybackConfig takes the playback settings from the config file
+func (vm *VoiceMessageManager) applyPlaybackConfig(config *Config) {
+	volume := defaultVolume
+	if config.Volume != nil {
+		volume = *config.Volume
+	}
+	speed := 1.0
+	if validPlaybackSpeed(config.PlaybackSpeed) {
+		speed = config.PlaybackSpeed
+	}
+	vm.SetPlayback(volume, config.VoiceMuted, speed)
+}
+
+// validPlaybackSpeed reports whether speed is one /speed offers
+func validPlaybackSpeed(speed float64) bool {
+	for _, allowed := range playbackSpeeds {
+		if speed == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// describePlayback summarises the playback settings for command replies
+func describePlayback(info PlaybackInfo) string {
+	volume := fmt.Sprintf("🔊 Volume %d%%", info.Volume)
+	if info.Muted {
+		volume = fmt.Sprintf("🔇 Muted (volume %d%%)", info.Volume)
+	}
+	return fmt.Sprintf("%s, speed %gx", volume, info.Speed)
+}
+
+// savePlayback stores the playback settings in the config file, returning the suffix for the reply
+func (en *EnhancedNode) savePlayback() string {
+	info := en.voiceManager.Playback()
+	volume := info.Volume
+	en.config.Volume = &volume
+	en.config.VoiceMuted = info.Muted
+	en.config.PlaybackSpeed = info.Speed
+	if err := SaveConfig(en.configPath, en.config); err != nil {
+		log.Printf("Failed to save config: %v", err)
+		return fmt.Sprintf(" (not saved: %v)", err)
+	}
+	return ""
+}
+
+// handleVolumeCommand processes /volume [0-100|mute|unmute]; /volume mute toggles
+func (en *EnhancedNode) handleVolumeCommand(args string) {
+	vm := en.voiceManager
+	info := vm.Playback()
+	arg := strings.TrimSpace(args)
+
+	var reply string
+	switch arg {
+	case "":
+		reply = describePlayback(info)
+
+	case "mute", "unmute":
+		muted := arg == "mute" && !info.Muted
+		vm.SetPlayback(info.Volume, muted, info.Speed)
+		reply = describePlayback(vm.Playback()) + en.savePlayback()
+
+	default:
+		volume, err := strconv.Atoi(strings.TrimSuffix(arg, "%"))
+		if err != nil || volume < 0 || volume > 100 {
+			reply = "Usage: /volume <0-100>, /volume mute (toggles) or /volume unmute"
+			break
+		}
+		vm.SetPlayback(volume, info.Muted, info.Speed)
+		reply = describePlayback(vm.Playback()) + en.savePlayback()
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
+
+// handleSpeedCommand processes /speed [1|1.5|2]
+func (en *EnhancedNode) handleSpeedCommand(args string) {
+	vm := en.voiceManager
+	info := vm.Playback()
+	arg := strings.TrimSuffix(strings.TrimSpace(args), "x")
+
+	var reply string
+	if arg == "" {
+		reply = describePlayback(info)
+	} else if speed, err := strconv.ParseFloat(arg, 64); err != nil || !validPlaybackSpeed(speed) {
+		reply = "Usage: /speed <1|1.5|2>"
+	} else {
+		vm.SetPlayback(info.Volume, info.Muted, speed)
+		reply = describePlayback(vm.Playback()) + en.savePlayback()
+	}
+
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
+
+// Playback returns the voice playback state (chatBackend)
+func (en *EnhancedNode) Playback() PlaybackInfo {
+	return en.voiceManager.Playback()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// voiceFileTime is the timestamp format in stored voice message file names
+const voiceFileTime = "20060102-150405"
+
+// voiceFileName matches stored voice messages: voice-<time>-<sender>-<seconds>s.<format>
+var voiceFileName = regexp.MustCompile(`^voice-(\d{8}-\d{6})-(.+)-(\d+)s\.(mp3|wav)$`)
+
+// unsafeFileChars are replaced in the sender part of a stored voice message's file name
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// StoredVoiceMessage is a received voice message saved in the voice directory, waiting for /play
+type StoredVoiceMessage struct {
+	ID       int // Short ID for /play, assigned in order of arrival
+	SenderID string
+	Received time.Time
+	Duration int // Seconds
+	Format   string
+	Size     int64
+	Path     string // Empty for a message we sent, which isn't kept
+	Direct   bool   // Sent to us alone; not known for messages saved by earlier runs
+}
+
+// summary describes a voice message for its chat entry, e.g. "12s, 96.4 KB mp3"
+func (msg StoredVoiceMessage) summary() string {
+	return fmt.Sprintf("%ds, %s %s", msg.Duration, formatBytes(msg.Size), msg.Format)
+}
+
+// conversation is the conversation notices about the message go in: the sender's for a direct
+// message, otherwise the broadcast channel
+func (msg StoredVoiceMessage) conversation() string {
+	if msg.Direct {
+		return msg.SenderID
+	}
+	return broadcastConversation
+}
+
+// loadStoredVoiceMessages finds voice messages saved by earlier runs, oldest first
+func (vm *VoiceMessageManager) loadStoredVoiceMessages() {
+	entries, err := os.ReadDir(vm.voiceDir)
+	if err != nil {
+		return
+	}
+
+	var stored []StoredVoiceMessage
+	for _, entry := range entries {
+		match := voiceFileName.FindStringSubmatch(entry.Name())
+		if match == nil || entry.IsDir() {
+			continue
+		}
+		received, err := time.ParseInLocation(voiceFileTime, match[1], time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		duration, _ := strconv.Atoi(match[3])
+		stored = append(stored, StoredVoiceMessage{
+			SenderID: match[2],
+			Received: received,
+			Duration: duration,
+			Format:   match[4],
+			Size:     info.Size(),
+			Path:     filepath.Join(vm.voiceDir, entry.Name()),
+		})
+	}
+
+	sort.SliceStable(stored, func(i, j int) bool { return stored[i].Received.Before(stored[j].Received) })
+	for i := range stored {
+		stored[i].ID = i + 1
+	}
+	vm.storedMutex.Lock()
+	vm.stored = stored
+	vm.storedMutex.Unlock()
+}
+
+// storeVoiceMessage saves a received clip, named after its sender and arrival time
+func (vm *VoiceMessageManager) storeVoiceMessage(senderID string, audioData []byte, duration int, format string, direct bool) (StoredVoiceMessage, error) {
+	// Failures still say who sent it, so their notice goes in the right conversation
+	failed := StoredVoiceMessage{SenderID: senderID, Direct: direct}
+	if format != "mp3" && format != "wav" {
+		return failed, fmt.Errorf("unsupported audio format: %s", format)
+	}
+
+	if duration < 0 {
+		duration = 0
+	}
+	received := time.Now()
+	name := fmt.Sprintf("voice-%s-%s-%ds.%s", received.Format(voiceFileTime),
+		unsafeFileChars.ReplaceAllString(senderID, "_"), duration, format)
+	path := filepath.Join(vm.voiceDir, name)
+	if err := os.WriteFile(path, audioData, 0600); err != nil {
+		return failed, fmt.Errorf("failed to save voice message: %w", err)
+	}
+
+	vm.storedMutex.Lock()
+	defer vm.storedMutex.Unlock()
+	msg := StoredVoiceMessage{
+		ID:       len(vm.stored) + 1,
+		SenderID: senderID,
+		Received: received,
+		Duration: duration,
+		Format:   format,
+		Size:     int64(len(audioData)),
+		Path:     path,
+		Direct:   direct,
+	}
+	vm.stored = append(vm.stored, msg)
+	return msg, nil
+}
+
+// StoredVoiceMessages returns the saved voice messages, oldest first
+func (vm *VoiceMessageManager) StoredVoiceMessages() []StoredVoiceMessage {
+	vm.storedMutex.Lock()
+	defer vm.storedMutex.Unlock()
+	return append([]StoredVoiceMessage(nil), vm.stored...)
+}
+
+// findStoredVoiceMessage looks up a saved voice message by ID, or the newest one for "last"
+func (vm *VoiceMessageManager) findStoredVoiceMessage(ref string) (StoredVoiceMessage, error) {
+	vm.storedMutex.Lock()
+	defer vm.storedMutex.Unlock()
+
+	if len(vm.stored) == 0 {
+		return StoredVoiceMessage{}, fmt.Errorf("no voice messages received yet")
+	}
+	if ref == "last" {
+		return vm.stored[len(vm.stored)-1], nil
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(ref, "#"))
+	if err != nil || id < 1 || id > len(vm.stored) {
+		return StoredVoiceMessage{}, fmt.Errorf("no voice message %s (see /voicemsgs)", ref)
+	}
+	return vm.stored[id-1], nil
+}
+
+// playStored plays a saved voice message. Clips are played one at a time, in the order asked for.
+func (vm *VoiceMessageManager) playStored(msg StoredVoiceMessage) error {
+	audioData, err := os.ReadFile(msg.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read voice message: %w", err)
+	}
+
+	vm.playMutex.Lock()
+	defer vm.playMutex.Unlock()
+	return vm.playVoiceMessage(audioData, msg.Format)
+}
+
+// HandlePlayCommand processes /play <id|last>. Playback runs in the background so the event
+// loop isn't held up for the length of the clip.
+func (vm *VoiceMessageManager) HandlePlayCommand(args string) {
+	ref := strings.TrimSpace(args)
+	if ref == "" {
+		vm.node.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("Usage: /play <id> or /play last (see /voicemsgs)"),
+		})
+		return
+	}
+
+	msg, err := vm.findStoredVoiceMessage(ref)
+	if err != nil {
+		vm.node.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ %v", err)),
+		})
+		return
+	}
+
+	go vm.play(msg)
+}
+
+// play plays a saved voice message and reports the outcome
+func (vm *VoiceMessageManager) play(msg StoredVoiceMessage) {
+	vm.node.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(fmt.Sprintf("▶️ Playing voice message #%d from %s (%ds)", msg.ID, msg.SenderID, msg.Duration)),
+	})
+	if err := vm.playStored(msg); err != nil {
+		log.Printf("Failed to play voice message #%d: %v", msg.ID, err)
+		vm.node.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte(fmt.Sprintf("❌ Failed to play voice message #%d: %v", msg.ID, err)),
+		})
+	}
+}
+
+// HandleListCommand processes /voicemsgs
+func (vm *VoiceMessageManager) HandleListCommand() {
+	stored := vm.StoredVoiceMessages()
+	if len(stored) == 0 {
+		vm.node.notifyUI(Message{
+			SenderID: "System",
+			Content:  []byte("🎙️ No voice messages received yet"),
+		})
+		return
+	}
+
+	var content strings.Builder
+	content.WriteString("🎙️ Voice messages (/play <id>):")
+	for _, msg := range stored {
+		content.WriteString(fmt.Sprintf("\n  #%-3d %s  %-24s %3ds", msg.ID, msg.Received.Format("2006-01-02 15:04"), msg.SenderID, msg.Duration))
+	}
+	vm.node.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(content.String()),
+	})
+}
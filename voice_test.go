@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCapture is a recorder that returns a tone instead of opening a microphone
+type fakeCapture struct{}
+
+func (fakeCapture) Name() string                    { return "fake" }
+func (fakeCapture) Devices() ([]audioDevice, error) { return nil, nil }
+
+func (fakeCapture) Record(device string, duration int) ([]byte, error) {
+	pcm := make([]byte, duration*voiceSampleRate*2)
+	for i := range pcm {
+		pcm[i] = byte(i * 7)
+	}
+	return pcm, nil
+}
+
+// voiceFrom waits for a voice message from sender to be stored by node and returns it
+func voiceFrom(t *testing.T, node *EnhancedNode, sender string) StoredVoiceMessage {
+	t.Helper()
+	var stored StoredVoiceMessage
+	waitFor(t, "a voice message from "+sender, func() bool {
+		messages := node.voiceManager.StoredVoiceMessages()
+		i := slices.IndexFunc(messages, func(msg StoredVoiceMessage) bool { return msg.SenderID == sender })
+		if i >= 0 {
+			stored = messages[i]
+		}
+		return i >= 0
+	})
+	return stored
+}
+
+// progressEvents waits for a transfer to reach 100% and returns its events up to then
+func progressEvents(t *testing.T, client *eventClient) []Event {
+	t.Helper()
+	var events []Event
+	for {
+		select {
+		case <-client.ready:
+		case <-time.After(testWait):
+			t.Fatalf("transfer stopped after %d events", len(events))
+		}
+		more, dropped := client.take()
+		if dropped > 0 {
+			t.Fatalf("%d transfer events dropped", dropped)
+		}
+		events = append(events, more...)
+		if len(events) > 0 && events[len(events)-1].Data.(TransferInfo).Progress == 100 {
+			return events
+		}
+	}
+}
+
+// TestLongVoiceMessage records a 30-second clip, too large for one message, and sends it to a
+// peer as a chunked voice transfer: it shows as one while under way, and arrives whole in the
+// peer's voice messages rather than its downloads
+func TestLongVoiceMessage(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	a.voiceManager.capture = fakeCapture{}
+	tn.connect(a, b)
+
+	progress := a.events.Subscribe(map[string]bool{eventTransfer: true}, 0)
+	defer a.events.Unsubscribe(progress)
+
+	sent, err := a.voiceManager.RecordVoiceMessage("30", b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Size <= maxInlineVoiceBytes {
+		t.Fatalf("a 30-second clip is %d bytes, small enough to send inline", sent.Size)
+	}
+
+	stored := voiceFrom(t, b, a.ID)
+	if stored.Duration != 30 || stored.Format != sent.Format || stored.Size != sent.Size || !stored.Direct {
+		t.Errorf("b stored %+v, a sent %+v", stored, sent)
+	}
+	data, err := os.ReadFile(stored.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != sent.Size {
+		t.Errorf("b saved %d bytes of a %d-byte clip", len(data), sent.Size)
+	}
+	waitFor(t, "b to announce the voice message", func() bool {
+		return slices.ContainsFunc(loggedTexts(b, a.ID), func(text string) bool { return strings.HasPrefix(text, "🎙️ Voice message #") })
+	})
+	// a showed its progress as it would a file's
+	var percents []int
+	for _, event := range progressEvents(t, progress) {
+		info := event.Data.(TransferInfo)
+		if info.Kind != transferKindVoice || info.PeerID != b.ID || !info.IsOutgoing {
+			t.Errorf("transfer event %+v, want one of a voice transfer to b", info)
+		}
+		percents = append(percents, info.Progress)
+	}
+	if len(percents) < 3 || percents[0] != 0 || percents[len(percents)-1] != 100 || !slices.IsSorted(percents) {
+		t.Errorf("progress went %v, want from 0 to 100 in steps", percents)
+	}
+
+	if downloads, _ := os.ReadDir(filepath.Join(b.dataDir, downloadsDirName)); len(downloads) != 0 {
+		t.Errorf("the voice message went to downloads too: %v", downloads)
+	}
+}
+
+// TestShortVoiceMessage sends a clip small enough for a single message, which takes no transfer
+func TestShortVoiceMessage(t *testing.T) {
+	_, a, b := connectedPair(t)
+
+	clip := bytes.Repeat([]byte("ID3 short clip "), 100)
+	voiceMsg := VoiceMessage{Type: "voice", AudioData: base64.StdEncoding.EncodeToString(clip), Duration: 1, SampleRate: voiceSampleRate, Format: "mp3"}
+	if err := a.voiceManager.sendVoiceMessageTo(b.ID, voiceMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := voiceFrom(t, b, a.ID)
+	if data, err := os.ReadFile(stored.Path); err != nil || !bytes.Equal(data, clip) {
+		t.Errorf("b saved %d bytes (%v), want the %d-byte clip", len(data), err, len(clip))
+	}
+	if transfers := a.Transfers(); len(transfers) != 0 {
+		t.Errorf("a short clip was sent as a transfer: %+v", transfers)
+	}
+}
+
+// TestOversizedVoiceTransferRefused has a peer offer a voice message over the size limit, which
+// is rejected rather than stored
+func TestOversizedVoiceTransferRefused(t *testing.T) {
+	_, a, b := connectedPair(t)
+
+	clip := make([]byte, maxVoiceTransferBytes+1)
+	if err := a.fileManager.SendVoice(b.ID, clip, "wav", 60, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a to hear the voice message was refused", func() bool {
+		return !slices.ContainsFunc(a.Transfers(), func(info TransferInfo) bool { return info.Status == "pending" })
+	})
+	if stored := b.voiceManager.StoredVoiceMessages(); len(stored) != 0 {
+		t.Errorf("b stored an oversized voice message: %+v", stored)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTranscribeTimeout   = 60 * time.Second // Transcription timeout if not configured
+	defaultTranscribeMaxOutput = 4096             // Transcript cap in bytes if not configured
+	maxConcurrentTranscripts   = 2                // Further voice messages wait for a slot
+)
+
+// TranscribeConfig configures a command that transcribes received voice messages. Its stdout is
+// shown after the voice message.
+type TranscribeConfig struct {
+	Command   []string `json:"command"`              // Program and arguments (run directly); {file} is replaced by the clip's path
+	Timeout   string   `json:"timeout,omitempty"`    // e.g. "60s"
+	MaxOutput int      `json:"max_output,omitempty"` // Bytes of transcript kept; the rest is discarded
+}
+
+// voiceTranscriber runs the configured transcription command
+type voiceTranscriber struct {
+	command   []string
+	timeout   time.Duration
+	maxOutput int
+	slots     chan struct{}
+}
+
+// newVoiceTranscriber checks the transcription settings from the config file
+func newVoiceTranscriber(cfg *TranscribeConfig) (*voiceTranscriber, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("transcribe: command is required")
+	}
+
+	timeout := defaultTranscribeTimeout
+	if cfg.Timeout != "" {
+		parsed, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("transcribe: invalid timeout: %w", err)
+		}
+		timeout = parsed
+	}
+
+	maxOutput := cfg.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = defaultTranscribeMaxOutput
+	}
+
+	return &voiceTranscriber{
+		command:   cfg.Command,
+		timeout:   timeout,
+		maxOutput: maxOutput,
+		slots:     make(chan struct{}, maxConcurrentTranscripts),
+	}, nil
+}
+
+// run transcribes a stored voice message, returning the command's output
+func (vt *voiceTranscriber) run(ctx context.Context, msg StoredVoiceMessage) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, vt.timeout)
+	defer cancel()
+
+	args := make([]string, len(vt.command))
+	for i, arg := range vt.command {
+		args[i] = strings.ReplaceAll(arg, "{file}", msg.Path)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"P2PCHAT_SENDER="+msg.SenderID,
+		"P2PCHAT_VOICE_FILE="+msg.Path,
+		"P2PCHAT_VOICE_FORMAT="+msg.Format,
+		"P2PCHAT_VOICE_DURATION="+strconv.Itoa(msg.Duration),
+	)
+
+	var stdout cappedBuffer
+	stdout.limit = vt.maxOutput
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("timed out after %v", vt.timeout)
+		}
+		return "", err
+	}
+
+	if stdout.truncated {
+		log.Printf("Transcript of voice message #%d truncated to %d bytes", msg.ID, vt.maxOutput)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// SetTranscriber sets the transcription command from the config file; nil turns transcription off
+func (vm *VoiceMessageManager) SetTranscriber(cfg *TranscribeConfig) error {
+	var transcriber *voiceTranscriber
+	if cfg != nil {
+		var err error
+		if transcriber, err = newVoiceTranscriber(cfg); err != nil {
+			return err
+		}
+		log.Printf("Transcribing voice messages with %s", cfg.Command[0])
+	}
+
+	vm.storedMutex.Lock()
+	vm.transcriber = transcriber
+	vm.storedMutex.Unlock()
+	return nil
+}
+
+// transcribe runs the transcription command on a received voice message in the background, and
+// shows its output after the message. It does nothing unless a command is configured.
+func (vm *VoiceMessageManager) transcribe(msg StoredVoiceMessage) {
+	vm.storedMutex.Lock()
+	transcriber := vm.transcriber
+	vm.storedMutex.Unlock()
+	if transcriber == nil {
+		return
+	}
+
+	vm.node.wg.Add(1)
+	go func() {
+		defer vm.node.wg.Done()
+
+		select {
+		case transcriber.slots <- struct{}{}:
+		case <-vm.node.Shutdown:
+			return
+		}
+		defer func() { <-transcriber.slots }()
+
+		// Abort the command if the node shuts down first
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-vm.node.Shutdown:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		transcript, err := transcriber.run(ctx, msg)
+		if err != nil {
+			log.Printf("Failed to transcribe voice message #%d: %v", msg.ID, err)
+			vm.node.notifyUI(Message{
+				SenderID:     "System",
+				Content:      []byte(fmt.Sprintf("❌ Couldn't transcribe voice message #%d from %s: %v", msg.ID, msg.SenderID, err)),
+				Conversation: msg.conversation(),
+			})
+			return
+		}
+		if transcript == "" {
+			return
+		}
+
+		vm.node.notifyUI(Message{
+			SenderID:     "System",
+			Content:      []byte(fmt.Sprintf("📝 Voice message #%d from %s: %s", msg.ID, msg.SenderID, transcript)),
+			Conversation: msg.conversation(),
+		})
+	}()
+}
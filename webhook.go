@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	webhookWorkers      = 4                // Concurrent deliveries
+	webhookQueueSize    = 100              // Events buffered before new ones are dropped
+	webhookAttempts     = 3                // Delivery attempts per event
+	webhookRetryDelay   = time.Second      // Base delay between attempts, doubled each retry
+	webhookTimeout      = 10 * time.Second // Per-request timeout
+	webhookLogInterval  = time.Minute      // Failures are logged at most this often
+	webhookSignatureKey = "X-P2PChat-Signature"
+)
+
+// WebhookConfig configures delivery of incoming messages to an HTTP endpoint
+type WebhookConfig struct {
+	URL    string
+	Secret string   // HMAC-SHA256 key for the signature header (unsigned if empty)
+	Peers  []string // Only forward messages from these node IDs (all if empty)
+	Rooms  []string // Only forward messages in these rooms (all messages, rooms or not, if empty)
+}
+
+// WebhookEvent is the JSON body POSTed for each received text message
+type WebhookEvent struct {
+	Sender    string `json:"sender"`
+	Nick      string `json:"nick"`
+	Room      string `json:"room"`
+	Text      string `json:"text"`
+	Timestamp string `json:"timestamp"`
+	MessageID string `json:"message_id"`
+}
+
+// WebhookStats counts webhook deliveries
+type WebhookStats struct {
+	Delivered uint64 `json:"delivered"`
+	Failed    uint64 `json:"failed"`  // Gave up after all attempts
+	Dropped   uint64 `json:"dropped"` // Discarded because the queue was full
+}
+
+// WebhookDispatcher posts events to the webhook from a small worker pool,
+// so a slow endpoint never blocks the event loop
+type WebhookDispatcher struct {
+	config WebhookConfig
+	peers  map[string]bool
+	rooms  map[string]bool
+	client *http.Client
+	queue  chan WebhookEvent
+
+	delivered atomic.Uint64
+	failed    atomic.Uint64
+	dropped   atomic.Uint64
+
+	logLock    sync.Mutex
+	lastLogged time.Time
+}
+
+// NewWebhookDispatcher creates a dispatcher; call Start to begin delivering
+func NewWebhookDispatcher(config WebhookConfig) *WebhookDispatcher {
+	peers := make(map[string]bool)
+	for _, peer := range config.Peers {
+		peers[peer] = true
+	}
+	rooms := make(map[string]bool)
+	for _, room := range config.Rooms {
+		rooms[room] = true
+	}
+
+	return &WebhookDispatcher{
+		config: config,
+		peers:  peers,
+		rooms:  rooms,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan WebhookEvent, webhookQueueSize),
+	}
+}
+
+// Start runs the delivery workers until the node shuts down
+func (wd *WebhookDispatcher) Start(node *Node) {
+	for i := 0; i < webhookWorkers; i++ {
+		node.wg.Add(1)
+		go wd.worker(node)
+	}
+}
+
+// Enqueue queues an event for delivery without blocking; events from filtered peers, or outside
+// the filtered rooms, are ignored
+func (wd *WebhookDispatcher) Enqueue(event WebhookEvent) {
+	if len(wd.peers) > 0 && !wd.peers[event.Sender] {
+		return
+	}
+	if len(wd.rooms) > 0 && !wd.rooms[event.Room] {
+		return
+	}
+
+	select {
+	case wd.queue <- event:
+	default:
+		wd.dropped.Add(1)
+		wd.logFailure("queue full, dropping message %s", event.MessageID)
+	}
+}
+
+// Stats returns the current delivery counters
+func (wd *WebhookDispatcher) Stats() WebhookStats {
+	return WebhookStats{
+		Delivered: wd.delivered.Load(),
+		Failed:    wd.failed.Load(),
+		Dropped:   wd.dropped.Load(),
+	}
+}
+
+func (wd *WebhookDispatcher) worker(node *Node) {
+	defer node.wg.Done()
+
+	for {
+		select {
+		case event := <-wd.queue:
+			wd.deliver(event, node.Shutdown)
+		case <-node.Shutdown:
+			return
+		}
+	}
+}
+
+// deliver posts one event, retrying with backoff
+func (wd *WebhookDispatcher) deliver(event WebhookEvent, shutdown <-chan struct{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		wd.failed.Add(1)
+		wd.logFailure("failed to serialize event: %v", err)
+		return
+	}
+
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = wd.post(body)
+		if err == nil {
+			wd.delivered.Add(1)
+			return
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-shutdown:
+			return
+		}
+	}
+
+	wd.failed.Add(1)
+	wd.logFailure("delivery of message %s failed after %d attempts: %v", event.MessageID, webhookAttempts, err)
+}
+
+func (wd *WebhookDispatcher) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wd.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wd.config.Secret != "" {
+		req.Header.Set(webhookSignatureKey, "sha256="+signWebhookBody(wd.config.Secret, body))
+	}
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// logFailure logs a webhook problem, at most once per webhookLogInterval
+func (wd *WebhookDispatcher) logFailure(format string, args ...interface{}) {
+	wd.logLock.Lock()
+	defer wd.logLock.Unlock()
+
+	if time.Since(wd.lastLogged) < webhookLogInterval {
+		return
+	}
+	wd.lastLogged = time.Now()
+
+	stats := wd.Stats()
+	log.Printf("Webhook: "+format+" (failed: %d, dropped: %d)", append(args, stats.Failed, stats.Dropped)...)
+}
+
+// signWebhookBody returns the hex HMAC-SHA256 of body, sent as "sha256=<hex>" in X-P2PChat-Signature
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
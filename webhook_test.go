@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// webhookEndpoint records what is posted to it, answering with status
+type webhookEndpoint struct {
+	mu         sync.Mutex
+	events     []WebhookEvent
+	bodies     [][]byte
+	signatures []string
+	status     int
+}
+
+func (we *webhookEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var event WebhookEvent
+	json.Unmarshal(body, &event)
+
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	we.events = append(we.events, event)
+	we.bodies = append(we.bodies, body)
+	if signature := r.Header.Get(webhookSignatureKey); signature != "" {
+		we.signatures = append(we.signatures, signature)
+	}
+	w.WriteHeader(we.status)
+}
+
+func (we *webhookEndpoint) received() []WebhookEvent {
+	we.mu.Lock()
+	defer we.mu.Unlock()
+	return append([]WebhookEvent(nil), we.events...)
+}
+
+// TestWebhook posts a received message under the sender's nick, signed with the secret, and
+// counts it delivered
+func TestWebhook(t *testing.T) {
+	endpoint := &webhookEndpoint{status: http.StatusNoContent}
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+
+	tn := newTestNetwork(t, 1)
+	a := tn.nodes[0]
+	a.mentions.Set("alice", nil)
+	b := tn.newNode()
+	b.webhook = NewWebhookDispatcher(WebhookConfig{URL: server.URL, Secret: "s3cret"})
+	b.webhook.Start(b.Node)
+	tn.start(b)
+	tn.connect(a, b)
+	waitFor(t, "b to learn a's nick", func() bool { return b.presence.Nick(a.ID) == "alice" })
+
+	_, err := a.SendEncryptedText("deploy finished")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the webhook to be posted", func() bool { return len(endpoint.received()) == 1 })
+	event := endpoint.received()[0]
+	if event.Sender != a.ID || event.Nick != "alice" || event.Room != "" || event.Text != "deploy finished" || event.MessageID == "" || event.Timestamp == "" {
+		t.Errorf("posted %+v", event)
+	}
+
+	endpoint.mu.Lock()
+	if want := "sha256=" + signWebhookBody("s3cret", endpoint.bodies[0]); len(endpoint.signatures) != 1 || endpoint.signatures[0] != want {
+		t.Errorf("signed %q, want %q", endpoint.signatures, want)
+	}
+	endpoint.mu.Unlock()
+	waitFor(t, "the delivery to be counted", func() bool { return b.webhook.Stats().Delivered == 1 })
+}
+
+// TestWebhookFailures forwards only the configured peers and counts deliveries the endpoint
+// refuses as failed once the retries run out
+func TestWebhookFailures(t *testing.T) {
+	endpoint := &webhookEndpoint{status: http.StatusInternalServerError}
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+
+	node := &Node{Shutdown: make(chan struct{})}
+	dispatcher := NewWebhookDispatcher(WebhookConfig{URL: server.URL, Peers: []string{"alice"}})
+	dispatcher.Start(node)
+	t.Cleanup(func() {
+		close(node.Shutdown)
+		node.wg.Wait()
+	})
+
+	dispatcher.Enqueue(WebhookEvent{Sender: "mallory", Text: "ignored"})
+	dispatcher.Enqueue(WebhookEvent{Sender: "alice", Text: "hello", MessageID: "m1"})
+	waitFor(t, "the delivery to fail", func() bool { return dispatcher.Stats().Failed == 1 })
+
+	received := endpoint.received()
+	if len(received) != webhookAttempts {
+		t.Errorf("posted %d times, want %d", len(received), webhookAttempts)
+	}
+	for _, event := range received {
+		if event.Sender != "alice" {
+			t.Errorf("forwarded a message from %s", event.Sender)
+		}
+	}
+	endpoint.mu.Lock()
+	defer endpoint.mu.Unlock()
+	if len(endpoint.signatures) != 0 {
+		t.Error("signed without a secret")
+	}
+}
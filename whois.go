@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Transports a peer can be connected over, for /whois
+const (
+	transportNoise  = "Noise (" + noiseHello + ")"
+	transportQUIC   = "QUIC (TLS 1.3)"
+	transportLegacy = "legacy (RSA envelopes)"
+)
+
+// WhoisInfo is everything known about a peer, connected or not. It backs /whois and GET /whois.
+type WhoisInfo struct {
+	Query  string `json:"query"`
+	Seen   bool   `json:"seen"` // False if nothing at all is known about the peer
+	NodeID string `json:"node_id,omitempty"`
+
+	Nick     string `json:"nick,omitempty"`
+	Contact  string `json:"contact,omitempty"` // Alias, if the peer's key is pinned to a contact
+	Presence string `json:"presence,omitempty"`
+
+	Fingerprint string         `json:"fingerprint,omitempty"`
+	Key         string         `json:"key"` // KeyNone, KeyExchanged or KeyVerified
+	Reputation  ReputationInfo `json:"reputation"`
+
+	Connected      bool           `json:"connected"`
+	Connection     string         `json:"connection,omitempty"` // Connection ID: the dialled address, or the peer's remote address
+	Outbound       bool           `json:"outbound"`
+	ConnectedSince time.Time      `json:"connected_since,omitzero"`
+	Transport      string         `json:"transport,omitempty"`
+	Capabilities   Capabilities   `json:"capabilities,omitempty"` // Nil if the peer announced none
+	Version        *VersionInfo   `json:"version,omitempty"`      // Nil if the peer announced none
+	Latency        time.Duration  `json:"-"`
+	LatencyMS      float64        `json:"latency_ms,omitempty"`
+	BytesIn        uint64         `json:"bytes_in"`
+	BytesOut       uint64         `json:"bytes_out"`
+	Transfers      []TransferInfo `json:"transfers,omitempty"`
+}
+
+// Whois gathers what the node knows about a peer, named by connection ID, node ID, contact
+// alias or nick
+func (en *EnhancedNode) Whois(ref string) WhoisInfo {
+	info := WhoisInfo{Query: ref, NodeID: ref}
+
+	connID, nodeID, err := en.resolvePeerRef(ref)
+	if err == nil {
+		info.Connected, info.Connection, info.NodeID = true, connID, nodeID
+	} else if contact, exists := en.contacts.Get(ref); exists {
+		info.NodeID, info.Fingerprint = contact.NodeID, contact.Fingerprint
+	} else if byNick, found := en.presence.NodeForNick(ref); found {
+		info.NodeID = byNick
+	}
+
+	if fingerprint, known := en.cryptoManager.PeerFingerprint(info.NodeID); known {
+		info.Fingerprint = fingerprint
+	}
+	if info.Fingerprint != "" {
+		if contact, saved := en.contacts.ForKey(info.Fingerprint); saved {
+			info.Contact = contact.Alias
+		}
+	}
+	info.Key = en.keyStatus(info.NodeID)
+	if info.Fingerprint != "" {
+		info.Reputation = en.reputation.Get(info.Fingerprint)
+	} else {
+		info.Reputation = en.reputation.Get(reputationNodeKeyPrefix + info.NodeID)
+	}
+	info.Nick = en.presence.Nick(info.NodeID)
+	if presence := en.presence.Get(info.NodeID); presence.Status != StatusUnknown {
+		info.Presence = presence.String()
+	}
+
+	known := en.knownAddr(info.NodeID)
+	info.Seen = info.Connected || known || info.Fingerprint != "" || info.Nick != "" || info.Presence != ""
+	if !info.Connected {
+		return info
+	}
+
+	en.peersMutex.RLock()
+	peer, exists := en.conns[connID]
+	en.peersMutex.RUnlock()
+	if exists {
+		info.Outbound, info.ConnectedSince = peer.outbound, peer.connectedAt
+		info.Transport = transportLegacy
+		if ac, ok := peerAuthenticatedConn(peer); ok {
+			info.Transport = transportQUIC
+			if _, noise := ac.(*noiseConn); noise {
+				info.Transport = transportNoise
+			}
+		}
+		if capabilities := peer.capabilities.Load(); capabilities != nil {
+			info.Capabilities = *capabilities
+		}
+		info.Version = peer.version.Load()
+	}
+	info.Latency, _ = en.peerStats.Get(info.NodeID)
+	info.LatencyMS = float64(info.Latency) / float64(time.Millisecond)
+	info.BytesIn, info.BytesOut = en.peerTraffic(connID)
+	for _, transfer := range en.fileManager.ListTransfers() {
+		if transfer.PeerID == connID || transfer.PeerID == info.NodeID {
+			info.Transfers = append(info.Transfers, transfer)
+		}
+	}
+	return info
+}
+
+// String formats the information for /whois
+func (info WhoisInfo) String() string {
+	if !info.Seen {
+		return fmt.Sprintf("👤 %s: never seen (not connected, and no key, contact or nick known)", info.Query)
+	}
+
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("👤 %s", info.NodeID))
+	line := func(label, value string) {
+		if value != "" {
+			content.WriteString(fmt.Sprintf("\n  %-14s %s", label+":", value))
+		}
+	}
+	line("Nick", info.Nick)
+	line("Contact", info.Contact)
+	line("Presence", info.Presence)
+	if info.Fingerprint != "" {
+		line("Key", fmt.Sprintf("%s (%s)", formatFingerprint(info.Fingerprint), info.Key))
+	} else {
+		line("Key", info.Key)
+	}
+	line("Reputation", info.Reputation.String())
+
+	if !info.Connected {
+		line("Connection", "not connected")
+		return content.String()
+	}
+	direction := "incoming"
+	if info.Outbound {
+		direction = "outgoing"
+	}
+	line("Connection", fmt.Sprintf("%s, %s over %s", info.Connection, direction, info.Transport))
+	if !info.ConnectedSince.IsZero() {
+		line("Connected", fmt.Sprintf("since %s (%s)", info.ConnectedSince.Format("15:04:05"),
+			time.Since(info.ConnectedSince).Round(time.Second)))
+	}
+	if info.Capabilities != nil {
+		line("Capabilities", info.Capabilities.String())
+	} else {
+		line("Capabilities", "not announced (an older version)")
+	}
+	if info.Version != nil {
+		line("Version", info.Version.String())
+	} else {
+		line("Version", "not announced (an older version)")
+	}
+	if info.Latency > 0 {
+		line("Latency", info.Latency.Round(time.Millisecond).String())
+	} else {
+		line("Latency", "not measured yet")
+	}
+	line("Traffic", fmt.Sprintf("↓%s ↑%s", formatBytes(int64(info.BytesIn)), formatBytes(int64(info.BytesOut))))
+	if len(info.Transfers) == 0 {
+		line("Transfers", "none")
+	}
+	for _, transfer := range info.Transfers {
+		direction := "⬇️"
+		if transfer.IsOutgoing {
+			direction = "⬆️"
+		}
+		line("Transfer", fmt.Sprintf("%s %s (%s, %d/%d chunks, %s)", direction, transfer.FileName,
+			formatBytes(transfer.FileSize), transfer.Progress, transfer.TotalChunks, transfer.Status))
+	}
+	return content.String()
+}
+
+// handleWhoisCommand processes /whois <peer>
+func (en *EnhancedNode) handleWhoisCommand(args string) {
+	ref := strings.TrimSpace(args)
+	reply := "Usage: /whois <peer>"
+	if ref != "" {
+		reply = en.Whois(ref).String()
+	}
+	en.notifyUI(Message{
+		SenderID: "System",
+		Content:  []byte(reply),
+	})
+}
+
+// handleWhois serves GET /whois?peer=<peer>
+func (api *APIServer) handleWhois(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	ref := strings.TrimSpace(r.URL.Query().Get("peer"))
+	if ref == "" {
+		writeAPIError(w, http.StatusBadRequest, "peer is required")
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, api.node.Whois(ref))
+}
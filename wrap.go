@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/rivo/uniseg"
+)
+
+// minWrapWidth is the narrowest a message is wrapped to. When the sender prefix leaves less room
+// than this, the content starts on the line below it instead.
+const minWrapWidth = 12
+
+// urlPattern finds links in message text; trailing punctuation is trimmed off by findURLs
+var urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// textSpan is a byte range of message text that is rendered specially
+type textSpan struct {
+	start, end int
+	link       string     // Target of a URL; empty otherwise
+	format     textFormat // Inline formatting; formatNone for URLs and search matches
+}
+
+// findURLs returns the URLs in text. Punctuation that ends a sentence isn't part of a URL, and
+// neither is a closing bracket without an opening one inside the URL.
+func findURLs(text string) []textSpan {
+	var spans []textSpan
+	for _, loc := range urlPattern.FindAllStringIndex(text, -1) {
+		url := text[loc[0]:loc[1]]
+		for url != "" {
+			last := url[len(url)-1]
+			if strings.IndexByte(".,;:!?'", last) >= 0 ||
+				(last == ')' && strings.Count(url, "(") < strings.Count(url, ")")) ||
+				(last == ']' && strings.Count(url, "[") < strings.Count(url, "]")) {
+				url = url[:len(url)-1]
+				continue
+			}
+			break
+		}
+		link := url
+		if !strings.Contains(strings.ToLower(link), "://") {
+			link = "https://" + link
+		}
+		if len(url) > len("www.") {
+			spans = append(spans, textSpan{start: loc[0], end: loc[0] + len(url), link: link})
+		}
+	}
+	return spans
+}
+
+// supportsHyperlinks guesses whether the terminal makes OSC 8 hyperlinks clickable. Terminals that
+// don't understand them may print them, so only known ones get them. FORCE_HYPERLINK=1 or 0
+// overrides the guess.
+func supportsHyperlinks() bool {
+	if force, ok := os.LookupEnv("FORCE_HYPERLINK"); ok {
+		return force != "0"
+	}
+	switch os.Getenv("TERM_PROGRAM") {
+	case "iTerm.app", "WezTerm", "vscode", "ghostty", "Hyper", "Tabby":
+		return true
+	}
+	if vte, err := strconv.Atoi(os.Getenv("VTE_VERSION")); err == nil && vte >= 5000 {
+		return true
+	}
+	if os.Getenv("WT_SESSION") != "" || os.Getenv("KONSOLE_VERSION") != "" || os.Getenv("KITTY_WINDOW_ID") != "" {
+		return true
+	}
+	term := os.Getenv("TERM")
+	return strings.Contains(term, "kitty") || strings.Contains(term, "foot") || strings.Contains(term, "alacritty")
+}
+
+// hyperlink makes text a clickable OSC 8 link to target
+func hyperlink(target, text string) string {
+	return "\x1b]8;;" + target + "\x1b\\" + text + "\x1b]8;;\x1b\\"
+}
+
+// wrapRanges splits text into lines at most width cells wide, breaking at spaces where it can and
+// inside words too long for a line. Newlines always break. It returns the byte range of each line;
+// the space a line is broken at belongs to neither line.
+func wrapRanges(text string, width int) [][2]int {
+	var lines [][2]int
+	start, lineWidth := 0, 0
+	lastSpace := -1 // Where the last space on the line is, the place to break it
+	state := -1
+	for pos := 0; pos < len(text); {
+		cluster, rest, clusterWidth, newState := uniseg.FirstGraphemeClusterInString(text[pos:], state)
+		state = newState
+		next := len(text) - len(rest)
+
+		switch {
+		case cluster == "\n" || cluster == "\r\n":
+			lines = append(lines, [2]int{start, pos})
+			start, lineWidth, lastSpace = next, 0, -1
+		case cluster == " ":
+			if lineWidth+clusterWidth > width {
+				lines = append(lines, [2]int{start, pos})
+				start, lineWidth, lastSpace = next, 0, -1
+			} else {
+				lastSpace = pos
+				lineWidth += clusterWidth
+			}
+		case lineWidth+clusterWidth > width && lineWidth > 0:
+			if lastSpace >= 0 {
+				// Move the word being written to the next line
+				lines = append(lines, [2]int{start, lastSpace})
+				start = lastSpace + 1
+			} else {
+				// A word longer than a line is cut where the line ends
+				lines = append(lines, [2]int{start, pos})
+				start = pos
+			}
+			lineWidth, lastSpace = uniseg.StringWidth(text[start:pos])+clusterWidth, -1
+		default:
+			lineWidth += clusterWidth
+		}
+		pos = next
+	}
+	return append(lines, [2]int{start, len(text)})
+}
+
+// renderContent renders message content after its prefix, wrapped to the viewport with the
+// further lines indented under the first. URLs are underlined (and clickable where the terminal
+// supports it) and search matches are highlighted; everything else is rendered with render, or
+// left as it is when render is nil. With markdown, the content's formatting and code blocks are
+// rendered too, unless the user turned that off. suffix goes at the end of the last line.
+func (ui *UI) renderContent(prefix, content string, render func(...string) string, current, markdown bool, suffix string) string {
+	if render == nil {
+		render = func(strs ...string) string { return strs[0] }
+	}
+
+	indent := lipgloss.Width(prefix)
+	width := ui.viewport.Width - indent - lipgloss.Width(suffix)
+	if width < minWrapWidth {
+		// Too narrow beside the prefix: start below it with a small indent
+		prefix += "\n  "
+		indent = 2
+		width = max(ui.viewport.Width-indent-lipgloss.Width(suffix), 1)
+	}
+
+	blocks := []messageBlock{{text: content}}
+	if markdown && !ui.plainText && canStyle() {
+		blocks = parseMessage(content)
+	}
+	var rendered []string
+	for _, block := range blocks {
+		if block.code {
+			rendered = append(rendered, ui.renderCodeBlock(block.text, width, current)...)
+			continue
+		}
+		urls := findURLs(block.text)
+		matches := ui.searchSpans(block.text)
+		for _, line := range wrapRanges(block.text, width) {
+			rendered = append(rendered, ui.renderSpans(block.text, line[0], line[1], urls, matches, block.formats, render, current))
+		}
+	}
+	return prefix + strings.Join(rendered, "\n"+strings.Repeat(" ", indent)) + suffix
+}
+
+// renderSpans renders text[start:end], styling the parts inside URLs, search matches and inline
+// formatting
+func (ui *UI) renderSpans(text string, start, end int, urls, matches, formats []textSpan, render func(...string) string, current bool) string {
+	matchStyle := searchMatchStyle
+	if current {
+		matchStyle = currentMatchStyle
+	}
+
+	var out strings.Builder
+	for pos := start; pos < end; {
+		// The piece runs up to the next place a URL, match or formatting starts or ends
+		next := end
+		url, inURL := spanAt(urls, pos, &next)
+		_, inMatch := spanAt(matches, pos, &next)
+		format, _ := spanAt(formats, pos, &next)
+
+		piece := text[pos:next]
+		switch {
+		case inMatch:
+			piece = matchStyle.Render(piece)
+		case format.format == formatCode:
+			piece = codeStyle.Render(piece)
+		case inURL:
+			piece = linkStyle.Render(piece)
+		default:
+			piece = render(piece)
+		}
+		switch format.format {
+		case formatBold:
+			piece = lipgloss.NewStyle().Bold(true).Render(piece)
+		case formatItalic:
+			piece = lipgloss.NewStyle().Italic(true).Render(piece)
+		}
+		if inURL && ui.hyperlinks {
+			piece = hyperlink(url.link, piece)
+		}
+		out.WriteString(piece)
+		pos = next
+	}
+	return out.String()
+}
+
+// spanAt returns the span containing pos, if any, and pulls next back to where the span ends or
+// the next span starts
+func spanAt(spans []textSpan, pos int, next *int) (textSpan, bool) {
+	var found textSpan
+	inside := false
+	for _, span := range spans {
+		switch {
+		case span.start <= pos && pos < span.end:
+			found, inside = span, true
+			*next = min(*next, span.end)
+		case span.start > pos:
+			*next = min(*next, span.start)
+		}
+	}
+	return found, inside
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// wrapLines is wrapRanges as the lines of text themselves
+func wrapLines(text string, width int) []string {
+	var lines []string
+	for _, line := range wrapRanges(text, width) {
+		lines = append(lines, text[line[0]:line[1]])
+	}
+	return lines
+}
+
+// TestWrapRanges breaks text at spaces where it can, inside words too long for a line, and at
+// newlines, counting wide characters as the two cells they take
+func TestWrapRanges(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		text  string
+		width int
+		want  []string
+	}{
+		{"fits", "hello world", 20, []string{"hello world"}},
+		{"exactly", "hello world", 11, []string{"hello world"}},
+		{"at a space", "hello world", 10, []string{"hello", "world"}},
+		{"several lines", "the quick brown fox jumps", 10, []string{"the quick", "brown fox", "jumps"}},
+		{"newlines", "one\ntwo\r\nthree", 20, []string{"one", "two", "three"}},
+		{"blank line", "one\n\ntwo", 20, []string{"one", "", "two"}},
+		{"long token", "aGVsbG8gd29ybGQ=", 5, []string{"aGVsb", "G8gd2", "9ybGQ", "="}},
+		{"long token after a word", "see aGVsbG8gd29ybGQ=", 8, []string{"see", "aGVsbG8g", "d29ybGQ="}},
+		{"one cell", "ab c", 1, []string{"a", "b", "c"}},
+		{"emoji", "hi 👋 👋👋👋", 5, []string{"hi 👋", "👋👋", "👋"}},
+		{"emoji wider than the line", "👋👋", 1, []string{"👋", "👋"}},
+		{"zwj family", "👨‍👩‍👧‍👦 family", 8, []string{"👨‍👩‍👧‍👦", "family"}},
+		{"cjk", "你好世界你好", 5, []string{"你好", "世界", "你好"}},
+		{"combining accent", "café café", 4, []string{"café", "café"}},
+		{"empty", "", 10, []string{""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := wrapLines(tc.text, tc.width); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tc.want) {
+				t.Errorf("wrapped to %d: %q, want %q", tc.width, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestWrapRangesKeepsText wraps a mix of scripts, emoji and long tokens at every narrow width:
+// no line is wider than asked unless it holds a single character wider still, and only the
+// spaces and newlines broken at go missing
+func TestWrapRangesKeepsText(t *testing.T) {
+	text := "Links like https://example.com/a/very/long/path?with=query 👍 and 你好 from 👨‍👩‍👧‍👦\nthen YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXo="
+	for width := 1; width <= 30; width++ {
+		lines := wrapLines(text, width)
+		for _, line := range lines {
+			if w := lipgloss.Width(line); w > width && w > 2 {
+				t.Errorf("width %d: line %q is %d cells", width, line, w)
+			}
+		}
+		if got, want := strings.Join(lines, ""), strings.NewReplacer(" ", "", "\n", "").Replace(text); strings.NewReplacer(" ", "").Replace(got) != want {
+			t.Errorf("width %d lost text: %q", width, lines)
+		}
+	}
+}
+
+// TestFindURLs finds links without the punctuation that ends the sentence around them
+func TestFindURLs(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want []string // Each as "text -> link"
+	}{
+		{"no links here", nil},
+		{"see https://example.com.", []string{"https://example.com -> https://example.com"}},
+		{"(https://example.com/a)", []string{"https://example.com/a -> https://example.com/a"}},
+		{"https://en.wikipedia.org/wiki/Go_(programming_language)!", []string{
+			"https://en.wikipedia.org/wiki/Go_(programming_language) -> https://en.wikipedia.org/wiki/Go_(programming_language)",
+		}},
+		{"[http://a.example]", []string{"http://a.example -> http://a.example"}},
+		{"try www.example.com, or HTTPS://EXAMPLE.ORG?", []string{
+			"www.example.com -> https://www.example.com",
+			"HTTPS://EXAMPLE.ORG -> HTTPS://EXAMPLE.ORG",
+		}},
+		{"a bare www. isn't one", nil},
+		{`<https://example.com/x>"quoted"`, []string{"https://example.com/x -> https://example.com/x"}},
+	} {
+		var got []string
+		for _, span := range findURLs(tc.text) {
+			got = append(got, tc.text[span.start:span.end]+" -> "+span.link)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("findURLs(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+// TestRenderContent wraps a message beside its prefix with the further lines indented under the
+// first, or starts it below the prefix when there's no room, and links it where the terminal can
+func TestRenderContent(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		viewport   int
+		hyperlinks bool
+		want       string
+	}{
+		{"beside the prefix", 30, false, "[alice] read https://x.io/a\n        and reply"},
+		{"below the prefix", 18, false, "[alice] \n  read\n  https://x.io/a\n  and reply"},
+		{"hyperlinks", 30, true, "[alice] read \x1b]8;;https://x.io/a\x1b\\https://x.io/a\x1b]8;;\x1b\\\n        and reply"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ui, _ := newTestUI(t, 80, 24)
+			ui.viewport.Width = tc.viewport
+			ui.hyperlinks = tc.hyperlinks
+			got := ui.renderContent("[alice] ", "read https://x.io/a and reply", nil, false, false, "")
+			if plain := stripANSIKeepOSC8(got); plain != tc.want {
+				t.Errorf("rendered %q, want %q", plain, tc.want)
+			}
+			for _, line := range strings.Split(got, "\n") {
+				if w := lipgloss.Width(line); w > tc.viewport {
+					t.Errorf("line %q is %d cells, over the viewport's %d", line, w, tc.viewport)
+				}
+			}
+		})
+	}
+}
+
+// stripANSIKeepOSC8 removes SGR styling, leaving text and OSC 8 hyperlinks
+func stripANSIKeepOSC8(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '[' {
+			for i += 2; i < len(s) && (s[i] < '@' || s[i] > '~'); i++ {
+			}
+			continue
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+// TestSupportsHyperlinks detects terminals known to make OSC 8 links clickable, with
+// FORCE_HYPERLINK overriding the guess either way
+func TestSupportsHyperlinks(t *testing.T) {
+	for _, tc := range []struct {
+		env  map[string]string
+		want bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"TERM": "xterm-256color"}, false},
+		{map[string]string{"TERM_PROGRAM": "WezTerm"}, true},
+		{map[string]string{"TERM": "xterm-kitty"}, true},
+		{map[string]string{"VTE_VERSION": "4800"}, false},
+		{map[string]string{"VTE_VERSION": "6003"}, true},
+		{map[string]string{"WT_SESSION": "1"}, true},
+		{map[string]string{"FORCE_HYPERLINK": "1"}, true},
+		{map[string]string{"FORCE_HYPERLINK": "0", "TERM_PROGRAM": "iTerm.app"}, false},
+	} {
+		for _, name := range []string{"FORCE_HYPERLINK", "TERM_PROGRAM", "VTE_VERSION", "WT_SESSION", "KONSOLE_VERSION", "KITTY_WINDOW_ID", "TERM"} {
+			t.Setenv(name, tc.env[name])
+		}
+		if tc.env["FORCE_HYPERLINK"] == "" {
+			unsetenv(t, "FORCE_HYPERLINK") // Set but empty still counts as forcing
+		}
+		if got := supportsHyperlinks(); got != tc.want {
+			t.Errorf("with %v: %v, want %v", tc.env, got, tc.want)
+		}
+	}
+}
+
+// unsetenv unsets an environment variable until the test ends
+func unsetenv(t *testing.T, name string) {
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}